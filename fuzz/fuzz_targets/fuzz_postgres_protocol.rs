@@ -0,0 +1,9 @@
+#![no_main]
+use libfuzzer_sys::fuzz_target;
+use yamlbase_fuzz::{exchange, WireProtocol};
+
+fuzz_target!(|data: &[u8]| {
+    // Feed raw bytes to the PostgreSQL handler as the client side of a
+    // connection: startup packet, authentication and then the message loop
+    exchange(WireProtocol::Postgres, data);
+});
@@ -1,14 +1,22 @@
 #![no_main]
 use libfuzzer_sys::fuzz_target;
-use sqlparser::dialect::GenericDialect;
-use sqlparser::parser::Parser;
+use yamlbase::sql::{parse_sql, QueryExecutor};
+use yamlbase_fuzz::{runtime, storage};
 
 fuzz_target!(|data: &[u8]| {
     // Only fuzz valid UTF-8 strings
     if let Ok(query) = std::str::from_utf8(data) {
-        // Try to parse the SQL query
-        let dialect = GenericDialect {};
-        // We don't care about the result, just that it doesn't panic
-        let _ = Parser::parse_sql(&dialect, query);
+        // Parse with the same front end the servers use, then run whatever
+        // parsed against the sample database. Errors are fine; panics are not.
+        let Ok(statements) = parse_sql(query) else {
+            return;
+        };
+        let storage = storage();
+        runtime().block_on(async {
+            let executor = QueryExecutor::new(storage).await.unwrap();
+            for statement in &statements {
+                let _ = executor.execute(statement).await;
+            }
+        });
     }
-});
\ No newline at end of file
+});
@@ -0,0 +1,155 @@
+//! Shared setup for the fuzz targets: a small sample database and a way to
+//! push raw bytes through the real wire protocol handlers.
+
+use clap::Parser;
+use std::sync::{Arc, OnceLock};
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tokio::runtime::Runtime;
+use yamlbase::database::{Database, Storage};
+use yamlbase::protocol::{MySqlProtocol, PostgresProtocol};
+use yamlbase::yaml::parse_yaml_database;
+use yamlbase::Config;
+
+const SAMPLE_DATABASE: &str = r#"
+database:
+  name: "fuzz_db"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "VARCHAR(100) NOT NULL"
+      email: "VARCHAR(255) UNIQUE"
+      active: "BOOLEAN DEFAULT true"
+      created_at: "TIMESTAMP"
+    data:
+      - id: 1
+        name: "Ada"
+        email: "ada@example.com"
+        active: true
+        created_at: "2024-01-01 10:00:00"
+      - id: 2
+        name: "Grace"
+        email: null
+        active: false
+        created_at: "2024-02-01 10:00:00"
+
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      user_id: "INTEGER REFERENCES users(id)"
+      total: "DECIMAL(10,2)"
+    data:
+      - id: 10
+        user_id: 1
+        total: 12.50
+      - id: 11
+        user_id: 1
+        total: 99.99
+"#;
+
+/// How long one fuzz input may keep a connection busy before it is abandoned
+const EXCHANGE_TIMEOUT: Duration = Duration::from_secs(5);
+
+#[derive(Debug, Clone, Copy)]
+pub enum WireProtocol {
+    Postgres,
+    Mysql,
+}
+
+pub fn runtime() -> &'static Runtime {
+    static RUNTIME: OnceLock<Runtime> = OnceLock::new();
+    RUNTIME.get_or_init(|| {
+        tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()
+            .expect("failed to build tokio runtime")
+    })
+}
+
+fn database() -> &'static Database {
+    static DATABASE: OnceLock<Database> = OnceLock::new();
+    DATABASE.get_or_init(|| {
+        let path = std::env::temp_dir().join(format!("yamlbase-fuzz-{}.yaml", std::process::id()));
+        std::fs::write(&path, SAMPLE_DATABASE).expect("failed to write sample database");
+        let (database, _) = runtime()
+            .block_on(parse_yaml_database(&path))
+            .expect("sample database must parse");
+        let _ = std::fs::remove_file(&path);
+        database
+    })
+}
+
+/// A fresh copy of the sample database, so writes made by one input do not
+/// leak into the next
+pub fn storage() -> Arc<Storage> {
+    let _runtime = runtime().enter();
+    Arc::new(Storage::new(database().clone()))
+}
+
+fn config(protocol: WireProtocol) -> Arc<Config> {
+    let protocol = match protocol {
+        WireProtocol::Postgres => "postgres",
+        WireProtocol::Mysql => "mysql",
+    };
+    Arc::new(Config::parse_from([
+        "yamlbase",
+        "-f",
+        "fuzz.yaml",
+        "--protocol",
+        protocol,
+        "-u",
+        "fuzz",
+        "--password",
+        "fuzz",
+    ]))
+}
+
+/// Send `data` to a fresh server connection as a client would, then hang up.
+///
+/// Errors from the handler are expected for garbage input; a panic is not,
+/// and is re-raised so libFuzzer records the input as a crash.
+pub fn exchange(protocol: WireProtocol, data: &[u8]) {
+    let storage = storage();
+    let config = config(protocol);
+
+    runtime().block_on(async move {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        let mut server = tokio::spawn(async move {
+            let (stream, _) = listener.accept().await?;
+            match protocol {
+                WireProtocol::Postgres => {
+                    let mut handler = PostgresProtocol::new(config, storage).await?;
+                    handler.handle_connection(stream).await
+                }
+                WireProtocol::Mysql => {
+                    let handler = MySqlProtocol::new(config, storage).await?;
+                    handler.handle_connection(stream).await
+                }
+            }
+        });
+
+        let client = async {
+            let mut stream = TcpStream::connect(addr).await?;
+            // The server may stop reading halfway through; that is fine
+            let _ = stream.write_all(data).await;
+            let _ = stream.shutdown().await;
+            let mut sink = Vec::new();
+            let _ = stream.read_to_end(&mut sink).await;
+            Ok::<_, std::io::Error>(())
+        };
+        let _ = tokio::time::timeout(EXCHANGE_TIMEOUT, client).await;
+
+        match tokio::time::timeout(EXCHANGE_TIMEOUT, &mut server).await {
+            Ok(Err(join_error)) if join_error.is_panic() => {
+                std::panic::resume_unwind(join_error.into_panic())
+            }
+            Ok(_) => {}
+            Err(_) => server.abort(),
+        }
+    });
+}
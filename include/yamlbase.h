@@ -0,0 +1,41 @@
+/*
+ * The C ABI of libyamlbase, for embedding a yamlbase server in-process.
+ * Build the shared library with `cargo build --release --lib`; see
+ * src/ffi.rs for the full contract of each function.
+ */
+#ifndef YAMLBASE_H
+#define YAMLBASE_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct YamlbaseServer YamlbaseServer;
+
+/*
+ * Serve the yaml_len bytes of YAML at yaml. args is NULL or whitespace
+ * separated yamlbase options such as "--protocol mysql --port 0".
+ * Returns NULL on failure; yamlbase_last_error() tells why.
+ */
+YamlbaseServer *yamlbase_start(const uint8_t *yaml, size_t yaml_len, const char *args);
+
+/* The port the server listens on, which the system picked for --port 0 */
+uint16_t yamlbase_port(const YamlbaseServer *server);
+
+/* Replace the served dataset; returns 0, or -1 and keeps the old one */
+int yamlbase_load(YamlbaseServer *server, const uint8_t *yaml, size_t yaml_len);
+
+/* Stop the server and free it; NULL is ignored */
+void yamlbase_stop(YamlbaseServer *server);
+
+/* Why the last failed call on this thread failed, or NULL */
+const char *yamlbase_last_error(void);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* YAMLBASE_H */
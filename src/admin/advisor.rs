@@ -0,0 +1,17 @@
+//! Endpoints exposing the index advisor's recommendations.
+
+use super::AdminState;
+use super::http::Response;
+
+/// `GET /advisor/indexes` lists recommended indexes, most expensive workload first
+pub(super) async fn index_recommendations(state: &AdminState) -> Response {
+    let db = state.storage.database();
+    let db = db.read().await;
+    Response::json(200, &state.storage.index_advisor().recommendations(&db))
+}
+
+/// `POST /advisor/reset` forgets the observed workload, e.g. between test scenarios
+pub(super) fn reset(state: &AdminState) -> Response {
+    state.storage.index_advisor().reset();
+    Response::json(200, &serde_json::json!({ "reset": true }))
+}
@@ -0,0 +1,57 @@
+//! Endpoints for reading and moving the server clock, to test expiring rows
+//! and other time-dependent logic.
+
+use super::AdminState;
+use super::http::{Request, Response};
+use crate::database::Clock;
+use crate::database::clock::parse_timestamp;
+
+/// `GET /clock` reports the server time and whether it is frozen
+pub(super) fn clock(state: &AdminState) -> Response {
+    clock_response(state.storage.clock())
+}
+
+/// `POST /clock/set?at=2024-01-31T12:00:00` freezes the clock at a time
+pub(super) fn set_clock(state: &AdminState, request: &Request) -> Response {
+    let Some(at) = request.query_param("at") else {
+        return Response::error(400, "Missing at parameter");
+    };
+    match parse_timestamp(at) {
+        Ok(at) => {
+            state.storage.clock().set(at);
+            clock_response(state.storage.clock())
+        }
+        Err(message) => Response::error(400, message),
+    }
+}
+
+/// `POST /clock/advance?duration=15m` moves the clock forward, freezing it
+/// first if it follows the system clock
+pub(super) fn advance_clock(state: &AdminState, request: &Request) -> Response {
+    let Some(duration) = request.query_param("duration") else {
+        return Response::error(400, "Missing duration parameter");
+    };
+    let by = humantime_serde::re::humantime::parse_duration(duration)
+        .map_err(|e| format!("Invalid duration '{}': {}", duration, e))
+        .and_then(|by| {
+            chrono::Duration::from_std(by)
+                .map_err(|_| format!("Duration '{}' is too long", duration))
+        });
+    match by {
+        Ok(by) => {
+            state.storage.clock().advance(by);
+            clock_response(state.storage.clock())
+        }
+        Err(message) => Response::error(400, message),
+    }
+}
+
+fn clock_response(clock: &Clock) -> Response {
+    Response::json(
+        200,
+        &serde_json::json!({
+            "now": clock.now().format("%Y-%m-%d %H:%M:%S").to_string(),
+            "fixed": clock.is_fixed(),
+        }),
+    )
+}
@@ -0,0 +1,49 @@
+//! Endpoints reporting which version of the dataset file is being served.
+
+use super::AdminState;
+use super::http::Response;
+
+/// `GET /dataset` reports the served dataset's checksum and version, which
+/// counts loads including the initial one and grows with every hot reload
+pub(super) async fn dataset(state: &AdminState) -> Response {
+    let db = state.storage.database();
+    let db = db.read().await;
+    Response::json(
+        200,
+        &serde_json::json!({
+            "database": db.name,
+            "checksum": db.checksum,
+            "version": state.storage.dataset_version(),
+            "tables": db.tables.len(),
+        }),
+    )
+}
+
+/// `GET /metrics` publishes the same checksum and version in the Prometheus
+/// text format, so a dashboard or alert can tell which rollout is served
+pub(super) async fn metrics(state: &AdminState) -> Response {
+    let db = state.storage.database();
+    let db = db.read().await;
+    let database = label(&db.name);
+    let body = format!(
+        "# HELP yamlbase_dataset_version Loads of the dataset file, including the initial one\n\
+         # TYPE yamlbase_dataset_version gauge\n\
+         yamlbase_dataset_version{{database=\"{}\"}} {}\n\
+         # HELP yamlbase_dataset_info The SHA-256 checksum of the served dataset file\n\
+         # TYPE yamlbase_dataset_info gauge\n\
+         yamlbase_dataset_info{{database=\"{}\",checksum=\"{}\"}} 1\n",
+        database,
+        state.storage.dataset_version(),
+        database,
+        label(db.checksum.as_deref().unwrap_or_default()),
+    );
+    Response::text(200, "text/plain; version=0.0.4", body)
+}
+
+/// A label value, escaped as the text format requires
+fn label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
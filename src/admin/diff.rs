@@ -0,0 +1,438 @@
+//! Asserting on a query's result through the server itself, so black-box test
+//! frameworks in any language can check database state with one request.
+//!
+//! Cells compare the way `=` does in SQL, after the same conversions (`'1'`
+//! matches an integer 1 and `'2024-01-31'` a date), except that NULL matches
+//! NULL. Rows match in any order unless `ordered` is set.
+
+use std::sync::Arc;
+
+use super::AdminState;
+use super::http::{Request, Response};
+use super::rows::parse_csv_with_header;
+use crate::database::Value;
+use crate::sql::executor::QueryResult;
+use crate::sql::{QueryExecutor, coercion, parse_sql};
+use crate::yaml::writer::to_yaml_value;
+
+/// The rows a test expects, as column names and cells
+struct Expected {
+    columns: Vec<String>,
+    rows: Vec<Vec<Cell>>,
+}
+
+/// An expected value, and how the client wrote it for the report
+struct Cell {
+    value: Value,
+    written: serde_json::Value,
+}
+
+#[derive(serde::Deserialize)]
+struct JsonAssertion {
+    sql: String,
+    expected: Vec<serde_json::Value>,
+    #[serde(default)]
+    ordered: bool,
+}
+
+/// `POST /query/diff` runs a query and compares its rows with the expected
+/// ones: 200 if they match, 409 with the differences otherwise
+///
+/// The body is JSON, `{"sql": ..., "expected": [rows], "ordered": false}`
+/// with rows as objects keyed by column or arrays in column order, or CSV
+/// with a header row when sent as `text/csv`, the query then going in
+/// `?sql=` and the order in `?ordered=true`.
+pub(super) async fn query_diff(state: &AdminState, request: &Request) -> crate::Result<Response> {
+    let content_type = request
+        .headers
+        .get("content-type")
+        .map(|value| value.to_lowercase())
+        .unwrap_or_default();
+    let (sql, ordered, expected) = if content_type.starts_with("text/csv") {
+        let Some(sql) = request.query_param("sql") else {
+            return Ok(Response::error(400, "Missing sql parameter"));
+        };
+        let ordered = match request.query_param("ordered") {
+            None | Some("false") => false,
+            Some("true") => true,
+            Some(other) => {
+                return Ok(Response::error(
+                    400,
+                    format!("Invalid ordered '{}' (expected true or false)", other),
+                ));
+            }
+        };
+        let (header, records) = match parse_csv_with_header(&request.body) {
+            Ok(csv) => csv,
+            Err(message) => return Ok(Response::error(400, message)),
+        };
+        (sql.to_string(), ordered, ExpectedRows::Csv(header, records))
+    } else if content_type.is_empty() || content_type.starts_with("application/json") {
+        match serde_json::from_slice::<JsonAssertion>(&request.body) {
+            Ok(assertion) => (
+                assertion.sql,
+                assertion.ordered,
+                ExpectedRows::Json(assertion.expected),
+            ),
+            Err(e) => {
+                return Ok(Response::error(400, format!("Invalid JSON body: {}", e)));
+            }
+        }
+    } else {
+        return Ok(Response::error(
+            415,
+            format!(
+                "Unsupported content type '{}' (expected application/json or text/csv)",
+                content_type
+            ),
+        ));
+    };
+
+    let statement = match parse_sql(&sql) {
+        Ok(mut statements) if statements.len() == 1 && is_query(&statements[0]) => {
+            statements.remove(0)
+        }
+        Ok(_) => return Ok(Response::error(400, "sql must be a single query")),
+        Err(e) => return Ok(Response::error(400, e.to_string())),
+    };
+    let executor = QueryExecutor::new(Arc::new(state.storage.clone())).await?;
+    let actual = match executor.execute_unobserved(&statement).await {
+        Ok(result) => result,
+        Err(e) => return Ok(Response::error(422, e.to_string())),
+    };
+    let expected = match expected.read(&actual.columns) {
+        Ok(expected) => expected,
+        Err(message) => return Ok(Response::error(400, message)),
+    };
+
+    let report = diff(&expected, &actual, ordered);
+    let status = if report["equal"] == true { 200 } else { 409 };
+    Ok(Response::json(status, &report))
+}
+
+fn is_query(statement: &sqlparser::ast::Statement) -> bool {
+    match statement {
+        // `SELECT ... INTO` stores its rows, which an assertion must not do
+        sqlparser::ast::Statement::Query(query) => match query.body.as_ref() {
+            sqlparser::ast::SetExpr::Select(select) => select.into.is_none(),
+            _ => true,
+        },
+        _ => false,
+    }
+}
+
+enum ExpectedRows {
+    Json(Vec<serde_json::Value>),
+    Csv(Vec<String>, Vec<Vec<Option<String>>>),
+}
+
+impl ExpectedRows {
+    /// Read the rows against the query's columns, which arrays follow in order
+    fn read(self, actual_columns: &[String]) -> Result<Expected, String> {
+        match self {
+            ExpectedRows::Csv(columns, records) => {
+                let rows = records
+                    .into_iter()
+                    .enumerate()
+                    .map(|(idx, record)| {
+                        if record.len() != columns.len() {
+                            return Err(format!(
+                                "Expected row {} has {} fields but the header has {}",
+                                idx + 1,
+                                record.len(),
+                                columns.len()
+                            ));
+                        }
+                        Ok(record
+                            .into_iter()
+                            .map(|cell| match cell {
+                                Some(text) => Cell {
+                                    written: serde_json::Value::String(text.clone()),
+                                    value: Value::Text(text),
+                                },
+                                None => Cell {
+                                    value: Value::Null,
+                                    written: serde_json::Value::Null,
+                                },
+                            })
+                            .collect())
+                    })
+                    .collect::<Result<_, _>>()?;
+                Ok(Expected { columns, rows })
+            }
+            ExpectedRows::Json(rows) if rows.iter().all(serde_json::Value::is_array) => {
+                let rows = rows
+                    .iter()
+                    .filter_map(serde_json::Value::as_array)
+                    .enumerate()
+                    .map(|(idx, cells)| {
+                        if cells.len() != actual_columns.len() {
+                            return Err(format!(
+                                "Expected row {} has {} values but the query returned {} columns",
+                                idx + 1,
+                                cells.len(),
+                                actual_columns.len()
+                            ));
+                        }
+                        Ok(cells.iter().cloned().map(json_cell).collect())
+                    })
+                    .collect::<Result<_, _>>()?;
+                Ok(Expected {
+                    columns: actual_columns.to_vec(),
+                    rows,
+                })
+            }
+            ExpectedRows::Json(rows) => {
+                let objects = rows
+                    .into_iter()
+                    .map(|row| match row {
+                        serde_json::Value::Object(object) => Ok(object),
+                        _ => Err("Expected rows must all be objects or all be arrays".to_string()),
+                    })
+                    .collect::<Result<Vec<_>, _>>()?;
+                // Every key any row uses, in the order they first appear
+                let mut columns: Vec<String> = Vec::new();
+                for key in objects.iter().flat_map(|object| object.keys()) {
+                    if !columns.contains(key) {
+                        columns.push(key.clone());
+                    }
+                }
+                let rows = objects
+                    .into_iter()
+                    .map(|mut object| {
+                        columns
+                            .iter()
+                            .map(|column| {
+                                json_cell(object.remove(column).unwrap_or(serde_json::Value::Null))
+                            })
+                            .collect()
+                    })
+                    .collect();
+                Ok(Expected { columns, rows })
+            }
+        }
+    }
+}
+
+fn json_cell(written: serde_json::Value) -> Cell {
+    let value = match &written {
+        serde_json::Value::Null => Value::Null,
+        serde_json::Value::Bool(b) => Value::Boolean(*b),
+        serde_json::Value::Number(n) => match n.as_i64() {
+            Some(i) => Value::Integer(i),
+            // The written digits, so 10.10 matches a DECIMAL exactly
+            None => n
+                .to_string()
+                .parse()
+                .map(Value::Decimal)
+                .unwrap_or_else(|_| Value::Double(n.as_f64().unwrap_or(f64::NAN))),
+        },
+        serde_json::Value::String(s) => Value::Text(s.clone()),
+        document => Value::Json(document.clone()),
+    };
+    Cell { value, written }
+}
+
+fn cell_matches(expected: &Value, actual: &Value) -> bool {
+    match (expected, actual) {
+        (Value::Null, Value::Null) => true,
+        (Value::Null, _) | (_, Value::Null) => false,
+        (expected, actual) => coercion::equals(expected, actual),
+    }
+}
+
+/// Compare the rows on the columns both sides have, reporting the rest
+fn diff(expected: &Expected, actual: &QueryResult, ordered: bool) -> serde_json::Value {
+    // Expected column -> position in the result, matching names as SQL does
+    let positions: Vec<Option<usize>> = expected
+        .columns
+        .iter()
+        .map(|name| {
+            actual
+                .columns
+                .iter()
+                .position(|column| column == name)
+                .or_else(|| {
+                    actual
+                        .columns
+                        .iter()
+                        .position(|column| column.eq_ignore_ascii_case(name))
+                })
+        })
+        .collect();
+    let missing_columns: Vec<&String> = expected
+        .columns
+        .iter()
+        .zip(&positions)
+        .filter(|(_, position)| position.is_none())
+        .map(|(name, _)| name)
+        .collect();
+    let unexpected_columns: Vec<&String> = actual
+        .columns
+        .iter()
+        .enumerate()
+        .filter(|(idx, _)| !positions.contains(&Some(*idx)))
+        .map(|(_, name)| name)
+        .collect();
+
+    // Columns whose cells differ between an expected and an actual row
+    let differing = |expected_row: &[Cell], actual_row: &[Value]| -> Vec<&String> {
+        expected
+            .columns
+            .iter()
+            .zip(expected_row)
+            .zip(&positions)
+            .filter_map(|((name, cell), position)| {
+                let actual = &actual_row[(*position)?];
+                (!cell_matches(&cell.value, actual)).then_some(name)
+            })
+            .collect()
+    };
+    let render_expected = |row: &[Cell]| -> serde_json::Map<String, serde_json::Value> {
+        expected
+            .columns
+            .iter()
+            .zip(row)
+            .map(|(name, cell)| (name.clone(), cell.written.clone()))
+            .collect()
+    };
+    let render_actual = |row: &[Value]| -> serde_json::Map<String, serde_json::Value> {
+        actual
+            .columns
+            .iter()
+            .zip(row)
+            .map(|(name, value)| {
+                let value =
+                    serde_json::to_value(to_yaml_value(value)).unwrap_or(serde_json::Value::Null);
+                (name.clone(), value)
+            })
+            .collect()
+    };
+
+    let mut missing_rows = Vec::new();
+    let mut unexpected_rows = Vec::new();
+    let mut changed_rows = Vec::new();
+    if ordered {
+        for (idx, (expected_row, actual_row)) in expected.rows.iter().zip(&actual.rows).enumerate()
+        {
+            let columns = differing(expected_row, actual_row);
+            if !columns.is_empty() {
+                changed_rows.push(serde_json::json!({
+                    "row": idx + 1,
+                    "columns": columns,
+                    "expected": render_expected(expected_row),
+                    "actual": render_actual(actual_row),
+                }));
+            }
+        }
+        let common = expected.rows.len().min(actual.rows.len());
+        missing_rows.extend(
+            expected.rows[common..]
+                .iter()
+                .map(|row| render_expected(row)),
+        );
+        unexpected_rows.extend(actual.rows[common..].iter().map(|row| render_actual(row)));
+    } else {
+        let mut matched = vec![false; actual.rows.len()];
+        for expected_row in &expected.rows {
+            let found = actual
+                .rows
+                .iter()
+                .enumerate()
+                .position(|(idx, actual_row)| {
+                    !matched[idx] && differing(expected_row, actual_row).is_empty()
+                });
+            match found {
+                Some(idx) => matched[idx] = true,
+                None => missing_rows.push(render_expected(expected_row)),
+            }
+        }
+        unexpected_rows.extend(
+            actual
+                .rows
+                .iter()
+                .zip(&matched)
+                .filter(|(_, matched)| !**matched)
+                .map(|(row, _)| render_actual(row)),
+        );
+    }
+
+    let equal = missing_columns.is_empty()
+        && unexpected_columns.is_empty()
+        && missing_rows.is_empty()
+        && unexpected_rows.is_empty()
+        && changed_rows.is_empty();
+    serde_json::json!({
+        "equal": equal,
+        "expected_rows": expected.rows.len(),
+        "actual_rows": actual.rows.len(),
+        "missing_columns": missing_columns,
+        "unexpected_columns": unexpected_columns,
+        "missing_rows": missing_rows,
+        "unexpected_rows": unexpected_rows,
+        "changed_rows": changed_rows,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn result(columns: &[&str], rows: Vec<Vec<Value>>) -> QueryResult {
+        QueryResult {
+            columns: columns.iter().map(|column| column.to_string()).collect(),
+            column_types: Vec::new(),
+            rows,
+        }
+    }
+
+    fn expected(rows: serde_json::Value, columns: &[String]) -> Expected {
+        let serde_json::Value::Array(rows) = rows else {
+            panic!("rows must be an array");
+        };
+        ExpectedRows::Json(rows).read(columns).unwrap()
+    }
+
+    #[test]
+    fn test_diff_unordered_and_ordered() {
+        let actual = result(
+            &["id", "total"],
+            vec![
+                vec![Value::Integer(1), Value::Decimal("10.50".parse().unwrap())],
+                vec![Value::Integer(2), Value::Null],
+            ],
+        );
+
+        let swapped = expected(
+            serde_json::json!([{"id": 2, "total": null}, {"id": "1", "total": 10.5}]),
+            &actual.columns,
+        );
+        assert_eq!(diff(&swapped, &actual, false)["equal"], true);
+        let report = diff(&swapped, &actual, true);
+        assert_eq!(report["equal"], false);
+        assert_eq!(report["changed_rows"][0]["row"], 1);
+        assert_eq!(
+            report["changed_rows"][0]["columns"],
+            serde_json::json!(["id", "total"])
+        );
+
+        let positional = expected(serde_json::json!([[1, 10.5], [3, 0]]), &actual.columns);
+        let report = diff(&positional, &actual, false);
+        assert_eq!(
+            report["missing_rows"],
+            serde_json::json!([{"id": 3, "total": 0}])
+        );
+        assert_eq!(
+            report["unexpected_rows"],
+            serde_json::json!([{"id": 2, "total": null}])
+        );
+
+        let renamed = expected(
+            serde_json::json!([{"ID": 1, "amount": 10.5}]),
+            &actual.columns,
+        );
+        let report = diff(&renamed, &actual, false);
+        assert_eq!(report["missing_columns"], serde_json::json!(["amount"]));
+        assert_eq!(report["unexpected_columns"], serde_json::json!(["total"]));
+    }
+}
@@ -0,0 +1,86 @@
+//! Endpoints for simulating outages: dropping connections, pausing and restarting listeners.
+
+use std::time::Duration;
+
+use super::AdminState;
+use super::http::{Request, Response};
+use crate::server::ListenerControl;
+
+pub(super) fn list_listeners(state: &AdminState) -> Response {
+    let statuses: Vec<_> = state
+        .listeners
+        .iter()
+        .map(ListenerControl::status)
+        .collect();
+    Response::json(200, &statuses)
+}
+
+/// `POST /connections/drop[?listener=NAME]` closes open connections on one or all listeners
+pub(super) fn drop_connections(state: &AdminState, request: &Request) -> crate::Result<Response> {
+    let targets: Vec<&ListenerControl> = match request.query_param("listener") {
+        Some(name) => match state.listener(name) {
+            Some(listener) => vec![listener],
+            None => return Ok(unknown_listener(name)),
+        },
+        None => state.listeners.iter().collect(),
+    };
+
+    let dropped: usize = targets.iter().map(|l| l.drop_connections()).sum();
+    Ok(Response::json(
+        200,
+        &serde_json::json!({ "dropped_connections": dropped }),
+    ))
+}
+
+/// `POST /listeners/NAME/pause?duration=5s` (or `?seconds=5`) stops accepting connections
+pub(super) fn pause_listener(
+    state: &AdminState,
+    name: &str,
+    request: &Request,
+) -> crate::Result<Response> {
+    let Some(listener) = state.listener(name) else {
+        return Ok(unknown_listener(name));
+    };
+
+    let duration = match (
+        request.query_param("duration"),
+        request.query_param("seconds"),
+    ) {
+        (Some(duration), _) => humantime_serde::re::humantime::parse_duration(duration)
+            .map_err(|e| format!("Invalid duration '{}': {}", duration, e)),
+        (None, Some(seconds)) => seconds
+            .parse::<f64>()
+            .ok()
+            .filter(|s| s.is_finite() && *s >= 0.0)
+            .map(Duration::from_secs_f64)
+            .ok_or_else(|| format!("Invalid seconds '{}'", seconds)),
+        (None, None) => Err("Missing duration or seconds parameter".to_string()),
+    };
+    let duration = match duration {
+        Ok(duration) => duration,
+        Err(message) => return Ok(Response::error(400, message)),
+    };
+
+    listener.pause(duration)?;
+    Ok(Response::json(
+        200,
+        &serde_json::json!({ "listener": name, "paused_ms": duration.as_millis() as u64 }),
+    ))
+}
+
+/// `POST /listeners/NAME/restart` drops connections and rebinds the socket
+pub(super) fn restart_listener(state: &AdminState, name: &str) -> crate::Result<Response> {
+    let Some(listener) = state.listener(name) else {
+        return Ok(unknown_listener(name));
+    };
+
+    listener.restart()?;
+    Ok(Response::json(
+        200,
+        &serde_json::json!({ "listener": name, "restarted": true }),
+    ))
+}
+
+fn unknown_listener(name: &str) -> Response {
+    Response::error(404, format!("Unknown listener '{}'", name))
+}
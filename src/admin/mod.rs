@@ -0,0 +1,415 @@
+//! HTTP admin API for controlling a running server from test orchestration.
+//!
+//! Enabled with `--admin-port`. Every endpoint speaks JSON; errors are returned
+//! as `{"error": "..."}` with a 4xx/5xx status.
+
+use std::sync::Arc;
+use tokio::net::{TcpListener, TcpStream};
+use tracing::{debug, error, warn};
+
+use crate::database::Storage;
+use crate::server::ListenerControl;
+
+mod advisor;
+mod clock;
+mod dataset;
+mod diff;
+mod failover;
+pub mod http;
+mod n_plus_one;
+mod openapi;
+mod rows;
+mod scenarios;
+mod sessions;
+mod tables;
+
+use http::{Request, Response};
+
+/// Everything the admin endpoints can observe or act on
+pub struct AdminState {
+    pub storage: Storage,
+    pub listeners: Vec<ListenerControl>,
+}
+
+impl AdminState {
+    fn listener(&self, name: &str) -> Option<&ListenerControl> {
+        self.listeners.iter().find(|l| l.name() == name)
+    }
+}
+
+pub struct AdminServer {
+    state: Arc<AdminState>,
+}
+
+impl AdminServer {
+    pub fn new(state: AdminState) -> Self {
+        Self {
+            state: Arc::new(state),
+        }
+    }
+
+    pub async fn run(self, listener: TcpListener) -> crate::Result<()> {
+        loop {
+            let (stream, client_addr) = listener.accept().await?;
+            debug!("Admin connection from {}", client_addr);
+
+            let state = self.state.clone();
+            tokio::spawn(async move {
+                if let Err(e) = serve_connection(stream, state).await {
+                    warn!("Admin connection from {} failed: {}", client_addr, e);
+                }
+            });
+        }
+    }
+}
+
+async fn serve_connection(mut stream: TcpStream, state: Arc<AdminState>) -> std::io::Result<()> {
+    let response = match http::read_request(&mut stream).await {
+        Ok(Some(request)) => route(&state, &request).await,
+        Ok(None) => return Ok(()),
+        Err(e) => Response::error(400, e.to_string()),
+    };
+    http::write_response(&mut stream, &response).await
+}
+
+async fn route(state: &AdminState, request: &Request) -> Response {
+    let segments = request.segments();
+    let response = match (request.method.as_str(), segments.as_slice()) {
+        ("GET", ["health"]) => Ok(Response::json(200, &serde_json::json!({ "status": "ok" }))),
+        ("GET", ["openapi.json"]) => Ok(openapi::openapi(state).await),
+        ("GET", ["dataset"]) => Ok(dataset::dataset(state).await),
+        ("GET", ["metrics"]) => Ok(dataset::metrics(state).await),
+        ("GET", ["clock"]) => Ok(clock::clock(state)),
+        ("POST", ["clock", "set"]) => Ok(clock::set_clock(state, request)),
+        ("POST", ["clock", "advance"]) => Ok(clock::advance_clock(state, request)),
+        ("GET", ["advisor", "indexes"]) => Ok(advisor::index_recommendations(state).await),
+        ("POST", ["advisor", "reset"]) => Ok(advisor::reset(state)),
+        ("GET", ["n-plus-one"]) => Ok(n_plus_one::list_reports(state)),
+        ("POST", ["n-plus-one", "reset"]) => Ok(n_plus_one::reset(state)),
+        ("GET", ["listeners"]) => Ok(failover::list_listeners(state)),
+        ("GET", ["tables", "columns"]) => Ok(tables::columns(state, request).await),
+        ("GET", ["tables", "errors"]) => Ok(tables::errored_tables(state).await),
+        ("POST", ["tables", name, "rows"]) => rows::load_rows(state, name, request).await,
+        ("POST", ["query", "diff"]) => diff::query_diff(state, request).await,
+        ("GET", ["scenarios"]) => Ok(scenarios::list_scenarios(state)),
+        ("POST", ["scenarios", "stop"]) => Ok(scenarios::stop_scenario(state)),
+        ("POST", ["scenarios", name, "start"]) => Ok(scenarios::start_scenario(state, name)),
+        ("GET", ["scenarios", name, "check"]) => Ok(scenarios::check_scenario(state, name)),
+        ("GET", ["connections"]) => Ok(sessions::connections(state)),
+        ("POST", ["connections", "drop"]) => failover::drop_connections(state, request),
+        ("POST", ["listeners", name, "pause"]) => failover::pause_listener(state, name, request),
+        ("POST", ["listeners", name, "restart"]) => failover::restart_listener(state, name),
+        _ => Ok(Response::not_found()),
+    };
+
+    response.unwrap_or_else(|e| {
+        error!(
+            "Admin request {} {} failed: {}",
+            request.method, request.path, e
+        );
+        Response::error(500, e.to_string())
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::Config;
+    use crate::database::Database;
+    use crate::server::{ConnectionManager, ManagedListener};
+    use clap::Parser;
+
+    fn admin_state() -> AdminState {
+        let config = Arc::new(Config::parse_from(["yamlbase", "-f", "db.yaml"]));
+        let storage = Storage::new(Database::new("test".to_string()));
+        let manager = ConnectionManager::new(config, Arc::new(storage.clone()));
+        let primary = ManagedListener::new("primary", "127.0.0.1:0".to_string(), manager);
+
+        AdminState {
+            storage,
+            listeners: vec![primary.control()],
+        }
+    }
+
+    fn request(method: &str, path: &str, query: &[(&str, &str)]) -> Request {
+        Request {
+            method: method.to_string(),
+            path: path.to_string(),
+            query: query
+                .iter()
+                .map(|(k, v)| (k.to_string(), v.to_string()))
+                .collect(),
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn test_routes() {
+        let state = admin_state();
+
+        assert_eq!(
+            route(&state, &request("GET", "/health", &[])).await.status,
+            200
+        );
+        assert_eq!(
+            route(&state, &request("GET", "/nope", &[])).await.status,
+            404
+        );
+
+        let listeners = route(&state, &request("GET", "/listeners", &[])).await;
+        let body: serde_json::Value = serde_json::from_slice(&listeners.body).unwrap();
+        assert_eq!(body[0]["name"], "primary");
+
+        let openapi = route(&state, &request("GET", "/openapi.json", &[])).await;
+        let body: serde_json::Value = serde_json::from_slice(&openapi.body).unwrap();
+        assert_eq!(openapi.status, 200);
+        assert_eq!(
+            body["paths"]["/listeners/{name}/restart"]["post"]["parameters"][0]["schema"]["enum"],
+            serde_json::json!(["primary"])
+        );
+
+        let advice = route(&state, &request("GET", "/advisor/indexes", &[])).await;
+        assert_eq!(advice.status, 200);
+        assert_eq!(advice.body, b"[]");
+
+        let dataset = route(&state, &request("GET", "/dataset", &[])).await;
+        let body: serde_json::Value = serde_json::from_slice(&dataset.body).unwrap();
+        assert_eq!(body["version"], 1);
+        assert_eq!(body["checksum"], serde_json::Value::Null);
+        let metrics = route(&state, &request("GET", "/metrics", &[])).await;
+        assert_eq!(metrics.content_type, "text/plain; version=0.0.4");
+        let metrics = String::from_utf8(metrics.body).unwrap();
+        assert!(metrics.contains("yamlbase_dataset_version{database=\"test\"} 1\n"));
+        assert!(metrics.contains("yamlbase_dataset_info{database=\"test\",checksum=\"\"} 1\n"));
+
+        let clock = route(&state, &request("GET", "/clock", &[])).await;
+        let body: serde_json::Value = serde_json::from_slice(&clock.body).unwrap();
+        assert_eq!(body["fixed"], false);
+        let set = request("POST", "/clock/set", &[("at", "2024-01-31T12:00:00")]);
+        route(&state, &set).await;
+        let advance = request("POST", "/clock/advance", &[("duration", "90m")]);
+        let clock = route(&state, &advance).await;
+        let body: serde_json::Value = serde_json::from_slice(&clock.body).unwrap();
+        assert_eq!(body["now"], "2024-01-31 13:30:00");
+        assert_eq!(body["fixed"], true);
+        let invalid = request("POST", "/clock/advance", &[("duration", "soon")]);
+        assert_eq!(route(&state, &invalid).await.status, 400);
+
+        let errors = route(&state, &request("GET", "/tables/errors", &[])).await;
+        assert_eq!(errors.status, 200);
+        assert_eq!(errors.body, b"[]");
+        let columns = route(&state, &request("GET", "/tables/columns", &[])).await;
+        assert_eq!(columns.body, b"[]");
+        let unknown = request("GET", "/tables/columns", &[("table", "users")]);
+        assert_eq!(route(&state, &unknown).await.status, 404);
+
+        let bursts = route(&state, &request("GET", "/n-plus-one", &[])).await;
+        let body: serde_json::Value = serde_json::from_slice(&bursts.body).unwrap();
+        assert_eq!(body["enabled"], false);
+
+        let dropped = route(&state, &request("POST", "/connections/drop", &[])).await;
+        let body: serde_json::Value = serde_json::from_slice(&dropped.body).unwrap();
+        assert_eq!(body["dropped_connections"], 0);
+    }
+
+    #[tokio::test]
+    async fn test_unknown_scenario() {
+        let state = admin_state();
+
+        let start = request("POST", "/scenarios/checkout/start", &[]);
+        assert_eq!(route(&state, &start).await.status, 404);
+        let check = request("GET", "/scenarios/checkout/check", &[]);
+        assert_eq!(route(&state, &check).await.status, 404);
+    }
+
+    #[tokio::test]
+    async fn test_pause_validates_input() {
+        let state = admin_state();
+
+        let missing = request("POST", "/listeners/primary/pause", &[]);
+        assert_eq!(route(&state, &missing).await.status, 400);
+
+        let unknown = request("POST", "/listeners/replica-9/pause", &[("seconds", "1")]);
+        assert_eq!(route(&state, &unknown).await.status, 404);
+    }
+
+    #[tokio::test]
+    async fn test_load_rows() {
+        use crate::database::{Column, Table, Value};
+        use crate::yaml::schema::SqlType;
+
+        let column = |name: &str, sql_type, nullable| Column {
+            name: name.to_string(),
+            sql_type,
+            primary_key: name == "id",
+            nullable,
+            unique: name == "id",
+            default: None,
+            references: None,
+        };
+        let mut db = Database::new("test".to_string());
+        db.add_table(Table::new(
+            "users".to_string(),
+            vec![
+                column("id", SqlType::Integer, false),
+                column("name", SqlType::Text, true),
+                column("active", SqlType::Boolean, true),
+            ],
+        ))
+        .unwrap();
+        let state = AdminState {
+            storage: Storage::new(db),
+            listeners: Vec::new(),
+        };
+        let load = |mode: &str, content_type: &str, body: &str| Request {
+            method: "POST".to_string(),
+            path: "/tables/users/rows".to_string(),
+            query: [("mode".to_string(), mode.to_string())].into(),
+            headers: [("content-type".to_string(), content_type.to_string())].into(),
+            body: body.as_bytes().to_vec(),
+        };
+        async fn users(state: &AdminState) -> Vec<Vec<Value>> {
+            let db = state.storage.database();
+            let db = db.read().await;
+            db.get_table("users").unwrap().rows.clone()
+        }
+
+        let columns = request("GET", "/tables/columns", &[("table", "USERS")]);
+        let body: serde_json::Value =
+            serde_json::from_slice(&route(&state, &columns).await.body).unwrap();
+        assert_eq!(body[2]["column"], "active");
+        assert_eq!(body[2]["type"], "boolean");
+        assert_eq!(body[2]["pii"], false);
+
+        let json = load(
+            "append",
+            "application/json",
+            r#"[{"id": 1, "name": "Ada"}, {"id": 2, "active": true}]"#,
+        );
+        let loaded = route(&state, &json).await;
+        assert_eq!(loaded.status, 200);
+        let body: serde_json::Value = serde_json::from_slice(&loaded.body).unwrap();
+        assert_eq!(body["inserted"], 2);
+        assert_eq!(
+            users(&state).await[1],
+            vec![Value::Integer(2), Value::Null, Value::Boolean(true)]
+        );
+
+        // A duplicate key rejects the whole batch
+        let duplicate = load("append", "text/csv", "id,name\n3,Lin\n1,Grace\n");
+        assert_eq!(route(&state, &duplicate).await.status, 422);
+        assert_eq!(users(&state).await.len(), 2);
+
+        let csv = load(
+            "replace",
+            "text/csv; charset=utf-8",
+            "ID,active,name\r\n7,false,\"Hopper, Grace\"\r\n8,,\r\n",
+        );
+        let loaded = route(&state, &csv).await;
+        let body: serde_json::Value = serde_json::from_slice(&loaded.body).unwrap();
+        assert_eq!(body["inserted"], 2);
+        assert_eq!(body["deleted"], 2);
+        assert_eq!(
+            users(&state).await,
+            vec![
+                vec![
+                    Value::Integer(7),
+                    Value::Text("Hopper, Grace".to_string()),
+                    Value::Boolean(false),
+                ],
+                vec![Value::Integer(8), Value::Null, Value::Null],
+            ]
+        );
+
+        let unknown_column = load("append", "application/json", r#"[{"id": 9, "email": "x"}]"#);
+        assert_eq!(route(&state, &unknown_column).await.status, 422);
+        let malformed = load("append", "application/json", r#"{"id": 9}"#);
+        assert_eq!(route(&state, &malformed).await.status, 400);
+        let bad_mode = load("upsert", "application/json", "[]");
+        assert_eq!(route(&state, &bad_mode).await.status, 400);
+        let xml = load("append", "application/xml", "<users/>");
+        assert_eq!(route(&state, &xml).await.status, 415);
+        let mut missing = load("append", "application/json", "[]");
+        missing.path = "/tables/orders/rows".to_string();
+        assert_eq!(route(&state, &missing).await.status, 404);
+    }
+
+    #[tokio::test]
+    async fn test_query_diff() {
+        use crate::database::{Column, Table, Value};
+        use crate::yaml::schema::SqlType;
+
+        let columns = ["id", "name"].map(|name| Column {
+            name: name.to_string(),
+            sql_type: if name == "id" {
+                SqlType::Integer
+            } else {
+                SqlType::Text
+            },
+            primary_key: name == "id",
+            nullable: name != "id",
+            unique: name == "id",
+            default: None,
+            references: None,
+        });
+        let mut users = Table::new("users".to_string(), columns.to_vec());
+        users
+            .insert_row(vec![Value::Integer(1), Value::Text("Ada".to_string())])
+            .unwrap();
+        users
+            .insert_row(vec![Value::Integer(2), Value::Null])
+            .unwrap();
+        let mut db = Database::new("test".to_string());
+        db.add_table(users).unwrap();
+        let state = AdminState {
+            storage: Storage::new(db),
+            listeners: Vec::new(),
+        };
+        let diff = |query: &[(&str, &str)], content_type: &str, body: &str| Request {
+            headers: [("content-type".to_string(), content_type.to_string())].into(),
+            body: body.as_bytes().to_vec(),
+            ..request("POST", "/query/diff", query)
+        };
+
+        let json = diff(
+            &[],
+            "application/json",
+            r#"{"sql": "SELECT id, name FROM users", "expected": [[2, null], [1, "Ada"]]}"#,
+        );
+        assert_eq!(route(&state, &json).await.status, 200);
+
+        let csv = diff(
+            &[
+                ("sql", "SELECT id, name FROM users ORDER BY id"),
+                ("ordered", "true"),
+            ],
+            "text/csv",
+            "id,name\n1,Grace\n2,\n3,Lin\n",
+        );
+        let report = route(&state, &csv).await;
+        assert_eq!(report.status, 409);
+        let body: serde_json::Value = serde_json::from_slice(&report.body).unwrap();
+        assert_eq!(
+            body["changed_rows"][0]["columns"],
+            serde_json::json!(["name"])
+        );
+        assert_eq!(body["changed_rows"][0]["actual"]["name"], "Ada");
+        assert_eq!(
+            body["missing_rows"],
+            serde_json::json!([{"id": "3", "name": "Lin"}])
+        );
+
+        let write = diff(
+            &[],
+            "application/json",
+            r#"{"sql": "INSERT INTO users SELECT * FROM users", "expected": []}"#,
+        );
+        assert_eq!(route(&state, &write).await.status, 400);
+        let failing = diff(
+            &[],
+            "application/json",
+            r#"{"sql": "SELECT nope FROM users", "expected": []}"#,
+        );
+        assert_eq!(route(&state, &failing).await.status, 422);
+    }
+}
@@ -0,0 +1,22 @@
+//! Endpoints exposing N+1 query bursts found by `--n-plus-one-threshold`.
+
+use super::AdminState;
+use super::http::Response;
+
+/// `GET /n-plus-one` lists detected bursts, oldest first
+pub(super) fn list_reports(state: &AdminState) -> Response {
+    let detector = state.storage.n_plus_one_detector();
+    let reports = detector.map(|d| d.reports()).unwrap_or_default();
+    Response::json(
+        200,
+        &serde_json::json!({ "enabled": detector.is_some(), "reports": reports }),
+    )
+}
+
+/// `POST /n-plus-one/reset` clears the reports, e.g. between test scenarios
+pub(super) fn reset(state: &AdminState) -> Response {
+    if let Some(detector) = state.storage.n_plus_one_detector() {
+        detector.clear();
+    }
+    Response::json(200, &serde_json::json!({ "reset": true }))
+}
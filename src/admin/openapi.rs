@@ -0,0 +1,497 @@
+//! An OpenAPI 3.0 description of the admin API, so client SDKs for driving
+//! the server can be generated.
+//!
+//! The document is built from what is being served when it is requested:
+//! each table has its own `POST /tables/NAME/rows` path whose body is an
+//! array of the table's component schema, with a property per column, and
+//! the table, scenario and listener parameters list the names that exist.
+
+use indexmap::IndexMap;
+use serde_json::{Map, Value as Json, json};
+
+use super::AdminState;
+use super::http::Response;
+use crate::database::{Annotation, Column, Database, Table};
+use crate::yaml::schema::SqlType;
+
+/// A query parameter: name, description and whether it is required
+type Parameter = (&'static str, &'static str, bool);
+
+/// The endpoints whose shape does not depend on the schema: method, path,
+/// summary and query parameters
+const ENDPOINTS: &[(&str, &str, &str, &[Parameter])] = &[
+    ("get", "/health", "Report that the server is up", &[]),
+    (
+        "get",
+        "/dataset",
+        "Report the served dataset's checksum and version",
+        &[],
+    ),
+    (
+        "get",
+        "/clock",
+        "Report the server time and whether it is frozen",
+        &[],
+    ),
+    (
+        "post",
+        "/clock/set",
+        "Freeze the clock at a time",
+        &[("at", "The time, such as 2024-01-31T12:00:00", true)],
+    ),
+    (
+        "post",
+        "/clock/advance",
+        "Move the clock forward, freezing it",
+        &[("duration", "How far, such as 15m", true)],
+    ),
+    (
+        "get",
+        "/advisor/indexes",
+        "List recommended indexes, most expensive workload first",
+        &[],
+    ),
+    (
+        "post",
+        "/advisor/reset",
+        "Forget the observed workload",
+        &[],
+    ),
+    (
+        "get",
+        "/n-plus-one",
+        "List detected N+1 query bursts, oldest first",
+        &[],
+    ),
+    ("post", "/n-plus-one/reset", "Clear the N+1 reports", &[]),
+    (
+        "get",
+        "/listeners",
+        "List the listeners and their state",
+        &[],
+    ),
+    (
+        "get",
+        "/connections",
+        "Count the open sessions per user and database against the connection quotas",
+        &[],
+    ),
+    (
+        "get",
+        "/tables/errors",
+        "List the tables that failed to load and why",
+        &[],
+    ),
+    (
+        "get",
+        "/scenarios",
+        "Report every declared scenario's latest run",
+        &[],
+    ),
+    ("post", "/scenarios/stop", "Stop counting queries", &[]),
+];
+
+/// `GET /openapi.json` describes the admin API over the tables being served
+pub(super) async fn openapi(state: &AdminState) -> Response {
+    let db = state.storage.database();
+    let db = db.read().await;
+    let scenarios: Vec<String> = state
+        .storage
+        .query_budgets()
+        .scenario_names()
+        .map(|name| name.to_string())
+        .collect();
+    let listeners: Vec<String> = state
+        .listeners
+        .iter()
+        .map(|listener| listener.name().to_string())
+        .collect();
+    Response::json(200, &document(&db, &scenarios, &listeners))
+}
+
+fn document(db: &Database, scenarios: &[String], listeners: &[String]) -> Json {
+    let mut paths = Map::new();
+    for (method, path, summary, parameters) in ENDPOINTS {
+        let parameters = parameters
+            .iter()
+            .map(|&(name, description, required)| {
+                query_parameter(name, description, required, string())
+            })
+            .collect();
+        paths.insert(
+            path.to_string(),
+            item(method, operation(summary, parameters)),
+        );
+    }
+
+    let mut metrics = operation(
+        "Publish the served dataset's checksum and version as Prometheus metrics",
+        vec![],
+    );
+    metrics["responses"]["200"]["content"] = json!({ "text/plain": { "schema": string() } });
+    paths.insert("/metrics".to_string(), item("get", metrics));
+
+    let tables: Vec<&str> = db
+        .tables
+        .values()
+        .map(|table| table.name.as_str())
+        .collect();
+    paths.insert(
+        "/tables/columns".to_string(),
+        item(
+            "get",
+            operation(
+                "List the columns of every table, or of one, with their annotations",
+                vec![query_parameter(
+                    "table",
+                    "Only this table's columns",
+                    false,
+                    names(&tables),
+                )],
+            ),
+        ),
+    );
+    let mut schemas = Map::new();
+    schemas.insert(
+        "Error".to_string(),
+        json!({
+            "type": "object",
+            "properties": { "error": { "type": "string" } },
+            "required": ["error"],
+        }),
+    );
+    for table in db.tables.values() {
+        paths.insert(
+            format!("/tables/{}/rows", table.name),
+            item("post", load_rows(table)),
+        );
+        schemas.insert(
+            table.name.clone(),
+            row_schema(table, db.annotations.get(&table.name)),
+        );
+    }
+    paths.insert("/query/diff".to_string(), item("post", query_diff()));
+
+    let scenario = || path_parameter("name", "The scenario", names(scenarios));
+    paths.insert(
+        "/scenarios/{name}/start".to_string(),
+        item(
+            "post",
+            operation(
+                "Count subsequent queries against the scenario's budget",
+                vec![scenario()],
+            ),
+        ),
+    );
+    let mut check = operation("Check whether the scenario's budget held", vec![scenario()]);
+    check["responses"]["409"] = json!({ "description": "The budget was exceeded" });
+    paths.insert("/scenarios/{name}/check".to_string(), item("get", check));
+
+    let listener = || path_parameter("name", "The listener", names(listeners));
+    paths.insert(
+        "/connections/drop".to_string(),
+        item(
+            "post",
+            operation(
+                "Close open connections on one or all listeners",
+                vec![query_parameter(
+                    "listener",
+                    "Only this listener's connections",
+                    false,
+                    names(listeners),
+                )],
+            ),
+        ),
+    );
+    paths.insert(
+        "/listeners/{name}/pause".to_string(),
+        item(
+            "post",
+            operation(
+                "Stop accepting connections for a while",
+                vec![
+                    listener(),
+                    query_parameter("duration", "How long, such as 5s", false, string()),
+                    query_parameter(
+                        "seconds",
+                        "How long, in seconds",
+                        false,
+                        json!({ "type": "integer" }),
+                    ),
+                ],
+            ),
+        ),
+    );
+    paths.insert(
+        "/listeners/{name}/restart".to_string(),
+        item(
+            "post",
+            operation(
+                "Drop the listener's connections and rebind its socket",
+                vec![listener()],
+            ),
+        ),
+    );
+
+    json!({
+        "openapi": "3.0.3",
+        "info": {
+            "title": format!("yamlbase admin API for {}", db.name),
+            "version": env!("CARGO_PKG_VERSION"),
+        },
+        "paths": paths,
+        "components": { "schemas": schemas },
+    })
+}
+
+/// `POST /tables/NAME/rows` for one table
+fn load_rows(table: &Table) -> Json {
+    let mode = json!({ "type": "string", "enum": ["append", "replace"], "default": "append" });
+    let mut operation = operation(
+        &format!("Append rows to {}, or replace its rows", table.name),
+        vec![query_parameter(
+            "mode",
+            "Whether to append or replace",
+            false,
+            mode,
+        )],
+    );
+    operation["requestBody"] = json!({
+        "required": true,
+        "content": {
+            "application/json": { "schema": {
+                "type": "array",
+                "items": { "$ref": format!("#/components/schemas/{}", table.name) },
+            }},
+            "text/csv": { "schema": string() },
+        },
+    });
+    operation["responses"]["200"]["content"]["application/json"]["schema"] = json!({
+        "type": "object",
+        "properties": {
+            "table": { "type": "string" },
+            "inserted": { "type": "integer" },
+            "deleted": { "type": "integer" },
+        },
+    });
+    operation["responses"]["400"] = error("The body could not be read");
+    operation["responses"]["404"] = error("The table does not exist");
+    operation["responses"]["415"] = error("The body is neither JSON nor CSV");
+    operation["responses"]["422"] = error("A row was rejected, and none were written");
+    operation
+}
+
+/// `POST /query/diff`
+fn query_diff() -> Json {
+    let mut operation = operation(
+        "Run a query and compare its rows with the expected ones",
+        vec![
+            query_parameter("sql", "The query, when the body is CSV", false, string()),
+            query_parameter(
+                "ordered",
+                "Whether rows must match in order, when the body is CSV",
+                false,
+                json!({ "type": "boolean" }),
+            ),
+        ],
+    );
+    operation["requestBody"] = json!({
+        "required": true,
+        "content": {
+            "application/json": { "schema": {
+                "type": "object",
+                "properties": {
+                    "sql": { "type": "string" },
+                    "expected": { "type": "array", "items": {} },
+                    "ordered": { "type": "boolean", "default": false },
+                },
+                "required": ["sql", "expected"],
+            }},
+            "text/csv": { "schema": string() },
+        },
+    });
+    operation["responses"]["400"] = error("The body or query could not be read");
+    operation["responses"]["409"] = json!({ "description": "The rows differ" });
+    operation
+}
+
+/// A table's rows as the JSON objects `POST /tables/NAME/rows` takes
+fn row_schema(table: &Table, annotations: Option<&IndexMap<String, Annotation>>) -> Json {
+    let mut properties = Map::new();
+    let mut required = Vec::new();
+    for column in &table.columns {
+        let mut schema = column_schema(column);
+        if let Some(annotation) = annotations.and_then(|annotations| annotations.get(&column.name))
+        {
+            schema["description"] = json!(annotation.comment());
+        }
+        if !column.nullable
+            && column.default.is_none()
+            && !table
+                .identities
+                .iter()
+                .any(|identity| identity.column == column.name)
+        {
+            required.push(column.name.clone());
+        }
+        properties.insert(column.name.clone(), schema);
+    }
+    let mut schema =
+        json!({ "type": "object", "properties": properties, "additionalProperties": false });
+    if !required.is_empty() {
+        schema["required"] = json!(required);
+    }
+    schema
+}
+
+/// A column's values in JSON
+fn column_schema(column: &Column) -> Json {
+    let mut schema = match &column.sql_type {
+        SqlType::Integer | SqlType::BigInt => json!({ "type": "integer", "format": "int64" }),
+        SqlType::Char(length) | SqlType::Varchar(length) => {
+            json!({ "type": "string", "maxLength": length })
+        }
+        SqlType::Text => json!({ "type": "string" }),
+        SqlType::Timestamp => json!({ "type": "string", "example": "2024-01-31 12:00:00" }),
+        SqlType::TimestampTz => json!({ "type": "string", "format": "date-time" }),
+        SqlType::Date => json!({ "type": "string", "format": "date" }),
+        SqlType::Time => json!({ "type": "string", "example": "12:00:00" }),
+        SqlType::Boolean => json!({ "type": "boolean" }),
+        SqlType::Decimal(..) => json!({ "type": "number" }),
+        SqlType::Float => json!({ "type": "number", "format": "float" }),
+        SqlType::Double => json!({ "type": "number", "format": "double" }),
+        SqlType::Uuid => json!({ "type": "string", "format": "uuid" }),
+        SqlType::Json => json!({}),
+        SqlType::Point => json!({
+            "type": "object",
+            "properties": { "lat": { "type": "number" }, "lon": { "type": "number" } },
+        }),
+        SqlType::Money(_) => json!({ "type": "number" }),
+        SqlType::Hstore => json!({
+            "type": "object",
+            "additionalProperties": { "type": "string", "nullable": true },
+        }),
+        SqlType::Enum(labels) => json!({ "type": "string", "enum": labels }),
+        SqlType::Bytea => json!({ "type": "string", "example": "\\x89504e47" }),
+        SqlType::Array(_) => json!({ "type": "array" }),
+    };
+    if column.nullable && !matches!(column.sql_type, SqlType::Json) {
+        schema["nullable"] = json!(true);
+    }
+    schema
+}
+
+/// An operation answering 200 with JSON, or 500 when the request fails
+fn operation(summary: &str, parameters: Vec<Json>) -> Json {
+    let mut operation = json!({
+        "summary": summary,
+        "responses": {
+            "200": {
+                "description": "OK",
+                "content": { "application/json": { "schema": {} } },
+            },
+            "500": error("The request failed"),
+        },
+    });
+    if !parameters.is_empty() {
+        operation["parameters"] = json!(parameters);
+    }
+    operation
+}
+
+/// A path item holding one operation
+fn item(method: &str, operation: Json) -> Json {
+    let mut item = Map::new();
+    item.insert(method.to_string(), operation);
+    Json::Object(item)
+}
+
+fn query_parameter(name: &str, description: &str, required: bool, schema: Json) -> Json {
+    json!({
+        "name": name,
+        "in": "query",
+        "description": description,
+        "required": required,
+        "schema": schema,
+    })
+}
+
+fn path_parameter(name: &str, description: &str, schema: Json) -> Json {
+    json!({
+        "name": name,
+        "in": "path",
+        "description": description,
+        "required": true,
+        "schema": schema,
+    })
+}
+
+/// A string parameter taking one of `names`
+fn names(names: &[impl AsRef<str>]) -> Json {
+    let names: Vec<&str> = names.iter().map(AsRef::as_ref).collect();
+    json!({ "type": "string", "enum": names })
+}
+
+fn string() -> Json {
+    json!({ "type": "string" })
+}
+
+fn error(description: &str) -> Json {
+    json!({
+        "description": description,
+        "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } },
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_document_describes_each_table() {
+        let db = crate::yaml::load_yaml_str(
+            r#"
+database:
+  name: "shop"
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      email: "VARCHAR(255) NOT NULL"
+      nickname: "TEXT"
+    annotations:
+      email:
+        description: "Contact address"
+        pii: true
+"#,
+            false,
+        )
+        .unwrap();
+        let document = document(&db, &["checkout".to_string()], &["primary".to_string()]);
+
+        assert_eq!(document["openapi"], "3.0.3");
+        let users = &document["components"]["schemas"]["users"];
+        assert_eq!(users["required"], json!(["id", "email"]));
+        assert_eq!(
+            users["properties"]["email"],
+            json!({ "type": "string", "maxLength": 255, "description": "Contact address (PII)" })
+        );
+        assert_eq!(users["properties"]["nickname"]["nullable"], true);
+
+        let rows = &document["paths"]["/tables/users/rows"]["post"];
+        assert_eq!(
+            rows["requestBody"]["content"]["application/json"]["schema"]["items"]["$ref"],
+            "#/components/schemas/users"
+        );
+        assert!(rows["responses"]["422"].is_object());
+        assert_eq!(
+            document["paths"]["/tables/columns"]["get"]["parameters"][0]["schema"]["enum"],
+            json!(["users"])
+        );
+        assert_eq!(
+            document["paths"]["/scenarios/{name}/start"]["post"]["parameters"][0]["schema"]["enum"],
+            json!(["checkout"])
+        );
+        assert!(document["paths"]["/health"]["get"].is_object());
+    }
+}
@@ -0,0 +1,303 @@
+//! Bulk loading rows over HTTP, so orchestration scripts can reshape the data
+//! without speaking a SQL wire protocol.
+//!
+//! A JSON body is an array of objects keyed by column name, read like the
+//! rows of a YAML file: missing columns are NULL, or their default when not
+//! nullable. A CSV body starts with a header row naming the columns; a cell
+//! converts as a text literal inserted into its column would, and an empty
+//! unquoted cell is NULL. All rows are written as one batch, so a row that is
+//! rejected leaves the table untouched.
+
+use indexmap::IndexMap;
+
+use super::AdminState;
+use super::http::{Request, Response};
+use crate::YamlBaseError;
+use crate::database::{RowChange, Table, Value};
+use crate::sql::coercion;
+use crate::yaml::parser::build_row;
+
+enum Payload {
+    Json(Vec<IndexMap<String, serde_yaml::Value>>),
+    Csv {
+        header: Vec<String>,
+        records: Vec<Vec<Option<String>>>,
+    },
+}
+
+/// `POST /tables/NAME/rows[?mode=replace]` appends the rows in the body to a
+/// table, or replaces its rows with them
+pub(super) async fn load_rows(
+    state: &AdminState,
+    name: &str,
+    request: &Request,
+) -> crate::Result<Response> {
+    let replace = match request.query_param("mode") {
+        None | Some("append") => false,
+        Some("replace") => true,
+        Some(mode) => {
+            return Ok(Response::error(
+                400,
+                format!("Invalid mode '{}' (expected append or replace)", mode),
+            ));
+        }
+    };
+    let content_type = request
+        .headers
+        .get("content-type")
+        .map(|value| value.to_lowercase())
+        .unwrap_or_default();
+    let payload = if content_type.starts_with("text/csv") {
+        parse_csv_payload(&request.body)
+    } else if content_type.is_empty() || content_type.starts_with("application/json") {
+        serde_json::from_slice(&request.body)
+            .map(Payload::Json)
+            .map_err(|e| format!("Invalid JSON body, expected an array of objects: {}", e))
+    } else {
+        return Ok(Response::error(
+            415,
+            format!(
+                "Unsupported content type '{}' (expected application/json or text/csv)",
+                content_type
+            ),
+        ));
+    };
+    let payload = match payload {
+        Ok(payload) => payload,
+        Err(message) => return Ok(Response::error(400, message)),
+    };
+
+    let exists = {
+        let db = state.storage.database();
+        let db = db.read().await;
+        db.get_table(name).is_some()
+    };
+    if !exists {
+        return Ok(Response::error(404, format!("Unknown table '{}'", name)));
+    }
+
+    let written = state
+        .storage
+        .write_table(name, |table| {
+            let rows = match payload {
+                Payload::Json(objects) => json_rows(table, objects)?,
+                Payload::Csv { header, records } => csv_rows(table, &header, records)?,
+            };
+            let deletes = if replace { table.rows.len() } else { 0 };
+            let mut changes = Vec::with_capacity(deletes + rows.len());
+            changes.extend((0..deletes).map(|index| RowChange::Delete { index }));
+            changes.extend(rows.into_iter().map(RowChange::Insert));
+            Ok(changes)
+        })
+        .await;
+    match written {
+        Ok(summary) => Ok(Response::json(
+            200,
+            &serde_json::json!({
+                "table": summary.table,
+                "inserted": summary.inserted.len(),
+                "deleted": summary.deleted.len(),
+            }),
+        )),
+        Err(e @ (YamlBaseError::Database { .. } | YamlBaseError::TypeConversion(_))) => {
+            Ok(Response::error(422, e.to_string()))
+        }
+        Err(e) => Err(e),
+    }
+}
+
+fn json_rows(
+    table: &Table,
+    objects: Vec<IndexMap<String, serde_yaml::Value>>,
+) -> crate::Result<Vec<Vec<Value>>> {
+    objects
+        .iter()
+        .enumerate()
+        .map(|(idx, object)| {
+            if let Some(key) = object
+                .keys()
+                .find(|key| !table.columns.iter().any(|column| &column.name == *key))
+            {
+                return Err(unknown_column(table, key));
+            }
+            build_row(object, &table.columns).map_err(|e| in_row(idx + 1, e))
+        })
+        .collect()
+}
+
+fn csv_rows(
+    table: &Table,
+    header: &[String],
+    records: Vec<Vec<Option<String>>>,
+) -> crate::Result<Vec<Vec<Value>>> {
+    let targets = header
+        .iter()
+        .map(|name| {
+            table
+                .get_column_index(name)
+                .ok_or_else(|| unknown_column(table, name))
+        })
+        .collect::<crate::Result<Vec<_>>>()?;
+    // The columns left out of the header take what a YAML row without them would
+    let present = header
+        .iter()
+        .filter_map(|name| table.get_column_index(name))
+        .map(|idx| (table.columns[idx].name.clone(), serde_yaml::Value::Null))
+        .collect();
+    let base = build_row(&present, &table.columns)?;
+
+    let mut rows = Vec::with_capacity(records.len());
+    for (idx, record) in records.into_iter().enumerate() {
+        if record.len() != header.len() {
+            return Err(YamlBaseError::Database {
+                message: format!(
+                    "Row {} has {} fields but the header has {}",
+                    idx + 1,
+                    record.len(),
+                    header.len()
+                ),
+            });
+        }
+        let mut row = base.clone();
+        for (cell, &target) in record.into_iter().zip(&targets) {
+            row[target] = match cell {
+                Some(text) => coercion::assign(Value::Text(text), &table.columns[target].sql_type)
+                    .map_err(|e| in_row(idx + 1, e))?,
+                None => Value::Null,
+            };
+        }
+        rows.push(row);
+    }
+    Ok(rows)
+}
+
+fn unknown_column(table: &Table, name: &str) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!("Table '{}' has no column '{}'", table.name, name),
+    }
+}
+
+fn in_row(row: usize, e: YamlBaseError) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!("Row {}: {}", row, e),
+    }
+}
+
+fn parse_csv_payload(body: &[u8]) -> Result<Payload, String> {
+    let (header, records) = parse_csv_with_header(body)?;
+    Ok(Payload::Csv { header, records })
+}
+
+/// The header row naming the columns of a CSV body, and the records after it
+pub(super) fn parse_csv_with_header(
+    body: &[u8],
+) -> Result<(Vec<String>, Vec<Vec<Option<String>>>), String> {
+    let text = std::str::from_utf8(body).map_err(|_| "CSV body is not UTF-8".to_string())?;
+    let mut records = parse_csv(text.strip_prefix('\u{feff}').unwrap_or(text))?.into_iter();
+    let header = records
+        .next()
+        .ok_or_else(|| "CSV body has no header row".to_string())?
+        .into_iter()
+        .map(|name| name.filter(|name| !name.is_empty()))
+        .collect::<Option<Vec<_>>>()
+        .ok_or_else(|| "CSV header has an empty column name".to_string())?;
+    Ok((header, records.collect()))
+}
+
+/// Records of RFC 4180 CSV. Unquoted empty fields are `None`, and blank lines
+/// are skipped.
+fn parse_csv(text: &str) -> Result<Vec<Vec<Option<String>>>, String> {
+    let mut records = Vec::new();
+    let mut record = Vec::new();
+    let mut field = String::new();
+    let mut quoted = false;
+    let mut in_quotes = false;
+    let mut line = 1;
+
+    let finish_field = |field: &mut String, quoted: &mut bool| {
+        let text = std::mem::take(field);
+        let cell = (*quoted || !text.is_empty()).then_some(text);
+        *quoted = false;
+        cell
+    };
+    let mut finish_record = |record: &mut Vec<Option<String>>| {
+        let record = std::mem::take(record);
+        if record != [None] {
+            records.push(record);
+        }
+    };
+
+    let mut chars = text.chars().peekable();
+    while let Some(c) = chars.next() {
+        if in_quotes {
+            match c {
+                '"' if chars.peek() == Some(&'"') => {
+                    chars.next();
+                    field.push('"');
+                }
+                '"' => in_quotes = false,
+                c => {
+                    if c == '\n' {
+                        line += 1;
+                    }
+                    field.push(c);
+                }
+            }
+            continue;
+        }
+        match c {
+            '"' if field.is_empty() && !quoted => {
+                in_quotes = true;
+                quoted = true;
+            }
+            ',' => record.push(finish_field(&mut field, &mut quoted)),
+            '\r' if chars.peek() == Some(&'\n') => {}
+            '\n' => {
+                record.push(finish_field(&mut field, &mut quoted));
+                finish_record(&mut record);
+                line += 1;
+            }
+            c => field.push(c),
+        }
+    }
+    if in_quotes {
+        return Err(format!("Unterminated quoted field on line {}", line));
+    }
+    if quoted || !field.is_empty() || !record.is_empty() {
+        record.push(finish_field(&mut field, &mut quoted));
+        finish_record(&mut record);
+    }
+    Ok(records)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cells(record: &[&str]) -> Vec<Option<String>> {
+        record
+            .iter()
+            .map(|cell| (!cell.is_empty()).then(|| cell.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn test_parse_csv() {
+        let records =
+            parse_csv("id,name,note\r\n1,\"Smith, J\",\n\n2,\"say \"\"hi\"\"\n now\",\"\"")
+                .unwrap();
+        assert_eq!(
+            records,
+            vec![
+                cells(&["id", "name", "note"]),
+                cells(&["1", "Smith, J", ""]),
+                vec![
+                    Some("2".to_string()),
+                    Some("say \"hi\"\n now".to_string()),
+                    Some(String::new()),
+                ],
+            ]
+        );
+        assert!(parse_csv("id\n\"open").is_err());
+    }
+}
@@ -0,0 +1,45 @@
+//! Endpoints for query budgets: start a scenario, run the test, then check it.
+
+use super::AdminState;
+use super::http::Response;
+
+/// `GET /scenarios` reports every declared scenario's latest run
+pub(super) fn list_scenarios(state: &AdminState) -> Response {
+    let budgets = state.storage.query_budgets();
+    let reports: Vec<_> = budgets
+        .scenario_names()
+        .filter_map(|name| budgets.report(name))
+        .collect();
+    Response::json(200, &reports)
+}
+
+/// `POST /scenarios/NAME/start` counts subsequent queries against NAME's budget
+pub(super) fn start_scenario(state: &AdminState, name: &str) -> Response {
+    if !state.storage.query_budgets().start(name) {
+        return unknown_scenario(name);
+    }
+    Response::json(
+        200,
+        &serde_json::json!({ "scenario": name, "active": true }),
+    )
+}
+
+/// `POST /scenarios/stop` stops counting queries
+pub(super) fn stop_scenario(state: &AdminState) -> Response {
+    let budgets = state.storage.query_budgets();
+    let stopped = budgets.active();
+    budgets.stop();
+    Response::json(200, &serde_json::json!({ "stopped": stopped }))
+}
+
+/// `GET /scenarios/NAME/check` answers 200 if the budget held and 409 with the violations if not
+pub(super) fn check_scenario(state: &AdminState, name: &str) -> Response {
+    match state.storage.query_budgets().report(name) {
+        Some(report) => Response::json(if report.ok { 200 } else { 409 }, &report),
+        None => unknown_scenario(name),
+    }
+}
+
+fn unknown_scenario(name: &str) -> Response {
+    Response::error(404, format!("Unknown scenario '{}'", name))
+}
@@ -0,0 +1,14 @@
+//! Endpoint reporting the open sessions and their use of the connection quotas.
+
+use super::AdminState;
+use super::http::Response;
+
+/// `GET /connections` counts the open sessions per user and per database,
+/// next to the quotas and how many logins they refused, and lists them
+pub(super) fn connections(state: &AdminState) -> Response {
+    let sessions = state.storage.sessions();
+    Response::json(
+        200,
+        &serde_json::json!({ "usage": sessions.usage(), "sessions": sessions.list() }),
+    )
+}
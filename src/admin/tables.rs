@@ -0,0 +1,51 @@
+//! Endpoints describing the dataset's tables: the columns and their
+//! annotations, and the tables that `--skip-invalid` left out.
+
+use super::AdminState;
+use super::http::{Request, Response};
+use crate::sql::catalog::data_type;
+
+/// `GET /tables/columns[?table=NAME]` lists the columns of every table, or of
+/// one, with what their `annotations` say about them
+pub(super) async fn columns(state: &AdminState, request: &Request) -> Response {
+    let db = state.storage.database();
+    let db = db.read().await;
+    let tables: Vec<_> = match request.query_param("table") {
+        None => db.tables.values().collect(),
+        Some(name) => match db.get_table(name) {
+            Some(table) => vec![table],
+            None => return Response::error(404, format!("Unknown table '{}'", name)),
+        },
+    };
+    let columns: Vec<_> = tables
+        .into_iter()
+        .flat_map(|table| {
+            let annotations = db.annotations.get(&table.name);
+            table.columns.iter().map(move |column| {
+                let annotation = annotations.and_then(|a| a.get(&column.name));
+                serde_json::json!({
+                    "table": table.name,
+                    "column": column.name,
+                    "type": data_type(&column.sql_type),
+                    "nullable": column.nullable,
+                    "description": annotation.and_then(|a| a.description.as_ref()),
+                    "source": annotation.and_then(|a| a.source.as_ref()),
+                    "pii": annotation.is_some_and(|a| a.pii),
+                })
+            })
+        })
+        .collect();
+    Response::json(200, &columns)
+}
+
+/// `GET /tables/errors` lists the tables that failed to load and why
+pub(super) async fn errored_tables(state: &AdminState) -> Response {
+    let db = state.storage.database();
+    let db = db.read().await;
+    let tables: Vec<_> = db
+        .errored_tables
+        .iter()
+        .map(|(table, error)| serde_json::json!({ "table": table, "error": error }))
+        .collect();
+    Response::json(200, &tables)
+}
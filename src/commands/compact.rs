@@ -0,0 +1,153 @@
+//! `yamlbase compact`: fold a `--persist` write-ahead log back into its YAML file.
+//!
+//! The YAML file is rewritten from the replayed data, so comments and
+//! formatting in the `data` sections are not preserved. Stop the server before
+//! compacting; a running server would keep appending to the removed log.
+
+use anyhow::Context;
+use clap::Args;
+use std::path::{Path, PathBuf};
+
+use crate::database::Storage;
+use crate::database::wal::{self, WalRecord, WriteAheadLog};
+use crate::yaml::parse_yaml_database;
+use crate::yaml::writer::{render_dataset, write_atomically};
+
+#[derive(Debug, Clone, Args)]
+pub struct CompactArgs {
+    #[arg(
+        short,
+        long,
+        value_name = "FILE",
+        help = "YAML database file the log was written against"
+    )]
+    pub file: PathBuf,
+
+    #[arg(
+        long,
+        value_name = "FILE",
+        help = "Write-ahead log to fold in (default: the YAML file path plus .wal)"
+    )]
+    pub wal_file: Option<PathBuf>,
+}
+
+pub async fn run(args: CompactArgs) -> anyhow::Result<()> {
+    let wal_path = args
+        .wal_file
+        .clone()
+        .unwrap_or_else(|| wal::default_path(&args.file));
+    if !tokio::fs::try_exists(&wal_path).await? {
+        println!(
+            "No write-ahead log at {}; nothing to compact",
+            wal_path.display()
+        );
+        return Ok(());
+    }
+
+    let content = tokio::fs::read_to_string(&args.file)
+        .await
+        .with_context(|| format!("Failed to read {}", args.file.display()))?;
+    let (log, records) = WriteAheadLog::open(&wal_path, content.as_bytes()).await?;
+    drop(log);
+
+    if !records.is_empty() {
+        let compacted = compact(&args.file, &content, &records).await?;
+        write_atomically(&args.file, &compacted)
+            .await
+            .with_context(|| format!("Failed to replace {}", args.file.display()))?;
+    }
+    tokio::fs::remove_file(&wal_path)
+        .await
+        .with_context(|| format!("Failed to remove {}", wal_path.display()))?;
+
+    println!(
+        "Folded {} logged write(s) from {} into {}",
+        records.len(),
+        wal_path.display(),
+        args.file.display()
+    );
+    Ok(())
+}
+
+/// Replay `records` onto the dataset and render it back to YAML
+async fn compact(file: &Path, content: &str, records: &[WalRecord]) -> anyhow::Result<String> {
+    let (database, _) = parse_yaml_database(file).await?;
+    let storage = Storage::new(database);
+    wal::replay(&storage, records)
+        .await
+        .context("Failed to replay write-ahead log")?;
+
+    let db = storage.database();
+    let db = db.read().await;
+    Ok(render_dataset(content, &db)?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{RowChange, Value};
+    use std::sync::Arc;
+
+    const DATASET: &str = r#"
+database:
+  name: shop
+tables:
+  products:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "TEXT NOT NULL"
+      price: "DECIMAL(10,2)"
+    data:
+      - id: 1
+        name: "Widget"
+        price: 9.99
+      - id: 2
+        name: "Gadget"
+"#;
+
+    #[tokio::test]
+    async fn test_compact_folds_log_into_yaml() {
+        let dir = std::env::temp_dir().join(format!("yamlbase-compact-{}", uuid::Uuid::new_v4()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let file = dir.join("shop.yaml");
+        std::fs::write(&file, DATASET).unwrap();
+        let wal_path = wal::default_path(&file);
+
+        let (log, _) = WriteAheadLog::open(&wal_path, DATASET.as_bytes())
+            .await
+            .unwrap();
+        let (database, _) = parse_yaml_database(&file).await.unwrap();
+        let storage = Storage::new(database).with_wal(Arc::new(log));
+        storage
+            .write_table("products", |_| {
+                Ok(vec![
+                    RowChange::Delete { index: 0 },
+                    RowChange::Insert(vec![
+                        Value::Integer(3),
+                        Value::Text("Gizmo".to_string()),
+                        Value::Decimal("4.50".parse().unwrap()),
+                    ]),
+                ])
+            })
+            .await
+            .unwrap();
+        drop(storage);
+
+        run(CompactArgs {
+            file: file.clone(),
+            wal_file: None,
+        })
+        .await
+        .unwrap();
+
+        assert!(!wal_path.exists());
+        let (database, _) = parse_yaml_database(&file).await.unwrap();
+        let products = database.get_table("products").unwrap();
+        assert_eq!(products.rows.len(), 2);
+        assert_eq!(products.rows[0][0], Value::Integer(2));
+        assert_eq!(products.rows[0][2], Value::Null);
+        assert_eq!(products.rows[1][1], Value::Text("Gizmo".to_string()));
+
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
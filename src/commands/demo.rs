@@ -0,0 +1,99 @@
+//! `yamlbase demo`: serve a built-in example dataset, with no files to write
+//! first.
+
+use anyhow::Context;
+use clap::{Args, Parser};
+use std::ffi::OsString;
+
+use crate::config::{Config, Protocol};
+use crate::server::Server;
+
+/// The demo dataset: a small online shop with customers, products, orders and
+/// order line items
+pub const DEMO_DATASET: &str = include_str!("datasets/demo.yaml");
+
+#[derive(Debug, Clone, Args)]
+pub struct DemoArgs {
+    #[arg(
+        value_name = "SERVER_OPTIONS",
+        trailing_var_arg = true,
+        allow_hyphen_values = true,
+        help = "Server options, e.g. --protocol mysql or --port 15432"
+    )]
+    pub server_args: Vec<String>,
+}
+
+pub async fn run(args: DemoArgs) -> anyhow::Result<()> {
+    // The server loads (and may watch) its dataset from disk
+    let path = std::env::temp_dir().join(format!("yamlbase-demo-{}.yaml", std::process::id()));
+    tokio::fs::write(&path, DEMO_DATASET)
+        .await
+        .with_context(|| format!("Failed to write {}", path.display()))?;
+
+    let config = Config::try_parse_from(
+        [
+            OsString::from("yamlbase"),
+            "-f".into(),
+            path.into_os_string(),
+        ]
+        .into_iter()
+        .chain(args.server_args.into_iter().map(OsString::from)),
+    )
+    .unwrap_or_else(|e| e.exit());
+    config.init_logging()?;
+
+    let hint = connection_hint(&config);
+    let server = Server::new(config).await?;
+    println!("{}", hint);
+    server.run().await?;
+    Ok(())
+}
+
+/// What to run to connect a client to the demo, and a query to start with
+fn connection_hint(config: &Config) -> String {
+    let port = config.effective_port();
+    let client = match config.protocol {
+        Protocol::Postgres => format!(
+            "psql -h localhost -p {} -U {} -d demo   (password: {})",
+            port, config.username, config.password
+        ),
+        Protocol::Mysql => format!(
+            "mysql -h 127.0.0.1 -P {} -u {} -p{} demo",
+            port, config.username, config.password
+        ),
+        Protocol::Sqlserver => format!(
+            "sqlcmd -S localhost,{} -U {} -P {} -d demo",
+            port, config.username, config.password
+        ),
+    };
+
+    format!(
+        "Serving the demo shop database (customers, products, orders, order_items) on port {}.\n\
+         Connect with:\n  {}\n\
+         Then try:\n  SELECT name, price FROM products ORDER BY price DESC;",
+        port, client
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::yaml::parser::build_database;
+    use crate::yaml::{YamlDatabase, validate_yaml_str};
+
+    #[test]
+    fn test_demo_dataset_is_valid() {
+        assert_eq!(validate_yaml_str(DEMO_DATASET), vec![]);
+
+        let yaml_db: YamlDatabase = serde_yaml::from_str(DEMO_DATASET).unwrap();
+        let (database, _) = build_database(&yaml_db).unwrap();
+        assert_eq!(database.name, "demo");
+        assert_eq!(database.get_table("order_items").unwrap().rows.len(), 8);
+    }
+
+    #[test]
+    fn test_connection_hint_follows_the_server_options() {
+        let config = Config::parse_from(["yamlbase", "-f", "demo.yaml", "--protocol", "mysql"]);
+        assert!(connection_hint(&config).contains("mysql -h 127.0.0.1 -P 3306 -u admin"));
+    }
+}
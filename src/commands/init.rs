@@ -0,0 +1,82 @@
+//! `yamlbase init`: write a starter dataset to edit, so a new project can be
+//! served right away.
+
+use anyhow::{Context, bail};
+use clap::Args;
+use std::path::{Path, PathBuf};
+
+/// Starter dataset: the `database` section with name and credentials, and two
+/// related example tables
+pub const STARTER_DATASET: &str = include_str!("datasets/starter.yaml");
+
+const STARTER_FILE: &str = "database.yaml";
+
+#[derive(Debug, Clone, Args)]
+pub struct InitArgs {
+    #[arg(
+        value_name = "DIR",
+        default_value = ".",
+        help = "Directory to write database.yaml into (created if missing)"
+    )]
+    pub dir: PathBuf,
+
+    #[arg(long, help = "Overwrite an existing database.yaml")]
+    pub force: bool,
+}
+
+pub async fn run(args: InitArgs) -> anyhow::Result<()> {
+    let path = init(&args.dir, args.force).await?;
+
+    println!("Wrote {}", path.display());
+    println!();
+    println!("Serve it:    yamlbase -f {}", path.display());
+    println!("Connect:     psql -h localhost -p 5432 -U admin -d my_app   (password: password)");
+    println!("Check edits: yamlbase validate {}", path.display());
+    Ok(())
+}
+
+async fn init(dir: &Path, force: bool) -> anyhow::Result<PathBuf> {
+    tokio::fs::create_dir_all(dir)
+        .await
+        .with_context(|| format!("Failed to create {}", dir.display()))?;
+
+    let path = dir.join(STARTER_FILE);
+    if !force && tokio::fs::try_exists(&path).await? {
+        bail!(
+            "{} already exists (use --force to overwrite)",
+            path.display()
+        );
+    }
+    tokio::fs::write(&path, STARTER_DATASET)
+        .await
+        .with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(path)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::yaml::{parse_yaml_database, validate_yaml_str};
+
+    #[tokio::test]
+    async fn test_init_writes_a_valid_dataset_once() {
+        let dir = tempfile::tempdir().unwrap();
+        let project = dir.path().join("project");
+
+        let path = init(&project, false).await.unwrap();
+        assert_eq!(validate_yaml_str(STARTER_DATASET), vec![]);
+        let (database, auth) = parse_yaml_database(&path).await.unwrap();
+        assert_eq!(database.name, "my_app");
+        assert_eq!(auth.unwrap().username, "admin");
+
+        tokio::fs::write(&path, "edited").await.unwrap();
+        assert!(init(&project, false).await.is_err());
+        assert_eq!(tokio::fs::read_to_string(&path).await.unwrap(), "edited");
+
+        init(&project, true).await.unwrap();
+        assert_eq!(
+            tokio::fs::read_to_string(&path).await.unwrap(),
+            STARTER_DATASET
+        );
+    }
+}
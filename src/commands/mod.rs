@@ -0,0 +1,68 @@
+//! Auxiliary subcommands that run instead of the server, e.g. `yamlbase scaffold ...`.
+//!
+//! The server itself is still configured through [`crate::Config`] so existing
+//! invocations (`yamlbase -f db.yaml`) keep working unchanged. A subcommand is
+//! only recognised when it is the first argument on the command line.
+
+use clap::{CommandFactory, Parser, Subcommand};
+
+pub mod compact;
+pub mod conformance;
+pub mod demo;
+pub mod doctor;
+pub mod init;
+pub mod replay;
+pub mod router;
+pub mod scaffold;
+pub mod validate;
+
+#[derive(Debug, Parser)]
+#[command(name = "yamlbase")]
+#[command(author, version, about, long_about = None)]
+pub struct Cli {
+    #[command(subcommand)]
+    pub command: Command,
+}
+
+#[derive(Debug, Subcommand)]
+pub enum Command {
+    /// Fold a --persist write-ahead log back into its YAML file
+    Compact(compact::CompactArgs),
+    /// Diff query results against real PostgreSQL / MySQL servers
+    Conformance(conformance::ConformanceArgs),
+    /// Serve a built-in example dataset to try out clients
+    Demo(demo::DemoArgs),
+    /// Check a server configuration and print client connection strings
+    Doctor(doctor::DoctorArgs),
+    /// Write a starter dataset to edit and serve
+    Init(init::InitArgs),
+    /// Re-run a captured query log against a dataset and report differences
+    Replay(replay::ReplayArgs),
+    /// Route PostgreSQL connections to the instance serving their database
+    Router(router::RouterArgs),
+    /// Generate a YAML dataset skeleton by introspecting a live database
+    Scaffold(scaffold::ScaffoldArgs),
+    /// Check dataset files for errors, or print the dataset JSON Schema
+    Validate(validate::ValidateArgs),
+}
+
+/// Returns true when the process was invoked as `yamlbase <subcommand> ...`.
+pub fn is_subcommand_invocation() -> bool {
+    std::env::args()
+        .nth(1)
+        .is_some_and(|arg| Cli::command().find_subcommand(&arg).is_some())
+}
+
+pub async fn run(cli: Cli) -> anyhow::Result<()> {
+    match cli.command {
+        Command::Compact(args) => compact::run(args).await,
+        Command::Conformance(args) => conformance::run(args).await,
+        Command::Demo(args) => demo::run(args).await,
+        Command::Doctor(args) => doctor::run(args).await,
+        Command::Init(args) => init::run(args).await,
+        Command::Replay(args) => replay::run(args).await,
+        Command::Router(args) => router::run(args).await,
+        Command::Scaffold(args) => scaffold::run(args).await,
+        Command::Validate(args) => validate::run(args).await,
+    }
+}
@@ -0,0 +1,722 @@
+//! `yamlbase replay`: re-run a captured query log against a dataset and report
+//! where the results and latencies differ from the logged run.
+//!
+//! Three kinds of log are read:
+//!
+//! - PostgreSQL's server log, written with `log_min_duration_statement = 0`
+//!   or, without durations, `log_statement = 'all'`. Statements of the
+//!   extended protocol get the values of their `parameters:` line, and
+//!   statements followed by an `ERROR:` line are known to have failed.
+//! - MySQL's general query log (`general_log = ON`).
+//! - JSON lines, from a proxy or a script, one statement per line:
+//!
+//! ```json
+//! {"sql": "SELECT * FROM orders WHERE id = 7", "at": "2024-01-31T12:00:00.125Z", "duration_ms": 0.8, "rows": 1}
+//! ```
+//!
+//! Everything but `sql` is optional; `error` marks a statement that failed.
+//!
+//! The dataset is served by an in-process yamlbase speaking the log's wire
+//! protocol, and the statements run in order on one connection, at full speed
+//! or, with `--original-timing`, as far apart as their timestamps. A statement
+//! that fails where the log has it succeed (or the reverse), or returns another
+//! number of rows than logged, is a result difference. One that runs more than
+//! `--slowdown` times as long as logged, and at least a millisecond longer, is
+//! listed as slower. Writes change the in-memory dataset only.
+
+use anyhow::{Context, bail};
+use chrono::{DateTime, NaiveDateTime};
+use clap::Args;
+use mysql::prelude::Queryable;
+use serde::Deserialize;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio_postgres::{NoTls, SimpleQueryMessage};
+
+use crate::commands::conformance::{Engine, serve_yamlbase};
+use crate::database::Storage;
+use crate::yaml::parse_yaml_database;
+
+/// Slowdowns smaller than this are noise, whatever the factor
+const MIN_SLOWDOWN: Duration = Duration::from_millis(1);
+/// Differences listed in full; the rest are only counted
+const LISTED: usize = 20;
+
+#[derive(Debug, Clone, Args)]
+pub struct ReplayArgs {
+    #[arg(value_name = "LOG", help = "Query log to replay")]
+    pub log: PathBuf,
+
+    #[arg(
+        short,
+        long,
+        value_name = "FILE",
+        help = "YAML database file to replay the log against"
+    )]
+    pub file: PathBuf,
+
+    #[arg(
+        long,
+        value_enum,
+        default_value = "auto",
+        help = "How the log is written"
+    )]
+    pub format: LogFormat,
+
+    #[arg(
+        long,
+        value_enum,
+        help = "Wire protocol to replay a JSON lines log over [default: postgres]"
+    )]
+    pub engine: Option<Engine>,
+
+    #[arg(
+        long,
+        help = "Space the statements as far apart as their logged timestamps instead of replaying at full speed"
+    )]
+    pub original_timing: bool,
+
+    #[arg(
+        long,
+        value_name = "FACTOR",
+        default_value_t = 2.0,
+        help = "List statements that run this many times as long as logged"
+    )]
+    pub slowdown: f64,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum LogFormat {
+    /// Tell from the content
+    Auto,
+    /// PostgreSQL server log
+    Postgres,
+    /// MySQL general query log
+    Mysql,
+    /// One JSON object per line
+    Jsonl,
+}
+
+/// A statement as the log has it
+#[derive(Debug, Clone, Default, PartialEq)]
+struct Logged {
+    /// Line of the log the statement starts on
+    line: usize,
+    sql: String,
+    at: Option<NaiveDateTime>,
+    duration: Option<Duration>,
+    rows: Option<u64>,
+    error: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct JsonEntry {
+    sql: String,
+    #[serde(default)]
+    at: Option<String>,
+    #[serde(default)]
+    duration_ms: Option<f64>,
+    #[serde(default)]
+    rows: Option<u64>,
+    #[serde(default)]
+    error: Option<String>,
+}
+
+/// A replayed statement's row count, or the error it failed with
+type Outcome = Result<u64, String>;
+
+struct Replayed {
+    elapsed: Duration,
+    outcome: Outcome,
+}
+
+pub async fn run(args: ReplayArgs) -> anyhow::Result<()> {
+    if args.slowdown.is_nan() || args.slowdown <= 0.0 {
+        bail!("--slowdown must be a positive factor");
+    }
+    let content = tokio::fs::read_to_string(&args.log)
+        .await
+        .with_context(|| format!("Failed to read {}", args.log.display()))?;
+    let format = match args.format {
+        LogFormat::Auto => detect_format(&content),
+        format => format,
+    };
+    let logged = match format {
+        LogFormat::Postgres => parse_postgres_log(&content),
+        LogFormat::Mysql => parse_mysql_log(&content),
+        _ => parse_json_lines(&content)
+            .with_context(|| format!("Invalid query log {}", args.log.display()))?,
+    };
+    if logged.is_empty() {
+        bail!("No statements found in {}", args.log.display());
+    }
+    let engine = match format {
+        LogFormat::Mysql => Engine::Mysql,
+        LogFormat::Postgres => Engine::Postgres,
+        _ => args.engine.unwrap_or(Engine::Postgres),
+    };
+
+    let (database, auth) = parse_yaml_database(&args.file).await?;
+    let (username, password) = match auth {
+        Some(auth) => (auth.username, auth.password),
+        None => ("admin".to_string(), "password".to_string()),
+    };
+    let name = database.name.clone();
+    let storage = Arc::new(Storage::new(database));
+    let port = serve_yamlbase(&args.file, &storage, engine, &username, &password).await?;
+
+    let started = Instant::now();
+    let replayed = match engine {
+        Engine::Postgres => {
+            let mut config = tokio_postgres::Config::new();
+            config
+                .host("127.0.0.1")
+                .port(port)
+                .user(&username)
+                .password(&password)
+                .dbname(&name);
+            let (client, connection) = config
+                .connect(NoTls)
+                .await
+                .context("Failed to connect to yamlbase over the PostgreSQL protocol")?;
+            tokio::spawn(connection);
+            replay_postgres(&client, &logged, args.original_timing).await
+        }
+        Engine::Mysql => {
+            let opts = mysql::OptsBuilder::new()
+                .ip_or_hostname(Some("127.0.0.1"))
+                .tcp_port(port)
+                .user(Some(username))
+                .pass(Some(password))
+                .db_name(Some(name));
+            let logged = logged.clone();
+            let original_timing = args.original_timing;
+            tokio::task::spawn_blocking(move || -> anyhow::Result<Vec<Replayed>> {
+                let mut conn = mysql::Conn::new(opts)
+                    .context("Failed to connect to yamlbase over the MySQL protocol")?;
+                Ok(replay_mysql(&mut conn, &logged, original_timing))
+            })
+            .await??
+        }
+    };
+
+    let differences = report(
+        &args.log,
+        &logged,
+        &replayed,
+        started.elapsed(),
+        args.slowdown,
+    );
+    if differences > 0 {
+        bail!(
+            "{} replayed statement(s) differ from the log in their results",
+            differences
+        );
+    }
+    Ok(())
+}
+
+/// PostgreSQL logs a `LOG:` line per statement, MySQL's general log a
+/// tab-separated `Query` line, and JSON lines start with a brace
+fn detect_format(content: &str) -> LogFormat {
+    let first = content.lines().find(|line| !line.trim().is_empty());
+    if first.is_some_and(|line| line.trim_start().starts_with('{')) {
+        LogFormat::Jsonl
+    } else if content.lines().any(|line| line.contains(" LOG:  ")) {
+        LogFormat::Postgres
+    } else {
+        LogFormat::Mysql
+    }
+}
+
+fn parse_json_lines(content: &str) -> anyhow::Result<Vec<Logged>> {
+    let mut logged = Vec::new();
+    for (idx, line) in content.lines().enumerate() {
+        if line.trim().is_empty() {
+            continue;
+        }
+        let entry: JsonEntry =
+            serde_json::from_str(line).with_context(|| format!("line {}", idx + 1))?;
+        let at = match &entry.at {
+            Some(at) => Some(
+                parse_timestamp(at)
+                    .with_context(|| format!("line {}: invalid timestamp '{}'", idx + 1, at))?,
+            ),
+            None => None,
+        };
+        logged.push(Logged {
+            line: idx + 1,
+            sql: entry.sql,
+            at,
+            duration: entry
+                .duration_ms
+                .map(|ms| Duration::from_secs_f64(ms.max(0.0) / 1000.0)),
+            rows: entry.rows,
+            error: entry.error,
+        });
+    }
+    Ok(logged)
+}
+
+/// RFC 3339, or a timestamp without a zone as the logs write them
+fn parse_timestamp(text: &str) -> Option<NaiveDateTime> {
+    if let Ok(at) = DateTime::parse_from_rfc3339(text) {
+        return Some(at.naive_utc());
+    }
+    ["%Y-%m-%dT%H:%M:%S%.f", "%Y-%m-%d %H:%M:%S%.f"]
+        .iter()
+        .find_map(|format| NaiveDateTime::parse_from_str(text, format).ok())
+}
+
+/// The statements of a PostgreSQL server log written with the default
+/// `log_line_prefix` (`%m [%p] `) or any other that starts with `%m` or `%t`
+fn parse_postgres_log(content: &str) -> Vec<Logged> {
+    let mut logged: Vec<Logged> = Vec::new();
+    // Whether continuation lines belong to the last statement
+    let mut continuing = false;
+    for (idx, line) in content.lines().enumerate() {
+        // A statement spanning lines continues on lines starting with a tab
+        if let Some(rest) = line.strip_prefix('\t') {
+            if let Some(last) = logged.last_mut().filter(|_| continuing) {
+                last.sql.push('\n');
+                last.sql.push_str(rest);
+            }
+            continue;
+        }
+        continuing = false;
+        let mut words = line.split_whitespace();
+        let at = match (words.next(), words.next()) {
+            (Some(date), Some(time)) => parse_timestamp(&format!("{} {}", date, time)),
+            _ => None,
+        };
+
+        if let Some((_, message)) = line.split_once("LOG:  ") {
+            let (duration, message) = match message.strip_prefix("duration: ") {
+                Some(rest) => {
+                    let (ms, rest) = rest.split_once(" ms").unwrap_or((rest, ""));
+                    let duration = ms
+                        .trim()
+                        .parse::<f64>()
+                        .ok()
+                        .map(|ms| Duration::from_secs_f64(ms.max(0.0) / 1000.0));
+                    (duration, rest.trim_start())
+                }
+                None => (None, message),
+            };
+            let sql = message.strip_prefix("statement: ").or_else(|| {
+                // `execute <unnamed>: ...`; parse and bind steps are not statements
+                let rest = message.strip_prefix("execute ")?;
+                Some(rest.split_once(": ")?.1)
+            });
+            match sql {
+                Some(sql) => {
+                    logged.push(Logged {
+                        line: idx + 1,
+                        sql: sql.to_string(),
+                        at,
+                        duration,
+                        ..Logged::default()
+                    });
+                    continuing = true;
+                }
+                // `log_duration` logs the duration on a line of its own
+                None if message.is_empty() => {
+                    if let Some(last) = logged.last_mut().filter(|last| last.duration.is_none()) {
+                        last.duration = duration;
+                    }
+                }
+                None => {}
+            }
+        } else if let Some((_, parameters)) = line.split_once("DETAIL:  parameters: ") {
+            if let Some(last) = logged.last_mut() {
+                last.sql = substitute_parameters(&last.sql, parameters);
+            }
+        } else if let Some((_, error)) = line.split_once("ERROR:  ") {
+            // Failed statements are logged before the error, or after it as
+            // `STATEMENT:` when they were not logged on their own
+            if let Some(last) = logged.last_mut().filter(|last| last.duration.is_none()) {
+                last.error.get_or_insert_with(|| error.to_string());
+            } else {
+                logged.push(Logged {
+                    line: idx + 1,
+                    at,
+                    error: Some(error.to_string()),
+                    ..Logged::default()
+                });
+            }
+        } else if let Some((_, sql)) = line.split_once("STATEMENT:  ") {
+            if let Some(last) = logged.last_mut() {
+                if last.sql.is_empty() {
+                    last.sql = sql.to_string();
+                    continuing = true;
+                }
+            }
+        }
+    }
+    // An error whose statement was not logged cannot be replayed
+    logged.retain(|statement| !statement.sql.is_empty());
+    logged
+}
+
+/// `sql` with the values of a `parameters: $1 = '42', $2 = NULL` line in
+/// place of its placeholders
+fn substitute_parameters(sql: &str, parameters: &str) -> String {
+    let mut values = Vec::new();
+    let mut rest = parameters.trim();
+    while let Some(after) = rest.strip_prefix('$') {
+        let Some((number, after)) = after.split_once(" = ") else {
+            break;
+        };
+        let Ok(number) = number.parse::<usize>() else {
+            break;
+        };
+        let (value, after) = if let Some(after) = after.strip_prefix("NULL") {
+            ("NULL".to_string(), after)
+        } else if after.starts_with('\'') {
+            // A literal's quotes are doubled inside it
+            let mut end = 1;
+            let bytes = after.as_bytes();
+            while end < bytes.len() {
+                if bytes[end] == b'\'' {
+                    if bytes.get(end + 1) == Some(&b'\'') {
+                        end += 2;
+                        continue;
+                    }
+                    break;
+                }
+                end += 1;
+            }
+            let end = (end + 1).min(after.len());
+            (after[..end].to_string(), &after[end..])
+        } else {
+            break;
+        };
+        values.push((number, value));
+        rest = after.trim_start_matches(", ");
+    }
+
+    // `$10` before `$1`, so that one is not read as the other
+    values.sort_by(|a, b| b.0.cmp(&a.0));
+    let mut sql = sql.to_string();
+    for (number, value) in values {
+        sql = sql.replace(&format!("${}", number), &value);
+    }
+    sql
+}
+
+/// The `Query` and `Execute` lines of a MySQL general query log, in the
+/// 5.7+ format (`2024-01-31T12:00:00.123456Z\t   10 Query\tSELECT 1`) or the
+/// older one that leaves out repeated times
+fn parse_mysql_log(content: &str) -> Vec<Logged> {
+    let mut logged: Vec<Logged> = Vec::new();
+    let mut last_at = None;
+    let mut continuing = false;
+    for (idx, line) in content.lines().enumerate() {
+        let entry = line.split_once('\t').and_then(|(time, rest)| {
+            let (id_command, argument) = rest.trim_start_matches('\t').split_once('\t')?;
+            let (id, command) = id_command.trim().split_once(' ')?;
+            id.parse::<u64>().ok()?;
+            Some((time.trim(), command.trim(), argument))
+        });
+        let Some((time, command, argument)) = entry else {
+            // A statement spanning lines continues on lines of its own
+            if let Some(last) = logged.last_mut().filter(|_| continuing) {
+                last.sql.push('\n');
+                last.sql.push_str(line);
+            }
+            continue;
+        };
+        if !time.is_empty() {
+            last_at = parse_timestamp(time)
+                .or_else(|| NaiveDateTime::parse_from_str(time, "%y%m%d %H:%M:%S").ok());
+        }
+        continuing = matches!(command, "Query" | "Execute");
+        if continuing {
+            logged.push(Logged {
+                line: idx + 1,
+                sql: argument.to_string(),
+                at: last_at,
+                ..Logged::default()
+            });
+        }
+    }
+    logged
+}
+
+/// How long to wait before `statement`, to keep it as far from the first
+/// timestamped statement as it was logged
+fn replay_delay(
+    statement: &Logged,
+    first_at: Option<NaiveDateTime>,
+    started: Instant,
+) -> Option<Duration> {
+    let offset = (statement.at? - first_at?).to_std().ok()?;
+    offset.checked_sub(started.elapsed())
+}
+
+async fn replay_postgres(
+    client: &tokio_postgres::Client,
+    logged: &[Logged],
+    original_timing: bool,
+) -> Vec<Replayed> {
+    let first_at = logged.iter().find_map(|statement| statement.at);
+    let started = Instant::now();
+    let mut replayed = Vec::new();
+    for statement in logged {
+        if original_timing {
+            if let Some(delay) = replay_delay(statement, first_at, started) {
+                tokio::time::sleep(delay).await;
+            }
+        }
+        let began = Instant::now();
+        let outcome = client
+            .simple_query(&statement.sql)
+            .await
+            .map(|messages| {
+                messages
+                    .iter()
+                    .filter(|message| matches!(message, SimpleQueryMessage::Row(_)))
+                    .count() as u64
+            })
+            .map_err(|e| e.to_string());
+        replayed.push(Replayed {
+            elapsed: began.elapsed(),
+            outcome,
+        });
+    }
+    replayed
+}
+
+fn replay_mysql(conn: &mut mysql::Conn, logged: &[Logged], original_timing: bool) -> Vec<Replayed> {
+    let first_at = logged.iter().find_map(|statement| statement.at);
+    let started = Instant::now();
+    let mut replayed = Vec::new();
+    for statement in logged {
+        if original_timing {
+            if let Some(delay) = replay_delay(statement, first_at, started) {
+                std::thread::sleep(delay);
+            }
+        }
+        let began = Instant::now();
+        let outcome = conn
+            .query::<mysql::Row, _>(&statement.sql)
+            .map(|rows| rows.len() as u64)
+            .map_err(|e| e.to_string());
+        replayed.push(Replayed {
+            elapsed: began.elapsed(),
+            outcome,
+        });
+    }
+    replayed
+}
+
+/// How the replay's `outcome` differs from the logged one, if it does
+fn result_difference(logged: &Logged, outcome: &Outcome) -> Option<String> {
+    match (&logged.error, outcome) {
+        (Some(_), Err(_)) => None,
+        (Some(error), Ok(rows)) => Some(format!(
+            "succeeded with {} row(s), logged as failing: {}",
+            rows, error
+        )),
+        (None, Err(error)) => Some(format!("failed: {}", error)),
+        (None, Ok(rows)) => match logged.rows {
+            Some(expected) if expected != *rows => {
+                Some(format!("returned {} row(s), logged {}", rows, expected))
+            }
+            _ => None,
+        },
+    }
+}
+
+/// Whether `elapsed` is more than `slowdown` times the logged duration
+fn is_slower(logged: &Logged, elapsed: Duration, slowdown: f64) -> bool {
+    logged.duration.is_some_and(|duration| {
+        elapsed.as_secs_f64() > duration.as_secs_f64() * slowdown
+            && elapsed.saturating_sub(duration) >= MIN_SLOWDOWN
+    })
+}
+
+/// Print what the replay found, giving the number of result differences
+fn report(
+    log: &Path,
+    logged: &[Logged],
+    replayed: &[Replayed],
+    elapsed: Duration,
+    slowdown: f64,
+) -> usize {
+    let replay_times: Vec<Duration> = replayed.iter().map(|replay| replay.elapsed).collect();
+    let logged_times: Vec<Duration> = logged.iter().filter_map(|s| s.duration).collect();
+    println!(
+        "Replayed {} statement(s) from {} in {:.1?}",
+        replayed.len(),
+        log.display(),
+        elapsed
+    );
+    println!("  replayed latency: {}", latency_summary(&replay_times));
+    if !logged_times.is_empty() {
+        println!("  logged latency:   {}", latency_summary(&logged_times));
+    }
+
+    let mut differences = 0;
+    let mut slower = 0;
+    for (statement, replay) in logged.iter().zip(replayed) {
+        if let Some(difference) = result_difference(statement, &replay.outcome) {
+            differences += 1;
+            if differences <= LISTED {
+                println!(
+                    "DIFFERS  line {}: {}",
+                    statement.line,
+                    one_line(&statement.sql)
+                );
+                println!("         {}", difference);
+            }
+        } else if is_slower(statement, replay.elapsed, slowdown) {
+            slower += 1;
+            if slower <= LISTED {
+                println!(
+                    "SLOWER   line {}: {}",
+                    statement.line,
+                    one_line(&statement.sql)
+                );
+                println!(
+                    "         {:.1?} replayed, {:.1?} logged",
+                    replay.elapsed,
+                    statement.duration.unwrap_or_default()
+                );
+            }
+        }
+    }
+    if differences > LISTED || slower > LISTED {
+        println!("... only the first {} of each are listed", LISTED);
+    }
+    println!(
+        "\n{} result difference(s), {} statement(s) over {}x slower than logged",
+        differences, slower, slowdown
+    );
+    differences
+}
+
+/// Median, 95th percentile and slowest of `times`
+fn latency_summary(times: &[Duration]) -> String {
+    let mut times = times.to_vec();
+    times.sort();
+    let at = |fraction: f64| {
+        let idx = ((times.len() as f64 - 1.0) * fraction).round() as usize;
+        times.get(idx).copied().unwrap_or_default()
+    };
+    format!(
+        "p50 {:.1?}, p95 {:.1?}, max {:.1?}",
+        at(0.5),
+        at(0.95),
+        at(1.0)
+    )
+}
+
+/// `sql` on one line, cut to a readable length
+fn one_line(sql: &str) -> String {
+    let sql = sql.split_whitespace().collect::<Vec<_>>().join(" ");
+    match sql.char_indices().nth(100) {
+        Some((end, _)) => format!("{}...", &sql[..end]),
+        None => sql,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_postgres_logs_are_read() {
+        let log = "\
+2024-01-31 12:00:00.125 UTC [4242] LOG:  duration: 0.512 ms  statement: SELECT *
+\tFROM orders
+2024-01-31 12:00:00.300 UTC [4242] LOG:  duration: 0.050 ms  parse <unnamed>: SELECT name FROM users WHERE id = $1 AND note = $2
+2024-01-31 12:00:00.301 UTC [4242] LOG:  duration: 0.081 ms  execute <unnamed>: SELECT name FROM users WHERE id = $1 AND note = $2
+2024-01-31 12:00:00.301 UTC [4242] DETAIL:  parameters: $1 = '42', $2 = 'it''s'
+2024-01-31 12:00:01.000 UTC [4242] ERROR:  relation \"missing\" does not exist at character 15
+2024-01-31 12:00:01.000 UTC [4242] STATEMENT:  SELECT * FROM missing
+2024-01-31 12:00:02.000 UTC [4242] LOG:  checkpoint starting: time
+";
+        let logged = parse_postgres_log(log);
+        assert_eq!(logged.len(), 3);
+        assert_eq!(logged[0].sql, "SELECT *\nFROM orders");
+        assert_eq!(logged[0].duration, Some(Duration::from_micros(512)));
+        assert_eq!(logged[0].at, parse_timestamp("2024-01-31 12:00:00.125"));
+        assert_eq!(
+            logged[1].sql,
+            "SELECT name FROM users WHERE id = '42' AND note = 'it''s'"
+        );
+        assert_eq!(logged[1].line, 4);
+        assert_eq!(logged[2].sql, "SELECT * FROM missing");
+        assert!(logged[2].error.as_deref().unwrap().contains("missing"));
+        assert_eq!(detect_format(log), LogFormat::Postgres);
+    }
+
+    #[test]
+    fn test_mysql_general_logs_are_read() {
+        let log = "\
+/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:
+Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+Time                 Id Command    Argument
+2024-01-31T12:00:00.123456Z\t   10 Connect\tapp@localhost on shop using TCP/IP
+2024-01-31T12:00:00.124000Z\t   10 Query\tSELECT id
+FROM orders
+2024-01-31T12:00:00.200000Z\t   10 Query\tSELECT 1
+2024-01-31T12:00:00.300000Z\t   10 Quit\t
+";
+        let logged = parse_mysql_log(log);
+        assert_eq!(logged.len(), 2);
+        assert_eq!(logged[0].sql, "SELECT id\nFROM orders");
+        assert_eq!(logged[0].line, 5);
+        assert_eq!(logged[1].at, parse_timestamp("2024-01-31T12:00:00.2Z"));
+        assert_eq!(detect_format(log), LogFormat::Mysql);
+    }
+
+    #[test]
+    fn test_json_lines_are_read() {
+        let log = r#"{"sql": "SELECT 1", "at": "2024-01-31T12:00:00.125Z", "duration_ms": 2, "rows": 1}
+
+{"sql": "SELECT * FROM missing", "error": "no such table"}
+"#;
+        let logged = parse_json_lines(log).unwrap();
+        assert_eq!(logged.len(), 2);
+        assert_eq!(logged[0].duration, Some(Duration::from_millis(2)));
+        assert_eq!(logged[0].rows, Some(1));
+        assert_eq!(logged[1].line, 3);
+        assert_eq!(detect_format(log), LogFormat::Jsonl);
+        assert!(parse_json_lines(r#"{"query": "SELECT 1"}"#).is_err());
+    }
+
+    #[test]
+    fn test_differences_are_found() {
+        let logged = Logged {
+            rows: Some(3),
+            duration: Some(Duration::from_millis(2)),
+            ..Logged::default()
+        };
+        assert_eq!(result_difference(&logged, &Ok(3)), None);
+        assert_eq!(
+            result_difference(&logged, &Ok(2)).unwrap(),
+            "returned 2 row(s), logged 3"
+        );
+        assert!(result_difference(&logged, &Err("boom".to_string())).is_some());
+        let failed = Logged {
+            error: Some("boom".to_string()),
+            ..Logged::default()
+        };
+        assert_eq!(result_difference(&failed, &Err("bang".to_string())), None);
+        assert!(result_difference(&failed, &Ok(0)).is_some());
+
+        assert!(is_slower(&logged, Duration::from_millis(5), 2.0));
+        assert!(!is_slower(&logged, Duration::from_millis(3), 2.0));
+        // Twice as slow, but by less than a millisecond
+        let quick = Logged {
+            duration: Some(Duration::from_micros(100)),
+            ..Logged::default()
+        };
+        assert!(!is_slower(&quick, Duration::from_micros(300), 2.0));
+        assert!(!is_slower(&failed, Duration::from_secs(1), 2.0));
+    }
+}
@@ -0,0 +1,254 @@
+//! `yamlbase router`: accept PostgreSQL connections on one address and hand
+//! each to the instance serving the database it asks for.
+//!
+//! This spreads a large fixture suite over several instances, such as one pod
+//! per database started with `-f fixtures/ --database NAME`, behind a single
+//! endpoint. The router only reads the client's startup packet: it forwards it
+//! unchanged to the chosen instance and then relays bytes in both directions,
+//! so authentication and queries are handled by the instance. MySQL is not
+//! routed, because a MySQL client names its database only after answering
+//! the server's greeting, which the router cannot send on an instance's behalf.
+
+use bytes::{BufMut, BytesMut};
+use clap::Args;
+use std::collections::HashMap;
+use std::sync::Arc;
+use tokio::io::AsyncWriteExt;
+use tokio::net::{TcpListener, TcpStream};
+use tracing::{debug, info, warn};
+
+use crate::protocol::postgres::{parse_startup_parameters, read_startup_packet};
+
+const SSL_REQUEST: u32 = 80877103;
+const GSSENC_REQUEST: u32 = 80877104;
+const CANCEL_REQUEST: u32 = 80877102;
+
+#[derive(Debug, Clone, Args)]
+pub struct RouterArgs {
+    #[arg(
+        long,
+        default_value = "0.0.0.0:5432",
+        help = "Address to accept client connections on"
+    )]
+    pub listen: String,
+
+    #[arg(
+        long = "route",
+        value_name = "DATABASE=HOST:PORT",
+        env = "YAMLBASE_ROUTES",
+        value_delimiter = ',',
+        value_parser = parse_route,
+        help = "Send connections for DATABASE to the instance at HOST:PORT (repeatable, or comma-separated in YAMLBASE_ROUTES)"
+    )]
+    pub routes: Vec<(String, String)>,
+
+    #[arg(
+        long,
+        value_name = "HOST:PORT",
+        help = "Instance for connections to databases without a route"
+    )]
+    pub default_route: Option<String>,
+}
+
+fn parse_route(s: &str) -> Result<(String, String), String> {
+    match s.split_once('=') {
+        Some((database, addr)) if !database.is_empty() && !addr.is_empty() => {
+            Ok((database.to_string(), addr.to_string()))
+        }
+        _ => Err(format!("expected DATABASE=HOST:PORT, got '{}'", s)),
+    }
+}
+
+pub async fn run(args: RouterArgs) -> anyhow::Result<()> {
+    tracing_subscriber::fmt().with_target(false).init();
+    if args.routes.is_empty() && args.default_route.is_none() {
+        anyhow::bail!("Nothing to route to: pass --route DATABASE=HOST:PORT or --default-route");
+    }
+
+    let listener = TcpListener::bind(&args.listen).await?;
+    info!(
+        "Routing PostgreSQL connections on {} to {} instance(s)",
+        args.listen,
+        args.routes.len() + usize::from(args.default_route.is_some())
+    );
+    Arc::new(Router::new(args.routes, args.default_route))
+        .run(listener)
+        .await
+}
+
+/// Picks the instance for each connection by the database it names
+pub struct Router {
+    routes: HashMap<String, String>,
+    default_route: Option<String>,
+}
+
+impl Router {
+    pub fn new(routes: Vec<(String, String)>, default_route: Option<String>) -> Self {
+        Self {
+            routes: routes.into_iter().collect(),
+            default_route,
+        }
+    }
+
+    fn backend(&self, database: &str) -> Option<&str> {
+        self.routes
+            .get(database)
+            .or(self.default_route.as_ref())
+            .map(String::as_str)
+    }
+
+    pub async fn run(self: Arc<Self>, listener: TcpListener) -> anyhow::Result<()> {
+        loop {
+            let (client, client_addr) = listener.accept().await?;
+            let router = self.clone();
+            tokio::spawn(async move {
+                if let Err(e) = router.serve(client).await {
+                    warn!("Routing connection from {} failed: {}", client_addr, e);
+                }
+            });
+        }
+    }
+
+    async fn serve(&self, mut client: TcpStream) -> crate::Result<()> {
+        let mut buffer = BytesMut::new();
+        let mut length = read_startup_packet(&mut client, &mut buffer).await?;
+        let mut code = u32::from_be_bytes([buffer[4], buffer[5], buffer[6], buffer[7]]);
+        // Encryption is not offered, the same answer the instances give
+        while code == SSL_REQUEST || code == GSSENC_REQUEST {
+            client.write_all(b"N").await?;
+            let _ = buffer.split_to(length);
+            length = read_startup_packet(&mut client, &mut buffer).await?;
+            code = u32::from_be_bytes([buffer[4], buffer[5], buffer[6], buffer[7]]);
+        }
+        if code == CANCEL_REQUEST {
+            // Instances do not support cancelling queries
+            debug!("Ignoring cancel request");
+            return Ok(());
+        }
+
+        let parameters = parse_startup_parameters(&buffer[..length])?;
+        let parameter = |name: &str| {
+            parameters
+                .iter()
+                .find(|(key, _)| key == name)
+                .map(|(_, value)| value.as_str())
+        };
+        // Like PostgreSQL, the database defaults to the user name
+        let database = parameter("database")
+            .or_else(|| parameter("user"))
+            .unwrap_or_default()
+            .to_string();
+
+        let Some(addr) = self.backend(&database) else {
+            warn!("No route for database '{}'", database);
+            let message = format!("database \"{}\" does not exist", database);
+            client.write_all(&fatal_error("3D000", &message)).await?;
+            return Ok(());
+        };
+        debug!("Routing database '{}' to {}", database, addr);
+
+        let mut backend = match TcpStream::connect(addr).await {
+            Ok(backend) => backend,
+            Err(e) => {
+                let message = format!("instance for database \"{}\" is unavailable", database);
+                client.write_all(&fatal_error("08006", &message)).await?;
+                return Err(e.into());
+            }
+        };
+        backend.set_nodelay(true)?;
+        client.set_nodelay(true)?;
+        backend.write_all(&buffer).await?;
+        tokio::io::copy_bidirectional(&mut client, &mut backend).await?;
+        Ok(())
+    }
+}
+
+/// A FATAL ErrorResponse message
+fn fatal_error(code: &str, message: &str) -> BytesMut {
+    let mut fields = BytesMut::new();
+    for (field_type, value) in [(b'S', "FATAL"), (b'C', code), (b'M', message)] {
+        fields.put_u8(field_type);
+        fields.put_slice(value.as_bytes());
+        fields.put_u8(0);
+    }
+    fields.put_u8(0);
+
+    let mut buf = BytesMut::new();
+    buf.put_u8(b'E');
+    buf.put_u32(fields.len() as u32 + 4);
+    buf.put_slice(&fields);
+    buf
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::io::AsyncReadExt;
+
+    fn startup_packet(parameters: &[(&str, &str)]) -> Vec<u8> {
+        let mut body = 196608u32.to_be_bytes().to_vec();
+        for (key, value) in parameters {
+            body.extend_from_slice(key.as_bytes());
+            body.push(0);
+            body.extend_from_slice(value.as_bytes());
+            body.push(0);
+        }
+        body.push(0);
+        let mut packet = (body.len() as u32 + 4).to_be_bytes().to_vec();
+        packet.extend(body);
+        packet
+    }
+
+    #[test]
+    fn test_parse_route() {
+        assert_eq!(
+            parse_route("shop=shop-0.yamlbase:5432").unwrap(),
+            ("shop".to_string(), "shop-0.yamlbase:5432".to_string())
+        );
+        assert!(parse_route("shop").is_err());
+        assert!(parse_route("=host:5432").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_connections_go_to_the_instance_for_their_database() {
+        let instance = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let instance_addr = instance.local_addr().unwrap().to_string();
+        let router = Arc::new(Router::new(vec![("shop".to_string(), instance_addr)], None));
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let router_addr = listener.local_addr().unwrap();
+        tokio::spawn(router.run(listener));
+
+        let packet = startup_packet(&[("user", "admin"), ("database", "shop")]);
+        let mut client = TcpStream::connect(router_addr).await.unwrap();
+        // An SSL request first, as psql sends by default
+        client
+            .write_all(&[0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f])
+            .await
+            .unwrap();
+        let mut answer = [0u8];
+        client.read_exact(&mut answer).await.unwrap();
+        assert_eq!(&answer, b"N");
+        client.write_all(&packet).await.unwrap();
+
+        // The instance receives the startup packet as the client sent it, and
+        // its replies reach the client
+        let (mut accepted, _) = instance.accept().await.unwrap();
+        let mut received = vec![0u8; packet.len()];
+        accepted.read_exact(&mut received).await.unwrap();
+        assert_eq!(received, packet);
+        accepted.write_all(b"R").await.unwrap();
+        client.read_exact(&mut answer).await.unwrap();
+        assert_eq!(&answer, b"R");
+
+        // Unknown databases are refused with PostgreSQL's error code
+        let mut other = TcpStream::connect(router_addr).await.unwrap();
+        other
+            .write_all(&startup_packet(&[("user", "admin"), ("database", "crm")]))
+            .await
+            .unwrap();
+        let mut response = Vec::new();
+        other.read_to_end(&mut response).await.unwrap();
+        assert_eq!(response[0], b'E');
+        assert!(String::from_utf8_lossy(&response).contains("3D000"));
+    }
+}
@@ -0,0 +1,50 @@
+use anyhow::{Context, bail};
+use clap::Args;
+use std::path::PathBuf;
+
+use crate::yaml::{DATASET_JSON_SCHEMA, validate_yaml_str};
+
+#[derive(Debug, Clone, Args)]
+pub struct ValidateArgs {
+    #[arg(
+        value_name = "FILE",
+        required_unless_present = "schema",
+        help = "Dataset files to validate"
+    )]
+    pub files: Vec<PathBuf>,
+
+    #[arg(
+        long,
+        help = "Print the JSON Schema for dataset files (for editor integration) and exit"
+    )]
+    pub schema: bool,
+}
+
+pub async fn run(args: ValidateArgs) -> anyhow::Result<()> {
+    if args.schema {
+        println!("{}", DATASET_JSON_SCHEMA);
+        return Ok(());
+    }
+
+    let mut problem_count = 0;
+    for file in &args.files {
+        let content = tokio::fs::read_to_string(file)
+            .await
+            .with_context(|| format!("Failed to read {}", file.display()))?;
+
+        let issues = validate_yaml_str(&content);
+        if issues.is_empty() {
+            println!("{}: OK", file.display());
+        } else {
+            for issue in &issues {
+                eprintln!("{}: {}", file.display(), issue);
+            }
+            problem_count += issues.len();
+        }
+    }
+
+    if problem_count > 0 {
+        bail!("{} problem(s) found", problem_count);
+    }
+    Ok(())
+}
@@ -7,7 +7,12 @@ use std::time::Duration;
 #[command(name = "yamlbase")]
 #[command(author, version, about, long_about = None)]
 pub struct Config {
-    #[arg(short, long, value_name = "FILE", help = "Path to YAML database file")]
+    #[arg(
+        short,
+        long,
+        value_name = "FILE",
+        help = "Path to YAML database file, or a directory of them to pick one from with --database"
+    )]
     pub file: PathBuf,
 
     #[arg(
@@ -57,7 +62,11 @@ pub struct Config {
     )]
     pub log_level: String,
 
-    #[arg(long, help = "Database name")]
+    #[arg(
+        long,
+        env = "YAMLBASE_DATABASE",
+        help = "With -f DIR, serve the dataset in DIR declaring this database name"
+    )]
     pub database: Option<String>,
 
     #[arg(
@@ -66,6 +75,335 @@ pub struct Config {
     )]
     pub allow_anonymous: bool,
 
+    #[arg(
+        long,
+        value_name = "URL",
+        help = "Check the passwords of users the static list lacks by binding to this ldap:// server as them"
+    )]
+    #[serde(default)]
+    pub auth_ldap: Option<String>,
+
+    #[arg(
+        long,
+        value_name = "DN",
+        default_value = "{user}",
+        help = "DN to bind to --auth-ldap as, {user} standing for the user name, e.g. uid={user},ou=people,dc=example,dc=com"
+    )]
+    #[serde(default = "default_auth_ldap_dn")]
+    pub auth_ldap_dn: String,
+
+    #[arg(
+        long,
+        value_name = "COMMAND",
+        help = "Check the passwords of users the static list lacks with this shell command, given the user in $YAMLBASE_AUTH_USER and the password on stdin; exit status 0 accepts"
+    )]
+    #[serde(default)]
+    pub auth_command: Option<String>,
+
+    #[arg(
+        long,
+        value_name = "N",
+        help = "Refuse a login when its user already holds N connections (\"too many connections for role\")"
+    )]
+    #[serde(default)]
+    pub max_user_connections: Option<usize>,
+
+    #[arg(
+        long = "user-connection-limit",
+        value_name = "USER=N",
+        value_parser = crate::server::parse_connection_limit,
+        help = "Let USER hold at most N connections, overriding --max-user-connections (repeatable)"
+    )]
+    #[serde(default)]
+    pub user_connection_limits: Vec<(String, usize)>,
+
+    #[arg(
+        long,
+        value_name = "N",
+        help = "Refuse a login when its database already has N connections (\"too many connections for database\")"
+    )]
+    #[serde(default)]
+    pub max_database_connections: Option<usize>,
+
+    #[arg(
+        long = "webhook",
+        value_name = "URL",
+        help = "POST a JSON event to this http:// URL on startup, reload and writes (repeatable)"
+    )]
+    #[serde(default)]
+    pub webhooks: Vec<String>,
+
+    #[arg(
+        long,
+        default_value_t = 0,
+        help = "Number of read replica listeners on the ports after --port"
+    )]
+    #[serde(default)]
+    pub replicas: u16,
+
+    #[arg(
+        long,
+        value_name = "DURATION",
+        default_value = "0s",
+        value_parser = humantime_serde::re::humantime::parse_duration,
+        help = "How long replicas lag behind the primary, e.g. 500ms or 2s"
+    )]
+    #[serde(default, with = "humantime_serde")]
+    pub replica_lag: Duration,
+
+    #[arg(
+        long,
+        value_name = "PORT",
+        help = "Serve the HTTP admin API on this port (disabled by default)"
+    )]
+    pub admin_port: Option<u16>,
+
+    #[arg(
+        long,
+        value_name = "RATE",
+        value_parser = crate::server::parse_bandwidth,
+        help = "Emulate a slow network: cap throughput per connection, e.g. 64k or 1m bytes/s"
+    )]
+    pub net_bandwidth: Option<u64>,
+
+    #[arg(
+        long,
+        value_name = "DURATION",
+        default_value = "0s",
+        value_parser = humantime_serde::re::humantime::parse_duration,
+        help = "Emulate network latency: delay every packet by this long, e.g. 20ms"
+    )]
+    #[serde(default, with = "humantime_serde")]
+    pub net_packet_delay: Duration,
+
+    #[arg(
+        long,
+        value_name = "PROBABILITY",
+        default_value_t = 0.0,
+        help = "Emulate a flaky network: chance (0.0-1.0) of resetting the connection per packet sent"
+    )]
+    #[serde(default)]
+    pub net_reset_probability: f64,
+
+    #[arg(
+        long,
+        help = "Keep writes across restarts by logging them to a write-ahead log replayed on startup"
+    )]
+    #[serde(default)]
+    pub persist: bool,
+
+    #[arg(
+        long,
+        value_name = "FILE",
+        help = "Write-ahead log location for --persist (default: the YAML file path plus .wal)"
+    )]
+    pub wal_file: Option<PathBuf>,
+
+    #[arg(
+        long,
+        value_name = "DURATION",
+        value_parser = humantime_serde::re::humantime::parse_duration,
+        help = "With --persist, fold the write-ahead log into the YAML file this often, e.g. 30s"
+    )]
+    #[serde(default, with = "humantime_serde")]
+    pub checkpoint_interval: Option<Duration>,
+
+    #[arg(
+        long,
+        help = "Save writes back into the YAML file as they happen (comments and formatting in data sections are not kept)"
+    )]
+    #[serde(default)]
+    pub write_back: bool,
+
+    #[arg(
+        long,
+        value_name = "URL",
+        help = "Read through to this postgres:// database: fetch tables the YAML file lacks and rows a query finds none of"
+    )]
+    pub upstream: Option<String>,
+
+    #[arg(
+        long,
+        default_value = "public",
+        help = "Schema of the --upstream database to read tables from"
+    )]
+    #[serde(default = "default_upstream_schema")]
+    pub upstream_schema: String,
+
+    #[arg(
+        long,
+        value_name = "ROWS",
+        default_value_t = crate::database::upstream::DEFAULT_ROW_LIMIT,
+        help = "Most rows fetched from --upstream per missed table or query"
+    )]
+    #[serde(default = "default_upstream_limit")]
+    pub upstream_limit: usize,
+
+    #[arg(
+        long,
+        requires = "upstream",
+        help = "Append the tables and rows fetched from --upstream to the YAML file (comments and formatting are not kept)"
+    )]
+    #[serde(default)]
+    pub upstream_record: bool,
+
+    #[arg(
+        long,
+        value_name = "DIR",
+        help = "Serve tables from an on-disk store in DIR, loading them into memory on demand"
+    )]
+    pub disk_store: Option<PathBuf>,
+
+    #[arg(
+        long,
+        value_name = "SIZE",
+        default_value = "1g",
+        value_parser = parse_byte_size,
+        help = "Memory budget for tables loaded from --disk-store, e.g. 512m or 4g"
+    )]
+    #[serde(default = "default_cache_size")]
+    pub cache_size: u64,
+
+    #[arg(
+        long,
+        value_name = "FILE",
+        help = "YAML file declaring per-scenario query budgets, checked through the admin API"
+    )]
+    pub scenarios: Option<PathBuf>,
+
+    #[arg(
+        long,
+        value_name = "N",
+        help = "Warn when one connection runs N queries differing only in their literals (N+1 pattern)"
+    )]
+    pub n_plus_one_threshold: Option<usize>,
+
+    #[arg(
+        long,
+        value_name = "DURATION",
+        default_value = "1s",
+        value_parser = humantime_serde::re::humantime::parse_duration,
+        help = "Time window in which --n-plus-one-threshold queries count as one burst"
+    )]
+    #[serde(default = "default_n_plus_one_window", with = "humantime_serde")]
+    pub n_plus_one_window: Duration,
+
+    #[arg(
+        long,
+        help = "Start even if some tables fail to load; queries on those tables return the load error"
+    )]
+    #[serde(default)]
+    pub skip_invalid: bool,
+
+    #[arg(
+        long,
+        value_name = "TABLES",
+        value_delimiter = ',',
+        help = "Refuse to start unless the dataset has these tables (comma-separated), e.g. users,orders"
+    )]
+    #[serde(default)]
+    pub require_tables: Vec<String>,
+
+    #[arg(
+        long,
+        value_name = "TABLE=N",
+        value_delimiter = ',',
+        value_parser = crate::server::parse_min_rows,
+        help = "Refuse to start unless TABLE has at least N rows (comma-separated or repeatable), e.g. users=10"
+    )]
+    #[serde(default)]
+    pub min_rows: Vec<(String, usize)>,
+
+    #[arg(
+        long,
+        value_name = "DIR",
+        help = "On a panic or fatal error, write a diagnostic bundle (recent queries, dataset checksums, threads, configuration) to this directory"
+    )]
+    #[serde(default)]
+    pub crash_dump_dir: Option<PathBuf>,
+
+    #[arg(
+        long,
+        help = "Log resource samples (tasks, threads, memory, file descriptors, connections) every --soak-interval and warn about those that keep growing"
+    )]
+    #[serde(default)]
+    pub soak: bool,
+
+    #[arg(
+        long,
+        value_name = "DURATION",
+        default_value = "1m",
+        value_parser = humantime_serde::re::humantime::parse_duration,
+        help = "Time between --soak samples"
+    )]
+    #[serde(default = "default_soak_interval", with = "humantime_serde")]
+    pub soak_interval: Duration,
+
+    #[arg(
+        long,
+        value_name = "TIMESTAMP",
+        value_parser = crate::database::clock::parse_timestamp,
+        help = "Freeze the server clock (NOW(), CURRENT_DATE, table expiry) at this time, e.g. 2024-01-31T12:00:00; move it with the admin API"
+    )]
+    #[serde(default)]
+    pub clock: Option<chrono::NaiveDateTime>,
+
+    #[arg(
+        long,
+        value_name = "ZONE",
+        default_value = "UTC",
+        value_parser = crate::database::timezone::parse_zone,
+        help = "Time zone TIMESTAMPTZ values are shown in, UTC or an offset such as +02:00; PostgreSQL clients can change it with SET TimeZone"
+    )]
+    #[serde(default = "default_timezone")]
+    pub timezone: String,
+
+    #[arg(
+        long,
+        value_name = "MODE",
+        value_parser = crate::database::uuids::parse_uuid_mode,
+        help = "How gen_random_uuid() and UUID defaults make UUIDs: random, sequential, or a number to seed a repeatable sequence with"
+    )]
+    #[serde(default)]
+    pub uuids: Option<crate::database::UuidMode>,
+
+    #[arg(
+        long,
+        value_name = "N",
+        default_value_t = crate::protocol::prepared_statements::DEFAULT_MAX_PREPARED_STATEMENTS,
+        help = "Named prepared statements kept per connection; past this the least recently used is dropped"
+    )]
+    #[serde(default = "default_max_prepared_statements")]
+    pub max_prepared_statements: usize,
+
+    #[arg(
+        long,
+        value_name = "SIZE",
+        default_value = "64k",
+        value_parser = parse_byte_size,
+        help = "Encoded result rows a connection gathers before writing them to the client, e.g. 16k or 1m"
+    )]
+    #[serde(default = "default_output_buffer")]
+    pub output_buffer: u64,
+
+    #[arg(
+        long,
+        value_name = "DURATION",
+        default_value = "30s",
+        value_parser = humantime_serde::re::humantime::parse_duration,
+        help = "Disconnect a client that accepts no result data for this long, freeing the result; 0s waits indefinitely"
+    )]
+    #[serde(default = "default_slow_client_timeout", with = "humantime_serde")]
+    pub slow_client_timeout: Duration,
+
+    #[arg(
+        long,
+        value_name = "N",
+        help = "Longest identifier: PostgreSQL cuts longer ones to N bytes, MySQL refuses longer table, column and index names [default: 63 bytes for PostgreSQL, 64 characters for MySQL]"
+    )]
+    #[serde(default)]
+    pub max_identifier_length: Option<usize>,
+
     // Connection management settings (not exposed via CLI - configured via YAML)
     #[serde(skip_serializing_if = "Option::is_none")]
     #[clap(skip)]
@@ -102,6 +440,22 @@ impl Config {
         })
     }
 
+    /// How long identifiers may be: `--max-identifier-length`, or the
+    /// protocol's own limit
+    pub fn identifier_limit(&self) -> usize {
+        self.max_identifier_length.unwrap_or(match self.protocol {
+            Protocol::Mysql => crate::sql::identifiers::MYSQL_MAX_IDENTIFIER_LENGTH,
+            _ => crate::sql::identifiers::POSTGRES_MAX_IDENTIFIER_LENGTH,
+        })
+    }
+
+    /// Where `--persist` keeps its write-ahead log
+    pub fn wal_path(&self) -> PathBuf {
+        self.wal_file
+            .clone()
+            .unwrap_or_else(|| crate::database::wal::default_path(&self.file))
+    }
+
     pub fn init_logging(&self) -> anyhow::Result<()> {
         let log_level = if self.verbose {
             "debug"
@@ -123,3 +477,66 @@ impl Config {
         Ok(())
     }
 }
+
+fn default_cache_size() -> u64 {
+    1024 * 1024 * 1024
+}
+
+fn default_auth_ldap_dn() -> String {
+    "{user}".to_string()
+}
+
+fn default_timezone() -> String {
+    "UTC".to_string()
+}
+
+fn default_max_prepared_statements() -> usize {
+    crate::protocol::prepared_statements::DEFAULT_MAX_PREPARED_STATEMENTS
+}
+
+fn default_output_buffer() -> u64 {
+    64 * 1024
+}
+
+fn default_slow_client_timeout() -> Duration {
+    Duration::from_secs(30)
+}
+
+fn default_upstream_schema() -> String {
+    "public".to_string()
+}
+
+fn default_upstream_limit() -> usize {
+    crate::database::upstream::DEFAULT_ROW_LIMIT
+}
+
+fn default_n_plus_one_window() -> Duration {
+    Duration::from_secs(1)
+}
+
+fn default_soak_interval() -> Duration {
+    Duration::from_secs(60)
+}
+
+/// Parse a byte count such as `65536`, `64k`, `1.5m` or `2g` (binary multiples)
+pub fn parse_byte_size(input: &str) -> Result<u64, String> {
+    let input = input.trim().to_lowercase();
+    let input = input.strip_suffix('b').unwrap_or(&input);
+
+    let (number, multiplier) = match input.chars().last() {
+        Some('k') => (&input[..input.len() - 1], 1024.0),
+        Some('m') => (&input[..input.len() - 1], 1024.0 * 1024.0),
+        Some('g') => (&input[..input.len() - 1], 1024.0 * 1024.0 * 1024.0),
+        _ => (input, 1.0),
+    };
+
+    let value: f64 = number
+        .trim()
+        .parse()
+        .map_err(|_| format!("Invalid size '{}'", input))?;
+    let bytes = value * multiplier;
+    if !bytes.is_finite() || bytes < 1.0 {
+        return Err(format!("Size must be at least 1 byte, got '{}'", input));
+    }
+    Ok(bytes as u64)
+}
@@ -0,0 +1,145 @@
+use chrono::{NaiveDate, NaiveDateTime};
+use std::sync::{Arc, RwLock};
+
+/// The current time as queries (`NOW()`, `CURRENT_DATE`) and table expiry see it.
+///
+/// A system clock follows the local wall clock. A fixed clock, set with
+/// `--clock` or through the admin API, stands still until it is set again or
+/// advanced, so tests can step through time deterministically. Clones share
+/// the same time.
+#[derive(Debug, Clone)]
+pub struct Clock {
+    state: Arc<RwLock<ClockState>>,
+}
+
+#[derive(Debug)]
+struct ClockState {
+    /// When the clock started; relative table expiries count from here
+    start: NaiveDateTime,
+    /// The frozen time, `None` while following the system clock
+    fixed: Option<NaiveDateTime>,
+}
+
+impl Clock {
+    pub fn system() -> Self {
+        Self::with_state(local_now(), None)
+    }
+
+    pub fn fixed(at: NaiveDateTime) -> Self {
+        Self::with_state(at, Some(at))
+    }
+
+    fn with_state(start: NaiveDateTime, fixed: Option<NaiveDateTime>) -> Self {
+        Self {
+            state: Arc::new(RwLock::new(ClockState { start, fixed })),
+        }
+    }
+
+    pub fn now(&self) -> NaiveDateTime {
+        self.state.read().unwrap().fixed.unwrap_or_else(local_now)
+    }
+
+    pub fn start(&self) -> NaiveDateTime {
+        self.state.read().unwrap().start
+    }
+
+    pub fn is_fixed(&self) -> bool {
+        self.state.read().unwrap().fixed.is_some()
+    }
+
+    /// Freeze the clock at `at`, which may be earlier than the current time
+    pub fn set(&self, at: NaiveDateTime) {
+        self.state.write().unwrap().fixed = Some(at);
+    }
+
+    /// Move the clock forward by `by`, freezing it first if it follows the
+    /// system clock, and return the new time
+    pub fn advance(&self, by: chrono::Duration) -> NaiveDateTime {
+        let mut state = self.state.write().unwrap();
+        let now = state.fixed.unwrap_or_else(local_now) + by;
+        state.fixed = Some(now);
+        now
+    }
+}
+
+impl Default for Clock {
+    fn default() -> Self {
+        Self::system()
+    }
+}
+
+fn local_now() -> NaiveDateTime {
+    chrono::Local::now().naive_local()
+}
+
+/// A timestamp as clients are sent it in text, `2024-01-31 12:00:00.25`,
+/// with fractional seconds only when there are any
+pub fn format_timestamp(at: NaiveDateTime) -> String {
+    at.format("%Y-%m-%d %H:%M:%S%.f").to_string()
+}
+
+/// Parse a point in time as written in `--clock` or a table's expiry:
+/// `2024-01-31 12:00:00`, `2024-01-31T12:00:00` (either with fractional
+/// seconds), RFC 3339 or a bare date
+pub fn parse_timestamp(s: &str) -> Result<NaiveDateTime, String> {
+    let s = s.trim();
+    for format in ["%Y-%m-%d %H:%M:%S%.f", "%Y-%m-%dT%H:%M:%S%.f"] {
+        if let Ok(at) = NaiveDateTime::parse_from_str(s, format) {
+            return Ok(at);
+        }
+    }
+    if let Ok(at) = chrono::DateTime::parse_from_rfc3339(s) {
+        return Ok(at.naive_local());
+    }
+    if let Ok(date) = NaiveDate::parse_from_str(s, "%Y-%m-%d") {
+        return Ok(date.and_hms_opt(0, 0, 0).unwrap());
+    }
+    Err(format!(
+        "Invalid timestamp '{}' (expected e.g. 2024-01-31 12:00:00)",
+        s
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_fixed_clock_moves_only_when_told() {
+        let start = parse_timestamp("2024-01-31T12:00:00").unwrap();
+        let clock = Clock::fixed(start);
+        let shared = clock.clone();
+        assert_eq!(clock.now(), start);
+
+        let later = shared.advance(chrono::Duration::minutes(90));
+        assert_eq!(later, parse_timestamp("2024-01-31 13:30:00").unwrap());
+        assert_eq!(clock.now(), later);
+        assert_eq!(clock.start(), start);
+
+        clock.set(parse_timestamp("2024-01-01").unwrap());
+        assert_eq!(
+            shared.now(),
+            parse_timestamp("2024-01-01 00:00:00").unwrap()
+        );
+    }
+
+    #[test]
+    fn test_advancing_a_system_clock_freezes_it() {
+        let clock = Clock::system();
+        assert!(!clock.is_fixed());
+        let before = clock.now();
+        let advanced = clock.advance(chrono::Duration::hours(1));
+        assert!(clock.is_fixed());
+        assert!(advanced >= before + chrono::Duration::hours(1));
+        assert_eq!(clock.now(), advanced);
+    }
+
+    #[test]
+    fn test_parse_timestamp_rejects_garbage() {
+        assert!(parse_timestamp("tomorrow").is_err());
+        assert_eq!(
+            parse_timestamp("2024-01-31T12:00:00Z").unwrap(),
+            parse_timestamp("2024-01-31 12:00:00").unwrap()
+        );
+    }
+}
@@ -0,0 +1,458 @@
+//! Disk-backed table storage for datasets larger than memory (`--disk-store`).
+//!
+//! The YAML file is imported once into a store directory: a manifest holding the
+//! dataset definition without its rows, plus one row file per table. Later
+//! starts skip the YAML file entirely unless it changed. Tables start out empty
+//! and are loaded when a statement references them; a byte budget keeps the
+//! most recently used tables resident and evicts the rest.
+//!
+//! Tables that have been written to are never evicted, so writes behave like the
+//! in-memory store (kept for the session, or persisted with `--persist`) and the
+//! row files always hold the imported data.
+
+use indexmap::IndexMap;
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::UNIX_EPOCH;
+use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader, BufWriter};
+use tracing::{debug, info};
+
+use crate::database::{Column, Database, Table, Value};
+use crate::yaml::parser::{build_columns, build_database, build_row, parse_value};
+use crate::yaml::schema::{AuthConfig, YamlDatabase};
+use crate::yaml::writer::to_yaml_value;
+
+const STORE_VERSION: u32 = 1;
+const MANIFEST_FILE: &str = "manifest.json";
+
+/// Identifies the YAML file a store was imported from, without reading it
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+struct SourceStamp {
+    len: u64,
+    modified_nanos: u128,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct Manifest {
+    version: u32,
+    source: SourceStamp,
+    /// The dataset file with every table's `data` removed
+    dataset: YamlDatabase,
+    tables: IndexMap<String, TableFile>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct TableFile {
+    file: String,
+    rows: usize,
+    bytes: u64,
+}
+
+#[derive(Debug, Default)]
+struct CacheState {
+    /// Loaded tables and their size, least recently used first
+    resident: IndexMap<String, u64>,
+    used: u64,
+    pinned: HashMap<String, usize>,
+    dirty: HashSet<String>,
+}
+
+pub struct DiskStore {
+    dir: PathBuf,
+    cache_limit: u64,
+    tables: IndexMap<String, TableFile>,
+    cache: std::sync::Mutex<CacheState>,
+    /// Serializes table loads so a cold table is read from disk only once
+    loading: tokio::sync::Mutex<()>,
+}
+
+/// Keeps tables resident while a statement uses them; dropping it releases them
+pub struct TableLease {
+    store: Arc<DiskStore>,
+    tables: Vec<String>,
+}
+
+impl Drop for TableLease {
+    fn drop(&mut self) {
+        let mut cache = self.store.cache.lock().unwrap();
+        for table in &self.tables {
+            if let Some(count) = cache.pinned.get_mut(table) {
+                *count -= 1;
+                if *count == 0 {
+                    cache.pinned.remove(table);
+                }
+            }
+        }
+    }
+}
+
+impl DiskStore {
+    /// Open the store in `dir`, importing `source` first if the store is missing or stale.
+    ///
+    /// Returns the store together with the database schema; every disk-backed
+    /// table starts out with no rows loaded.
+    pub async fn open(
+        dir: &Path,
+        source: &Path,
+        cache_limit: u64,
+    ) -> crate::Result<(Self, Database, Option<AuthConfig>)> {
+        let stamp = source_stamp(source).await?;
+        let manifest = match read_manifest(dir).await {
+            Some(manifest) if manifest.version == STORE_VERSION && manifest.source == stamp => {
+                info!("Using disk store {}", dir.display());
+                manifest
+            }
+            _ => import(dir, source, stamp).await?,
+        };
+
+        let (database, auth) = build_database(&manifest.dataset)?;
+        let store = Self {
+            dir: dir.to_path_buf(),
+            cache_limit,
+            tables: manifest.tables,
+            cache: std::sync::Mutex::new(CacheState::default()),
+            loading: tokio::sync::Mutex::new(()),
+        };
+        Ok((store, database, auth))
+    }
+
+    /// Whether `table` lives on disk (generated tables are always in memory)
+    pub fn manages(&self, table: &str) -> bool {
+        self.tables.contains_key(table)
+    }
+
+    /// How many rows `table` was imported with, whether or not they are loaded
+    pub fn row_count(&self, table: &str) -> Option<usize> {
+        self.tables.get(table).map(|file| file.rows)
+    }
+
+    /// Names of the tables, among `tables`, whose rows are not in memory
+    pub(crate) fn missing(&self, tables: &[String]) -> Vec<String> {
+        let mut cache = self.cache.lock().unwrap();
+        tables
+            .iter()
+            .filter(|table| match cache.resident.shift_remove(*table) {
+                // Re-inserting moves the table to the most recently used end
+                Some(bytes) => {
+                    cache.resident.insert((*table).clone(), bytes);
+                    false
+                }
+                None => true,
+            })
+            .cloned()
+            .collect()
+    }
+
+    pub(crate) fn pin(self: &Arc<Self>, tables: Vec<String>) -> TableLease {
+        let mut cache = self.cache.lock().unwrap();
+        for table in &tables {
+            *cache.pinned.entry(table.clone()).or_default() += 1;
+        }
+        drop(cache);
+        TableLease {
+            store: Arc::clone(self),
+            tables,
+        }
+    }
+
+    pub(crate) async fn lock_loading(&self) -> tokio::sync::MutexGuard<'_, ()> {
+        self.loading.lock().await
+    }
+
+    /// Read a table's rows from its row file
+    pub(crate) async fn load_rows(
+        &self,
+        table: &str,
+        columns: &[Column],
+    ) -> crate::Result<Vec<Vec<Value>>> {
+        let Some(table_file) = self.tables.get(table) else {
+            return Ok(Vec::new());
+        };
+        debug!("Loading table {} from disk", table);
+
+        let file = tokio::fs::File::open(self.dir.join(&table_file.file)).await?;
+        let mut lines = BufReader::new(file).lines();
+        let mut rows = Vec::with_capacity(table_file.rows);
+        while let Some(line) = lines.next_line().await? {
+            let values: Vec<serde_yaml::Value> =
+                serde_json::from_str(&line).map_err(|e| crate::YamlBaseError::Database {
+                    message: format!("Corrupt row file for table '{}': {}", table, e),
+                })?;
+            let row = values
+                .iter()
+                .zip(columns)
+                .map(|(value, column)| parse_value(value, &column.sql_type))
+                .collect::<crate::Result<Vec<_>>>()?;
+            rows.push(row);
+        }
+        Ok(rows)
+    }
+
+    /// Record `table` as loaded and return the tables to evict to stay within budget
+    pub(crate) fn admit(&self, table: &str) -> Vec<String> {
+        let bytes = self.tables.get(table).map_or(0, |t| t.bytes);
+        let mut cache = self.cache.lock().unwrap();
+        cache.resident.insert(table.to_string(), bytes);
+        cache.used += bytes;
+
+        let mut evicted = Vec::new();
+        let candidates: Vec<String> = cache.resident.keys().cloned().collect();
+        for candidate in candidates {
+            if cache.used <= self.cache_limit {
+                break;
+            }
+            if candidate == table
+                || cache.pinned.contains_key(&candidate)
+                || cache.dirty.contains(&candidate)
+            {
+                continue;
+            }
+            if let Some(bytes) = cache.resident.shift_remove(&candidate) {
+                cache.used -= bytes;
+                evicted.push(candidate);
+            }
+        }
+        evicted
+    }
+
+    /// Keep a written table resident for the rest of the session
+    pub(crate) fn mark_dirty(&self, table: &str) {
+        self.cache.lock().unwrap().dirty.insert(table.to_string());
+    }
+}
+
+async fn source_stamp(source: &Path) -> crate::Result<SourceStamp> {
+    let metadata = tokio::fs::metadata(source).await?;
+    let modified_nanos = metadata
+        .modified()?
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_nanos());
+    Ok(SourceStamp {
+        len: metadata.len(),
+        modified_nanos,
+    })
+}
+
+async fn read_manifest(dir: &Path) -> Option<Manifest> {
+    let content = tokio::fs::read(dir.join(MANIFEST_FILE)).await.ok()?;
+    serde_json::from_slice(&content).ok()
+}
+
+/// Convert the YAML file into row files, one table at a time
+async fn import(dir: &Path, source: &Path, stamp: SourceStamp) -> crate::Result<Manifest> {
+    info!(
+        "Importing {} into disk store {}",
+        source.display(),
+        dir.display()
+    );
+
+    // Removing the manifest first means an interrupted import is redone next time
+    match tokio::fs::remove_file(dir.join(MANIFEST_FILE)).await {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => return Err(e.into()),
+        _ => {}
+    }
+    let tables_dir = dir.join("tables");
+    if tokio::fs::try_exists(&tables_dir).await? {
+        tokio::fs::remove_dir_all(&tables_dir).await?;
+    }
+    tokio::fs::create_dir_all(&tables_dir).await?;
+
+    let content = tokio::fs::read_to_string(source).await?;
+    let mut dataset: YamlDatabase = serde_yaml::from_str(&content)?;
+    drop(content);
+
+    let mut tables = IndexMap::new();
+    for (idx, (table_name, yaml_table)) in dataset.tables.iter_mut().enumerate() {
+        if yaml_table.generator.is_some() {
+            continue;
+        }
+
+        let table = Table::new(table_name.clone(), build_columns(&yaml_table.columns)?);
+        let file_name = format!("tables/{}.rows", idx);
+        let path = dir.join(&file_name);
+        let mut writer = BufWriter::new(tokio::fs::File::create(&path).await?);
+
+        // Free each table's parsed rows as soon as they are on disk
+        let data = std::mem::take(&mut yaml_table.data);
+        let mut primary_keys = HashSet::new();
+        for row_data in &data {
+            let row = build_row(row_data, &table.columns)?;
+            table.validate_row(&row)?;
+            if let Some(pk_idx) = table.primary_key_index {
+                if !primary_keys.insert(row[pk_idx].clone()) {
+                    return Err(crate::YamlBaseError::Database {
+                        message: format!(
+                            "Duplicate key value {} violates primary key of table '{}'",
+                            row[pk_idx], table_name
+                        ),
+                    });
+                }
+            }
+
+            let values: Vec<serde_yaml::Value> = row.iter().map(to_yaml_value).collect();
+            let mut line = serde_json::to_vec(&values).map_err(std::io::Error::from)?;
+            line.push(b'\n');
+            writer.write_all(&line).await?;
+        }
+        writer.flush().await?;
+        writer.get_ref().sync_all().await?;
+
+        let bytes = tokio::fs::metadata(&path).await?.len();
+        debug!(
+            "Imported table {} ({} rows, {} bytes)",
+            table_name,
+            data.len(),
+            bytes
+        );
+        tables.insert(
+            table_name.clone(),
+            TableFile {
+                file: file_name,
+                rows: data.len(),
+                bytes,
+            },
+        );
+    }
+
+    let manifest = Manifest {
+        version: STORE_VERSION,
+        source: stamp,
+        dataset,
+        tables,
+    };
+    let encoded = serde_json::to_vec_pretty(&manifest).map_err(std::io::Error::from)?;
+    tokio::fs::write(dir.join(MANIFEST_FILE), encoded).await?;
+
+    info!("Imported {} table(s) to disk", manifest.tables.len());
+    Ok(manifest)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Storage;
+    use crate::sql::{QueryExecutor, parse_sql};
+
+    const DATASET: &str = r#"
+database:
+  name: warehouse
+tables:
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      customer: "VARCHAR(50)"
+    data:
+      - id: 1
+        customer: "alice"
+      - id: 2
+        customer: "bob"
+  customers:
+    columns:
+      name: "VARCHAR(50) PRIMARY KEY"
+      city: "VARCHAR(50)"
+    data:
+      - name: "alice"
+        city: "Utrecht"
+      - name: "bob"
+        city: "Delft"
+"#;
+
+    struct Fixture {
+        dir: PathBuf,
+        source: PathBuf,
+    }
+
+    impl Fixture {
+        fn new() -> Self {
+            let dir = std::env::temp_dir().join(format!("yamlbase-disk-{}", uuid::Uuid::new_v4()));
+            std::fs::create_dir_all(&dir).unwrap();
+            let source = dir.join("warehouse.yaml");
+            std::fs::write(&source, DATASET).unwrap();
+            Self { dir, source }
+        }
+
+        async fn storage(&self, cache_limit: u64) -> Storage {
+            let (store, database, _) =
+                DiskStore::open(&self.dir.join("store"), &self.source, cache_limit)
+                    .await
+                    .unwrap();
+            Storage::new(database).with_disk_store(Arc::new(store))
+        }
+    }
+
+    impl Drop for Fixture {
+        fn drop(&mut self) {
+            let _ = std::fs::remove_dir_all(&self.dir);
+        }
+    }
+
+    async fn query(storage: Storage, sql: &str) -> Vec<Vec<Value>> {
+        let executor = QueryExecutor::new(Arc::new(storage)).await.unwrap();
+        let statement = parse_sql(sql).unwrap().remove(0);
+        executor.execute(&statement).await.unwrap().rows
+    }
+
+    async fn resident_rows(storage: &Storage, table: &str) -> usize {
+        let db = storage.database();
+        let db = db.read().await;
+        db.get_table(table).unwrap().rows.len()
+    }
+
+    #[tokio::test]
+    async fn test_tables_load_on_demand() {
+        let fixture = Fixture::new();
+        let storage = fixture.storage(1024 * 1024).await;
+        assert_eq!(resident_rows(&storage, "orders").await, 0);
+
+        let rows = query(
+            storage.clone(),
+            "SELECT o.id, c.city FROM orders o JOIN customers c ON o.customer = c.name ORDER BY o.id",
+        )
+        .await;
+        assert_eq!(
+            rows,
+            vec![
+                vec![Value::Integer(1), Value::Text("Utrecht".to_string())],
+                vec![Value::Integer(2), Value::Text("Delft".to_string())],
+            ]
+        );
+        assert_eq!(resident_rows(&storage, "orders").await, 2);
+    }
+
+    #[tokio::test]
+    async fn test_least_recently_used_table_is_evicted() {
+        let fixture = Fixture::new();
+        // Each table's row file is 20-40 bytes, so only one fits
+        let storage = fixture.storage(40).await;
+
+        query(storage.clone(), "SELECT * FROM orders").await;
+        query(storage.clone(), "SELECT * FROM customers").await;
+        assert_eq!(resident_rows(&storage, "orders").await, 0);
+        assert_eq!(resident_rows(&storage, "customers").await, 2);
+
+        // Evicted tables come back transparently
+        let rows = query(storage.clone(), "SELECT COUNT(*) FROM orders").await;
+        assert_eq!(rows, vec![vec![Value::Integer(2)]]);
+    }
+
+    #[tokio::test]
+    async fn test_store_is_reused_until_source_changes() {
+        let fixture = Fixture::new();
+        drop(fixture.storage(1024).await);
+        let manifest = fixture.dir.join("store").join(MANIFEST_FILE);
+        let imported = std::fs::metadata(&manifest).unwrap().modified().unwrap();
+
+        drop(fixture.storage(1024).await);
+        assert_eq!(
+            std::fs::metadata(&manifest).unwrap().modified().unwrap(),
+            imported
+        );
+
+        std::fs::write(&fixture.source, DATASET.replace("Delft", "Leiden")).unwrap();
+        let storage = fixture.storage(1024).await;
+        let rows = query(storage, "SELECT city FROM customers WHERE name = 'bob'").await;
+        assert_eq!(rows, vec![vec![Value::Text("Leiden".to_string())]]);
+    }
+}
@@ -1,2 +1,280 @@
-// Future implementation for advanced indexing strategies
-// This module will contain B-tree indexes, hash indexes, and other performance optimizations
+//! Secondary indexes made with `CREATE INDEX`.
+//!
+//! An index maps the values of its columns to the positions of the rows
+//! holding them. A hash index finds the rows with given values in all of its
+//! columns; a btree index keeps its keys in order, so it also finds them by a
+//! leading prefix of the columns or by a range of the first one. Lookups may
+//! return rows the full WHERE clause rejects, so callers still evaluate it
+//! on every candidate.
+
+use serde::Serialize;
+use std::cmp::Ordering;
+use std::collections::{BTreeMap, HashMap};
+use std::ops::Bound;
+
+use crate::database::{Table, Value};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum IndexKind {
+    /// Point lookups and joins
+    Hash,
+    /// Range scans
+    Btree,
+}
+
+impl IndexKind {
+    pub fn name(&self) -> &'static str {
+        match self {
+            IndexKind::Hash => "hash",
+            IndexKind::Btree => "btree",
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct Index {
+    pub name: String,
+    pub columns: Vec<String>,
+    pub kind: IndexKind,
+    /// Declared `UNIQUE`; like a column's UNIQUE constraint, not enforced
+    pub unique: bool,
+    /// Positions of the columns in the table
+    positions: Vec<usize>,
+    entries: Entries,
+    /// How many of the table's rows the entries cover
+    rows: usize,
+}
+
+#[derive(Debug, Clone)]
+enum Entries {
+    Hash(HashMap<Vec<Value>, Vec<usize>>),
+    Btree(BTreeMap<Key, Vec<usize>>),
+}
+
+/// A btree key, ordered column by column as ORDER BY orders values
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Key(Vec<Value>);
+
+impl Ord for Key {
+    fn cmp(&self, other: &Self) -> Ordering {
+        for (left, right) in self.0.iter().zip(&other.0) {
+            match left.compare(right).unwrap_or(Ordering::Equal) {
+                Ordering::Equal => continue,
+                ordering => return ordering,
+            }
+        }
+        // A prefix sorts before the keys it starts
+        self.0.len().cmp(&other.0.len())
+    }
+}
+
+impl PartialOrd for Key {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Index {
+    /// Index `columns` of a table, building the entries for its rows
+    pub fn new(
+        name: String,
+        table: &Table,
+        columns: &[String],
+        kind: IndexKind,
+        unique: bool,
+    ) -> crate::Result<Self> {
+        let positions = columns
+            .iter()
+            .map(|column| {
+                table
+                    .get_column_index(column)
+                    .ok_or_else(|| crate::YamlBaseError::Database {
+                        message: format!("column \"{}\" does not exist", column),
+                    })
+            })
+            .collect::<crate::Result<Vec<_>>>()?;
+        if positions.is_empty() {
+            return Err(crate::YamlBaseError::Database {
+                message: format!("index \"{}\" has no columns", name),
+            });
+        }
+        let mut index = Self {
+            name,
+            columns: positions
+                .iter()
+                .map(|&idx| table.columns[idx].name.clone())
+                .collect(),
+            kind,
+            unique,
+            positions,
+            entries: match kind {
+                IndexKind::Hash => Entries::Hash(HashMap::new()),
+                IndexKind::Btree => Entries::Btree(BTreeMap::new()),
+            },
+            rows: 0,
+        };
+        index.build(&table.rows);
+        Ok(index)
+    }
+
+    /// Rebuild the entries from every row
+    pub fn build(&mut self, rows: &[Vec<Value>]) {
+        match &mut self.entries {
+            Entries::Hash(map) => map.clear(),
+            Entries::Btree(map) => map.clear(),
+        }
+        self.rows = 0;
+        self.insert_from(rows, 0);
+    }
+
+    /// Add the rows appended from `start` on, which is all a batch of inserts
+    /// needs when the entries already cover the rows before them
+    pub fn insert_from(&mut self, rows: &[Vec<Value>], start: usize) {
+        if self.rows != start {
+            return self.build(rows);
+        }
+        for (row_idx, row) in rows.iter().enumerate().skip(start) {
+            let key: Vec<Value> = self.positions.iter().map(|&idx| row[idx].clone()).collect();
+            match &mut self.entries {
+                Entries::Hash(map) => map.entry(key).or_default().push(row_idx),
+                Entries::Btree(map) => map.entry(Key(key)).or_default().push(row_idx),
+            }
+        }
+        self.rows = rows.len();
+    }
+
+    /// Whether the entries are those of a table with `rows` rows, rather than
+    /// of the table a copy was made from
+    pub fn covers(&self, rows: usize) -> bool {
+        self.rows == rows
+    }
+
+    /// Rows whose leading columns hold `values`, or `None` when the index
+    /// cannot look them up: a hash index needs a value for every column
+    pub fn find(&self, values: &[Value]) -> Option<Vec<usize>> {
+        if values.is_empty() || values.len() > self.columns.len() {
+            return None;
+        }
+        match &self.entries {
+            Entries::Hash(map) if values.len() == self.columns.len() => {
+                Some(map.get(values).cloned().unwrap_or_default())
+            }
+            Entries::Hash(_) => None,
+            Entries::Btree(map) => {
+                let prefix = Key(values.to_vec());
+                Some(
+                    map.range(prefix.clone()..)
+                        .take_while(|(key, _)| {
+                            Key(key.0[..values.len()].to_vec()).cmp(&prefix).is_eq()
+                        })
+                        .flat_map(|(_, rows)| rows.iter().copied())
+                        .collect(),
+                )
+            }
+        }
+    }
+
+    /// Rows whose first column lies between the bounds, skipping NULLs, or
+    /// `None` for a hash index
+    pub fn range(&self, lower: Bound<&Value>, upper: Bound<&Value>) -> Option<Vec<usize>> {
+        let Entries::Btree(map) = &self.entries else {
+            return None;
+        };
+        let first = |key: &Key, value: &Value| key.0[0].compare(value).unwrap_or(Ordering::Equal);
+        let start = match lower {
+            Bound::Included(value) | Bound::Excluded(value) => {
+                Bound::Included(Key(vec![value.clone()]))
+            }
+            Bound::Unbounded => Bound::Unbounded,
+        };
+        Some(
+            map.range((start, Bound::Unbounded))
+                .filter(|(key, _)| key.0[0] != Value::Null)
+                .skip_while(|(key, _)| match lower {
+                    Bound::Excluded(value) => first(key, value).is_eq(),
+                    _ => false,
+                })
+                .take_while(|(key, _)| match upper {
+                    Bound::Included(value) => first(key, value).is_le(),
+                    Bound::Excluded(value) => first(key, value).is_lt(),
+                    Bound::Unbounded => true,
+                })
+                .flat_map(|(_, rows)| rows.iter().copied())
+                .collect(),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Column;
+    use crate::yaml::schema::SqlType;
+
+    fn table() -> Table {
+        let columns = [("id", SqlType::Integer), ("city", SqlType::Text)]
+            .into_iter()
+            .map(|(name, sql_type)| Column {
+                name: name.to_string(),
+                sql_type,
+                primary_key: false,
+                nullable: true,
+                unique: false,
+                default: None,
+                references: None,
+            })
+            .collect();
+        let mut table = Table::new("people".to_string(), columns);
+        for (id, city) in [(3, "Oslo"), (1, "Rome"), (2, "Oslo"), (4, "Lima")] {
+            table
+                .rows
+                .push(vec![Value::Integer(id), Value::Text(city.to_string())]);
+        }
+        table.rows.push(vec![Value::Null, Value::Null]);
+        table
+    }
+
+    #[test]
+    fn test_lookups() {
+        let mut table = table();
+        let oslo = Value::Text("Oslo".to_string());
+        let columns = ["city".to_string(), "id".to_string()];
+
+        let hash = Index::new("h".to_string(), &table, &columns, IndexKind::Hash, false).unwrap();
+        assert_eq!(hash.find(&[oslo.clone(), Value::Integer(2)]), Some(vec![2]));
+        assert_eq!(hash.find(std::slice::from_ref(&oslo)), None);
+        assert_eq!(hash.range(Bound::Unbounded, Bound::Unbounded), None);
+
+        let mut btree =
+            Index::new("b".to_string(), &table, &columns, IndexKind::Btree, false).unwrap();
+        assert_eq!(btree.find(std::slice::from_ref(&oslo)), Some(vec![2, 0]));
+        let ids = Index::new(
+            "i".to_string(),
+            &table,
+            &["ID".to_string()],
+            IndexKind::Btree,
+            false,
+        )
+        .unwrap();
+        assert_eq!(ids.columns, ["id"]);
+        let (two, four) = (Value::Integer(2), Value::Integer(4));
+        assert_eq!(
+            ids.range(Bound::Excluded(&two), Bound::Included(&four)),
+            Some(vec![0, 3])
+        );
+        assert_eq!(
+            ids.range(Bound::Unbounded, Bound::Excluded(&two)),
+            Some(vec![1])
+        );
+
+        table
+            .rows
+            .push(vec![Value::Integer(5), Value::Text("Oslo".to_string())]);
+        assert!(!btree.covers(table.rows.len()));
+        btree.insert_from(&table.rows, 5);
+        assert!(btree.covers(table.rows.len()));
+        assert_eq!(btree.find(&[oslo]), Some(vec![2, 0, 5]));
+        assert!(Index::new("x".to_string(), &table, &[], IndexKind::Hash, false).is_err());
+    }
+}
@@ -1,6 +1,26 @@
+pub mod clock;
+pub mod disk;
 pub mod index;
+pub mod money;
+pub mod numeric;
 pub mod schema;
+pub mod sequences;
 pub mod storage;
+pub mod timezone;
+pub mod upstream;
+pub mod uuids;
+pub mod wal;
 
-pub use schema::{Column, Database, Table, Value};
-pub use storage::Storage;
+pub use clock::Clock;
+pub use index::{Index, IndexKind};
+pub use money::Currency;
+pub use schema::{
+    Annotation, Column, Database, Expiry, Identity, Rewrite, RewriteAction, RewritePattern,
+    SoftDelete, Table, Tenancy, TenantUser, Value,
+};
+pub use sequences::{Sequence, Sequences};
+pub use storage::{RowChange, Storage, WriteSummary};
+pub use disk::DiskStore;
+pub use upstream::Upstream;
+pub use uuids::{UuidGenerator, UuidMode};
+pub use wal::WriteAheadLog;
@@ -0,0 +1,202 @@
+//! Monetary amounts for `MONEY` columns, declared with an ISO 4217 currency
+//! code as `MONEY(EUR)`. A bare `MONEY` is in US dollars, as PostgreSQL's
+//! `money` is under its default locale.
+//!
+//! Amounts are exact decimals held at the currency's minor unit, so `12.5`
+//! is stored and sent to clients as `12.50` EUR while yen have no decimals
+//! and dinars three. An amount with more decimals than its currency allows
+//! is rejected rather than rounded.
+
+use rust_decimal::Decimal;
+use std::str::FromStr;
+
+use crate::YamlBaseError;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Currency {
+    pub code: &'static str,
+    /// Digits after the decimal point, e.g. 2 for cents
+    pub minor_units: u32,
+    pub symbol: Option<&'static str>,
+}
+
+const fn currency(code: &'static str, minor_units: u32, symbol: Option<&'static str>) -> Currency {
+    Currency {
+        code,
+        minor_units,
+        symbol,
+    }
+}
+
+/// Currencies by code. A symbol shared by several currencies, such as `kr`
+/// or the dollar sign outside the US, is left out so it is never misread.
+const CURRENCIES: &[Currency] = &[
+    Currency::USD,
+    currency("EUR", 2, Some("€")),
+    currency("GBP", 2, Some("£")),
+    currency("JPY", 0, Some("¥")),
+    currency("CHF", 2, None),
+    currency("CAD", 2, None),
+    currency("AUD", 2, None),
+    currency("NZD", 2, None),
+    currency("CNY", 2, None),
+    currency("HKD", 2, None),
+    currency("SGD", 2, None),
+    currency("SEK", 2, None),
+    currency("NOK", 2, None),
+    currency("DKK", 2, None),
+    currency("PLN", 2, Some("zł")),
+    currency("CZK", 2, None),
+    currency("HUF", 2, None),
+    currency("INR", 2, Some("₹")),
+    currency("KRW", 0, Some("₩")),
+    currency("BRL", 2, Some("R$")),
+    currency("MXN", 2, None),
+    currency("ZAR", 2, None),
+    currency("TRY", 2, Some("₺")),
+    currency("ILS", 2, Some("₪")),
+    currency("ISK", 0, None),
+    currency("CLP", 0, None),
+    currency("VND", 0, Some("₫")),
+    currency("BHD", 3, None),
+    currency("KWD", 3, None),
+    currency("OMR", 3, None),
+    currency("JOD", 3, None),
+    currency("TND", 3, None),
+];
+
+impl Currency {
+    pub const USD: Currency = currency("USD", 2, Some("$"));
+
+    pub fn from_code(code: &str) -> crate::Result<Self> {
+        CURRENCIES
+            .iter()
+            .find(|currency| currency.code.eq_ignore_ascii_case(code.trim()))
+            .copied()
+            .ok_or_else(|| {
+                YamlBaseError::TypeConversion(format!("Unknown currency code: {}", code))
+            })
+    }
+
+    /// Bring an amount to the currency's scale, keeping it exact
+    pub fn amount(&self, amount: Decimal) -> crate::Result<Decimal> {
+        if amount.normalize().scale() > self.minor_units {
+            return Err(YamlBaseError::TypeConversion(format!(
+                "Amount {} has more decimals than {} allows ({})",
+                amount, self.code, self.minor_units
+            )));
+        }
+        let mut amount = amount;
+        amount.rescale(self.minor_units);
+        Ok(amount)
+    }
+
+    /// Parse an amount written as `1234.50`, `1,234.50`, `EUR 1234.50`,
+    /// `1234.50 EUR` or `€1,234.50`. A code or symbol must be this currency's.
+    pub fn parse_amount(&self, text: &str) -> crate::Result<Decimal> {
+        let invalid = || YamlBaseError::TypeConversion(format!("Cannot parse amount: {}", text));
+        let trimmed = text.trim();
+        let (negative, mut number) = match trimmed.strip_prefix('-') {
+            Some(rest) => (true, rest.trim_start()),
+            None => (false, trimmed),
+        };
+
+        for marker in [Some(self.code), self.symbol].into_iter().flatten() {
+            if let Some(rest) = strip_prefix_ignore_case(number, marker) {
+                number = rest.trim_start();
+            } else if let Some(rest) = strip_suffix_ignore_case(number, marker) {
+                number = rest.trim_end();
+            }
+        }
+        if let Some(other) = foreign_code(number) {
+            return Err(YamlBaseError::TypeConversion(format!(
+                "Amount {} is in {}, not {}",
+                text, other, self.code
+            )));
+        }
+
+        let digits: String = number.chars().filter(|c| *c != ',' && *c != '_').collect();
+        let digits = if negative {
+            format!("-{}", digits)
+        } else {
+            digits
+        };
+        let amount = Decimal::from_str(&digits).map_err(|_| invalid())?;
+        self.amount(amount)
+    }
+}
+
+fn strip_prefix_ignore_case<'a>(text: &'a str, prefix: &str) -> Option<&'a str> {
+    text.get(..prefix.len())
+        .filter(|head| head.eq_ignore_ascii_case(prefix))
+        .map(|_| &text[prefix.len()..])
+}
+
+fn strip_suffix_ignore_case<'a>(text: &'a str, suffix: &str) -> Option<&'a str> {
+    let start = text.len().checked_sub(suffix.len())?;
+    text.get(start..)
+        .filter(|tail| tail.eq_ignore_ascii_case(suffix))
+        .map(|_| &text[..start])
+}
+
+/// A three letter code left at either end of a numeric amount
+fn foreign_code(number: &str) -> Option<&str> {
+    if !number.chars().any(|c| c.is_ascii_digit()) {
+        return None;
+    }
+    let is_code = |s: &&str| s.len() == 3 && s.chars().all(|c| c.is_ascii_alphabetic());
+    let tail = number
+        .len()
+        .checked_sub(3)
+        .and_then(|start| number.get(start..));
+    [number.get(..3), tail].into_iter().flatten().find(is_code)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn decimal(s: &str) -> Decimal {
+        Decimal::from_str(s).unwrap()
+    }
+
+    #[test]
+    fn test_amounts_take_the_currency_scale() {
+        let eur = Currency::from_code("eur").unwrap();
+        assert_eq!(eur.amount(decimal("12.5")).unwrap().to_string(), "12.50");
+        assert_eq!(eur.amount(decimal("12.500")).unwrap().to_string(), "12.50");
+        assert!(eur.amount(decimal("12.505")).is_err());
+
+        let yen = Currency::from_code("JPY").unwrap();
+        assert_eq!(yen.amount(decimal("1500")).unwrap().to_string(), "1500");
+        assert!(yen.amount(decimal("1500.5")).is_err());
+        let dinar = Currency::from_code("KWD").unwrap();
+        assert_eq!(dinar.amount(decimal("1.25")).unwrap().to_string(), "1.250");
+
+        assert!(Currency::from_code("XYZ").is_err());
+    }
+
+    #[test]
+    fn test_amounts_parse_with_codes_symbols_and_separators() {
+        let eur = Currency::from_code("EUR").unwrap();
+        for text in [
+            "1234.5",
+            "1,234.50",
+            "EUR 1234.50",
+            "1234.50 eur",
+            "€1,234.50",
+        ] {
+            assert_eq!(
+                eur.parse_amount(text).unwrap(),
+                decimal("1234.50"),
+                "{}",
+                text
+            );
+        }
+        assert_eq!(eur.parse_amount("-€5").unwrap().to_string(), "-5.00");
+        assert_eq!(eur.parse_amount("€-5").unwrap().to_string(), "-5.00");
+        assert!(eur.parse_amount("GBP 5.00").is_err());
+        assert!(eur.parse_amount("$5.00").is_err());
+        assert!(eur.parse_amount("five").is_err());
+    }
+}
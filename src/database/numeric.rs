@@ -0,0 +1,144 @@
+//! Exact arithmetic for `DECIMAL` / `NUMERIC` values.
+//!
+//! A `DECIMAL(10,2)` column holds decimals rather than floats, so prices such
+//! as `19.99` stay exact through comparisons, sums and averages, and show as
+//! PostgreSQL shows them: at the column's scale, trailing zeros included.
+//! Values are rounded to the scale as they are stored, half away from zero,
+//! and a value with more integer digits than the precision leaves room for
+//! is refused, as PostgreSQL's `numeric field overflow` does. Division gives
+//! as many decimals as PostgreSQL's does, at least 16 significant digits.
+
+use rust_decimal::{Decimal, RoundingStrategy};
+
+use crate::YamlBaseError;
+
+/// The most decimals a value can have
+const MAX_SCALE: u32 = 28;
+
+/// The significant digits a quotient has at least, as in PostgreSQL
+const MIN_SIGNIFICANT_DIGITS: i64 = 16;
+
+/// A float at its shortest decimal form, which is how numeric literals such
+/// as `0.1` arrive: `0.1` rather than the binary fraction closest to it
+pub fn from_f64(f: f64) -> Option<Decimal> {
+    if !f.is_finite() {
+        return None;
+    }
+    f.to_string().parse().ok()
+}
+
+/// A single-precision float at its shortest decimal form, as [`from_f64`]
+pub fn from_f32(f: f32) -> Option<Decimal> {
+    if !f.is_finite() {
+        return None;
+    }
+    f.to_string().parse().ok()
+}
+
+/// Bring a value to a `DECIMAL(precision, scale)` column: rounded to the
+/// scale and shown with all of its decimals
+pub fn fit(value: Decimal, precision: u32, scale: u32) -> crate::Result<Decimal> {
+    let scale = scale.min(MAX_SCALE);
+    let mut fitted = value.round_dp_with_strategy(scale, RoundingStrategy::MidpointAwayFromZero);
+    fitted.rescale(scale);
+    let integer_digits = precision.saturating_sub(scale);
+    let limit = (integer_digits < MAX_SCALE)
+        .then(|| Decimal::from_i128_with_scale(10i128.pow(integer_digits), 0));
+    if limit.is_some_and(|limit| fitted.trunc().abs() >= limit) {
+        return Err(YamlBaseError::TypeConversion(format!(
+            "Numeric field overflow: a field with precision {}, scale {} must round to an absolute value less than 10^{}",
+            precision, scale, integer_digits
+        )));
+    }
+    Ok(fitted)
+}
+
+/// `left / right` with its decimals chosen as PostgreSQL does, or `None`
+/// for a division by zero or a quotient out of range
+pub fn quotient(left: Decimal, right: Decimal) -> Option<Decimal> {
+    if right.is_zero() {
+        return None;
+    }
+    // Quotients have at least 16 significant digits, counted in the base
+    // 10000 digits PostgreSQL keeps numerics in, and no fewer decimals than
+    // either operand
+    let (left_weight, left_first) = leading_digit(left);
+    let (right_weight, right_first) = leading_digit(right);
+    let mut weight = left_weight - right_weight;
+    if left_first <= right_first {
+        weight -= 1;
+    }
+    let scale = (MIN_SIGNIFICANT_DIGITS - weight * 4)
+        .max(left.scale() as i64)
+        .max(right.scale() as i64)
+        .clamp(0, MAX_SCALE as i64) as u32;
+    let mut quotient = left
+        .checked_div(right)?
+        .round_dp_with_strategy(scale, RoundingStrategy::MidpointAwayFromZero);
+    quotient.rescale(scale);
+    Some(quotient)
+}
+
+/// The position and value of a decimal's leading base 10000 digit, so that
+/// `12345.6` has `1` at position 1; zero has none and counts as `0` at 0
+fn leading_digit(value: Decimal) -> (i64, i128) {
+    let mantissa = value.mantissa().abs();
+    if mantissa == 0 {
+        return (0, 0);
+    }
+    let digits = mantissa.to_string().len() as i64;
+    let exponent = digits - 1 - value.scale() as i64;
+    let weight = exponent.div_euclid(4);
+    let shift = -(value.scale() as i64) - 4 * weight;
+    let first = match shift {
+        0.. => mantissa * 10i128.pow(shift as u32),
+        _ => mantissa / 10i128.pow(-shift as u32),
+    };
+    (weight, first)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::str::FromStr;
+
+    fn decimal(s: &str) -> Decimal {
+        Decimal::from_str(s).unwrap()
+    }
+
+    #[test]
+    fn test_values_fit_their_column() {
+        assert_eq!(fit(decimal("19.9"), 10, 2).unwrap().to_string(), "19.90");
+        assert_eq!(fit(decimal("2.345"), 10, 2).unwrap().to_string(), "2.35");
+        assert_eq!(fit(decimal("-2.345"), 10, 2).unwrap().to_string(), "-2.35");
+        assert_eq!(
+            fit(decimal("99999999.99"), 10, 2).unwrap().to_string(),
+            "99999999.99"
+        );
+        assert!(fit(decimal("99999999.995"), 10, 2).is_err());
+        assert!(fit(decimal("123456"), 5, 2).is_err());
+        assert_eq!(fit(decimal("0.5"), 1, 0).unwrap().to_string(), "1");
+
+        assert_eq!(from_f64(0.1), Some(decimal("0.1")));
+        assert_eq!(from_f64(19.99), Some(decimal("19.99")));
+        assert_eq!(from_f32(19.99), Some(decimal("19.99")));
+        assert_eq!(from_f64(f64::NAN), None);
+    }
+
+    #[test]
+    fn test_quotients_have_postgres_scale() {
+        let cases = [
+            ("30.00", "2", "15.0000000000000000"),
+            ("10", "3", "3.3333333333333333"),
+            ("1", "3", "0.33333333333333333333"),
+            ("100000", "3", "33333.333333333333"),
+            ("2.50", "0.5", "5.0000000000000000"),
+            ("0", "2", "0.00000000000000000000"),
+        ];
+        for (left, right, expected) in cases {
+            let result = quotient(decimal(left), decimal(right)).unwrap();
+            assert_eq!(result.to_string(), expected, "{} / {}", left, right);
+        }
+        assert_eq!(quotient(decimal("1"), Decimal::ZERO), None);
+    }
+}
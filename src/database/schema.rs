@@ -2,14 +2,145 @@ use chrono::{NaiveDate, NaiveDateTime, NaiveTime};
 use indexmap::IndexMap;
 use rust_decimal::Decimal;
 use serde_json::Value as JsonValue;
+use std::sync::Arc;
 use uuid::Uuid;
 
+use crate::database::index::Index;
+use crate::database::numeric;
+use crate::script::ScriptEngine;
 use crate::yaml::schema::SqlType;
 
 #[derive(Debug, Clone)]
 pub struct Database {
     pub name: String,
     pub tables: IndexMap<String, Table>,
+    pub script: Option<Arc<ScriptEngine>>,
+    /// Tables left out of the dataset by `--skip-invalid`, with the reason they failed to load
+    pub errored_tables: IndexMap<String, String>,
+    /// SHA-256 of the dataset file contents this database was built from
+    pub checksum: Option<String>,
+    /// Tables whose rows expire, keyed by table name
+    pub expiries: IndexMap<String, Expiry>,
+    /// Tables whose soft-deleted rows queries skip, by table name
+    pub soft_deletes: IndexMap<String, SoftDelete>,
+    /// Users restricted to their tenant's rows, from `database.tenancy`
+    pub tenancy: Option<Tenancy>,
+    /// Rules from `database.rewrites`, tried in order before each statement runs
+    pub rewrites: Vec<Rewrite>,
+    /// Documented columns from each table's `annotations`, by table name and
+    /// then column name
+    pub annotations: IndexMap<String, IndexMap<String, Annotation>>,
+}
+
+/// When the rows of a table expire, by the server [`Clock`](crate::database::Clock)
+#[derive(Debug, Clone, PartialEq)]
+pub enum Expiry {
+    /// Every row expires at this time
+    At(NaiveDateTime),
+    /// Every row expires this long after the clock started
+    After(chrono::Duration),
+    /// Each row expires `ttl` after the TIMESTAMP or DATE in column `index`;
+    /// rows with NULL there never expire
+    Column { index: usize, ttl: chrono::Duration },
+}
+
+impl Expiry {
+    pub fn is_expired(
+        &self,
+        row: &[Value],
+        clock_start: NaiveDateTime,
+        now: NaiveDateTime,
+    ) -> bool {
+        match self {
+            Expiry::At(at) => *at <= now,
+            Expiry::After(after) => clock_start + *after <= now,
+            Expiry::Column { index, ttl } => match row.get(*index) {
+                Some(Value::Timestamp(at)) => *at + *ttl <= now,
+                Some(Value::Date(date)) => date.and_hms_opt(0, 0, 0).unwrap() + *ttl <= now,
+                _ => false,
+            },
+        }
+    }
+}
+
+/// Which rows of a table are live. Queries only see those unless the session
+/// sets `yamlbase.include_deleted`, like a view or row policy over the table.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SoftDelete {
+    /// Condition over the table's columns that live rows satisfy, e.g. `deleted_at IS NULL`
+    pub filter: sqlparser::ast::Expr,
+}
+
+/// What a column holds, where its values come from and whether it is
+/// personal data, as catalogs and the admin API report it
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Annotation {
+    pub description: Option<String>,
+    pub source: Option<String>,
+    pub pii: bool,
+}
+
+impl Annotation {
+    /// The column's comment, as `COMMENT ON COLUMN` would have set it: the
+    /// description followed by the source and PII flag, e.g. `Contact
+    /// address (source: crm.contacts.email; PII)`
+    pub fn comment(&self) -> String {
+        let mut notes = Vec::new();
+        if let Some(source) = &self.source {
+            notes.push(format!("source: {}", source));
+        }
+        if self.pii {
+            notes.push("PII".to_string());
+        }
+        match (&self.description, notes.is_empty()) {
+            (Some(description), true) => description.clone(),
+            (Some(description), false) => format!("{} ({})", description, notes.join("; ")),
+            (None, _) => notes.join("; "),
+        }
+    }
+}
+
+/// Users who stand for tenants of a multi-tenant application. Connected as
+/// one, a session only sees and writes the rows whose tenant column holds the
+/// user's tenant, in the tables that have the column; the others are shared.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Tenancy {
+    pub column: String,
+    /// Tenant users by user name
+    pub users: IndexMap<String, TenantUser>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct TenantUser {
+    pub password: String,
+    pub tenant: Value,
+}
+
+/// A rule redirecting statements that a client library sends and yamlbase
+/// cannot run as written, such as a vendor's catalog queries
+#[derive(Debug, Clone)]
+pub struct Rewrite {
+    pub pattern: RewritePattern,
+    pub action: RewriteAction,
+}
+
+#[derive(Debug, Clone)]
+pub enum RewritePattern {
+    /// Searched for in the statement's SQL as yamlbase prints it
+    Regex(regex::Regex),
+    /// Matches statements with this syntax tree
+    Statement(Box<sqlparser::ast::Statement>),
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum RewriteAction {
+    /// SQL to run instead; a regex's groups may be referred to as `$1` or `${name}`
+    Replace(String),
+    /// Rows to answer with
+    Result {
+        columns: Vec<String>,
+        rows: Vec<Vec<Value>>,
+    },
 }
 
 #[derive(Debug, Clone)]
@@ -19,6 +150,31 @@ pub struct Table {
     pub column_index: IndexMap<String, usize>,
     pub rows: Vec<Vec<Value>>,
     pub primary_key_index: Option<usize>,
+    /// Secondary indexes made by `CREATE INDEX`, kept current by every write
+    pub indexes: Vec<Index>,
+    /// Columns numbering the rows inserted without a value for them
+    pub identities: Vec<Identity>,
+}
+
+/// A `SERIAL`, `GENERATED ... AS IDENTITY` or MySQL `AUTO_INCREMENT` column
+#[derive(Debug, Clone, PartialEq)]
+pub struct Identity {
+    pub column: String,
+    /// The number the next row inserted without a value gets
+    pub next: i64,
+    /// MySQL's `AUTO_INCREMENT`, which every `TRUNCATE` restarts
+    pub auto_increment: bool,
+}
+
+impl Identity {
+    /// Move `next` past the numbers the rows hold in column `idx`
+    fn advance_past(&mut self, idx: usize, rows: &[Vec<Value>]) {
+        for row in rows {
+            if let Value::Integer(value) = row[idx] {
+                self.next = self.next.max(value.saturating_add(1));
+            }
+        }
+    }
 }
 
 #[derive(Debug, Clone)]
@@ -128,6 +284,14 @@ impl Database {
         Self {
             name,
             tables: IndexMap::new(),
+            script: None,
+            errored_tables: IndexMap::new(),
+            checksum: None,
+            expiries: IndexMap::new(),
+            soft_deletes: IndexMap::new(),
+            tenancy: None,
+            rewrites: Vec::new(),
+            annotations: IndexMap::new(),
         }
     }
 
@@ -157,6 +321,34 @@ impl Database {
         None
     }
 
+    /// The password of a tenant user from `database.tenancy`
+    pub fn tenant_password(&self, user: &str) -> Option<&str> {
+        self.tenancy
+            .as_ref()?
+            .users
+            .get(user)
+            .map(|tenant_user| tenant_user.password.as_str())
+    }
+
+    /// The index named `name`, and the table it indexes
+    pub fn find_index(&self, name: &str) -> Option<(&Table, &Index)> {
+        self.tables.values().find_map(|table| {
+            table
+                .indexes
+                .iter()
+                .find(|index| index.name.eq_ignore_ascii_case(name))
+                .map(|index| (table, index))
+        })
+    }
+
+    /// Why a table skipped by `--skip-invalid` failed to load
+    pub fn table_error(&self, name: &str) -> Option<&str> {
+        self.errored_tables
+            .iter()
+            .find(|(table_name, _)| table_name.eq_ignore_ascii_case(name))
+            .map(|(_, reason)| reason.as_str())
+    }
+
     pub fn get_table_mut(&mut self, name: &str) -> Option<&mut Table> {
         // First try exact match
         if self.tables.contains_key(name) {
@@ -194,10 +386,57 @@ impl Table {
             column_index,
             rows: Vec::new(),
             primary_key_index,
+            indexes: Vec::new(),
+            identities: Vec::new(),
+        }
+    }
+
+    /// Keep the identity columns ahead of the values `rows` were inserted
+    /// with, so a number given explicitly is not given out again
+    pub fn advance_identities(&mut self, rows: &[Vec<Value>]) {
+        for identity in &mut self.identities {
+            if let Some(&idx) = self.column_index.get(&identity.column) {
+                identity.advance_past(idx, rows);
+            }
+        }
+    }
+
+    /// Restart the identity columns at 1, as `TRUNCATE ... RESTART IDENTITY`
+    /// does, or past the rows still holding numbers. `all` restarts columns
+    /// of every kind, else only `AUTO_INCREMENT` ones.
+    pub fn restart_identities(&mut self, all: bool) {
+        for identity in &mut self.identities {
+            if all || identity.auto_increment {
+                identity.next = 1;
+                if let Some(&idx) = self.column_index.get(&identity.column) {
+                    identity.advance_past(idx, &self.rows);
+                }
+            }
+        }
+    }
+
+    /// Rebuild the secondary indexes after the rows were replaced or moved
+    pub fn reindex(&mut self) {
+        for index in &mut self.indexes {
+            index.build(&self.rows);
+        }
+    }
+
+    /// Add the rows appended from `start` on to the secondary indexes
+    pub fn index_appended(&mut self, start: usize) {
+        for index in &mut self.indexes {
+            index.insert_from(&self.rows, start);
         }
     }
 
     pub fn insert_row(&mut self, row: Vec<Value>) -> crate::Result<()> {
+        self.validate_row(&row)?;
+        self.rows.push(row);
+        Ok(())
+    }
+
+    /// Check a row's arity, value types and NOT NULL constraints against the columns
+    pub fn validate_row(&self, row: &[Value]) -> crate::Result<()> {
         if row.len() != self.columns.len() {
             return Err(crate::YamlBaseError::Database {
                 message: format!(
@@ -224,7 +463,6 @@ impl Table {
             }
         }
 
-        self.rows.push(row);
         Ok(())
     }
 
@@ -260,11 +498,20 @@ impl Value {
                     SqlType::Char(_) | SqlType::Varchar(_) | SqlType::Text
                 )
                 | (Value::Boolean(_), SqlType::Boolean)
-                | (Value::Timestamp(_), SqlType::Timestamp)
+                | (
+                    Value::Timestamp(_),
+                    SqlType::Timestamp | SqlType::TimestampTz
+                )
                 | (Value::Date(_), SqlType::Date)
                 | (Value::Time(_), SqlType::Time)
                 | (Value::Uuid(_), SqlType::Uuid)
                 | (Value::Json(_), SqlType::Json)
+                | (Value::Text(_), SqlType::Point)
+                | (Value::Decimal(_), SqlType::Money(_))
+                | (Value::Text(_), SqlType::Hstore)
+                | (Value::Text(_), SqlType::Bytea)
+                | (Value::Text(_), SqlType::Enum(_))
+                | (Value::Text(_), SqlType::Array(_))
         )
     }
 
@@ -305,19 +552,19 @@ impl Value {
             }
             (Value::Decimal(a), Value::Double(b)) => {
                 // Convert double to decimal for comparison
-                Decimal::from_f64(*b).map(|b_decimal| a.cmp(&b_decimal))
+                numeric::from_f64(*b).map(|b_decimal| a.cmp(&b_decimal))
             }
             (Value::Double(a), Value::Decimal(b)) => {
                 // Convert double to decimal for comparison
-                Decimal::from_f64(*a).map(|a_decimal| a_decimal.cmp(b))
+                numeric::from_f64(*a).map(|a_decimal| a_decimal.cmp(b))
             }
             (Value::Decimal(a), Value::Float(b)) => {
                 // Convert float to decimal for comparison
-                Decimal::from_f32(*b).map(|b_decimal| a.cmp(&b_decimal))
+                numeric::from_f32(*b).map(|b_decimal| a.cmp(&b_decimal))
             }
             (Value::Float(a), Value::Decimal(b)) => {
                 // Convert float to decimal for comparison
-                Decimal::from_f32(*a).map(|a_decimal| a_decimal.cmp(b))
+                numeric::from_f32(*a).map(|a_decimal| a_decimal.cmp(b))
             }
 
             _ => None,
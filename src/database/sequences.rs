@@ -0,0 +1,164 @@
+use indexmap::IndexMap;
+use std::sync::{Arc, Mutex};
+
+use crate::YamlBaseError;
+
+/// A `CREATE SEQUENCE` object
+#[derive(Debug, Clone, PartialEq)]
+pub struct Sequence {
+    pub start: i64,
+    pub increment: i64,
+    /// The value `nextval()` last gave, or `setval()` set; `None` until then
+    pub last: Option<i64>,
+}
+
+impl Sequence {
+    pub fn new(start: i64, increment: i64) -> Self {
+        Self {
+            start,
+            increment,
+            last: None,
+        }
+    }
+}
+
+/// The sequences `CREATE SEQUENCE` made, which `nextval()` and `setval()`
+/// advance. Clones share the same sequences, so every connection draws
+/// from one counter.
+#[derive(Debug, Clone, Default)]
+pub struct Sequences {
+    /// Keyed by lower-cased name
+    sequences: Arc<Mutex<IndexMap<String, Sequence>>>,
+}
+
+impl Sequences {
+    /// Add a sequence; with `if_not_exists` an existing one is kept and
+    /// `false` returned
+    pub fn create(
+        &self,
+        name: &str,
+        sequence: Sequence,
+        if_not_exists: bool,
+    ) -> crate::Result<bool> {
+        let mut sequences = self.sequences.lock().unwrap();
+        let key = name.to_lowercase();
+        if sequences.contains_key(&key) {
+            if if_not_exists {
+                return Ok(false);
+            }
+            return Err(YamlBaseError::Database {
+                message: format!("relation \"{}\" already exists", name),
+            });
+        }
+        sequences.insert(key, sequence);
+        Ok(true)
+    }
+
+    /// Drop the sequences, all or none: every one must exist unless
+    /// `if_exists` is set
+    pub fn remove(&self, names: &[String], if_exists: bool) -> crate::Result<()> {
+        let mut sequences = self.sequences.lock().unwrap();
+        if !if_exists {
+            if let Some(missing) = names
+                .iter()
+                .find(|name| !sequences.contains_key(&name.to_lowercase()))
+            {
+                return Err(unknown_sequence(missing));
+            }
+        }
+        for name in names {
+            sequences.shift_remove(&name.to_lowercase());
+        }
+        Ok(())
+    }
+
+    pub fn contains(&self, name: &str) -> bool {
+        self.sequences
+            .lock()
+            .unwrap()
+            .contains_key(&name.to_lowercase())
+    }
+
+    /// Advance a sequence and return its new value, as `nextval()` does
+    pub fn next(&self, name: &str) -> crate::Result<i64> {
+        let mut sequences = self.sequences.lock().unwrap();
+        let sequence = sequences
+            .get_mut(&name.to_lowercase())
+            .ok_or_else(|| unknown_sequence(name))?;
+        let next = match sequence.last {
+            None => Some(sequence.start),
+            Some(last) => last.checked_add(sequence.increment),
+        }
+        .ok_or_else(|| YamlBaseError::Database {
+            message: format!("nextval: reached maximum value of sequence \"{}\"", name),
+        })?;
+        sequence.last = Some(next);
+        Ok(next)
+    }
+
+    /// Set the value a sequence last gave, as `setval()` does; unless
+    /// `is_called`, the next `nextval()` returns `value` itself
+    pub fn set(&self, name: &str, value: i64, is_called: bool) -> crate::Result<()> {
+        let mut sequences = self.sequences.lock().unwrap();
+        let sequence = sequences
+            .get_mut(&name.to_lowercase())
+            .ok_or_else(|| unknown_sequence(name))?;
+        sequence.last = match is_called {
+            true => Some(value),
+            false => value.checked_sub(sequence.increment),
+        };
+        Ok(())
+    }
+}
+
+fn unknown_sequence(name: &str) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!("relation \"{}\" does not exist", name),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_sequences_count_from_their_start() {
+        let sequences = Sequences::default();
+        assert!(
+            sequences
+                .create("order_no", Sequence::new(100, 10), false)
+                .unwrap()
+        );
+        assert!(
+            !sequences
+                .create("ORDER_NO", Sequence::new(1, 1), true)
+                .unwrap()
+        );
+        assert!(
+            sequences
+                .create("order_no", Sequence::new(1, 1), false)
+                .is_err()
+        );
+
+        let shared = sequences.clone();
+        assert_eq!(sequences.next("order_no").unwrap(), 100);
+        assert_eq!(shared.next("Order_No").unwrap(), 110);
+
+        sequences.set("order_no", 500, true).unwrap();
+        assert_eq!(sequences.next("order_no").unwrap(), 510);
+        sequences.set("order_no", 500, false).unwrap();
+        assert_eq!(sequences.next("order_no").unwrap(), 500);
+
+        assert!(sequences.next("invoice_no").is_err());
+        assert!(
+            sequences
+                .remove(&["order_no".to_string(), "invoice_no".to_string()], false)
+                .is_err()
+        );
+        assert!(sequences.contains("order_no"));
+        sequences
+            .remove(&["order_no".to_string(), "invoice_no".to_string()], true)
+            .unwrap();
+        assert!(!sequences.contains("order_no"));
+    }
+}
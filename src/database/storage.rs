@@ -1,12 +1,65 @@
 use dashmap::DashMap;
+use std::collections::{HashMap, HashSet};
 use std::sync::Arc;
-use tokio::sync::RwLock;
+use std::sync::atomic::{AtomicU64, Ordering};
+use tokio::sync::{Mutex, OwnedMutexGuard, RwLock, watch};
+use tracing::debug;
 
-use crate::database::{Database, Value};
+use crate::crash_dump::QueryLog;
+use crate::database::disk::{DiskStore, TableLease};
+use crate::database::upstream::Upstream;
+use crate::database::wal::{WalRecord, WriteAheadLog};
+use crate::database::{Clock, Column, Database, Index, Sequences, Table, UuidGenerator, Value};
+use crate::server::{Sessions, WebhookEvent, WebhookNotifier};
+use crate::sql::advisor::IndexAdvisor;
+use crate::sql::budget::QueryBudgets;
+use crate::sql::n_plus_one::NPlusOneDetector;
+use crate::yaml::writer::row_to_yaml;
+
+/// A single row mutation, addressed by row position in the table being written
+#[derive(Debug, Clone, PartialEq)]
+pub enum RowChange {
+    Insert(Vec<Value>),
+    Update { index: usize, row: Vec<Value> },
+    Delete { index: usize },
+}
+
+/// Rows affected by a committed write, for result counts and change notifications
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct WriteSummary {
+    pub table: String,
+    pub inserted: Vec<Vec<Value>>,
+    /// New versions of updated rows
+    pub updated: Vec<Vec<Value>>,
+    pub deleted: Vec<Vec<Value>>,
+}
+
+impl WriteSummary {
+    pub fn affected_rows(&self) -> usize {
+        self.inserted.len() + self.updated.len() + self.deleted.len()
+    }
+}
 
 pub struct Storage {
     database: Arc<RwLock<Database>>,
     primary_key_index: Arc<DashMap<String, DashMap<Value, usize>>>, // table -> pk_value -> row_idx
+    changes: Arc<watch::Sender<u64>>, // bumped whenever the database contents are replaced or modified
+    table_writers: Arc<DashMap<String, Arc<Mutex<()>>>>, // lower-cased table name -> writer lock
+    wal: Option<Arc<WriteAheadLog>>,
+    disk: Option<Arc<DiskStore>>,
+    upstream: Option<Arc<Upstream>>,
+    index_advisor: Arc<IndexAdvisor>,
+    query_budgets: Arc<QueryBudgets>,
+    n_plus_one: Option<Arc<NPlusOneDetector>>,
+    sessions: Arc<Sessions>,
+    query_log: Option<Arc<QueryLog>>,
+    dataset_version: Arc<AtomicU64>, // 1 for the dataset the server started with, bumped on every reload
+    clock: Clock,
+    uuids: UuidGenerator,
+    sequences: Sequences,
+    webhooks: WebhookNotifier,
+    read_only: bool,
+    write_back: bool,
 }
 
 impl Storage {
@@ -14,6 +67,23 @@ impl Storage {
         let storage = Self {
             database: Arc::new(RwLock::new(database)),
             primary_key_index: Arc::new(DashMap::new()),
+            changes: Arc::new(watch::channel(0).0),
+            table_writers: Arc::new(DashMap::new()),
+            wal: None,
+            disk: None,
+            upstream: None,
+            index_advisor: Arc::new(IndexAdvisor::default()),
+            query_budgets: Arc::new(QueryBudgets::default()),
+            n_plus_one: None,
+            sessions: Arc::new(Sessions::default()),
+            query_log: None,
+            dataset_version: Arc::new(AtomicU64::new(1)),
+            clock: Clock::system(),
+            uuids: UuidGenerator::default(),
+            sequences: Sequences::default(),
+            webhooks: WebhookNotifier::default(),
+            read_only: false,
+            write_back: false,
         };
 
         // Build initial indexes - try to spawn if in tokio context, otherwise do it synchronously
@@ -36,13 +106,238 @@ impl Storage {
         storage
     }
 
+    /// Send a `write` event to `webhooks` for every subsequent committed write
+    pub fn with_webhooks(mut self, webhooks: WebhookNotifier) -> Self {
+        self.webhooks = webhooks;
+        self
+    }
+
+    /// Log every subsequent write to `wal` before applying it
+    pub fn with_wal(mut self, wal: Arc<WriteAheadLog>) -> Self {
+        self.wal = Some(wal);
+        self
+    }
+
+    pub fn wal(&self) -> Option<&Arc<WriteAheadLog>> {
+        self.wal.as_ref()
+    }
+
+    /// Note that the YAML file's `data` sections are rewritten from the tables
+    /// after every write, as `--write-back` does
+    pub fn with_write_back(mut self) -> Self {
+        self.write_back = true;
+        self
+    }
+
+    /// The option that keeps rows across restarts, if one is on. Both record
+    /// rows only, so schema changes and sequences would be lost.
+    pub fn persisted_by(&self) -> Option<&'static str> {
+        if self.wal.is_some() {
+            Some("--persist")
+        } else if self.write_back {
+            Some("--write-back")
+        } else {
+            None
+        }
+    }
+
+    /// Serve disk-backed tables from `disk`, loading their rows on demand
+    pub fn with_disk_store(mut self, disk: Arc<DiskStore>) -> Self {
+        self.disk = Some(disk);
+        self
+    }
+
+    pub fn is_disk_backed(&self) -> bool {
+        self.disk.is_some()
+    }
+
+    /// Read tables and rows that queries miss through from `upstream`
+    pub fn with_upstream(mut self, upstream: Arc<Upstream>) -> Self {
+        self.upstream = Some(upstream);
+        self
+    }
+
+    pub fn upstream(&self) -> Option<&Upstream> {
+        self.upstream.as_deref()
+    }
+
+    /// Refuse every write from clients, as a replica does; the replicator
+    /// still swaps in the primary's copy
+    pub fn with_read_only(mut self) -> Self {
+        self.read_only = true;
+        self
+    }
+
+    pub fn is_read_only(&self) -> bool {
+        self.read_only
+    }
+
+    /// Make sure the rows of `tables` are in memory, and keep them there until
+    /// the returned lease is dropped. Unknown names are ignored.
+    pub async fn ensure_loaded(&self, tables: &[String]) -> crate::Result<Option<TableLease>> {
+        let Some(disk) = &self.disk else {
+            return Ok(None);
+        };
+
+        let mut names: Vec<String> = {
+            let db = self.database.read().await;
+            tables
+                .iter()
+                .filter_map(|name| db.get_table(name))
+                .map(|table| table.name.clone())
+                .filter(|name| disk.manages(name))
+                .collect()
+        };
+        names.sort();
+        names.dedup();
+        let lease = disk.pin(names.clone());
+
+        if disk.missing(&names).is_empty() {
+            return Ok(Some(lease));
+        }
+        let _loading = disk.lock_loading().await;
+        for name in disk.missing(&names) {
+            let columns = match self.database.read().await.get_table(&name) {
+                Some(table) => table.columns.clone(),
+                None => continue,
+            };
+            let rows = disk.load_rows(&name, &columns).await?;
+
+            let mut db = self.database.write().await;
+            if let Some(table) = db.get_table_mut(&name) {
+                table.rows = rows;
+                self.index_table(table);
+            }
+            for evicted in disk.admit(&name) {
+                debug!("Evicting table {} from memory", evicted);
+                if let Some(table) = db.get_table_mut(&evicted) {
+                    table.rows = Vec::new();
+                }
+                self.primary_key_index.remove(&evicted);
+            }
+        }
+
+        Ok(Some(lease))
+    }
+
+    /// Workload statistics behind the admin API's index recommendations
+    pub fn index_advisor(&self) -> &IndexAdvisor {
+        &self.index_advisor
+    }
+
+    /// Count queries against the scenario budgets in `budgets`
+    pub fn with_query_budgets(mut self, budgets: Arc<QueryBudgets>) -> Self {
+        self.query_budgets = budgets;
+        self
+    }
+
+    pub fn query_budgets(&self) -> &QueryBudgets {
+        &self.query_budgets
+    }
+
+    /// Watch every connection for N+1 query bursts
+    pub fn with_n_plus_one_detector(mut self, detector: Arc<NPlusOneDetector>) -> Self {
+        self.n_plus_one = Some(detector);
+        self
+    }
+
+    pub fn n_plus_one_detector(&self) -> Option<&NPlusOneDetector> {
+        self.n_plus_one.as_deref()
+    }
+
+    /// Count sessions against `sessions`' connection quotas
+    pub fn with_sessions(mut self, sessions: Arc<Sessions>) -> Self {
+        self.sessions = sessions;
+        self
+    }
+
+    pub fn sessions(&self) -> &Arc<Sessions> {
+        &self.sessions
+    }
+
+    /// Remember the statements run, for crash dumps
+    pub fn with_query_log(mut self, log: Arc<QueryLog>) -> Self {
+        self.query_log = Some(log);
+        self
+    }
+
+    pub fn query_log(&self) -> Option<&Arc<QueryLog>> {
+        self.query_log.as_ref()
+    }
+
+    /// Tell time by `clock` instead of the system clock
+    pub fn with_clock(mut self, clock: Clock) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    pub fn clock(&self) -> &Clock {
+        &self.clock
+    }
+
+    /// Make UUIDs with `uuids` instead of at random
+    pub fn with_uuids(mut self, uuids: UuidGenerator) -> Self {
+        self.uuids = uuids;
+        self
+    }
+
+    pub fn uuids(&self) -> &UuidGenerator {
+        &self.uuids
+    }
+
+    /// Share `sequences` with another storage, as a scratch database does
+    pub fn with_sequences(mut self, sequences: Sequences) -> Self {
+        self.sequences = sequences;
+        self
+    }
+
+    pub fn sequences(&self) -> &Sequences {
+        &self.sequences
+    }
+
     pub fn database(&self) -> Arc<RwLock<Database>> {
         Arc::clone(&self.database)
     }
 
+    /// Swap in a freshly loaded dataset in place of the current one. Queries
+    /// see either the old dataset or the new one with its indexes, never a mix.
+    ///
+    /// Writers to the tables of either dataset are waited for, as they address
+    /// the rows they change by their positions in the old one.
+    pub async fn reload(&self, database: Database) {
+        let mut table_names: Vec<String> = database.tables.keys().cloned().collect();
+        table_names.extend(self.database.read().await.tables.keys().cloned());
+        let _writer_guards = self.lock_writers(&table_names).await;
+
+        let mut db = self.database.write().await;
+        *db = database;
+        self.rebuild_indexes_of(&db);
+        self.dataset_version.fetch_add(1, Ordering::SeqCst);
+        drop(db);
+        self.mark_changed();
+    }
+
+    /// How many datasets have been loaded, counting the initial one
+    pub fn dataset_version(&self) -> u64 {
+        self.dataset_version.load(Ordering::SeqCst)
+    }
+
+    /// Signal subscribers that the database contents changed
+    pub fn mark_changed(&self) {
+        self.changes.send_modify(|version| *version += 1);
+    }
+
+    /// Watch for [`Storage::mark_changed`] calls; the value is a change counter
+    pub fn subscribe_changes(&self) -> watch::Receiver<u64> {
+        self.changes.subscribe()
+    }
+
     pub async fn rebuild_indexes(&self) {
         let db = self.database.read().await;
+        self.rebuild_indexes_of(&db);
+    }
 
+    fn rebuild_indexes_of(&self, db: &Database) {
         for (table_name, table) in &db.tables {
             if let Some(pk_idx) = table.primary_key_index {
                 let table_index = self
@@ -69,12 +364,404 @@ impl Storage {
             if let Some(row_idx) = table_index.get(pk_value) {
                 let db = self.database.read().await;
                 if let Some(table) = db.get_table(table_name) {
-                    return table.rows.get(*row_idx).cloned();
+                    // The index is maintained outside the database lock, so confirm the hit
+                    let pk_idx = table.primary_key_index?;
+                    return table
+                        .rows
+                        .get(*row_idx)
+                        .filter(|row| &row[pk_idx] == pk_value)
+                        .cloned();
                 }
             }
         }
         None
     }
+
+    /// Atomically modify one table.
+    ///
+    /// Writers to the same table are serialized by a per-table lock, while
+    /// writers to different tables and all readers proceed concurrently. `plan`
+    /// inspects the committed table (under a shared read lock) and returns the
+    /// changes to make; they are validated as a whole and then applied under a
+    /// short exclusive lock, so readers see either none or all of a statement's
+    /// effects and a failed statement leaves no trace.
+    ///
+    /// With a write-ahead log attached, the changes are durably logged before
+    /// they are applied.
+    pub async fn write_table<F>(&self, table_name: &str, plan: F) -> crate::Result<WriteSummary>
+    where
+        F: FnOnce(&Table) -> crate::Result<Vec<RowChange>>,
+    {
+        let writer = self.table_writer(table_name);
+        let _writer_guard = writer.lock().await;
+        let _lease = self.ensure_loaded(&[table_name.to_string()]).await?;
+
+        let (changes, record) = {
+            let db = self.database.read().await;
+            let table = db
+                .get_table(table_name)
+                .ok_or_else(|| unknown_table(table_name))?;
+            let changes = plan(table)?;
+            let record = self.validate_and_record(table, &changes)?;
+            (changes, record)
+        };
+        self.commit(table_name, changes, record).await
+    }
+
+    /// Like [`Storage::write_table`], for plans that await, such as ones that
+    /// run subqueries.
+    ///
+    /// `plan` gets a copy of the table rather than holding the read lock, so
+    /// the queries it runs can take their own. Other writers to the table are
+    /// locked out until the changes are applied, which keeps the copy current.
+    pub async fn write_table_async<F, Fut>(
+        &self,
+        table_name: &str,
+        plan: F,
+    ) -> crate::Result<WriteSummary>
+    where
+        F: FnOnce(Table) -> Fut,
+        Fut: std::future::Future<Output = crate::Result<Vec<RowChange>>>,
+    {
+        let writer = self.table_writer(table_name);
+        let _writer_guard = writer.lock().await;
+        let _lease = self.ensure_loaded(&[table_name.to_string()]).await?;
+
+        let snapshot = {
+            let db = self.database.read().await;
+            db.get_table(table_name)
+                .ok_or_else(|| unknown_table(table_name))?
+                .clone()
+        };
+        let changes = plan(snapshot).await?;
+        let record = {
+            let db = self.database.read().await;
+            let table = db
+                .get_table(table_name)
+                .ok_or_else(|| unknown_table(table_name))?;
+            self.validate_and_record(table, &changes)?
+        };
+        self.commit(table_name, changes, record).await
+    }
+
+    fn table_writer(&self, table_name: &str) -> Arc<Mutex<()>> {
+        self.table_writers
+            .entry(table_name.to_lowercase())
+            .or_default()
+            .clone()
+    }
+
+    /// Take the writer locks of several tables, in one order so that two
+    /// callers locking overlapping sets cannot deadlock
+    async fn lock_writers(&self, table_names: &[String]) -> Vec<OwnedMutexGuard<()>> {
+        let mut names: Vec<String> = table_names.iter().map(|name| name.to_lowercase()).collect();
+        names.sort();
+        names.dedup();
+        let mut guards = Vec::with_capacity(names.len());
+        for name in &names {
+            guards.push(self.table_writer(name).lock_owned().await);
+        }
+        guards
+    }
+
+    /// Check planned changes against the committed table, and the log record for them
+    fn validate_and_record(
+        &self,
+        table: &Table,
+        changes: &[RowChange],
+    ) -> crate::Result<Option<WalRecord>> {
+        validate_changes(table, changes)?;
+        Ok(match &self.wal {
+            Some(_) if !changes.is_empty() => Some(WalRecord::new(table, changes)),
+            _ => None,
+        })
+    }
+
+    /// Log and apply validated changes; the table's writer lock must be held
+    async fn commit(
+        &self,
+        table_name: &str,
+        changes: Vec<RowChange>,
+        record: Option<WalRecord>,
+    ) -> crate::Result<WriteSummary> {
+        // The writer lock is still held, so log order matches apply order for this table
+        let _applying = match (&self.wal, &record) {
+            (Some(wal), Some(record)) => {
+                let applying = wal.applying().await;
+                wal.append(record).await?;
+                Some(applying)
+            }
+            _ => None,
+        };
+
+        let mut db = self.database.write().await;
+        let table = db
+            .get_table_mut(table_name)
+            .ok_or_else(|| unknown_table(table_name))?;
+        let appended_from = table.rows.len();
+        let summary = apply_changes(table, changes);
+        table.advance_identities(&summary.inserted);
+        if summary.updated.is_empty() && summary.deleted.is_empty() {
+            self.index_appended(table, appended_from);
+            table.index_appended(appended_from);
+        } else {
+            self.index_table(table);
+            table.reindex();
+        }
+        if let Some(disk) = &self.disk {
+            if summary.affected_rows() > 0 {
+                disk.mark_dirty(&table.name);
+            }
+        }
+        // The rows are made into events after the lock is released
+        let notify = if self.webhooks.is_enabled() && summary.affected_rows() > 0 {
+            db.get_table(&summary.table)
+                .map(|table| (db.name.clone(), table.columns.clone()))
+        } else {
+            None
+        };
+        drop(db);
+
+        if summary.affected_rows() > 0 {
+            self.mark_changed();
+        }
+        if let Some((database, columns)) = notify {
+            for event in write_events(&database, &columns, &summary) {
+                self.webhooks.notify(event);
+            }
+        }
+        Ok(summary)
+    }
+
+    /// Restart the numbering of a table's identity columns, as `TRUNCATE`
+    /// does; see [`Table::restart_identities`]
+    pub async fn restart_identities(&self, table_name: &str, all: bool) -> crate::Result<()> {
+        let writer = self.table_writer(table_name);
+        let _writer_guard = writer.lock().await;
+        let mut db = self.database.write().await;
+        db.get_table_mut(table_name)
+            .ok_or_else(|| unknown_table(table_name))?
+            .restart_identities(all);
+        Ok(())
+    }
+
+    /// Add a table made at run time, such as by `CREATE TABLE ... AS`.
+    ///
+    /// The table lives in memory only: neither the write-ahead log nor the
+    /// YAML file records it, so a restart or reload drops it.
+    pub async fn create_table(&self, table: Table) -> crate::Result<()> {
+        let mut db = self.database.write().await;
+        if db.get_table(&table.name).is_some() {
+            return Err(crate::YamlBaseError::Database {
+                message: format!("Table '{}' already exists", table.name),
+            });
+        }
+        check_index_names(&db, &table, None)?;
+        self.index_table(&table);
+        db.add_table(table)?;
+        drop(db);
+
+        self.mark_changed();
+        Ok(())
+    }
+
+    /// Replace a table with the one `plan` builds from it, as `ALTER TABLE`
+    /// does. The new table may be renamed.
+    ///
+    /// Like [`Storage::create_table`], the change lives in memory only.
+    pub async fn alter_table<F>(&self, table_name: &str, plan: F) -> crate::Result<()>
+    where
+        F: FnOnce(&Table) -> crate::Result<Table>,
+    {
+        self.check_schema_change(table_name)?;
+        let writer = self.table_writer(table_name);
+        let _writer_guard = writer.lock().await;
+
+        let mut db = self.database.write().await;
+        let current = db
+            .get_table(table_name)
+            .ok_or_else(|| unknown_table(table_name))?;
+        let old_name = current.name.clone();
+        if db.expiries.contains_key(&old_name) || db.soft_deletes.contains_key(&old_name) {
+            return Err(crate::YamlBaseError::Database {
+                message: format!(
+                    "Table '{}' has an expiry or soft_delete setting and cannot be altered",
+                    old_name
+                ),
+            });
+        }
+        let table = plan(current)?;
+        if !table.name.eq_ignore_ascii_case(&old_name) && db.get_table(&table.name).is_some() {
+            return Err(crate::YamlBaseError::Database {
+                message: format!("Table '{}' already exists", table.name),
+            });
+        }
+        check_index_names(&db, &table, Some(&old_name))?;
+        if let Some(mut annotations) = db.annotations.shift_remove(&old_name) {
+            // Annotations of dropped columns go with them
+            annotations.retain(|column, _| table.get_column_index(column).is_some());
+            db.annotations.insert(table.name.clone(), annotations);
+        }
+        db.tables.shift_remove(&old_name);
+        self.primary_key_index.remove(&old_name);
+        self.index_table(&table);
+        db.add_table(table)?;
+        drop(db);
+
+        self.mark_changed();
+        Ok(())
+    }
+
+    /// Remove tables, as `DROP TABLE` does; either all of them go or, when
+    /// one does not exist, none do.
+    pub async fn drop_tables(&self, table_names: &[String]) -> crate::Result<()> {
+        for table_name in table_names {
+            self.check_schema_change(table_name)?;
+        }
+        let _writer_guards = self.lock_writers(table_names).await;
+
+        let mut db = self.database.write().await;
+        let names = table_names
+            .iter()
+            .map(|name| {
+                db.get_table(name)
+                    .map(|table| table.name.clone())
+                    .ok_or_else(|| unknown_table(name))
+            })
+            .collect::<crate::Result<Vec<_>>>()?;
+        for name in &names {
+            db.tables.shift_remove(name);
+            db.expiries.shift_remove(name);
+            db.soft_deletes.shift_remove(name);
+            db.annotations.shift_remove(name);
+            self.primary_key_index.remove(name);
+        }
+        drop(db);
+
+        self.mark_changed();
+        Ok(())
+    }
+
+    /// Add an index to a table, as `CREATE INDEX` does. `build` makes it from
+    /// the table's rows while writers to the table wait.
+    ///
+    /// Like [`Storage::create_table`], the index lives in memory only.
+    pub async fn create_index<F>(&self, table_name: &str, build: F) -> crate::Result<()>
+    where
+        F: FnOnce(&Table) -> crate::Result<Index>,
+    {
+        self.check_schema_change(table_name)?;
+        let writer = self.table_writer(table_name);
+        let _writer_guard = writer.lock().await;
+
+        let mut db = self.database.write().await;
+        let table = db
+            .get_table(table_name)
+            .ok_or_else(|| unknown_table(table_name))?;
+        let index = build(table)?;
+        if db.find_index(&index.name).is_some() {
+            return Err(index_exists(&index.name));
+        }
+        db.get_table_mut(table_name)
+            .ok_or_else(|| unknown_table(table_name))?
+            .indexes
+            .push(index);
+        Ok(())
+    }
+
+    /// Remove an index, as `DROP INDEX` does
+    pub async fn drop_index(&self, name: &str) -> crate::Result<()> {
+        let table_name = {
+            let db = self.database.read().await;
+            index_table_name(&db, name)?
+        };
+        let writer = self.table_writer(&table_name);
+        let _writer_guard = writer.lock().await;
+
+        let mut db = self.database.write().await;
+        // The table may have been altered or dropped while waiting for its writers
+        let table_name = index_table_name(&db, name)?;
+        if let Some(table) = db.get_table_mut(&table_name) {
+            table
+                .indexes
+                .retain(|index| !index.name.eq_ignore_ascii_case(name));
+        }
+        Ok(())
+    }
+
+    /// Replace the rows of tables with the ones `rows` makes for each, given
+    /// its position in `table_names`, as the tables a script generates are
+    /// refreshed. Writers to the tables wait, so none applies changes
+    /// addressed to the rows replaced; tables that do not exist are left out.
+    pub async fn replace_rows<F>(&self, table_names: &[String], mut rows: F) -> crate::Result<()>
+    where
+        F: FnMut(usize, &Table) -> crate::Result<Vec<Vec<Value>>>,
+    {
+        let _writer_guards = self.lock_writers(table_names).await;
+
+        let mut db = self.database.write().await;
+        for (position, table_name) in table_names.iter().enumerate() {
+            if let Some(table) = db.get_table_mut(table_name) {
+                let new_rows = rows(position, table)?;
+                table.rows.clear();
+                for row in new_rows {
+                    table.insert_row(row)?;
+                }
+                table.reindex();
+                self.index_table(table);
+            }
+        }
+        Ok(())
+    }
+
+    /// Tables kept in the disk store are reloaded from it, so their schema is fixed
+    fn check_schema_change(&self, table_name: &str) -> crate::Result<()> {
+        match &self.disk {
+            Some(disk) if disk.manages(table_name) => Err(crate::YamlBaseError::Database {
+                message: format!(
+                    "Table '{}' is kept in the disk store and its schema cannot change",
+                    table_name
+                ),
+            }),
+            _ => Ok(()),
+        }
+    }
+
+    /// Index the rows appended from `start` on, which is all a batch of
+    /// inserts needs when the index already covers the rows before them
+    fn index_appended(&self, table: &Table, start: usize) {
+        if let (Some(pk_idx), Some(table_index)) = (
+            table.primary_key_index,
+            self.primary_key_index.get(&table.name),
+        ) {
+            // Primary keys are unique, so a complete index has an entry per row
+            if table_index.len() == start {
+                for (row_idx, row) in table.rows.iter().enumerate().skip(start) {
+                    table_index.insert(row[pk_idx].clone(), row_idx);
+                }
+                return;
+            }
+        }
+        self.index_table(table);
+    }
+
+    fn index_table(&self, table: &Table) {
+        match table.primary_key_index {
+            Some(pk_idx) => {
+                let table_index = self
+                    .primary_key_index
+                    .entry(table.name.clone())
+                    .or_default();
+                table_index.clear();
+                for (row_idx, row) in table.rows.iter().enumerate() {
+                    table_index.insert(row[pk_idx].clone(), row_idx);
+                }
+            }
+            None => {
+                self.primary_key_index.remove(&table.name);
+            }
+        }
+    }
 }
 
 impl Clone for Storage {
@@ -82,6 +769,198 @@ impl Clone for Storage {
         Self {
             database: Arc::clone(&self.database),
             primary_key_index: Arc::clone(&self.primary_key_index),
+            changes: Arc::clone(&self.changes),
+            table_writers: Arc::clone(&self.table_writers),
+            wal: self.wal.clone(),
+            disk: self.disk.clone(),
+            upstream: self.upstream.clone(),
+            index_advisor: Arc::clone(&self.index_advisor),
+            query_budgets: Arc::clone(&self.query_budgets),
+            n_plus_one: self.n_plus_one.clone(),
+            sessions: Arc::clone(&self.sessions),
+            query_log: self.query_log.clone(),
+            dataset_version: Arc::clone(&self.dataset_version),
+            clock: self.clock.clone(),
+            uuids: self.uuids.clone(),
+            sequences: self.sequences.clone(),
+            webhooks: self.webhooks.clone(),
+        }
+    }
+}
+
+/// Index names are unique across the database, as in PostgreSQL. The indexes
+/// of the table being `replaced` do not count.
+fn check_index_names(db: &Database, table: &Table, replaced: Option<&str>) -> crate::Result<()> {
+    for (position, index) in table.indexes.iter().enumerate() {
+        let taken = table.indexes[..position]
+            .iter()
+            .any(|other| other.name.eq_ignore_ascii_case(&index.name))
+            || db.find_index(&index.name).is_some_and(|(owner, _)| {
+                replaced.is_none_or(|name| !owner.name.eq_ignore_ascii_case(name))
+            });
+        if taken {
+            return Err(index_exists(&index.name));
+        }
+    }
+    Ok(())
+}
+
+/// The name of the table holding index `name`
+fn index_table_name(db: &Database, name: &str) -> crate::Result<String> {
+    match db.find_index(name) {
+        Some((table, _)) => Ok(table.name.clone()),
+        None => Err(crate::YamlBaseError::Database {
+            message: format!("index \"{}\" does not exist", name),
+        }),
+    }
+}
+
+fn index_exists(name: &str) -> crate::YamlBaseError {
+    crate::YamlBaseError::Database {
+        message: format!("relation \"{}\" already exists", name),
+    }
+}
+
+fn unknown_table(table_name: &str) -> crate::YamlBaseError {
+    crate::YamlBaseError::Database {
+        message: format!("Table '{}' does not exist", table_name),
+    }
+}
+
+/// Check every change against the table as it would look after the whole batch
+fn validate_changes(table: &Table, changes: &[RowChange]) -> crate::Result<()> {
+    let mut touched = HashSet::new();
+    let mut deleted = HashSet::new();
+    let mut replaced: HashMap<usize, &Vec<Value>> = HashMap::new();
+
+    for change in changes {
+        if let RowChange::Update { index, .. } | RowChange::Delete { index } = change {
+            if *index >= table.rows.len() {
+                return Err(crate::YamlBaseError::Database {
+                    message: format!("Row {} of table '{}' does not exist", index, table.name),
+                });
+            }
+        }
+
+        match change {
+            RowChange::Insert(row) => table.validate_row(row)?,
+            RowChange::Update { index, row } => {
+                table.validate_row(row)?;
+                if !touched.insert(*index) {
+                    return Err(conflicting_change(table, *index));
+                }
+                replaced.insert(*index, row);
+            }
+            RowChange::Delete { index } => {
+                if !touched.insert(*index) {
+                    return Err(conflicting_change(table, *index));
+                }
+                deleted.insert(*index);
+            }
+        }
+    }
+
+    // Primary keys must stay unique across surviving, updated and inserted rows
+    if let Some(pk_idx) = table.primary_key_index {
+        let mut keys = HashSet::with_capacity(table.rows.len() + changes.len());
+        let surviving = table
+            .rows
+            .iter()
+            .enumerate()
+            .filter(|(idx, _)| !deleted.contains(idx))
+            .map(|(idx, row)| replaced.get(&idx).copied().unwrap_or(row));
+        let inserted = changes.iter().filter_map(|change| match change {
+            RowChange::Insert(row) => Some(row),
+            _ => None,
+        });
+
+        for row in surviving.chain(inserted) {
+            let key = &row[pk_idx];
+            if !keys.insert(key) {
+                return Err(crate::YamlBaseError::Database {
+                    message: format!(
+                        "Duplicate key value {} violates primary key of table '{}'",
+                        key, table.name
+                    ),
+                });
+            }
+        }
+    }
+
+    Ok(())
+}
+
+fn conflicting_change(table: &Table, index: usize) -> crate::YamlBaseError {
+    crate::YamlBaseError::Database {
+        message: format!(
+            "Row {} of table '{}' is changed more than once in one write",
+            index, table.name
+        ),
+    }
+}
+
+/// The webhook events for a committed write, one per kind of change it made
+fn write_events(database: &str, columns: &[Column], summary: &WriteSummary) -> Vec<WebhookEvent> {
+    [
+        ("insert", &summary.inserted),
+        ("update", &summary.updated),
+        ("delete", &summary.deleted),
+    ]
+    .into_iter()
+    .filter(|(_, rows)| !rows.is_empty())
+    .map(|(operation, rows)| WebhookEvent::Write {
+        database: database.to_string(),
+        table: summary.table.clone(),
+        operation: operation.to_string(),
+        rows: rows
+            .iter()
+            .map(|row| serde_json::to_value(row_to_yaml(row, columns)).unwrap_or_default())
+            .collect(),
+    })
+    .collect()
+}
+
+fn apply_changes(table: &mut Table, changes: Vec<RowChange>) -> WriteSummary {
+    let mut summary = WriteSummary {
+        table: table.name.clone(),
+        ..Default::default()
+    };
+    let mut deletes = Vec::new();
+    let inserts = changes
+        .iter()
+        .filter(|change| matches!(change, RowChange::Insert(_)))
+        .count();
+    table.rows.reserve(inserts);
+    summary.inserted.reserve(inserts);
+
+    for change in changes {
+        match change {
+            RowChange::Insert(row) => {
+                summary.inserted.push(row.clone());
+                table.rows.push(row);
+            }
+            RowChange::Update { index, row } => {
+                summary.updated.push(row.clone());
+                table.rows[index] = row;
+            }
+            RowChange::Delete { index } => deletes.push(index),
         }
     }
+
+    // One pass over the rows however many are deleted; inserts were appended past them
+    if !deletes.is_empty() {
+        deletes.sort_unstable();
+        let mut deletes = deletes.into_iter().peekable();
+        let rows = std::mem::take(&mut table.rows);
+        table.rows.reserve(rows.len() - deletes.len());
+        for (index, row) in rows.into_iter().enumerate() {
+            if deletes.next_if_eq(&index).is_some() {
+                summary.deleted.push(row);
+            } else {
+                table.rows.push(row);
+            }
+        }
+    }
+
+    summary
 }
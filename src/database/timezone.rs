@@ -0,0 +1,152 @@
+//! Time zones for `TIMESTAMPTZ` values.
+//!
+//! A `TIMESTAMPTZ` column holds instants, kept in UTC whichever offset they
+//! were written with, so rows written in different zones order and compare
+//! correctly. Text without an offset is taken as UTC. Clients see the
+//! instants in a time zone: a PostgreSQL session's `TimeZone`, which starts
+//! as the server's `--timezone`. Zones are UTC or a fixed offset such as
+//! `+02:00`; a named zone like `Europe/Amsterdam` would need the tz database,
+//! so a session set to one sees UTC.
+
+use chrono::{DateTime, FixedOffset, NaiveDateTime};
+
+use crate::database::clock::parse_timestamp;
+
+pub fn utc() -> FixedOffset {
+    FixedOffset::east_opt(0).unwrap()
+}
+
+/// Parse a time zone as `--timezone` and `SET TimeZone` take it: `UTC`, or
+/// an offset east of UTC such as `+02:00`, `+0530` or `-08`
+pub fn parse_offset(zone: &str) -> Result<FixedOffset, String> {
+    let zone = zone.trim();
+    if ["UTC", "GMT", "Z", "Etc/UTC"]
+        .iter()
+        .any(|name| zone.eq_ignore_ascii_case(name))
+    {
+        return Ok(utc());
+    }
+    let invalid = || {
+        format!(
+            "Invalid time zone '{}' (expected UTC or an offset such as +02:00)",
+            zone
+        )
+    };
+    let (sign, offset) = match zone.split_at_checked(1) {
+        Some(("+", offset)) => (1, offset),
+        Some(("-", offset)) => (-1, offset),
+        _ => return Err(invalid()),
+    };
+    if offset.is_empty() || !offset.bytes().all(|b| b.is_ascii_digit() || b == b':') {
+        return Err(invalid());
+    }
+    let (hours, minutes) = match offset.split_once(':') {
+        Some(parts) => parts,
+        None if offset.len() > 2 => offset.split_at(2),
+        None => (offset, "0"),
+    };
+    let hours: i32 = hours.parse().map_err(|_| invalid())?;
+    let minutes: i32 = minutes.parse().map_err(|_| invalid())?;
+    if hours > 15 || minutes >= 60 {
+        return Err(invalid());
+    }
+    FixedOffset::east_opt(sign * (hours * 3600 + minutes * 60)).ok_or_else(invalid)
+}
+
+/// Check a `--timezone` value, giving the name sessions report it by
+pub fn parse_zone(zone: &str) -> Result<String, String> {
+    parse_offset(zone).map(zone_name)
+}
+
+/// How a zone is reported in PostgreSQL's `TimeZone` parameter
+pub fn zone_name(offset: FixedOffset) -> String {
+    match offset.local_minus_utc() {
+        0 => "UTC".to_string(),
+        _ => offset.to_string(),
+    }
+}
+
+/// Parse an instant, as a `TIMESTAMPTZ` column takes it, into UTC: an
+/// offset after the time (`Z`, `+02`, `+02:00`) says which zone it was in,
+/// and text without one is UTC already
+pub fn parse_instant(s: &str) -> Result<NaiveDateTime, String> {
+    let s = s.trim();
+    for format in ["%Y-%m-%d %H:%M:%S%.f%#z", "%Y-%m-%dT%H:%M:%S%.f%#z"] {
+        if let Ok(at) = DateTime::parse_from_str(s, format) {
+            return Ok(at.naive_utc());
+        }
+    }
+    parse_timestamp(s)
+}
+
+/// Whether text names its zone, so that it reads as an instant rather than
+/// a wall-clock time
+pub fn has_offset(s: &str) -> bool {
+    let s = s.trim();
+    ["%Y-%m-%d %H:%M:%S%.f%#z", "%Y-%m-%dT%H:%M:%S%.f%#z"]
+        .iter()
+        .any(|format| DateTime::parse_from_str(s, format).is_ok())
+}
+
+/// An instant as PostgreSQL shows a `TIMESTAMPTZ` in a zone:
+/// `2024-01-31 14:00:00+02`, with the minutes of the offset only when it
+/// has some and fractional seconds only when there are any
+pub fn format_instant(utc: NaiveDateTime, offset: FixedOffset) -> String {
+    let local = utc + offset;
+    let seconds = offset.local_minus_utc();
+    let sign = if seconds < 0 { '-' } else { '+' };
+    let (hours, minutes) = (seconds.abs() / 3600, seconds.abs() % 3600 / 60);
+    let zone = match minutes {
+        0 => format!("{}{:02}", sign, hours),
+        _ => format!("{}{:02}:{:02}", sign, hours, minutes),
+    };
+    format!("{}{}", local.format("%Y-%m-%d %H:%M:%S%.f"), zone)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn at(s: &str) -> NaiveDateTime {
+        NaiveDateTime::parse_from_str(s, "%Y-%m-%d %H:%M:%S%.f").unwrap()
+    }
+
+    #[test]
+    fn test_zones_are_utc_or_fixed_offsets() {
+        assert_eq!(parse_offset("utc").unwrap(), utc());
+        assert_eq!(parse_offset("+02:00").unwrap().local_minus_utc(), 7200);
+        assert_eq!(parse_offset("+0530").unwrap().local_minus_utc(), 19800);
+        assert_eq!(parse_offset("-08").unwrap().local_minus_utc(), -28800);
+        assert!(parse_offset("Europe/Amsterdam").is_err());
+        assert!(parse_offset("+2x").is_err());
+        assert!(parse_offset("+16:00").is_err());
+        assert_eq!(parse_zone("+02").unwrap(), "+02:00");
+        assert_eq!(parse_zone("GMT").unwrap(), "UTC");
+    }
+
+    #[test]
+    fn test_instants_are_held_in_utc() {
+        let utc_noon = at("2024-01-31 12:00:00");
+        assert_eq!(parse_instant("2024-01-31 14:00:00+02").unwrap(), utc_noon);
+        assert_eq!(
+            parse_instant("2024-01-31T07:00:00-05:00").unwrap(),
+            utc_noon
+        );
+        assert_eq!(parse_instant("2024-01-31T12:00:00Z").unwrap(), utc_noon);
+        assert_eq!(parse_instant("2024-01-31 12:00:00").unwrap(), utc_noon);
+        assert_eq!(
+            parse_instant("2024-01-31 12:00:00.25+00").unwrap(),
+            at("2024-01-31 12:00:00.25")
+        );
+        assert!(has_offset("2024-01-31 14:00:00+02"));
+        assert!(!has_offset("2024-01-31 14:00:00"));
+
+        let plus_two = parse_offset("+02").unwrap();
+        assert_eq!(format_instant(utc_noon, utc()), "2024-01-31 12:00:00+00");
+        assert_eq!(format_instant(utc_noon, plus_two), "2024-01-31 14:00:00+02");
+        assert_eq!(
+            format_instant(at("2024-01-31 12:00:00.5"), parse_offset("-03:30").unwrap()),
+            "2024-01-31 08:30:00.500-03:30"
+        );
+    }
+}
@@ -0,0 +1,492 @@
+//! Read-through caching of an upstream PostgreSQL database (`--upstream`).
+//!
+//! A query misses when it names a table the dataset lacks, or when a query on
+//! a single table finds no rows. A missing table is created from its upstream
+//! definition with its first rows; for an empty result, the upstream rows the
+//! query's WHERE clause matches are added to the table. The query then runs
+//! again against the cached rows. Each table and each WHERE clause is looked
+//! up once, hit or miss, so a query that found nothing upstream is not sent
+//! there again.
+//!
+//! Upstream queries run with the upstream credentials, so only WHERE clauses
+//! comparing columns with literals are sent there; any other is evaluated
+//! against the table's first rows instead. Every lookup runs in a READ ONLY
+//! transaction.
+//!
+//! With `--upstream-record`, what is fetched is also appended to the YAML
+//! file, gradually building a local dataset from real traffic. Like
+//! `--write-back`, recording keeps the file's settings but not its comments
+//! or formatting.
+
+use indexmap::IndexMap;
+use sqlparser::ast::{BinaryOperator, Expr, TableAlias, UnaryOperator, Value as SqlValue};
+use std::collections::HashSet;
+use std::path::PathBuf;
+use tokio_postgres::{Client, NoTls};
+use tracing::{error, info, warn};
+
+use crate::commands::scaffold::{
+    TableKeys, column_definitions, fetch_columns, fetch_keys, normalize_row, query_rows,
+    quote_ident,
+};
+use crate::database::{RowChange, Storage, Table, Value};
+use crate::yaml::parser::{build_row, build_table};
+use crate::yaml::schema::{YamlDatabase, YamlTable};
+use crate::yaml::writer::{row_to_yaml, write_atomically};
+
+/// Rows fetched per miss unless `--upstream-limit` says otherwise
+pub const DEFAULT_ROW_LIMIT: usize = 1000;
+
+pub struct Upstream {
+    client: Client,
+    schema: String,
+    limit: usize,
+    /// The dataset file fetched tables and rows are appended to
+    record: Option<PathBuf>,
+    /// Tables and queries already looked up
+    looked_up: std::sync::Mutex<HashSet<String>>,
+    /// Held while the dataset file is rewritten
+    recording: tokio::sync::Mutex<()>,
+    /// Held for a lookup's transaction, which the connection is shared by
+    transaction: tokio::sync::Mutex<()>,
+}
+
+impl Upstream {
+    /// Connect to the PostgreSQL database at `url`, reading tables from
+    /// `schema` and at most `limit` rows per miss
+    pub async fn connect(url: &str, schema: &str, limit: usize) -> crate::Result<Self> {
+        if !(url.starts_with("postgres://") || url.starts_with("postgresql://")) {
+            return Err(crate::YamlBaseError::Config(format!(
+                "Unsupported upstream URL '{}': only postgres:// URLs can be read through",
+                url
+            )));
+        }
+        let (client, connection) = tokio_postgres::connect(url, NoTls).await.map_err(|e| {
+            crate::YamlBaseError::Config(format!("Failed to connect to upstream database: {}", e))
+        })?;
+        tokio::spawn(async move {
+            if let Err(e) = connection.await {
+                warn!("Upstream connection error: {}", e);
+            }
+        });
+
+        Ok(Self {
+            client,
+            schema: schema.to_string(),
+            limit,
+            record: None,
+            looked_up: std::sync::Mutex::new(HashSet::new()),
+            recording: tokio::sync::Mutex::new(()),
+            transaction: tokio::sync::Mutex::new(()),
+        })
+    }
+
+    /// Also append what is fetched to the dataset file at `path`
+    pub fn recording_to(mut self, path: PathBuf) -> Self {
+        self.record = Some(path);
+        self
+    }
+
+    /// Whether this is the first lookup of `key`
+    fn first_lookup(&self, key: String) -> bool {
+        self.looked_up.lock().unwrap().insert(key)
+    }
+
+    /// Run the queries of `lookup` in a READ ONLY transaction, so that they
+    /// cannot change the upstream database
+    async fn read_only<T, F>(&self, lookup: F) -> crate::Result<T>
+    where
+        F: std::future::Future<Output = anyhow::Result<T>>,
+    {
+        let _transaction = self.transaction.lock().await;
+        self.client
+            .batch_execute("BEGIN READ ONLY")
+            .await
+            .map_err(|e| upstream_error(e.into()))?;
+        let result = lookup.await;
+        let end = if result.is_ok() { "COMMIT" } else { "ROLLBACK" };
+        self.client
+            .batch_execute(end)
+            .await
+            .map_err(|e| upstream_error(e.into()))?;
+        result.map_err(upstream_error)
+    }
+
+    /// Create the tables among `names` that the database lacks and the
+    /// upstream schema has, with their first rows
+    pub async fn fetch_missing_tables(
+        &self,
+        storage: &Storage,
+        names: &[String],
+    ) -> crate::Result<()> {
+        let missing: Vec<&String> = {
+            let db = storage.database();
+            let db = db.read().await;
+            names
+                .iter()
+                .filter(|name| db.get_table(name).is_none())
+                .collect()
+        };
+
+        for name in missing {
+            if !self.first_lookup(format!("table {}", name.to_lowercase())) {
+                continue;
+            }
+            let fetched = self
+                .read_only(async {
+                    let columns = fetch_columns(&self.client, &self.schema, name).await?;
+                    if columns.is_empty() {
+                        return Ok(None);
+                    }
+                    let keys = fetch_keys(&self.client, &self.schema, name).await?;
+                    let query = first_rows_query(&self.schema, name, self.limit);
+                    let rows = query_rows(&self.client, &query).await?;
+                    Ok(Some((columns, keys, rows)))
+                })
+                .await?;
+            let Some((columns, keys, rows)) = fetched else {
+                continue;
+            };
+            let data = rows
+                .into_iter()
+                .enumerate()
+                .map(|(idx, row)| normalize_row(row, &columns, &keys, idx, false))
+                .collect();
+            let yaml_table = YamlTable {
+                columns: column_definitions(&columns, &keys),
+                data,
+                generator: None,
+                expiry: None,
+                soft_delete: None,
+                annotations: IndexMap::new(),
+            };
+
+            storage
+                .create_table(build_table(name, &yaml_table)?)
+                .await?;
+            info!(
+                "Cached table {} with {} row(s) from upstream",
+                name,
+                yaml_table.data.len()
+            );
+            self.record(|dataset| {
+                dataset.tables.entry(name.clone()).or_insert(yaml_table);
+            })
+            .await;
+        }
+        Ok(())
+    }
+
+    /// Add the upstream rows of `table_name` that `selection` matches and
+    /// the table does not hold yet, returning how many were added. `alias` is
+    /// the name the selection may refer to the table by.
+    ///
+    /// A selection [`forwardable`] rejects, such as one calling a function or
+    /// running a subquery, is not sent upstream: the table's first rows are
+    /// fetched instead and `matches` picks the ones it holds for.
+    pub async fn fetch_matching_rows<F>(
+        &self,
+        storage: &Storage,
+        table_name: &str,
+        alias: Option<&TableAlias>,
+        selection: &Expr,
+        matches: F,
+    ) -> crate::Result<usize>
+    where
+        F: Fn(&Table, &[Value]) -> bool,
+    {
+        if !self.first_lookup(format!("rows {} {}", table_name.to_lowercase(), selection)) {
+            return Ok(0);
+        }
+        let forwarded = forwardable(selection);
+        let query = if forwarded {
+            matching_query(&self.schema, table_name, alias, selection, self.limit)
+        } else {
+            first_rows_query(&self.schema, table_name, self.limit)
+        };
+        // The upstream column types say how to read the values row_to_json gives
+        let (columns, rows) = self
+            .read_only(async {
+                let columns = fetch_columns(&self.client, &self.schema, table_name).await?;
+                let rows = query_rows(&self.client, &query).await?;
+                Ok((columns, rows))
+            })
+            .await?;
+        let rows: Vec<_> = rows
+            .into_iter()
+            .enumerate()
+            .map(|(idx, row)| normalize_row(row, &columns, &TableKeys::default(), idx, false))
+            .collect();
+        if rows.is_empty() {
+            return Ok(0);
+        }
+
+        let mut table_columns = Vec::new();
+        let summary = storage
+            .write_table(table_name, |table| {
+                table_columns = table.columns.clone();
+                let mut changes = Vec::new();
+                for yaml_row in &rows {
+                    let row = build_row(yaml_row, &table.columns)?;
+                    if !forwarded && !matches(table, &row) {
+                        continue;
+                    }
+                    let cached = match table.primary_key_index {
+                        Some(pk_idx) => table
+                            .rows
+                            .iter()
+                            .any(|cached| cached[pk_idx] == row[pk_idx]),
+                        None => table.rows.contains(&row),
+                    };
+                    if !cached {
+                        changes.push(RowChange::Insert(row));
+                    }
+                }
+                Ok(changes)
+            })
+            .await?;
+        if summary.inserted.is_empty() {
+            return Ok(0);
+        }
+
+        info!(
+            "Cached {} row(s) of {} from upstream",
+            summary.inserted.len(),
+            summary.table
+        );
+        let data: Vec<_> = summary
+            .inserted
+            .iter()
+            .map(|row| {
+                let mut row = row_to_yaml(row, &table_columns);
+                row.retain(|_, value| !value.is_null());
+                row
+            })
+            .collect();
+        self.record(|dataset| {
+            // A table made at run time has no section to add to
+            if let Some(yaml_table) = dataset.tables.get_mut(&summary.table) {
+                yaml_table.data.extend(data);
+            }
+        })
+        .await;
+        Ok(summary.inserted.len())
+    }
+
+    /// Apply `change` to the dataset file, when recording. A failure is
+    /// logged: the rows are cached either way.
+    async fn record<F>(&self, change: F)
+    where
+        F: FnOnce(&mut YamlDatabase),
+    {
+        let Some(path) = &self.record else {
+            return;
+        };
+        let _recording = self.recording.lock().await;
+        let written = async {
+            let content = tokio::fs::read_to_string(path).await?;
+            write_atomically(path, &recorded(&content, change)?).await?;
+            Ok::<_, crate::YamlBaseError>(())
+        }
+        .await;
+        if let Err(e) = written {
+            error!(
+                "Failed to record upstream rows in {}: {}",
+                path.display(),
+                e
+            );
+        }
+    }
+}
+
+/// Whether `selection` can be sent upstream: it only compares columns with
+/// literals, combined with AND and OR
+fn forwardable(selection: &Expr) -> bool {
+    match selection {
+        Expr::Nested(expr) => forwardable(expr),
+        Expr::BinaryOp { left, op, right } => match op {
+            BinaryOperator::And | BinaryOperator::Or => forwardable(left) && forwardable(right),
+            BinaryOperator::Eq
+            | BinaryOperator::NotEq
+            | BinaryOperator::Lt
+            | BinaryOperator::LtEq
+            | BinaryOperator::Gt
+            | BinaryOperator::GtEq => {
+                (is_column(left) && is_literal(right)) || (is_literal(left) && is_column(right))
+            }
+            _ => false,
+        },
+        Expr::InList { expr, list, .. } => is_column(expr) && list.iter().all(is_literal),
+        Expr::Between {
+            expr, low, high, ..
+        } => is_column(expr) && is_literal(low) && is_literal(high),
+        Expr::IsNull(expr) | Expr::IsNotNull(expr) => is_column(expr),
+        _ => false,
+    }
+}
+
+fn is_column(expr: &Expr) -> bool {
+    match expr {
+        Expr::Nested(expr) => is_column(expr),
+        Expr::Identifier(_) | Expr::CompoundIdentifier(_) => true,
+        _ => false,
+    }
+}
+
+fn is_literal(expr: &Expr) -> bool {
+    match expr {
+        Expr::Nested(expr) => is_literal(expr),
+        Expr::Value(SqlValue::Placeholder(_)) => false,
+        Expr::Value(_) => true,
+        Expr::UnaryOp {
+            op: UnaryOperator::Minus | UnaryOperator::Plus,
+            expr,
+        } => matches!(expr.as_ref(), Expr::Value(SqlValue::Number(..))),
+        _ => false,
+    }
+}
+
+/// The upstream query for the first rows of a table
+fn first_rows_query(schema: &str, table_name: &str, limit: usize) -> String {
+    format!(
+        "SELECT * FROM {}.{} LIMIT {}",
+        quote_ident(schema),
+        quote_ident(table_name),
+        limit
+    )
+}
+
+/// The upstream query for the rows of a table a WHERE clause matches, which
+/// must be [`forwardable`]
+fn matching_query(
+    schema: &str,
+    table_name: &str,
+    alias: Option<&TableAlias>,
+    selection: &Expr,
+    limit: usize,
+) -> String {
+    let alias = alias
+        .map(|alias| format!(" AS {}", alias))
+        .unwrap_or_default();
+    format!(
+        "SELECT * FROM {}.{}{} WHERE {} LIMIT {}",
+        quote_ident(schema),
+        quote_ident(table_name),
+        alias,
+        selection,
+        limit
+    )
+}
+
+/// The dataset file `content` after `change`
+fn recorded<F>(content: &str, change: F) -> crate::Result<String>
+where
+    F: FnOnce(&mut YamlDatabase),
+{
+    let mut dataset: YamlDatabase = serde_yaml::from_str(content)?;
+    change(&mut dataset);
+    Ok(serde_yaml::to_string(&dataset)?)
+}
+
+fn upstream_error(e: anyhow::Error) -> crate::YamlBaseError {
+    crate::YamlBaseError::Database {
+        message: format!("Upstream query failed: {:#}", e),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parser::parse_expr;
+    use sqlparser::ast::Ident;
+
+    #[test]
+    fn test_matching_query() {
+        let selection = parse_expr("u.email = 'ann@example.com' AND u.id > 5").unwrap();
+        assert_eq!(
+            matching_query("public", "users", None, &selection, 100),
+            "SELECT * FROM \"public\".\"users\" WHERE u.email = 'ann@example.com' AND u.id > 5 LIMIT 100"
+        );
+        let alias = TableAlias {
+            name: Ident::new("u"),
+            columns: vec![],
+        };
+        assert_eq!(
+            matching_query("sales", "users", Some(&alias), &selection, 100),
+            "SELECT * FROM \"sales\".\"users\" AS u WHERE u.email = 'ann@example.com' AND u.id > 5 LIMIT 100"
+        );
+    }
+
+    #[test]
+    fn test_only_comparisons_with_literals_are_forwarded() {
+        for selection in [
+            "email = 'ann@example.com' AND (id > -5 OR id IN (1, 2))",
+            "u.created_at BETWEEN '2024-01-01' AND '2024-02-01' AND deleted_at IS NULL",
+            "10 <= id",
+        ] {
+            assert!(
+                forwardable(&parse_expr(selection).unwrap()),
+                "{}",
+                selection
+            );
+        }
+        for selection in [
+            "id IN (SELECT user_id FROM admins)",
+            "EXISTS (SELECT 1 FROM pg_shadow)",
+            "id = (SELECT max(id) FROM users)",
+            "email = current_setting('app.email')",
+            "pg_sleep(10) IS NULL",
+            "lower(email) = 'ann@example.com'",
+            "id = other_id",
+            "id = $1",
+            "email LIKE 'ann%'",
+        ] {
+            assert!(
+                !forwardable(&parse_expr(selection).unwrap()),
+                "{}",
+                selection
+            );
+        }
+    }
+
+    #[test]
+    fn test_recording_appends_to_the_dataset() {
+        let content = r#"
+database:
+  name: shop
+tables:
+  products:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+    data:
+      - id: 1
+"#;
+        let written = recorded(content, |dataset| {
+            let products = dataset.tables.get_mut("products").unwrap();
+            products.data.push(
+                [("id".to_string(), serde_yaml::Value::Number(2.into()))]
+                    .into_iter()
+                    .collect(),
+            );
+            dataset.tables.insert(
+                "users".to_string(),
+                YamlTable {
+                    columns: [("id".to_string(), "INTEGER PRIMARY KEY".to_string())]
+                        .into_iter()
+                        .collect(),
+                    data: vec![],
+                    generator: None,
+                    expiry: None,
+                    soft_delete: None,
+                    annotations: IndexMap::new(),
+                },
+            );
+        })
+        .unwrap();
+
+        let (database, _) = crate::yaml::load_yaml_str(&written, false).unwrap();
+        assert_eq!(database.name, "shop");
+        assert_eq!(database.get_table("products").unwrap().rows.len(), 2);
+        assert!(database.get_table("users").is_some());
+    }
+}
@@ -0,0 +1,129 @@
+use serde::{Deserialize, Serialize};
+use std::sync::{Arc, Mutex};
+use uuid::Uuid;
+
+/// Where the UUIDs the server makes come from, set with `--uuids`
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum UuidMode {
+    /// Version 4 UUIDs from the system's randomness
+    Random,
+    /// 00000000-0000-4000-8000-000000000001, ...000002 and so on
+    Sequential,
+    /// Version 4 UUIDs from a pseudo-random sequence the seed fixes
+    Seeded(u64),
+}
+
+/// The UUIDs `gen_random_uuid()`, `uuid_generate_v4()`, `UUID()` and
+/// `DEFAULT gen_random_uuid()` columns get.
+///
+/// In sequential and seeded mode a run makes the same UUIDs in the same
+/// order, so tests can assert on the keys of the rows they insert. Clones
+/// share the same sequence.
+#[derive(Debug, Clone)]
+pub struct UuidGenerator {
+    mode: UuidMode,
+    /// UUIDs made so far
+    count: Arc<Mutex<u64>>,
+}
+
+impl UuidGenerator {
+    pub fn new(mode: UuidMode) -> Self {
+        Self {
+            mode,
+            count: Arc::new(Mutex::new(0)),
+        }
+    }
+
+    pub fn next(&self) -> Uuid {
+        match self.mode {
+            UuidMode::Random => Uuid::new_v4(),
+            UuidMode::Sequential => Uuid::from_u128(
+                0x0000_0000_0000_4000_8000_0000_0000_0000 | u128::from(self.count()),
+            ),
+            UuidMode::Seeded(seed) => {
+                let count = self.count().wrapping_mul(2);
+                let mut bytes = [0; 16];
+                bytes[..8].copy_from_slice(&splitmix64(seed.wrapping_add(count)).to_be_bytes());
+                bytes[8..].copy_from_slice(&splitmix64(seed.wrapping_add(count + 1)).to_be_bytes());
+                uuid::Builder::from_random_bytes(bytes).into_uuid()
+            }
+        }
+    }
+
+    /// Count one more UUID made, returning the new count
+    fn count(&self) -> u64 {
+        let mut count = self.count.lock().unwrap();
+        *count += 1;
+        *count
+    }
+}
+
+impl Default for UuidGenerator {
+    fn default() -> Self {
+        Self::new(UuidMode::Random)
+    }
+}
+
+/// One step of SplitMix64, whose output is fixed for a given input unlike
+/// that of `rand`'s generators, which may change between releases
+fn splitmix64(x: u64) -> u64 {
+    let mut z = x.wrapping_add(0x9E37_79B9_7F4A_7C15);
+    z = (z ^ (z >> 30)).wrapping_mul(0xBF58_476D_1CE4_E5B9);
+    z = (z ^ (z >> 27)).wrapping_mul(0x94D0_49BB_1331_11EB);
+    z ^ (z >> 31)
+}
+
+/// Parse a `--uuids` mode: `random`, `sequential` or a number to seed with
+pub fn parse_uuid_mode(s: &str) -> Result<UuidMode, String> {
+    match s.trim().to_lowercase().as_str() {
+        "random" => Ok(UuidMode::Random),
+        "sequential" => Ok(UuidMode::Sequential),
+        seed => seed.parse().map(UuidMode::Seeded).map_err(|_| {
+            format!(
+                "Invalid UUID mode '{}' (expected random, sequential or a seed such as 42)",
+                s
+            )
+        }),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_sequential_uuids_count_up() {
+        let uuids = UuidGenerator::new(UuidMode::Sequential);
+        let shared = uuids.clone();
+        assert_eq!(
+            uuids.next().to_string(),
+            "00000000-0000-4000-8000-000000000001"
+        );
+        assert_eq!(
+            shared.next().to_string(),
+            "00000000-0000-4000-8000-000000000002"
+        );
+    }
+
+    #[test]
+    fn test_seeded_uuids_repeat_across_runs() {
+        let first = UuidGenerator::new(UuidMode::Seeded(42));
+        let second = UuidGenerator::new(UuidMode::Seeded(42));
+        let made: Vec<Uuid> = (0..3).map(|_| first.next()).collect();
+        assert_eq!(made, (0..3).map(|_| second.next()).collect::<Vec<_>>());
+        assert_ne!(made[0], made[1]);
+        assert_eq!(made[0].get_version_num(), 4);
+        assert_ne!(made, {
+            let other = UuidGenerator::new(UuidMode::Seeded(7));
+            (0..3).map(|_| other.next()).collect::<Vec<_>>()
+        });
+    }
+
+    #[test]
+    fn test_parse_uuid_mode() {
+        assert_eq!(parse_uuid_mode("Sequential"), Ok(UuidMode::Sequential));
+        assert_eq!(parse_uuid_mode("42"), Ok(UuidMode::Seeded(42)));
+        assert_eq!(parse_uuid_mode("random"), Ok(UuidMode::Random));
+        assert!(parse_uuid_mode("ordered").is_err());
+    }
+}
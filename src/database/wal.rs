@@ -0,0 +1,521 @@
+//! Write-ahead log for `--persist` mode.
+//!
+//! Every committed write is appended as one JSON line before it is applied in
+//! memory, and the log is replayed on top of the YAML file at startup, so a
+//! crash loses nothing that a client saw succeed. The first line records a
+//! fingerprint of the YAML file the log was started against; replaying onto a
+//! different file would put rows in the wrong places, so that is refused.
+//! `yamlbase compact` folds the log into the YAML file and removes it.
+//!
+//! A checkpoint does the same on a running server: it rewrites the YAML file
+//! from the rows in memory, atomically, and restarts the log against the new
+//! file. It first logs the fingerprint of the file it is about to write, so
+//! if it crashes after replacing the file but before restarting the log, the
+//! log is recognised as folded in at the next start rather than refused.
+
+use indexmap::IndexMap;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use tokio::fs::{File, OpenOptions};
+use tokio::io::AsyncWriteExt;
+use tokio::sync::{Mutex, RwLock, RwLockReadGuard};
+use tracing::warn;
+
+use crate::database::{RowChange, Storage, Table};
+use crate::yaml::parser::build_row;
+use crate::yaml::writer::{render_dataset, row_to_yaml, write_atomically};
+
+const WAL_VERSION: u32 = 1;
+
+#[derive(Debug, Serialize, Deserialize)]
+struct WalHeader {
+    version: u32,
+    /// SHA-256 of the YAML file the logged row positions refer to
+    base: String,
+}
+
+/// Logged by a checkpoint before it replaces the YAML file
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct WalCheckpoint {
+    /// SHA-256 of the YAML file the checkpoint writes
+    checkpoint: String,
+}
+
+/// One committed write to a single table
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct WalRecord {
+    pub table: String,
+    pub changes: Vec<WalChange>,
+}
+
+/// A [`RowChange`] with rows stored by column name, as they would appear in YAML
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "op", rename_all = "lowercase")]
+pub enum WalChange {
+    Insert {
+        row: IndexMap<String, serde_yaml::Value>,
+    },
+    Update {
+        index: usize,
+        row: IndexMap<String, serde_yaml::Value>,
+    },
+    Delete {
+        index: usize,
+    },
+}
+
+impl WalRecord {
+    pub fn new(table: &Table, changes: &[RowChange]) -> Self {
+        let changes = changes
+            .iter()
+            .map(|change| match change {
+                RowChange::Insert(row) => WalChange::Insert {
+                    row: row_to_yaml(row, &table.columns),
+                },
+                RowChange::Update { index, row } => WalChange::Update {
+                    index: *index,
+                    row: row_to_yaml(row, &table.columns),
+                },
+                RowChange::Delete { index } => WalChange::Delete { index: *index },
+            })
+            .collect();
+
+        Self {
+            table: table.name.clone(),
+            changes,
+        }
+    }
+
+    fn to_row_changes(&self, table: &Table) -> crate::Result<Vec<RowChange>> {
+        self.changes
+            .iter()
+            .map(|change| {
+                Ok(match change {
+                    WalChange::Insert { row } => RowChange::Insert(build_row(row, &table.columns)?),
+                    WalChange::Update { index, row } => RowChange::Update {
+                        index: *index,
+                        row: build_row(row, &table.columns)?,
+                    },
+                    WalChange::Delete { index } => RowChange::Delete { index: *index },
+                })
+            })
+            .collect()
+    }
+}
+
+pub struct WriteAheadLog {
+    path: PathBuf,
+    file: Mutex<File>,
+    /// Held shared by each write from its append until it is applied, and
+    /// exclusively by a checkpoint, which must see every logged write in memory
+    applying: RwLock<()>,
+    /// Records logged since the log was started against the current file
+    pending: AtomicUsize,
+}
+
+impl WriteAheadLog {
+    /// Open (or create) the log at `path` and return it with the records it already holds.
+    ///
+    /// A partially written last line, left behind by a crash mid-append, is
+    /// discarded. `base` is the content of the YAML file being served.
+    pub async fn open(path: &Path, base: &[u8]) -> crate::Result<(Self, Vec<WalRecord>)> {
+        let fingerprint = fingerprint(base);
+        let mut records = Vec::new();
+        let mut valid_len = 0;
+        let mut header_matches = true;
+        let mut folded_in = false;
+
+        match tokio::fs::read(path).await {
+            Ok(content) => {
+                let mut offset = 0;
+                for (line_no, line) in content.split_inclusive(|b| *b == b'\n').enumerate() {
+                    offset += line.len();
+                    if !line.ends_with(b"\n") {
+                        warn!(
+                            "Discarding incomplete last entry of write-ahead log {}",
+                            path.display()
+                        );
+                        break;
+                    }
+                    if line_no == 0 {
+                        let header: WalHeader =
+                            serde_json::from_slice(line).map_err(|e| corrupt(path, line_no, e))?;
+                        header_matches =
+                            header.version == WAL_VERSION && header.base == fingerprint;
+                    } else if let Ok(marker) = serde_json::from_slice::<WalCheckpoint>(line) {
+                        // The file is the one the checkpoint wrote, so what it logged is in it
+                        if !header_matches && marker.checkpoint == fingerprint {
+                            records.clear();
+                            folded_in = true;
+                        }
+                    } else {
+                        records.push(
+                            serde_json::from_slice(line).map_err(|e| corrupt(path, line_no, e))?,
+                        );
+                    }
+                    valid_len = offset;
+                }
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+            Err(e) => return Err(e.into()),
+        }
+        if !header_matches && !folded_in {
+            return Err(crate::YamlBaseError::Config(format!(
+                "Write-ahead log {} was written against a different version of the YAML file; \
+                 run `yamlbase compact` with the original file or delete the log",
+                path.display()
+            )));
+        }
+        if folded_in {
+            // Restart the log against the file the interrupted checkpoint wrote
+            valid_len = 0;
+        }
+
+        // Opened in append mode, so truncating away a torn entry keeps later writes at the end
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .await?;
+        file.set_len(valid_len as u64).await?;
+        let wal = Self {
+            path: path.to_path_buf(),
+            file: Mutex::new(file),
+            applying: RwLock::new(()),
+            pending: AtomicUsize::new(records.len()),
+        };
+
+        if valid_len == 0 {
+            wal.append_line(&header_line(fingerprint)?).await?;
+            for record in &records {
+                wal.append_line(&serde_json::to_vec(record).map_err(std::io::Error::from)?)
+                    .await?;
+            }
+        }
+        Ok((wal, records))
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Durably append one record; returns only after the data reached the disk
+    pub async fn append(&self, record: &WalRecord) -> crate::Result<()> {
+        let line = serde_json::to_vec(record).map_err(std::io::Error::from)?;
+        self.append_line(&line).await?;
+        self.pending.fetch_add(1, Ordering::SeqCst);
+        Ok(())
+    }
+
+    /// Held by a write from before it is appended until it is applied, so a
+    /// checkpoint never misses a logged write in memory
+    pub async fn applying(&self) -> RwLockReadGuard<'_, ()> {
+        self.applying.read().await
+    }
+
+    /// Fold the logged writes into `yaml_file`, whose content as loaded is
+    /// `base`: rewrite it from the rows of `storage` and start the log afresh
+    /// against it. Writes wait meanwhile. Returns how many records were
+    /// folded in; with none logged, the file is left alone.
+    pub async fn checkpoint(
+        &self,
+        storage: &Storage,
+        yaml_file: &Path,
+        base: &str,
+    ) -> crate::Result<usize> {
+        let _paused = self.applying.write().await;
+        let pending = self.pending.load(Ordering::SeqCst);
+        if pending == 0 {
+            return Ok(0);
+        }
+        let content = {
+            let db = storage.database();
+            let db = db.read().await;
+            render_dataset(base, &db)?
+        };
+        let fingerprint = fingerprint(content.as_bytes());
+
+        let marker = WalCheckpoint {
+            checkpoint: fingerprint.clone(),
+        };
+        self.append_line(&serde_json::to_vec(&marker).map_err(std::io::Error::from)?)
+            .await?;
+        write_atomically(yaml_file, &content).await?;
+
+        let header = header_line(fingerprint)?;
+        let mut file = self.file.lock().await;
+        file.set_len(0).await?;
+        file.write_all(&header).await?;
+        file.write_all(b"\n").await?;
+        file.sync_data().await?;
+        self.pending.store(0, Ordering::SeqCst);
+        Ok(pending)
+    }
+
+    async fn append_line(&self, line: &[u8]) -> crate::Result<()> {
+        let mut entry = Vec::with_capacity(line.len() + 1);
+        entry.extend_from_slice(line);
+        entry.push(b'\n');
+
+        let mut file = self.file.lock().await;
+        file.write_all(&entry).await?;
+        file.sync_data().await?;
+        Ok(())
+    }
+}
+
+fn header_line(base: String) -> crate::Result<Vec<u8>> {
+    let header = WalHeader {
+        version: WAL_VERSION,
+        base,
+    };
+    Ok(serde_json::to_vec(&header).map_err(std::io::Error::from)?)
+}
+
+/// Re-apply logged writes, in order, to storage loaded from the log's base file
+pub async fn replay(storage: &Storage, records: &[WalRecord]) -> crate::Result<()> {
+    for record in records {
+        storage
+            .write_table(&record.table, |table| record.to_row_changes(table))
+            .await?;
+    }
+    Ok(())
+}
+
+/// Default log location: the YAML file with `.wal` appended, e.g. `db.yaml.wal`
+pub fn default_path(yaml_file: &Path) -> PathBuf {
+    let mut path = yaml_file.as_os_str().to_owned();
+    path.push(".wal");
+    PathBuf::from(path)
+}
+
+fn fingerprint(content: &[u8]) -> String {
+    hex::encode(Sha256::digest(content))
+}
+
+fn corrupt(path: &Path, line_no: usize, e: serde_json::Error) -> crate::YamlBaseError {
+    crate::YamlBaseError::Database {
+        message: format!(
+            "Write-ahead log {} is corrupt at line {}: {}",
+            path.display(),
+            line_no + 1,
+            e
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{Column, Database, Value};
+    use crate::yaml::schema::SqlType;
+
+    const BASE: &[u8] = b"database:\n  name: test\n";
+
+    fn storage() -> Storage {
+        let columns = vec![
+            Column {
+                name: "id".to_string(),
+                sql_type: SqlType::Integer,
+                primary_key: true,
+                nullable: false,
+                unique: true,
+                default: None,
+                references: None,
+            },
+            Column {
+                name: "name".to_string(),
+                sql_type: SqlType::Text,
+                primary_key: false,
+                nullable: true,
+                unique: false,
+                default: None,
+                references: None,
+            },
+        ];
+        let mut table = Table::new("users".to_string(), columns);
+        table
+            .insert_row(vec![Value::Integer(1), Value::Text("Ada".to_string())])
+            .unwrap();
+        let mut db = Database::new("test".to_string());
+        db.add_table(table).unwrap();
+        Storage::new(db)
+    }
+
+    fn temp_wal(name: &str) -> PathBuf {
+        let path = std::env::temp_dir().join(format!(
+            "yamlbase-{}-{}-{}.wal",
+            name,
+            std::process::id(),
+            uuid::Uuid::new_v4()
+        ));
+        let _ = std::fs::remove_file(&path);
+        path
+    }
+
+    async fn rows(storage: &Storage) -> Vec<Vec<Value>> {
+        let db = storage.database();
+        let db = db.read().await;
+        db.get_table("users").unwrap().rows.clone()
+    }
+
+    #[tokio::test]
+    async fn test_logged_writes_replay_after_restart() {
+        let path = temp_wal("replay");
+        let (wal, records) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        assert!(records.is_empty());
+
+        let wal = std::sync::Arc::new(wal);
+        let before = storage().with_wal(wal.clone());
+        before
+            .write_table("users", |_| {
+                Ok(vec![
+                    RowChange::Update {
+                        index: 0,
+                        row: vec![Value::Integer(1), Value::Text("Ada L.".to_string())],
+                    },
+                    RowChange::Insert(vec![Value::Integer(2), Value::Null]),
+                ])
+            })
+            .await
+            .unwrap();
+        before
+            .write_table("users", |_| Ok(vec![RowChange::Delete { index: 0 }]))
+            .await
+            .unwrap();
+        drop(wal);
+
+        let (_wal, records) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        assert_eq!(records.len(), 2);
+        let after = storage();
+        replay(&after, &records).await.unwrap();
+        assert_eq!(rows(&after).await, rows(&before).await);
+        assert_eq!(
+            rows(&after).await,
+            vec![vec![Value::Integer(2), Value::Null]]
+        );
+
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_torn_last_entry_is_discarded() {
+        let path = temp_wal("torn");
+        let (wal, _) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        let table = storage()
+            .database()
+            .read()
+            .await
+            .get_table("users")
+            .unwrap()
+            .clone();
+        wal.append(&WalRecord::new(&table, &[RowChange::Delete { index: 0 }]))
+            .await
+            .unwrap();
+        drop(wal);
+
+        let mut file = std::fs::OpenOptions::new()
+            .append(true)
+            .open(&path)
+            .unwrap();
+        std::io::Write::write_all(&mut file, br#"{"table":"users","chan"#).unwrap();
+        drop(file);
+
+        let (wal, records) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        assert_eq!(records.len(), 1);
+        wal.append(&WalRecord::new(&table, &[RowChange::Delete { index: 0 }]))
+            .await
+            .unwrap();
+        drop(wal);
+
+        let (_, records) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        assert_eq!(records.len(), 2);
+
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_log_for_other_base_file_is_rejected() {
+        let path = temp_wal("base");
+        drop(WriteAheadLog::open(&path, BASE).await.unwrap());
+
+        let result = WriteAheadLog::open(&path, b"database:\n  name: edited\n").await;
+        assert!(matches!(result, Err(crate::YamlBaseError::Config(_))));
+
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_checkpoint_restarts_the_log_against_the_rewritten_file() {
+        let path = temp_wal("checkpoint");
+        let yaml_file = path.with_extension("yaml");
+        std::fs::write(&yaml_file, BASE).unwrap();
+        let (wal, _) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        let wal = std::sync::Arc::new(wal);
+        let storage = storage().with_wal(wal.clone());
+        let base = std::str::from_utf8(BASE).unwrap();
+        assert_eq!(wal.checkpoint(&storage, &yaml_file, base).await.unwrap(), 0);
+
+        storage
+            .write_table("users", |_| Ok(vec![RowChange::Delete { index: 0 }]))
+            .await
+            .unwrap();
+        assert_eq!(wal.checkpoint(&storage, &yaml_file, base).await.unwrap(), 1);
+        drop(storage);
+        drop(wal);
+
+        let content = std::fs::read(&yaml_file).unwrap();
+        let (_, records) = WriteAheadLog::open(&path, &content).await.unwrap();
+        assert!(records.is_empty());
+
+        let _ = std::fs::remove_file(&path);
+        let _ = std::fs::remove_file(&yaml_file);
+    }
+
+    #[tokio::test]
+    async fn test_interrupted_checkpoint_counts_as_folded_in() {
+        let path = temp_wal("interrupted");
+        let (wal, _) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        let table = storage()
+            .database()
+            .read()
+            .await
+            .get_table("users")
+            .unwrap()
+            .clone();
+        wal.append(&WalRecord::new(&table, &[RowChange::Delete { index: 0 }]))
+            .await
+            .unwrap();
+
+        // Crashed after replacing the YAML file, before restarting the log
+        let rewritten = b"database:\n  name: rewritten\n";
+        let marker = WalCheckpoint {
+            checkpoint: fingerprint(rewritten),
+        };
+        wal.append_line(&serde_json::to_vec(&marker).unwrap())
+            .await
+            .unwrap();
+        drop(wal);
+
+        let (_, records) = WriteAheadLog::open(&path, BASE).await.unwrap();
+        assert_eq!(records.len(), 1);
+        let (_, records) = WriteAheadLog::open(&path, rewritten).await.unwrap();
+        assert!(records.is_empty());
+        let (_, records) = WriteAheadLog::open(&path, rewritten).await.unwrap();
+        assert!(records.is_empty());
+        assert!(WriteAheadLog::open(&path, BASE).await.is_err());
+
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn test_default_path() {
+        assert_eq!(
+            default_path(Path::new("data/db.yaml")),
+            PathBuf::from("data/db.yaml.wal")
+        );
+    }
+}
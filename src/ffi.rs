@@ -0,0 +1,270 @@
+//! A C ABI for embedding yamlbase in another language's process.
+//!
+//! Test frameworks in Python, Node and elsewhere load the `cdylib` build
+//! (`libyamlbase.so`, `libyamlbase.dylib` or `yamlbase.dll`) and start a
+//! server from a dataset held in memory, rather than managing a subprocess.
+//! `include/yamlbase.h` declares the functions:
+//!
+//! - `yamlbase_start` serves a YAML dataset on its own runtime threads, taking
+//!   the command-line options of the `yamlbase` binary; with `--port 0` the
+//!   system picks a free port, which `yamlbase_port` reports.
+//! - `yamlbase_load` replaces the served dataset, as a hot reload would.
+//! - `yamlbase_stop` shuts the server down and frees it.
+//! - `yamlbase_last_error` tells why the last call on the thread failed.
+//!
+//! The server does not install a log subscriber; the embedding process sees
+//! yamlbase's logs only if it sets one up itself.
+
+use clap::Parser;
+use std::cell::RefCell;
+use std::ffi::{CStr, CString, c_char, c_int};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+use tokio::runtime::Runtime;
+use tracing::error;
+
+use crate::database::Storage;
+use crate::yaml::load_yaml_str;
+use crate::{Config, Server, YamlBaseError};
+
+thread_local! {
+    static LAST_ERROR: RefCell<Option<CString>> = const { RefCell::new(None) };
+}
+
+/// Numbers the dataset files of the servers this process starts
+static DATASETS: AtomicU64 = AtomicU64::new(0);
+
+/// How long `yamlbase_stop` waits for connections to wind down
+const SHUTDOWN_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// A running server, opaque to C
+pub struct YamlbaseServer {
+    runtime: Runtime,
+    storage: Storage,
+    port: u16,
+    skip_invalid: bool,
+    /// The file the dataset was written to, which the server's file-based
+    /// options (`--hot-reload`, `--write-back`, `--persist`) work against
+    dataset: PathBuf,
+}
+
+/// Serve the `yaml_len` bytes of YAML at `yaml`. `args` is NULL or the
+/// `yamlbase` options to serve it with, separated by whitespace, such as
+/// `"--protocol mysql --port 0"`; `--file` is set already. Returns NULL if
+/// the dataset or the options are invalid or the port cannot be bound.
+///
+/// # Safety
+///
+/// `yaml` must point to `yaml_len` readable bytes and `args` must be NULL or
+/// a NUL-terminated string.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn yamlbase_start(
+    yaml: *const u8,
+    yaml_len: usize,
+    args: *const c_char,
+) -> *mut YamlbaseServer {
+    let started = unsafe { dataset(yaml, yaml_len) }.and_then(|yaml| {
+        let args = match args.is_null() {
+            true => String::new(),
+            false => utf8(unsafe { CStr::from_ptr(args) }.to_bytes())?.to_string(),
+        };
+        start(yaml, &args)
+    });
+    match started {
+        Ok(server) => Box::into_raw(Box::new(server)),
+        Err(e) => {
+            set_last_error(e);
+            std::ptr::null_mut()
+        }
+    }
+}
+
+/// The port the server listens on
+///
+/// # Safety
+///
+/// `server` must come from `yamlbase_start` and not be stopped yet.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn yamlbase_port(server: *const YamlbaseServer) -> u16 {
+    unsafe { &*server }.port
+}
+
+/// Replace the served dataset with the `yaml_len` bytes of YAML at `yaml`.
+/// Returns 0, or -1 if the dataset is invalid and the old one kept. The
+/// users the dataset's `auth` section lists are not changed.
+///
+/// # Safety
+///
+/// `server` must come from `yamlbase_start` and not be stopped yet, and
+/// `yaml` must point to `yaml_len` readable bytes.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn yamlbase_load(
+    server: *mut YamlbaseServer,
+    yaml: *const u8,
+    yaml_len: usize,
+) -> c_int {
+    let server = unsafe { &*server };
+    let loaded = unsafe { dataset(yaml, yaml_len) }
+        .and_then(|yaml| load_yaml_str(yaml, server.skip_invalid));
+    match loaded {
+        Ok((database, _auth)) => {
+            server.runtime.block_on(server.storage.reload(database));
+            0
+        }
+        Err(e) => {
+            set_last_error(e);
+            -1
+        }
+    }
+}
+
+/// Stop the server and free it. Connections still open are closed.
+///
+/// # Safety
+///
+/// `server` must be NULL or come from `yamlbase_start`, and is not usable
+/// afterwards.
+#[unsafe(no_mangle)]
+pub unsafe extern "C" fn yamlbase_stop(server: *mut YamlbaseServer) {
+    if server.is_null() {
+        return;
+    }
+    let server = unsafe { Box::from_raw(server) };
+    server.runtime.shutdown_timeout(SHUTDOWN_TIMEOUT);
+    let _ = std::fs::remove_file(&server.dataset);
+}
+
+/// Why the last failed call on this thread failed, or NULL. The string stays
+/// valid until the thread's next failing call.
+#[unsafe(no_mangle)]
+pub extern "C" fn yamlbase_last_error() -> *const c_char {
+    LAST_ERROR.with(|last| {
+        last.borrow()
+            .as_ref()
+            .map_or(std::ptr::null(), |message| message.as_ptr())
+    })
+}
+
+fn start(yaml: &str, args: &str) -> crate::Result<YamlbaseServer> {
+    let dataset = std::env::temp_dir().join(format!(
+        "yamlbase-{}-{}.yaml",
+        std::process::id(),
+        DATASETS.fetch_add(1, Ordering::SeqCst)
+    ));
+    std::fs::write(&dataset, yaml)?;
+    let started = serve(&dataset, args);
+    if started.is_err() {
+        let _ = std::fs::remove_file(&dataset);
+    }
+    let (runtime, storage, port, skip_invalid) = started?;
+    Ok(YamlbaseServer {
+        runtime,
+        storage,
+        port,
+        skip_invalid,
+        dataset,
+    })
+}
+
+/// Start serving the dataset file with the runtime returned
+fn serve(dataset: &Path, args: &str) -> crate::Result<(Runtime, Storage, u16, bool)> {
+    let argv = ["yamlbase", "--file"]
+        .into_iter()
+        .map(String::from)
+        .chain([dataset.display().to_string()])
+        .chain(args.split_whitespace().map(String::from));
+    let config = Config::try_parse_from(argv).map_err(|e| YamlBaseError::Config(e.to_string()))?;
+    let skip_invalid = config.skip_invalid;
+
+    let runtime = Runtime::new()?;
+    let (server, listener) = runtime.block_on(async {
+        let server = Server::new(config).await?;
+        let listener = server.bind().await?;
+        Ok::<_, YamlBaseError>((server, listener))
+    })?;
+    let port = listener.local_addr()?.port();
+    let storage = server.storage().clone();
+    runtime.spawn(async move {
+        if let Err(e) = server.serve(listener).await {
+            error!("Embedded server stopped: {}", e);
+        }
+    });
+    Ok((runtime, storage, port, skip_invalid))
+}
+
+/// The YAML text of a buffer passed in
+unsafe fn dataset<'a>(yaml: *const u8, yaml_len: usize) -> crate::Result<&'a str> {
+    if yaml.is_null() {
+        return Err(YamlBaseError::Config("No dataset given".to_string()));
+    }
+    utf8(unsafe { std::slice::from_raw_parts(yaml, yaml_len) })
+}
+
+fn utf8(bytes: &[u8]) -> crate::Result<&str> {
+    std::str::from_utf8(bytes).map_err(|e| YamlBaseError::Config(format!("Invalid UTF-8: {}", e)))
+}
+
+fn set_last_error(e: YamlBaseError) {
+    // An interior NUL cannot come from the error messages, but is dropped if it does
+    let message = CString::new(e.to_string().replace('\0', "")).unwrap_or_default();
+    LAST_ERROR.with(|last| *last.borrow_mut() = Some(message));
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const DATASET: &str = r#"
+database:
+  name: "embedded"
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "VARCHAR(50)"
+    data:
+      - id: 1
+        name: "Ada"
+"#;
+
+    #[test]
+    fn test_embedded_server_serves_and_reloads_a_buffer() {
+        let args = CString::new("--port 0 --bind-address 127.0.0.1").unwrap();
+        let server = unsafe { yamlbase_start(DATASET.as_ptr(), DATASET.len(), args.as_ptr()) };
+        assert!(!server.is_null());
+        let port = unsafe { yamlbase_port(server) };
+        assert_ne!(port, 0);
+        assert!(std::net::TcpStream::connect(("127.0.0.1", port)).is_ok());
+
+        let reloaded = DATASET.replace("Ada", "Lin");
+        assert_eq!(
+            unsafe { yamlbase_load(server, reloaded.as_ptr(), reloaded.len()) },
+            0
+        );
+        let embedded = unsafe { &*server };
+        let name = embedded.runtime.block_on(async {
+            let db = embedded.storage.database();
+            let db = db.read().await;
+            db.get_table("users").unwrap().rows[0][1].clone()
+        });
+        assert_eq!(name, crate::database::Value::Text("Lin".to_string()));
+        assert_eq!(
+            unsafe { yamlbase_load(server, b"tables: [".as_ptr(), 9) },
+            -1
+        );
+        assert!(!yamlbase_last_error().is_null());
+
+        unsafe { yamlbase_stop(server) };
+        assert!(std::net::TcpStream::connect(("127.0.0.1", port)).is_err());
+    }
+
+    #[test]
+    fn test_start_reports_invalid_options() {
+        let args = CString::new("--no-such-option").unwrap();
+        let server = unsafe { yamlbase_start(DATASET.as_ptr(), DATASET.len(), args.as_ptr()) };
+        assert!(server.is_null());
+        let message = unsafe { CStr::from_ptr(yamlbase_last_error()) };
+        assert!(message.to_str().unwrap().contains("no-such-option"));
+    }
+}
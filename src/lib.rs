@@ -1,8 +1,14 @@
 #![allow(clippy::uninlined_format_args)]
 
+pub mod admin;
+pub mod commands;
 pub mod config;
+pub mod crash_dump;
 pub mod database;
+pub mod ffi;
 pub mod protocol;
+pub mod recovery;
+pub mod script;
 pub mod server;
 pub mod sql;
 pub mod yaml;
@@ -40,6 +46,12 @@ pub enum YamlBaseError {
 
     #[error("Not implemented: {0}")]
     NotImplemented(String),
+
+    #[error("Query cancelled: {0}")]
+    Cancelled(String),
+
+    #[error("cannot execute {0} in a read-only transaction")]
+    ReadOnly(String),
 }
 
 pub type Result<T> = std::result::Result<T, YamlBaseError>;
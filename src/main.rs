@@ -2,10 +2,15 @@
 
 use clap::Parser;
 use tracing::info;
-use yamlbase::{Config, Server};
+use yamlbase::{Config, Server, commands};
 
 #[tokio::main]
 async fn main() -> anyhow::Result<()> {
+    // Auxiliary subcommands (scaffold, ...) bypass the server entirely
+    if commands::is_subcommand_invocation() {
+        return commands::run(commands::Cli::parse()).await;
+    }
+
     // Parse command line arguments
     let config = Config::parse();
 
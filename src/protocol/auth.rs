@@ -0,0 +1,343 @@
+//! Checking passwords against a directory instead of the static user list.
+//!
+//! `--auth-ldap ldap://HOST[:PORT]` accepts a password the LDAP server takes
+//! in a simple bind as the DN `--auth-ldap-dn` makes of the user name, and
+//! `--auth-command CMD` a password CMD accepts: it runs through `sh -c` with
+//! the user name in `YAMLBASE_AUTH_USER` and the password on its standard
+//! input, and exit status 0 accepts. Either is asked only about users the
+//! static list, the configured user and the tenants, does not name; with both
+//! configured, a password either accepts is accepted.
+//!
+//! PostgreSQL clients send the password itself already. MySQL clients are
+//! asked for it with the `mysql_clear_password` plugin, as MySQL's own LDAP
+//! authentication does, which some clients only answer when told to, as the
+//! `mysql` client is with `--enable-cleartext-plugin`.
+
+use std::process::Stdio;
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tokio::process::Command;
+use tracing::{debug, warn};
+
+use crate::YamlBaseError;
+use crate::config::Config;
+
+/// How long a directory gets to answer before the login is refused
+const CHECK_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// The MySQL authentication plugin that has clients send their password
+pub const CLEAR_PASSWORD_PLUGIN_NAME: &str = "mysql_clear_password";
+
+/// The directories configured to check passwords against
+#[derive(Debug, Clone, Default)]
+pub struct AuthBackends {
+    ldap: Option<LdapServer>,
+    command: Option<String>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct LdapServer {
+    host: String,
+    port: u16,
+    dn: String,
+}
+
+impl LdapServer {
+    fn parse(url: &str, dn: &str) -> crate::Result<Self> {
+        let authority = url
+            .strip_prefix("ldap://")
+            .ok_or_else(|| {
+                YamlBaseError::Config(format!("LDAP URL '{}' must start with ldap://", url))
+            })?
+            .trim_end_matches('/');
+        let (host, port) = match authority.rsplit_once(':') {
+            Some((host, port)) => {
+                let port = port.parse().map_err(|_| {
+                    YamlBaseError::Config(format!("Invalid port in LDAP URL '{}'", url))
+                })?;
+                (host, port)
+            }
+            None => (authority, 389),
+        };
+        if host.is_empty() || host.contains('/') {
+            return Err(YamlBaseError::Config(format!(
+                "LDAP URL '{}' must be ldap://HOST or ldap://HOST:PORT",
+                url
+            )));
+        }
+        if !dn.contains("{user}") {
+            return Err(YamlBaseError::Config(format!(
+                "--auth-ldap-dn '{}' must contain {{user}}",
+                dn
+            )));
+        }
+
+        Ok(Self {
+            host: host.to_string(),
+            port,
+            dn: dn.to_string(),
+        })
+    }
+
+    /// The DN a user binds as, the user name escaped as RFC 4514 has it
+    fn bind_dn(&self, user: &str) -> String {
+        let last = user.chars().count().saturating_sub(1);
+        let escaped: String = user
+            .chars()
+            .enumerate()
+            .map(|(i, c)| match c {
+                ',' | '+' | '"' | '\\' | '<' | '>' | ';' | '=' => format!("\\{}", c),
+                '#' if i == 0 => "\\#".to_string(),
+                ' ' if i == 0 || i == last => "\\ ".to_string(),
+                '\0' => "\\00".to_string(),
+                c => c.to_string(),
+            })
+            .collect();
+        self.dn.replace("{user}", &escaped)
+    }
+}
+
+impl AuthBackends {
+    pub fn from_config(config: &Config) -> crate::Result<Self> {
+        let ldap = config
+            .auth_ldap
+            .as_deref()
+            .map(|url| LdapServer::parse(url, &config.auth_ldap_dn))
+            .transpose()?;
+        Ok(Self {
+            ldap,
+            command: config.auth_command.clone(),
+        })
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.ldap.is_some() || self.command.is_some()
+    }
+
+    /// Whether a directory accepts this user's password; a directory that
+    /// cannot be reached, or takes too long, accepts nothing
+    pub async fn verify(&self, user: &str, password: &str) -> bool {
+        // An LDAP bind without a password is anonymous, and always succeeds
+        if user.is_empty() || password.is_empty() {
+            return false;
+        }
+        if let Some(ldap) = &self.ldap {
+            match tokio::time::timeout(CHECK_TIMEOUT, simple_bind(ldap, user, password)).await {
+                Ok(Ok(true)) => return true,
+                Ok(Ok(false)) => debug!("LDAP server refused the bind for {}", user),
+                Ok(Err(e)) => warn!("LDAP server {}:{} failed: {}", ldap.host, ldap.port, e),
+                Err(_) => warn!(
+                    "LDAP server {}:{} timed out after {:?}",
+                    ldap.host, ldap.port, CHECK_TIMEOUT
+                ),
+            }
+        }
+        if let Some(command) = &self.command {
+            match tokio::time::timeout(CHECK_TIMEOUT, run_command(command, user, password)).await {
+                Ok(Ok(true)) => return true,
+                Ok(Ok(false)) => debug!("Authentication command refused {}", user),
+                Ok(Err(e)) => warn!("Authentication command failed: {}", e),
+                Err(_) => warn!("Authentication command timed out after {:?}", CHECK_TIMEOUT),
+            }
+        }
+        false
+    }
+}
+
+async fn run_command(command: &str, user: &str, password: &str) -> std::io::Result<bool> {
+    let mut child = Command::new("sh")
+        .arg("-c")
+        .arg(command)
+        .env("YAMLBASE_AUTH_USER", user)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .kill_on_drop(true)
+        .spawn()?;
+    if let Some(mut stdin) = child.stdin.take() {
+        // A command that decides without reading the password may close its
+        // input first, which is no failure
+        let _ = stdin.write_all(format!("{}\n", password).as_bytes()).await;
+    }
+    Ok(child.wait().await?.success())
+}
+
+/// Bind to an LDAP server as a user, returning whether it took the password
+async fn simple_bind(ldap: &LdapServer, user: &str, password: &str) -> std::io::Result<bool> {
+    let mut stream = TcpStream::connect((ldap.host.as_str(), ldap.port)).await?;
+    stream
+        .write_all(&bind_request(&ldap.bind_dn(user), password))
+        .await?;
+
+    let mut response = Vec::new();
+    let mut buf = [0u8; 512];
+    loop {
+        if let Some(code) = bind_result(&response)? {
+            return Ok(code == 0);
+        }
+        let n = stream.read(&mut buf).await?;
+        if n == 0 {
+            return Err(std::io::Error::other("LDAP server closed the connection"));
+        }
+        response.extend_from_slice(&buf[..n]);
+    }
+}
+
+/// A BER element: its tag, then its length and contents
+fn ber(tag: u8, contents: &[u8]) -> Vec<u8> {
+    let mut element = vec![tag];
+    match contents.len() {
+        len if len < 0x80 => element.push(len as u8),
+        len if len <= 0xff => element.extend([0x81, len as u8]),
+        len => element.extend([0x82, (len >> 8) as u8, len as u8]),
+    }
+    element.extend_from_slice(contents);
+    element
+}
+
+/// LDAPv3 BindRequest message 1 with simple authentication
+fn bind_request(dn: &str, password: &str) -> Vec<u8> {
+    let bind = [
+        ber(0x02, &[3]),                // version
+        ber(0x04, dn.as_bytes()),       // name
+        ber(0x80, password.as_bytes()), // simple authentication
+    ]
+    .concat();
+    ber(0x30, &[ber(0x02, &[1]), ber(0x60, &bind)].concat())
+}
+
+/// The tag, contents and end of the BER element at `pos`, or `None` if it
+/// has not all arrived
+fn element(bytes: &[u8], pos: usize) -> Option<(u8, &[u8], usize)> {
+    let tag = *bytes.get(pos)?;
+    let first = *bytes.get(pos + 1)? as usize;
+    let (len, start) = if first < 0x80 {
+        (first, pos + 2)
+    } else {
+        let count = first & 0x7f;
+        let len = bytes
+            .get(pos + 2..pos + 2 + count)?
+            .iter()
+            .fold(0usize, |len, &b| len << 8 | b as usize);
+        (len, pos + 2 + count)
+    };
+    let contents = bytes.get(start..start + len)?;
+    Some((tag, contents, start + len))
+}
+
+/// The result code of a BindResponse, once all of it has arrived
+fn bind_result(response: &[u8]) -> std::io::Result<Option<u8>> {
+    let malformed = || std::io::Error::other("Malformed LDAP bind response");
+    let Some((0x30, message, _)) = element(response, 0) else {
+        return match response.first() {
+            None | Some(0x30) => Ok(None),
+            Some(_) => Err(malformed()),
+        };
+    };
+    let (_, _, op_start) = element(message, 0).ok_or_else(malformed)?;
+    match element(message, op_start) {
+        Some((0x61, op, _)) => match element(op, 0) {
+            Some((0x0a, [code], _)) => Ok(Some(*code)),
+            _ => Err(malformed()),
+        },
+        _ => Err(malformed()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::net::TcpListener;
+
+    #[test]
+    fn test_parse_ldap_server() {
+        let dn = "uid={user},ou=people,dc=example,dc=com";
+        let ldap = LdapServer::parse("ldap://ldap.internal", dn).unwrap();
+        assert_eq!((ldap.host.as_str(), ldap.port), ("ldap.internal", 389));
+        assert_eq!(
+            LdapServer::parse("ldap://10.0.0.5:1389/", dn).unwrap().port,
+            1389
+        );
+        assert!(LdapServer::parse("ldaps://ldap.internal", dn).is_err());
+        assert!(LdapServer::parse("ldap://:389", dn).is_err());
+        assert!(LdapServer::parse("ldap://ldap.internal", "ou=people").is_err());
+
+        assert_eq!(ldap.bind_dn("ada"), "uid=ada,ou=people,dc=example,dc=com");
+        assert_eq!(
+            ldap.bind_dn("x,ou=admins"),
+            "uid=x\\,ou\\=admins,ou=people,dc=example,dc=com"
+        );
+    }
+
+    #[test]
+    fn test_bind_messages() {
+        assert_eq!(
+            bind_request("cn=a", "pw"),
+            [
+                0x30, 0x12, 0x02, 0x01, 0x01, 0x60, 0x0d, 0x02, 0x01, 0x03, 0x04, 0x04, b'c', b'n',
+                b'=', b'a', 0x80, 0x02, b'p', b'w'
+            ]
+        );
+
+        let success = [
+            0x30, 0x0c, 0x02, 0x01, 0x01, 0x61, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00,
+        ];
+        assert_eq!(bind_result(&success).unwrap(), Some(0));
+        assert_eq!(bind_result(&success[..6]).unwrap(), None);
+        let mut invalid = success;
+        invalid[9] = 49; // invalidCredentials
+        assert_eq!(bind_result(&invalid).unwrap(), Some(49));
+        assert!(bind_result(b"HTTP/1.1 400").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_ldap_bind_checks_the_password() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        tokio::spawn(async move {
+            loop {
+                let (mut socket, _) = listener.accept().await.unwrap();
+                let mut request = vec![0u8; 512];
+                let n = socket.read(&mut request).await.unwrap();
+                let code = if request[..n].ends_with(b"secret") {
+                    0
+                } else {
+                    49
+                };
+                socket
+                    .write_all(&[
+                        0x30, 0x0c, 0x02, 0x01, 0x01, 0x61, 0x07, 0x0a, 0x01, code, 0x04, 0x00,
+                        0x04, 0x00,
+                    ])
+                    .await
+                    .unwrap();
+            }
+        });
+
+        let backends = AuthBackends {
+            ldap: Some(
+                LdapServer::parse(&format!("ldap://127.0.0.1:{}", port), "cn={user}").unwrap(),
+            ),
+            command: None,
+        };
+        assert!(backends.verify("ada", "secret").await);
+        assert!(!backends.verify("ada", "guess").await);
+        assert!(!backends.verify("ada", "").await);
+    }
+
+    #[tokio::test]
+    async fn test_command_checks_the_password() {
+        let backends = AuthBackends {
+            ldap: None,
+            command: Some(
+                r#"read password; [ "$YAMLBASE_AUTH_USER" = ada ] && [ "$password" = secret ]"#
+                    .to_string(),
+            ),
+        };
+        assert!(backends.is_enabled());
+        assert!(backends.verify("ada", "secret").await);
+        assert!(!backends.verify("ada", "guess").await);
+        assert!(!backends.verify("bob", "secret").await);
+        assert!(!AuthBackends::default().is_enabled());
+    }
+}
@@ -1,10 +1,16 @@
+use bytes::BytesMut;
+use std::future::Future;
 use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::AsyncWriteExt;
 use tokio::net::TcpStream;
-use tracing::error;
+use tracing::{debug, error, warn};
 
 use crate::config::{Config, Protocol};
+use crate::crash_dump::{self, Crash};
 use crate::database::Storage;
 use crate::protocol::{MySqlProtocol, PostgresProtocol};
+use crate::recovery::catch_panic;
 
 pub struct Connection {
     config: Arc<Config>,
@@ -16,7 +22,27 @@ impl Connection {
         Self { config, storage }
     }
 
+    /// Serve one client. A panic while handling it is contained to this
+    /// connection and reported as a protocol error rather than unwinding into
+    /// the connection manager, which still needs to release the slot.
     pub async fn handle(&self, stream: TcpStream) -> crate::Result<()> {
+        match catch_panic(self.serve(stream)).await {
+            Ok(result) => result,
+            Err(panic) => {
+                error!(
+                    "Connection handler panicked: {}\n{}",
+                    panic, panic.backtrace
+                );
+                crash_dump::write(&Crash::panic(&panic, None));
+                Err(crate::YamlBaseError::Protocol(format!(
+                    "Connection handler panicked: {}",
+                    panic.message
+                )))
+            }
+        }
+    }
+
+    async fn serve(&self, stream: TcpStream) -> crate::Result<()> {
         match self.config.protocol {
             Protocol::Postgres => {
                 let mut protocol =
@@ -37,3 +63,185 @@ impl Connection {
         }
     }
 }
+
+/// Run `work`, a statement for the client on `stream`, unless the client
+/// disconnects first; then `work` is dropped, which stops the statement, and
+/// `None` returned. Messages the client sends meanwhile are left unread.
+pub(crate) async fn unless_disconnected<T>(
+    stream: &TcpStream,
+    work: impl Future<Output = T>,
+) -> Option<T> {
+    tokio::select! {
+        biased;
+        result = work => Some(result),
+        _ = disconnected(stream) => {
+            debug!("Client disconnected while its statement ran");
+            None
+        }
+    }
+}
+
+/// Resolve once the client closes its end of `stream`
+async fn disconnected(stream: &TcpStream) {
+    let mut byte = [0u8; 1];
+    match stream.peek(&mut byte).await {
+        Ok(0) | Err(_) => {}
+        // The client sent more, to be read after the statement; a disconnect
+        // then shows when reading it
+        Ok(_) => std::future::pending().await,
+    }
+}
+
+/// How results are written to a client: rows are encoded into a buffer of at
+/// most `buffer` bytes, written out whenever it fills, so a connection never
+/// holds more than that of encoded output beside the result itself; and a
+/// client that accepts none of it for `stall_timeout` is disconnected, which
+/// frees the result rather than letting a stalled reader keep it in memory.
+/// A zero `stall_timeout` waits for the client indefinitely.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub(crate) struct OutputLimits {
+    pub buffer: usize,
+    pub stall_timeout: Duration,
+}
+
+impl Default for OutputLimits {
+    fn default() -> Self {
+        Self {
+            buffer: 64 * 1024,
+            stall_timeout: Duration::from_secs(30),
+        }
+    }
+}
+
+impl OutputLimits {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            buffer: config.output_buffer as usize,
+            stall_timeout: config.slow_client_timeout,
+        }
+    }
+}
+
+/// Writes the rows of a result to a client within [`OutputLimits`]
+pub(crate) struct ResultWriter<'a> {
+    stream: &'a mut TcpStream,
+    buffer: BytesMut,
+    limits: OutputLimits,
+}
+
+impl<'a> ResultWriter<'a> {
+    pub fn new(stream: &'a mut TcpStream, limits: OutputLimits) -> Self {
+        Self {
+            stream,
+            buffer: BytesMut::with_capacity(limits.buffer),
+            limits,
+        }
+    }
+
+    /// Queue an encoded message, writing the buffer out once it is full
+    pub async fn push(&mut self, message: &[u8]) -> crate::Result<()> {
+        self.buffer.extend_from_slice(message);
+        if self.buffer.len() >= self.limits.buffer {
+            self.flush().await?;
+        }
+        Ok(())
+    }
+
+    /// Write out whatever is queued
+    pub async fn flush(&mut self) -> crate::Result<()> {
+        if !self.buffer.is_empty() {
+            send(self.stream, &self.buffer, self.limits.stall_timeout).await?;
+            self.buffer.clear();
+        }
+        Ok(())
+    }
+}
+
+/// Write `bytes` to the client, failing once it has accepted none of them for
+/// `stall_timeout`. A client reading slowly but steadily is waited for; only
+/// one that stops reading altogether times out.
+pub(crate) async fn send(
+    stream: &mut TcpStream,
+    bytes: &[u8],
+    stall_timeout: Duration,
+) -> crate::Result<()> {
+    if stall_timeout.is_zero() {
+        stream.write_all(bytes).await?;
+        return Ok(());
+    }
+    let mut written = 0;
+    while written < bytes.len() {
+        match tokio::time::timeout(stall_timeout, stream.write(&bytes[written..])).await {
+            Ok(Ok(0)) => return Err(std::io::Error::from(std::io::ErrorKind::WriteZero).into()),
+            Ok(Ok(n)) => written += n,
+            Ok(Err(e)) => return Err(e.into()),
+            Err(_) => {
+                warn!(
+                    "Disconnecting a client that accepted no result data for {:?}",
+                    stall_timeout
+                );
+                return Err(crate::YamlBaseError::Protocol(format!(
+                    "Write timeout: the client accepted no result data for {:?}",
+                    stall_timeout
+                )));
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::io::AsyncReadExt;
+    use tokio::net::TcpListener;
+
+    async fn pair() -> (TcpStream, TcpStream) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let client = TcpStream::connect(listener.local_addr().unwrap())
+            .await
+            .unwrap();
+        let (server, _) = listener.accept().await.unwrap();
+        (client, server)
+    }
+
+    const LIMITS: OutputLimits = OutputLimits {
+        buffer: 4096,
+        stall_timeout: Duration::from_millis(200),
+    };
+
+    #[tokio::test]
+    async fn test_results_reach_a_reading_client_in_bounded_writes() {
+        let (mut client, mut server) = pair().await;
+        let reader = tokio::spawn(async move {
+            let mut received = Vec::new();
+            client.read_to_end(&mut received).await.unwrap();
+            received
+        });
+
+        let mut writer = ResultWriter::new(&mut server, LIMITS);
+        for _ in 0..1000 {
+            writer.push(&[7u8; 100]).await.unwrap();
+            assert!(writer.buffer.len() < LIMITS.buffer);
+        }
+        writer.flush().await.unwrap();
+        drop(server);
+        assert_eq!(reader.await.unwrap(), vec![7u8; 100_000]);
+    }
+
+    #[tokio::test]
+    async fn test_a_client_that_stops_reading_is_cut_off() {
+        let (_client, mut server) = pair().await;
+        let mut writer = ResultWriter::new(&mut server, LIMITS);
+        // Far more than the socket buffers hold, so writes stall
+        let mut outcome = Ok(());
+        for _ in 0..64 * 1024 {
+            outcome = writer.push(&[0u8; 1024]).await;
+            if outcome.is_err() {
+                break;
+            }
+        }
+        let error = outcome.unwrap_err();
+        assert!(error.to_string().contains("Write timeout"));
+    }
+}
@@ -1,8 +1,11 @@
+pub mod auth;
 pub mod connection;
 pub mod mysql_caching_sha2;
 pub mod mysql_simple;
 pub mod postgres;
 pub mod postgres_extended;
+pub mod postgres_session;
+pub mod prepared_statements;
 
 pub use connection::Connection;
 pub use mysql_simple::MySqlProtocol;
@@ -1,15 +1,21 @@
 use bytes::{BufMut, BytesMut};
 use sha1::{Digest, Sha1};
 use std::sync::Arc;
-use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::io::AsyncReadExt;
 use tokio::net::TcpStream;
 use tracing::{debug, info};
 
 use crate::YamlBaseError;
 use crate::config::Config;
-use crate::database::Storage;
+use crate::database::{Storage, Value, clock};
+use crate::protocol::auth::{AuthBackends, CLEAR_PASSWORD_PLUGIN_NAME};
+use crate::protocol::connection::{OutputLimits, ResultWriter, send, unless_disconnected};
 use crate::protocol::mysql_caching_sha2::{CACHING_SHA2_PLUGIN_NAME, CachingSha2Auth};
-use crate::sql::{QueryExecutor, parse_sql};
+use crate::server::{QuotaExceeded, SessionSlot};
+use crate::sql::copy::{self, BulkLoad};
+use crate::sql::literals::{self, Escapes};
+use crate::sql::{QueryExecutor, SqlDialect, booleans, bytea, coercion, identifiers, parse_sql};
+use crate::yaml::schema::SqlType;
 
 // MySQL Protocol Constants
 const PROTOCOL_VERSION: u8 = 10;
@@ -21,27 +27,86 @@ const COM_QUIT: u8 = 0x01;
 const COM_INIT_DB: u8 = 0x02;
 const COM_QUERY: u8 = 0x03;
 const COM_PING: u8 = 0x0e;
+const COM_CHANGE_USER: u8 = 0x11;
+const COM_RESET_CONNECTION: u8 = 0x1f;
 
 // Capability flags
 const CLIENT_LONG_PASSWORD: u32 = 0x00000001;
 const CLIENT_FOUND_ROWS: u32 = 0x00000002;
 const CLIENT_LONG_FLAG: u32 = 0x00000004;
 const CLIENT_CONNECT_WITH_DB: u32 = 0x00000008;
+const CLIENT_LOCAL_FILES: u32 = 0x00000080;
 const CLIENT_PROTOCOL_41: u32 = 0x00000200;
 const CLIENT_SECURE_CONNECTION: u32 = 0x00008000;
 const CLIENT_PLUGIN_AUTH: u32 = 0x00080000;
 const _CLIENT_DEPRECATE_EOF: u32 = 0x01000000;
 
 // Column types
+const MYSQL_TYPE_TINY: u8 = 1;
+const MYSQL_TYPE_LONG: u8 = 3;
+const MYSQL_TYPE_FLOAT: u8 = 4;
+const MYSQL_TYPE_DOUBLE: u8 = 5;
+const MYSQL_TYPE_LONGLONG: u8 = 8;
+const MYSQL_TYPE_DATE: u8 = 10;
+const MYSQL_TYPE_TIME: u8 = 11;
+const MYSQL_TYPE_DATETIME: u8 = 12;
+const MYSQL_TYPE_NEWDECIMAL: u8 = 246;
+const MYSQL_TYPE_BLOB: u8 = 252;
 const MYSQL_TYPE_VAR_STRING: u8 = 253;
 
+// The decimals of a FLOAT or DOUBLE, whose digits after the point vary
+const NOT_FIXED_DEC: u8 = 31;
+
+// Column flags
+const BLOB_FLAG: u16 = 0x0010;
+const BINARY_FLAG: u16 = 0x0080;
+const NUM_FLAG: u16 = 0x8000;
+
+// The binary character set, which BLOB columns have
+const BINARY_CHARSET: u16 = 63;
+
 // Status flags
+const SERVER_STATUS_IN_TRANS: u16 = 0x0001;
 const SERVER_STATUS_AUTOCOMMIT: u16 = 0x0002;
 
+/// System variables that ProxySQL and drivers read to decide how to route
+/// to the server; the rest read as `'1'`. The primary is writable, so
+/// ProxySQL keeps it in the writer hostgroup.
+const SYSTEM_VARIABLES: &[(&str, &str)] = &[
+    ("autocommit", "1"),
+    ("innodb_read_only", "0"),
+    ("interactive_timeout", "28800"),
+    ("read_only", "0"),
+    ("super_read_only", "0"),
+    ("transaction_isolation", "'REPEATABLE-READ'"),
+    ("transaction_read_only", "0"),
+    ("tx_isolation", "'REPEATABLE-READ'"),
+    ("tx_read_only", "0"),
+    ("wait_timeout", "28800"),
+];
+
+/// The variables that read as `1` on a replica listener instead, which puts
+/// it in ProxySQL's reader hostgroup
+const REPLICA_READ_ONLY_VARIABLES: &[&str] = &[
+    "read_only",
+    "super_read_only",
+    "transaction_read_only",
+    "tx_read_only",
+];
+
+/// What a replica tells a client whose statement would write, as a server
+/// started with `--read-only` does
+const READ_ONLY_MESSAGE: &str =
+    "The MySQL server is running with the --read-only option so it cannot execute this statement";
+
+/// MySQL 8.0's default `sql_mode`, which a session starts with
+const DEFAULT_SQL_MODE: &str = "ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ZERO_DATE,ERROR_FOR_DIVISION_BY_ZERO,NO_ENGINE_SUBSTITUTION";
+
 pub struct MySqlProtocol {
     config: Arc<Config>,
     executor: QueryExecutor,
     _database_name: String,
+    auth_backends: AuthBackends,
 }
 
 struct ConnectionState {
@@ -49,6 +114,11 @@ struct ConnectionState {
     _capabilities: u32,
     auth_data: Vec<u8>,
     client_auth_plugin: Option<String>,
+    /// Between `BEGIN` and `COMMIT` or `ROLLBACK`; ProxySQL keeps a client on
+    /// one backend connection while the status flags say so
+    in_transaction: bool,
+    /// The session's `sql_mode`, which the executor follows as well
+    sql_mode: String,
 }
 
 impl Default for ConnectionState {
@@ -58,17 +128,33 @@ impl Default for ConnectionState {
             _capabilities: 0,
             auth_data: generate_auth_data(),
             client_auth_plugin: None,
+            in_transaction: false,
+            sql_mode: DEFAULT_SQL_MODE.to_string(),
+        }
+    }
+}
+
+impl ConnectionState {
+    fn status_flags(&self) -> u16 {
+        if self.in_transaction {
+            SERVER_STATUS_AUTOCOMMIT | SERVER_STATUS_IN_TRANS
+        } else {
+            SERVER_STATUS_AUTOCOMMIT
         }
     }
 }
 
 impl MySqlProtocol {
     pub async fn new(config: Arc<Config>, storage: Arc<Storage>) -> crate::Result<Self> {
-        let executor = QueryExecutor::new(storage).await?;
+        let executor = QueryExecutor::new(storage)
+            .await?
+            .with_dialect(SqlDialect::MySQL);
+        let auth_backends = AuthBackends::from_config(&config)?;
         Ok(Self {
             config,
             executor,
             _database_name: String::new(), // Will be set later if needed
+            auth_backends,
         })
     }
 
@@ -82,84 +168,71 @@ impl MySqlProtocol {
 
         // Read handshake response
         let response_packet = self.read_packet(&mut stream, &mut state).await?;
-        let (username, auth_response, _database, client_plugin) =
+        let (username, auth_response, database, client_plugin) =
             self.parse_handshake_response(&response_packet)?;
         state.client_auth_plugin = client_plugin;
 
-        // Simple authentication check
+        // Simple authentication check: the configured user or a tenant user
         debug!(
             "Authentication check - username: {}, expected: {}",
             username, self.config.username
         );
-        if username != self.config.username {
-            debug!("Username mismatch");
+        let password = if username == self.config.username {
+            Some(self.config.password.clone())
+        } else {
+            self.executor
+                .storage()
+                .database()
+                .read()
+                .await
+                .tenant_password(&username)
+                .map(str::to_string)
+        };
+        let authenticated = match password {
+            Some(password) => {
+                self.static_login(&mut stream, &mut state, &username, &password, auth_response)
+                    .await?
+            }
+            // Users the static list lacks are checked against a directory
+            None if self.auth_backends.is_enabled() => {
+                self.clear_password_login(&mut stream, &mut state, &username)
+                    .await?
+            }
+            None => {
+                debug!("Username mismatch");
+                false
+            }
+        };
+        if !authenticated {
             self.send_error(&mut stream, &mut state, 1045, "28000", "Access denied")
                 .await?;
             return Ok(());
         }
 
-        // Verify password
-        let expected = compute_auth_response(&self.config.password, &state.auth_data);
-        debug!(
-            "Password check - auth_response len: {}, expected len: {}, config password: {}",
-            auth_response.len(),
-            expected.len(),
-            self.config.password
-        );
-
-        // Check if client requested caching_sha2_password
-        let client_wants_caching = state
-            .client_auth_plugin
-            .as_ref()
-            .map(|p| p == CACHING_SHA2_PLUGIN_NAME)
-            .unwrap_or(false);
-
-        if client_wants_caching || auth_response.is_empty() {
-            // Switch to caching_sha2_password
-            debug!("Client requested caching_sha2_password or sent empty auth");
-
-            // Generate new auth data for caching_sha2
-            let caching_auth_data = generate_auth_data();
-            let caching_auth = CachingSha2Auth::new(caching_auth_data.clone());
-
-            // Send auth switch request
-            caching_auth
-                .send_auth_switch_request(&mut stream, &mut state.sequence_id)
-                .await?;
-
-            // Read client's response to auth switch
-            let auth_switch_response = self.read_packet(&mut stream, &mut state).await?;
-
-            // Authenticate using caching_sha2_password
-            let auth_success = caching_auth
-                .authenticate(
-                    &mut stream,
-                    &mut state.sequence_id,
-                    &username,
-                    "", // password will be sent in clear text
-                    &self.config.username,
-                    &self.config.password,
-                    auth_switch_response,
-                )
-                .await?;
-
-            if !auth_success {
-                self.send_error(&mut stream, &mut state, 1045, "28000", "Access denied")
-                    .await?;
-                return Ok(());
-            }
-        } else {
-            // Use mysql_native_password authentication
-            if auth_response != expected {
-                debug!(
-                    "Password mismatch - expected: {:?}, got: {:?}",
-                    expected, auth_response
-                );
-                self.send_error(&mut stream, &mut state, 1045, "28000", "Access denied")
+        self.executor.set_user(&username);
+
+        // The session holds its place among the open sessions until it ends
+        let _slot = match self.open_session(&stream, &username, database).await {
+            Ok(slot) => slot,
+            Err(quota) => {
+                let (code, sql_state, message) = match quota {
+                    QuotaExceeded::User { user, .. } => (
+                        1203,
+                        "42000",
+                        format!(
+                            "User {} already has more than 'max_user_connections' active connections",
+                            user
+                        ),
+                    ),
+                    QuotaExceeded::Database { .. } => {
+                        (1040, "08004", "Too many connections".to_string())
+                    }
+                };
+                self.send_error(&mut stream, &mut state, code, sql_state, &message)
                     .await?;
                 return Ok(());
             }
-        }
+        };
 
         // Send OK packet
         self.send_ok(&mut stream, &mut state, 0, 0).await?;
@@ -197,6 +270,24 @@ impl MySqlProtocol {
                     })?;
                     self.send_ok(&mut stream, &mut state, 0, 0).await?;
                 }
+                COM_RESET_CONNECTION => {
+                    // Poolers reset a connection before handing it to another client
+                    self.executor.reset_session();
+                    state.in_transaction = false;
+                    state.sql_mode = DEFAULT_SQL_MODE.to_string();
+                    self.send_ok(&mut stream, &mut state, 0, 0).await?;
+                }
+                COM_CHANGE_USER => {
+                    if !self.change_user(&state, &packet[1..])? {
+                        self.send_error(&mut stream, &mut state, 1045, "28000", "Access denied")
+                            .await?;
+                        break;
+                    }
+                    self.executor.reset_session();
+                    state.in_transaction = false;
+                    state.sql_mode = DEFAULT_SQL_MODE.to_string();
+                    self.send_ok(&mut stream, &mut state, 0, 0).await?;
+                }
                 _ => {
                     debug!("Unhandled command: 0x{:02x}", command);
                     self.send_error(&mut stream, &mut state, 1047, "08S01", "Unknown command")
@@ -236,6 +327,7 @@ impl MySqlProtocol {
             | CLIENT_FOUND_ROWS
             | CLIENT_LONG_FLAG
             | CLIENT_CONNECT_WITH_DB
+            | CLIENT_LOCAL_FILES
             | CLIENT_PROTOCOL_41
             | CLIENT_SECURE_CONNECTION
             | CLIENT_PLUGIN_AUTH;
@@ -268,12 +360,40 @@ impl MySqlProtocol {
         Ok(())
     }
 
+    /// Open the logged-in connection's session, unless its user or database
+    /// already has as many as the connection quotas allow
+    async fn open_session(
+        &self,
+        stream: &TcpStream,
+        username: &str,
+        database: Option<String>,
+    ) -> Result<SessionSlot, QuotaExceeded> {
+        let storage = self.executor.storage();
+        let database = match database {
+            Some(database) => database,
+            None => storage.database().read().await.name.clone(),
+        };
+        storage.sessions().open(
+            username,
+            &database,
+            stream.peer_addr().ok().map(|addr| addr.ip().to_string()),
+            "",
+            storage.clock().now(),
+        )
+    }
+
     #[allow(clippy::type_complexity)]
     fn parse_handshake_response(
         &self,
         packet: &[u8],
     ) -> crate::Result<(String, Vec<u8>, Option<String>, Option<String>)> {
         debug!("Parsing handshake response, packet len: {}", packet.len());
+        // Fixed-length prefix: capabilities, max packet size, charset, reserved
+        if packet.len() < 32 {
+            return Err(YamlBaseError::Protocol(
+                "Handshake response too short".to_string(),
+            ));
+        }
         let mut pos = 0;
 
         // Parse client capabilities (4 bytes)
@@ -307,11 +427,8 @@ impl MySqlProtocol {
         pos += username_end + 1;
 
         // Auth response length
-        let auth_len = packet[pos] as usize;
-        debug!(
-            "Auth response length byte: {}, interpreted as: {}",
-            packet[pos], auth_len
-        );
+        let auth_len = packet.get(pos).copied().unwrap_or(0) as usize;
+        debug!("Auth response length: {}", auth_len);
         pos += 1;
 
         // Auth response
@@ -321,7 +438,7 @@ impl MySqlProtocol {
             debug!("Auth response empty or invalid length");
             Vec::new()
         };
-        pos += auth_len;
+        pos = (pos + auth_len).min(packet.len());
 
         // Database (optional, null-terminated)
         let database = if pos < packet.len() {
@@ -372,12 +489,122 @@ impl MySqlProtocol {
         Ok((username, auth_response, database, auth_plugin))
     }
 
+    /// Check the password of a user in the static list, the configured user
+    /// or a tenant, with mysql_native_password or caching_sha2_password
+    async fn static_login(
+        &self,
+        stream: &mut TcpStream,
+        state: &mut ConnectionState,
+        username: &str,
+        password: &str,
+        auth_response: Vec<u8>,
+    ) -> crate::Result<bool> {
+        // Verify password
+        let expected = compute_auth_response(password, &state.auth_data);
+        debug!(
+            "Password check - auth_response len: {}, expected len: {}, config password: {}",
+            auth_response.len(),
+            expected.len(),
+            password
+        );
+
+        // Check if client requested caching_sha2_password
+        let client_wants_caching = state
+            .client_auth_plugin
+            .as_ref()
+            .map(|p| p == CACHING_SHA2_PLUGIN_NAME)
+            .unwrap_or(false);
+
+        if client_wants_caching || auth_response.is_empty() {
+            // Switch to caching_sha2_password
+            debug!("Client requested caching_sha2_password or sent empty auth");
+
+            // Generate new auth data for caching_sha2
+            let caching_auth_data = generate_auth_data();
+            let caching_auth = CachingSha2Auth::new(caching_auth_data.clone());
+
+            // Send auth switch request
+            caching_auth
+                .send_auth_switch_request(stream, &mut state.sequence_id)
+                .await?;
+
+            // Read client's response to auth switch
+            let auth_switch_response = self.read_packet(stream, state).await?;
+
+            // Authenticate using caching_sha2_password
+            caching_auth
+                .authenticate(
+                    stream,
+                    &mut state.sequence_id,
+                    username,
+                    "", // password will be sent in clear text
+                    username,
+                    password,
+                    auth_switch_response,
+                )
+                .await
+        } else {
+            // Use mysql_native_password authentication
+            if auth_response != expected {
+                debug!(
+                    "Password mismatch - expected: {:?}, got: {:?}",
+                    expected, auth_response
+                );
+            }
+            Ok(auth_response == expected)
+        }
+    }
+
+    /// Ask the client for its password with mysql_clear_password, and check
+    /// it against the configured directories
+    async fn clear_password_login(
+        &self,
+        stream: &mut TcpStream,
+        state: &mut ConnectionState,
+        username: &str,
+    ) -> crate::Result<bool> {
+        debug!("Asking for the password of {} in clear text", username);
+        let mut switch = BytesMut::new();
+        switch.put_u8(0xfe); // auth switch request
+        switch.put_slice(CLEAR_PASSWORD_PLUGIN_NAME.as_bytes());
+        switch.put_u8(0);
+        self.write_packet(stream, state, &switch).await?;
+
+        let response = self.read_packet(stream, state).await?;
+        let password = response.strip_suffix(&[0]).unwrap_or(&response);
+        let Ok(password) = std::str::from_utf8(password) else {
+            return Ok(false);
+        };
+        Ok(self.auth_backends.verify(username, password).await)
+    }
+
+    /// Check the credentials of a COM_CHANGE_USER, which ProxySQL sends to
+    /// reset a connection; the auth response must be a mysql_native_password
+    /// one for the scramble of the initial handshake
+    fn change_user(&self, state: &ConnectionState, payload: &[u8]) -> crate::Result<bool> {
+        let invalid = || YamlBaseError::Protocol("Invalid change user packet".to_string());
+        let username_end = payload.iter().position(|&b| b == 0).ok_or_else(invalid)?;
+        let username = std::str::from_utf8(&payload[..username_end]).map_err(|_| invalid())?;
+        let auth_start = username_end + 1;
+        let auth_len = *payload.get(auth_start).ok_or_else(invalid)? as usize;
+        let auth_response = payload
+            .get(auth_start + 1..auth_start + 1 + auth_len)
+            .ok_or_else(invalid)?;
+
+        debug!("Change user to {}", username);
+        Ok(username == self.config.username
+            && auth_response == compute_auth_response(&self.config.password, &state.auth_data))
+    }
+
     async fn handle_query(
         &self,
         stream: &mut TcpStream,
         state: &mut ConnectionState,
         query: &str,
     ) -> crate::Result<()> {
+        // Comments, optimizer hints and sqlcommenter trailers are dropped,
+        // and the text of /*! ... */ comments kept
+        let query = literals::strip_comments(query, Escapes::mysql(&state.sql_mode));
         let query_trimmed = query.trim();
         let query_upper = query_trimmed.to_uppercase();
 
@@ -389,9 +616,30 @@ impl MySqlProtocol {
             return Ok(());
         }
 
+        // LOAD DATA LOCAL INFILE, which sqlparser cannot parse
+        if let Some(load) = copy::parse_load_data(query_trimmed) {
+            return match load {
+                Ok((load, file)) => self.load_local_infile(stream, state, load, &file).await,
+                Err(e) => {
+                    self.send_error(stream, state, 1064, "42000", &e.to_string())
+                        .await
+                }
+            };
+        }
+
+        // Strings are read with backslash escapes unless sql_mode has
+        // NO_BACKSLASH_ESCAPES, and "..." is a string unless it has ANSI_QUOTES
+        let normalized = literals::normalize(query_trimmed, Escapes::mysql(&state.sql_mode));
+        let query_trimmed = match &normalized {
+            Ok(query) => query.as_ref(),
+            Err(message) => {
+                return self.send_error(stream, state, 1064, "42000", message).await;
+            }
+        };
+
         // Handle queries with system variables by preprocessing them
         let mut processed_query = if query_trimmed.contains("@@") {
-            self.preprocess_system_variables(query_trimmed)
+            self.preprocess_system_variables(query_trimmed, state)
         } else {
             query_trimmed.to_string()
         };
@@ -402,14 +650,23 @@ impl MySqlProtocol {
             debug!("Removed backticks: {}", processed_query);
         }
 
+        // SET sql_mode, which changes how later queries read and what they accept
+        if let Some(sql_mode) = sql_mode_setting(&query) {
+            debug!("Setting sql_mode to {}", sql_mode);
+            self.executor.set_sql_mode(&sql_mode);
+            state.sql_mode = sql_mode;
+            return self.send_ok(stream, state, 0, 0).await;
+        }
+
         // Handle SET NAMES command (ignore it - we always use UTF-8)
         if query_upper.starts_with("SET NAMES") || query_upper.starts_with("SET CHARACTER SET") {
             debug!("Ignoring SET NAMES/CHARACTER SET command: {}", query);
             return self.send_ok(stream, state, 0, 0).await;
         }
 
-        // Handle other SET commands that MySQL clients might send
-        if query_upper.starts_with("SET ") {
+        // Handle other SET commands that MySQL clients might send; yamlbase's
+        // own settings go to the executor
+        if query_upper.starts_with("SET ") && !query_upper.contains("YAMLBASE.") {
             debug!("Ignoring SET command: {}", query);
             return self.send_ok(stream, state, 0, 0).await;
         }
@@ -429,6 +686,16 @@ impl MySqlProtocol {
                 return Ok(());
             }
         };
+        let limit = self.config.identifier_limit();
+        if let Some(name) = statements
+            .iter()
+            .find_map(|statement| identifiers::too_long(statement, limit))
+        {
+            let message = format!("Identifier name '{}' is too long", name);
+            return self
+                .send_error(stream, state, 1059, "42000", &message)
+                .await;
+        }
 
         for statement in statements {
             debug!("Executing statement: {:?}", statement);
@@ -441,8 +708,23 @@ impl MySqlProtocol {
                     | sqlparser::ast::Statement::Rollback { .. }
             );
 
-            match self.executor.execute(&statement).await {
+            let Some(outcome) =
+                unless_disconnected(stream, self.executor.execute(&statement)).await
+            else {
+                return Ok(());
+            };
+            match outcome {
                 Ok(result) => {
+                    match &statement {
+                        sqlparser::ast::Statement::StartTransaction { .. } => {
+                            state.in_transaction = true
+                        }
+                        sqlparser::ast::Statement::Commit { .. }
+                        | sqlparser::ast::Statement::Rollback { .. } => {
+                            state.in_transaction = false
+                        }
+                        _ => {}
+                    }
                     debug!(
                         "Query executed successfully. Result: {} columns, {} rows",
                         result.columns.len(),
@@ -454,11 +736,22 @@ impl MySqlProtocol {
                         || (result.columns.is_empty() && result.rows.is_empty())
                     {
                         debug!("Sending OK packet for transaction command or empty result");
-                        self.send_ok(stream, state, 0, 0).await?;
+                        let affected_rows = self.executor.take_affected_rows().unwrap_or(0);
+                        let last_insert_id = self.executor.take_insert_id().unwrap_or(0);
+                        self.send_ok(stream, state, affected_rows, last_insert_id)
+                            .await?;
                     } else {
                         self.send_query_result(stream, state, &result).await?;
                     }
                 }
+                Err(e @ YamlBaseError::Cancelled(_)) => {
+                    self.send_error(stream, state, 3024, "HY000", &e.to_string())
+                        .await?;
+                }
+                Err(YamlBaseError::ReadOnly(_)) => {
+                    self.send_error(stream, state, 1290, "HY000", READ_ONLY_MESSAGE)
+                        .await?;
+                }
                 Err(e) => {
                     debug!("Query execution error: {}", e);
                     self.send_error(stream, state, 1146, "42S02", &e.to_string())
@@ -470,7 +763,60 @@ impl MySqlProtocol {
         Ok(())
     }
 
-    fn preprocess_system_variables(&self, query: &str) -> String {
+    /// Ask the client for the file a `LOAD DATA LOCAL INFILE` names, read it
+    /// up to the empty packet that ends it and load it
+    async fn load_local_infile(
+        &self,
+        stream: &mut TcpStream,
+        state: &mut ConnectionState,
+        load: BulkLoad,
+        file: &str,
+    ) -> crate::Result<()> {
+        if let Err(e) = self.executor.copy_width(&load).await {
+            if let YamlBaseError::ReadOnly(_) = e {
+                return self
+                    .send_error(stream, state, 1290, "HY000", READ_ONLY_MESSAGE)
+                    .await;
+            }
+            return self
+                .send_error(stream, state, 1146, "42S02", &e.to_string())
+                .await;
+        }
+
+        let mut request = BytesMut::new();
+        request.put_u8(0xfb);
+        request.put_slice(file.as_bytes());
+        self.write_packet(stream, state, &request).await?;
+
+        let mut data = Vec::new();
+        loop {
+            let packet = self.read_packet(stream, state).await?;
+            if packet.is_empty() {
+                break;
+            }
+            data.extend_from_slice(&packet);
+        }
+
+        let loaded = match String::from_utf8(data) {
+            Ok(data) => match load.layout.records(&data) {
+                Ok(records) => self.executor.copy_in(&load, records).await,
+                Err(e) => Err(e),
+            },
+            Err(_) => Err(YamlBaseError::Database {
+                message: format!("Invalid utf8 character string in file '{}'", file),
+            }),
+        };
+        match loaded {
+            Ok(rows) => self.send_ok(stream, state, rows, 0).await,
+            Err(e) => {
+                debug!("LOAD DATA error: {}", e);
+                self.send_error(stream, state, 1146, "42S02", &e.to_string())
+                    .await
+            }
+        }
+    }
+
+    fn preprocess_system_variables(&self, query: &str, state: &ConnectionState) -> String {
         use once_cell::sync::Lazy;
         use regex::Regex;
 
@@ -536,9 +882,25 @@ impl MySqlProtocol {
             return result;
         }
 
-        // Replace remaining system variables with '1'
+        // Replace remaining system variables with their known values, or '1'
+        let read_only = self.executor.storage().is_read_only();
         if let Ok(ref system_var_re) = *SYSTEM_VAR_RE {
-            result = system_var_re.replace_all(&result, "'1'").to_string();
+            result = system_var_re
+                .replace_all(&result, |caps: &regex::Captures| {
+                    let name = caps[1].to_lowercase();
+                    if name == "sql_mode" {
+                        return format!("'{}'", state.sql_mode);
+                    }
+                    if read_only && REPLICA_READ_ONLY_VARIABLES.contains(&name.as_str()) {
+                        return "1".to_string();
+                    }
+                    SYSTEM_VARIABLES
+                        .iter()
+                        .find(|(variable, _)| *variable == name)
+                        .map_or("'1'", |(_, value)| *value)
+                        .to_string()
+                })
+                .to_string();
         } else {
             debug!("Failed to compile SYSTEM_VAR_RE regex");
         }
@@ -559,24 +921,11 @@ impl MySqlProtocol {
             result.rows.len()
         );
 
-        // Convert to string representation
         let columns: Vec<&str> = result.columns.iter().map(|s| s.as_str()).collect();
         debug!("Columns: {:?}", columns);
 
-        let rows: Vec<Vec<String>> = result
-            .rows
-            .iter()
-            .map(|row| row.iter().map(|val| val.to_string()).collect())
-            .collect();
-        debug!("Converted {} rows to strings", rows.len());
-
-        let string_rows: Vec<Vec<&str>> = rows
-            .iter()
-            .map(|row| row.iter().map(|s| s.as_str()).collect())
-            .collect();
-
         debug!("Calling send_simple_result_set");
-        self.send_simple_result_set(stream, state, &columns, &string_rows)
+        self.send_simple_result_set(stream, state, &columns, &result.column_types, &result.rows)
             .await
     }
 
@@ -585,8 +934,24 @@ impl MySqlProtocol {
         stream: &mut TcpStream,
         state: &mut ConnectionState,
         columns: &[&str],
-        rows: &[Vec<&str>],
+        column_types: &[SqlType],
+        rows: &[Vec<Value>],
     ) -> crate::Result<()> {
+        // Columns are described as their values read, so drivers that
+        // convert by type, as PyMySQL does, get numbers and dates back
+        let types: Vec<SqlType> = (0..columns.len())
+            .map(|idx| {
+                coercion::described_type(
+                    column_types.get(idx),
+                    rows.iter().filter_map(|row| row.get(idx)),
+                )
+            })
+            .collect();
+        let binary: Vec<bool> = types
+            .iter()
+            .map(|sql_type| *sql_type == SqlType::Bytea)
+            .collect();
+
         debug!(
             "send_simple_result_set: {} columns, {} rows",
             columns.len(),
@@ -618,31 +983,23 @@ impl MySqlProtocol {
             // Original table
             col_packet.put_u8(0);
 
-            // Column name
-            col_packet.put_u8(column.len() as u8);
+            // Column name, which as an alias may be longer than 250 bytes
+            put_lenenc_int(&mut col_packet, column.len() as u64);
             col_packet.put_slice(column.as_bytes());
 
             // Original column name
-            col_packet.put_u8(column.len() as u8);
+            put_lenenc_int(&mut col_packet, column.len() as u64);
             col_packet.put_slice(column.as_bytes());
 
             // Length of fixed fields (0x0c)
             col_packet.put_u8(0x0c);
 
-            // Character set (utf8mb4)
-            col_packet.put_u16_le(33);
-
-            // Column length
-            col_packet.put_u32_le(255);
-
-            // Column type (VAR_STRING)
-            col_packet.put_u8(MYSQL_TYPE_VAR_STRING);
-
-            // Flags
-            col_packet.put_u16_le(0);
-
-            // Decimals
-            col_packet.put_u8(0);
+            let column_type = column_type(&types[idx]);
+            col_packet.put_u16_le(column_type.charset);
+            col_packet.put_u32_le(column_type.length);
+            col_packet.put_u8(column_type.type_code);
+            col_packet.put_u16_le(column_type.flags);
+            col_packet.put_u8(column_type.decimals);
 
             // Filler
             col_packet.put_u16_le(0);
@@ -655,128 +1012,50 @@ impl MySqlProtocol {
         let mut eof_packet = BytesMut::new();
         eof_packet.put_u8(0xfe); // EOF marker
         eof_packet.put_u16_le(0); // warnings
-        eof_packet.put_u16_le(SERVER_STATUS_AUTOCOMMIT); // status flags
+        eof_packet.put_u16_le(state.status_flags()); // status flags
         self.write_packet(stream, state, &eof_packet).await?;
 
-        // Send rows with intelligent batching for performance
+        // Rows are encoded one at a time and written in bounded batches, so
+        // a large result never sits in memory twice
         debug!("Sending {} rows", rows.len());
-        const BATCH_SIZE_THRESHOLD: usize = 100; // Process in batches for large result sets
-        const MAX_BATCH_MEMORY: usize = 8 * 1024 * 1024; // 8MB batch limit
-
-        if rows.len() > BATCH_SIZE_THRESHOLD {
-            // Large result set - send in optimized batches
-            debug!("Large result set detected, using batch processing");
-            let mut batch_start = 0;
-
-            while batch_start < rows.len() {
-                let mut batch_size = 0;
-                let mut batch_memory = 0;
-
-                // Calculate optimal batch size based on memory usage
-                for (_i, row) in rows.iter().enumerate().skip(batch_start) {
-                    let estimated_row_size: usize = row
-                        .iter()
-                        .map(|v| if *v == "NULL" { 1 } else { v.len() + 5 }) // +5 for length encoding overhead
-                        .sum();
-
-                    if batch_memory + estimated_row_size > MAX_BATCH_MEMORY && batch_size > 0 {
-                        break;
-                    }
-
-                    batch_memory += estimated_row_size;
-                    batch_size += 1;
-
-                    if batch_size >= BATCH_SIZE_THRESHOLD {
-                        break;
-                    }
-                }
-
-                let batch_end = std::cmp::min(batch_start + batch_size, rows.len());
-                debug!(
-                    "Processing batch: rows {}-{} ({} rows, ~{} bytes)",
-                    batch_start,
-                    batch_end - 1,
-                    batch_end - batch_start,
-                    batch_memory
-                );
-
-                // Send this batch
-                for (idx, row) in rows[batch_start..batch_end].iter().enumerate() {
-                    let global_idx = batch_start + idx;
-                    debug!("Sending row {} with {} values", global_idx, row.len());
-                    let mut row_packet = BytesMut::new();
-                    for (col_idx, value) in row.iter().enumerate() {
-                        if *value == "NULL" {
-                            debug!("  Column {}: NULL", col_idx);
-                            row_packet.put_u8(0xfb); // NULL value
-                        } else {
-                            let bytes = value.as_bytes();
-                            debug!("  Column {}: '{}' ({} bytes)", col_idx, value, bytes.len());
-                            // MySQL uses length-encoded strings for result rows
-                            if bytes.len() < 251 {
-                                row_packet.put_u8(bytes.len() as u8);
-                            } else if bytes.len() < 65536 {
-                                row_packet.put_u8(0xfc);
-                                row_packet.put_u16_le(bytes.len() as u16);
-                            } else if bytes.len() < 16777216 {
-                                row_packet.put_u8(0xfd);
-                                row_packet.put_u8((bytes.len() & 0xff) as u8);
-                                row_packet.put_u8(((bytes.len() >> 8) & 0xff) as u8);
-                                row_packet.put_u8(((bytes.len() >> 16) & 0xff) as u8);
-                            } else {
-                                row_packet.put_u8(0xfe);
-                                row_packet.put_u64_le(bytes.len() as u64);
-                            }
-                            row_packet.put_slice(bytes);
-                        }
-                    }
-                    debug!("Row packet size: {} bytes", row_packet.len());
-                    self.write_packet(stream, state, &row_packet).await?;
+        let mut out = ResultWriter::new(stream, OutputLimits::from_config(&self.config));
+        for (idx, row) in rows.iter().enumerate() {
+            debug!("Sending row {} with {} values", idx, row.len());
+            let mut row_packet = BytesMut::new();
+            for (col_idx, value) in row.iter().enumerate() {
+                if *value == Value::Null {
+                    debug!("  Column {}: NULL", col_idx);
+                    row_packet.put_u8(0xfb); // NULL value
+                } else if let (true, Ok(bytes)) = (binary[col_idx], bytea::bytes(value)) {
+                    debug!("  Column {}: {} binary bytes", col_idx, bytes.len());
+                    put_lenenc_int(&mut row_packet, bytes.len() as u64);
+                    row_packet.put_slice(&bytes);
+                } else {
+                    let text = match value {
+                        Value::Boolean(b) => booleans::mysql_text(*b).to_string(),
+                        Value::Timestamp(at) => clock::format_timestamp(*at),
+                        value => value.to_string(),
+                    };
+                    let bytes = text.as_bytes();
+                    debug!("  Column {}: '{}' ({} bytes)", col_idx, text, bytes.len());
+                    // MySQL uses length-encoded strings for result rows
+                    put_lenenc_int(&mut row_packet, bytes.len() as u64);
+                    row_packet.put_slice(bytes);
                 }
-
-                batch_start = batch_end;
-            }
-        } else {
-            // Small result set - use original direct sending
-            for (idx, row) in rows.iter().enumerate() {
-                debug!("Sending row {} with {} values", idx, row.len());
-                let mut row_packet = BytesMut::new();
-                for (col_idx, value) in row.iter().enumerate() {
-                    if *value == "NULL" {
-                        debug!("  Column {}: NULL", col_idx);
-                        row_packet.put_u8(0xfb); // NULL value
-                    } else {
-                        let bytes = value.as_bytes();
-                        debug!("  Column {}: '{}' ({} bytes)", col_idx, value, bytes.len());
-                        // MySQL uses length-encoded strings for result rows
-                        if bytes.len() < 251 {
-                            row_packet.put_u8(bytes.len() as u8);
-                        } else if bytes.len() < 65536 {
-                            row_packet.put_u8(0xfc);
-                            row_packet.put_u16_le(bytes.len() as u16);
-                        } else if bytes.len() < 16777216 {
-                            row_packet.put_u8(0xfd);
-                            row_packet.put_u8((bytes.len() & 0xff) as u8);
-                            row_packet.put_u8(((bytes.len() >> 8) & 0xff) as u8);
-                            row_packet.put_u8(((bytes.len() >> 16) & 0xff) as u8);
-                        } else {
-                            row_packet.put_u8(0xfe);
-                            row_packet.put_u64_le(bytes.len() as u64);
-                        }
-                        row_packet.put_slice(bytes);
-                    }
-                }
-                debug!("Row packet size: {} bytes", row_packet.len());
-                self.write_packet(stream, state, &row_packet).await?;
             }
+            debug!("Row packet size: {} bytes", row_packet.len());
+            let mut packet = BytesMut::new();
+            frame_packet(&mut packet, state, &row_packet);
+            out.push(&packet).await?;
         }
+        out.flush().await?;
 
         // Send EOF packet after rows
         debug!("Sending final EOF packet");
         let mut eof_packet = BytesMut::new();
         eof_packet.put_u8(0xfe); // EOF marker
         eof_packet.put_u16_le(0); // warnings
-        eof_packet.put_u16_le(SERVER_STATUS_AUTOCOMMIT); // status flags
+        eof_packet.put_u16_le(state.status_flags()); // status flags
         self.write_packet(stream, state, &eof_packet).await
     }
 
@@ -785,7 +1064,7 @@ impl MySqlProtocol {
         stream: &mut TcpStream,
         state: &mut ConnectionState,
         affected_rows: u64,
-        _info: u64,
+        last_insert_id: u64,
     ) -> crate::Result<()> {
         let mut packet = BytesMut::new();
 
@@ -796,10 +1075,10 @@ impl MySqlProtocol {
         put_lenenc_int(&mut packet, affected_rows);
 
         // Last insert ID
-        put_lenenc_int(&mut packet, 0);
+        put_lenenc_int(&mut packet, last_insert_id);
 
         // Status flags
-        packet.put_u16_le(SERVER_STATUS_AUTOCOMMIT);
+        packet.put_u16_le(state.status_flags());
 
         // Warnings
         packet.put_u16_le(0);
@@ -841,78 +1120,9 @@ impl MySqlProtocol {
         state: &mut ConnectionState,
         payload: &[u8],
     ) -> crate::Result<()> {
-        const MAX_PACKET_SIZE: usize = 0xffffff; // 16MB - 1 (maximum MySQL packet size)
-
-        if payload.len() <= MAX_PACKET_SIZE {
-            // Single packet - original logic
-            let mut packet = BytesMut::with_capacity(4 + payload.len());
-
-            // Length (3 bytes)
-            packet.put_u8((payload.len() & 0xff) as u8);
-            packet.put_u8(((payload.len() >> 8) & 0xff) as u8);
-            packet.put_u8(((payload.len() >> 16) & 0xff) as u8);
-
-            // Sequence ID
-            packet.put_u8(state.sequence_id);
-
-            debug!(
-                "Writing single packet: len={}, seq={}, first_bytes={:?}",
-                payload.len(),
-                state.sequence_id,
-                &payload[..std::cmp::min(20, payload.len())]
-            );
-
-            state.sequence_id = state.sequence_id.wrapping_add(1);
-
-            // Payload
-            packet.put_slice(payload);
-
-            stream.write_all(&packet).await?;
-            stream.flush().await?;
-        } else {
-            // Large payload - split into multiple packets
-            debug!(
-                "Splitting large payload: total_len={}, max_packet_size={}",
-                payload.len(),
-                MAX_PACKET_SIZE
-            );
-
-            let mut offset = 0;
-            while offset < payload.len() {
-                let chunk_size = std::cmp::min(MAX_PACKET_SIZE, payload.len() - offset);
-                let chunk = &payload[offset..offset + chunk_size];
-
-                let mut packet = BytesMut::with_capacity(4 + chunk_size);
-
-                // Length (3 bytes)
-                packet.put_u8((chunk_size & 0xff) as u8);
-                packet.put_u8(((chunk_size >> 8) & 0xff) as u8);
-                packet.put_u8(((chunk_size >> 16) & 0xff) as u8);
-
-                // Sequence ID
-                packet.put_u8(state.sequence_id);
-
-                debug!(
-                    "Writing packet chunk: len={}, seq={}, offset={}, total_remaining={}",
-                    chunk_size,
-                    state.sequence_id,
-                    offset,
-                    payload.len() - offset
-                );
-
-                state.sequence_id = state.sequence_id.wrapping_add(1);
-
-                // Payload chunk
-                packet.put_slice(chunk);
-
-                stream.write_all(&packet).await?;
-                stream.flush().await?;
-
-                offset += chunk_size;
-            }
-        }
-
-        Ok(())
+        let mut packet = BytesMut::with_capacity(4 + payload.len());
+        frame_packet(&mut packet, state, payload);
+        send(stream, &packet, self.config.slow_client_timeout).await
     }
 
     async fn read_packet(
@@ -933,6 +1143,29 @@ impl MySqlProtocol {
     }
 }
 
+/// The session `sql_mode` a `SET` gives, as a quoted list of modes or
+/// `DEFAULT`; a `SET GLOBAL` leaves the session's as it is
+fn sql_mode_setting(query: &str) -> Option<String> {
+    use once_cell::sync::Lazy;
+    use regex::Regex;
+
+    static SQL_MODE_RE: Lazy<Result<Regex, regex::Error>> = Lazy::new(|| {
+        Regex::new(
+            r#"(?i)^\s*SET\s+(?:.*,\s*)?(GLOBAL\s+|PERSIST\s+|@@GLOBAL\.|@@PERSIST\.)?(?:SESSION\s+|LOCAL\s+|@@SESSION\.|@@LOCAL\.|@@)?sql_mode\s*:?=\s*(?:'([^']*)'|"([^"]*)"|(DEFAULT)\b)"#,
+        )
+    });
+
+    let caps = SQL_MODE_RE.as_ref().ok()?.captures(query)?;
+    if caps.get(1).is_some() {
+        return None;
+    }
+    match (caps.get(2).or(caps.get(3)), caps.get(4)) {
+        (Some(modes), _) => Some(modes.as_str().to_uppercase()),
+        (None, Some(_)) => Some(DEFAULT_SQL_MODE.to_string()),
+        (None, None) => None,
+    }
+}
+
 fn generate_auth_data() -> Vec<u8> {
     use rand::Rng;
     let mut rng = rand::thread_rng();
@@ -970,6 +1203,51 @@ fn compute_auth_response(password: &str, auth_data: &[u8]) -> Vec<u8> {
         .collect()
 }
 
+/// Append `payload` to `buf` as the next packets of the connection: one
+/// packet, or several when it exceeds the maximum MySQL packet size
+fn frame_packet(buf: &mut BytesMut, state: &mut ConnectionState, payload: &[u8]) {
+    const MAX_PACKET_SIZE: usize = 0xffffff; // 16MB - 1 (maximum MySQL packet size)
+
+    if payload.len() > MAX_PACKET_SIZE {
+        debug!(
+            "Splitting large payload: total_len={}, max_packet_size={}",
+            payload.len(),
+            MAX_PACKET_SIZE
+        );
+    }
+    let mut offset = 0;
+    loop {
+        let chunk_size = std::cmp::min(MAX_PACKET_SIZE, payload.len() - offset);
+        let chunk = &payload[offset..offset + chunk_size];
+
+        // Length (3 bytes)
+        buf.put_u8((chunk_size & 0xff) as u8);
+        buf.put_u8(((chunk_size >> 8) & 0xff) as u8);
+        buf.put_u8(((chunk_size >> 16) & 0xff) as u8);
+
+        // Sequence ID
+        buf.put_u8(state.sequence_id);
+
+        debug!(
+            "Writing packet: len={}, seq={}, first_bytes={:?}",
+            chunk_size,
+            state.sequence_id,
+            &chunk[..std::cmp::min(20, chunk_size)]
+        );
+
+        state.sequence_id = state.sequence_id.wrapping_add(1);
+
+        // Payload
+        buf.put_slice(chunk);
+
+        // A payload of an exact multiple of the maximum ends with an empty packet
+        offset += chunk_size;
+        if chunk_size < MAX_PACKET_SIZE {
+            break;
+        }
+    }
+}
+
 fn put_lenenc_int(buf: &mut BytesMut, value: u64) {
     if value < 251 {
         buf.put_u8(value as u8);
@@ -986,3 +1264,63 @@ fn put_lenenc_int(buf: &mut BytesMut, value: u64) {
         buf.put_u64_le(value);
     }
 }
+
+/// How a column definition describes a result column's type
+struct ColumnType {
+    charset: u16,
+    length: u32,
+    type_code: u8,
+    flags: u16,
+    decimals: u8,
+}
+
+/// The MySQL type a column of `sql_type` is sent as, which drivers such as
+/// PyMySQL convert its values by; types MySQL has no match for are text
+fn column_type(sql_type: &SqlType) -> ColumnType {
+    let number = |length: u32, type_code: u8, decimals: u8| ColumnType {
+        charset: BINARY_CHARSET,
+        length,
+        type_code,
+        flags: NUM_FLAG,
+        decimals,
+    };
+    let temporal = |length: u32, type_code: u8| ColumnType {
+        charset: BINARY_CHARSET,
+        length,
+        type_code,
+        flags: BINARY_FLAG,
+        decimals: 0,
+    };
+    match sql_type {
+        // Booleans are TINYINT(1), as in MySQL
+        SqlType::Boolean => number(1, MYSQL_TYPE_TINY, 0),
+        SqlType::Integer => number(11, MYSQL_TYPE_LONG, 0),
+        SqlType::BigInt => number(20, MYSQL_TYPE_LONGLONG, 0),
+        SqlType::Float => number(12, MYSQL_TYPE_FLOAT, NOT_FIXED_DEC),
+        SqlType::Double => number(22, MYSQL_TYPE_DOUBLE, NOT_FIXED_DEC),
+        // The length counts the sign and the point
+        SqlType::Decimal(precision, scale) => {
+            number(*precision + 2, MYSQL_TYPE_NEWDECIMAL, *scale as u8)
+        }
+        SqlType::Money(currency) => number(20, MYSQL_TYPE_NEWDECIMAL, currency.minor_units as u8),
+        SqlType::Date => temporal(10, MYSQL_TYPE_DATE),
+        SqlType::Time => temporal(10, MYSQL_TYPE_TIME),
+        SqlType::Timestamp | SqlType::TimestampTz => temporal(19, MYSQL_TYPE_DATETIME),
+        // Binary strings are LONGBLOBs, of bytes rather than text
+        SqlType::Bytea => ColumnType {
+            charset: BINARY_CHARSET,
+            length: u32::MAX,
+            type_code: MYSQL_TYPE_BLOB,
+            flags: BLOB_FLAG | BINARY_FLAG,
+            decimals: 0,
+        },
+        _ => ColumnType {
+            // utf8mb4
+            charset: 33,
+            length: 255,
+            type_code: MYSQL_TYPE_VAR_STRING,
+            flags: 0,
+            decimals: 0,
+        },
+    }
+}
@@ -8,14 +8,41 @@ use tracing::{debug, info};
 use crate::YamlBaseError;
 use crate::config::Config;
 use crate::database::{Storage, Value};
-use crate::protocol::postgres_extended::ExtendedProtocol;
-use crate::sql::{QueryExecutor, parse_sql};
+use crate::protocol::auth::AuthBackends;
+use crate::protocol::connection::{OutputLimits, ResultWriter, unless_disconnected};
+use crate::protocol::postgres_extended::{
+    ExtendedProtocol, executor_error, put_field_type, send_notice_response, send_parameter_status,
+    text_value,
+};
+use crate::protocol::postgres_session::{
+    Completion, Session, SessionCommand, SqlError, parse_session_command,
+};
+use crate::server::{QuotaExceeded, SessionSlot};
+use crate::sql::copy::{self, BulkLoad};
+use crate::sql::literals::{self, Escapes};
+use crate::sql::{QueryExecutor, coercion, identifiers, split_statements};
+use crate::yaml::schema::SqlType;
+
+/// Largest frontend message accepted, as in PostgreSQL itself
+const MAX_MESSAGE_LENGTH: usize = 1 << 30;
+/// Startup packets only carry a handful of parameters
+const MAX_STARTUP_LENGTH: usize = 10_000;
 
 pub struct PostgresProtocol {
     config: Arc<Config>,
     executor: QueryExecutor,
     _database_name: String,
     extended_protocol: ExtendedProtocol,
+    session: Session,
+    auth_backends: AuthBackends,
+    /// The connection's place among the open sessions, once logged in
+    slot: Option<SessionSlot>,
+}
+
+/// One statement of a simple query
+enum QueryStatement {
+    Session(SessionCommand),
+    Sql(sqlparser::ast::Statement),
 }
 
 #[derive(Debug, Default)]
@@ -29,11 +56,19 @@ struct ConnectionState {
 impl PostgresProtocol {
     pub async fn new(config: Arc<Config>, storage: Arc<Storage>) -> crate::Result<Self> {
         let executor = QueryExecutor::new(storage).await?;
+        let extended_protocol =
+            ExtendedProtocol::with_statement_limit(config.max_prepared_statements)
+                .with_output(OutputLimits::from_config(&config))
+                .with_identifier_limit(config.identifier_limit());
+        let auth_backends = AuthBackends::from_config(&config)?;
         Ok(Self {
             config,
             executor,
             _database_name: String::new(), // Will be set later if needed
-            extended_protocol: ExtendedProtocol::new(),
+            extended_protocol,
+            session: Session::default(),
+            auth_backends,
+            slot: None,
         })
     }
 
@@ -67,6 +102,12 @@ impl PostgresProtocol {
 
             let msg_type = buffer[0];
             let length = u32::from_be_bytes([buffer[1], buffer[2], buffer[3], buffer[4]]) as usize;
+            // The length counts itself; anything shorter or absurdly large is a broken client
+            if !(4..=MAX_MESSAGE_LENGTH).contains(&length) {
+                let message = format!("Invalid message length {}", length);
+                self.send_error(&mut stream, "08P01", &message).await?;
+                return Err(YamlBaseError::Protocol(message));
+            }
 
             // Check if we have the complete message
             if buffer.len() < length + 1 {
@@ -79,15 +120,28 @@ impl PostgresProtocol {
 
             // Process message
             match msg_type {
+                b'P' | b'B' | b'D' | b'E' | b'C' if self.extended_protocol.is_failed() => {
+                    debug!(
+                        "Skipping message {} after an error, until Sync",
+                        msg_type as char
+                    );
+                }
                 b'Q' => {
-                    // Simple query
+                    // Simple query; a COPY FROM STDIN in it reads the messages after it
                     let query = self.parse_query(&buffer[5..length + 1])?;
-                    self.handle_query(&mut stream, &query).await?;
+                    buffer.advance(length + 1);
+                    self.handle_query(&mut stream, &mut buffer, &query).await?;
+                    continue;
                 }
                 b'P' => {
                     // Parse (extended query protocol)
                     self.extended_protocol
-                        .handle_parse(&mut stream, &buffer[5..length + 1])
+                        .handle_parse(
+                            &mut stream,
+                            &buffer[5..length + 1],
+                            &self.session,
+                            &self.executor,
+                        )
                         .await?;
                 }
                 b'B' => {
@@ -99,27 +153,38 @@ impl PostgresProtocol {
                 b'D' => {
                     // Describe (extended query protocol)
                     self.extended_protocol
-                        .handle_describe(&mut stream, &buffer[5..length + 1], &self.executor)
+                        .handle_describe(
+                            &mut stream,
+                            &buffer[5..length + 1],
+                            &self.executor,
+                            &mut self.session,
+                        )
                         .await?;
                 }
                 b'E' => {
                     // Execute (extended query protocol)
                     self.extended_protocol
-                        .handle_execute(&mut stream, &buffer[5..length + 1], &self.executor)
+                        .handle_execute(
+                            &mut stream,
+                            &buffer[5..length + 1],
+                            &self.executor,
+                            &mut self.session,
+                        )
                         .await?;
                 }
                 b'S' => {
                     // Sync (extended query protocol)
-                    self.extended_protocol.handle_sync(&mut stream).await?;
+                    self.extended_protocol
+                        .handle_sync(&mut stream, self.session.status())
+                        .await?;
                 }
                 b'C' => {
                     // Close (extended query protocol)
-                    let close_type = buffer[5];
-                    let name_end = buffer[6..length + 1]
-                        .iter()
-                        .position(|&b| b == 0)
-                        .unwrap_or(length - 5);
-                    let name = std::str::from_utf8(&buffer[6..6 + name_end]).map_err(|_| {
+                    let Some((&close_type, rest)) = buffer[5..length + 1].split_first() else {
+                        return Err(YamlBaseError::Protocol("Empty close message".to_string()));
+                    };
+                    let name_end = rest.iter().position(|&b| b == 0).unwrap_or(rest.len());
+                    let name = std::str::from_utf8(&rest[..name_end]).map_err(|_| {
                         YamlBaseError::Protocol("Invalid UTF-8 in close name".to_string())
                     })?;
 
@@ -155,21 +220,13 @@ impl PostgresProtocol {
     }
 
     async fn read_startup_message(
-        &self,
+        &mut self,
         stream: &mut TcpStream,
         buffer: &mut BytesMut,
         state: &mut ConnectionState,
     ) -> crate::Result<()> {
         // Read startup packet
-        stream.read_buf(buffer).await?;
-
-        if buffer.len() < 8 {
-            return Err(YamlBaseError::Protocol(
-                "Invalid startup packet".to_string(),
-            ));
-        }
-
-        let mut length = u32::from_be_bytes([buffer[0], buffer[1], buffer[2], buffer[3]]) as usize;
+        let mut length = read_startup_packet(stream, buffer).await?;
         let version = u32::from_be_bytes([buffer[4], buffer[5], buffer[6], buffer[7]]);
 
         // Check for SSL request
@@ -177,33 +234,13 @@ impl PostgresProtocol {
             // SSL request - we don't support it
             stream.write_all(b"N").await?;
             buffer.clear();
-            stream.read_buf(buffer).await?;
 
             // Re-read the actual startup message
-            length = u32::from_be_bytes([buffer[0], buffer[1], buffer[2], buffer[3]]) as usize;
+            length = read_startup_packet(stream, buffer).await?;
         }
 
         // Parse startup parameters
-        let mut pos = 8;
-        while pos < length - 1 {
-            let key_start = pos;
-            while pos < buffer.len() && buffer[pos] != 0 {
-                pos += 1;
-            }
-            let key = std::str::from_utf8(&buffer[key_start..pos])
-                .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in startup".to_string()))?
-                .to_string();
-            pos += 1;
-
-            let val_start = pos;
-            while pos < buffer.len() && buffer[pos] != 0 {
-                pos += 1;
-            }
-            let val = std::str::from_utf8(&buffer[val_start..pos])
-                .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in startup".to_string()))?
-                .to_string();
-            pos += 1;
-
+        for (key, val) in parse_startup_parameters(&buffer[..length])? {
             match key.as_str() {
                 "user" => state.username = Some(val.clone()),
                 "database" => state.database = Some(val.clone()),
@@ -211,6 +248,8 @@ impl PostgresProtocol {
             }
             state.parameters.insert(key, val);
         }
+        // Parameters such as application_name, which poolers pass through
+        self.session = Session::new(&state.parameters, &self.config.timezone);
 
         // Send authentication request
         self.send_auth_request(stream).await?;
@@ -222,7 +261,11 @@ impl PostgresProtocol {
         if buffer.len() >= 5 && buffer[0] == b'p' {
             // Password message
             let msg_len = u32::from_be_bytes([buffer[1], buffer[2], buffer[3], buffer[4]]) as usize;
-            let password = self.parse_password_message(&buffer[5..5 + msg_len - 4])?;
+            let body = msg_len
+                .checked_sub(4)
+                .and_then(|body_len| buffer.get(5..5 + body_len))
+                .ok_or_else(|| YamlBaseError::Protocol("Invalid password message".to_string()))?;
+            let password = self.parse_password_message(body)?;
 
             // Verify credentials
             debug!(
@@ -234,11 +277,38 @@ impl PostgresProtocol {
                 self.config.allow_anonymous
             );
 
-            if self.config.allow_anonymous
-                || (state.username.as_deref() == Some(&self.config.username)
-                    && password == self.config.password)
-            {
+            // The configured user and the tenants, then any directory
+            let password_login = match state.username.as_deref() {
+                Some(user) if user == self.config.username => password == self.config.password,
+                Some(user) => {
+                    let tenant_password = self
+                        .executor
+                        .storage()
+                        .database()
+                        .read()
+                        .await
+                        .tenant_password(user)
+                        .map(str::to_string);
+                    match tenant_password {
+                        Some(expected) => expected == password,
+                        None => self.auth_backends.verify(user, &password).await,
+                    }
+                }
+                None => false,
+            };
+            if self.config.allow_anonymous || password_login {
                 state.authenticated = true;
+                if let Some(user) = &state.username {
+                    self.executor.set_user(user);
+                }
+                match self.open_session(stream, state).await {
+                    Ok(slot) => self.slot = Some(slot),
+                    Err(quota) => {
+                        let message = quota.to_string();
+                        self.send_error(stream, "53300", &message).await?;
+                        return Err(YamlBaseError::Protocol(message));
+                    }
+                }
                 self.send_auth_ok(stream, state).await?;
 
                 // Clear the buffer after processing password message
@@ -257,6 +327,27 @@ impl PostgresProtocol {
         Ok(())
     }
 
+    /// Open the logged-in connection's session, unless its user or database
+    /// already has as many as the connection quotas allow
+    async fn open_session(
+        &self,
+        stream: &TcpStream,
+        state: &ConnectionState,
+    ) -> Result<SessionSlot, QuotaExceeded> {
+        let storage = self.executor.storage();
+        let database = match &state.database {
+            Some(database) => database.clone(),
+            None => storage.database().read().await.name.clone(),
+        };
+        storage.sessions().open(
+            state.username.as_deref().unwrap_or_default(),
+            &database,
+            stream.peer_addr().ok().map(|addr| addr.ip().to_string()),
+            self.session.get("application_name").unwrap_or_default(),
+            storage.clock().now(),
+        )
+    }
+
     async fn send_auth_request(&self, stream: &mut TcpStream) -> crate::Result<()> {
         // Request clear text password authentication
         let mut buf = BytesMut::new();
@@ -284,21 +375,14 @@ impl PostgresProtocol {
         buf.clear();
         buf.put_u8(b'K');
         buf.put_u32(12);
-        buf.put_u32(12345); // Process ID
+        buf.put_u32(self.slot.as_ref().map_or(0, SessionSlot::pid)); // Process ID
         buf.put_u32(67890); // Secret key
         stream.write_all(&buf).await?;
 
         // Send parameter status messages
-        self.send_parameter_status(stream, "server_version", "14.0")
-            .await?;
-        self.send_parameter_status(stream, "server_encoding", "UTF8")
-            .await?;
-        self.send_parameter_status(stream, "client_encoding", "UTF8")
-            .await?;
-        self.send_parameter_status(stream, "DateStyle", "ISO, MDY")
-            .await?;
-        self.send_parameter_status(stream, "TimeZone", "UTC")
-            .await?;
+        for (name, value) in self.session.reported() {
+            send_parameter_status(stream, name, &value).await?;
+        }
 
         // Ready for query
         self.send_ready_for_query(stream).await?;
@@ -306,69 +390,217 @@ impl PostgresProtocol {
         Ok(())
     }
 
-    async fn send_parameter_status(
-        &self,
-        stream: &mut TcpStream,
-        name: &str,
-        value: &str,
-    ) -> crate::Result<()> {
-        let mut buf = BytesMut::new();
-        buf.put_u8(b'S');
-        let length = 4 + name.len() + 1 + value.len() + 1;
-        buf.put_u32(length as u32);
-        buf.put_slice(name.as_bytes());
-        buf.put_u8(0);
-        buf.put_slice(value.as_bytes());
-        buf.put_u8(0);
-
-        stream.write_all(&buf).await?;
-        Ok(())
-    }
-
     async fn send_ready_for_query(&self, stream: &mut TcpStream) -> crate::Result<()> {
         let mut buf = BytesMut::new();
         buf.put_u8(b'Z');
         buf.put_u32(5);
-        buf.put_u8(b'I'); // Idle
+        buf.put_u8(self.session.status().indicator());
 
         stream.write_all(&buf).await?;
         Ok(())
     }
 
-    async fn handle_query(&self, stream: &mut TcpStream, query: &str) -> crate::Result<()> {
+    async fn handle_query(
+        &mut self,
+        stream: &mut TcpStream,
+        buffer: &mut BytesMut,
+        query: &str,
+    ) -> crate::Result<()> {
         debug!("Executing query: {}", query);
 
-        // Parse SQL
-        let statements = match parse_sql(query) {
-            Ok(stmts) => stmts,
-            Err(e) => {
-                self.send_error(stream, "42601", &format!("Syntax error: {}", e))
-                    .await?;
+        // Strings are read as the session's standard_conforming_strings
+        // says, and comments, hints and sqlcommenter trailers dropped
+        let escapes = Escapes::postgres(self.session.get("standard_conforming_strings"));
+        let query = literals::strip_comments(query, escapes);
+        let query = match literals::normalize(&query, escapes) {
+            Ok(query) => query,
+            Err(message) => {
+                self.session.finish(None, false);
+                self.send_error(stream, "22025", &message).await?;
                 self.send_ready_for_query(stream).await?;
                 return Ok(());
             }
         };
 
-        for statement in statements {
-            match self.executor.execute(&statement).await {
-                Ok(result) => {
-                    self.send_query_result(stream, &result).await?;
+        // Parse every statement before running any, as PostgreSQL does
+        let mut parsed = Vec::new();
+        for sql in split_statements(&query) {
+            // Long identifiers are cut as PostgreSQL reads them
+            let (sql, notices) = identifiers::truncate(sql, self.config.identifier_limit());
+            for notice in &notices {
+                send_notice_response(stream, notice).await?;
+            }
+            match parse_session_command(&sql) {
+                Some(command) => parsed.push(QueryStatement::Session(command)),
+                None => match copy::parse_statement(&sql) {
+                    Ok(stmts) => parsed.extend(stmts.into_iter().map(QueryStatement::Sql)),
+                    Err(e) => {
+                        self.session.finish(None, false);
+                        self.send_error(stream, "42601", &format!("Syntax error: {}", e))
+                            .await?;
+                        self.send_ready_for_query(stream).await?;
+                        return Ok(());
+                    }
+                },
+            }
+        }
+
+        if parsed.is_empty() {
+            // EmptyQueryResponse, which some poolers use as a cheap ping
+            let mut buf = BytesMut::new();
+            buf.put_u8(b'I');
+            buf.put_u32(4);
+            stream.write_all(&buf).await?;
+        }
+
+        for statement in parsed {
+            let outcome = match statement {
+                QueryStatement::Session(command) => self.run_session_command(command),
+                QueryStatement::Sql(statement) => match copy::plan_copy(&statement) {
+                    Some(load) => {
+                        self.copy_from_stdin(stream, buffer, &statement, load)
+                            .await?
+                    }
+                    None => {
+                        let running = self.extended_protocol.execute_statement(
+                            &statement,
+                            &mut self.session,
+                            &self.executor,
+                        );
+                        match unless_disconnected(stream, running).await {
+                            Some(outcome) => outcome,
+                            None => return Ok(()),
+                        }
+                    }
+                },
+            };
+            let failed = outcome.is_err();
+            match outcome {
+                Ok(completion) => {
+                    for (name, value) in &completion.reports {
+                        send_parameter_status(stream, name, value).await?;
+                    }
+                    match &completion.result {
+                        Some(result) => {
+                            self.send_query_result(stream, result, &completion.tag)
+                                .await?
+                        }
+                        None => self.send_command_complete(stream, &completion.tag).await?,
+                    }
                 }
-                Err(e) => {
-                    self.send_error(stream, "XX000", &e.to_string()).await?;
+                Err(error) => {
+                    self.send_error(stream, error.code, &error.message).await?;
                 }
             }
+            for notice in self.executor.take_notices() {
+                send_notice_response(stream, &notice).await?;
+            }
+            // An error skips the rest of the query string
+            if failed {
+                break;
+            }
         }
 
         self.send_ready_for_query(stream).await?;
         Ok(())
     }
 
+    /// Run `COPY ... FROM STDIN`: ask the client for the data, read it up to
+    /// CopyDone and load it. The outcome is the statement's, while the error
+    /// returned is the connection's.
+    async fn copy_from_stdin(
+        &mut self,
+        stream: &mut TcpStream,
+        buffer: &mut BytesMut,
+        statement: &sqlparser::ast::Statement,
+        load: crate::Result<BulkLoad>,
+    ) -> crate::Result<Result<Completion, SqlError>> {
+        if let Some(error) = self.session.rejects(Some(statement)) {
+            self.session.finish(Some(statement), false);
+            return Ok(Err(error));
+        }
+        let planned = match load {
+            Ok(load) => self
+                .executor
+                .copy_width(&load)
+                .await
+                .map(|width| (load, width)),
+            Err(e) => Err(e),
+        };
+        let (load, width) = match planned {
+            Ok(planned) => planned,
+            Err(e) => {
+                self.session.finish(Some(statement), false);
+                return Ok(Err(executor_error(e)));
+            }
+        };
+
+        // CopyInResponse: every column in text format
+        let mut buf = BytesMut::new();
+        buf.put_u8(b'G');
+        buf.put_u32(4 + 1 + 2 + 2 * width as u32);
+        buf.put_u8(0);
+        buf.put_u16(width as u16);
+        for _ in 0..width {
+            buf.put_u16(0);
+        }
+        stream.write_all(&buf).await?;
+
+        let outcome = match read_copy_data(stream, buffer).await? {
+            Ok(data) => match String::from_utf8(data) {
+                Ok(data) => match load.layout.records(&data) {
+                    Ok(records) => match self.executor.copy_in(&load, records).await {
+                        Ok(loaded) => Ok(Completion::tag(format!("COPY {}", loaded))),
+                        Err(e) => Err(SqlError::new("XX000", e.to_string())),
+                    },
+                    Err(e) => Err(SqlError::new("22P04", e.to_string())),
+                },
+                Err(_) => Err(SqlError::new(
+                    "22021",
+                    "invalid byte sequence for encoding \"UTF8\"",
+                )),
+            },
+            Err(message) => Err(SqlError::new(
+                "57014",
+                format!("COPY from stdin failed: {}", message),
+            )),
+        };
+        self.session.finish(Some(statement), outcome.is_ok());
+        Ok(outcome)
+    }
+
+    /// Run `RESET`, `LISTEN` or `UNLISTEN`, moving the transaction status on
+    /// as for any other statement
+    fn run_session_command(&mut self, command: SessionCommand) -> Result<Completion, SqlError> {
+        if let Some(error) = self.session.rejects(None) {
+            self.session.finish(None, false);
+            return Err(error);
+        }
+        if command.resets_executor() {
+            self.executor.reset_session();
+        }
+        let outcome = self.session.run(command);
+        self.session.finish(None, outcome.is_ok());
+        outcome
+    }
+
     async fn send_query_result(
         &self,
         stream: &mut TcpStream,
         result: &crate::sql::executor::QueryResult,
+        tag: &str,
     ) -> crate::Result<()> {
+        // Columns are described as their values read, so drivers that
+        // convert by type, as psycopg2 does, get numbers and dates back
+        let types: Vec<SqlType> = (0..result.columns.len())
+            .map(|i| {
+                coercion::described_type(
+                    result.column_types.get(i),
+                    result.rows.iter().filter_map(|row| row.get(i)),
+                )
+            })
+            .collect();
+
         // For empty results (like transaction commands), skip row description
         if !result.columns.is_empty() {
             // Send row description
@@ -389,13 +621,7 @@ impl PostgresProtocol {
                 buf.put_u8(0); // Null terminator
                 buf.put_u32(0); // Table OID
                 buf.put_u16(i as u16); // Column number
-
-                // For simple protocol, we always send text format, so declare as text
-                // to match the text data we send
-                buf.put_u32(25); // text OID
-
-                buf.put_i16(-1); // Type size
-                buf.put_i32(-1); // Type modifier
+                put_field_type(&mut buf, types.get(i));
                 buf.put_i16(0); // Format code (text)
             }
 
@@ -403,17 +629,24 @@ impl PostgresProtocol {
         }
 
         // Send data rows
+        let timezone = self.session.timezone();
+        let mut out = ResultWriter::new(stream, OutputLimits::from_config(&self.config));
         for row in &result.rows {
             let mut buf = BytesMut::new();
             buf.put_u8(b'D');
 
+            let texts: Vec<String> = row
+                .iter()
+                .enumerate()
+                .map(|(i, val)| text_value(val, types.get(i), timezone))
+                .collect();
+
             // Calculate row length
             let mut row_length = 6; // 4 bytes for length + 2 bytes for field count
-            for val in row {
+            for (val, val_str) in row.iter().zip(&texts) {
                 if matches!(val, Value::Null) {
                     row_length += 4; // Just 4 bytes for NULL (-1)
                 } else {
-                    let val_str = val.to_string();
                     row_length += 4 + val_str.len(); // 4 bytes for value length + value
                 }
             }
@@ -422,28 +655,25 @@ impl PostgresProtocol {
             buf.put_u16(row.len() as u16);
 
             // Send field values
-            for val in row {
+            for (val, val_str) in row.iter().zip(&texts) {
                 if matches!(val, Value::Null) {
                     buf.put_i32(-1); // NULL
                 } else {
-                    let val_str = val.to_string();
                     buf.put_i32(val_str.len() as i32);
                     buf.put_slice(val_str.as_bytes());
                 }
             }
 
-            stream.write_all(&buf).await?;
+            out.push(&buf).await?;
         }
+        out.flush().await?;
+
+        self.send_command_complete(stream, tag).await
+    }
 
-        // Send command complete
+    async fn send_command_complete(&self, stream: &mut TcpStream, tag: &str) -> crate::Result<()> {
         let mut buf = BytesMut::new();
         buf.put_u8(b'C');
-        let tag = if result.columns.is_empty() {
-            // For transaction commands, use appropriate command tag
-            "BEGIN".to_string() // This is generic - ideally we'd track the actual command
-        } else {
-            format!("SELECT {}", result.rows.len())
-        };
         buf.put_u32(4 + tag.len() as u32 + 1);
         buf.put_slice(tag.as_bytes());
         buf.put_u8(0);
@@ -496,3 +726,104 @@ impl PostgresProtocol {
             .to_string())
     }
 }
+
+/// Read one complete startup packet into `buffer`, returning its length
+/// Read the CopyData messages of a COPY FROM STDIN up to CopyDone, or the
+/// message of the client's CopyFail
+async fn read_copy_data(
+    stream: &mut TcpStream,
+    buffer: &mut BytesMut,
+) -> crate::Result<Result<Vec<u8>, String>> {
+    let mut data = Vec::new();
+    loop {
+        if buffer.len() >= 5 {
+            let length = u32::from_be_bytes([buffer[1], buffer[2], buffer[3], buffer[4]]) as usize;
+            if !(4..=MAX_MESSAGE_LENGTH).contains(&length) {
+                return Err(YamlBaseError::Protocol(format!(
+                    "Invalid message length {} during COPY",
+                    length
+                )));
+            }
+            if buffer.len() > length {
+                let message = buffer.split_to(length + 1);
+                let body = &message[5..];
+                match message[0] {
+                    b'd' => data.extend_from_slice(body),
+                    b'c' => return Ok(Ok(data)),
+                    b'f' => {
+                        let end = body.iter().position(|&b| b == 0).unwrap_or(body.len());
+                        return Ok(Err(String::from_utf8_lossy(&body[..end]).into_owned()));
+                    }
+                    // Flush and Sync mean nothing while copying
+                    b'H' | b'S' => {}
+                    other => {
+                        return Err(YamlBaseError::Protocol(format!(
+                            "Unexpected message {} during COPY",
+                            other as char
+                        )));
+                    }
+                }
+                continue;
+            }
+        }
+        if stream.read_buf(buffer).await? == 0 {
+            return Err(YamlBaseError::Protocol(
+                "Client disconnected during COPY".to_string(),
+            ));
+        }
+    }
+}
+
+pub(crate) async fn read_startup_packet(
+    stream: &mut TcpStream,
+    buffer: &mut BytesMut,
+) -> crate::Result<usize> {
+    loop {
+        if buffer.len() >= 4 {
+            let length = u32::from_be_bytes([buffer[0], buffer[1], buffer[2], buffer[3]]) as usize;
+            if !(8..=MAX_STARTUP_LENGTH).contains(&length) {
+                return Err(YamlBaseError::Protocol(
+                    "Invalid startup packet".to_string(),
+                ));
+            }
+            if buffer.len() >= length {
+                return Ok(length);
+            }
+        }
+        if stream.read_buf(buffer).await? == 0 {
+            return Err(YamlBaseError::Protocol(
+                "Invalid startup packet".to_string(),
+            ));
+        }
+    }
+}
+
+/// The `key=value` parameters of a startup packet of `packet.len()` bytes,
+/// such as `user` and `database`
+pub(crate) fn parse_startup_parameters(packet: &[u8]) -> crate::Result<Vec<(String, String)>> {
+    let end = packet.len() - 1;
+    let mut pos = 8;
+    let mut parameters = Vec::new();
+    while pos < end {
+        let key_start = pos;
+        while pos < end && packet[pos] != 0 {
+            pos += 1;
+        }
+        let key = std::str::from_utf8(&packet[key_start..pos])
+            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in startup".to_string()))?
+            .to_string();
+        pos += 1;
+
+        let val_start = pos;
+        while pos < end && packet[pos] != 0 {
+            pos += 1;
+        }
+        let val = std::str::from_utf8(&packet[val_start..pos])
+            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in startup".to_string()))?
+            .to_string();
+        pos += 1;
+
+        parameters.push((key, val));
+    }
+    Ok(parameters)
+}
@@ -1,16 +1,26 @@
 use bytes::{BufMut, BytesMut};
+use chrono::{FixedOffset, NaiveDate, NaiveDateTime, NaiveTime};
+use rust_decimal::Decimal;
+use rust_decimal::prelude::ToPrimitive;
 use std::collections::HashMap;
 use tokio::io::AsyncWriteExt;
 use tokio::net::TcpStream;
 use tracing::debug;
 
 use crate::YamlBaseError;
-use crate::database::Value;
-use crate::sql::executor::QueryResult;
-use crate::sql::{QueryExecutor, parse_sql};
+use crate::database::{Database, Value, clock, timezone};
+use crate::protocol::connection::{OutputLimits, ResultWriter, unless_disconnected};
+use crate::protocol::postgres_session::{
+    Completion, CursorDeclaration, Session, SqlError, TransactionStatus,
+};
+use crate::protocol::prepared_statements::{DEFAULT_MAX_PREPARED_STATEMENTS, PreparedStatements};
+use crate::sql::executor::{QueryResult, value_to_sql_expr};
+use crate::sql::literals::{self, Escapes};
+use crate::sql::{QueryExecutor, array, booleans, bytea, catalog, enums, identifiers, parse_sql};
 use crate::yaml::schema::SqlType;
 use sqlparser::ast::{
-    Expr, FunctionArg, FunctionArgExpr, FunctionArguments, SelectItem, Statement, Value as SqlValue,
+    DiscardObject, Expr, FunctionArg, FunctionArgExpr, FunctionArguments, Insert, SelectItem,
+    Statement, Value as SqlValue,
 };
 
 #[derive(Debug, Clone)]
@@ -18,29 +28,200 @@ pub struct PreparedStatement {
     pub name: String,
     pub query: String,
     pub parameter_types: Vec<SqlType>,
+    /// The type OIDs the client sent with Parse, 0 where it left one out
+    pub parameter_oids: Vec<u32>,
     pub parsed_statements: Vec<sqlparser::ast::Statement>,
+    /// The column types a Describe of the statement gave the client, which
+    /// it decodes the binary results of its portals by
+    pub result_types: Option<Vec<SqlType>>,
 }
 
-#[derive(Debug, Clone)]
+#[derive(Debug)]
 pub struct Portal {
     pub name: String,
     pub statement: PreparedStatement,
     pub parameters: Vec<Value>,
     pub result_formats: Vec<u16>,
+    /// The column types the client was told, by a Describe of the portal or
+    /// of its statement
+    pub result_types: Option<Vec<SqlType>>,
+    /// What running the statement gave, once a Describe or Execute ran it
+    pub run: Option<PortalRun>,
+}
+
+/// A portal's statement once run; Executes with a row limit send its rows a
+/// batch at a time, and each row is dropped once sent, so a client fetching
+/// a large table in batches never has the server hold it twice
+#[derive(Debug)]
+pub struct PortalRun {
+    /// The statement's completion, its result without the rows
+    pub completion: Completion,
+    /// Rows still to be sent
+    pub rows: std::vec::IntoIter<Vec<Value>>,
+    /// Rows already sent
+    pub sent: usize,
+}
+
+impl PortalRun {
+    pub fn new(mut completion: Completion) -> Self {
+        let rows = completion
+            .result
+            .as_mut()
+            .map(|result| std::mem::take(&mut result.rows))
+            .unwrap_or_default();
+        Self {
+            completion,
+            rows: rows.into_iter(),
+            sent: 0,
+        }
+    }
 }
 
 pub struct ExtendedProtocol {
-    pub prepared_statements: HashMap<String, PreparedStatement>,
+    pub prepared_statements: PreparedStatements,
     pub portals: HashMap<String, Portal>,
+    /// Set when a message of the current batch failed; as in PostgreSQL, the
+    /// rest of the batch is skipped up to the next Sync
+    failed: bool,
+    output: OutputLimits,
+    /// Identifiers longer than this many bytes are cut to it
+    identifier_limit: usize,
 }
 
 impl ExtendedProtocol {
     pub fn new() -> Self {
+        Self::with_statement_limit(DEFAULT_MAX_PREPARED_STATEMENTS)
+    }
+
+    /// A connection keeping at most `max_statements` named prepared statements
+    pub fn with_statement_limit(max_statements: usize) -> Self {
         Self {
-            prepared_statements: HashMap::new(),
+            prepared_statements: PreparedStatements::new(max_statements),
             portals: HashMap::new(),
+            failed: false,
+            output: OutputLimits::default(),
+            identifier_limit: identifiers::POSTGRES_MAX_IDENTIFIER_LENGTH,
+        }
+    }
+
+    /// The same, writing results within `output`
+    pub(crate) fn with_output(mut self, output: OutputLimits) -> Self {
+        self.output = output;
+        self
+    }
+
+    /// The same, cutting identifiers longer than `limit` bytes
+    pub(crate) fn with_identifier_limit(mut self, limit: usize) -> Self {
+        self.identifier_limit = limit;
+        self
+    }
+
+    /// Whether messages are being skipped until Sync after an error
+    pub fn is_failed(&self) -> bool {
+        self.failed
+    }
+
+    /// `DEALLOCATE [PREPARE] name`, `DEALLOCATE ALL` or `DISCARD ALL`, run on
+    /// this connection's statements. Gives the command tag, an error message
+    /// for an unknown statement, or `None` for any other statement.
+    pub fn deallocate(&mut self, statement: &Statement) -> Option<Result<&'static str, String>> {
+        match statement {
+            Statement::Deallocate { name, .. }
+                if name.quote_style.is_none() && name.value.eq_ignore_ascii_case("ALL") =>
+            {
+                self.prepared_statements.clear();
+                Some(Ok("DEALLOCATE ALL"))
+            }
+            Statement::Deallocate { name, .. } => {
+                if self.prepared_statements.remove(&name.value) {
+                    Some(Ok("DEALLOCATE"))
+                } else {
+                    Some(Err(format!(
+                        "prepared statement \"{}\" does not exist",
+                        name.value
+                    )))
+                }
+            }
+            Statement::Discard {
+                object_type: DiscardObject::ALL,
+            } => {
+                self.prepared_statements.clear();
+                self.portals.clear();
+                Some(Ok("DISCARD ALL"))
+            }
+            _ => None,
         }
     }
+
+    /// Run one statement for either query flow: prepared statement commands
+    /// here, session commands in `session` and everything else in the
+    /// executor, moving the session's transaction status on
+    pub async fn execute_statement(
+        &mut self,
+        statement: &Statement,
+        session: &mut Session,
+        executor: &QueryExecutor,
+    ) -> Result<Completion, SqlError> {
+        if let Some(error) = session.rejects(Some(statement)) {
+            session.finish(Some(statement), false);
+            return Err(error);
+        }
+        let outcome = match self.deallocate(statement) {
+            // DISCARD ALL resets the session as well
+            Some(Ok(tag)) => match session.execute(statement) {
+                Some(outcome) => {
+                    executor.reset_session();
+                    outcome
+                }
+                None => Ok(Completion::tag(tag)),
+            },
+            Some(Err(message)) => Err(SqlError::new("26000", message)),
+            None => match session.execute(statement) {
+                Some(outcome) => outcome,
+                None => match CursorDeclaration::of(statement) {
+                    // A cursor's query runs when it is declared; FETCH reads
+                    // its rows from the session
+                    Some(cursor) => {
+                        let query = Statement::Query(Box::new(cursor.query.clone()));
+                        match executor.execute(&query).await {
+                            Ok(result) => session.declare(cursor.name, result, cursor.hold),
+                            Err(e) => Err(executor_error(e)),
+                        }
+                    }
+                    None => match executor.execute(statement).await {
+                        Ok(result) => Ok(Completion {
+                            tag: session.tag(statement, &result, executor.take_affected_rows()),
+                            result: Some(result),
+                            reports: vec![],
+                        }),
+                        Err(e) => Err(executor_error(e)),
+                    },
+                },
+            },
+        };
+        session.finish(Some(statement), outcome.is_ok());
+        outcome
+    }
+
+    /// Report an error for the current message and skip the rest of the batch
+    async fn fail(
+        &mut self,
+        stream: &mut TcpStream,
+        code: &str,
+        message: &str,
+    ) -> crate::Result<()> {
+        self.failed = true;
+        send_error_response(stream, code, message).await
+    }
+}
+
+/// The error a client gets for a statement the executor failed to run
+pub(crate) fn executor_error(error: YamlBaseError) -> SqlError {
+    match error {
+        YamlBaseError::Cancelled(_) => SqlError::new("57014", error.to_string()),
+        YamlBaseError::ReadOnly(_) => SqlError::new("25006", error.to_string()),
+        _ => SqlError::new("XX000", error.to_string()),
+    }
 }
 
 impl Default for ExtendedProtocol {
@@ -50,30 +231,22 @@ impl Default for ExtendedProtocol {
 }
 
 impl ExtendedProtocol {
-    pub async fn handle_parse(&mut self, stream: &mut TcpStream, data: &[u8]) -> crate::Result<()> {
+    pub async fn handle_parse(
+        &mut self,
+        stream: &mut TcpStream,
+        data: &[u8],
+        session: &Session,
+        executor: &QueryExecutor,
+    ) -> crate::Result<()> {
         debug!("Handling Parse message");
 
         let mut pos = 0;
 
         // Read statement name
-        let name_end = data[pos..]
-            .iter()
-            .position(|&b| b == 0)
-            .unwrap_or(data.len() - pos);
-        let name = std::str::from_utf8(&data[pos..pos + name_end])
-            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in statement name".to_string()))?
-            .to_string();
-        pos += name_end + 1;
+        let name = read_cstr(data, &mut pos, "statement name")?.to_string();
 
         // Read query
-        let query_end = data[pos..]
-            .iter()
-            .position(|&b| b == 0)
-            .unwrap_or(data.len() - pos);
-        let query = std::str::from_utf8(&data[pos..pos + query_end])
-            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in query".to_string()))?
-            .to_string();
-        pos += query_end + 1;
+        let query = read_cstr(data, &mut pos, "query")?.to_string();
 
         // Read parameter type count
         if pos + 2 > data.len() {
@@ -86,6 +259,7 @@ impl ExtendedProtocol {
 
         // Read parameter types
         let mut parameter_types = Vec::new();
+        let mut parameter_oids = Vec::new();
         for _ in 0..param_count {
             if pos + 4 > data.len() {
                 return Err(YamlBaseError::Protocol(
@@ -94,16 +268,58 @@ impl ExtendedProtocol {
             }
             let oid = u32::from_be_bytes([data[pos], data[pos + 1], data[pos + 2], data[pos + 3]]);
             parameter_types.push(oid_to_sql_type(oid));
+            parameter_oids.push(oid);
             pos += 4;
         }
 
-        // Parse the SQL
+        // Only the unnamed statement may be replaced without closing it first
+        if !name.is_empty() && self.prepared_statements.contains(&name) {
+            let message = format!("prepared statement \"{}\" already exists", name);
+            return self.fail(stream, "42P05", &message).await;
+        }
+
+        // Parse the SQL without its comments, with its strings read as the
+        // session's standard_conforming_strings says and long identifiers
+        // cut as PostgreSQL reads them
+        let escapes = Escapes::postgres(session.get("standard_conforming_strings"));
+        let query = literals::strip_comments(&query, escapes);
+        let query = match literals::normalize(&query, escapes) {
+            Ok(query) => query.into_owned(),
+            Err(message) => return self.fail(stream, "22025", &message).await,
+        };
+        let (truncated, notices) = identifiers::truncate(&query, self.identifier_limit);
+        let query = truncated.into_owned();
+        for notice in &notices {
+            send_notice_response(stream, notice).await?;
+        }
         let parsed_statements = parse_sql(&query)?;
 
         // If no parameter types were provided, we need to infer them from the query
         if parameter_types.is_empty() && !parsed_statements.is_empty() {
-            if let Statement::Query(query_ref) = &parsed_statements[0] {
-                let inferred_types = infer_parameter_types(query_ref);
+            // Waits out a writer, so a statement's types never depend on timing
+            let db = executor.storage().database();
+            let db = db.read().await;
+            let inferred_types = match &parsed_statements[0] {
+                Statement::Query(query_ref) => Some(infer_parameter_types(query_ref)),
+                Statement::Insert(insert) => Some(infer_insert_parameter_types(insert, &db)),
+                Statement::Update {
+                    table,
+                    assignments,
+                    selection,
+                    ..
+                } => Some(infer_update_parameter_types(
+                    table,
+                    assignments,
+                    selection.as_ref(),
+                    &db,
+                )),
+                Statement::Delete(delete) => Some(infer_where_parameter_types(
+                    delete.selection.as_ref(),
+                    std::collections::HashMap::new(),
+                )),
+                _ => None,
+            };
+            if let Some(inferred_types) = inferred_types {
                 debug!("Inferred {} parameters from query", inferred_types.len());
                 parameter_types = inferred_types;
             }
@@ -117,13 +333,20 @@ impl ExtendedProtocol {
 
         // Store prepared statement
         let stmt = PreparedStatement {
-            name: name.clone(),
+            name,
             query,
             parameter_types,
+            parameter_oids,
             parsed_statements,
+            result_types: None,
         };
 
-        self.prepared_statements.insert(name, stmt);
+        if let Some(evicted) = self.prepared_statements.insert(stmt) {
+            debug!(
+                "Dropped least recently used prepared statement '{}'",
+                evicted
+            );
+        }
 
         // Send ParseComplete
         let mut buf = BytesMut::new();
@@ -140,33 +363,16 @@ impl ExtendedProtocol {
         let mut pos = 0;
 
         // Read portal name
-        let portal_name_end = data[pos..]
-            .iter()
-            .position(|&b| b == 0)
-            .unwrap_or(data.len() - pos);
-        let portal_name = std::str::from_utf8(&data[pos..pos + portal_name_end])
-            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in portal name".to_string()))?
-            .to_string();
-        pos += portal_name_end + 1;
+        let portal_name = read_cstr(data, &mut pos, "portal name")?.to_string();
 
         // Read statement name
-        let stmt_name_end = data[pos..]
-            .iter()
-            .position(|&b| b == 0)
-            .unwrap_or(data.len() - pos);
-        let stmt_name = std::str::from_utf8(&data[pos..pos + stmt_name_end])
-            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in statement name".to_string()))?
-            .to_string();
-        pos += stmt_name_end + 1;
+        let stmt_name = read_cstr(data, &mut pos, "statement name")?.to_string();
 
         // Get the prepared statement
-        let statement = self
-            .prepared_statements
-            .get(&stmt_name)
-            .ok_or_else(|| {
-                YamlBaseError::Protocol(format!("Unknown prepared statement: {}", stmt_name))
-            })?
-            .clone();
+        let Some(statement) = self.prepared_statements.get(&stmt_name).cloned() else {
+            let message = format!("prepared statement \"{}\" does not exist", stmt_name);
+            return self.fail(stream, "26000", &message).await;
+        };
 
         // Read parameter format codes
         if pos + 2 > data.len() {
@@ -177,7 +383,7 @@ impl ExtendedProtocol {
         let format_code_count = u16::from_be_bytes([data[pos], data[pos + 1]]) as usize;
         pos += 2;
 
-        let mut _format_codes = Vec::new();
+        let mut format_codes = Vec::new();
         for _ in 0..format_code_count {
             if pos + 2 > data.len() {
                 return Err(YamlBaseError::Protocol(
@@ -185,7 +391,7 @@ impl ExtendedProtocol {
                 ));
             }
             let format = u16::from_be_bytes([data[pos], data[pos + 1]]);
-            _format_codes.push(format);
+            format_codes.push(format);
             pos += 2;
         }
 
@@ -212,18 +418,45 @@ impl ExtendedProtocol {
             if length == -1 {
                 parameters.push(Value::Null);
             } else {
-                let length = length as usize;
-                if pos + length > data.len() {
-                    return Err(YamlBaseError::Protocol(
-                        "Incomplete parameter data".to_string(),
-                    ));
-                }
-                let value_data = &data[pos..pos + length];
-                pos += length;
-
-                // Convert based on parameter type
+                let value_data = usize::try_from(length)
+                    .ok()
+                    .and_then(|length| data.get(pos..pos.checked_add(length)?))
+                    .ok_or_else(|| {
+                        YamlBaseError::Protocol("Incomplete parameter data".to_string())
+                    })?;
+                pos += value_data.len();
+
+                // No format codes means text, and a single one applies to every parameter
+                let format = match format_codes.as_slice() {
+                    [] => 0,
+                    [format] => *format,
+                    formats => formats.get(i).copied().unwrap_or(0),
+                };
+                let oid = statement.parameter_oids.get(i).copied().unwrap_or(0);
                 let sql_type = statement.parameter_types.get(i).unwrap_or(&SqlType::Text);
-                let value = parse_parameter_value(value_data, sql_type)?;
+                let value = if format == 1 && array_element_oid(oid).is_some() {
+                    Value::Text(parse_binary_array(value_data)?)
+                } else if format == 1
+                    && matches!(
+                        sql_type,
+                        SqlType::Date | SqlType::Time | SqlType::Timestamp | SqlType::TimestampTz
+                    )
+                {
+                    parse_binary_temporal(value_data, sql_type)?
+                } else if format == 1 && matches!(sql_type, SqlType::Decimal(_, _)) {
+                    parse_binary_numeric(value_data)?
+                } else if format == 1 && matches!(sql_type, SqlType::Json) {
+                    parse_binary_jsonb(value_data)?
+                } else if format == 1 && matches!(sql_type, SqlType::Bytea) {
+                    Value::Text(bytea::to_text(value_data))
+                } else if format == 1 && matches!(sql_type, SqlType::Uuid) {
+                    parse_binary_uuid(value_data)?
+                } else if format == 1 {
+                    // Convert based on parameter type
+                    parse_parameter_value(value_data, sql_type)?
+                } else {
+                    parse_text_parameter(value_data, sql_type)?
+                };
                 parameters.push(value);
             }
         }
@@ -252,9 +485,11 @@ impl ExtendedProtocol {
         // Store portal
         let portal = Portal {
             name: portal_name.clone(),
+            result_types: statement.result_types.clone(),
             statement,
             parameters,
             result_formats,
+            run: None,
         };
 
         self.portals.insert(portal_name, portal);
@@ -269,10 +504,11 @@ impl ExtendedProtocol {
     }
 
     pub async fn handle_describe(
-        &self,
+        &mut self,
         stream: &mut TcpStream,
         data: &[u8],
         executor: &QueryExecutor,
+        session: &mut Session,
     ) -> crate::Result<()> {
         debug!("Handling Describe message with {} bytes", data.len());
 
@@ -283,94 +519,151 @@ impl ExtendedProtocol {
         }
 
         let describe_type = data[0];
-        let name_end = data[1..]
-            .iter()
-            .position(|&b| b == 0)
-            .unwrap_or(data.len() - 1);
-        let name = std::str::from_utf8(&data[1..1 + name_end])
-            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in describe name".to_string()))?;
+        let mut pos = 1;
+        let name = read_cstr(data, &mut pos, "describe name")?;
 
         match describe_type {
             b'S' => {
                 // Describe statement
-                if let Some(stmt) = self.prepared_statements.get(name) {
+                if let Some(stmt) = self.prepared_statements.get(name).cloned() {
                     // Send ParameterDescription
                     let mut buf = BytesMut::new();
                     buf.put_u8(b't');
                     buf.put_u32(4 + 2 + stmt.parameter_types.len() as u32 * 4);
                     buf.put_u16(stmt.parameter_types.len() as u16);
-                    for param_type in &stmt.parameter_types {
-                        buf.put_u32(sql_type_to_oid(param_type));
+                    for (i, param_type) in stmt.parameter_types.iter().enumerate() {
+                        // Array parameters keep the type the client declared
+                        let oid = match stmt.parameter_oids.get(i) {
+                            Some(&oid) if array_element_oid(oid).is_some() => oid,
+                            _ => sql_type_to_oid(param_type),
+                        };
+                        buf.put_u32(oid);
                     }
                     stream.write_all(&buf).await?;
 
                     // For SELECT queries, we need to describe the result
+                    let mut described = None;
                     if !stmt.parsed_statements.is_empty() {
                         if let sqlparser::ast::Statement::Query(query) = &stmt.parsed_statements[0]
                         {
                             // Try to extract column information from the query
-                            if let sqlparser::ast::SetExpr::Select(select) = &*query.body {
+                            // `SELECT ... INTO table` stores its rows instead of returning them
+                            if let Some(select) =
+                                leftmost_select(&query.body).filter(|select| select.into.is_none())
+                            {
                                 let (columns, types) =
                                     extract_columns_and_types_from_select(select, executor);
                                 send_row_description_for_columns_with_types(
                                     stream, &columns, &types,
                                 )
                                 .await?;
+                                described = Some(types);
                             } else {
                                 // Send NoData if we can't determine columns
-                                buf.clear();
-                                buf.put_u8(b'n');
-                                buf.put_u32(4);
-                                stream.write_all(&buf).await?;
+                                send_no_data(stream).await?;
                             }
+                        } else if let Some(Ok(result)) = session
+                            .show(&stmt.parsed_statements[0])
+                            .or_else(|| session.describe_fetch(&stmt.parsed_statements[0]))
+                        {
+                            // SHOW, and FETCH from a cursor declared before
+                            send_row_description(stream, &result, &[]).await?;
+                            described = Some(result.column_types);
+                        } else if let Some(select) = returning_select(&stmt.parsed_statements[0]) {
+                            let (columns, types) =
+                                extract_columns_and_types_from_select(&select, executor);
+                            send_row_description_for_columns_with_types(stream, &columns, &types)
+                                .await?;
+                            described = Some(types);
                         } else {
                             // Non-SELECT statements don't return data
-                            buf.clear();
-                            buf.put_u8(b'n');
-                            buf.put_u32(4);
-                            stream.write_all(&buf).await?;
+                            send_no_data(stream).await?;
                         }
                     }
+                    // Portals bound from now on send binary results as these types
+                    if let Some(stmt) = self.prepared_statements.get(name) {
+                        stmt.result_types = described;
+                    }
                 } else {
-                    return Err(YamlBaseError::Protocol(format!(
-                        "Unknown statement: {}",
-                        name
-                    )));
+                    let message = format!("prepared statement \"{}\" does not exist", name);
+                    return self.fail(stream, "26000", &message).await;
                 }
             }
             b'P' => {
                 // Describe portal
-                if let Some(portal) = self.portals.get(name) {
-                    // For SELECT queries, describe the result
-                    if !portal.statement.parsed_statements.is_empty() {
-                        if let sqlparser::ast::Statement::Query(_) =
-                            &portal.statement.parsed_statements[0]
-                        {
-                            match executor
-                                .execute(&portal.statement.parsed_statements[0])
-                                .await
-                            {
-                                Ok(result) => {
-                                    send_row_description(stream, &result).await?;
-                                }
-                                Err(_) => {
-                                    // Send NoData
-                                    let mut buf = BytesMut::new();
-                                    buf.put_u8(b'n');
-                                    buf.put_u32(4);
-                                    stream.write_all(&buf).await?;
-                                }
+                let Some(portal) = self.portals.get(name) else {
+                    let message = format!("portal \"{}\" does not exist", name);
+                    return self.fail(stream, "34000", &message).await;
+                };
+                let result_formats = portal.result_formats.clone();
+                if let Some(run) = &portal.run {
+                    return match &run.completion.result {
+                        Some(result) => {
+                            let types = result.column_types.clone();
+                            send_row_description(stream, result, &result_formats).await?;
+                            if let Some(portal) = self.portals.get_mut(name) {
+                                portal.result_types = Some(types);
                             }
-                        } else {
-                            // Send NoData
-                            let mut buf = BytesMut::new();
-                            buf.put_u8(b'n');
-                            buf.put_u32(4);
-                            stream.write_all(&buf).await?;
+                            Ok(())
+                        }
+                        None => send_no_data(stream).await,
+                    };
+                }
+                let Some(mut statement) = portal.statement.parsed_statements.first().cloned()
+                else {
+                    return send_no_data(stream).await;
+                };
+                let parameters = portal.parameters.clone();
+
+                if let sqlparser::ast::Statement::Query(query) = &statement {
+                    // Running `SELECT ... INTO table` here would create the table early
+                    if leftmost_select(&query.body).is_some_and(|select| select.into.is_some()) {
+                        return send_no_data(stream).await;
+                    }
+                }
+                if matches!(
+                    statement,
+                    sqlparser::ast::Statement::Query(_) | sqlparser::ast::Statement::Fetch { .. }
+                ) {
+                    // Run the query, or fetch from the cursor, now and keep
+                    // the rows for Execute, so that it runs once however the
+                    // portal is described and fetched
+                    substitute_parameters(&mut statement, &parameters)?;
+                    let running = self.execute_statement(&statement, session, executor);
+                    let Some(outcome) = unless_disconnected(stream, running).await else {
+                        return Ok(());
+                    };
+                    let completion = match outcome {
+                        Ok(completion) => completion,
+                        Err(error) => return self.fail(stream, error.code, &error.message).await,
+                    };
+                    match &completion.result {
+                        Some(result) => {
+                            send_row_description(stream, result, &result_formats).await?
                         }
+                        None => send_no_data(stream).await?,
+                    }
+                    if let Some(portal) = self.portals.get_mut(name) {
+                        portal.result_types = completion
+                            .result
+                            .as_ref()
+                            .map(|result| result.column_types.clone());
+                        portal.run = Some(PortalRun::new(completion));
+                    }
+                } else if let Some(Ok(result)) = session.show(&statement) {
+                    send_row_description(stream, &result, &result_formats).await?;
+                    if let Some(portal) = self.portals.get_mut(name) {
+                        portal.result_types = Some(result.column_types);
+                    }
+                } else if let Some(select) = returning_select(&statement) {
+                    // Described from its RETURNING list, since running it would write
+                    let (columns, types) = extract_columns_and_types_from_select(&select, executor);
+                    send_row_description_for_columns_with_types(stream, &columns, &types).await?;
+                    if let Some(portal) = self.portals.get_mut(name) {
+                        portal.result_types = Some(types);
                     }
                 } else {
-                    return Err(YamlBaseError::Protocol(format!("Unknown portal: {}", name)));
+                    send_no_data(stream).await?;
                 }
             }
             _ => {
@@ -385,86 +678,150 @@ impl ExtendedProtocol {
     }
 
     pub async fn handle_execute(
-        &self,
+        &mut self,
         stream: &mut TcpStream,
         data: &[u8],
         executor: &QueryExecutor,
+        session: &mut Session,
     ) -> crate::Result<()> {
         debug!("Handling Execute message");
 
         let mut pos = 0;
 
         // Read portal name
-        let name_end = data[pos..]
-            .iter()
-            .position(|&b| b == 0)
-            .unwrap_or(data.len() - pos);
-        let portal_name = std::str::from_utf8(&data[pos..pos + name_end])
-            .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in portal name".to_string()))?;
-        pos += name_end + 1;
+        let portal_name = read_cstr(data, &mut pos, "portal name")?;
 
-        // Read row limit
+        // Read row limit; 0 sends every row
         if pos + 4 > data.len() {
             return Err(YamlBaseError::Protocol(
                 "Incomplete execute message".to_string(),
             ));
         }
-        let _row_limit =
-            u32::from_be_bytes([data[pos], data[pos + 1], data[pos + 2], data[pos + 3]]);
+        let row_limit =
+            u32::from_be_bytes([data[pos], data[pos + 1], data[pos + 2], data[pos + 3]]) as usize;
 
         // Get portal
-        let portal = self
-            .portals
-            .get(portal_name)
-            .ok_or_else(|| YamlBaseError::Protocol(format!("Unknown portal: {}", portal_name)))?;
-
-        // Execute the statement with parameter substitution
-        if !portal.statement.parsed_statements.is_empty() {
-            // Clone the statement and substitute parameters
-            let mut statement = portal.statement.parsed_statements[0].clone();
-            substitute_parameters(&mut statement, &portal.parameters)?;
-
-            match executor.execute(&statement).await {
-                Ok(result) => {
-                    debug!(
-                        "Execute result: {} rows, {} columns: {:?}",
-                        result.rows.len(),
-                        result.columns.len(),
-                        result.columns
-                    );
-                    if !result.rows.is_empty() {
-                        debug!("First row: {:?}", result.rows[0]);
-                    }
-
-                    // Pass the result formats from the portal
-                    send_data_rows(stream, &result, &portal.result_formats).await?;
+        let Some(portal) = self.portals.get_mut(portal_name) else {
+            let message = format!("portal \"{}\" does not exist", portal_name);
+            return self.fail(stream, "34000", &message).await;
+        };
 
-                    // Send CommandComplete
-                    let mut buf = BytesMut::new();
-                    buf.put_u8(b'C');
-                    let tag = format!("SELECT {}", result.rows.len());
-                    buf.put_u32(4 + tag.len() as u32 + 1);
-                    buf.put_slice(tag.as_bytes());
-                    buf.put_u8(0);
-                    stream.write_all(&buf).await?;
-                }
-                Err(e) => {
-                    send_error_response(stream, "XX000", &e.to_string()).await?;
+        if portal.statement.parsed_statements.is_empty() {
+            // EmptyQueryResponse, for a statement prepared from an empty string
+            let mut buf = BytesMut::new();
+            buf.put_u8(b'I');
+            buf.put_u32(4);
+            stream.write_all(&buf).await?;
+            return Ok(());
+        }
+        let result_formats = portal.result_formats.clone();
+        let result_types = portal.result_types.clone();
+
+        // Run the statement with parameter substitution, unless a Describe
+        // or an earlier Execute already did
+        let mut run = match portal.run.take() {
+            Some(run) => run,
+            None => {
+                let mut statement = portal.statement.parsed_statements[0].clone();
+                substitute_parameters(&mut statement, &portal.parameters)?;
+                let running = self.execute_statement(&statement, session, executor);
+                let Some(outcome) = unless_disconnected(stream, running).await else {
+                    return Ok(());
+                };
+                match outcome {
+                    Ok(completion) => PortalRun::new(completion),
+                    Err(error) => {
+                        self.fail(stream, error.code, &error.message).await?;
+                        for notice in executor.take_notices() {
+                            send_notice_response(stream, &notice).await?;
+                        }
+                        return Ok(());
+                    }
                 }
             }
+        };
+
+        for (name, value) in run.completion.reports.drain(..) {
+            send_parameter_status(stream, name, &value).await?;
+        }
+        let sent_before = run.sent;
+        let mut suspended = false;
+        if let Some(result) = &run.completion.result {
+            let limit = match row_limit {
+                0 => usize::MAX,
+                limit => limit,
+            };
+            let batch: Vec<Vec<Value>> = run.rows.by_ref().take(limit).collect();
+            debug!(
+                "Execute result: {} rows after {} sent, {} left, {} columns: {:?}",
+                batch.len(),
+                sent_before,
+                run.rows.len(),
+                result.columns.len(),
+                result.columns
+            );
+
+            // Pass the result formats from the portal
+            let mut out = ResultWriter::new(stream, self.output);
+            send_data_rows(
+                &mut out,
+                result,
+                &batch,
+                &result_formats,
+                result_types.as_deref(),
+                session.timezone(),
+            )
+            .await?;
+            suspended = !run.rows.as_slice().is_empty();
+            run.sent += batch.len();
+        }
+
+        let mut buf = BytesMut::new();
+        if suspended {
+            // PortalSuspended: the next Execute sends the rows that follow
+            buf.put_u8(b's');
+            buf.put_u32(4);
+        } else {
+            // CommandComplete; after a suspension PostgreSQL counts the rows
+            // of this Execute only
+            let tag = if sent_before > 0 && run.completion.tag.starts_with("SELECT ") {
+                format!("SELECT {}", run.sent - sent_before)
+            } else {
+                run.completion.tag.clone()
+            };
+            buf.put_u8(b'C');
+            buf.put_u32(4 + tag.len() as u32 + 1);
+            buf.put_slice(tag.as_bytes());
+            buf.put_u8(0);
+        }
+        stream.write_all(&buf).await?;
+        if let Some(portal) = self.portals.get_mut(portal_name) {
+            portal.run = Some(run);
+        }
+        for notice in executor.take_notices() {
+            send_notice_response(stream, &notice).await?;
         }
 
         Ok(())
     }
 
-    pub async fn handle_sync(&self, stream: &mut TcpStream) -> crate::Result<()> {
+    pub async fn handle_sync(
+        &mut self,
+        stream: &mut TcpStream,
+        status: TransactionStatus,
+    ) -> crate::Result<()> {
         debug!("Handling Sync message");
+        self.failed = false;
+        // Portals last until the end of their transaction, as in PostgreSQL
+        if status == TransactionStatus::Idle {
+            self.portals.clear();
+        }
 
         // Send ReadyForQuery
         let mut buf = BytesMut::new();
         buf.put_u8(b'Z');
         buf.put_u32(5);
-        buf.put_u8(b'I'); // Idle
+        buf.put_u8(status.indicator());
         stream.write_all(&buf).await?;
 
         Ok(())
@@ -479,7 +836,11 @@ impl ExtendedProtocol {
     }
 }
 
-async fn send_row_description(stream: &mut TcpStream, result: &QueryResult) -> crate::Result<()> {
+async fn send_row_description(
+    stream: &mut TcpStream,
+    result: &QueryResult,
+    result_formats: &[u16],
+) -> crate::Result<()> {
     let mut buf = BytesMut::new();
     buf.put_u8(b'T');
 
@@ -498,23 +859,44 @@ async fn send_row_description(stream: &mut TcpStream, result: &QueryResult) -> c
         buf.put_u32(0); // Table OID
         buf.put_u16(i as u16); // Column number
 
-        // Get the type OID from column_types if available
-        let type_oid = if i < result.column_types.len() {
-            sql_type_to_oid(&result.column_types[i])
-        } else {
-            25 // Default to text
-        };
-        buf.put_u32(type_oid);
-
-        buf.put_i16(-1); // Type size
-        buf.put_i32(-1); // Type modifier
-        buf.put_i16(0); // Format code (text)
+        put_field_type(&mut buf, result.column_types.get(i));
+        buf.put_u16(result_format(result_formats, i));
     }
 
     stream.write_all(&buf).await?;
     Ok(())
 }
 
+/// A RowDescription field's type OID, size and modifier, from which drivers
+/// give the length of a `VARCHAR(n)` and the precision and scale of a
+/// `DECIMAL(p,s)`, as psycopg2's `cursor.description` does; a column of no
+/// known type is text
+pub(crate) fn put_field_type(buf: &mut BytesMut, sql_type: Option<&SqlType>) {
+    let sql_type = sql_type.unwrap_or(&SqlType::Text);
+    let type_oid = sql_type_to_oid(sql_type);
+    buf.put_u32(type_oid);
+    buf.put_i16(catalog::type_length(type_oid as i64) as i16);
+    buf.put_i32(catalog::type_modifier(sql_type) as i32);
+}
+
+async fn send_no_data(stream: &mut TcpStream) -> crate::Result<()> {
+    let mut buf = BytesMut::new();
+    buf.put_u8(b'n');
+    buf.put_u32(4);
+    stream.write_all(&buf).await?;
+    Ok(())
+}
+
+/// The format of column `col_idx` among a Bind's result format codes: none
+/// means text, and a single one applies to every column
+fn result_format(result_formats: &[u16], col_idx: usize) -> u16 {
+    match result_formats {
+        [] => 0,
+        [format] => *format,
+        formats => formats.get(col_idx).copied().unwrap_or(0),
+    }
+}
+
 async fn send_row_description_for_columns_with_types(
     stream: &mut TcpStream,
     columns: &[String],
@@ -538,16 +920,7 @@ async fn send_row_description_for_columns_with_types(
         buf.put_u32(0); // Table OID
         buf.put_u16(i as u16); // Column number
 
-        // Get the type OID from types if available
-        let type_oid = if i < types.len() {
-            sql_type_to_oid(&types[i])
-        } else {
-            25 // Default to text
-        };
-        buf.put_u32(type_oid);
-
-        buf.put_i16(-1); // Type size
-        buf.put_i32(-1); // Type modifier
+        put_field_type(&mut buf, types.get(i));
         buf.put_i16(0); // Format code (text)
     }
 
@@ -561,6 +934,24 @@ fn extract_columns_and_types_from_select(
 ) -> (Vec<String>, Vec<SqlType>) {
     let mut columns = Vec::new();
     let mut types = Vec::new();
+    let tables = from_tables(select);
+    let db = executor.storage().database();
+    let db = db.try_read().ok();
+    // The declared columns of a table the select reads, by name or alias
+    let table_columns = |reference: &str| {
+        let (_, table_name) = tables
+            .iter()
+            .find(|(name, _)| name.eq_ignore_ascii_case(reference))?;
+        db.as_ref()?
+            .get_table(table_name)
+            .map(|table| table.columns.clone())
+    };
+    let column_type = |reference: &str, name: &str| {
+        table_columns(reference)?
+            .into_iter()
+            .find(|column| column.name.eq_ignore_ascii_case(name))
+            .map(|column| column.sql_type)
+    };
 
     for item in &select.projection {
         match item {
@@ -568,8 +959,21 @@ fn extract_columns_and_types_from_select(
                 match expr {
                     Expr::Identifier(ident) => {
                         columns.push(ident.value.clone());
-                        // Try to infer type from column name in WHERE clause context
-                        types.push(infer_type_from_column_name(&ident.value));
+                        // The type of the column it reads, else a guess from its name
+                        types.push(
+                            tables
+                                .iter()
+                                .find_map(|(reference, _)| column_type(reference, &ident.value))
+                                .unwrap_or_else(|| infer_type_from_column_name(&ident.value)),
+                        );
+                    }
+                    // `u.name` is named `name`, as PostgreSQL does
+                    Expr::CompoundIdentifier(parts) if parts.len() == 2 => {
+                        columns.push(parts[1].value.clone());
+                        types.push(
+                            column_type(&parts[0].value, &parts[1].value)
+                                .unwrap_or_else(|| infer_type_from_column_name(&parts[1].value)),
+                        );
                     }
                     Expr::Function(func) => {
                         let func_name = func
@@ -625,24 +1029,39 @@ fn extract_columns_and_types_from_select(
                             _ => types.push(SqlType::Text),
                         }
                     }
+                    // `o.id AS order_id` has the type of the column it reads
+                    Expr::CompoundIdentifier(parts) if parts.len() == 2 => types.push(
+                        column_type(&parts[0].value, &parts[1].value).unwrap_or(SqlType::Text),
+                    ),
+                    Expr::Identifier(ident) => types.push(
+                        tables
+                            .iter()
+                            .find_map(|(reference, _)| column_type(reference, &ident.value))
+                            .unwrap_or(SqlType::Text),
+                    ),
                     _ => types.push(SqlType::Text),
                 }
             }
             sqlparser::ast::SelectItem::Wildcard(_) => {
-                // For SELECT *, we need to get all columns from the table
-                if let Some(table) = select.from.first() {
-                    if let Some(table_name) = get_table_name_from_relation(&table.relation) {
-                        if let Ok(db) = executor.storage().database().try_read() {
-                            if let Some(table) = db.get_table(&table_name) {
-                                for col in &table.columns {
-                                    columns.push(col.name.clone());
-                                    types.push(col.sql_type.clone());
-                                }
-                            }
-                        }
+                // `SELECT *` returns the columns of every table it reads, in FROM order
+                for (reference, _) in &tables {
+                    for column in table_columns(reference).unwrap_or_default() {
+                        columns.push(column.name);
+                        types.push(column.sql_type);
                     }
                 }
             }
+            sqlparser::ast::SelectItem::QualifiedWildcard(name, _) => {
+                let reference = name
+                    .0
+                    .first()
+                    .map(|ident| ident.value.as_str())
+                    .unwrap_or("");
+                for column in table_columns(reference).unwrap_or_default() {
+                    columns.push(column.name);
+                    types.push(column.sql_type);
+                }
+            }
             _ => {
                 // For other types, use a generic name
                 columns.push(format!("column{}", columns.len()));
@@ -665,142 +1084,406 @@ fn infer_type_from_column_name(name: &str) -> SqlType {
     }
 }
 
-fn get_table_name_from_relation(relation: &sqlparser::ast::TableFactor) -> Option<String> {
-    match relation {
-        sqlparser::ast::TableFactor::Table { name, .. } => {
-            name.0.first().map(|ident| ident.value.clone())
+/// The tables a select reads, with the name or alias the query calls each by
+fn from_tables(select: &sqlparser::ast::Select) -> Vec<(String, String)> {
+    let mut tables = Vec::new();
+    for table in &select.from {
+        let joined = table.joins.iter().map(|join| &join.relation);
+        for relation in std::iter::once(&table.relation).chain(joined) {
+            if let sqlparser::ast::TableFactor::Table { name, alias, .. } = relation {
+                if let Some(table_name) = name.0.last() {
+                    let reference = alias
+                        .as_ref()
+                        .map_or(&table_name.value, |alias| &alias.name.value);
+                    tables.push((reference.clone(), table_name.value.clone()));
+                }
+            }
         }
-        _ => None,
     }
+    tables
 }
 
+/// Send `rows`, some or all of `result`'s
 async fn send_data_rows(
-    stream: &mut TcpStream,
+    out: &mut ResultWriter<'_>,
     result: &QueryResult,
+    rows: &[Vec<Value>],
     result_formats: &[u16],
+    described_types: Option<&[SqlType]>,
+    timezone: FixedOffset,
 ) -> crate::Result<()> {
-    for row in &result.rows {
+    for row in rows {
+        let fields: Vec<Option<Vec<u8>>> = row
+            .iter()
+            .enumerate()
+            .map(|(col_idx, val)| {
+                if matches!(val, Value::Null) {
+                    return None;
+                }
+                let col_type = result.column_types.get(col_idx);
+                Some(match result_format(result_formats, col_idx) {
+                    // Binary as the type the client was told, which it decodes by
+                    1 => {
+                        let described = match described_types {
+                            Some(types) => types.get(col_idx),
+                            None => col_type,
+                        };
+                        binary_value(val, described, timezone)
+                    }
+                    _ => text_value(val, col_type, timezone).into_bytes(),
+                })
+            })
+            .collect();
+
         let mut buf = BytesMut::new();
         buf.put_u8(b'D');
-
-        // First pass: calculate row length
-        let mut row_length = 6; // 4 bytes for length + 2 bytes for field count
-        for (col_idx, val) in row.iter().enumerate() {
-            if matches!(val, Value::Null) {
-                row_length += 4; // 4 bytes for -1 (NULL indicator)
-            } else {
-                // Check the format for this column
-                let format = if result_formats.is_empty() {
-                    0 // Default to text
-                } else if result_formats.len() == 1 {
-                    result_formats[0] // Use the single format for all columns
-                } else if col_idx < result_formats.len() {
-                    result_formats[col_idx] // Use the specific format for this column
-                } else {
-                    0 // Default to text if not specified
-                };
-
-                if format == 1 {
-                    // Binary format
-                    match val {
-                        Value::Integer(_) => {
-                            // Check the column type to determine size
-                            let col_type = result.column_types.get(col_idx);
-                            match col_type {
-                                Some(SqlType::BigInt) => row_length += 4 + 8, // int8 (i64)
-                                Some(SqlType::Integer) => row_length += 4 + 4, // int4 (i32)
-                                _ => row_length += 4 + 4, // Default to int4 for compatibility
-                            }
-                        }
-                        Value::Boolean(_) => row_length += 4 + 1, // 4 bytes for length + 1 byte for bool
-                        Value::Float(_) => row_length += 4 + 4, // 4 bytes for length + 4 bytes for f32
-                        Value::Double(_) => row_length += 4 + 8, // 4 bytes for length + 8 bytes for f64
-                        _ => {
-                            // For other types, fall back to text
-                            let val_str = val.to_string();
-                            row_length += 4 + val_str.len();
-                        }
-                    }
-                } else {
-                    // Text format
-                    let val_str = val.to_string();
-                    row_length += 4 + val_str.len();
+        // 4 bytes for length + 2 bytes for field count, then each field's
+        // length and bytes; NULL is just a length of -1
+        let row_length = 6 + fields
+            .iter()
+            .map(|field| 4 + field.as_ref().map_or(0, Vec::len))
+            .sum::<usize>();
+        buf.put_u32(row_length as u32);
+        buf.put_u16(row.len() as u16);
+        for field in &fields {
+            match field {
+                Some(bytes) => {
+                    buf.put_i32(bytes.len() as i32);
+                    buf.put_slice(bytes);
                 }
+                None => buf.put_i32(-1), // NULL
             }
         }
 
-        buf.put_u32(row_length as u32);
-        buf.put_u16(row.len() as u16);
+        out.push(&buf).await?;
+    }
+    out.flush().await
+}
 
-        // Second pass: send field values
-        for (col_idx, val) in row.iter().enumerate() {
-            if matches!(val, Value::Null) {
-                buf.put_i32(-1); // NULL
-            } else {
-                // Check the format for this column
-                let format = if result_formats.is_empty() {
-                    0 // Default to text
-                } else if result_formats.len() == 1 {
-                    result_formats[0] // Use the single format for all columns
-                } else if col_idx < result_formats.len() {
-                    result_formats[col_idx] // Use the specific format for this column
-                } else {
-                    0 // Default to text if not specified
-                };
+/// A value in PostgreSQL's binary format for the column type the client was
+/// told, or in its text format for the types sent as text either way and
+/// for columns of no known type, which are described as text. Clients decode
+/// the bytes by the described type alone, so a value of another type, such
+/// as an integer `SUM` described as float8, is converted to it first
+fn binary_value(val: &Value, sql_type: Option<&SqlType>, timezone: FixedOffset) -> Vec<u8> {
+    let binary = match sql_type {
+        Some(SqlType::Integer) => binary_integer(val).map(|i| (i as i32).to_be_bytes().to_vec()),
+        Some(SqlType::BigInt) => binary_integer(val).map(|i| i.to_be_bytes().to_vec()),
+        Some(SqlType::Float) => binary_double(val).map(|d| (d as f32).to_be_bytes().to_vec()),
+        Some(SqlType::Double) => binary_double(val).map(|d| d.to_be_bytes().to_vec()),
+        // Amounts are described as numeric
+        Some(SqlType::Decimal(_, _) | SqlType::Money(_)) => {
+            binary_decimal(val).map(|d| binary_numeric(&d))
+        }
+        Some(SqlType::Boolean) => match val {
+            Value::Boolean(b) => Some(vec![*b as u8]),
+            Value::Integer(i) => Some(vec![(*i != 0) as u8]),
+            _ => None,
+        },
+        Some(SqlType::Uuid) => match val {
+            Value::Uuid(u) => Some(u.as_bytes().to_vec()),
+            Value::Text(s) => uuid::Uuid::parse_str(s).ok().map(|u| u.as_bytes().to_vec()),
+            _ => None,
+        },
+        Some(SqlType::Json) => match val {
+            Value::Json(j) => Some(binary_jsonb(j)),
+            Value::Text(s) => serde_json::from_str(s).ok().map(|j| binary_jsonb(&j)),
+            _ => None,
+        },
+        Some(
+            sql_type @ (SqlType::Date | SqlType::Time | SqlType::Timestamp | SqlType::TimestampTz),
+        ) => as_temporal(val, sql_type).and_then(|val| binary_temporal(&val)),
+        Some(SqlType::Array(element)) => binary_array(val, element, timezone),
+        // The bytes themselves, not their hex text
+        Some(SqlType::Bytea) => bytea::bytes(val).ok(),
+        _ => None,
+    };
+    binary.unwrap_or_else(|| text_value(val, sql_type, timezone).into_bytes())
+}
 
-                if format == 1 {
-                    // Binary format
-                    match val {
-                        Value::Integer(i) => {
-                            // Check the column type to determine size
-                            let col_type = result.column_types.get(col_idx);
-                            match col_type {
-                                Some(SqlType::BigInt) => {
-                                    buf.put_i32(8); // Length of i64
-                                    buf.put_i64(*i); // Send as 8-byte big-endian integer
-                                }
-                                Some(SqlType::Integer) => {
-                                    buf.put_i32(4); // Length of i32
-                                    buf.put_i32(*i as i32); // Send as 4-byte big-endian integer
-                                }
-                                _ => {
-                                    // Default to int4 for compatibility
-                                    buf.put_i32(4); // Length of i32
-                                    buf.put_i32(*i as i32); // Send as 4-byte big-endian integer
-                                }
-                            }
-                        }
-                        Value::Boolean(b) => {
-                            buf.put_i32(1); // Length of bool
-                            buf.put_u8(if *b { 1 } else { 0 });
-                        }
-                        Value::Float(f) => {
-                            buf.put_i32(4); // Length of f32
-                            buf.put_f32(*f);
-                        }
-                        Value::Double(d) => {
-                            buf.put_i32(8); // Length of f64
-                            buf.put_f64(*d);
-                        }
-                        _ => {
-                            // For other types, fall back to text
-                            let val_str = val.to_string();
-                            buf.put_i32(val_str.len() as i32);
-                            buf.put_slice(val_str.as_bytes());
-                        }
-                    }
-                } else {
-                    // Text format
-                    let val_str = val.to_string();
-                    buf.put_i32(val_str.len() as i32);
-                    buf.put_slice(val_str.as_bytes());
-                }
+/// A number as the int2, int4 or int8 of a column described as one
+fn binary_integer(val: &Value) -> Option<i64> {
+    match val {
+        Value::Integer(i) => Some(*i),
+        Value::Boolean(b) => Some(*b as i64),
+        Value::Float(f) => Some(f.round() as i64).filter(|_| f.is_finite()),
+        Value::Double(d) => Some(d.round() as i64).filter(|_| d.is_finite()),
+        Value::Decimal(d) => d.round().to_i64(),
+        Value::Text(s) => s.trim().parse().ok(),
+        _ => None,
+    }
+}
+
+/// A number as the float4 or float8 of a column described as one
+fn binary_double(val: &Value) -> Option<f64> {
+    match val {
+        Value::Integer(i) => Some(*i as f64),
+        Value::Float(f) => Some(*f as f64),
+        Value::Double(d) => Some(*d),
+        Value::Decimal(d) => d.to_f64(),
+        Value::Text(s) => s.trim().parse().ok(),
+        _ => None,
+    }
+}
+
+/// A number as the numeric of a column described as one
+fn binary_decimal(val: &Value) -> Option<Decimal> {
+    match val {
+        Value::Decimal(d) => Some(*d),
+        Value::Integer(i) => Some(Decimal::from(*i)),
+        Value::Float(f) => Decimal::try_from(*f).ok(),
+        Value::Double(d) => Decimal::try_from(*d).ok(),
+        Value::Text(s) => s.trim().parse().ok(),
+        _ => None,
+    }
+}
+
+/// A date or time as the type of a column described as `sql_type`, a date
+/// being midnight of its day and a timestamp's date its day
+fn as_temporal(val: &Value, sql_type: &SqlType) -> Option<Value> {
+    let val = match val {
+        Value::Text(s) => {
+            let s = s.trim();
+            ["%Y-%m-%d %H:%M:%S%.f", "%Y-%m-%dT%H:%M:%S%.f"]
+                .iter()
+                .find_map(|format| NaiveDateTime::parse_from_str(s, format).ok())
+                .map(Value::Timestamp)
+                .or_else(|| {
+                    NaiveDate::parse_from_str(s, "%Y-%m-%d")
+                        .ok()
+                        .map(Value::Date)
+                })
+                .or_else(|| {
+                    NaiveTime::parse_from_str(s, "%H:%M:%S%.f")
+                        .ok()
+                        .map(Value::Time)
+                })?
+        }
+        val => val.clone(),
+    };
+    match (sql_type, val) {
+        (SqlType::Date, Value::Date(d)) => Some(Value::Date(d)),
+        (SqlType::Date, Value::Timestamp(at)) => Some(Value::Date(at.date())),
+        (SqlType::Time, Value::Time(t)) => Some(Value::Time(t)),
+        (SqlType::Time, Value::Timestamp(at)) => Some(Value::Time(at.time())),
+        (SqlType::Timestamp | SqlType::TimestampTz, Value::Timestamp(at)) => {
+            Some(Value::Timestamp(at))
+        }
+        (SqlType::Timestamp | SqlType::TimestampTz, Value::Date(d)) => {
+            Some(Value::Timestamp(d.and_time(NaiveTime::MIN)))
+        }
+        _ => None,
+    }
+}
+
+/// An array in PostgreSQL's binary format: the number of dimensions, 1 or 0
+/// when empty, whether it holds NULLs and the element type, each an int4,
+/// the length and lower bound of the dimension, then each element's length
+/// and bytes, a length of -1 for NULL
+fn binary_array(val: &Value, element: &SqlType, timezone: FixedOffset) -> Option<Vec<u8>> {
+    let elements = array::typed_elements(val, element).ok()?;
+    let has_nulls = elements
+        .iter()
+        .any(|element| matches!(element, Value::Null));
+    let mut buf = Vec::new();
+    buf.extend_from_slice(&(!elements.is_empty() as i32).to_be_bytes());
+    buf.extend_from_slice(&(has_nulls as i32).to_be_bytes());
+    buf.extend_from_slice(&sql_type_to_oid(element).to_be_bytes());
+    if !elements.is_empty() {
+        buf.extend_from_slice(&(elements.len() as i32).to_be_bytes());
+        buf.extend_from_slice(&1i32.to_be_bytes());
+    }
+    for value in &elements {
+        match value {
+            Value::Null => buf.extend_from_slice(&(-1i32).to_be_bytes()),
+            value => {
+                let bytes = binary_value(value, Some(element), timezone);
+                buf.extend_from_slice(&(bytes.len() as i32).to_be_bytes());
+                buf.extend_from_slice(&bytes);
             }
         }
+    }
+    Some(buf)
+}
 
-        stream.write_all(&buf).await?;
+/// A value in PostgreSQL's text format; `TIMESTAMPTZ` values are shown in
+/// the session's time zone
+pub(crate) fn text_value(val: &Value, sql_type: Option<&SqlType>, timezone: FixedOffset) -> String {
+    match (val, sql_type) {
+        (Value::Timestamp(at), Some(SqlType::TimestampTz)) => {
+            timezone::format_instant(*at, timezone)
+        }
+        (Value::Timestamp(at), _) => clock::format_timestamp(*at),
+        (Value::Boolean(b), _) => booleans::postgres_text(*b).to_string(),
+        (Value::Integer(i), Some(SqlType::Boolean)) => booleans::postgres_text(*i != 0).to_string(),
+        (val, _) => val.to_string(),
     }
-    Ok(())
+}
+
+/// 2000-01-01, which PostgreSQL's binary dates and timestamps count from
+fn postgres_epoch() -> NaiveDateTime {
+    NaiveDate::from_ymd_opt(2000, 1, 1)
+        .unwrap()
+        .and_time(NaiveTime::MIN)
+}
+
+/// A date or time in PostgreSQL's binary format: a date is an int4 of days
+/// since the epoch, a time an int8 of microseconds since midnight, and a
+/// timestamp an int8 of microseconds since the epoch, in UTC for
+/// `TIMESTAMPTZ`
+fn binary_temporal(val: &Value) -> Option<Vec<u8>> {
+    match val {
+        Value::Date(d) => {
+            let days = d.signed_duration_since(postgres_epoch().date()).num_days();
+            Some((days as i32).to_be_bytes().to_vec())
+        }
+        Value::Time(t) => {
+            let micros = t.signed_duration_since(NaiveTime::MIN).num_microseconds()?;
+            Some(micros.to_be_bytes().to_vec())
+        }
+        Value::Timestamp(at) => {
+            let micros = at
+                .signed_duration_since(postgres_epoch())
+                .num_microseconds()?;
+            Some(micros.to_be_bytes().to_vec())
+        }
+        _ => None,
+    }
+}
+
+/// A date or time parameter a client sent in binary, as [`binary_temporal`]
+/// encodes it
+fn parse_binary_temporal(data: &[u8], sql_type: &SqlType) -> crate::Result<Value> {
+    let invalid = || YamlBaseError::Protocol(format!("Invalid binary {:?} parameter", sql_type));
+    if let SqlType::Date = sql_type {
+        let days = i32::from_be_bytes(data.try_into().map_err(|_| invalid())?);
+        return postgres_epoch()
+            .date()
+            .checked_add_signed(chrono::Duration::days(days as i64))
+            .map(Value::Date)
+            .ok_or_else(invalid);
+    }
+    let micros = i64::from_be_bytes(data.try_into().map_err(|_| invalid())?);
+    match sql_type {
+        SqlType::Time => NaiveTime::from_num_seconds_from_midnight_opt(
+            micros.div_euclid(1_000_000) as u32,
+            (micros.rem_euclid(1_000_000) * 1000) as u32,
+        )
+        .map(Value::Time)
+        .ok_or_else(invalid),
+        _ => postgres_epoch()
+            .checked_add_signed(chrono::Duration::microseconds(micros))
+            .map(Value::Timestamp)
+            .ok_or_else(invalid),
+    }
+}
+
+/// A decimal in PostgreSQL's binary `numeric` format: the count of its base
+/// 10000 digits, the power of 10000 of the first, the sign and the number
+/// of decimals shown, each an int2, then the digits, leading and trailing
+/// zero digits left out
+fn binary_numeric(d: &Decimal) -> Vec<u8> {
+    let text = d.abs().to_string();
+    let (integer, fraction) = text.split_once('.').unwrap_or((&text, ""));
+    let integer = integer.trim_start_matches('0');
+    let padding = (4 - integer.len() % 4) % 4;
+    let digits_text = format!(
+        "{}{}{}{}",
+        "0".repeat(padding),
+        integer,
+        fraction,
+        "0".repeat((4 - fraction.len() % 4) % 4)
+    );
+    let mut digits: Vec<i16> = digits_text
+        .as_bytes()
+        .chunks(4)
+        .map(|chunk| chunk.iter().fold(0, |n, b| n * 10 + (b - b'0') as i16))
+        .collect();
+    let mut weight = ((padding + integer.len()) / 4) as i16 - 1;
+    let leading = digits.iter().take_while(|digit| **digit == 0).count();
+    digits.drain(..leading);
+    weight -= leading as i16;
+    while digits.last() == Some(&0) {
+        digits.pop();
+    }
+    if digits.is_empty() {
+        weight = 0;
+    }
+    let sign: u16 = if d.is_sign_negative() && !d.is_zero() {
+        0x4000
+    } else {
+        0
+    };
+
+    let mut buf = Vec::with_capacity(8 + 2 * digits.len());
+    buf.extend_from_slice(&(digits.len() as i16).to_be_bytes());
+    buf.extend_from_slice(&weight.to_be_bytes());
+    buf.extend_from_slice(&sign.to_be_bytes());
+    buf.extend_from_slice(&(d.scale() as u16).to_be_bytes());
+    for digit in digits {
+        buf.extend_from_slice(&digit.to_be_bytes());
+    }
+    buf
+}
+
+/// A `numeric` parameter a client sent in binary, as [`binary_numeric`]
+/// encodes it
+/// A document in jsonb's binary format: a version byte, 1, and the JSON text
+fn binary_jsonb(json: &serde_json::Value) -> Vec<u8> {
+    let mut bytes = vec![1];
+    bytes.extend_from_slice(json.to_string().as_bytes());
+    bytes
+}
+
+fn parse_binary_jsonb(data: &[u8]) -> crate::Result<Value> {
+    let Some((&1, text)) = data.split_first() else {
+        return Err(YamlBaseError::Protocol(
+            "Unsupported binary jsonb version".to_string(),
+        ));
+    };
+    serde_json::from_slice(text)
+        .map(Value::Json)
+        .map_err(|e| YamlBaseError::Protocol(format!("Invalid binary jsonb: {}", e)))
+}
+
+fn parse_binary_numeric(data: &[u8]) -> crate::Result<Value> {
+    let invalid = || YamlBaseError::Protocol("Invalid binary numeric parameter".to_string());
+    let field = |i: usize| {
+        data.get(i * 2..i * 2 + 2)
+            .map(|bytes| u16::from_be_bytes([bytes[0], bytes[1]]))
+            .ok_or_else(invalid)
+    };
+    let (count, weight, sign, scale) = (field(0)?, field(1)? as i16, field(2)?, field(3)?);
+    if sign == 0xC000 {
+        return Err(YamlBaseError::Protocol(
+            "NaN is not supported for numeric parameters".to_string(),
+        ));
+    }
+    let mut mantissa: i128 = 0;
+    for i in 0..count as usize {
+        let digit = field(4 + i)?;
+        mantissa = mantissa
+            .checked_mul(10000)
+            .and_then(|m| m.checked_add(digit as i128))
+            .ok_or_else(invalid)?;
+    }
+    // The digits count from 10000^weight down to 10000^(weight - count + 1)
+    let exponent = 4 * (weight as i64 - count as i64 + 1);
+    let mut value = match exponent {
+        0.. => Decimal::try_from_i128_with_scale(
+            mantissa
+                .checked_mul(10i128.checked_pow(exponent as u32).ok_or_else(invalid)?)
+                .ok_or_else(invalid)?,
+            0,
+        ),
+        _ => Decimal::try_from_i128_with_scale(mantissa, -exponent as u32),
+    }
+    .map_err(|_| invalid())?;
+    value.rescale(scale as u32);
+    if sign == 0x4000 {
+        value.set_sign_negative(true);
+    }
+    Ok(Value::Decimal(value))
 }
 
 async fn send_error_response(
@@ -832,9 +1515,59 @@ async fn send_error_response(
     Ok(())
 }
 
+/// Send a ParameterStatus with the value of a reported run-time parameter
+pub(crate) async fn send_parameter_status(
+    stream: &mut TcpStream,
+    name: &str,
+    value: &str,
+) -> crate::Result<()> {
+    let mut buf = BytesMut::new();
+    buf.put_u8(b'S');
+    let length = 4 + name.len() + 1 + value.len() + 1;
+    buf.put_u32(length as u32);
+    buf.put_slice(name.as_bytes());
+    buf.put_u8(0);
+    buf.put_slice(value.as_bytes());
+    buf.put_u8(0);
+
+    stream.write_all(&buf).await?;
+    Ok(())
+}
+
+/// Send a NoticeResponse with severity WARNING; clients show these without
+/// failing the query
+pub(crate) async fn send_notice_response(
+    stream: &mut TcpStream,
+    message: &str,
+) -> crate::Result<()> {
+    let mut buf = BytesMut::new();
+    buf.put_u8(b'N');
+
+    let notice_fields = vec![(b'S', "WARNING"), (b'C', "01000"), (b'M', message)];
+
+    let mut length = 4; // Length field
+    for (_, val) in &notice_fields {
+        length += 1 + val.len() + 1; // Field type + value + null
+    }
+    length += 1; // Final null
+
+    buf.put_u32(length as u32);
+
+    for (field_type, val) in notice_fields {
+        buf.put_u8(field_type);
+        buf.put_slice(val.as_bytes());
+        buf.put_u8(0);
+    }
+    buf.put_u8(0); // End of fields
+
+    stream.write_all(&buf).await?;
+    Ok(())
+}
+
 fn oid_to_sql_type(oid: u32) -> SqlType {
     match oid {
         16 => SqlType::Boolean,          // bool
+        17 => SqlType::Bytea,            // bytea
         20 => SqlType::BigInt,           // int8
         21 => SqlType::Integer,          // int2
         23 => SqlType::Integer,          // int4
@@ -846,6 +1579,7 @@ fn oid_to_sql_type(oid: u32) -> SqlType {
         1082 => SqlType::Date,           // date
         1083 => SqlType::Time,           // time
         1114 => SqlType::Timestamp,      // timestamp
+        1184 => SqlType::TimestampTz,    // timestamptz
         1700 => SqlType::Decimal(38, 0), // numeric
         2950 => SqlType::Uuid,           // uuid
         3802 => SqlType::Json,           // jsonb
@@ -853,6 +1587,116 @@ fn oid_to_sql_type(oid: u32) -> SqlType {
     }
 }
 
+/// Array types and the types of their elements
+const ARRAY_TYPES: [(u32, u32); 17] = [
+    (1000, 16),   // bool[]
+    (1001, 17),   // bytea[]
+    (1005, 21),   // int2[]
+    (1007, 23),   // int4[]
+    (1009, 25),   // text[]
+    (1014, 1042), // bpchar[]
+    (1015, 1043), // varchar[]
+    (1016, 20),   // int8[]
+    (1021, 700),  // float4[]
+    (1022, 701),  // float8[]
+    (1115, 1114), // timestamp[]
+    (1182, 1082), // date[]
+    (1183, 1083), // time[]
+    (1185, 1184), // timestamptz[]
+    (1231, 1700), // numeric[]
+    (2951, 2950), // uuid[]
+    (3807, 3802), // jsonb[]
+];
+
+/// The element type of the array types clients bind, as sqlx does for
+/// `id = ANY($1)`
+fn array_element_oid(oid: u32) -> Option<u32> {
+    ARRAY_TYPES
+        .iter()
+        .find(|(array, _)| *array == oid)
+        .map(|(_, element)| *element)
+}
+
+/// The type of arrays of an element type, text[] for types without one
+fn array_oid(element_oid: u32) -> u32 {
+    ARRAY_TYPES
+        .iter()
+        .find(|(_, element)| *element == element_oid)
+        .map_or(1009, |(array, _)| *array)
+}
+
+/// A parameter in the binary array format as the array literal a client
+/// would send as text, such as `{"1","2",NULL}`
+fn parse_binary_array(data: &[u8]) -> crate::Result<String> {
+    let incomplete = || YamlBaseError::Protocol("Incomplete array parameter".to_string());
+    let mut pos = 0;
+    let read_i32 = |pos: &mut usize| -> crate::Result<i32> {
+        let bytes = data.get(*pos..*pos + 4).ok_or_else(incomplete)?;
+        *pos += 4;
+        Ok(i32::from_be_bytes([bytes[0], bytes[1], bytes[2], bytes[3]]))
+    };
+
+    let dimensions = read_i32(&mut pos)?;
+    if !(0..=6).contains(&dimensions) {
+        return Err(YamlBaseError::Protocol(format!(
+            "Invalid array dimensions: {}",
+            dimensions
+        )));
+    }
+    let _has_nulls = read_i32(&mut pos)?;
+    let element_type = oid_to_sql_type(read_i32(&mut pos)? as u32);
+    let mut lengths = Vec::new();
+    for _ in 0..dimensions {
+        let length = usize::try_from(read_i32(&mut pos)?).map_err(|_| incomplete())?;
+        let _lower_bound = read_i32(&mut pos)?;
+        lengths.push(length);
+    }
+    if lengths.is_empty() {
+        return Ok("{}".to_string());
+    }
+
+    let count = lengths
+        .iter()
+        .try_fold(1usize, |count, length| count.checked_mul(*length))
+        .ok_or_else(incomplete)?;
+    let mut elements = Vec::new();
+    for _ in 0..count {
+        let length = read_i32(&mut pos)?;
+        if length == -1 {
+            elements.push("NULL".to_string());
+            continue;
+        }
+        let start = pos;
+        let end = usize::try_from(length)
+            .ok()
+            .and_then(|length| start.checked_add(length))
+            .ok_or_else(incomplete)?;
+        let bytes = data.get(start..end).ok_or_else(incomplete)?;
+        pos = end;
+        let text = match element_type {
+            SqlType::Bytea => bytea::to_text(bytes),
+            SqlType::Uuid => parse_binary_uuid(bytes)?.to_string(),
+            _ => parse_parameter_value(bytes, &element_type)?.to_string(),
+        };
+        elements.push(format!(
+            "\"{}\"",
+            text.replace('\\', "\\\\").replace('"', "\\\"")
+        ));
+    }
+    Ok(nest_array(&lengths, &mut elements.into_iter()))
+}
+
+/// Elements laid out as an array literal with the given dimension lengths
+fn nest_array(lengths: &[usize], elements: &mut impl Iterator<Item = String>) -> String {
+    match lengths.split_first() {
+        None => elements.next().unwrap_or_default(),
+        Some((length, inner)) => {
+            let items: Vec<String> = (0..*length).map(|_| nest_array(inner, elements)).collect();
+            format!("{{{}}}", items.join(","))
+        }
+    }
+}
+
 fn sql_type_to_oid(sql_type: &SqlType) -> u32 {
     match sql_type {
         SqlType::Boolean => 16,
@@ -867,8 +1711,20 @@ fn sql_type_to_oid(sql_type: &SqlType) -> u32 {
         SqlType::Date => 1082,
         SqlType::Time => 1083,
         SqlType::Timestamp => 1114,
+        SqlType::TimestampTz => 1184,
         SqlType::Uuid => 2950,
         SqlType::Json => 3802,
+        // Points are sent as WKT, like ST_AsText output
+        SqlType::Point => 25,
+        // Amounts go out as numeric at their currency's scale, which clients
+        // read exactly, unlike money's locale-formatted text
+        SqlType::Money(_) => 1700,
+        // hstore's OID depends on the installation, so clients get its text form
+        SqlType::Hstore => 25,
+        SqlType::Bytea => 17,
+        // The enum type pg_type describes
+        SqlType::Enum(labels) => enums::oid(labels),
+        SqlType::Array(element) => array_oid(sql_type_to_oid(element)),
     }
 }
 
@@ -877,6 +1733,30 @@ fn substitute_parameters(statement: &mut Statement, parameters: &[Value]) -> cra
         Statement::Query(query) => {
             substitute_parameters_in_query(query, parameters)?;
         }
+        Statement::Insert(insert) => {
+            if let Some(source) = &mut insert.source {
+                substitute_parameters_in_query(source, parameters)?;
+            }
+        }
+        Statement::Update {
+            assignments,
+            selection,
+            ..
+        } => {
+            for assignment in assignments {
+                substitute_parameters_in_expr(&mut assignment.value, parameters)?;
+            }
+            if let Some(selection) = selection {
+                substitute_parameters_in_expr(selection, parameters)?;
+            }
+        }
+        Statement::Delete(delete) => {
+            if let Some(selection) = &mut delete.selection {
+                substitute_parameters_in_expr(selection, parameters)?;
+            }
+        }
+        // DDL and other statements run as written when they take no parameters
+        _ if parameters.is_empty() => {}
         _ => {
             return Err(YamlBaseError::Protocol(
                 "Parameter substitution only supported for queries".to_string(),
@@ -890,14 +1770,69 @@ fn substitute_parameters_in_query(
     query: &mut sqlparser::ast::Query,
     parameters: &[Value],
 ) -> crate::Result<()> {
-    if let sqlparser::ast::SetExpr::Select(select) = &mut *query.body {
-        if let Some(selection) = &mut select.selection {
-            substitute_parameters_in_expr(selection, parameters)?;
+    substitute_parameters_in_set_expr(&mut query.body, parameters)?;
+    // `LIMIT $1 OFFSET $2`, as ORMs paginate
+    if let Some(limit) = &mut query.limit {
+        substitute_parameters_in_expr(limit, parameters)?;
+    }
+    if let Some(offset) = &mut query.offset {
+        substitute_parameters_in_expr(&mut offset.value, parameters)?;
+    }
+    if let Some(quantity) = query
+        .fetch
+        .as_mut()
+        .and_then(|fetch| fetch.quantity.as_mut())
+    {
+        substitute_parameters_in_expr(quantity, parameters)?;
+    }
+    Ok(())
+}
+
+fn substitute_parameters_in_set_expr(
+    body: &mut sqlparser::ast::SetExpr,
+    parameters: &[Value],
+) -> crate::Result<()> {
+    match body {
+        sqlparser::ast::SetExpr::Select(select) => {
+            if let Some(selection) = &mut select.selection {
+                substitute_parameters_in_expr(selection, parameters)?;
+            }
+        }
+        // Every operand of UNION / INTERSECT / EXCEPT
+        sqlparser::ast::SetExpr::SetOperation { left, right, .. } => {
+            substitute_parameters_in_set_expr(left, parameters)?;
+            substitute_parameters_in_set_expr(right, parameters)?;
+        }
+        sqlparser::ast::SetExpr::Query(query) => {
+            substitute_parameters_in_query(query, parameters)?;
         }
+        sqlparser::ast::SetExpr::Values(values) => {
+            for expr in values.rows.iter_mut().flatten() {
+                substitute_parameters_in_expr(expr, parameters)?;
+            }
+        }
+        _ => {}
     }
     Ok(())
 }
 
+/// The SELECT a write's RETURNING list stands for, which describes its rows
+fn returning_select(statement: &sqlparser::ast::Statement) -> Option<sqlparser::ast::Select> {
+    let query = crate::sql::returning::returning_query(statement)?;
+    leftmost_select(&query.body).cloned()
+}
+
+/// The SELECT that determines a query's result columns: the query itself, or
+/// the first operand of a set operation
+fn leftmost_select(body: &sqlparser::ast::SetExpr) -> Option<&sqlparser::ast::Select> {
+    match body {
+        sqlparser::ast::SetExpr::Select(select) => Some(select),
+        sqlparser::ast::SetExpr::SetOperation { left, .. } => leftmost_select(left),
+        sqlparser::ast::SetExpr::Query(query) => leftmost_select(&query.body),
+        _ => None,
+    }
+}
+
 fn substitute_parameters_in_expr(expr: &mut Expr, parameters: &[Value]) -> crate::Result<()> {
     match expr {
         Expr::Value(SqlValue::Placeholder(s)) => {
@@ -960,13 +1895,28 @@ fn substitute_parameters_in_expr(expr: &mut Expr, parameters: &[Value]) -> crate
                 substitute_parameters_in_expr(else_res, parameters)?;
             }
         }
-        Expr::Nested(inner) => {
+        Expr::Nested(inner) | Expr::Cast { expr: inner, .. } => {
             substitute_parameters_in_expr(inner, parameters)?;
         }
+        // `id = ANY($1)` with an array parameter, or `x > ALL (SELECT ... WHERE y = $1)`
+        Expr::AnyOp { left, right, .. } | Expr::AllOp { left, right, .. } => {
+            substitute_parameters_in_expr(left, parameters)?;
+            match right.as_mut() {
+                Expr::Subquery(query) => substitute_parameters_in_query(query, parameters)?,
+                right => substitute_parameters_in_expr(right, parameters)?,
+            }
+        }
+        Expr::Array(array) => {
+            for element in &mut array.elem {
+                substitute_parameters_in_expr(element, parameters)?;
+            }
+        }
         Expr::IsNull(inner) | Expr::IsNotNull(inner) => {
             substitute_parameters_in_expr(inner, parameters)?;
         }
-        Expr::Like { expr, pattern, .. } => {
+        Expr::Like { expr, pattern, .. }
+        | Expr::ILike { expr, pattern, .. }
+        | Expr::RLike { expr, pattern, .. } => {
             substitute_parameters_in_expr(expr, parameters)?;
             substitute_parameters_in_expr(pattern, parameters)?;
         }
@@ -975,23 +1925,6 @@ fn substitute_parameters_in_expr(expr: &mut Expr, parameters: &[Value]) -> crate
     Ok(())
 }
 
-fn value_to_sql_expr(value: &Value) -> Expr {
-    match value {
-        Value::Null => Expr::Value(SqlValue::Null),
-        Value::Boolean(b) => Expr::Value(SqlValue::Boolean(*b)),
-        Value::Integer(i) => Expr::Value(SqlValue::Number(i.to_string(), false)),
-        Value::Float(f) => Expr::Value(SqlValue::Number(f.to_string(), false)),
-        Value::Double(d) => Expr::Value(SqlValue::Number(d.to_string(), false)),
-        Value::Text(s) => Expr::Value(SqlValue::SingleQuotedString(s.clone())),
-        Value::Date(d) => Expr::Value(SqlValue::SingleQuotedString(d.to_string())),
-        Value::Time(t) => Expr::Value(SqlValue::SingleQuotedString(t.to_string())),
-        Value::Timestamp(ts) => Expr::Value(SqlValue::SingleQuotedString(ts.to_string())),
-        Value::Uuid(u) => Expr::Value(SqlValue::SingleQuotedString(u.to_string())),
-        Value::Json(j) => Expr::Value(SqlValue::SingleQuotedString(j.to_string())),
-        Value::Decimal(d) => Expr::Value(SqlValue::Number(d.to_string(), false)),
-    }
-}
-
 fn infer_parameter_types(query: &sqlparser::ast::Query) -> Vec<SqlType> {
     let mut parameter_types = std::collections::HashMap::new();
 
@@ -1020,6 +1953,114 @@ fn infer_parameter_types(query: &sqlparser::ast::Query) -> Vec<SqlType> {
     result
 }
 
+/// Types of the placeholders in `INSERT ... VALUES`: a placeholder standing
+/// alone in a row takes the type of the column it fills
+fn infer_insert_parameter_types(insert: &Insert, db: &Database) -> Vec<SqlType> {
+    let Some(sqlparser::ast::SetExpr::Values(values)) =
+        insert.source.as_deref().map(|source| source.body.as_ref())
+    else {
+        return Vec::new();
+    };
+    let table = insert
+        .table_name
+        .0
+        .last()
+        .and_then(|ident| db.get_table(&ident.value));
+    let Some(table) = table else {
+        return Vec::new();
+    };
+    let targets: Vec<Option<&SqlType>> = if insert.columns.is_empty() {
+        table
+            .columns
+            .iter()
+            .map(|column| Some(&column.sql_type))
+            .collect()
+    } else {
+        insert
+            .columns
+            .iter()
+            .map(|ident| {
+                table
+                    .columns
+                    .iter()
+                    .find(|column| column.name.eq_ignore_ascii_case(&ident.value))
+                    .map(|column| &column.sql_type)
+            })
+            .collect()
+    };
+
+    let mut parameter_types = std::collections::HashMap::new();
+    for row in &values.rows {
+        for (expr, sql_type) in row.iter().zip(&targets) {
+            if let (Expr::Value(SqlValue::Placeholder(s)), Some(sql_type)) = (expr, sql_type) {
+                if let Some(param_num) = s.strip_prefix('$').and_then(|n| n.parse::<usize>().ok()) {
+                    parameter_types.insert(param_num, (*sql_type).clone());
+                }
+            }
+        }
+    }
+
+    let max_param = parameter_types.keys().max().copied().unwrap_or(0);
+    (1..=max_param)
+        .map(|i| parameter_types.remove(&i).unwrap_or(SqlType::Text))
+        .collect()
+}
+
+/// Types of the placeholders in an UPDATE: one assigned to a column takes the
+/// column's type, and ones in the WHERE clause are inferred as for a SELECT
+fn infer_update_parameter_types(
+    table: &sqlparser::ast::TableWithJoins,
+    assignments: &[sqlparser::ast::Assignment],
+    selection: Option<&Expr>,
+    db: &Database,
+) -> Vec<SqlType> {
+    let mut parameter_types = std::collections::HashMap::new();
+    let table = match &table.relation {
+        sqlparser::ast::TableFactor::Table { name, .. } => {
+            name.0.last().and_then(|ident| db.get_table(&ident.value))
+        }
+        _ => None,
+    };
+    if let Some(table) = table {
+        for assignment in assignments {
+            let (
+                sqlparser::ast::AssignmentTarget::ColumnName(column),
+                Expr::Value(SqlValue::Placeholder(s)),
+            ) = (&assignment.target, &assignment.value)
+            else {
+                continue;
+            };
+            let sql_type = column.0.last().and_then(|ident| {
+                table
+                    .columns
+                    .iter()
+                    .find(|c| c.name.eq_ignore_ascii_case(&ident.value))
+                    .map(|c| c.sql_type.clone())
+            });
+            let param_num = s.strip_prefix('$').and_then(|n| n.parse::<usize>().ok());
+            if let (Some(sql_type), Some(param_num)) = (sql_type, param_num) {
+                parameter_types.insert(param_num, sql_type);
+            }
+        }
+    }
+    infer_where_parameter_types(selection, parameter_types)
+}
+
+/// `parameter_types` with the placeholders of a WHERE clause added, in
+/// placeholder order
+fn infer_where_parameter_types(
+    selection: Option<&Expr>,
+    mut parameter_types: std::collections::HashMap<usize, SqlType>,
+) -> Vec<SqlType> {
+    if let Some(selection) = selection {
+        infer_types_in_expr(selection, &mut parameter_types);
+    }
+    let max_param = parameter_types.keys().max().copied().unwrap_or(0);
+    (1..=max_param)
+        .map(|i| parameter_types.remove(&i).unwrap_or(SqlType::Text))
+        .collect()
+}
+
 fn infer_types_in_expr(
     expr: &Expr,
     parameter_types: &mut std::collections::HashMap<usize, SqlType>,
@@ -1100,11 +2141,24 @@ fn infer_types_in_expr(
         Expr::Nested(inner) => {
             infer_types_in_expr(inner, parameter_types);
         }
+        // `id = ANY($1)` takes an array, described as text and bound as an array literal
+        Expr::AnyOp { left, right, .. } | Expr::AllOp { left, right, .. } => {
+            infer_types_in_expr(left, parameter_types);
+            if let Expr::Value(SqlValue::Placeholder(s)) = &**right {
+                if let Some(num_str) = s.strip_prefix('$') {
+                    if let Ok(param_num) = num_str.parse::<usize>() {
+                        parameter_types.insert(param_num, SqlType::Text);
+                    }
+                }
+            }
+        }
         Expr::IsNull(inner) | Expr::IsNotNull(inner) => {
             infer_types_in_expr(inner, parameter_types);
         }
-        Expr::Like { expr, pattern, .. } => {
-            // For LIKE expressions, both sides should be text
+        Expr::Like { expr, pattern, .. }
+        | Expr::ILike { expr, pattern, .. }
+        | Expr::RLike { expr, pattern, .. } => {
+            // For pattern matches, both sides should be text
             infer_types_in_expr(expr, parameter_types);
 
             // If the pattern is a parameter, mark it as text
@@ -1169,6 +2223,57 @@ fn infer_types_in_projection_expr(
     }
 }
 
+/// Read the NUL-terminated string at `*pos` and move past it. A missing
+/// terminator takes the rest of the message.
+fn read_cstr<'a>(data: &'a [u8], pos: &mut usize, what: &str) -> crate::Result<&'a str> {
+    let rest = data.get(*pos..).unwrap_or_default();
+    let end = rest.iter().position(|&b| b == 0).unwrap_or(rest.len());
+    let text = std::str::from_utf8(&rest[..end])
+        .map_err(|_| YamlBaseError::Protocol(format!("Invalid UTF-8 in {}", what)))?;
+    *pos = (*pos + end + 1).min(data.len());
+    Ok(text)
+}
+
+/// A uuid parameter sent in binary: its 16 bytes
+fn parse_binary_uuid(data: &[u8]) -> crate::Result<Value> {
+    uuid::Uuid::from_slice(data)
+        .map(Value::Uuid)
+        .map_err(|_| YamlBaseError::Protocol("Invalid binary uuid".to_string()))
+}
+
+/// A parameter sent as text, parsed as the type it was described with
+fn parse_text_parameter(data: &[u8], sql_type: &SqlType) -> crate::Result<Value> {
+    let text = std::str::from_utf8(data)
+        .map_err(|_| YamlBaseError::Protocol("Invalid UTF-8 in parameter".to_string()))?;
+    let invalid = |type_name: &str| {
+        YamlBaseError::Protocol(format!(
+            "invalid input syntax for type {}: \"{}\"",
+            type_name, text
+        ))
+    };
+    let trimmed = text.trim();
+    match sql_type {
+        SqlType::Integer | SqlType::BigInt => trimmed
+            .parse()
+            .map(Value::Integer)
+            .map_err(|_| invalid("integer")),
+        SqlType::Float => trimmed
+            .parse()
+            .map(Value::Float)
+            .map_err(|_| invalid("real")),
+        SqlType::Double => trimmed
+            .parse()
+            .map(Value::Double)
+            .map_err(|_| invalid("double precision")),
+        SqlType::Boolean => match trimmed.to_ascii_lowercase().as_str() {
+            "t" | "true" | "y" | "yes" | "on" | "1" => Ok(Value::Boolean(true)),
+            "f" | "false" | "n" | "no" | "off" | "0" => Ok(Value::Boolean(false)),
+            _ => Err(invalid("boolean")),
+        },
+        _ => Ok(Value::Text(text.to_string())),
+    }
+}
+
 fn parse_parameter_value(data: &[u8], sql_type: &SqlType) -> crate::Result<Value> {
     match sql_type {
         SqlType::Integer => {
@@ -1242,3 +2347,231 @@ fn parse_parameter_value(data: &[u8], sql_type: &SqlType) -> crate::Result<Value
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_dates_and_times_round_trip_in_binary() {
+        let at = NaiveDate::from_ymd_opt(2024, 1, 31)
+            .unwrap()
+            .and_hms_micro_opt(12, 30, 0, 250)
+            .unwrap();
+        let cases = [
+            (Value::Date(at.date()), SqlType::Date),
+            (
+                Value::Date(NaiveDate::from_ymd_opt(1999, 12, 31).unwrap()),
+                SqlType::Date,
+            ),
+            (Value::Time(at.time()), SqlType::Time),
+            (Value::Timestamp(at), SqlType::Timestamp),
+            (Value::Timestamp(at), SqlType::TimestampTz),
+        ];
+        for (value, sql_type) in cases {
+            let bytes = binary_temporal(&value).unwrap();
+            assert_eq!(parse_binary_temporal(&bytes, &sql_type).unwrap(), value);
+        }
+        // The epoch itself is zero
+        assert_eq!(
+            binary_temporal(&Value::Timestamp(postgres_epoch())).unwrap(),
+            0i64.to_be_bytes()
+        );
+        assert!(parse_binary_temporal(&[0, 1], &SqlType::Date).is_err());
+
+        let plus_two = timezone::parse_offset("+02").unwrap();
+        let utc_noon = at.date().and_hms_opt(12, 0, 0).unwrap();
+        assert_eq!(
+            text_value(
+                &Value::Timestamp(utc_noon),
+                Some(&SqlType::TimestampTz),
+                plus_two
+            ),
+            "2024-01-31 14:00:00+02"
+        );
+        assert_eq!(
+            text_value(
+                &Value::Timestamp(utc_noon),
+                Some(&SqlType::Timestamp),
+                plus_two
+            ),
+            "2024-01-31 12:00:00"
+        );
+        assert_eq!(
+            text_value(&Value::Timestamp(at), Some(&SqlType::Timestamp), plus_two),
+            "2024-01-31 12:30:00.000250"
+        );
+    }
+
+    #[test]
+    fn test_portal_runs_keep_only_the_rows_left_to_send() {
+        let completion = Completion {
+            result: Some(QueryResult {
+                columns: vec!["n".to_string()],
+                column_types: vec![SqlType::Integer],
+                rows: (1..=3).map(|n| vec![Value::Integer(n)]).collect(),
+            }),
+            tag: "SELECT 3".to_string(),
+            reports: vec![],
+        };
+        let mut run = PortalRun::new(completion);
+        assert!(run.completion.result.as_ref().unwrap().rows.is_empty());
+        let batch: Vec<_> = run.rows.by_ref().take(2).collect();
+        assert_eq!(batch, [vec![Value::Integer(1)], vec![Value::Integer(2)]]);
+        assert_eq!(run.rows.as_slice(), [vec![Value::Integer(3)]]);
+    }
+
+    #[test]
+    fn test_decimals_round_trip_in_binary() {
+        let decimal = |s: &str| s.parse::<Decimal>().unwrap();
+        // 12.50 is the digits 12 and 5000, the first at 10000^0, shown with 2 decimals
+        assert_eq!(
+            binary_numeric(&decimal("12.50")),
+            [0, 2, 0, 0, 0, 0, 0, 2, 0, 12, 0x13, 0x88]
+        );
+        for text in [
+            "12.50",
+            "-12.50",
+            "0",
+            "0.00",
+            "0.0001",
+            "123456789.123456789",
+            "10000",
+            "-0.5",
+        ] {
+            let value = decimal(text);
+            let bytes = binary_numeric(&value);
+            match parse_binary_numeric(&bytes).unwrap() {
+                Value::Decimal(d) => assert_eq!(d.to_string(), value.to_string()),
+                other => panic!("Expected a decimal, got {:?}", other),
+            }
+        }
+        assert!(parse_binary_numeric(&[0, 1]).is_err());
+    }
+
+    #[test]
+    fn test_jsonb_round_trips_in_binary() {
+        let json = serde_json::json!({"tags": ["a", "b"], "n": 1});
+        let bytes = binary_jsonb(&json);
+        assert_eq!(bytes[0], 1);
+        assert_eq!(parse_binary_jsonb(&bytes).unwrap(), Value::Json(json));
+        assert!(parse_binary_jsonb(b"{}").is_err());
+    }
+
+    #[test]
+    fn test_arrays_in_binary() {
+        let tags = Value::Text("{1,NULL,3}".to_string());
+        let integer = SqlType::Integer;
+        let bytes = binary_array(&tags, &integer, timezone::utc()).unwrap();
+        assert_eq!(&bytes[..12], &[0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 23]);
+        assert_eq!(parse_binary_array(&bytes).unwrap(), r#"{"1",NULL,"3"}"#);
+        let empty = binary_array(&Value::Text("{}".to_string()), &integer, timezone::utc());
+        assert_eq!(parse_binary_array(&empty.unwrap()).unwrap(), "{}");
+
+        let text_array = SqlType::Array(Box::new(SqlType::Text));
+        assert_eq!(sql_type_to_oid(&text_array), 1009);
+        assert_eq!(sql_type_to_oid(&SqlType::Array(Box::new(integer))), 1007);
+        assert_eq!(array_element_oid(1007), Some(23));
+    }
+
+    #[test]
+    fn test_text_parameters_are_parsed_as_their_type() {
+        let parse =
+            |text: &str, sql_type: SqlType| parse_text_parameter(text.as_bytes(), &sql_type);
+        assert_eq!(parse("42", SqlType::Integer).unwrap(), Value::Integer(42));
+        assert_eq!(parse("-7", SqlType::BigInt).unwrap(), Value::Integer(-7));
+        assert_eq!(parse("1.5", SqlType::Double).unwrap(), Value::Double(1.5));
+        assert_eq!(parse("f", SqlType::Boolean).unwrap(), Value::Boolean(false));
+        assert_eq!(
+            parse("TRUE", SqlType::Boolean).unwrap(),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            parse("42", SqlType::Text).unwrap(),
+            Value::Text("42".to_string())
+        );
+        assert!(parse("4x", SqlType::Integer).is_err());
+        assert!(parse("maybe", SqlType::Boolean).is_err());
+    }
+
+    #[test]
+    fn test_uuids_in_binary() {
+        let id = uuid::Uuid::parse_str("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11").unwrap();
+        let bytes = binary_value(&Value::Uuid(id), Some(&SqlType::Uuid), timezone::utc());
+        assert_eq!(bytes.len(), 16);
+        assert_eq!(bytes[0], 0xa0);
+        assert_eq!(parse_binary_uuid(&bytes).unwrap(), Value::Uuid(id));
+        assert!(parse_binary_uuid(&bytes[..15]).is_err());
+
+        // Text parameters are left for the column to parse
+        let text = id.to_string();
+        assert_eq!(
+            parse_parameter_value(text.as_bytes(), &SqlType::Uuid).unwrap(),
+            Value::Text(text)
+        );
+
+        // The elements of a uuid[] are sent the same way
+        let ids = Value::Text(format!("{{{}}}", id));
+        let uuids = binary_array(&ids, &SqlType::Uuid, timezone::utc()).unwrap();
+        assert_eq!(&uuids[8..12], &2950u32.to_be_bytes());
+        assert_eq!(
+            parse_binary_array(&uuids).unwrap(),
+            format!("{{\"{}\"}}", id)
+        );
+    }
+
+    #[test]
+    fn test_values_are_sent_in_binary_as_their_described_type() {
+        let utc = timezone::utc();
+        let send = |val: Value, sql_type: SqlType| binary_value(&val, Some(&sql_type), utc);
+        assert_eq!(
+            send(Value::Integer(3), SqlType::Integer),
+            3i32.to_be_bytes()
+        );
+        assert_eq!(send(Value::Integer(3), SqlType::BigInt), 3i64.to_be_bytes());
+        assert_eq!(send(Value::Integer(3), SqlType::Double), 3f64.to_be_bytes());
+        assert_eq!(
+            send(Value::Float(0.5), SqlType::Double),
+            0.5f64.to_be_bytes()
+        );
+        assert_eq!(
+            send(Value::Double(0.5), SqlType::Float),
+            0.5f32.to_be_bytes()
+        );
+        assert_eq!(
+            send(Value::Integer(12), SqlType::Decimal(10, 2)),
+            binary_numeric(&Decimal::from(12))
+        );
+        assert_eq!(send(Value::Integer(1), SqlType::Boolean), [1]);
+
+        let day = NaiveDate::from_ymd_opt(2024, 1, 31).unwrap();
+        assert_eq!(
+            send(Value::Text("2024-01-31".to_string()), SqlType::Date),
+            binary_temporal(&Value::Date(day)).unwrap()
+        );
+        assert_eq!(
+            send(Value::Date(day), SqlType::Timestamp),
+            binary_temporal(&Value::Timestamp(day.and_time(NaiveTime::MIN))).unwrap()
+        );
+        let id = "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11";
+        assert_eq!(send(Value::Text(id.to_string()), SqlType::Uuid).len(), 16);
+
+        // Text types, and columns of no known type, which are described as text
+        assert_eq!(send(Value::Integer(3), SqlType::Text), b"3");
+        assert_eq!(binary_value(&Value::Integer(3), None, utc), b"3");
+    }
+
+    #[test]
+    fn test_binary_strings_in_binary() {
+        let png = Value::Text("\\x89504e47".to_string());
+        let bytes = binary_value(&png, Some(&SqlType::Bytea), timezone::utc());
+        assert_eq!(bytes, vec![0x89, b'P', b'N', b'G']);
+        // Text format gets the hex text
+        assert_eq!(
+            text_value(&png, Some(&SqlType::Bytea), timezone::utc()),
+            "\\x89504e47"
+        );
+        assert_eq!(sql_type_to_oid(&SqlType::Bytea), 17);
+        assert_eq!(oid_to_sql_type(17), SqlType::Bytea);
+    }
+}
@@ -0,0 +1,923 @@
+//! The session state of one PostgreSQL connection: the run-time parameters
+//! read with `SHOW` and changed with `SET`, `RESET` and `DISCARD ALL`, and
+//! the transaction status sent with every ReadyForQuery.
+//!
+//! Connection poolers lean on both. pgbouncer replays each client's startup
+//! parameters on the server connection it hands out with `SET`, keeps the
+//! values reported back in ParameterStatus messages, cleans a connection up
+//! with `DISCARD ALL` before reusing it, and in transaction pooling only
+//! takes a connection back once ReadyForQuery says it is idle. A statement
+//! that fails inside a transaction block aborts it, and everything up to the
+//! closing `COMMIT` or `ROLLBACK` is refused, as in PostgreSQL.
+//!
+//! The session also keeps the cursors of `DECLARE name CURSOR FOR query`,
+//! which ODBC drivers such as psqlODBC declare for every result set when
+//! `UseDeclareFetch` is on, as Tableau has it, and read with `FETCH n IN
+//! name` until it comes back short. The query runs when the cursor is
+//! declared; its rows are handed out in order, and a cursor goes away with
+//! `CLOSE`, `DISCARD ALL` or, unless declared `WITH HOLD`, the end of its
+//! transaction.
+
+use chrono::FixedOffset;
+use sqlparser::ast::{
+    CloseCursor, DiscardObject, Expr, FetchDirection, ObjectType, Query, Statement,
+    Value as SqlValue,
+};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+
+use crate::database::{Value, timezone};
+use crate::sql::executor::QueryResult;
+use crate::yaml::schema::SqlType;
+
+/// The built-in parameters and their values, under PostgreSQL's spelling
+const BUILT_IN: &[(&str, &str)] = &[
+    ("application_name", ""),
+    ("client_encoding", "UTF8"),
+    ("DateStyle", "ISO, MDY"),
+    ("default_transaction_isolation", "read committed"),
+    ("extra_float_digits", "1"),
+    ("integer_datetimes", "on"),
+    ("IntervalStyle", "postgres"),
+    ("is_superuser", "off"),
+    ("max_identifier_length", "63"),
+    ("search_path", "\"$user\", public"),
+    ("server_encoding", "UTF8"),
+    ("server_version", "14.0"),
+    ("session_authorization", ""),
+    ("standard_conforming_strings", "on"),
+    ("statement_timeout", "0"),
+    ("TimeZone", "UTC"),
+    ("transaction_isolation", "read committed"),
+];
+
+/// Parameters whose values are sent in ParameterStatus at startup and again
+/// whenever they change
+const REPORTED: &[&str] = &[
+    "application_name",
+    "client_encoding",
+    "DateStyle",
+    "integer_datetimes",
+    "IntervalStyle",
+    "is_superuser",
+    "server_encoding",
+    "server_version",
+    "session_authorization",
+    "standard_conforming_strings",
+    "TimeZone",
+];
+
+/// Parameters fixed when the server starts
+const READ_ONLY: &[&str] = &[
+    "integer_datetimes",
+    "is_superuser",
+    "max_identifier_length",
+    "server_encoding",
+    "server_version",
+    "session_authorization",
+];
+
+/// Startup packet entries that are not run-time parameters
+const NOT_PARAMETERS: &[&str] = &["user", "database", "options", "replication"];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TransactionStatus {
+    Idle,
+    InTransaction,
+    /// A statement failed inside the transaction block
+    Failed,
+}
+
+impl TransactionStatus {
+    /// The status byte of ReadyForQuery
+    pub fn indicator(self) -> u8 {
+        match self {
+            TransactionStatus::Idle => b'I',
+            TransactionStatus::InTransaction => b'T',
+            TransactionStatus::Failed => b'E',
+        }
+    }
+}
+
+/// An error for the client, with its SQLSTATE
+#[derive(Debug, Clone, PartialEq)]
+pub struct SqlError {
+    pub code: &'static str,
+    pub message: String,
+}
+
+impl SqlError {
+    pub fn new(code: &'static str, message: impl Into<String>) -> Self {
+        Self {
+            code,
+            message: message.into(),
+        }
+    }
+}
+
+/// What a statement did: the rows it returned, if it is a query, its command
+/// tag, and the reported parameters it changed
+#[derive(Debug)]
+pub struct Completion {
+    pub result: Option<QueryResult>,
+    pub tag: String,
+    pub reports: Vec<(&'static str, String)>,
+}
+
+impl Completion {
+    pub fn tag(tag: impl Into<String>) -> Self {
+        Self {
+            result: None,
+            tag: tag.into(),
+            reports: vec![],
+        }
+    }
+}
+
+/// Session commands the SQL parser does not know
+#[derive(Debug, PartialEq)]
+pub enum SessionCommand {
+    /// `RESET ALL`
+    ResetAll,
+    /// `RESET name`
+    Reset(String),
+    /// `LISTEN channel`
+    Listen(String),
+    /// `UNLISTEN channel`, or `UNLISTEN *` for `None`
+    Unlisten(Option<String>),
+}
+
+impl SessionCommand {
+    /// Whether the command also resets the executor's `yamlbase.*` settings
+    pub fn resets_executor(&self) -> bool {
+        match self {
+            SessionCommand::ResetAll => true,
+            SessionCommand::Reset(name) => name.to_lowercase().starts_with("yamlbase."),
+            _ => false,
+        }
+    }
+}
+
+/// The session command one statement of a query is, if it is one
+pub fn parse_session_command(statement: &str) -> Option<SessionCommand> {
+    let words: Vec<&str> = statement
+        .trim()
+        .trim_end_matches(';')
+        .split_whitespace()
+        .collect();
+    let (command, name) = match words.as_slice() {
+        [command, name] => (command.to_uppercase(), *name),
+        _ => return None,
+    };
+    // Unquoted names fold to lower case, as in PostgreSQL
+    let identifier = match name
+        .strip_prefix('"')
+        .and_then(|name| name.strip_suffix('"'))
+    {
+        Some(quoted) => quoted.to_string(),
+        None => name.to_lowercase(),
+    };
+    match command.as_str() {
+        "RESET" if name.eq_ignore_ascii_case("ALL") => Some(SessionCommand::ResetAll),
+        "RESET" => Some(SessionCommand::Reset(identifier)),
+        "LISTEN" => Some(SessionCommand::Listen(identifier)),
+        "UNLISTEN" if name == "*" => Some(SessionCommand::Unlisten(None)),
+        "UNLISTEN" => Some(SessionCommand::Unlisten(Some(identifier))),
+        _ => None,
+    }
+}
+
+#[derive(Debug)]
+pub struct Session {
+    /// Current values, by lowercased name
+    parameters: BTreeMap<String, String>,
+    /// The values `RESET` goes back to: the built-in ones, overridden by the
+    /// startup packet
+    defaults: BTreeMap<String, String>,
+    /// Channels from `LISTEN`; nothing is ever notified, but poolers expect
+    /// `UNLISTEN *` to work
+    channels: BTreeSet<String>,
+    cursors: HashMap<String, Cursor>,
+    status: TransactionStatus,
+}
+
+/// An open cursor, holding the rows of its query
+#[derive(Debug)]
+struct Cursor {
+    result: QueryResult,
+    /// Rows already fetched
+    position: usize,
+    /// Whether it was declared `WITH HOLD`, to outlive its transaction
+    hold: bool,
+}
+
+/// The cursor a `DECLARE ... CURSOR FOR query` opens
+pub struct CursorDeclaration<'a> {
+    pub name: String,
+    pub query: &'a Query,
+    pub hold: bool,
+}
+
+impl<'a> CursorDeclaration<'a> {
+    pub fn of(statement: &'a Statement) -> Option<Self> {
+        let Statement::Declare { stmts } = statement else {
+            return None;
+        };
+        let [declare] = stmts.as_slice() else {
+            return None;
+        };
+        Some(Self {
+            name: declare.names.first()?.value.clone(),
+            query: declare.for_query.as_deref()?,
+            hold: declare.hold == Some(true),
+        })
+    }
+}
+
+impl Default for Session {
+    fn default() -> Self {
+        Self::new(&HashMap::new(), "UTC")
+    }
+}
+
+impl Session {
+    /// A session for the parameters of a startup packet, in the server's
+    /// `--timezone` unless the client asks for another
+    pub fn new(startup: &HashMap<String, String>, timezone: &str) -> Self {
+        let mut defaults: BTreeMap<String, String> = BUILT_IN
+            .iter()
+            .map(|(name, value)| (name.to_lowercase(), value.to_string()))
+            .collect();
+        defaults.insert("timezone".to_string(), timezone.to_string());
+        for (name, value) in startup {
+            let key = name.to_lowercase();
+            if NOT_PARAMETERS.contains(&key.as_str()) || is_read_only(&key) {
+                continue;
+            }
+            defaults.insert(key, value.clone());
+        }
+        if let Some(user) = startup.get("user") {
+            defaults.insert("session_authorization".to_string(), user.clone());
+        }
+        Self {
+            parameters: defaults.clone(),
+            defaults,
+            channels: BTreeSet::new(),
+            cursors: HashMap::new(),
+            status: TransactionStatus::Idle,
+        }
+    }
+
+    pub fn status(&self) -> TransactionStatus {
+        self.status
+    }
+
+    pub fn is_listening(&self, channel: &str) -> bool {
+        self.channels.contains(channel)
+    }
+
+    pub fn get(&self, name: &str) -> Option<&str> {
+        self.parameters
+            .get(&name.to_lowercase())
+            .map(String::as_str)
+    }
+
+    /// The zone `TIMESTAMPTZ` values are shown in; see [`timezone`]
+    pub fn timezone(&self) -> FixedOffset {
+        self.get("TimeZone")
+            .and_then(|zone| timezone::parse_offset(zone).ok())
+            .unwrap_or_else(timezone::utc)
+    }
+
+    /// Every reported parameter with its value, for the startup ParameterStatus
+    /// messages
+    pub fn reported(&self) -> Vec<(&'static str, String)> {
+        REPORTED
+            .iter()
+            .map(|name| (*name, self.get(name).unwrap_or_default().to_string()))
+            .collect()
+    }
+
+    /// The error for a statement the session cannot run now: anything but
+    /// `COMMIT` or `ROLLBACK` in an aborted transaction, and `DISCARD ALL`
+    /// inside a transaction block
+    pub fn rejects(&self, statement: Option<&Statement>) -> Option<SqlError> {
+        let ends_transaction = matches!(
+            statement,
+            Some(Statement::Commit { .. } | Statement::Rollback { .. })
+        );
+        if self.status == TransactionStatus::Failed && !ends_transaction {
+            return Some(SqlError::new(
+                "25P02",
+                "current transaction is aborted, commands ignored until end of transaction block",
+            ));
+        }
+        if self.status == TransactionStatus::InTransaction
+            && matches!(
+                statement,
+                Some(Statement::Discard {
+                    object_type: DiscardObject::ALL
+                })
+            )
+        {
+            return Some(SqlError::new(
+                "25001",
+                "DISCARD ALL cannot run inside a transaction block",
+            ));
+        }
+        None
+    }
+
+    /// Run a session statement, or give `None` for one the executor has to run
+    pub fn execute(&mut self, statement: &Statement) -> Option<Result<Completion, SqlError>> {
+        Some(match statement {
+            Statement::SetVariable {
+                variables, value, ..
+            } => {
+                let name = variables.to_string();
+                // The executor's own settings
+                if name.to_lowercase().starts_with("yamlbase.") {
+                    return None;
+                }
+                self.set(&name, value)
+            }
+            Statement::SetTimeZone { value, .. } => {
+                self.set("TimeZone", std::slice::from_ref(value))
+            }
+            Statement::SetNames { charset_name, .. } => self.set(
+                "client_encoding",
+                &[Expr::Value(SqlValue::SingleQuotedString(
+                    charset_name.to_string(),
+                ))],
+            ),
+            // Isolation levels change nothing on read-only data
+            Statement::SetTransaction { .. } => Ok(Completion::tag("SET")),
+            Statement::ShowVariable { .. } => self.show(statement)?.map(|result| Completion {
+                result: Some(result),
+                tag: "SHOW".to_string(),
+                reports: vec![],
+            }),
+            Statement::Discard {
+                object_type: DiscardObject::ALL,
+            } => {
+                self.channels.clear();
+                self.cursors.clear();
+                Ok(Completion {
+                    result: None,
+                    tag: "DISCARD ALL".to_string(),
+                    reports: self.reset_all(),
+                })
+            }
+            // There are no cached plans, sequences or temporary tables to drop
+            Statement::Discard { object_type } => {
+                Ok(Completion::tag(format!("DISCARD {}", object_type)))
+            }
+            Statement::Fetch {
+                name, direction, ..
+            } => self.fetch(&name.value, direction),
+            Statement::Close {
+                cursor: CloseCursor::All,
+            } => {
+                self.cursors.clear();
+                Ok(Completion::tag("CLOSE CURSOR ALL"))
+            }
+            Statement::Close {
+                cursor: CloseCursor::Specific { name },
+            } => match self.cursors.remove(&name.value) {
+                Some(_) => Ok(Completion::tag("CLOSE CURSOR")),
+                None => Err(no_cursor(&name.value)),
+            },
+            _ => return None,
+        })
+    }
+
+    /// Open a cursor on the rows of its query
+    pub fn declare(
+        &mut self,
+        name: String,
+        result: QueryResult,
+        hold: bool,
+    ) -> Result<Completion, SqlError> {
+        if !hold && self.status == TransactionStatus::Idle {
+            return Err(SqlError::new(
+                "25P01",
+                "DECLARE CURSOR can only be used in transaction blocks",
+            ));
+        }
+        if self.cursors.contains_key(&name) {
+            return Err(SqlError::new(
+                "42P03",
+                format!("cursor \"{}\" already exists", name),
+            ));
+        }
+        self.cursors.insert(
+            name,
+            Cursor {
+                result,
+                position: 0,
+                hold,
+            },
+        );
+        Ok(Completion::tag("DECLARE CURSOR"))
+    }
+
+    /// The columns a `FETCH` returns, for a Describe of one, or `None` for any
+    /// other statement
+    pub fn describe_fetch(&self, statement: &Statement) -> Option<Result<QueryResult, SqlError>> {
+        let Statement::Fetch { name, .. } = statement else {
+            return None;
+        };
+        Some(match self.cursors.get(&name.value) {
+            Some(cursor) => Ok(QueryResult {
+                columns: cursor.result.columns.clone(),
+                column_types: cursor.result.column_types.clone(),
+                rows: vec![],
+            }),
+            None => Err(no_cursor(&name.value)),
+        })
+    }
+
+    /// The next rows of a cursor; only fetching forward is supported
+    fn fetch(&mut self, name: &str, direction: &FetchDirection) -> Result<Completion, SqlError> {
+        let cursor = self.cursors.get_mut(name).ok_or_else(|| no_cursor(name))?;
+        let remaining = cursor.result.rows.len() - cursor.position;
+        let count = match direction {
+            FetchDirection::Next | FetchDirection::Forward { limit: None } => Some(1),
+            FetchDirection::Count { limit } | FetchDirection::Forward { limit: Some(limit) } => {
+                match limit {
+                    SqlValue::Number(n, _) => n.parse::<usize>().ok(),
+                    _ => None,
+                }
+            }
+            FetchDirection::All | FetchDirection::ForwardAll => Some(remaining),
+            _ => None,
+        };
+        // Backward fetches, and the negative counts that stand for them
+        let Some(count) = count else {
+            return Err(SqlError::new(
+                "0A000",
+                format!(
+                    "FETCH {} is not supported; cursors only fetch forward",
+                    direction
+                ),
+            ));
+        };
+        let end = cursor.position + count.min(remaining);
+        let rows = cursor.result.rows[cursor.position..end].to_vec();
+        cursor.position = end;
+        Ok(Completion {
+            tag: format!("FETCH {}", rows.len()),
+            result: Some(QueryResult {
+                columns: cursor.result.columns.clone(),
+                column_types: cursor.result.column_types.clone(),
+                rows,
+            }),
+            reports: vec![],
+        })
+    }
+
+    /// Run a session command the SQL parser does not know
+    pub fn run(&mut self, command: SessionCommand) -> Result<Completion, SqlError> {
+        Ok(match command {
+            SessionCommand::ResetAll => Completion {
+                result: None,
+                tag: "RESET".to_string(),
+                reports: self.reset_all(),
+            },
+            SessionCommand::Reset(name) => Completion {
+                result: None,
+                tag: "RESET".to_string(),
+                reports: self.reset(&name)?,
+            },
+            SessionCommand::Listen(channel) => {
+                self.channels.insert(channel);
+                Completion::tag("LISTEN")
+            }
+            SessionCommand::Unlisten(Some(channel)) => {
+                self.channels.remove(&channel);
+                Completion::tag("UNLISTEN")
+            }
+            SessionCommand::Unlisten(None) => {
+                self.channels.clear();
+                Completion::tag("UNLISTEN")
+            }
+        })
+    }
+
+    /// The command tag of a statement the executor ran; `affected_rows` counts
+    /// the rows it wrote, as `INSERT` and `CREATE TABLE AS` do
+    pub fn tag(
+        &self,
+        statement: &Statement,
+        result: &QueryResult,
+        affected_rows: Option<u64>,
+    ) -> String {
+        match statement {
+            Statement::StartTransaction { .. } => "BEGIN".to_string(),
+            // Committing an aborted transaction rolls it back
+            Statement::Commit { .. } if self.status == TransactionStatus::Failed => {
+                "ROLLBACK".to_string()
+            }
+            Statement::Commit { .. } => "COMMIT".to_string(),
+            Statement::Rollback { .. } => "ROLLBACK".to_string(),
+            Statement::SetVariable { .. } => "SET".to_string(),
+            // The 0 is the OID PostgreSQL once reported for single-row inserts
+            Statement::Insert(_) => format!("INSERT 0 {}", affected_rows.unwrap_or(0)),
+            Statement::Update { .. } => format!("UPDATE {}", affected_rows.unwrap_or(0)),
+            Statement::Delete(_) => format!("DELETE {}", affected_rows.unwrap_or(0)),
+            Statement::CreateTable(create) if create.query.is_none() => "CREATE TABLE".to_string(),
+            Statement::AlterTable { .. } => "ALTER TABLE".to_string(),
+            Statement::CreateIndex(_) => "CREATE INDEX".to_string(),
+            Statement::Drop {
+                object_type: ObjectType::Index,
+                ..
+            } => "DROP INDEX".to_string(),
+            Statement::Drop { .. } => "DROP TABLE".to_string(),
+            Statement::Truncate { .. } => "TRUNCATE TABLE".to_string(),
+            _ => format!(
+                "SELECT {}",
+                affected_rows.unwrap_or(result.rows.len() as u64)
+            ),
+        }
+    }
+
+    /// The rows of a `SHOW`, or `None` for any other statement
+    pub fn show(&self, statement: &Statement) -> Option<Result<QueryResult, SqlError>> {
+        let Statement::ShowVariable { variable } = statement else {
+            return None;
+        };
+        let words: Vec<&str> = variable.iter().map(|ident| ident.value.as_str()).collect();
+        // The parser splits dotted names such as `custom.flag` into words
+        let key = match words.join(" ").to_lowercase().as_str() {
+            "all" => {
+                let text = |s: &str| Value::Text(s.to_string());
+                return Some(Ok(QueryResult {
+                    columns: vec![
+                        "name".to_string(),
+                        "setting".to_string(),
+                        "description".to_string(),
+                    ],
+                    column_types: vec![SqlType::Text; 3],
+                    rows: self
+                        .parameters
+                        .iter()
+                        .map(|(name, value)| vec![text(canonical(name)), text(value), text("")])
+                        .collect(),
+                }));
+            }
+            "transaction isolation level" => "transaction_isolation".to_string(),
+            "time zone" => "timezone".to_string(),
+            _ => words.join(".").to_lowercase(),
+        };
+        Some(match self.parameters.get(&key) {
+            Some(value) => Ok(QueryResult {
+                columns: vec![canonical(&key).to_string()],
+                column_types: vec![SqlType::Text],
+                rows: vec![vec![Value::Text(value.clone())]],
+            }),
+            None => Err(unrecognized(&words.join("."))),
+        })
+    }
+
+    fn set(&mut self, name: &str, value: &[Expr]) -> Result<Completion, SqlError> {
+        let key = name.to_lowercase();
+        if is_read_only(&key) {
+            return Err(SqlError::new(
+                "55P02",
+                format!("parameter \"{}\" cannot be changed", name),
+            ));
+        }
+        let value = setting(value);
+        let reports = if value.eq_ignore_ascii_case("DEFAULT") {
+            self.reset(name)?
+        } else {
+            self.assign(key, value)
+        };
+        Ok(Completion {
+            result: None,
+            tag: "SET".to_string(),
+            reports,
+        })
+    }
+
+    /// `RESET name`: back to the startup or built-in value, or unset for a
+    /// parameter that has neither
+    pub fn reset(&mut self, name: &str) -> Result<Vec<(&'static str, String)>, SqlError> {
+        let key = name.to_lowercase();
+        if is_read_only(&key) {
+            return Err(SqlError::new(
+                "55P02",
+                format!("parameter \"{}\" cannot be changed", name),
+            ));
+        }
+        match self.defaults.get(&key).cloned() {
+            Some(value) => Ok(self.assign(key, value)),
+            None => {
+                self.parameters.remove(&key);
+                Ok(vec![])
+            }
+        }
+    }
+
+    /// `RESET ALL`, which `DISCARD ALL` includes
+    pub fn reset_all(&mut self) -> Vec<(&'static str, String)> {
+        let previous = std::mem::replace(&mut self.parameters, self.defaults.clone());
+        REPORTED
+            .iter()
+            .filter_map(|name| {
+                let key = name.to_lowercase();
+                let value = self.parameters.get(&key)?;
+                (previous.get(&key) != Some(value)).then(|| (*name, value.clone()))
+            })
+            .collect()
+    }
+
+    /// Move the transaction status on after a statement ran or failed
+    pub fn finish(&mut self, statement: Option<&Statement>, succeeded: bool) {
+        // Cursors not declared WITH HOLD close with their transaction
+        if matches!(
+            statement,
+            Some(Statement::Commit { .. } | Statement::Rollback { .. })
+        ) {
+            self.cursors.retain(|_, cursor| cursor.hold);
+        }
+        self.status = match (statement, succeeded) {
+            (Some(Statement::Commit { .. } | Statement::Rollback { .. }), _) => {
+                TransactionStatus::Idle
+            }
+            (Some(Statement::StartTransaction { .. }), true) => TransactionStatus::InTransaction,
+            (_, false) if self.status == TransactionStatus::InTransaction => {
+                TransactionStatus::Failed
+            }
+            _ => self.status,
+        };
+    }
+
+    fn assign(&mut self, key: String, value: String) -> Vec<(&'static str, String)> {
+        let report = REPORTED
+            .iter()
+            .find(|name| name.eq_ignore_ascii_case(&key))
+            .filter(|_| self.parameters.get(&key) != Some(&value))
+            .map(|name| (*name, value.clone()));
+        self.parameters.insert(key, value);
+        report.into_iter().collect()
+    }
+}
+
+/// PostgreSQL's spelling of a lowercased parameter name
+fn canonical(key: &str) -> &str {
+    BUILT_IN
+        .iter()
+        .map(|(name, _)| *name)
+        .find(|name| name.eq_ignore_ascii_case(key))
+        .unwrap_or(key)
+}
+
+fn is_read_only(key: &str) -> bool {
+    READ_ONLY.iter().any(|name| name.eq_ignore_ascii_case(key))
+}
+
+fn no_cursor(name: &str) -> SqlError {
+    SqlError::new("34000", format!("cursor \"{}\" does not exist", name))
+}
+
+fn unrecognized(name: &str) -> SqlError {
+    SqlError::new(
+        "42704",
+        format!("unrecognized configuration parameter \"{}\"", name),
+    )
+}
+
+/// The text of a `SET` value; a list such as a search path is joined with
+/// commas
+fn setting(value: &[Expr]) -> String {
+    value
+        .iter()
+        .map(|expr| match expr {
+            Expr::Value(SqlValue::SingleQuotedString(s)) => s.clone(),
+            Expr::Value(SqlValue::Number(n, _)) => n.to_string(),
+            Expr::Value(SqlValue::Boolean(b)) => if *b { "on" } else { "off" }.to_string(),
+            Expr::Identifier(ident) => ident.value.clone(),
+            expr => expr.to_string(),
+        })
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parse_sql;
+
+    fn run(session: &mut Session, sql: &str) -> Result<Completion, SqlError> {
+        let statement = parse_sql(sql).unwrap().remove(0);
+        if let Some(error) = session.rejects(Some(&statement)) {
+            session.finish(Some(&statement), false);
+            return Err(error);
+        }
+        let empty = QueryResult {
+            columns: vec![],
+            column_types: vec![],
+            rows: vec![],
+        };
+        let outcome = session
+            .execute(&statement)
+            .unwrap_or_else(|| Ok(Completion::tag(session.tag(&statement, &empty, None))));
+        session.finish(Some(&statement), outcome.is_ok());
+        outcome
+    }
+
+    fn show(session: &mut Session, name: &str) -> String {
+        let result = run(session, &format!("SHOW {}", name))
+            .unwrap()
+            .result
+            .unwrap();
+        result.rows[0][0].to_string()
+    }
+
+    #[test]
+    fn test_set_show_and_reset_parameters() {
+        let startup = HashMap::from([
+            ("user".to_string(), "app".to_string()),
+            ("application_name".to_string(), "psql".to_string()),
+        ]);
+        let mut session = Session::new(&startup, "UTC");
+        assert_eq!(show(&mut session, "application_name"), "psql");
+        assert_eq!(show(&mut session, "session_authorization"), "app");
+
+        let set = run(&mut session, "SET application_name = 'worker'").unwrap();
+        assert_eq!(set.tag, "SET");
+        assert_eq!(
+            set.reports,
+            vec![("application_name", "worker".to_string())]
+        );
+        run(&mut session, "SET search_path TO app, public").unwrap();
+        assert_eq!(show(&mut session, "search_path"), "app, public");
+        run(&mut session, "SET TIME ZONE 'Europe/Amsterdam'").unwrap();
+        assert_eq!(show(&mut session, "timezone"), "Europe/Amsterdam");
+        run(&mut session, "SET custom.flag = 1").unwrap();
+
+        assert_eq!(
+            session.reset("application_name").unwrap(),
+            vec![("application_name", "psql".to_string())]
+        );
+        let reports = session.reset_all();
+        assert_eq!(reports, vec![("TimeZone", "UTC".to_string())]);
+        assert_eq!(show(&mut session, "search_path"), "\"$user\", public");
+        assert_eq!(
+            run(&mut session, "SHOW custom.flag").unwrap_err().code,
+            "42704"
+        );
+        assert_eq!(
+            run(&mut session, "SET server_version = '9.6'")
+                .unwrap_err()
+                .code,
+            "55P02"
+        );
+
+        assert_eq!(
+            parse_session_command("reset ALL;"),
+            Some(SessionCommand::ResetAll)
+        );
+        assert_eq!(
+            parse_session_command("RESET Statement_Timeout"),
+            Some(SessionCommand::Reset("statement_timeout".to_string()))
+        );
+        assert_eq!(parse_session_command("SELECT 1"), None);
+    }
+
+    #[test]
+    fn test_failed_transactions_refuse_statements_until_they_end() {
+        let mut session = Session::default();
+        run(&mut session, "BEGIN").unwrap();
+        assert_eq!(session.status(), TransactionStatus::InTransaction);
+        assert_eq!(run(&mut session, "DISCARD ALL").unwrap_err().code, "25001");
+        assert_eq!(session.status(), TransactionStatus::Failed);
+        assert_eq!(
+            run(&mut session, "SHOW DateStyle").unwrap_err().code,
+            "25P02"
+        );
+        assert_eq!(run(&mut session, "COMMIT").unwrap().tag, "ROLLBACK");
+        assert_eq!(session.status(), TransactionStatus::Idle);
+
+        // Outside a transaction block a failure aborts nothing
+        session.finish(None, false);
+        assert_eq!(session.status(), TransactionStatus::Idle);
+        assert_eq!(run(&mut session, "DISCARD ALL").unwrap().tag, "DISCARD ALL");
+    }
+
+    #[test]
+    fn test_cursors_are_fetched_forward() {
+        let mut session = Session::default();
+        let rows = QueryResult {
+            columns: vec!["id".to_string()],
+            column_types: vec![SqlType::Integer],
+            rows: (1..=5).map(|id| vec![Value::Integer(id)]).collect(),
+        };
+        let declare = |session: &mut Session, sql: &str| {
+            let statement = parse_sql(sql).unwrap().remove(0);
+            let cursor = CursorDeclaration::of(&statement).unwrap();
+            assert_eq!(cursor.query.to_string(), "SELECT id FROM users");
+            session.declare(cursor.name, rows.clone(), cursor.hold)
+        };
+
+        let sql = "DECLARE \"SQL_CUR1\" CURSOR FOR SELECT id FROM users";
+        assert_eq!(declare(&mut session, sql).unwrap_err().code, "25P01");
+        run(&mut session, "BEGIN").unwrap();
+        assert_eq!(declare(&mut session, sql).unwrap().tag, "DECLARE CURSOR");
+        assert_eq!(declare(&mut session, sql).unwrap_err().code, "42P03");
+
+        let fetched = run(&mut session, "FETCH 2 IN \"SQL_CUR1\"").unwrap();
+        assert_eq!(fetched.tag, "FETCH 2");
+        assert_eq!(fetched.result.unwrap().rows[1], vec![Value::Integer(2)]);
+        let fetched = run(&mut session, "FETCH FORWARD 10 FROM \"SQL_CUR1\"").unwrap();
+        assert_eq!(fetched.tag, "FETCH 3");
+        assert_eq!(
+            run(&mut session, "FETCH NEXT IN \"SQL_CUR1\"").unwrap().tag,
+            "FETCH 0"
+        );
+        let statement = parse_sql("FETCH 1 IN \"SQL_CUR1\"").unwrap().remove(0);
+        let described = session.describe_fetch(&statement).unwrap().unwrap();
+        assert_eq!(described.columns, ["id"]);
+        assert!(described.rows.is_empty());
+        assert_eq!(
+            run(&mut session, "FETCH PRIOR IN \"SQL_CUR1\"")
+                .unwrap_err()
+                .code,
+            "0A000"
+        );
+        run(&mut session, "ROLLBACK").unwrap();
+
+        // Only cursors declared WITH HOLD outlive their transaction
+        assert_eq!(
+            run(&mut session, "CLOSE \"SQL_CUR1\"").unwrap_err().code,
+            "34000"
+        );
+        run(&mut session, "BEGIN").unwrap();
+        declare(
+            &mut session,
+            "DECLARE held CURSOR WITH HOLD FOR SELECT id FROM users",
+        )
+        .unwrap();
+        run(&mut session, "COMMIT").unwrap();
+        assert_eq!(
+            run(&mut session, "FETCH ALL IN held").unwrap().tag,
+            "FETCH 5"
+        );
+        assert_eq!(run(&mut session, "CLOSE held").unwrap().tag, "CLOSE CURSOR");
+        assert_eq!(
+            run(&mut session, "FETCH ALL IN held").unwrap_err().code,
+            "34000"
+        );
+    }
+
+    #[test]
+    fn test_listen_and_session_cleanup() {
+        let mut session = Session::default();
+        let command = |sql| parse_session_command(sql).unwrap();
+        session.run(command("LISTEN Jobs")).unwrap();
+        session.run(command("LISTEN \"Mail\"")).unwrap();
+        assert!(session.is_listening("jobs") && session.is_listening("Mail"));
+        assert_eq!(
+            session.run(command("UNLISTEN jobs")).unwrap().tag,
+            "UNLISTEN"
+        );
+        assert!(!session.is_listening("jobs"));
+        session.run(command("UNLISTEN *")).unwrap();
+        assert!(!session.is_listening("Mail"));
+
+        session.run(command("LISTEN jobs")).unwrap();
+        assert_eq!(run(&mut session, "DISCARD ALL").unwrap().tag, "DISCARD ALL");
+        assert!(!session.is_listening("jobs"));
+        assert_eq!(
+            run(&mut session, "DISCARD PLANS").unwrap().tag,
+            "DISCARD PLANS"
+        );
+        assert_eq!(
+            run(&mut session, "CLOSE ALL").unwrap().tag,
+            "CLOSE CURSOR ALL"
+        );
+        assert_eq!(run(&mut session, "CLOSE c").unwrap_err().code, "34000");
+
+        // Only DISCARD ALL is refused inside a transaction block
+        run(&mut session, "BEGIN").unwrap();
+        run(&mut session, "DISCARD TEMP").unwrap();
+        assert_eq!(session.status(), TransactionStatus::InTransaction);
+    }
+
+    #[test]
+    fn test_sessions_start_in_the_server_time_zone() {
+        let mut session = Session::new(&HashMap::new(), "+02:00");
+        assert_eq!(show(&mut session, "TimeZone"), "+02:00");
+        assert_eq!(session.timezone().local_minus_utc(), 7200);
+
+        run(&mut session, "SET TIME ZONE '-05:00'").unwrap();
+        assert_eq!(session.timezone().local_minus_utc(), -18000);
+        // Named zones are not known, so their values are shown in UTC
+        run(&mut session, "SET TIME ZONE 'Europe/Amsterdam'").unwrap();
+        assert_eq!(session.timezone(), timezone::utc());
+        assert_eq!(
+            session.reset_all(),
+            vec![("TimeZone", "+02:00".to_string())]
+        );
+    }
+}
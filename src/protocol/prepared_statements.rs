@@ -0,0 +1,128 @@
+//! The prepared statements of one PostgreSQL connection.
+//!
+//! Connection poolers keep server connections open for days while their
+//! clients prepare statements under generated names, so the set is capped:
+//! preparing one more named statement than the cap drops the statement used
+//! least recently, as pgbouncer's own statement cache does. A client that
+//! binds a dropped statement gets the same error as for one it deallocated.
+//! The unnamed statement is replaced by every Parse and is never dropped.
+
+use std::collections::HashMap;
+
+use crate::protocol::postgres_extended::PreparedStatement;
+
+/// Named statements a connection keeps unless `--max-prepared-statements` says otherwise
+pub const DEFAULT_MAX_PREPARED_STATEMENTS: usize = 1000;
+
+pub struct PreparedStatements {
+    statements: HashMap<String, Entry>,
+    capacity: usize,
+    /// Bumped on every use, so the smallest `last_used` is the LRU statement
+    uses: u64,
+}
+
+struct Entry {
+    statement: PreparedStatement,
+    last_used: u64,
+}
+
+impl PreparedStatements {
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            statements: HashMap::new(),
+            capacity: capacity.max(1),
+            uses: 0,
+        }
+    }
+
+    pub fn contains(&self, name: &str) -> bool {
+        self.statements.contains_key(name)
+    }
+
+    /// Add a statement, replacing one of the same name, and return the name of
+    /// the statement dropped to stay within the cap, if any
+    pub fn insert(&mut self, statement: PreparedStatement) -> Option<String> {
+        self.uses += 1;
+        let name = statement.name.clone();
+        self.statements.insert(
+            name.clone(),
+            Entry {
+                statement,
+                last_used: self.uses,
+            },
+        );
+
+        let named = self.statements.len() - usize::from(self.contains(""));
+        if named <= self.capacity {
+            return None;
+        }
+        let evicted = self
+            .statements
+            .iter()
+            .filter(|(key, _)| !key.is_empty() && **key != name)
+            .min_by_key(|(_, entry)| entry.last_used)
+            .map(|(key, _)| key.clone())?;
+        self.statements.remove(&evicted);
+        Some(evicted)
+    }
+
+    /// The statement for a Bind or Describe, which counts as a use
+    pub fn get(&mut self, name: &str) -> Option<&mut PreparedStatement> {
+        self.uses += 1;
+        let entry = self.statements.get_mut(name)?;
+        entry.last_used = self.uses;
+        Some(&mut entry.statement)
+    }
+
+    pub fn remove(&mut self, name: &str) -> bool {
+        self.statements.remove(name).is_some()
+    }
+
+    pub fn clear(&mut self) {
+        self.statements.clear();
+    }
+
+    pub fn len(&self) -> usize {
+        self.statements.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.statements.is_empty()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn statement(name: &str) -> PreparedStatement {
+        PreparedStatement {
+            name: name.to_string(),
+            query: "SELECT 1".to_string(),
+            parameter_types: vec![],
+            parameter_oids: vec![],
+            parsed_statements: vec![],
+            result_types: None,
+        }
+    }
+
+    #[test]
+    fn test_least_recently_used_statement_is_evicted() {
+        let mut statements = PreparedStatements::new(2);
+        assert_eq!(statements.insert(statement("a")), None);
+        assert_eq!(statements.insert(statement("b")), None);
+        // The unnamed statement does not count against the cap
+        assert_eq!(statements.insert(statement("")), None);
+
+        assert!(statements.get("a").is_some());
+        assert_eq!(statements.insert(statement("c")), Some("b".to_string()));
+        assert!(statements.contains("a") && statements.contains("c"));
+        assert!(!statements.contains("b"));
+        assert_eq!(statements.len(), 3);
+
+        assert!(statements.remove("a"));
+        assert!(!statements.remove("a"));
+        statements.clear();
+        assert!(statements.is_empty());
+    }
+}
@@ -0,0 +1,121 @@
+//! Panic isolation for connections and queries.
+//!
+//! A panic while serving one client is caught where it happens and turned into
+//! an error for that client, so a pathological query cannot take down a shared
+//! instance or skip the connection bookkeeping around it. The panic hook
+//! records the stack trace of caught panics so callers can log it.
+
+use std::backtrace::Backtrace;
+use std::cell::{Cell, RefCell};
+use std::fmt;
+use std::future::Future;
+use std::panic::{AssertUnwindSafe, PanicHookInfo};
+use std::sync::Once;
+use std::task::Poll;
+
+thread_local! {
+    /// How many `catch_panic` polls are on this thread's stack
+    static CATCHING: Cell<usize> = const { Cell::new(0) };
+    static LAST_PANIC: RefCell<Option<(String, String)>> = const { RefCell::new(None) };
+}
+
+/// A panic caught by [`catch_panic`]
+#[derive(Debug)]
+pub struct CaughtPanic {
+    pub message: String,
+    /// `file:line:column` of the panic
+    pub location: String,
+    pub backtrace: String,
+}
+
+impl fmt::Display for CaughtPanic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} at {}", self.message, self.location)
+    }
+}
+
+/// Run `future` to completion, catching a panic in any of its polls.
+///
+/// The future is treated as unwind safe. Shared state such as the database
+/// sits behind tokio locks, which do not poison, so it stays usable after a
+/// caught panic.
+pub async fn catch_panic<F: Future>(future: F) -> Result<F::Output, CaughtPanic> {
+    install_hook();
+
+    let mut future = std::pin::pin!(future);
+    std::future::poll_fn(|cx| {
+        CATCHING.with(|depth| depth.set(depth.get() + 1));
+        let polled = std::panic::catch_unwind(AssertUnwindSafe(|| future.as_mut().poll(cx)));
+        CATCHING.with(|depth| depth.set(depth.get() - 1));
+
+        match polled {
+            Ok(Poll::Ready(output)) => Poll::Ready(Ok(output)),
+            Ok(Poll::Pending) => Poll::Pending,
+            Err(payload) => {
+                let message = payload
+                    .downcast_ref::<&str>()
+                    .map(|s| s.to_string())
+                    .or_else(|| payload.downcast_ref::<String>().cloned())
+                    .unwrap_or_else(|| "unknown panic".to_string());
+                let (location, backtrace) = LAST_PANIC
+                    .with(|last| last.borrow_mut().take())
+                    .unwrap_or_default();
+                Poll::Ready(Err(CaughtPanic {
+                    message,
+                    location,
+                    backtrace,
+                }))
+            }
+        }
+    })
+    .await
+}
+
+/// Whether a panic on this thread now would be caught by [`catch_panic`]
+pub(crate) fn is_catching() -> bool {
+    CATCHING.with(|depth| depth.get()) > 0
+}
+
+/// Chain a hook in front of the existing one: panics inside [`catch_panic`]
+/// are recorded for the caller to log instead of printed, everything else goes
+/// to the previous hook as before
+fn install_hook() {
+    static INSTALL: Once = Once::new();
+    INSTALL.call_once(|| {
+        let previous = std::panic::take_hook();
+        std::panic::set_hook(Box::new(move |info: &PanicHookInfo<'_>| {
+            if CATCHING.with(|depth| depth.get()) == 0 {
+                previous(info);
+                return;
+            }
+            let location = info
+                .location()
+                .map(|location| location.to_string())
+                .unwrap_or_default();
+            let backtrace = Backtrace::force_capture().to_string();
+            LAST_PANIC.with(|last| *last.borrow_mut() = Some((location, backtrace)));
+        }));
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_panics_are_caught_with_their_location() {
+        let caught = catch_panic(async {
+            tokio::task::yield_now().await;
+            let values: Vec<u8> = Vec::new();
+            values[3]
+        })
+        .await
+        .unwrap_err();
+
+        assert!(caught.message.contains("index out of bounds"));
+        assert!(caught.location.contains("recovery.rs"));
+        assert!(!caught.backtrace.is_empty());
+
+        assert_eq!(catch_panic(async { 7 }).await.unwrap(), 7);
+    }
+}
@@ -0,0 +1,330 @@
+//! Embedded Lua scripting for datasets.
+//!
+//! A dataset can carry a Lua chunk in `database.script`. Functions defined
+//! there serve two purposes:
+//!
+//! * **Generators** — a table with `generator: name` has its rows replaced by
+//!   the return value of `name()` before every query. The function returns an
+//!   array of rows, each a table keyed by column name.
+//! * **`before_query(sql)`** — if defined, it is called with the SQL of every
+//!   statement. Returning `nil` runs the query unchanged, returning a string
+//!   runs that SQL instead, and returning `{ columns = {...}, rows = {{...}} }`
+//!   answers the query directly.
+
+use indexmap::IndexMap;
+use mlua::{Lua, Value as LuaValue};
+use std::sync::Mutex;
+
+use crate::database::{Column, Value};
+use crate::yaml::parser::build_row;
+
+const BEFORE_QUERY_HOOK: &str = "before_query";
+
+/// What the `before_query` hook, or a rewrite rule, decided to do with a statement
+#[derive(Debug, Clone, PartialEq)]
+pub enum HookOutcome {
+    Continue,
+    Rewrite(String),
+    Answer {
+        columns: Vec<String>,
+        rows: Vec<Vec<Value>>,
+    },
+}
+
+pub struct ScriptEngine {
+    // Lua states are not thread-safe, so calls are serialized
+    lua: Mutex<Lua>,
+    generators: Vec<(String, String)>,
+    has_before_query: bool,
+}
+
+impl std::fmt::Debug for ScriptEngine {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ScriptEngine")
+            .field("generators", &self.generators)
+            .field("has_before_query", &self.has_before_query)
+            .finish()
+    }
+}
+
+impl ScriptEngine {
+    /// Run the dataset script and check that every `(table, function)` generator exists
+    pub fn load(source: &str, generators: Vec<(String, String)>) -> crate::Result<Self> {
+        let lua = Lua::new();
+        lua.load(source)
+            .set_name("database.script")
+            .exec()
+            .map_err(script_error)?;
+
+        let globals = lua.globals();
+        for (table, function) in &generators {
+            let value: LuaValue = globals.get(function.as_str()).map_err(script_error)?;
+            if !matches!(value, LuaValue::Function(_)) {
+                return Err(crate::YamlBaseError::Config(format!(
+                    "Generator '{}' for table '{}' is not a function in database.script",
+                    function, table
+                )));
+            }
+        }
+        let hook: LuaValue = globals.get(BEFORE_QUERY_HOOK).map_err(script_error)?;
+        let has_before_query = matches!(hook, LuaValue::Function(_));
+        drop(globals);
+
+        Ok(Self {
+            lua: Mutex::new(lua),
+            generators,
+            has_before_query,
+        })
+    }
+
+    /// `(table, function)` pairs for tables whose rows are computed by the script
+    pub fn generators(&self) -> &[(String, String)] {
+        &self.generators
+    }
+
+    /// Call a generator and convert its rows to the given column layout
+    pub fn generate_rows(
+        &self,
+        function: &str,
+        columns: &[Column],
+    ) -> crate::Result<Vec<Vec<Value>>> {
+        let lua = self.lua.lock().unwrap_or_else(|e| e.into_inner());
+        let generator: mlua::Function = lua.globals().get(function).map_err(script_error)?;
+        let result: LuaValue = generator.call(()).map_err(script_error)?;
+
+        let rows = match result {
+            LuaValue::Nil => return Ok(Vec::new()),
+            LuaValue::Table(rows) => rows,
+            other => {
+                return Err(crate::YamlBaseError::TypeConversion(format!(
+                    "Generator '{}' must return an array of rows, got {}",
+                    function,
+                    other.type_name()
+                )));
+            }
+        };
+
+        let mut generated = Vec::new();
+        for row in rows.sequence_values::<mlua::Table>() {
+            let row = row.map_err(script_error)?;
+            let mut row_data = IndexMap::new();
+            for pair in row.pairs::<String, LuaValue>() {
+                let (column, value) = pair.map_err(script_error)?;
+                row_data.insert(column, lua_to_yaml(value)?);
+            }
+            generated.push(build_row(&row_data, columns)?);
+        }
+
+        Ok(generated)
+    }
+
+    /// Run the `before_query` hook, if the script defines one
+    pub fn before_query(&self, sql: &str) -> crate::Result<HookOutcome> {
+        if !self.has_before_query {
+            return Ok(HookOutcome::Continue);
+        }
+
+        let lua = self.lua.lock().unwrap_or_else(|e| e.into_inner());
+        let hook: mlua::Function = lua.globals().get(BEFORE_QUERY_HOOK).map_err(script_error)?;
+        let result: LuaValue = hook.call(sql).map_err(script_error)?;
+
+        match result {
+            LuaValue::Nil => Ok(HookOutcome::Continue),
+            LuaValue::String(rewritten) => Ok(HookOutcome::Rewrite(
+                rewritten.to_str().map_err(script_error)?.to_string(),
+            )),
+            LuaValue::Table(answer) => {
+                let columns: Vec<String> = answer
+                    .get::<Option<Vec<String>>>("columns")
+                    .map_err(script_error)?
+                    .unwrap_or_default();
+
+                let mut rows = Vec::new();
+                if let Some(answer_rows) = answer
+                    .get::<Option<mlua::Table>>("rows")
+                    .map_err(script_error)?
+                {
+                    for row in answer_rows.sequence_values::<mlua::Table>() {
+                        let row = row.map_err(script_error)?;
+                        let values = row
+                            .sequence_values::<LuaValue>()
+                            .map(|value| lua_to_db(value.map_err(script_error)?))
+                            .collect::<crate::Result<Vec<_>>>()?;
+                        if values.len() != columns.len() {
+                            return Err(crate::YamlBaseError::Database {
+                                message: format!(
+                                    "before_query returned a row with {} values for {} columns",
+                                    values.len(),
+                                    columns.len()
+                                ),
+                            });
+                        }
+                        rows.push(values);
+                    }
+                }
+
+                Ok(HookOutcome::Answer { columns, rows })
+            }
+            other => Err(crate::YamlBaseError::TypeConversion(format!(
+                "before_query must return nil, a string or a result table, got {}",
+                other.type_name()
+            ))),
+        }
+    }
+}
+
+fn script_error(e: mlua::Error) -> crate::YamlBaseError {
+    crate::YamlBaseError::Database {
+        message: format!("Script error: {}", e),
+    }
+}
+
+fn lua_to_yaml(value: LuaValue) -> crate::Result<serde_yaml::Value> {
+    use serde_yaml::Value as YamlValue;
+
+    match value {
+        LuaValue::Nil => Ok(YamlValue::Null),
+        LuaValue::Boolean(b) => Ok(YamlValue::Bool(b)),
+        LuaValue::Integer(i) => Ok(YamlValue::Number(i.into())),
+        LuaValue::Number(n) => Ok(YamlValue::Number(n.into())),
+        LuaValue::String(s) => Ok(YamlValue::String(
+            s.to_str().map_err(script_error)?.to_string(),
+        )),
+        LuaValue::Table(table) => {
+            // Arrays become sequences, everything else a mapping (e.g. for JSON columns)
+            if table.raw_len() > 0 {
+                let items = table
+                    .sequence_values::<LuaValue>()
+                    .map(|item| lua_to_yaml(item.map_err(script_error)?))
+                    .collect::<crate::Result<Vec<_>>>()?;
+                Ok(YamlValue::Sequence(items))
+            } else {
+                let mut mapping = serde_yaml::Mapping::new();
+                for pair in table.pairs::<LuaValue, LuaValue>() {
+                    let (key, value) = pair.map_err(script_error)?;
+                    mapping.insert(lua_to_yaml(key)?, lua_to_yaml(value)?);
+                }
+                Ok(YamlValue::Mapping(mapping))
+            }
+        }
+        other => Err(crate::YamlBaseError::TypeConversion(format!(
+            "Unsupported script value of type {}",
+            other.type_name()
+        ))),
+    }
+}
+
+fn lua_to_db(value: LuaValue) -> crate::Result<Value> {
+    match value {
+        LuaValue::Nil => Ok(Value::Null),
+        LuaValue::Boolean(b) => Ok(Value::Boolean(b)),
+        LuaValue::Integer(i) => Ok(Value::Integer(i)),
+        LuaValue::Number(n) => Ok(Value::Double(n)),
+        LuaValue::String(s) => Ok(Value::Text(s.to_str().map_err(script_error)?.to_string())),
+        other => Err(crate::YamlBaseError::TypeConversion(format!(
+            "Unsupported script value of type {}",
+            other.type_name()
+        ))),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::yaml::schema::SqlType;
+
+    fn column(name: &str, sql_type: SqlType, nullable: bool) -> Column {
+        Column {
+            name: name.to_string(),
+            sql_type,
+            primary_key: false,
+            nullable,
+            unique: false,
+            default: None,
+            references: None,
+        }
+    }
+
+    #[test]
+    fn test_generator_rows_follow_column_layout() {
+        let source = r#"
+            function make_events()
+              local rows = {}
+              for i = 1, 3 do
+                rows[i] = { kind = "tick", id = i }
+              end
+              return rows
+            end
+        "#;
+        let engine = ScriptEngine::load(
+            source,
+            vec![("events".to_string(), "make_events".to_string())],
+        )
+        .unwrap();
+        let columns = vec![
+            column("id", SqlType::Integer, false),
+            column("kind", SqlType::Text, false),
+            column("note", SqlType::Text, true),
+        ];
+
+        let rows = engine.generate_rows("make_events", &columns).unwrap();
+        assert_eq!(rows.len(), 3);
+        assert_eq!(
+            rows[2],
+            vec![
+                Value::Integer(3),
+                Value::Text("tick".to_string()),
+                Value::Null
+            ]
+        );
+    }
+
+    #[test]
+    fn test_missing_generator_is_rejected() {
+        let err =
+            ScriptEngine::load("x = 1", vec![("t".to_string(), "nope".to_string())]).unwrap_err();
+        assert!(err.to_string().contains("nope"));
+    }
+
+    #[test]
+    fn test_before_query_outcomes() {
+        let source = r#"
+            function before_query(sql)
+              if sql:find("legacy_users") then
+                return (sql:gsub("legacy_users", "users"))
+              elseif sql:find("pg_stat_activity") then
+                return { columns = { "pid", "state" }, rows = { { 42, "idle" } } }
+              end
+              return nil
+            end
+        "#;
+        let engine = ScriptEngine::load(source, Vec::new()).unwrap();
+
+        assert_eq!(
+            engine.before_query("SELECT 1").unwrap(),
+            HookOutcome::Continue
+        );
+        assert_eq!(
+            engine.before_query("SELECT * FROM legacy_users").unwrap(),
+            HookOutcome::Rewrite("SELECT * FROM users".to_string())
+        );
+        assert_eq!(
+            engine
+                .before_query("SELECT * FROM pg_stat_activity")
+                .unwrap(),
+            HookOutcome::Answer {
+                columns: vec!["pid".to_string(), "state".to_string()],
+                rows: vec![vec![Value::Integer(42), Value::Text("idle".to_string())]],
+            }
+        );
+    }
+
+    #[test]
+    fn test_script_without_hook_continues() {
+        let engine = ScriptEngine::load("", Vec::new()).unwrap();
+        assert_eq!(
+            engine.before_query("SELECT 1").unwrap(),
+            HookOutcome::Continue
+        );
+    }
+}
@@ -0,0 +1,104 @@
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::task::JoinHandle;
+use tracing::{debug, error};
+
+use crate::database::{Storage, WriteAheadLog};
+
+/// Every `interval`, fold the writes `wal` logged into the dataset file at
+/// `path`, whose content as loaded is `base`. The file is replaced by a
+/// rename, so a crash leaves either the old file and the full log or the new
+/// file and a log the next start recognises as folded in.
+pub(crate) fn spawn_checkpoints(
+    storage: Storage,
+    wal: Arc<WriteAheadLog>,
+    path: PathBuf,
+    base: String,
+    interval: Duration,
+) -> JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut ticks = tokio::time::interval(interval);
+        ticks.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        ticks.tick().await;
+        loop {
+            ticks.tick().await;
+            match wal.checkpoint(&storage, &path, &base).await {
+                Ok(0) => {}
+                Ok(folded) => debug!(
+                    "Checkpointed {} logged write(s) into {}",
+                    folded,
+                    path.display()
+                ),
+                Err(e) => error!("Failed to checkpoint into {}: {}", path.display(), e),
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{RowChange, Value, wal};
+    use crate::yaml::parse_yaml_database;
+
+    const DATASET: &str = r#"
+database:
+  name: shop
+tables:
+  products:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "TEXT NOT NULL"
+    data:
+      - id: 1
+        name: "Widget"
+"#;
+
+    #[tokio::test]
+    async fn test_checkpoints_fold_the_log_into_the_yaml_file() {
+        let dir =
+            std::env::temp_dir().join(format!("yamlbase-checkpoint-{}", uuid::Uuid::new_v4()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let file = dir.join("shop.yaml");
+        std::fs::write(&file, DATASET).unwrap();
+        let wal_path = wal::default_path(&file);
+
+        let (log, _) = WriteAheadLog::open(&wal_path, DATASET.as_bytes())
+            .await
+            .unwrap();
+        let log = Arc::new(log);
+        let (database, _) = parse_yaml_database(&file).await.unwrap();
+        let storage = Storage::new(database).with_wal(log.clone());
+        spawn_checkpoints(
+            storage.clone(),
+            log,
+            file.clone(),
+            DATASET.to_string(),
+            Duration::from_millis(20),
+        );
+
+        storage
+            .write_table("products", |_| {
+                Ok(vec![RowChange::Insert(vec![
+                    Value::Integer(2),
+                    Value::Text("Gadget".to_string()),
+                ])])
+            })
+            .await
+            .unwrap();
+
+        let mut checkpointed = false;
+        for _ in 0..50 {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+            let (database, _) = parse_yaml_database(&file).await.unwrap();
+            if database.get_table("products").unwrap().rows.len() == 2 {
+                checkpointed = true;
+                break;
+            }
+        }
+        assert!(checkpointed, "insert was not checkpointed");
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -5,10 +5,11 @@ use std::sync::{
 };
 use std::time::{Duration, Instant};
 use tokio::net::TcpStream;
-use tokio::sync::{RwLock, Semaphore};
+use tokio::sync::{RwLock, Semaphore, broadcast};
 use tokio::time::timeout;
 use tracing::{debug, error, info, warn};
 
+use super::netem::{self, NetworkConditions};
 use crate::config::Config;
 use crate::database::Storage;
 use crate::protocol::Connection;
@@ -41,6 +42,7 @@ pub struct ConnectionManager {
     failed_connections: AtomicUsize,
     timeout_connections: AtomicUsize,
     connection_semaphore: Arc<Semaphore>,
+    kill_switch: broadcast::Sender<()>,
 }
 
 impl Clone for ConnectionManager {
@@ -54,6 +56,7 @@ impl Clone for ConnectionManager {
             failed_connections: AtomicUsize::new(self.failed_connections.load(Ordering::SeqCst)),
             timeout_connections: AtomicUsize::new(self.timeout_connections.load(Ordering::SeqCst)),
             connection_semaphore: self.connection_semaphore.clone(),
+            kill_switch: self.kill_switch.clone(),
         }
     }
 }
@@ -71,9 +74,17 @@ impl ConnectionManager {
             failed_connections: AtomicUsize::new(0),
             timeout_connections: AtomicUsize::new(0),
             connection_semaphore: Arc::new(Semaphore::new(max_connections)),
+            kill_switch: broadcast::channel(1).0,
         }
     }
 
+    /// Abruptly close every open connection, returning how many were dropped
+    pub fn drop_all_connections(&self) -> usize {
+        let open = self.kill_switch.receiver_count();
+        let _ = self.kill_switch.send(());
+        open
+    }
+
     /// Handle a new client connection with full stability features
     pub async fn handle_connection(
         &self,
@@ -104,6 +115,11 @@ impl ConnectionManager {
             // Continue anyway - not critical
         }
 
+        let conditions = NetworkConditions::from_config(&self.config);
+        if conditions.is_active() {
+            stream = netem::shape(stream, conditions).await?;
+        }
+
         let connection_id = self.connection_counter.fetch_add(1, Ordering::SeqCst);
         let now = Instant::now();
 
@@ -127,9 +143,18 @@ impl ConnectionManager {
         );
 
         // Handle the connection with comprehensive error handling
-        let result = self
-            .handle_connection_with_recovery(stream, connection_id, client_addr.clone())
-            .await;
+        let mut kill = self.kill_switch.subscribe();
+        let result = tokio::select! {
+            result = self.handle_connection_with_recovery(
+                stream,
+                connection_id,
+                client_addr.clone(),
+            ) => result,
+            _ = kill.recv() => {
+                info!("Connection {} from {} dropped on request", connection_id, client_addr);
+                Ok(())
+            }
+        };
 
         // Cleanup connection
         {
@@ -337,6 +362,11 @@ impl ConnectionManager {
         }
     }
 
+    /// How many connections are open now
+    pub async fn open_connections(&self) -> usize {
+        self.connections.read().await.len()
+    }
+
     /// Cleanup idle/stale connections
     pub async fn cleanup_stale_connections(&self) {
         let idle_timeout = Duration::from_secs(1800); // 30 minutes
@@ -0,0 +1,179 @@
+//! `--require-tables` and `--min-rows`: assertions about the dataset,
+//! checked once it is loaded.
+//!
+//! A fixture file that was truncated, or rendered from a template that
+//! dropped a table, otherwise starts a server anyway, and a CI pipeline then
+//! fails much later with errors from the tests that query it. With the gates
+//! set, startup fails instead, with a report listing every table that is
+//! missing, failed to load under `--skip-invalid` or has too few rows. A
+//! `--hot-reload` of a file that fails them is refused, and the dataset
+//! already served is kept.
+
+use crate::YamlBaseError;
+use crate::config::Config;
+use crate::database::{Database, Table};
+
+/// The tables a dataset must have, and the rows some of them must hold
+#[derive(Debug, Clone, Default)]
+pub struct HealthGates {
+    tables: Vec<String>,
+    min_rows: Vec<(String, usize)>,
+}
+
+impl HealthGates {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            tables: config.require_tables.clone(),
+            min_rows: config.min_rows.clone(),
+        }
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        !self.tables.is_empty() || !self.min_rows.is_empty()
+    }
+
+    /// Check `db`, counting a table's rows with `rows`, which knows those of
+    /// tables a `--disk-store` has not loaded
+    pub fn check(&self, db: &Database, rows: impl Fn(&Table) -> usize) -> crate::Result<()> {
+        let mut problems = Vec::new();
+        let mut missing: Vec<&str> = Vec::new();
+        let required = self.tables.iter().map(|name| (name.as_str(), None)).chain(
+            self.min_rows
+                .iter()
+                .map(|(name, n)| (name.as_str(), Some(*n))),
+        );
+        for (name, min_rows) in required {
+            let Some(table) = db.get_table(name) else {
+                if missing.iter().any(|seen| seen.eq_ignore_ascii_case(name)) {
+                    continue;
+                }
+                missing.push(name);
+                problems.push(match db.table_error(name) {
+                    Some(reason) => format!("table '{}' failed to load: {}", name, reason),
+                    None => format!("table '{}' is missing", name),
+                });
+                continue;
+            };
+            if let Some(min_rows) = min_rows {
+                let count = rows(table);
+                if count < min_rows {
+                    problems.push(format!(
+                        "table '{}' has {} row{}, fewer than the {} required",
+                        table.name,
+                        count,
+                        if count == 1 { "" } else { "s" },
+                        min_rows
+                    ));
+                }
+            }
+        }
+        if problems.is_empty() {
+            return Ok(());
+        }
+        Err(YamlBaseError::Config(format!(
+            "Dataset '{}' failed its startup checks:\n  - {}",
+            db.name,
+            problems.join("\n  - ")
+        )))
+    }
+}
+
+/// A `--min-rows` value: `TABLE=N`
+pub fn parse_min_rows(input: &str) -> Result<(String, usize), String> {
+    let (table, rows) = input
+        .rsplit_once('=')
+        .ok_or_else(|| format!("Expected TABLE=N, got '{}'", input))?;
+    let table = table.trim();
+    if table.is_empty() {
+        return Err(format!("Missing table in '{}'", input));
+    }
+    let rows = rows
+        .trim()
+        .parse()
+        .map_err(|_| format!("Invalid row count '{}'", rows))?;
+    Ok((table.to_string(), rows))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{Column, Value};
+    use crate::yaml::schema::SqlType;
+
+    fn table(name: &str, rows: i64) -> Table {
+        let mut table = Table::new(
+            name.to_string(),
+            vec![Column {
+                name: "id".to_string(),
+                sql_type: SqlType::Integer,
+                primary_key: true,
+                nullable: false,
+                unique: true,
+                default: None,
+                references: None,
+            }],
+        );
+        for id in 1..=rows {
+            table.insert_row(vec![Value::Integer(id)]).unwrap();
+        }
+        table
+    }
+
+    fn gates(tables: &[&str], min_rows: &[(&str, usize)]) -> HealthGates {
+        HealthGates {
+            tables: tables.iter().map(|name| name.to_string()).collect(),
+            min_rows: min_rows
+                .iter()
+                .map(|(name, n)| (name.to_string(), *n))
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn test_unmet_gates_are_reported_together() {
+        let mut db = Database::new("shop".to_string());
+        db.add_table(table("users", 3)).unwrap();
+        db.add_table(table("products", 1)).unwrap();
+        db.errored_tables.insert(
+            "orders".to_string(),
+            "Cannot parse integer: a lot".to_string(),
+        );
+        let rows = |table: &Table| table.rows.len();
+
+        assert!(!HealthGates::default().is_enabled());
+        assert!(gates(&["Users"], &[("users", 3)]).check(&db, rows).is_ok());
+
+        let error = gates(
+            &["users", "orders", "invoices"],
+            &[("users", 10), ("products", 2), ("invoices", 1)],
+        )
+        .check(&db, rows)
+        .unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Configuration error: Dataset 'shop' failed its startup checks:\n  \
+             - table 'orders' failed to load: Cannot parse integer: a lot\n  \
+             - table 'invoices' is missing\n  \
+             - table 'users' has 3 rows, fewer than the 10 required\n  \
+             - table 'products' has 1 row, fewer than the 2 required"
+        );
+
+        // Rows counted elsewhere, as a disk store's are
+        assert!(gates(&[], &[("users", 10)]).check(&db, |_| 10).is_ok());
+    }
+
+    #[test]
+    fn test_min_rows_are_parsed() {
+        assert_eq!(parse_min_rows("users=10"), Ok(("users".to_string(), 10)));
+        assert_eq!(
+            parse_min_rows(" order_items = 0"),
+            Ok(("order_items".to_string(), 0))
+        );
+        assert_eq!(
+            parse_min_rows("users"),
+            Err("Expected TABLE=N, got 'users'".to_string())
+        );
+        assert!(parse_min_rows("=10").is_err());
+        assert!(parse_min_rows("users=many").is_err());
+    }
+}
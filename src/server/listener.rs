@@ -0,0 +1,242 @@
+use serde::Serialize;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+use tokio::net::TcpListener;
+use tokio::sync::mpsc;
+use tracing::{error, info};
+
+use super::ConnectionManager;
+
+#[derive(Debug)]
+enum ListenerCommand {
+    Pause(Duration),
+    Restart,
+}
+
+/// Snapshot of a listener's state for the admin API
+#[derive(Debug, Clone, Serialize)]
+pub struct ListenerStatus {
+    pub name: String,
+    pub address: String,
+    pub accepting: bool,
+}
+
+/// Remote control for a running listener, used to simulate outages and failovers
+#[derive(Clone)]
+pub struct ListenerControl {
+    name: String,
+    addr: String,
+    manager: ConnectionManager,
+    accepting: Arc<AtomicBool>,
+    commands: mpsc::UnboundedSender<ListenerCommand>,
+}
+
+impl ListenerControl {
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn status(&self) -> ListenerStatus {
+        ListenerStatus {
+            name: self.name.clone(),
+            address: self.addr.clone(),
+            accepting: self.accepting.load(Ordering::SeqCst),
+        }
+    }
+
+    /// Close every connection currently served by this listener
+    pub fn drop_connections(&self) -> usize {
+        self.manager.drop_all_connections()
+    }
+
+    /// Close the listening socket for `duration`; clients get connection refused meanwhile
+    pub fn pause(&self, duration: Duration) -> crate::Result<()> {
+        self.send(ListenerCommand::Pause(duration))
+    }
+
+    /// Drop all connections and rebind the socket, like a server restart
+    pub fn restart(&self) -> crate::Result<()> {
+        self.send(ListenerCommand::Restart)
+    }
+
+    fn drop_for_restart(&self) {
+        let dropped = self.drop_connections();
+        info!(
+            "Restarting listener {} on {} ({} connection(s) dropped)",
+            self.name, self.addr, dropped
+        );
+    }
+
+    fn send(&self, command: ListenerCommand) -> crate::Result<()> {
+        self.commands.send(command).map_err(|_| {
+            crate::YamlBaseError::Protocol(format!("Listener {} has stopped", self.name))
+        })
+    }
+}
+
+/// An accept loop that can be paused and restarted through its [`ListenerControl`]
+pub struct ManagedListener {
+    control: ListenerControl,
+    commands: mpsc::UnboundedReceiver<ListenerCommand>,
+}
+
+impl ManagedListener {
+    pub fn new(name: impl Into<String>, addr: String, manager: ConnectionManager) -> Self {
+        let (tx, rx) = mpsc::unbounded_channel();
+        Self {
+            control: ListenerControl {
+                name: name.into(),
+                addr,
+                manager,
+                accepting: Arc::new(AtomicBool::new(false)),
+                commands: tx,
+            },
+            commands: rx,
+        }
+    }
+
+    pub fn control(&self) -> ListenerControl {
+        self.control.clone()
+    }
+
+    /// Serve connections on `listener`, rebinding the same address after pauses and restarts
+    pub async fn run(mut self, listener: TcpListener) -> crate::Result<()> {
+        let control = self.control.clone();
+        let mut listener = Some(listener);
+
+        loop {
+            let active = match listener.take() {
+                Some(listener) => listener,
+                None => TcpListener::bind(&control.addr).await?,
+            };
+            control.accepting.store(true, Ordering::SeqCst);
+
+            let command = loop {
+                tokio::select! {
+                    accepted = active.accept() => {
+                        let (stream, client_addr) = accepted?;
+                        let client_addr_str = client_addr.to_string();
+                        info!("New connection from {}", client_addr_str);
+
+                        let manager = control.manager.clone();
+                        tokio::spawn(async move {
+                            if let Err(e) = manager
+                                .handle_connection(stream, client_addr_str.clone())
+                                .await
+                            {
+                                error!("Connection error from {}: {}", client_addr_str, e);
+                            }
+                        });
+                    }
+                    command = self.commands.recv() => break command,
+                }
+            };
+
+            drop(active);
+            control.accepting.store(false, Ordering::SeqCst);
+
+            match command {
+                None => return Ok(()),
+                Some(ListenerCommand::Restart) => control.drop_for_restart(),
+                Some(ListenerCommand::Pause(duration)) => {
+                    info!(
+                        "Listener {} on {} paused for {:?}",
+                        control.name, control.addr, duration
+                    );
+                    // Any further command ends the pause early; a restart still
+                    // drops the connections opened before it
+                    tokio::select! {
+                        _ = tokio::time::sleep(duration) => {}
+                        command = self.commands.recv() => {
+                            match command {
+                                None => return Ok(()),
+                                Some(ListenerCommand::Restart) => control.drop_for_restart(),
+                                Some(ListenerCommand::Pause(_)) => {}
+                            }
+                        }
+                    }
+                    info!("Listener {} on {} resumed", control.name, control.addr);
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::Config;
+    use crate::database::{Database, Storage};
+    use clap::Parser;
+    use tokio::io::AsyncReadExt;
+    use tokio::net::TcpStream;
+
+    async fn managed_listener() -> (ManagedListener, TcpListener, String) {
+        let config = Config::parse_from(["yamlbase", "-f", "db.yaml"]);
+        let storage = Storage::new(Database::new("test".to_string()));
+        let manager = ConnectionManager::new(Arc::new(config), Arc::new(storage));
+
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        (
+            ManagedListener::new("primary", addr.clone(), manager),
+            listener,
+            addr,
+        )
+    }
+
+    #[tokio::test]
+    async fn test_pause_refuses_connections_until_resumed() {
+        let (managed, listener, addr) = managed_listener().await;
+        let control = managed.control();
+        tokio::spawn(managed.run(listener));
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(control.status().accepting);
+
+        control.pause(Duration::from_millis(300)).unwrap();
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert!(!control.status().accepting);
+        assert!(TcpStream::connect(&addr).await.is_err());
+
+        tokio::time::sleep(Duration::from_millis(400)).await;
+        assert!(control.status().accepting);
+        assert!(TcpStream::connect(&addr).await.is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_restart_rebinds_listener() {
+        let (managed, listener, addr) = managed_listener().await;
+        let control = managed.control();
+        tokio::spawn(managed.run(listener));
+
+        control.restart().unwrap();
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert!(control.status().accepting);
+        assert!(TcpStream::connect(&addr).await.is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_restart_while_paused_drops_connections_and_resumes() {
+        let (managed, listener, addr) = managed_listener().await;
+        let control = managed.control();
+        tokio::spawn(managed.run(listener));
+        let mut client = TcpStream::connect(&addr).await.unwrap();
+        tokio::time::sleep(Duration::from_millis(50)).await;
+
+        control.pause(Duration::from_secs(60)).unwrap();
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(!control.status().accepting);
+
+        control.restart().unwrap();
+        let mut buf = [0u8; 16];
+        let read = tokio::time::timeout(Duration::from_secs(2), client.read(&mut buf))
+            .await
+            .expect("the connection from before the pause was not dropped");
+        assert!(matches!(read, Ok(0) | Err(_)));
+
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert!(control.status().accepting);
+        assert!(TcpStream::connect(&addr).await.is_ok());
+    }
+}
@@ -2,12 +2,35 @@ use std::sync::Arc;
 use tokio::net::TcpListener;
 use tracing::{error, info};
 
+use crate::admin::{AdminServer, AdminState};
 use crate::config::Config;
-use crate::database::Storage;
-use crate::yaml::{FileWatcher, parse_yaml_database};
+use crate::crash_dump::{self, Crash, CrashDumps, QueryLog};
+use crate::database::wal::{self, WriteAheadLog};
+use crate::database::{Clock, DiskStore, Storage, Upstream, UuidGenerator, UuidMode};
+use crate::protocol::auth::AuthBackends;
+use crate::sql::budget::QueryBudgets;
+use crate::sql::n_plus_one::NPlusOneDetector;
+use crate::yaml::{FileWatcher, find_dataset_file, load_yaml_database, load_yaml_str};
 
+mod checkpoint;
 mod connection_manager;
+mod health;
+mod listener;
+mod netem;
+mod replica;
+mod sessions;
+mod soak;
+mod webhook;
+mod write_back;
 pub use connection_manager::{ConnectionManager, ConnectionStats};
+pub use health::{HealthGates, parse_min_rows};
+pub use listener::{ListenerControl, ListenerStatus, ManagedListener};
+pub use netem::{NetworkConditions, parse_bandwidth};
+pub use sessions::{
+    QuotaExceeded, SessionInfo, SessionLimits, SessionSlot, SessionUsage, Sessions,
+    parse_connection_limit,
+};
+pub use webhook::{WebhookEvent, WebhookNotifier};
 
 #[cfg(test)]
 mod tests;
@@ -15,12 +38,41 @@ mod tests;
 pub struct Server {
     config: Arc<Config>,
     storage: Storage,
+    webhooks: WebhookNotifier,
 }
 
 impl Server {
     pub async fn new(mut config: Config) -> crate::Result<Self> {
+        // One instance of a sharded fixture suite serves a single file of it
+        if config.file.is_dir() {
+            config.file = find_dataset_file(&config.file, config.database.as_deref()).await?;
+            info!("Serving dataset file {}", config.file.display());
+        }
+
+        Self::check_options(&config)?;
+
         // Parse initial database
-        let (database, auth_config) = parse_yaml_database(&config.file).await?;
+        let mut disk_store = None;
+        let (database, auth_config) = match &config.disk_store {
+            Some(dir) => {
+                let (store, database, auth) =
+                    DiskStore::open(dir, &config.file, config.cache_size).await?;
+                disk_store = Some(Arc::new(store));
+                (database, auth)
+            }
+            None => load_yaml_database(&config.file, config.skip_invalid).await?,
+        };
+
+        let health = HealthGates::from_config(&config);
+        if health.is_enabled() {
+            health.check(&database, |table| {
+                disk_store
+                    .as_ref()
+                    .and_then(|store| store.row_count(&table.name))
+                    .unwrap_or(table.rows.len())
+            })?;
+            info!("Dataset has the tables and rows --require-tables and --min-rows ask for");
+        }
 
         // If auth is specified in YAML, override command line args
         if let Some(auth) = auth_config {
@@ -34,23 +86,199 @@ impl Server {
             info!("Using default authentication: username={}", config.username);
         }
 
+        if AuthBackends::from_config(&config)?.is_enabled() {
+            info!("Checking users the static list lacks against --auth-ldap or --auth-command");
+        }
+        let webhooks = WebhookNotifier::new(&config.webhooks)?;
+        let mut storage = Storage::new(database);
+        let session_limits = SessionLimits::from_config(&config);
+        if session_limits.is_enabled() {
+            info!(
+                "Limiting connections per user to {:?} and per database to {:?}",
+                session_limits.per_user, session_limits.per_database
+            );
+            storage = storage.with_sessions(Arc::new(Sessions::new(session_limits)));
+        }
+        if config.crash_dump_dir.is_some() {
+            storage = storage.with_query_log(Arc::new(QueryLog::default()));
+        }
+        if let Some(disk_store) = disk_store {
+            storage = storage.with_disk_store(disk_store);
+        }
+        if let Some(at) = config.clock {
+            info!("Server clock fixed at {}", at);
+            storage = storage.with_clock(Clock::fixed(at));
+        }
+        match config.uuids {
+            Some(UuidMode::Sequential) => info!("Making sequential UUIDs"),
+            Some(UuidMode::Seeded(seed)) => info!("Making UUIDs seeded with {}", seed),
+            Some(UuidMode::Random) | None => {}
+        }
+        if let Some(mode) = config.uuids {
+            storage = storage.with_uuids(UuidGenerator::new(mode));
+        }
+        if let Some(path) = &config.scenarios {
+            storage = storage.with_query_budgets(Arc::new(QueryBudgets::load(path)?));
+        }
+        if let Some(threshold) = config.n_plus_one_threshold {
+            storage = storage.with_n_plus_one_detector(Arc::new(NPlusOneDetector::new(
+                threshold,
+                config.n_plus_one_window,
+            )));
+        }
+        if config.persist {
+            storage = Self::restore_from_wal(&config, storage).await?;
+        }
+        if config.write_back {
+            storage = storage.with_write_back();
+        }
+        // After the replay, so writes logged before the restart are not announced again
+        storage = storage.with_webhooks(webhooks.clone());
+        if let Some(url) = &config.upstream {
+            storage = storage.with_upstream(Arc::new(Self::connect_upstream(&config, url).await?));
+        }
+        if let Some(dir) = &config.crash_dump_dir {
+            crash_dump::install(CrashDumps::new(dir, &config, storage.clone())?);
+            info!("Writing crash dumps to {}", dir.display());
+        }
         let config = Arc::new(config);
-        let storage = Storage::new(database);
 
-        Ok(Self { config, storage })
+        Ok(Self {
+            config,
+            storage,
+            webhooks,
+        })
+    }
+
+    /// Reject option combinations that cannot work together, before the WAL
+    /// is replayed, a disk store opened or anything else is touched
+    fn check_options(config: &Config) -> crate::Result<()> {
+        let conflict = |message: &str| Err(crate::YamlBaseError::Config(message.to_string()));
+        if config.write_back && (config.persist || config.hot_reload || config.disk_store.is_some())
+        {
+            // The file would be rewritten under the log, the watcher or the store reading it
+            return conflict(
+                "--write-back cannot be combined with --persist, --hot-reload or --disk-store",
+            );
+        }
+        if config.disk_store.is_some() {
+            if config.hot_reload || config.replicas > 0 {
+                return conflict("--disk-store cannot be combined with --hot-reload or --replicas");
+            }
+            if config.skip_invalid {
+                return conflict("--disk-store cannot be combined with --skip-invalid");
+            }
+        }
+        if config.persist && config.hot_reload {
+            // A reload would discard the logged writes and invalidate their row positions
+            return conflict("--persist cannot be combined with --hot-reload");
+        }
+        if !config.persist && config.checkpoint_interval.is_some() {
+            return conflict("--checkpoint-interval requires --persist");
+        }
+        if config.soak && config.soak_interval.is_zero() {
+            return conflict("--soak-interval must be longer than 0s");
+        }
+        if config.upstream.is_some() {
+            if config.persist || config.disk_store.is_some() {
+                // Neither keeps tables made at run time, so cached rows could not be restored
+                return conflict("--upstream cannot be combined with --persist or --disk-store");
+            }
+            if config.upstream_record && (config.write_back || config.hot_reload) {
+                // Both would rewrite or reload the file under the recorded rows
+                return conflict(
+                    "--upstream-record cannot be combined with --write-back or --hot-reload",
+                );
+            }
+        }
+        Ok(())
+    }
+
+    /// Connect to the `--upstream` database that misses are read through from
+    async fn connect_upstream(config: &Config, url: &str) -> crate::Result<Upstream> {
+        let upstream =
+            Upstream::connect(url, &config.upstream_schema, config.upstream_limit).await?;
+        info!(
+            "Reading misses through from upstream schema {}",
+            config.upstream_schema
+        );
+        if !config.upstream_record {
+            return Ok(upstream);
+        }
+        info!("Recording upstream rows in {}", config.file.display());
+        Ok(upstream.recording_to(config.file.clone()))
+    }
+
+    /// Replay the write-ahead log onto the freshly parsed database and keep logging to it
+    async fn restore_from_wal(config: &Config, storage: Storage) -> crate::Result<Storage> {
+        let wal_path = config.wal_path();
+        let base = tokio::fs::read(&config.file).await?;
+        let (wal, records) = WriteAheadLog::open(&wal_path, &base).await?;
+        wal::replay(&storage, &records).await?;
+        info!(
+            "Persisting writes to {} ({} logged write(s) replayed)",
+            wal_path.display(),
+            records.len()
+        );
+
+        Ok(storage.with_wal(Arc::new(wal)))
+    }
+
+    /// The storage the server serves
+    pub fn storage(&self) -> &Storage {
+        &self.storage
     }
 
     pub async fn run(self) -> crate::Result<()> {
+        let result = match self.bind().await {
+            Ok(listener) => self.serve(listener).await,
+            Err(e) => Err(e),
+        };
+        if let Err(e) = &result {
+            crash_dump::write(&Crash::fatal(e));
+        }
+        result
+    }
+
+    /// Bind the primary listener. With `--port 0` the system picks the port,
+    /// which the listener's local address then tells.
+    pub async fn bind(&self) -> crate::Result<TcpListener> {
         let addr = format!(
             "{}:{}",
             self.config.bind_address,
             self.config.effective_port()
         );
+        Ok(TcpListener::bind(&addr).await?)
+    }
+
+    /// Serve connections accepted by `listener`, a listener from `bind`
+    pub async fn serve(self, listener: TcpListener) -> crate::Result<()> {
+        let addr = listener.local_addr()?.to_string();
         info!("Starting YamlBase server on {}", addr);
 
         // Set up hot reload if enabled
         if self.config.hot_reload {
-            self.setup_hot_reload()?;
+            self.setup_hot_reload().await?;
+        }
+        if self.config.write_back {
+            let base = tokio::fs::read_to_string(&self.config.file).await?;
+            write_back::spawn_write_back(self.storage.clone(), self.config.file.clone(), base);
+            info!("Writing changes back to {}", self.config.file.display());
+        }
+        if let (Some(wal), Some(interval)) = (self.storage.wal(), self.config.checkpoint_interval) {
+            let base = tokio::fs::read_to_string(&self.config.file).await?;
+            checkpoint::spawn_checkpoints(
+                self.storage.clone(),
+                wal.clone(),
+                self.config.file.clone(),
+                base,
+                interval,
+            );
+            info!(
+                "Checkpointing the write-ahead log into {} every {}",
+                self.config.file.display(),
+                humantime_serde::re::humantime::format_duration(interval)
+            );
         }
 
         // Create connection manager for stable connection handling
@@ -59,54 +287,141 @@ impl Server {
 
         // Start background monitoring for connection stability
         let _monitoring_handle = connection_manager.start_monitoring();
+        if self.config.soak {
+            soak::spawn_soak(
+                self.storage.clone(),
+                connection_manager.clone(),
+                self.config.soak_interval,
+            );
+            info!(
+                "Soak mode: sampling resources every {}",
+                humantime_serde::re::humantime::format_duration(self.config.soak_interval)
+            );
+        }
 
-        // Start listening
-        let listener = TcpListener::bind(&addr).await?;
         info!(
             "Server listening on {} with connection stability features",
             addr
         );
+        self.webhooks.notify(WebhookEvent::Startup {
+            database: self.storage.database().read().await.name.clone(),
+            address: addr.clone(),
+        });
 
-        // Accept connections with enhanced stability handling
-        loop {
-            let (stream, client_addr) = listener.accept().await?;
-            let client_addr_str = client_addr.to_string();
-            info!("New connection from {}", client_addr_str);
+        let primary = ManagedListener::new("primary", addr, connection_manager);
+        let mut controls = vec![primary.control()];
+        controls.extend(self.start_replicas().await?);
 
-            let manager = connection_manager.clone();
+        if let Some(admin_port) = self.config.admin_port {
+            let admin_addr = format!("{}:{}", self.config.bind_address, admin_port);
+            let admin_listener = TcpListener::bind(&admin_addr).await?;
+            info!("Admin API listening on {}", admin_addr);
+            let admin = AdminServer::new(AdminState {
+                storage: self.storage.clone(),
+                listeners: controls,
+            });
             tokio::spawn(async move {
-                if let Err(e) = manager
-                    .handle_connection(stream, client_addr_str.clone())
-                    .await
-                {
-                    error!("Connection error from {}: {}", client_addr_str, e);
+                if let Err(e) = admin.run(admin_listener).await {
+                    error!("Admin API stopped: {}", e);
                 }
             });
         }
+
+        primary.run(listener).await
+    }
+
+    /// Bind one listener per replica on the ports following the primary's, each
+    /// serving a copy of the database that trails the primary by `replica_lag`
+    async fn start_replicas(&self) -> crate::Result<Vec<ListenerControl>> {
+        let mut controls = Vec::new();
+        for replica_idx in 1..=self.config.replicas {
+            let port = self
+                .config
+                .effective_port()
+                .checked_add(replica_idx)
+                .ok_or_else(|| {
+                    crate::YamlBaseError::Config(format!(
+                        "Replica {} port is out of range",
+                        replica_idx
+                    ))
+                })?;
+            let addr = format!("{}:{}", self.config.bind_address, port);
+
+            let snapshot = self.storage.database().read().await.clone();
+            let mut replica_storage = Storage::new(snapshot)
+                .with_clock(self.storage.clock().clone())
+                .with_uuids(self.storage.uuids().clone())
+                .with_sessions(self.storage.sessions().clone())
+                .with_read_only();
+            if let Some(log) = self.storage.query_log() {
+                replica_storage = replica_storage.with_query_log(log.clone());
+            }
+            replica::spawn_replicator(
+                self.storage.clone(),
+                replica_storage.clone(),
+                self.config.replica_lag,
+            );
+
+            let manager = ConnectionManager::new(self.config.clone(), Arc::new(replica_storage));
+            let listener = TcpListener::bind(&addr).await?;
+            info!(
+                "Replica {} listening on {} (lag {:?})",
+                replica_idx, addr, self.config.replica_lag
+            );
+
+            let replica = ManagedListener::new(format!("replica-{}", replica_idx), addr, manager);
+            controls.push(replica.control());
+            tokio::spawn(async move {
+                if let Err(e) = replica.run(listener).await {
+                    error!("Replica {} listener stopped: {}", replica_idx, e);
+                }
+            });
+        }
+
+        Ok(controls)
     }
 
-    fn setup_hot_reload(&self) -> crate::Result<()> {
-        let (watcher, mut rx) = FileWatcher::new(self.config.file.clone());
+    async fn setup_hot_reload(&self) -> crate::Result<()> {
+        let checksum = self.storage.database().read().await.checksum.clone();
+        let (watcher, mut rx) = FileWatcher::new(self.config.file.clone(), checksum);
         watcher
             .start()
             .map_err(|e| crate::YamlBaseError::Io(std::io::Error::other(e)))?;
 
         let storage = self.storage.clone();
         let config = self.config.clone();
+        let webhooks = self.webhooks.clone();
+        let health = HealthGates::from_config(&config);
 
         tokio::spawn(async move {
-            while let Some(()) = rx.recv().await {
+            while let Some(content) = rx.recv().await {
                 info!("Reloading database from file");
-                match parse_yaml_database(&config.file).await {
+                // Parse the exact contents the watcher checksummed, so a file
+                // replaced again meanwhile cannot be half-applied
+                match load_yaml_str(&content, config.skip_invalid) {
                     Ok((new_db, _auth)) => {
+                        // A file that fails the startup checks is not served
+                        if let Err(e) = health.check(&new_db, |table| table.rows.len()) {
+                            error!("Not reloading the database: {}", e);
+                            continue;
+                        }
                         // Note: We don't update auth on hot reload for security reasons
                         // Auth changes require a server restart
-                        let db_arc = storage.database();
-                        let mut db = db_arc.write().await;
-                        *db = new_db;
-                        drop(db);
-                        storage.rebuild_indexes().await;
-                        info!("Database reloaded successfully");
+                        let database = new_db.name.clone();
+                        let tables = new_db.tables.len();
+                        let checksum = new_db.checksum.clone();
+                        storage.reload(new_db).await;
+                        info!(
+                            "Database reloaded successfully (version {}, checksum {})",
+                            storage.dataset_version(),
+                            checksum.as_deref().unwrap_or("-")
+                        );
+                        webhooks.notify(WebhookEvent::Reload {
+                            database,
+                            tables,
+                            checksum,
+                            version: storage.dataset_version(),
+                        });
                     }
                     Err(e) => {
                         error!("Failed to reload database: {}", e);
@@ -0,0 +1,220 @@
+//! Socket-level network emulation: bandwidth caps, per-packet delay and random resets.
+//!
+//! The protocol handlers work directly on a `TcpStream`, so shaping is done by
+//! a loopback relay: the handler gets one end of a local socket pair while a
+//! relay task copies bytes between the other end and the real client, pacing
+//! and occasionally resetting the traffic.
+
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::tcp::{OwnedReadHalf, OwnedWriteHalf};
+use tokio::net::{TcpListener, TcpStream};
+use tracing::{debug, info};
+
+use crate::config::Config;
+
+/// Roughly one Ethernet segment, so delays apply per packet rather than per buffer
+const PACKET_SIZE: usize = 1460;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct NetworkConditions {
+    /// Maximum throughput per direction, in bytes per second
+    pub bandwidth: Option<u64>,
+    /// Delay added before each packet is forwarded
+    pub packet_delay: Duration,
+    /// Probability (0.0-1.0) that forwarding a packet resets the connection instead
+    pub reset_probability: f64,
+}
+
+impl NetworkConditions {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            bandwidth: config.net_bandwidth,
+            packet_delay: config.net_packet_delay,
+            reset_probability: config.net_reset_probability,
+        }
+    }
+
+    pub fn is_active(&self) -> bool {
+        self.bandwidth.is_some() || !self.packet_delay.is_zero() || self.reset_probability > 0.0
+    }
+
+    fn transmit_time(&self, bytes: usize) -> Duration {
+        match self.bandwidth {
+            Some(bandwidth) if bandwidth > 0 => {
+                Duration::from_secs_f64(bytes as f64 / bandwidth as f64)
+            }
+            _ => Duration::ZERO,
+        }
+    }
+}
+
+/// Put a shaping relay in front of `client`, returning the stream the protocol should use
+pub(crate) async fn shape(
+    client: TcpStream,
+    conditions: NetworkConditions,
+) -> std::io::Result<TcpStream> {
+    let relay_listener = TcpListener::bind("127.0.0.1:0").await?;
+    let relay = TcpStream::connect(relay_listener.local_addr()?).await?;
+    let (server_side, _) = relay_listener.accept().await?;
+    relay.set_nodelay(true)?;
+    server_side.set_nodelay(true)?;
+
+    let (client_read, client_write) = client.into_split();
+    let (relay_read, relay_write) = relay.into_split();
+
+    tokio::spawn(async move {
+        // Whichever direction finishes first tears down the whole connection
+        let outcome = tokio::select! {
+            outcome = pump(client_read, relay_write, conditions) => outcome,
+            outcome = pump_to_client(relay_read, client_write, conditions) => outcome,
+        };
+        if let Err(e) = outcome {
+            debug!("Shaped connection ended: {}", e);
+        }
+    });
+
+    Ok(server_side)
+}
+
+async fn pump(
+    mut reader: OwnedReadHalf,
+    mut writer: OwnedWriteHalf,
+    conditions: NetworkConditions,
+) -> std::io::Result<()> {
+    let mut buf = [0u8; PACKET_SIZE];
+    loop {
+        let n = reader.read(&mut buf).await?;
+        if n == 0 {
+            return Ok(());
+        }
+        forward(&mut writer, &buf[..n], conditions).await?;
+    }
+}
+
+/// Like [`pump`], but a reset aborts the client socket with RST instead of a clean close
+async fn pump_to_client(
+    mut reader: OwnedReadHalf,
+    mut writer: OwnedWriteHalf,
+    conditions: NetworkConditions,
+) -> std::io::Result<()> {
+    let mut buf = [0u8; PACKET_SIZE];
+    loop {
+        let n = reader.read(&mut buf).await?;
+        if n == 0 {
+            return Ok(());
+        }
+        if conditions.reset_probability > 0.0
+            && rand::random::<f64>() < conditions.reset_probability
+        {
+            info!("Network emulation: resetting connection");
+            abort_on_close(writer.as_ref());
+            return Err(std::io::Error::from(std::io::ErrorKind::ConnectionReset));
+        }
+        forward(&mut writer, &buf[..n], conditions).await?;
+    }
+}
+
+/// Set SO_LINGER to zero so closing the socket sends RST rather than FIN
+fn abort_on_close(stream: &TcpStream) {
+    #[cfg(unix)]
+    {
+        use std::os::unix::io::AsRawFd;
+
+        let linger = libc::linger {
+            l_onoff: 1,
+            l_linger: 0,
+        };
+        unsafe {
+            libc::setsockopt(
+                stream.as_raw_fd(),
+                libc::SOL_SOCKET,
+                libc::SO_LINGER,
+                &linger as *const _ as *const libc::c_void,
+                std::mem::size_of::<libc::linger>() as libc::socklen_t,
+            );
+        }
+    }
+    #[cfg(not(unix))]
+    let _ = stream;
+}
+
+async fn forward(
+    writer: &mut OwnedWriteHalf,
+    packet: &[u8],
+    conditions: NetworkConditions,
+) -> std::io::Result<()> {
+    if !conditions.packet_delay.is_zero() {
+        tokio::time::sleep(conditions.packet_delay).await;
+    }
+    writer.write_all(packet).await?;
+    let transmit = conditions.transmit_time(packet.len());
+    if !transmit.is_zero() {
+        tokio::time::sleep(transmit).await;
+    }
+    Ok(())
+}
+
+/// Parse a byte rate such as `65536`, `64k`, `1.5m/s` or `2g` (binary multiples)
+pub fn parse_bandwidth(input: &str) -> Result<u64, String> {
+    let input = input.trim().to_lowercase();
+    crate::config::parse_byte_size(input.strip_suffix("/s").unwrap_or(&input))
+        .map_err(|e| format!("Invalid bandwidth: {}", e))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Instant;
+
+    #[test]
+    fn test_parse_bandwidth() {
+        assert_eq!(parse_bandwidth("65536"), Ok(65536));
+        assert_eq!(parse_bandwidth("64k"), Ok(65536));
+        assert_eq!(parse_bandwidth("64KB/s"), Ok(65536));
+        assert_eq!(parse_bandwidth("1.5m"), Ok(1_572_864));
+        assert!(parse_bandwidth("fast").is_err());
+        assert!(parse_bandwidth("0").is_err());
+    }
+
+    async fn shaped_pair(conditions: NetworkConditions) -> (TcpStream, TcpStream) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let client = TcpStream::connect(listener.local_addr().unwrap())
+            .await
+            .unwrap();
+        let (accepted, _) = listener.accept().await.unwrap();
+        (client, shape(accepted, conditions).await.unwrap())
+    }
+
+    #[tokio::test]
+    async fn test_bandwidth_cap_slows_transfer() {
+        let conditions = NetworkConditions {
+            bandwidth: Some(32 * 1024),
+            ..Default::default()
+        };
+        let (mut client, mut server) = shaped_pair(conditions).await;
+
+        let payload = vec![7u8; 16 * 1024];
+        let started = Instant::now();
+        server.write_all(&payload).await.unwrap();
+
+        let mut received = vec![0u8; payload.len()];
+        client.read_exact(&mut received).await.unwrap();
+        assert_eq!(received, payload);
+        assert!(started.elapsed() >= Duration::from_millis(400));
+    }
+
+    #[tokio::test]
+    async fn test_reset_closes_client_connection() {
+        let conditions = NetworkConditions {
+            reset_probability: 1.0,
+            ..Default::default()
+        };
+        let (mut client, mut server) = shaped_pair(conditions).await;
+
+        server.write_all(b"hello").await.unwrap();
+        let mut buf = [0u8; 5];
+        let result = client.read(&mut buf).await;
+        assert!(matches!(result, Ok(0) | Err(_)));
+    }
+}
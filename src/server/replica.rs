@@ -0,0 +1,94 @@
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::sync::watch;
+use tokio::task::JoinHandle;
+use tokio::time::Instant;
+use tracing::debug;
+
+use crate::database::{Database, Storage};
+
+/// Copy the primary's database into `replica` whenever it changes, `lag` after the change
+pub(crate) fn spawn_replicator(
+    primary: Storage,
+    replica: Storage,
+    lag: Duration,
+) -> JoinHandle<()> {
+    // Only the newest snapshot waits to be applied: one taken while another
+    // is due replaces it, so a burst of writes holds two copies at most
+    let pending = Arc::new(Mutex::new(None::<(Instant, Database)>));
+    let (wake, mut woken) = watch::channel(());
+
+    // Each snapshot is applied no earlier than its change time plus lag
+    tokio::spawn({
+        let pending = Arc::clone(&pending);
+        async move {
+            while woken.changed().await.is_ok() {
+                let next = pending.lock().unwrap().take();
+                let Some((changed_at, snapshot)) = next else {
+                    continue;
+                };
+                tokio::time::sleep_until(changed_at + lag).await;
+                let db_arc = replica.database();
+                let mut db = db_arc.write().await;
+                *db = snapshot;
+                drop(db);
+                replica.rebuild_indexes().await;
+                replica.mark_changed();
+                debug!("Replica caught up with primary");
+            }
+        }
+    });
+
+    let mut changes = primary.subscribe_changes();
+    tokio::spawn(async move {
+        while changes.changed().await.is_ok() {
+            let changed_at = Instant::now();
+            let snapshot = primary.database().read().await.clone();
+            *pending.lock().unwrap() = Some((changed_at, snapshot));
+            if wake.send(()).is_err() {
+                break;
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_replica_applies_changes_after_lag() {
+        let primary = Storage::new(Database::new("primary".to_string()));
+        let replica = Storage::new(primary.database().read().await.clone());
+        spawn_replicator(primary.clone(), replica.clone(), Duration::from_millis(200));
+
+        primary.database().write().await.name = "renamed".to_string();
+        primary.mark_changed();
+
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert_eq!(replica.database().read().await.name, "primary");
+
+        tokio::time::sleep(Duration::from_millis(400)).await;
+        assert_eq!(replica.database().read().await.name, "renamed");
+    }
+
+    #[tokio::test]
+    async fn test_replica_keeps_only_the_newest_pending_snapshot() {
+        let primary = Storage::new(Database::new("primary".to_string()));
+        let replica = Storage::new(primary.database().read().await.clone());
+        spawn_replicator(primary.clone(), replica.clone(), Duration::from_millis(200));
+
+        for version in 1..=20 {
+            primary.database().write().await.name = format!("v{}", version);
+            primary.mark_changed();
+            tokio::task::yield_now().await;
+        }
+
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert_eq!(replica.database().read().await.name, "primary");
+
+        // The first snapshot taken is applied, then the newest, with none in between kept
+        tokio::time::sleep(Duration::from_millis(600)).await;
+        assert_eq!(replica.database().read().await.name, "v20");
+    }
+}
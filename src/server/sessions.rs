@@ -0,0 +1,280 @@
+//! The sessions open on the server and the connection quotas they count
+//! against.
+//!
+//! A connection opens a session once it has logged in, naming its user and
+//! database, and closes it when its slot is dropped. `--max-user-connections`
+//! caps the sessions one user may hold at once, `--user-connection-limit`
+//! overrides that for a single user, and `--max-database-connections` caps
+//! the sessions on one database, like PostgreSQL's per-role and per-database
+//! `CONNECTION LIMIT`. The open sessions are listed in `pg_stat_activity`
+//! and counted in `pg_stat_database` and `GET /connections`.
+
+use chrono::NaiveDateTime;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::sync::atomic::{AtomicU32, AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+
+use crate::config::Config;
+
+/// How many sessions a user, or a database, may hold at once
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SessionLimits {
+    pub per_user: Option<usize>,
+    pub per_database: Option<usize>,
+    /// Limits of single users, overriding `per_user`
+    pub users: HashMap<String, usize>,
+}
+
+impl SessionLimits {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            per_user: config.max_user_connections,
+            per_database: config.max_database_connections,
+            users: config.user_connection_limits.iter().cloned().collect(),
+        }
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.per_user.is_some() || self.per_database.is_some() || !self.users.is_empty()
+    }
+
+    fn for_user(&self, user: &str) -> Option<usize> {
+        self.users.get(user).copied().or(self.per_user)
+    }
+}
+
+/// An open session, as `pg_stat_activity` lists it
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct SessionInfo {
+    pub pid: u32,
+    pub user: String,
+    pub database: String,
+    pub client_addr: Option<String>,
+    pub application_name: String,
+    pub backend_start: NaiveDateTime,
+}
+
+/// Why a session could not be opened
+#[derive(Debug, Clone, PartialEq)]
+pub enum QuotaExceeded {
+    User { user: String, limit: usize },
+    Database { database: String, limit: usize },
+}
+
+impl fmt::Display for QuotaExceeded {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            QuotaExceeded::User { user, .. } => {
+                write!(f, "too many connections for role \"{}\"", user)
+            }
+            QuotaExceeded::Database { database, .. } => {
+                write!(f, "too many connections for database \"{}\"", database)
+            }
+        }
+    }
+}
+
+/// Current usage, for `GET /connections`
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct SessionUsage {
+    pub total: usize,
+    pub users: BTreeMap<String, usize>,
+    pub databases: BTreeMap<String, usize>,
+    pub max_user_connections: Option<usize>,
+    pub max_database_connections: Option<usize>,
+    pub user_connection_limits: BTreeMap<String, usize>,
+    pub rejected_for_user: u64,
+    pub rejected_for_database: u64,
+}
+
+/// The sessions open on every listener of a server
+#[derive(Debug, Default)]
+pub struct Sessions {
+    limits: SessionLimits,
+    open: Mutex<BTreeMap<u32, SessionInfo>>,
+    last_pid: AtomicU32,
+    rejected_for_user: AtomicU64,
+    rejected_for_database: AtomicU64,
+}
+
+impl Sessions {
+    pub fn new(limits: SessionLimits) -> Self {
+        Self {
+            limits,
+            ..Self::default()
+        }
+    }
+
+    /// Open a session for `user` on `database`, unless either already holds
+    /// as many as it may; it stays open until the slot is dropped
+    pub fn open(
+        self: &Arc<Self>,
+        user: &str,
+        database: &str,
+        client_addr: Option<String>,
+        application_name: &str,
+        backend_start: NaiveDateTime,
+    ) -> Result<SessionSlot, QuotaExceeded> {
+        let mut open = self.open.lock().unwrap();
+        if let Some(limit) = self.limits.for_user(user) {
+            if open.values().filter(|s| s.user == user).count() >= limit {
+                self.rejected_for_user.fetch_add(1, Ordering::Relaxed);
+                return Err(QuotaExceeded::User {
+                    user: user.to_string(),
+                    limit,
+                });
+            }
+        }
+        if let Some(limit) = self.limits.per_database {
+            if open.values().filter(|s| s.database == database).count() >= limit {
+                self.rejected_for_database.fetch_add(1, Ordering::Relaxed);
+                return Err(QuotaExceeded::Database {
+                    database: database.to_string(),
+                    limit,
+                });
+            }
+        }
+
+        let pid = self.last_pid.fetch_add(1, Ordering::Relaxed) + 1;
+        open.insert(
+            pid,
+            SessionInfo {
+                pid,
+                user: user.to_string(),
+                database: database.to_string(),
+                client_addr,
+                application_name: application_name.to_string(),
+                backend_start,
+            },
+        );
+        Ok(SessionSlot {
+            sessions: self.clone(),
+            pid,
+        })
+    }
+
+    /// The open sessions, oldest first
+    pub fn list(&self) -> Vec<SessionInfo> {
+        self.open.lock().unwrap().values().cloned().collect()
+    }
+
+    pub fn usage(&self) -> SessionUsage {
+        let open = self.open.lock().unwrap();
+        let mut usage = SessionUsage {
+            total: open.len(),
+            max_user_connections: self.limits.per_user,
+            max_database_connections: self.limits.per_database,
+            user_connection_limits: self.limits.users.clone().into_iter().collect(),
+            rejected_for_user: self.rejected_for_user.load(Ordering::Relaxed),
+            rejected_for_database: self.rejected_for_database.load(Ordering::Relaxed),
+            ..SessionUsage::default()
+        };
+        for session in open.values() {
+            *usage.users.entry(session.user.clone()).or_default() += 1;
+            *usage.databases.entry(session.database.clone()).or_default() += 1;
+        }
+        usage
+    }
+}
+
+/// A session's place among the open sessions, given up when dropped
+#[derive(Debug)]
+pub struct SessionSlot {
+    sessions: Arc<Sessions>,
+    pid: u32,
+}
+
+impl SessionSlot {
+    /// The session's process ID, as `pg_stat_activity.pid` has it
+    pub fn pid(&self) -> u32 {
+        self.pid
+    }
+}
+
+impl Drop for SessionSlot {
+    fn drop(&mut self) {
+        self.sessions.open.lock().unwrap().remove(&self.pid);
+    }
+}
+
+/// A `--user-connection-limit` value: `USER=N`
+pub fn parse_connection_limit(input: &str) -> Result<(String, usize), String> {
+    let (user, limit) = input
+        .rsplit_once('=')
+        .ok_or_else(|| format!("Expected USER=N, got '{}'", input))?;
+    if user.is_empty() {
+        return Err(format!("Missing user in '{}'", input));
+    }
+    let limit = limit
+        .trim()
+        .parse()
+        .map_err(|_| format!("Invalid connection limit '{}'", limit))?;
+    Ok((user.to_string(), limit))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn start() -> NaiveDateTime {
+        chrono::NaiveDate::from_ymd_opt(2024, 1, 31)
+            .unwrap()
+            .and_hms_opt(12, 0, 0)
+            .unwrap()
+    }
+
+    #[test]
+    fn test_quotas_are_enforced() {
+        let sessions = Arc::new(Sessions::new(SessionLimits {
+            per_user: Some(2),
+            per_database: Some(3),
+            users: [("etl".to_string(), 1)].into_iter().collect(),
+        }));
+        let open = |user: &str, database: &str| sessions.open(user, database, None, "", start());
+
+        let first = open("alice", "shop").unwrap();
+        let _second = open("alice", "shop").unwrap();
+        let error = open("alice", "shop").unwrap_err();
+        assert_eq!(error.to_string(), "too many connections for role \"alice\"");
+
+        let _etl = open("etl", "shop").unwrap();
+        assert!(matches!(
+            open("etl", "other"),
+            Err(QuotaExceeded::User { limit: 1, .. })
+        ));
+        assert_eq!(
+            open("bob", "shop").unwrap_err().to_string(),
+            "too many connections for database \"shop\""
+        );
+        let _bob = open("bob", "other").unwrap();
+
+        // Closing a session frees its place
+        drop(first);
+        let third = open("alice", "shop").unwrap();
+        assert_eq!(third.pid(), 5);
+
+        let usage = sessions.usage();
+        assert_eq!(usage.total, 4);
+        assert_eq!(usage.users["alice"], 2);
+        assert_eq!(usage.databases["shop"], 3);
+        assert_eq!(usage.rejected_for_user, 2);
+        assert_eq!(usage.rejected_for_database, 1);
+        assert_eq!(
+            sessions.list().iter().map(|s| s.pid).collect::<Vec<_>>(),
+            [2, 3, 4, 5]
+        );
+    }
+
+    #[test]
+    fn test_parse_connection_limit() {
+        assert_eq!(
+            parse_connection_limit("etl=3").unwrap(),
+            ("etl".to_string(), 3)
+        );
+        assert!(parse_connection_limit("etl").is_err());
+        assert!(parse_connection_limit("=3").is_err());
+        assert!(parse_connection_limit("etl=many").is_err());
+    }
+}
@@ -0,0 +1,249 @@
+//! `--soak`: periodic resource samples for long-running instances, with a
+//! warning when one only ever grows.
+//!
+//! Every `--soak-interval` the server logs its live tasks, threads, resident
+//! and data memory, open file descriptors, connections, sessions and dataset
+//! rows. A figure that rises on [`GROWTH_SAMPLES`] samples without falling in
+//! between is reported as a warning, and again as long as it keeps rising,
+//! which is how a slow leak on a shared instance shows up long before it runs
+//! out of memory. Rows are sampled so that memory growing with the data can
+//! be told from memory that grows by itself.
+//!
+//! The process figures come from `/proc/self` and are left out where it does
+//! not exist.
+
+use std::collections::HashMap;
+use std::time::Duration;
+use tokio::task::JoinHandle;
+use tracing::{info, warn};
+
+use crate::database::Storage;
+use crate::server::ConnectionManager;
+
+/// Rises in a row, plateaus aside, that count as steady growth
+const GROWTH_SAMPLES: usize = 6;
+
+/// One figure of a sample
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Reading {
+    name: &'static str,
+    value: u64,
+    bytes: bool,
+}
+
+impl Reading {
+    fn count(name: &'static str, value: u64) -> Self {
+        Self {
+            name,
+            value,
+            bytes: false,
+        }
+    }
+
+    fn bytes(name: &'static str, value: u64) -> Self {
+        Self {
+            name,
+            value,
+            bytes: true,
+        }
+    }
+
+    fn describe(&self, value: u64) -> String {
+        if self.bytes {
+            format!("{:.1} MiB", value as f64 / (1024.0 * 1024.0))
+        } else {
+            value.to_string()
+        }
+    }
+}
+
+/// A figure's run of samples that rose or held level
+#[derive(Debug, Clone, Copy)]
+struct Run {
+    from: u64,
+    last: u64,
+    rises: usize,
+    samples: usize,
+}
+
+/// Steady growth of one figure
+#[derive(Debug, Clone, PartialEq)]
+struct Growth {
+    from: u64,
+    to: u64,
+    /// Samples taken since the growth began
+    samples: usize,
+}
+
+/// Follows each figure across samples to spot those that only grow
+#[derive(Debug, Default)]
+struct GrowthWatch {
+    runs: HashMap<&'static str, Run>,
+}
+
+impl GrowthWatch {
+    /// Take in a new value of `name`, telling whether it has now grown on
+    /// another [`GROWTH_SAMPLES`] samples without falling
+    fn observe(&mut self, name: &'static str, value: u64) -> Option<Growth> {
+        let run = self.runs.entry(name).or_insert(Run {
+            from: value,
+            last: value,
+            rises: 0,
+            samples: 0,
+        });
+        run.samples += 1;
+        if value < run.last {
+            *run = Run {
+                from: value,
+                last: value,
+                rises: 0,
+                samples: 1,
+            };
+            return None;
+        }
+        let rose = value > run.last;
+        run.last = value;
+        if !rose {
+            return None;
+        }
+        run.rises += 1;
+        (run.rises % GROWTH_SAMPLES == 0).then_some(Growth {
+            from: run.from,
+            to: value,
+            samples: run.samples,
+        })
+    }
+}
+
+/// Every `interval`, log a sample of the server's resources and warn about
+/// those that keep growing
+pub(crate) fn spawn_soak(
+    storage: Storage,
+    connections: ConnectionManager,
+    interval: Duration,
+) -> JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut ticks = tokio::time::interval(interval);
+        ticks.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        let mut watch = GrowthWatch::default();
+        loop {
+            ticks.tick().await;
+            let readings = sample(&storage, &connections).await;
+            info!(
+                "Soak sample: {}",
+                readings
+                    .iter()
+                    .map(|reading| format!("{} {}", reading.name, reading.describe(reading.value)))
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            );
+            for reading in &readings {
+                if let Some(growth) = watch.observe(reading.name, reading.value) {
+                    warn!(
+                        "Soak: {} grew from {} to {} over the last {}, without falling in between",
+                        reading.name,
+                        reading.describe(growth.from),
+                        reading.describe(growth.to),
+                        humantime_serde::re::humantime::format_duration(
+                            interval * growth.samples.saturating_sub(1) as u32
+                        )
+                    );
+                }
+            }
+        }
+    })
+}
+
+async fn sample(storage: &Storage, connections: &ConnectionManager) -> Vec<Reading> {
+    let mut readings = vec![Reading::count(
+        "tasks",
+        tokio::runtime::Handle::current()
+            .metrics()
+            .num_alive_tasks() as u64,
+    )];
+    let status = std::fs::read_to_string("/proc/self/status").unwrap_or_default();
+    if let Some(threads) = status_field(&status, "Threads") {
+        readings.push(Reading::count("threads", threads));
+    }
+    // Resident memory, and the heap with the other private mappings
+    if let Some(kb) = status_field(&status, "VmRSS") {
+        readings.push(Reading::bytes("resident memory", kb * 1024));
+    }
+    if let Some(kb) = status_field(&status, "VmData") {
+        readings.push(Reading::bytes("data memory", kb * 1024));
+    }
+    if let Ok(fds) = std::fs::read_dir("/proc/self/fd") {
+        readings.push(Reading::count("file descriptors", fds.count() as u64));
+    }
+    readings.push(Reading::count(
+        "connections",
+        connections.open_connections().await as u64,
+    ));
+    readings.push(Reading::count(
+        "sessions",
+        storage.sessions().list().len() as u64,
+    ));
+    let rows = {
+        let database = storage.database();
+        let db = database.read().await;
+        db.tables
+            .values()
+            .map(|table| table.rows.len() as u64)
+            .sum()
+    };
+    readings.push(Reading::count("rows", rows));
+    readings
+}
+
+/// The number in a `/proc/self/status` line such as `VmRSS:  4120 kB`
+fn status_field(status: &str, field: &str) -> Option<u64> {
+    status.lines().find_map(|line| {
+        let value = line.strip_prefix(field)?.strip_prefix(':')?;
+        value.split_whitespace().next()?.parse().ok()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_steady_growth_is_reported() {
+        let mut watch = GrowthWatch::default();
+        let mut reports = Vec::new();
+        // Level samples neither count as rises nor end the run
+        for value in [100, 110, 110, 120, 130, 140, 150, 160, 170] {
+            reports.extend(watch.observe("rss", value));
+        }
+        assert_eq!(
+            reports,
+            [Growth {
+                from: 100,
+                to: 160,
+                samples: 8
+            }]
+        );
+
+        // A fall starts over
+        for value in [150, 160, 170, 180, 190, 200] {
+            assert_eq!(watch.observe("rss", value), None);
+        }
+        assert_eq!(
+            watch.observe("rss", 210),
+            Some(Growth {
+                from: 150,
+                to: 210,
+                samples: 7
+            })
+        );
+        assert_eq!(watch.observe("fds", 10), None);
+    }
+
+    #[test]
+    fn test_status_fields_are_read() {
+        let status = "Name:\tyamlbase\nThreads:\t9\nVmRSS:\t   41232 kB\n";
+        assert_eq!(status_field(status, "Threads"), Some(9));
+        assert_eq!(status_field(status, "VmRSS"), Some(41232));
+        assert_eq!(status_field(status, "VmData"), None);
+    }
+}
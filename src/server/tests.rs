@@ -1,7 +1,10 @@
 #[cfg(test)]
 use crate::config::{Config, Protocol};
 use crate::server::Server;
+use crate::sql::{QueryExecutor, parse_sql};
+use clap::Parser;
 use std::io::Write;
+use std::sync::Arc;
 use tempfile::NamedTempFile;
 
 #[tokio::test]
@@ -35,10 +38,49 @@ tables:
         log_level: "error".to_string(),
         database: None,
         allow_anonymous: false,
+        auth_ldap: None,
+        auth_ldap_dn: "{user}".to_string(),
+        auth_command: None,
+        max_user_connections: None,
+        user_connection_limits: vec![],
+        max_database_connections: None,
         max_connections: None,
         connection_timeout: None,
         idle_timeout: None,
         enable_keepalive: false,
+        webhooks: vec![],
+        replicas: 0,
+        replica_lag: std::time::Duration::ZERO,
+        admin_port: None,
+        net_bandwidth: None,
+        net_packet_delay: std::time::Duration::ZERO,
+        net_reset_probability: 0.0,
+        persist: false,
+        wal_file: None,
+        checkpoint_interval: None,
+        write_back: false,
+        upstream: None,
+        upstream_schema: "public".to_string(),
+        upstream_limit: 1000,
+        upstream_record: false,
+        disk_store: None,
+        cache_size: 1024 * 1024 * 1024,
+        scenarios: None,
+        n_plus_one_threshold: None,
+        n_plus_one_window: std::time::Duration::from_secs(1),
+        skip_invalid: false,
+        require_tables: vec![],
+        min_rows: vec![],
+        crash_dump_dir: None,
+        soak: false,
+        soak_interval: std::time::Duration::from_secs(60),
+        clock: None,
+        timezone: "UTC".to_string(),
+        uuids: None,
+        max_prepared_statements: 1000,
+        output_buffer: 64 * 1024,
+        slow_client_timeout: std::time::Duration::from_secs(30),
+        max_identifier_length: None,
     };
 
     let server = Server::new(config).await.unwrap();
@@ -76,10 +118,49 @@ tables:
         log_level: "error".to_string(),
         database: None,
         allow_anonymous: false,
+        auth_ldap: None,
+        auth_ldap_dn: "{user}".to_string(),
+        auth_command: None,
+        max_user_connections: None,
+        user_connection_limits: vec![],
+        max_database_connections: None,
         max_connections: None,
         connection_timeout: None,
         idle_timeout: None,
         enable_keepalive: false,
+        webhooks: vec![],
+        replicas: 0,
+        replica_lag: std::time::Duration::ZERO,
+        admin_port: None,
+        net_bandwidth: None,
+        net_packet_delay: std::time::Duration::ZERO,
+        net_reset_probability: 0.0,
+        persist: false,
+        wal_file: None,
+        checkpoint_interval: None,
+        write_back: false,
+        upstream: None,
+        upstream_schema: "public".to_string(),
+        upstream_limit: 1000,
+        upstream_record: false,
+        disk_store: None,
+        cache_size: 1024 * 1024 * 1024,
+        scenarios: None,
+        n_plus_one_threshold: None,
+        n_plus_one_window: std::time::Duration::from_secs(1),
+        skip_invalid: false,
+        require_tables: vec![],
+        min_rows: vec![],
+        crash_dump_dir: None,
+        soak: false,
+        soak_interval: std::time::Duration::from_secs(60),
+        clock: None,
+        timezone: "UTC".to_string(),
+        uuids: None,
+        max_prepared_statements: 1000,
+        output_buffer: 64 * 1024,
+        slow_client_timeout: std::time::Duration::from_secs(30),
+        max_identifier_length: None,
     };
 
     let server = Server::new(config).await.unwrap();
@@ -88,3 +169,82 @@ tables:
     assert_eq!(server.config.username, "cli_user");
     assert_eq!(server.config.password, "cli_pass");
 }
+
+#[tokio::test]
+async fn test_option_conflicts_are_rejected_before_the_wal_is_opened() {
+    let dir = tempfile::tempdir().unwrap();
+    let file = dir.path().join("db.yaml");
+    std::fs::write(
+        &file,
+        "database:\n  name: test_db\ntables:\n  test:\n    columns:\n      id: INTEGER PRIMARY KEY\n",
+    )
+    .unwrap();
+    let wal = dir.path().join("db.wal");
+
+    for (options, message) in [
+        (&["--write-back"][..], "--write-back cannot be combined"),
+        (
+            &["--soak", "--soak-interval", "0s"][..],
+            "--soak-interval must be longer",
+        ),
+        (
+            &["--upstream", "postgres://localhost/shop"][..],
+            "--upstream cannot be combined",
+        ),
+    ] {
+        let mut args = vec![
+            "yamlbase",
+            "-f",
+            file.to_str().unwrap(),
+            "--persist",
+            "--wal-file",
+            wal.to_str().unwrap(),
+        ];
+        args.extend_from_slice(options);
+        let error = Server::new(Config::parse_from(args)).await.err().unwrap();
+        assert!(error.to_string().contains(message), "{}", error);
+        assert!(!wal.exists(), "{:?} touched the WAL", options);
+    }
+}
+
+#[tokio::test]
+async fn test_persisted_writes_survive_a_restart_but_schema_changes_are_refused() {
+    let dir = tempfile::tempdir().unwrap();
+    let file = dir.path().join("db.yaml");
+    std::fs::write(
+        &file,
+        "database:\n  name: test_db\ntables:\n  test:\n    columns:\n      id: INTEGER PRIMARY KEY\n",
+    )
+    .unwrap();
+    let wal = dir.path().join("db.wal");
+    let args = [
+        "yamlbase",
+        "-f",
+        file.to_str().unwrap(),
+        "--persist",
+        "--wal-file",
+        wal.to_str().unwrap(),
+    ];
+    let run = |server: &Server, sql: &str| {
+        let storage = Arc::new(server.storage().clone());
+        let statement = parse_sql(sql).unwrap().remove(0);
+        async move {
+            let executor = QueryExecutor::new(storage).await?;
+            executor.execute(&statement).await
+        }
+    };
+
+    let server = Server::new(Config::parse_from(args)).await.unwrap();
+    let error = run(&server, "CREATE TABLE notes (id INTEGER PRIMARY KEY)")
+        .await
+        .unwrap_err();
+    assert!(error.to_string().contains("--persist"), "{}", error);
+    assert!(run(&server, "DROP TABLE test").await.is_err());
+    run(&server, "INSERT INTO test VALUES (1)").await.unwrap();
+    drop(server);
+
+    let server = Server::new(Config::parse_from(args)).await.unwrap();
+    let rows = run(&server, "SELECT id FROM test").await.unwrap().rows;
+    assert_eq!(rows, [[crate::database::Value::Integer(1)]]);
+    assert!(run(&server, "SELECT id FROM notes").await.is_err());
+}
@@ -0,0 +1,324 @@
+use serde::Serialize;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tracing::{debug, warn};
+
+const DELIVERY_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// A state change reported to configured webhooks as a JSON POST body
+#[derive(Debug, Clone, Serialize)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum WebhookEvent {
+    Startup {
+        database: String,
+        address: String,
+    },
+    Reload {
+        database: String,
+        tables: usize,
+        /// SHA-256 of the reloaded dataset file
+        checksum: Option<String>,
+        /// How many datasets have been loaded, counting the initial one
+        version: u64,
+    },
+    Write {
+        database: String,
+        table: String,
+        operation: String,
+        rows: Vec<serde_json::Value>,
+    },
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct WebhookUrl {
+    host: String,
+    port: u16,
+    path: String,
+}
+
+impl WebhookUrl {
+    fn parse(url: &str) -> crate::Result<Self> {
+        let rest = url.strip_prefix("http://").ok_or_else(|| {
+            crate::YamlBaseError::Config(format!("Webhook URL '{}' must start with http://", url))
+        })?;
+
+        let (authority, path) = match rest.find('/') {
+            Some(idx) => (&rest[..idx], &rest[idx..]),
+            None => (rest, "/"),
+        };
+        let (host, port) = match authority.rsplit_once(':') {
+            Some((host, port)) => {
+                let port = port.parse().map_err(|_| {
+                    crate::YamlBaseError::Config(format!("Invalid port in webhook URL '{}'", url))
+                })?;
+                (host, port)
+            }
+            None => (authority, 80),
+        };
+        if host.is_empty() {
+            return Err(crate::YamlBaseError::Config(format!(
+                "Missing host in webhook URL '{}'",
+                url
+            )));
+        }
+
+        Ok(Self {
+            host: host.to_string(),
+            port,
+            path: path.to_string(),
+        })
+    }
+}
+
+/// Delivers [`WebhookEvent`]s to every configured URL without blocking the caller
+#[derive(Debug, Clone, Default)]
+pub struct WebhookNotifier {
+    urls: Arc<Vec<WebhookUrl>>,
+}
+
+impl WebhookNotifier {
+    pub fn new(urls: &[String]) -> crate::Result<Self> {
+        let urls = urls
+            .iter()
+            .map(|url| WebhookUrl::parse(url))
+            .collect::<crate::Result<Vec<_>>>()?;
+        Ok(Self {
+            urls: Arc::new(urls),
+        })
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        !self.urls.is_empty()
+    }
+
+    /// Fire an event at all webhooks in the background; failures are logged, not returned
+    pub fn notify(&self, event: WebhookEvent) {
+        if !self.is_enabled() {
+            return;
+        }
+
+        let body = match serde_json::to_string(&event) {
+            Ok(body) => Arc::new(body),
+            Err(e) => {
+                warn!("Failed to serialize webhook event: {}", e);
+                return;
+            }
+        };
+
+        for url in self.urls.iter().cloned() {
+            let body = body.clone();
+            tokio::spawn(async move {
+                match tokio::time::timeout(DELIVERY_TIMEOUT, deliver(&url, &body)).await {
+                    Ok(Ok(status)) if (200..300).contains(&status) => {
+                        debug!(
+                            "Webhook {}:{}{} returned {}",
+                            url.host, url.port, url.path, status
+                        )
+                    }
+                    Ok(Ok(status)) => warn!(
+                        "Webhook {}:{}{} returned HTTP {}",
+                        url.host, url.port, url.path, status
+                    ),
+                    Ok(Err(e)) => warn!(
+                        "Webhook {}:{}{} failed: {}",
+                        url.host, url.port, url.path, e
+                    ),
+                    Err(_) => warn!(
+                        "Webhook {}:{}{} timed out after {:?}",
+                        url.host, url.port, url.path, DELIVERY_TIMEOUT
+                    ),
+                }
+            });
+        }
+    }
+}
+
+async fn deliver(url: &WebhookUrl, body: &str) -> std::io::Result<u16> {
+    let mut stream = TcpStream::connect((url.host.as_str(), url.port)).await?;
+    let request = format!(
+        "POST {} HTTP/1.1\r\nHost: {}:{}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        url.path,
+        url.host,
+        url.port,
+        body.len(),
+        body
+    );
+    stream.write_all(request.as_bytes()).await?;
+
+    // Only the status line matters; the rest of the response is ignored
+    let mut response = Vec::new();
+    let mut buf = [0u8; 512];
+    while !response.contains(&b'\n') {
+        let n = stream.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        response.extend_from_slice(&buf[..n]);
+    }
+
+    let status_line = String::from_utf8_lossy(&response);
+    status_line
+        .split_whitespace()
+        .nth(1)
+        .and_then(|status| status.parse().ok())
+        .ok_or_else(|| std::io::Error::other("Malformed HTTP response from webhook"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Storage;
+    use crate::sql::{QueryExecutor, parse_sql};
+    use tokio::net::TcpListener;
+
+    #[test]
+    fn test_parse_webhook_url() {
+        assert_eq!(
+            WebhookUrl::parse("http://localhost:8080/hooks/yamlbase").unwrap(),
+            WebhookUrl {
+                host: "localhost".to_string(),
+                port: 8080,
+                path: "/hooks/yamlbase".to_string(),
+            }
+        );
+        assert_eq!(WebhookUrl::parse("http://orchestrator").unwrap().port, 80);
+        assert!(WebhookUrl::parse("https://example.com").is_err());
+        assert!(WebhookUrl::parse("http://:80/").is_err());
+    }
+
+    #[test]
+    fn test_event_payload_shape() {
+        let event = WebhookEvent::Write {
+            database: "shop".to_string(),
+            table: "users".to_string(),
+            operation: "insert".to_string(),
+            rows: vec![serde_json::json!({"id": 1})],
+        };
+        assert_eq!(
+            serde_json::to_value(&event).unwrap(),
+            serde_json::json!({
+                "event": "write",
+                "database": "shop",
+                "table": "users",
+                "operation": "insert",
+                "rows": [{"id": 1}],
+            })
+        );
+    }
+
+    #[tokio::test]
+    async fn test_notify_posts_json() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let notifier =
+            WebhookNotifier::new(&[format!("http://127.0.0.1:{}/events", port)]).unwrap();
+
+        notifier.notify(WebhookEvent::Reload {
+            database: "shop".to_string(),
+            tables: 2,
+            checksum: None,
+            version: 2,
+        });
+
+        let (mut socket, _) = listener.accept().await.unwrap();
+        let mut request = Vec::new();
+        let mut buf = [0u8; 1024];
+        while !String::from_utf8_lossy(&request).contains("\"tables\":2") {
+            let n = socket.read(&mut buf).await.unwrap();
+            assert!(n > 0, "connection closed before body was received");
+            request.extend_from_slice(&buf[..n]);
+        }
+        socket
+            .write_all(b"HTTP/1.1 204 No Content\r\n\r\n")
+            .await
+            .unwrap();
+
+        let request = String::from_utf8_lossy(&request);
+        assert!(request.starts_with("POST /events HTTP/1.1\r\n"));
+        assert!(request.contains("\"event\":\"reload\""));
+    }
+
+    /// The body of the next webhook request `listener` receives
+    async fn receive_event(listener: &TcpListener) -> serde_json::Value {
+        let (mut socket, _) = listener.accept().await.unwrap();
+        let mut request = Vec::new();
+        let mut buf = [0u8; 1024];
+        loop {
+            let n = socket.read(&mut buf).await.unwrap();
+            assert!(n > 0, "connection closed before body was received");
+            request.extend_from_slice(&buf[..n]);
+            let received = String::from_utf8_lossy(&request);
+            if let Some((_, body)) = received.split_once("\r\n\r\n") {
+                if let Ok(event) = serde_json::from_str(body) {
+                    socket
+                        .write_all(b"HTTP/1.1 204 No Content\r\n\r\n")
+                        .await
+                        .unwrap();
+                    return event;
+                }
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_committed_writes_are_notified() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let notifier =
+            WebhookNotifier::new(&[format!("http://127.0.0.1:{}/events", port)]).unwrap();
+        let (db, _) = crate::yaml::load_yaml_str(
+            r#"
+database:
+  name: shop
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "TEXT"
+"#,
+            false,
+        )
+        .unwrap();
+        let storage = Arc::new(Storage::new(db).with_webhooks(notifier));
+        let executor = QueryExecutor::new(storage).await.unwrap();
+        let statement = |sql: &str| parse_sql(sql).unwrap().remove(0);
+
+        executor
+            .execute(&statement("INSERT INTO users (id, name) VALUES (1, 'Ann')"))
+            .await
+            .unwrap();
+        assert_eq!(
+            receive_event(&listener).await,
+            serde_json::json!({
+                "event": "write",
+                "database": "shop",
+                "table": "users",
+                "operation": "insert",
+                "rows": [{"id": 1, "name": "Ann"}],
+            })
+        );
+
+        executor
+            .execute(&statement("UPDATE users SET name = 'Bo' WHERE id = 1"))
+            .await
+            .unwrap();
+        let event = receive_event(&listener).await;
+        assert_eq!(event["operation"], "update");
+        assert_eq!(event["rows"], serde_json::json!([{"id": 1, "name": "Bo"}]));
+
+        // A statement that changes nothing is not announced
+        executor
+            .execute(&statement("DELETE FROM users WHERE id = 2"))
+            .await
+            .unwrap();
+        executor
+            .execute(&statement("DELETE FROM users WHERE id = 1"))
+            .await
+            .unwrap();
+        let event = receive_event(&listener).await;
+        assert_eq!(event["operation"], "delete");
+        assert_eq!(event["rows"], serde_json::json!([{"id": 1, "name": "Bo"}]));
+    }
+}
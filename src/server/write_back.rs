@@ -0,0 +1,94 @@
+use std::path::PathBuf;
+use tokio::task::JoinHandle;
+use tracing::{debug, error};
+
+use crate::database::Storage;
+use crate::yaml::writer::{render_dataset, write_atomically};
+
+/// Rewrite the dataset file at `path` from the primary's rows whenever they
+/// change. `base` is the file as loaded; its schema and settings are kept and
+/// only the `data` sections are replaced.
+pub(crate) fn spawn_write_back(storage: Storage, path: PathBuf, base: String) -> JoinHandle<()> {
+    let mut changes = storage.subscribe_changes();
+    tokio::spawn(async move {
+        // Changes made while a write is in flight are folded into the next one
+        while changes.changed().await.is_ok() {
+            let rendered = {
+                let db = storage.database();
+                let db = db.read().await;
+                render_dataset(&base, &db)
+            };
+            let written = match rendered {
+                Ok(content) => write_atomically(&path, &content)
+                    .await
+                    .map_err(crate::YamlBaseError::from),
+                Err(e) => Err(e),
+            };
+            match written {
+                Ok(()) => debug!("Wrote changes back to {}", path.display()),
+                Err(e) => error!("Failed to write changes back to {}: {}", path.display(), e),
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{RowChange, Value};
+    use crate::yaml::parse_yaml_database;
+    use std::time::Duration;
+
+    const DATASET: &str = r#"
+database:
+  name: shop
+tables:
+  products:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "TEXT NOT NULL"
+    data:
+      - id: 1
+        name: "Widget"
+"#;
+
+    #[tokio::test]
+    async fn test_writes_reach_the_yaml_file() {
+        let dir =
+            std::env::temp_dir().join(format!("yamlbase-write-back-{}", uuid::Uuid::new_v4()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let file = dir.join("shop.yaml");
+        std::fs::write(&file, DATASET).unwrap();
+
+        let (database, _) = parse_yaml_database(&file).await.unwrap();
+        let storage = Storage::new(database);
+        spawn_write_back(storage.clone(), file.clone(), DATASET.to_string());
+
+        storage
+            .write_table("products", |_| {
+                Ok(vec![RowChange::Insert(vec![
+                    Value::Integer(2),
+                    Value::Text("Gadget".to_string()),
+                ])])
+            })
+            .await
+            .unwrap();
+
+        let mut reloaded = None;
+        for _ in 0..50 {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+            let (database, _) = parse_yaml_database(&file).await.unwrap();
+            if database.get_table("products").unwrap().rows.len() == 2 {
+                reloaded = Some(database);
+                break;
+            }
+        }
+        let reloaded = reloaded.expect("insert was not written back");
+        assert_eq!(
+            reloaded.get_table("products").unwrap().rows[1],
+            vec![Value::Integer(2), Value::Text("Gadget".to_string())]
+        );
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
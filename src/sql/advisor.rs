@@ -0,0 +1,516 @@
+//! Index advisor: watches the predicates of real queries and suggests indexes.
+//!
+//! Every executed query is scanned for columns compared against constants or
+//! joined on. Once a column of a large table that neither the primary key nor
+//! an index covers has been filtered often enough, a recommendation is logged
+//! (once) and listed by the admin API under `GET /advisor/indexes`.
+
+use dashmap::DashMap;
+use serde::Serialize;
+use sqlparser::ast::{
+    BinaryOperator, Expr, JoinConstraint, JoinOperator, Query, SetExpr, TableFactor, TableWithJoins,
+};
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use tracing::info;
+
+use crate::database::{Database, IndexKind, Table};
+
+/// Tables smaller than this are cheap to scan and never get a recommendation
+const DEFAULT_MIN_ROWS: usize = 1_000;
+/// How many queries must filter on a column before it is recommended
+const DEFAULT_MIN_QUERIES: u64 = 10;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum PredicateKind {
+    Equality,
+    Range,
+}
+
+#[derive(Debug, Default)]
+struct ColumnUsage {
+    equality: AtomicU64,
+    range: AtomicU64,
+    rows_scanned: AtomicU64,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct IndexRecommendation {
+    pub table: String,
+    pub column: String,
+    pub kind: IndexKind,
+    /// Queries that filtered or joined on the column
+    pub queries: u64,
+    /// Rows scanned by those queries in total
+    pub rows_scanned: u64,
+    pub message: String,
+}
+
+pub struct IndexAdvisor {
+    min_rows: usize,
+    min_queries: u64,
+    usage: DashMap<(String, String), ColumnUsage>,
+    /// Recommendations already logged, so each is reported only once
+    reported: DashMap<(String, String), ()>,
+}
+
+impl Default for IndexAdvisor {
+    fn default() -> Self {
+        Self::new(DEFAULT_MIN_ROWS, DEFAULT_MIN_QUERIES)
+    }
+}
+
+impl IndexAdvisor {
+    pub fn new(min_rows: usize, min_queries: u64) -> Self {
+        Self {
+            min_rows,
+            min_queries,
+            usage: DashMap::new(),
+            reported: DashMap::new(),
+        }
+    }
+
+    /// Record the indexable predicates of one executed query
+    pub fn observe(&self, query: &Query, db: &Database) {
+        let mut predicates = Vec::new();
+        collect_query(query, db, &mut predicates);
+
+        // A query filtering on the same column twice still counts once
+        let mut seen = HashMap::new();
+        for (table, column, kind) in predicates {
+            let entry = seen.entry((table, column)).or_insert(kind);
+            if kind == PredicateKind::Range {
+                *entry = kind;
+            }
+        }
+
+        for ((table, column), kind) in seen {
+            let rows = db.get_table(&table).map_or(0, |t| t.rows.len()) as u64;
+            let key = (table, column);
+            {
+                let usage = self.usage.entry(key.clone()).or_default();
+                match kind {
+                    PredicateKind::Equality => usage.equality.fetch_add(1, Ordering::Relaxed),
+                    PredicateKind::Range => usage.range.fetch_add(1, Ordering::Relaxed),
+                };
+                usage.rows_scanned.fetch_add(rows, Ordering::Relaxed);
+            }
+
+            if self.reported.contains_key(&key) {
+                continue;
+            }
+            let recommendation = self
+                .usage
+                .get(&key)
+                .and_then(|usage| self.recommendation(&key, &usage, db));
+            if let Some(recommendation) = recommendation {
+                if self.reported.insert(key, ()).is_none() {
+                    info!("Index advisor: {}", recommendation.message);
+                }
+            }
+        }
+    }
+
+    /// Current recommendations, most expensive workload first
+    pub fn recommendations(&self, db: &Database) -> Vec<IndexRecommendation> {
+        let mut recommendations: Vec<_> = self
+            .usage
+            .iter()
+            .filter_map(|entry| self.recommendation(entry.key(), entry.value(), db))
+            .collect();
+        recommendations.sort_by(|a, b| {
+            b.rows_scanned
+                .cmp(&a.rows_scanned)
+                .then_with(|| (&a.table, &a.column).cmp(&(&b.table, &b.column)))
+        });
+        recommendations
+    }
+
+    /// Forget all observed queries
+    pub fn reset(&self) {
+        self.usage.clear();
+        self.reported.clear();
+    }
+
+    fn recommendation(
+        &self,
+        key: &(String, String),
+        usage: &ColumnUsage,
+        db: &Database,
+    ) -> Option<IndexRecommendation> {
+        let (table_name, column_name) = key;
+        let table = db.get_table(table_name)?;
+        let column_idx = table.get_column_index(column_name)?;
+
+        // The primary key is already indexed
+        if table.primary_key_index == Some(column_idx) || table.rows.len() < self.min_rows {
+            return None;
+        }
+
+        let equality = usage.equality.load(Ordering::Relaxed);
+        let range = usage.range.load(Ordering::Relaxed);
+        let queries = equality + range;
+        if queries < self.min_queries {
+            return None;
+        }
+
+        let kind = if range > equality {
+            IndexKind::Btree
+        } else {
+            IndexKind::Hash
+        };
+        // An index led by the column serves the queries already; a btree serves both kinds
+        if table.indexes.iter().any(|index| {
+            index.columns[0].eq_ignore_ascii_case(&table.columns[column_idx].name)
+                && (index.kind == kind || index.kind == IndexKind::Btree)
+        }) {
+            return None;
+        }
+        let rows_scanned = usage.rows_scanned.load(Ordering::Relaxed);
+        Some(IndexRecommendation {
+            message: format!(
+                "add a {} index on {}.{} ({} queries filtered on it, scanning {} rows)",
+                kind.name(),
+                table.name,
+                table.columns[column_idx].name,
+                queries,
+                rows_scanned
+            ),
+            table: table.name.clone(),
+            column: table.columns[column_idx].name.clone(),
+            kind,
+            queries,
+            rows_scanned,
+        })
+    }
+}
+
+type Predicate = (String, String, PredicateKind);
+
+/// Tables visible in one SELECT, keyed by lower-cased alias or name
+type Scope<'a> = Vec<(String, &'a Table)>;
+
+fn collect_query(query: &Query, db: &Database, out: &mut Vec<Predicate>) {
+    if let Some(with) = &query.with {
+        for cte in &with.cte_tables {
+            collect_query(&cte.query, db, out);
+        }
+    }
+    collect_set_expr(&query.body, db, out);
+}
+
+fn collect_set_expr(body: &SetExpr, db: &Database, out: &mut Vec<Predicate>) {
+    match body {
+        SetExpr::Select(select) => {
+            let mut scope = Vec::new();
+            for table_with_joins in &select.from {
+                add_to_scope(table_with_joins, db, &mut scope, out);
+            }
+
+            let mut conditions: Vec<&Expr> = select.selection.iter().collect();
+            for table_with_joins in &select.from {
+                join_conditions(table_with_joins, &mut conditions);
+            }
+            for condition in conditions {
+                collect_expr(condition, &scope, db, out);
+            }
+        }
+        SetExpr::Query(query) => collect_query(query, db, out),
+        SetExpr::SetOperation { left, right, .. } => {
+            collect_set_expr(left, db, out);
+            collect_set_expr(right, db, out);
+        }
+        _ => {}
+    }
+}
+
+fn add_to_scope<'a>(
+    table_with_joins: &TableWithJoins,
+    db: &'a Database,
+    scope: &mut Scope<'a>,
+    out: &mut Vec<Predicate>,
+) {
+    let relations = std::iter::once(&table_with_joins.relation)
+        .chain(table_with_joins.joins.iter().map(|join| &join.relation));
+    for relation in relations {
+        match relation {
+            TableFactor::Table { name, alias, .. } => {
+                let Some(ident) = name.0.last() else {
+                    continue;
+                };
+                if let Some(table) = db.get_table(&ident.value) {
+                    let visible_as = alias.as_ref().map_or(&ident.value, |a| &a.name.value);
+                    scope.push((visible_as.to_lowercase(), table));
+                }
+            }
+            TableFactor::Derived { subquery, .. } => collect_query(subquery, db, out),
+            TableFactor::NestedJoin {
+                table_with_joins, ..
+            } => add_to_scope(table_with_joins, db, scope, out),
+            _ => {}
+        }
+    }
+}
+
+fn join_conditions<'a>(table_with_joins: &'a TableWithJoins, conditions: &mut Vec<&'a Expr>) {
+    for join in &table_with_joins.joins {
+        let constraint = match &join.join_operator {
+            JoinOperator::Inner(constraint)
+            | JoinOperator::LeftOuter(constraint)
+            | JoinOperator::RightOuter(constraint)
+            | JoinOperator::FullOuter(constraint) => constraint,
+            _ => continue,
+        };
+        if let JoinConstraint::On(expr) = constraint {
+            conditions.push(expr);
+        }
+    }
+}
+
+fn collect_expr(expr: &Expr, scope: &Scope, db: &Database, out: &mut Vec<Predicate>) {
+    match expr {
+        Expr::BinaryOp { left, op, right } => match op {
+            BinaryOperator::And | BinaryOperator::Or => {
+                collect_expr(left, scope, db, out);
+                collect_expr(right, scope, db, out);
+            }
+            BinaryOperator::Eq => {
+                let (left_col, right_col) = (resolve(left, scope), resolve(right, scope));
+                match (left_col, right_col) {
+                    // Join condition: either side benefits from an index
+                    (Some(l), Some(r)) => {
+                        out.push((l.0, l.1, PredicateKind::Equality));
+                        out.push((r.0, r.1, PredicateKind::Equality));
+                    }
+                    (Some(col), None) if is_constant(right) => {
+                        out.push((col.0, col.1, PredicateKind::Equality))
+                    }
+                    (None, Some(col)) if is_constant(left) => {
+                        out.push((col.0, col.1, PredicateKind::Equality))
+                    }
+                    _ => {}
+                }
+                collect_subqueries(left, db, out);
+                collect_subqueries(right, db, out);
+            }
+            BinaryOperator::Lt
+            | BinaryOperator::LtEq
+            | BinaryOperator::Gt
+            | BinaryOperator::GtEq => {
+                if let Some(col) = resolve(left, scope).filter(|_| is_constant(right)) {
+                    out.push((col.0, col.1, PredicateKind::Range));
+                } else if let Some(col) = resolve(right, scope).filter(|_| is_constant(left)) {
+                    out.push((col.0, col.1, PredicateKind::Range));
+                }
+                collect_subqueries(left, db, out);
+                collect_subqueries(right, db, out);
+            }
+            _ => {}
+        },
+        Expr::Between {
+            expr,
+            negated: false,
+            low,
+            high,
+        } => {
+            if let Some(col) =
+                resolve(expr, scope).filter(|_| is_constant(low) && is_constant(high))
+            {
+                out.push((col.0, col.1, PredicateKind::Range));
+            }
+        }
+        Expr::InList {
+            expr,
+            list,
+            negated: false,
+        } => {
+            if let Some(col) = resolve(expr, scope).filter(|_| list.iter().all(is_constant)) {
+                out.push((col.0, col.1, PredicateKind::Equality));
+            }
+        }
+        Expr::InSubquery {
+            expr,
+            subquery,
+            negated: false,
+        } => {
+            if let Some(col) = resolve(expr, scope) {
+                out.push((col.0, col.1, PredicateKind::Equality));
+            }
+            collect_query(subquery, db, out);
+        }
+        Expr::Nested(inner) => collect_expr(inner, scope, db, out),
+        other => collect_subqueries(other, db, out),
+    }
+}
+
+/// Correlated subqueries have their own scope, so only their inner predicates count
+fn collect_subqueries(expr: &Expr, db: &Database, out: &mut Vec<Predicate>) {
+    match expr {
+        Expr::Subquery(query)
+        | Expr::Exists {
+            subquery: query, ..
+        } => collect_query(query, db, out),
+        Expr::Nested(inner) | Expr::UnaryOp { expr: inner, .. } => {
+            collect_subqueries(inner, db, out)
+        }
+        _ => {}
+    }
+}
+
+/// Resolve a column reference to `(table, column)` using the SELECT's scope
+fn resolve(expr: &Expr, scope: &Scope) -> Option<(String, String)> {
+    let (qualifier, column) = match expr {
+        Expr::Identifier(ident) => (None, &ident.value),
+        Expr::CompoundIdentifier(parts) if parts.len() >= 2 => (
+            Some(parts[parts.len() - 2].value.to_lowercase()),
+            &parts[parts.len() - 1].value,
+        ),
+        Expr::Nested(inner) => return resolve(inner, scope),
+        _ => return None,
+    };
+
+    scope
+        .iter()
+        .filter(|(visible_as, _)| qualifier.as_ref().is_none_or(|q| q == visible_as))
+        .find_map(|(_, table)| {
+            let idx = table.get_column_index(column)?;
+            Some((table.name.clone(), table.columns[idx].name.clone()))
+        })
+}
+
+fn is_constant(expr: &Expr) -> bool {
+    match expr {
+        Expr::Value(_) | Expr::TypedString { .. } => true,
+        Expr::UnaryOp { expr, .. } | Expr::Nested(expr) | Expr::Cast { expr, .. } => {
+            is_constant(expr)
+        }
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{Column, Index, Value};
+    use crate::sql::parse_sql;
+    use crate::yaml::schema::SqlType;
+    use sqlparser::ast::Statement;
+
+    fn column(name: &str, primary_key: bool) -> Column {
+        Column {
+            name: name.to_string(),
+            sql_type: SqlType::Integer,
+            primary_key,
+            nullable: !primary_key,
+            unique: primary_key,
+            default: None,
+            references: None,
+        }
+    }
+
+    fn database() -> Database {
+        let mut db = Database::new("shop".to_string());
+        for (name, rows) in [("orders", 50), ("users", 5)] {
+            let mut table = Table::new(
+                name.to_string(),
+                vec![
+                    column("id", true),
+                    column("user_id", false),
+                    column("amount", false),
+                ],
+            );
+            for id in 0..rows {
+                table
+                    .insert_row(vec![
+                        Value::Integer(id),
+                        Value::Integer(id % 5),
+                        Value::Integer(id * 10),
+                    ])
+                    .unwrap();
+            }
+            db.add_table(table).unwrap();
+        }
+        db
+    }
+
+    fn observe(advisor: &IndexAdvisor, db: &Database, sql: &str) {
+        match parse_sql(sql).unwrap().remove(0) {
+            Statement::Query(query) => advisor.observe(&query, db),
+            other => panic!("not a query: {}", other),
+        }
+    }
+
+    #[test]
+    fn test_recommends_frequently_filtered_column() {
+        let db = database();
+        let advisor = IndexAdvisor::new(10, 3);
+
+        for user_id in 0..3 {
+            assert!(advisor.recommendations(&db).is_empty());
+            observe(
+                &advisor,
+                &db,
+                &format!("SELECT * FROM orders WHERE user_id = {}", user_id),
+            );
+        }
+
+        let recommendations = advisor.recommendations(&db);
+        assert_eq!(recommendations.len(), 1);
+        assert_eq!(recommendations[0].table, "orders");
+        assert_eq!(recommendations[0].column, "user_id");
+        assert_eq!(recommendations[0].kind, IndexKind::Hash);
+        assert_eq!(recommendations[0].rows_scanned, 150);
+        assert_eq!(
+            recommendations[0].message,
+            "add a hash index on orders.user_id (3 queries filtered on it, scanning 150 rows)"
+        );
+    }
+
+    #[test]
+    fn test_skips_indexed_columns_and_small_tables() {
+        let mut db = database();
+        let orders = db.get_table_mut("orders").unwrap();
+        let index = Index::new(
+            "orders_amount_idx".to_string(),
+            orders,
+            &["amount".to_string()],
+            IndexKind::Btree,
+            false,
+        )
+        .unwrap();
+        orders.indexes.push(index);
+        let advisor = IndexAdvisor::new(10, 1);
+
+        observe(&advisor, &db, "SELECT * FROM orders WHERE id = 7");
+        observe(&advisor, &db, "SELECT * FROM orders WHERE amount = 70");
+        observe(&advisor, &db, "SELECT * FROM users WHERE user_id = 1");
+        assert!(advisor.recommendations(&db).is_empty());
+    }
+
+    #[test]
+    fn test_resolves_aliases_joins_and_ranges() {
+        let db = database();
+        let advisor = IndexAdvisor::new(10, 1);
+
+        observe(
+            &advisor,
+            &db,
+            "SELECT o.id FROM users u JOIN orders o ON o.user_id = u.id \
+             WHERE o.amount BETWEEN 100 AND 200 \
+             AND o.id IN (SELECT id FROM orders WHERE amount > 5)",
+        );
+
+        let recommendations = advisor.recommendations(&db);
+        let found: Vec<_> = recommendations
+            .iter()
+            .map(|r| (r.table.as_str(), r.column.as_str(), r.kind))
+            .collect();
+        assert_eq!(
+            found,
+            vec![
+                ("orders", "amount", IndexKind::Btree),
+                ("orders", "user_id", IndexKind::Hash),
+            ]
+        );
+    }
+}
@@ -0,0 +1,493 @@
+//! PostgreSQL arrays: `INTEGER[]`, `TEXT[]` and other columns of a type
+//! followed by brackets, written in YAML as lists.
+//!
+//! A value is kept in the array's text form, `{1,2,3}` or `{"a b",NULL}`,
+//! which is what PostgreSQL sends clients, with each element in its type's
+//! form. Arrays have one dimension; nested `ARRAY[...]` constructors are
+//! flattened. `= ANY(tags)` and `<> ALL(tags)` compare with the elements of
+//! the row's array, `@>` and `<@` test containment, `array_agg` gathers a
+//! group's values into an array and `unnest` makes a row of each element,
+//! both in the select list and in FROM.
+
+use sqlparser::ast::{
+    BinaryOperator, Expr, FunctionArg, FunctionArgExpr, FunctionArguments, Ident, Select,
+    SelectItem, Statement, TableAlias, TableFactor, Visit, VisitMut, Visitor, VisitorMut,
+};
+use std::ops::ControlFlow;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+use crate::sql::coercion;
+use crate::sql::executor::QueryResult;
+use crate::sql::parse_sql;
+use crate::yaml::schema::SqlType;
+
+/// Whether text is an array literal rather than, say, hstore text
+pub(crate) fn is_literal(text: &str) -> bool {
+    let text = text.trim();
+    text.starts_with('{') && text.ends_with('}')
+}
+
+/// The elements of a PostgreSQL array literal such as `{1,"a b",NULL}`, with
+/// nested arrays flattened, or `None` when it is not one
+pub(crate) fn parse(literal: &str) -> Option<Vec<Option<String>>> {
+    let literal = literal.trim();
+    if !literal.starts_with('{') || !literal.ends_with('}') {
+        return None;
+    }
+
+    let mut elements = Vec::new();
+    let mut current = String::new();
+    // Whether an element has started, and whether it was quoted
+    let mut started = false;
+    let mut quoted = false;
+    let mut in_quotes = false;
+    let mut escaped = false;
+    let mut finish = |current: &mut String, started: &mut bool, quoted: &mut bool| {
+        if *started {
+            let text = std::mem::take(current);
+            elements.push(if *quoted {
+                Some(text)
+            } else if text.trim().eq_ignore_ascii_case("NULL") {
+                None
+            } else {
+                Some(text.trim().to_string())
+            });
+        }
+        *started = false;
+        *quoted = false;
+    };
+    for c in literal.chars() {
+        if escaped {
+            current.push(c);
+            escaped = false;
+            continue;
+        }
+        match c {
+            '\\' => {
+                escaped = true;
+                started = true;
+            }
+            '"' => {
+                in_quotes = !in_quotes;
+                quoted = true;
+                started = true;
+            }
+            _ if in_quotes => current.push(c),
+            ',' | '{' | '}' => finish(&mut current, &mut started, &mut quoted),
+            c if c.is_whitespace() => {
+                if started && !quoted {
+                    current.push(c);
+                }
+            }
+            c => {
+                current.push(c);
+                started = true;
+            }
+        }
+    }
+    if in_quotes || escaped {
+        return None;
+    }
+    Some(elements)
+}
+
+/// The text form of an array of the given elements, quoting those that
+/// would not read back as themselves
+pub(crate) fn format(elements: &[Value]) -> String {
+    let elements: Vec<String> = elements
+        .iter()
+        .map(|element| match element {
+            Value::Null => "NULL".to_string(),
+            Value::Boolean(true) => "t".to_string(),
+            Value::Boolean(false) => "f".to_string(),
+            element => quote(&element.to_string()),
+        })
+        .collect();
+    format!("{{{}}}", elements.join(","))
+}
+
+fn quote(text: &str) -> String {
+    let plain = !text.is_empty()
+        && !text.eq_ignore_ascii_case("NULL")
+        && !text
+            .chars()
+            .any(|c| matches!(c, '{' | '}' | ',' | '"' | '\\') || c.is_whitespace());
+    if plain {
+        return text.to_string();
+    }
+    format!("\"{}\"", text.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+/// The elements of an array value as text, none for a NULL array
+pub(crate) fn elements(value: &Value) -> crate::Result<Vec<Value>> {
+    let literal = match value {
+        Value::Null => return Ok(Vec::new()),
+        Value::Text(text) => text,
+        value => {
+            return Err(YamlBaseError::Database {
+                message: format!("{} is not an array", value),
+            });
+        }
+    };
+    let elements = parse(literal).ok_or_else(|| YamlBaseError::Database {
+        message: format!("malformed array literal: \"{}\"", literal),
+    })?;
+    Ok(elements
+        .into_iter()
+        .map(|element| element.map_or(Value::Null, Value::Text))
+        .collect())
+}
+
+/// The elements of an array value, each converted to the element type
+pub(crate) fn typed_elements(value: &Value, element_type: &SqlType) -> crate::Result<Vec<Value>> {
+    elements(value)?
+        .into_iter()
+        .map(|element| coercion::assign(element, element_type))
+        .collect()
+}
+
+/// Cast a value to an array of `element_type`, bringing its text to the
+/// canonical form
+pub(crate) fn cast(value: Value, element_type: &SqlType) -> crate::Result<Value> {
+    match value {
+        Value::Null => Ok(Value::Null),
+        value => Ok(Value::Text(format(&typed_elements(&value, element_type)?))),
+    }
+}
+
+/// Whether every element of `other` equals an element of `array`; NULL
+/// elements equal nothing
+pub(crate) fn contains(array: &Value, other: &Value) -> crate::Result<bool> {
+    let array = elements(array)?;
+    Ok(elements(other)?.iter().all(|wanted| {
+        !matches!(wanted, Value::Null)
+            && array
+                .iter()
+                .any(|element| !matches!(element, Value::Null) && coercion::equals(element, wanted))
+    }))
+}
+
+/// `left op ANY (array)`, or `ALL` when `all`: whether some element, or
+/// every one, satisfies the comparison, and NULL when that turns on a NULL
+pub(crate) fn compare_each(
+    left: &Value,
+    op: &BinaryOperator,
+    array: &Value,
+    all: bool,
+) -> crate::Result<Value> {
+    if matches!(array, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let mut unknown = false;
+    for element in elements(array)? {
+        match coercion::apply_comparison(op, left, &element)? {
+            Value::Boolean(result) if result != all => return Ok(Value::Boolean(result)),
+            Value::Null => unknown = true,
+            _ => {}
+        }
+    }
+    Ok(if unknown {
+        Value::Null
+    } else {
+        Value::Boolean(all)
+    })
+}
+
+/// The array function a call names, if any
+pub(crate) fn function(name: &str) -> Option<fn(&[Value]) -> crate::Result<Value>> {
+    let function: fn(&[Value]) -> crate::Result<Value> = match name.to_uppercase().as_str() {
+        "ARRAY_LENGTH" => array_length,
+        "CARDINALITY" => cardinality,
+        _ => return None,
+    };
+    Some(function)
+}
+
+/// `array_length(array, 1)`, NULL for an empty array as in PostgreSQL
+fn array_length(args: &[Value]) -> crate::Result<Value> {
+    let [array, dimension] = args else {
+        return Err(YamlBaseError::Database {
+            message: "ARRAY_LENGTH requires an array and a dimension".to_string(),
+        });
+    };
+    if matches!(array, Value::Null) || !matches!(dimension, Value::Integer(1)) {
+        return Ok(Value::Null);
+    }
+    Ok(match elements(array)?.len() {
+        0 => Value::Null,
+        len => Value::Integer(len as i64),
+    })
+}
+
+fn cardinality(args: &[Value]) -> crate::Result<Value> {
+    let [array] = args else {
+        return Err(YamlBaseError::Database {
+            message: "CARDINALITY requires an array".to_string(),
+        });
+    };
+    if matches!(array, Value::Null) {
+        return Ok(Value::Null);
+    }
+    Ok(Value::Integer(elements(array)?.len() as i64))
+}
+
+/// The `unnest(array)` calls of a select list, which make a row of each
+/// element of the arrays they are given
+pub(crate) struct Unnest {
+    columns: Vec<usize>,
+}
+
+impl Unnest {
+    /// The select with each top-level `unnest(array)` replaced by the array,
+    /// named `unnest` unless aliased, or `None` when it calls none
+    pub fn of(select: &Select) -> crate::Result<Option<(Self, Select)>> {
+        let calls: Vec<(usize, &Expr)> = select
+            .projection
+            .iter()
+            .enumerate()
+            .filter_map(|(index, item)| match item {
+                SelectItem::UnnamedExpr(expr) | SelectItem::ExprWithAlias { expr, .. } => {
+                    Some((index, unnest_argument(expr)?))
+                }
+                _ => None,
+            })
+            .collect();
+        if calls.is_empty() {
+            return Ok(None);
+        }
+        if select.projection.iter().any(|item| {
+            matches!(
+                item,
+                SelectItem::Wildcard(_) | SelectItem::QualifiedWildcard(..)
+            )
+        }) {
+            return Err(YamlBaseError::NotImplemented(
+                "unnest() next to * in a select list is not supported".to_string(),
+            ));
+        }
+
+        let mut arrays = select.clone();
+        for &(index, array) in &calls {
+            let alias = match &select.projection[index] {
+                SelectItem::ExprWithAlias { alias, .. } => alias.clone(),
+                _ => Ident::new("unnest"),
+            };
+            arrays.projection[index] = SelectItem::ExprWithAlias {
+                expr: array.clone(),
+                alias,
+            };
+        }
+        let columns = calls.into_iter().map(|(index, _)| index).collect();
+        Ok(Some((Self { columns }, arrays)))
+    }
+
+    /// The rows of the select's result, each repeated once for every element
+    /// of its longest array; shorter arrays are padded with NULLs, and a row
+    /// whose arrays are all empty or NULL is left out
+    pub fn expand(&self, mut result: QueryResult) -> crate::Result<QueryResult> {
+        let element_types: Vec<Option<SqlType>> = self
+            .columns
+            .iter()
+            .map(|&column| match result.column_types.get(column) {
+                Some(SqlType::Array(element)) => Some((**element).clone()),
+                _ => None,
+            })
+            .collect();
+        let mut rows = Vec::new();
+        for row in std::mem::take(&mut result.rows) {
+            let arrays = self
+                .columns
+                .iter()
+                .zip(&element_types)
+                .map(|(&column, element_type)| match element_type {
+                    Some(element_type) => typed_elements(&row[column], element_type),
+                    None => elements(&row[column]),
+                })
+                .collect::<crate::Result<Vec<_>>>()?;
+            let len = arrays.iter().map(Vec::len).max().unwrap_or(0);
+            for position in 0..len {
+                let mut expanded = row.clone();
+                for (&column, array) in self.columns.iter().zip(&arrays) {
+                    expanded[column] = array.get(position).cloned().unwrap_or(Value::Null);
+                }
+                rows.push(expanded);
+            }
+        }
+        for (&column, element_type) in self.columns.iter().zip(element_types) {
+            result.column_types[column] = element_type.unwrap_or(SqlType::Text);
+        }
+        result.rows = rows;
+        Ok(result)
+    }
+}
+
+/// The array of an `unnest(array)` call
+fn unnest_argument(expr: &Expr) -> Option<&Expr> {
+    let Expr::Function(function) = expr else {
+        return None;
+    };
+    let FunctionArguments::List(list) = &function.args else {
+        return None;
+    };
+    let is_unnest =
+        matches!(function.name.0.as_slice(), [name] if name.value.eq_ignore_ascii_case("UNNEST"));
+    match list.args.as_slice() {
+        [FunctionArg::Unnamed(FunctionArgExpr::Expr(array))] if is_unnest => Some(array),
+        _ => None,
+    }
+}
+
+/// The statement with each `unnest(...)` in FROM made a derived table that
+/// calls `unnest` in its select list, or `None` when it has none
+pub(crate) fn rewrite_from(statement: &Statement) -> crate::Result<Option<Statement>> {
+    if Visit::visit(statement, &mut FindUnnest).is_continue() {
+        return Ok(None);
+    }
+    let mut statement = statement.clone();
+    match VisitMut::visit(&mut statement, &mut FromUnnest) {
+        ControlFlow::Break(e) => Err(e),
+        ControlFlow::Continue(()) => Ok(Some(statement)),
+    }
+}
+
+struct FindUnnest;
+
+impl Visitor for FindUnnest {
+    type Break = ();
+
+    fn pre_visit_table_factor(&mut self, table_factor: &TableFactor) -> ControlFlow<()> {
+        if matches!(table_factor, TableFactor::UNNEST { .. }) {
+            ControlFlow::Break(())
+        } else {
+            ControlFlow::Continue(())
+        }
+    }
+}
+
+struct FromUnnest;
+
+impl VisitorMut for FromUnnest {
+    type Break = YamlBaseError;
+
+    fn pre_visit_table_factor(
+        &mut self,
+        table_factor: &mut TableFactor,
+    ) -> ControlFlow<YamlBaseError> {
+        let TableFactor::UNNEST {
+            alias, array_exprs, ..
+        } = table_factor
+        else {
+            return ControlFlow::Continue(());
+        };
+        match derived(alias.take(), array_exprs) {
+            Ok(derived) => {
+                *table_factor = derived;
+                ControlFlow::Continue(())
+            }
+            Err(e) => ControlFlow::Break(e),
+        }
+    }
+}
+
+/// `unnest(a, b) AS t(x, y)` as `(SELECT unnest(a) AS x, unnest(b) AS y) AS
+/// t`. As in PostgreSQL, the column of a single array without column names
+/// is named after the alias, and `unnest` without one.
+fn derived(alias: Option<TableAlias>, arrays: &[Expr]) -> crate::Result<TableFactor> {
+    let name = alias
+        .as_ref()
+        .map_or_else(|| Ident::new("unnest"), |alias| alias.name.clone());
+    let columns: Vec<String> = alias
+        .iter()
+        .flat_map(|alias| &alias.columns)
+        .map(ToString::to_string)
+        .collect();
+    let items: Vec<String> = arrays
+        .iter()
+        .enumerate()
+        .map(|(index, array)| {
+            let column = match columns.get(index) {
+                Some(column) => column.clone(),
+                None if arrays.len() == 1 => name.to_string(),
+                None => "unnest".to_string(),
+            };
+            format!("unnest({}) AS {}", array, column)
+        })
+        .collect();
+    match parse_sql(&format!("SELECT {}", items.join(", ")))?.pop() {
+        Some(Statement::Query(subquery)) => Ok(TableFactor::Derived {
+            lateral: false,
+            subquery,
+            alias: Some(TableAlias {
+                name,
+                columns: Vec::new(),
+            }),
+        }),
+        _ => Err(YamlBaseError::Database {
+            message: "unnest() in FROM needs at least one array".to_string(),
+        }),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn text(s: &str) -> Value {
+        Value::Text(s.to_string())
+    }
+
+    #[test]
+    fn test_array_literals() {
+        assert_eq!(
+            parse(r#"{1, 2,"a b",NULL,"NULL",{3,"q\"x"}}"#).unwrap(),
+            vec![
+                Some("1".to_string()),
+                Some("2".to_string()),
+                Some("a b".to_string()),
+                None,
+                Some("NULL".to_string()),
+                Some("3".to_string()),
+                Some("q\"x".to_string()),
+            ]
+        );
+        assert_eq!(parse("{}").unwrap(), Vec::<Option<String>>::new());
+        assert!(parse("1,2").is_none());
+        assert!(parse(r#"{"open}"#).is_none());
+
+        let elements = [
+            Value::Integer(1),
+            text("a b"),
+            Value::Null,
+            text("NULL"),
+            text(""),
+            text(r#"q"x"#),
+            Value::Boolean(true),
+        ];
+        let formatted = format(&elements);
+        assert_eq!(formatted, r#"{1,"a b",NULL,"NULL","","q\"x",t}"#);
+        assert_eq!(parse(&formatted).unwrap().len(), elements.len());
+        assert_eq!(
+            cast(text("{ 3, 01 ,NULL}"), &SqlType::Integer).unwrap(),
+            text("{3,1,NULL}")
+        );
+        assert!(cast(text("{a}"), &SqlType::Integer).is_err());
+    }
+
+    #[test]
+    fn test_comparisons_with_elements() {
+        let array = text("{1,2,NULL}");
+        let eq = BinaryOperator::Eq;
+        let any = |left: i64, array: &Value| compare_each(&Value::Integer(left), &eq, array, false);
+        assert_eq!(any(2, &array).unwrap(), Value::Boolean(true));
+        assert_eq!(any(3, &array).unwrap(), Value::Null);
+        assert_eq!(any(3, &text("{1,2}")).unwrap(), Value::Boolean(false));
+        assert_eq!(any(3, &text("{}")).unwrap(), Value::Boolean(false));
+        let all = compare_each(&Value::Integer(3), &BinaryOperator::Gt, &array, true);
+        assert_eq!(all.unwrap(), Value::Null);
+
+        assert!(contains(&array, &text("{2,1}")).unwrap());
+        assert!(!contains(&array, &text("{NULL}")).unwrap());
+        assert!(contains(&array, &text("{}")).unwrap());
+    }
+}
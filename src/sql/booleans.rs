@@ -0,0 +1,90 @@
+//! Booleans as each dialect has them.
+//!
+//! PostgreSQL's `boolean` is a type of its own. A column of it takes `TRUE`
+//! and `FALSE` and text reading as one, such as `'t'`, `'f'`, `'yes'` or
+//! `'off'`, but not a number, which has to be cast (`1::boolean`), and
+//! clients get it as `t` or `f`. MySQL has no such type: `BOOLEAN` is
+//! `TINYINT(1)`, which takes `0` and `1`, any other number being true, and
+//! reaches clients as the integers `1` and `0` in a `TINYINT(1)` column,
+//! which drivers scan into a bool.
+
+use crate::YamlBaseError;
+use crate::database::{Column, Value};
+use crate::sql::SqlDialect;
+use crate::yaml::schema::SqlType;
+
+/// Refuse a number stored into a PostgreSQL boolean column, as PostgreSQL
+/// does; anything else is converted as for any other column
+pub(crate) fn store(value: Value, column: &Column, dialect: SqlDialect) -> crate::Result<Value> {
+    let number = match value {
+        Value::Integer(_) => "integer",
+        Value::Float(_) | Value::Double(_) => "double precision",
+        Value::Decimal(_) => "numeric",
+        _ => return Ok(value),
+    };
+    if column.sql_type == SqlType::Boolean && dialect != SqlDialect::MySQL {
+        return Err(YamlBaseError::TypeConversion(format!(
+            "column \"{}\" is of type boolean but expression is of type {}",
+            column.name, number
+        )));
+    }
+    Ok(value)
+}
+
+/// A boolean in PostgreSQL's text format
+pub(crate) fn postgres_text(b: bool) -> &'static str {
+    if b { "t" } else { "f" }
+}
+
+/// A boolean as MySQL sends a `TINYINT(1)`
+pub(crate) fn mysql_text(b: bool) -> &'static str {
+    if b { "1" } else { "0" }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn column(sql_type: SqlType) -> Column {
+        Column {
+            name: "active".to_string(),
+            sql_type,
+            primary_key: false,
+            nullable: true,
+            unique: false,
+            default: None,
+            references: None,
+        }
+    }
+
+    #[test]
+    fn test_numbers_are_refused_by_postgres_booleans() {
+        let active = column(SqlType::Boolean);
+
+        let error = store(Value::Integer(1), &active, SqlDialect::PostgreSQL).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Type conversion error: column \"active\" is of type boolean but expression is of type integer"
+        );
+        assert_eq!(
+            store(Value::Integer(1), &active, SqlDialect::MySQL).unwrap(),
+            Value::Integer(1)
+        );
+        let text = Value::Text("t".to_string());
+        assert_eq!(
+            store(text.clone(), &active, SqlDialect::PostgreSQL).unwrap(),
+            text
+        );
+        assert_eq!(
+            store(
+                Value::Integer(1),
+                &column(SqlType::Integer),
+                SqlDialect::PostgreSQL
+            )
+            .unwrap(),
+            Value::Integer(1)
+        );
+        assert_eq!(postgres_text(false), "f");
+        assert_eq!(mysql_text(true), "1");
+    }
+}
@@ -0,0 +1,290 @@
+//! Query budgets per test scenario (`--scenarios FILE`).
+//!
+//! A scenario file declares, per scenario, how many queries and how much query
+//! time a test is expected to need:
+//!
+//! ```yaml
+//! scenarios:
+//!   checkout:
+//!     max_queries: 20
+//!     max_total_time: 200ms
+//!     max_query_time: 50ms
+//! ```
+//!
+//! Tests start a scenario through the admin API, run, and then ask the check
+//! endpoint whether the budget held. Every violation is also logged as a
+//! structured warning the moment it happens.
+
+use indexmap::IndexMap;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::Mutex;
+use std::time::Duration;
+use tracing::warn;
+
+/// Violations kept per scenario run; later ones are only counted
+const MAX_RECORDED_VIOLATIONS: usize = 100;
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct QueryBudget {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_queries: Option<u64>,
+    /// Combined execution time of all queries in the scenario
+    #[serde(
+        default,
+        with = "humantime_serde",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub max_total_time: Option<Duration>,
+    /// Execution time of any single query
+    #[serde(
+        default,
+        with = "humantime_serde",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub max_query_time: Option<Duration>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ScenarioFile {
+    scenarios: IndexMap<String, QueryBudget>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct BudgetViolation {
+    /// Which limit was crossed: `max_queries`, `max_total_time` or `max_query_time`
+    pub budget: &'static str,
+    pub limit: String,
+    pub actual: String,
+    /// The query that crossed the limit
+    pub sql: String,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct ScenarioReport {
+    pub scenario: String,
+    pub active: bool,
+    pub ok: bool,
+    pub queries: u64,
+    pub total_time_ms: f64,
+    pub budget: QueryBudget,
+    pub violation_count: usize,
+    pub violations: Vec<BudgetViolation>,
+}
+
+#[derive(Debug, Default)]
+struct ScenarioRun {
+    queries: u64,
+    total_time: Duration,
+    violation_count: usize,
+    violations: Vec<BudgetViolation>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    active: Option<String>,
+    runs: HashMap<String, ScenarioRun>,
+}
+
+#[derive(Debug, Default)]
+pub struct QueryBudgets {
+    budgets: IndexMap<String, QueryBudget>,
+    state: Mutex<State>,
+}
+
+impl QueryBudgets {
+    pub fn new(budgets: IndexMap<String, QueryBudget>) -> Self {
+        Self {
+            budgets,
+            state: Mutex::new(State::default()),
+        }
+    }
+
+    pub fn load(path: &Path) -> crate::Result<Self> {
+        let content = std::fs::read_to_string(path)?;
+        let file: ScenarioFile = serde_yaml::from_str(&content)?;
+        Ok(Self::new(file.scenarios))
+    }
+
+    pub fn scenario_names(&self) -> impl Iterator<Item = &str> {
+        self.budgets.keys().map(String::as_str)
+    }
+
+    pub fn active(&self) -> Option<String> {
+        self.state.lock().unwrap().active.clone()
+    }
+
+    pub fn is_active(&self) -> bool {
+        self.state.lock().unwrap().active.is_some()
+    }
+
+    /// Make `scenario` the one queries count against, clearing its previous run.
+    /// Returns false if no such scenario is declared.
+    pub fn start(&self, scenario: &str) -> bool {
+        if !self.budgets.contains_key(scenario) {
+            return false;
+        }
+        let mut state = self.state.lock().unwrap();
+        state
+            .runs
+            .insert(scenario.to_string(), ScenarioRun::default());
+        state.active = Some(scenario.to_string());
+        true
+    }
+
+    /// Stop counting queries; results stay available to [`QueryBudgets::report`]
+    pub fn stop(&self) {
+        self.state.lock().unwrap().active = None;
+    }
+
+    /// Count one executed query against the active scenario, if any
+    pub fn record(&self, sql: &str, elapsed: Duration) {
+        let mut state = self.state.lock().unwrap();
+        let Some(scenario) = state.active.clone() else {
+            return;
+        };
+        let Some(budget) = self.budgets.get(&scenario) else {
+            return;
+        };
+        let run = state.runs.entry(scenario.clone()).or_default();
+
+        let previous_time = run.total_time;
+        run.queries += 1;
+        run.total_time += elapsed;
+
+        let mut violations = Vec::new();
+        if let Some(limit) = budget.max_queries {
+            // Report the crossing once rather than for every query after it
+            if run.queries == limit + 1 {
+                violations.push(("max_queries", limit.to_string(), run.queries.to_string()));
+            }
+        }
+        if let Some(limit) = budget.max_total_time {
+            if previous_time <= limit && run.total_time > limit {
+                violations.push((
+                    "max_total_time",
+                    format_ms(limit),
+                    format_ms(run.total_time),
+                ));
+            }
+        }
+        if let Some(limit) = budget.max_query_time {
+            if elapsed > limit {
+                violations.push(("max_query_time", format_ms(limit), format_ms(elapsed)));
+            }
+        }
+
+        for (budget, limit, actual) in violations {
+            warn!(
+                scenario = %scenario,
+                budget,
+                limit = %limit,
+                actual = %actual,
+                sql,
+                "Query budget exceeded"
+            );
+            run.violation_count += 1;
+            if run.violations.len() < MAX_RECORDED_VIOLATIONS {
+                run.violations.push(BudgetViolation {
+                    budget,
+                    limit,
+                    actual,
+                    sql: sql.to_string(),
+                });
+            }
+        }
+    }
+
+    /// The latest run of `scenario`, or None if it is not declared
+    pub fn report(&self, scenario: &str) -> Option<ScenarioReport> {
+        let budget = self.budgets.get(scenario)?;
+        let state = self.state.lock().unwrap();
+        let empty = ScenarioRun::default();
+        let run = state.runs.get(scenario).unwrap_or(&empty);
+
+        Some(ScenarioReport {
+            scenario: scenario.to_string(),
+            active: state.active.as_deref() == Some(scenario),
+            ok: run.violation_count == 0,
+            queries: run.queries,
+            total_time_ms: run.total_time.as_secs_f64() * 1000.0,
+            budget: budget.clone(),
+            violation_count: run.violation_count,
+            violations: run.violations.clone(),
+        })
+    }
+}
+
+fn format_ms(duration: Duration) -> String {
+    format!("{:.3}ms", duration.as_secs_f64() * 1000.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn budgets() -> QueryBudgets {
+        let file: ScenarioFile = serde_yaml::from_str(
+            r#"
+scenarios:
+  checkout:
+    max_queries: 2
+    max_total_time: 30ms
+  search:
+    max_query_time: 5ms
+"#,
+        )
+        .unwrap();
+        QueryBudgets::new(file.scenarios)
+    }
+
+    #[test]
+    fn test_queries_outside_a_scenario_are_ignored() {
+        let budgets = budgets();
+        budgets.record("SELECT 1", Duration::from_secs(1));
+        assert_eq!(budgets.report("checkout").unwrap().queries, 0);
+        assert!(!budgets.start("unknown"));
+        assert!(budgets.report("unknown").is_none());
+    }
+
+    #[test]
+    fn test_count_and_total_time_violations_are_reported_once() {
+        let budgets = budgets();
+        assert!(budgets.start("checkout"));
+        for _ in 0..4 {
+            budgets.record("SELECT * FROM orders", Duration::from_millis(10));
+        }
+
+        let report = budgets.report("checkout").unwrap();
+        assert!(!report.ok);
+        assert_eq!(report.queries, 4);
+        let crossed: Vec<_> = report.violations.iter().map(|v| v.budget).collect();
+        assert_eq!(crossed, vec!["max_queries", "max_total_time"]);
+        assert_eq!(report.violations[0].actual, "3");
+        assert_eq!(report.violations[1].limit, "30.000ms");
+
+        // Restarting the scenario starts a clean run
+        budgets.start("checkout");
+        assert!(budgets.report("checkout").unwrap().ok);
+    }
+
+    #[test]
+    fn test_slow_queries_are_reported_individually() {
+        let budgets = budgets();
+        budgets.start("search");
+        budgets.record("SELECT slow", Duration::from_millis(8));
+        budgets.record("SELECT fast", Duration::from_millis(1));
+        budgets.record("SELECT slower", Duration::from_millis(9));
+        budgets.stop();
+        budgets.record("SELECT ignored", Duration::from_millis(50));
+
+        let report = budgets.report("search").unwrap();
+        assert!(!report.active);
+        assert_eq!(report.queries, 3);
+        let slow: Vec<_> = report.violations.iter().map(|v| v.sql.as_str()).collect();
+        assert_eq!(slow, vec!["SELECT slow", "SELECT slower"]);
+    }
+}
@@ -0,0 +1,216 @@
+//! Binary strings: PostgreSQL's `BYTEA` and MySQL's `BLOB`.
+//!
+//! A binary value is held as PostgreSQL's hex text, `\x` then two lowercase
+//! hex digits a byte, which is how PostgreSQL clients see it in text format;
+//! in binary format, and on MySQL, clients get the bytes themselves. YAML
+//! writes values in hex, `\x89504e47` or `0x89504E47`, or in base64, as
+//! `iVBORw0KGgo=`. Text stored into a binary column is read as PostgreSQL
+//! reads it: hex after a `\x`, otherwise the bytes of the text itself.
+//! `encode(data, 'hex' | 'base64' | 'escape')` and `decode(text, format)`
+//! convert between binary values and text.
+
+use base64::Engine;
+use base64::engine::general_purpose::STANDARD;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+
+/// Bytes as a binary column holds them: `\x` and their hex digits
+pub(crate) fn to_text(bytes: &[u8]) -> String {
+    format!("\\x{}", hex::encode(bytes))
+}
+
+/// The bytes of a binary value held as hex text
+pub(crate) fn bytes(value: &Value) -> crate::Result<Vec<u8>> {
+    match value {
+        Value::Text(text) => from_hex(text),
+        value => Ok(value.to_string().into_bytes()),
+    }
+}
+
+/// A binary value written in YAML: hex after `\x` or `0x`, else base64
+pub(crate) fn parse(s: &str) -> crate::Result<String> {
+    let s = s.trim();
+    if s.starts_with("\\x") || s.starts_with("0x") || s.starts_with("0X") {
+        return from_hex(s).map(|bytes| to_text(&bytes));
+    }
+    STANDARD
+        .decode(s.split_whitespace().collect::<String>())
+        .map(|bytes| to_text(&bytes))
+        .map_err(|_| {
+            YamlBaseError::TypeConversion(format!(
+                "Invalid binary value '{}' (expected base64, or hex after \\x or 0x)",
+                s
+            ))
+        })
+}
+
+/// A value stored into a binary column or cast with `::bytea`: text in hex
+/// after `\x` is checked, and other text stands for its own bytes
+pub(crate) fn cast(value: Value) -> crate::Result<Value> {
+    match value {
+        Value::Null => Ok(Value::Null),
+        Value::Text(text) if text.starts_with("\\x") => {
+            from_hex(&text).map(|bytes| Value::Text(to_text(&bytes)))
+        }
+        value => Ok(Value::Text(to_text(value.to_string().as_bytes()))),
+    }
+}
+
+fn from_hex(text: &str) -> crate::Result<Vec<u8>> {
+    let digits = text
+        .strip_prefix("\\x")
+        .or_else(|| text.strip_prefix("0x"))
+        .or_else(|| text.strip_prefix("0X"))
+        .unwrap_or(text);
+    hex::decode(digits).map_err(|_| {
+        YamlBaseError::TypeConversion(format!("Invalid hexadecimal binary value '{}'", text))
+    })
+}
+
+/// The binary string function a call names, if it is one
+pub(crate) fn function(name: &str) -> Option<fn(&[Value]) -> crate::Result<Value>> {
+    let function: fn(&[Value]) -> crate::Result<Value> = match name.to_uppercase().as_str() {
+        "ENCODE" => encode,
+        "DECODE" => decode,
+        _ => return None,
+    };
+    Some(function)
+}
+
+/// `encode(data, format)`: binary data as hex, base64 or escaped text
+fn encode(args: &[Value]) -> crate::Result<Value> {
+    let [data, format] = args else {
+        return Err(YamlBaseError::Database {
+            message: "ENCODE requires binary data and a format".to_string(),
+        });
+    };
+    if matches!(data, Value::Null) || matches!(format, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let bytes = match data {
+        Value::Text(text) if text.starts_with("\\x") => from_hex(text)?,
+        data => data.to_string().into_bytes(),
+    };
+    let text = match format.to_string().to_lowercase().as_str() {
+        "hex" => hex::encode(&bytes),
+        "base64" => STANDARD.encode(&bytes),
+        "escape" => bytes
+            .iter()
+            .map(|&b| match b {
+                b'\\' => "\\\\".to_string(),
+                0x20..=0x7e => (b as char).to_string(),
+                b => format!("\\{:03o}", b),
+            })
+            .collect(),
+        other => return Err(unknown_format(other)),
+    };
+    Ok(Value::Text(text))
+}
+
+/// `decode(text, format)`: the binary data hex, base64 or escaped text
+/// stands for
+fn decode(args: &[Value]) -> crate::Result<Value> {
+    let [text, format] = args else {
+        return Err(YamlBaseError::Database {
+            message: "DECODE requires text and a format".to_string(),
+        });
+    };
+    if matches!(text, Value::Null) || matches!(format, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let text = text.to_string();
+    let invalid = |format: &str| YamlBaseError::Database {
+        message: format!("Invalid {} data: '{}'", format, text),
+    };
+    let bytes = match format.to_string().to_lowercase().as_str() {
+        "hex" => hex::decode(text.trim()).map_err(|_| invalid("hex"))?,
+        "base64" => STANDARD
+            .decode(text.split_whitespace().collect::<String>())
+            .map_err(|_| invalid("base64"))?,
+        "escape" => unescape(&text).ok_or_else(|| invalid("escape"))?,
+        other => return Err(unknown_format(other)),
+    };
+    Ok(Value::Text(to_text(&bytes)))
+}
+
+/// The bytes of `escape` text: `\\` is a backslash and `\ooo` an octal byte
+fn unescape(text: &str) -> Option<Vec<u8>> {
+    let bytes = text.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut pos = 0;
+    while pos < bytes.len() {
+        match bytes[pos] {
+            b'\\' if bytes.get(pos + 1) == Some(&b'\\') => {
+                decoded.push(b'\\');
+                pos += 2;
+            }
+            b'\\' => {
+                let octal = std::str::from_utf8(bytes.get(pos + 1..pos + 4)?).ok()?;
+                decoded.push(u8::from_str_radix(octal, 8).ok()?);
+                pos += 4;
+            }
+            b => {
+                decoded.push(b);
+                pos += 1;
+            }
+        }
+    }
+    Some(decoded)
+}
+
+fn unknown_format(format: &str) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!(
+            "Unrecognized encoding: '{}' (expected hex, base64 or escape)",
+            format
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn text(s: &str) -> Value {
+        Value::Text(s.to_string())
+    }
+
+    #[test]
+    fn test_binary_values_are_held_as_hex() {
+        assert_eq!(parse("\\x89504E47").unwrap(), "\\x89504e47");
+        assert_eq!(parse("0x89504e47").unwrap(), "\\x89504e47");
+        assert_eq!(parse("iVBORw==").unwrap(), "\\x89504e47");
+        assert_eq!(parse("aGVs\n bG8=").unwrap(), "\\x68656c6c6f");
+        assert!(parse("\\xabc").is_err());
+        assert!(parse("not base64!").is_err());
+
+        assert_eq!(cast(text("hi")).unwrap(), text("\\x6869"));
+        assert_eq!(cast(text("\\x00FF")).unwrap(), text("\\x00ff"));
+        assert!(cast(text("\\xzz")).is_err());
+        assert_eq!(bytes(&text("\\x00ff")).unwrap(), vec![0, 255]);
+    }
+
+    #[test]
+    fn test_encode_and_decode() {
+        let png = text("\\x89504e47");
+        let call = |name: &str, args: &[Value]| function(name).unwrap()(args).unwrap();
+        assert_eq!(
+            call("encode", &[png.clone(), text("base64")]),
+            text("iVBORw==")
+        );
+        assert_eq!(
+            call("encode", &[png.clone(), text("hex")]),
+            text("89504e47")
+        );
+        assert_eq!(
+            call("ENCODE", &[png.clone(), text("escape")]),
+            text("\\211PNG")
+        );
+        assert_eq!(call("decode", &[text("iVBORw=="), text("base64")]), png);
+        assert_eq!(call("decode", &[text("89504E47"), text("hex")]), png);
+        assert_eq!(call("decode", &[text("\\211PNG"), text("escape")]), png);
+        assert_eq!(call("decode", &[Value::Null, text("hex")]), Value::Null);
+        assert!(function("decode").unwrap()(&[text("x"), text("rot13")]).is_err());
+    }
+}
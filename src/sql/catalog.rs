@@ -0,0 +1,1059 @@
+//! The system catalogs SQL tools browse a schema through:
+//! `information_schema.tables` and `information_schema.columns`, and
+//! PostgreSQL's `pg_catalog.pg_namespace`, `pg_catalog.pg_class`,
+//! `pg_catalog.pg_attribute`, `pg_catalog.pg_attrdef`,
+//! `pg_catalog.pg_description`, `pg_catalog.pg_type` and
+//! `pg_catalog.pg_enum`, and the statistics views
+//! `pg_catalog.pg_stat_activity` and `pg_catalog.pg_stat_database`.
+//!
+//! They are built from the database when a query reads them. A query that
+//! does runs against a scratch database holding the catalogs under their
+//! unqualified names, next to copies of the other tables it reads. A column's
+//! `annotations` entry is its comment: `column_comment` in
+//! `information_schema.columns`, as MySQL has it, and a `pg_description` row
+//! for the table's `pg_class` OID and the column's position, as PostgreSQL
+//! has it. `pg_type` lists the built-in types yamlbase sends and the enum
+//! types of the dataset's columns, and `pg_enum` their labels.
+//! `pg_attribute` and `pg_attrdef` describe the columns and their defaults
+//! the way ODBC drivers such as psqlODBC read them for `SQLColumns`, which
+//! Tableau and Power BI call to list a table's fields, with the catalog
+//! functions those queries use, such as `format_type` and `pg_get_expr`.
+//! `pg_stat_activity` lists the sessions open on the server, on every
+//! listener, and `pg_stat_database` counts them per database. The
+//! `pg_catalog` tables can also be named without the `pg_catalog.` schema,
+//! unless the dataset has a table of that name.
+
+use sqlparser::ast::{Expr, Ident, ObjectName, Statement};
+use std::collections::BTreeMap;
+use std::ops::ControlFlow;
+
+use crate::YamlBaseError;
+use crate::database::{Column, Database, Table, Value};
+use crate::server::SessionInfo;
+use crate::sql::enums;
+use crate::yaml::schema::SqlType;
+
+/// The OID of the first table, where PostgreSQL starts numbering user objects
+const FIRST_OID: i64 = 16384;
+/// The OID of `pg_class`, which a comment on a column of a table is filed under
+const PG_CLASS_OID: i64 = 1259;
+/// The OID of the `public` schema
+const PUBLIC_OID: i64 = 2200;
+/// The OID of the `pg_catalog` schema, which holds the built-in types
+const PG_CATALOG_OID: i64 = 11;
+/// The OID of the superuser that owns every schema and table
+const BOOTSTRAP_SUPERUSER_OID: i64 = 10;
+/// The OID of the first column default, numbered after the tables
+const FIRST_ATTRDEF_OID: i64 = 24576;
+
+/// The built-in types yamlbase sends: their OID, name, category and the OID
+/// of their array type
+const BUILTIN_TYPES: [(i64, &str, &str, i64); 17] = [
+    (16, "bool", "B", 1000),
+    (17, "bytea", "U", 1001),
+    (20, "int8", "N", 1016),
+    (21, "int2", "N", 1005),
+    (23, "int4", "N", 1007),
+    (25, "text", "S", 1009),
+    (700, "float4", "N", 1021),
+    (701, "float8", "N", 1022),
+    (1042, "bpchar", "S", 1014),
+    (1043, "varchar", "S", 1015),
+    (1082, "date", "D", 1182),
+    (1083, "time", "D", 1183),
+    (1114, "timestamp", "D", 1115),
+    (1184, "timestamptz", "D", 1185),
+    (1700, "numeric", "N", 1231),
+    (2950, "uuid", "U", 2951),
+    (3802, "jsonb", "U", 3807),
+];
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Catalog {
+    Tables,
+    Columns,
+    PgNamespace,
+    PgClass,
+    PgAttribute,
+    PgAttrdef,
+    PgDescription,
+    PgType,
+    PgEnum,
+    PgStatActivity,
+    PgStatDatabase,
+}
+
+impl Catalog {
+    const ALL: [Catalog; 11] = [
+        Catalog::Tables,
+        Catalog::Columns,
+        Catalog::PgNamespace,
+        Catalog::PgClass,
+        Catalog::PgAttribute,
+        Catalog::PgAttrdef,
+        Catalog::PgDescription,
+        Catalog::PgType,
+        Catalog::PgEnum,
+        Catalog::PgStatActivity,
+        Catalog::PgStatDatabase,
+    ];
+
+    fn schema(self) -> &'static str {
+        match self {
+            Catalog::Tables | Catalog::Columns => "information_schema",
+            Catalog::PgNamespace
+            | Catalog::PgClass
+            | Catalog::PgAttribute
+            | Catalog::PgAttrdef
+            | Catalog::PgDescription
+            | Catalog::PgType
+            | Catalog::PgEnum
+            | Catalog::PgStatActivity
+            | Catalog::PgStatDatabase => "pg_catalog",
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Catalog::Tables => "tables",
+            Catalog::Columns => "columns",
+            Catalog::PgNamespace => "pg_namespace",
+            Catalog::PgClass => "pg_class",
+            Catalog::PgAttribute => "pg_attribute",
+            Catalog::PgAttrdef => "pg_attrdef",
+            Catalog::PgDescription => "pg_description",
+            Catalog::PgType => "pg_type",
+            Catalog::PgEnum => "pg_enum",
+            Catalog::PgStatActivity => "pg_stat_activity",
+            Catalog::PgStatDatabase => "pg_stat_database",
+        }
+    }
+
+    /// The catalog a relation names
+    fn named(name: &ObjectName, db: &Database) -> Option<Self> {
+        let parts: Vec<String> = name
+            .0
+            .iter()
+            .map(|ident| ident.value.to_lowercase())
+            .collect();
+        Self::ALL
+            .into_iter()
+            .find(|catalog| match parts.as_slice() {
+                [schema, name] => schema == catalog.schema() && name == catalog.name(),
+                [name] => {
+                    catalog.schema() == "pg_catalog"
+                        && name == catalog.name()
+                        && db.get_table(name).is_none()
+                }
+                _ => false,
+            })
+    }
+
+    fn build(self, db: &Database, sessions: &[SessionInfo]) -> Table {
+        let (columns, rows) = match self {
+            Catalog::Tables => (
+                vec![
+                    text("table_catalog"),
+                    text("table_schema"),
+                    text("table_name"),
+                    text("table_type"),
+                ],
+                db.tables
+                    .values()
+                    .map(|table| {
+                        vec![
+                            Value::Text(db.name.clone()),
+                            Value::Text("public".to_string()),
+                            Value::Text(table.name.clone()),
+                            Value::Text("BASE TABLE".to_string()),
+                        ]
+                    })
+                    .collect(),
+            ),
+            Catalog::Columns => (
+                vec![
+                    text("table_catalog"),
+                    text("table_schema"),
+                    text("table_name"),
+                    text("column_name"),
+                    integer("ordinal_position"),
+                    text("column_default"),
+                    text("is_nullable"),
+                    text("data_type"),
+                    integer("character_maximum_length"),
+                    text("column_comment"),
+                ],
+                db.tables
+                    .values()
+                    .flat_map(|table| {
+                        (0..table.columns.len()).map(move |idx| column_row(db, table, idx))
+                    })
+                    .collect(),
+            ),
+            Catalog::PgNamespace => (
+                vec![integer("oid"), text("nspname"), integer("nspowner")],
+                [(PG_CATALOG_OID, "pg_catalog"), (PUBLIC_OID, "public")]
+                    .into_iter()
+                    .map(|(oid, name)| {
+                        vec![
+                            Value::Integer(oid),
+                            Value::Text(name.to_string()),
+                            Value::Integer(BOOTSTRAP_SUPERUSER_OID),
+                        ]
+                    })
+                    .collect(),
+            ),
+            Catalog::PgClass => (
+                vec![
+                    integer("oid"),
+                    text("relname"),
+                    integer("relnamespace"),
+                    text("relkind"),
+                    integer("relowner"),
+                    integer("relnatts"),
+                    catalog_column("reltuples", SqlType::Float),
+                    boolean("relhasrules"),
+                    boolean("relhasoids"),
+                    boolean("relhassubclass"),
+                ],
+                db.tables
+                    .values()
+                    .enumerate()
+                    .map(|(position, table)| {
+                        vec![
+                            Value::Integer(FIRST_OID + position as i64),
+                            Value::Text(table.name.clone()),
+                            Value::Integer(PUBLIC_OID),
+                            Value::Text("r".to_string()),
+                            Value::Integer(BOOTSTRAP_SUPERUSER_OID),
+                            Value::Integer(table.columns.len() as i64),
+                            Value::Float(table.rows.len() as f32),
+                            Value::Boolean(false),
+                            Value::Boolean(false),
+                            Value::Boolean(false),
+                        ]
+                    })
+                    .collect(),
+            ),
+            Catalog::PgAttribute => (
+                vec![
+                    integer("attrelid"),
+                    text("attname"),
+                    integer("atttypid"),
+                    integer("attnum"),
+                    integer("attlen"),
+                    integer("atttypmod"),
+                    boolean("attnotnull"),
+                    boolean("atthasdef"),
+                    boolean("attisdropped"),
+                ],
+                db.tables
+                    .values()
+                    .enumerate()
+                    .flat_map(|(position, table)| {
+                        table.columns.iter().enumerate().map(move |(idx, column)| {
+                            let type_oid = type_oid(&column.sql_type);
+                            vec![
+                                Value::Integer(FIRST_OID + position as i64),
+                                Value::Text(column.name.clone()),
+                                Value::Integer(type_oid),
+                                Value::Integer(idx as i64 + 1),
+                                Value::Integer(type_length(type_oid)),
+                                Value::Integer(type_modifier(&column.sql_type)),
+                                Value::Boolean(!column.nullable),
+                                Value::Boolean(column.default.is_some()),
+                                Value::Boolean(false),
+                            ]
+                        })
+                    })
+                    .collect(),
+            ),
+            Catalog::PgAttrdef => (
+                vec![
+                    integer("oid"),
+                    integer("adrelid"),
+                    integer("adnum"),
+                    text("adbin"),
+                ],
+                db.tables
+                    .values()
+                    .enumerate()
+                    .flat_map(|(position, table)| {
+                        table
+                            .columns
+                            .iter()
+                            .enumerate()
+                            .filter_map(move |(idx, column)| {
+                                let table_oid = FIRST_OID + position as i64;
+                                Some((table_oid, idx, column.default.clone()?))
+                            })
+                    })
+                    .enumerate()
+                    .map(|(n, (table_oid, idx, default))| {
+                        vec![
+                            Value::Integer(FIRST_ATTRDEF_OID + n as i64),
+                            Value::Integer(table_oid),
+                            Value::Integer(idx as i64 + 1),
+                            // `pg_get_expr` gives the expression back as is
+                            Value::Text(default),
+                        ]
+                    })
+                    .collect(),
+            ),
+            Catalog::PgDescription => (
+                vec![
+                    integer("objoid"),
+                    integer("classoid"),
+                    integer("objsubid"),
+                    text("description"),
+                ],
+                db.tables
+                    .values()
+                    .enumerate()
+                    .flat_map(|(position, table)| {
+                        table
+                            .columns
+                            .iter()
+                            .enumerate()
+                            .filter_map(move |(idx, column)| {
+                                let comment = comment(db, table, &column.name)?;
+                                Some(vec![
+                                    Value::Integer(FIRST_OID + position as i64),
+                                    Value::Integer(PG_CLASS_OID),
+                                    Value::Integer(idx as i64 + 1),
+                                    Value::Text(comment),
+                                ])
+                            })
+                    })
+                    .collect(),
+            ),
+            Catalog::PgType => (
+                vec![
+                    integer("oid"),
+                    text("typname"),
+                    integer("typnamespace"),
+                    text("typtype"),
+                    text("typcategory"),
+                    integer("typelem"),
+                    integer("typarray"),
+                    integer("typbasetype"),
+                    integer("typrelid"),
+                    integer("typlen"),
+                    integer("typtypmod"),
+                    boolean("typnotnull"),
+                ],
+                BUILTIN_TYPES
+                    .iter()
+                    .flat_map(|&(oid, name, category, array)| {
+                        [
+                            type_row(oid, name, PG_CATALOG_OID, "b", category, 0, array),
+                            type_row(
+                                array,
+                                &format!("_{}", name),
+                                PG_CATALOG_OID,
+                                "b",
+                                "A",
+                                oid,
+                                0,
+                            ),
+                        ]
+                    })
+                    .chain(enums::types(db).into_iter().map(|enum_type| {
+                        let oid = enum_type.oid as i64;
+                        type_row(oid, &enum_type.name, PUBLIC_OID, "e", "E", 0, 0)
+                    }))
+                    .collect(),
+            ),
+            Catalog::PgEnum => (
+                vec![
+                    integer("oid"),
+                    integer("enumtypid"),
+                    catalog_column("enumsortorder", SqlType::Float),
+                    text("enumlabel"),
+                ],
+                enums::types(db)
+                    .into_iter()
+                    .flat_map(|enum_type| {
+                        let type_oid = enum_type.oid as i64;
+                        enum_type
+                            .labels
+                            .iter()
+                            .enumerate()
+                            .map(move |(idx, label)| {
+                                vec![
+                                    Value::Integer(type_oid + idx as i64 + 1),
+                                    Value::Integer(type_oid),
+                                    Value::Float(idx as f32 + 1.0),
+                                    Value::Text(label.clone()),
+                                ]
+                            })
+                    })
+                    .collect(),
+            ),
+            Catalog::PgStatActivity => (
+                vec![
+                    text("datname"),
+                    integer("pid"),
+                    text("usename"),
+                    text("application_name"),
+                    text("client_addr"),
+                    catalog_column("backend_start", SqlType::Timestamp),
+                ],
+                sessions
+                    .iter()
+                    .map(|session| {
+                        vec![
+                            Value::Text(session.database.clone()),
+                            Value::Integer(session.pid as i64),
+                            Value::Text(session.user.clone()),
+                            Value::Text(session.application_name.clone()),
+                            session.client_addr.clone().map_or(Value::Null, Value::Text),
+                            Value::Timestamp(session.backend_start),
+                        ]
+                    })
+                    .collect(),
+            ),
+            Catalog::PgStatDatabase => {
+                // The served database, and any other a client asked for
+                let mut databases = BTreeMap::from([(db.name.clone(), 0)]);
+                for session in sessions {
+                    *databases.entry(session.database.clone()).or_default() += 1;
+                }
+                (
+                    vec![text("datname"), integer("numbackends")],
+                    databases
+                        .into_iter()
+                        .map(|(name, backends)| vec![Value::Text(name), Value::Integer(backends)])
+                        .collect(),
+                )
+            }
+        };
+
+        let mut table = Table::new(self.name().to_string(), columns);
+        table.rows = rows;
+        table
+    }
+}
+
+/// The statement with the catalogs it reads renamed to their unqualified
+/// names, and a database holding those catalogs and copies of the other
+/// tables the statement reads; `None` when it reads no catalog
+pub(crate) fn resolve(
+    statement: &Statement,
+    db: &Database,
+    sessions: &[SessionInfo],
+) -> crate::Result<Option<(Statement, Database)>> {
+    let mut statement = statement.clone();
+    let mut catalogs = Vec::new();
+    let mut tables = Vec::new();
+    let _ = sqlparser::ast::visit_relations_mut(&mut statement, |name| {
+        match Catalog::named(name, db) {
+            Some(catalog) => {
+                *name = ObjectName(vec![Ident::new(catalog.name())]);
+                if !catalogs.contains(&catalog) {
+                    catalogs.push(catalog);
+                }
+            }
+            None => {
+                if let Some(table) = name.0.last().and_then(|ident| db.get_table(&ident.value)) {
+                    tables.push(table.name.clone());
+                }
+            }
+        }
+        ControlFlow::<()>::Continue(())
+    });
+    if catalogs.is_empty() {
+        return Ok(None);
+    }
+
+    let mut scratch = Database::new(db.name.clone());
+    for catalog in &catalogs {
+        scratch.add_table(catalog.build(db, sessions))?;
+    }
+    for name in tables {
+        // In the rewritten statement the name can only stand for one of them
+        if catalogs
+            .iter()
+            .any(|catalog| catalog.name().eq_ignore_ascii_case(&name))
+        {
+            return Err(YamlBaseError::NotImplemented(format!(
+                "A query cannot read both a catalog and table '{}' of the same name",
+                name
+            )));
+        }
+        if scratch.get_table(&name).is_none() {
+            if let Some(table) = db.get_table(&name) {
+                scratch.add_table(table.clone())?;
+            }
+        }
+    }
+    Ok(Some((statement, scratch)))
+}
+
+/// The statement with the `pg_catalog.` schema left out of the functions it
+/// calls and the catalog columns it names, or `None` when it names none.
+/// SQLAlchemy qualifies everything it asks PostgreSQL for, as in
+/// `pg_catalog.version()` and `pg_catalog.pg_class.relname`, and the
+/// catalogs are read under their unqualified names; see [`resolve`].
+pub(crate) fn unqualify(statement: &Statement) -> Option<Statement> {
+    let mut statement = statement.clone();
+    let mut unqualified = false;
+    let _ = sqlparser::ast::visit_expressions_mut(&mut statement, |expr| {
+        match expr {
+            Expr::Function(function)
+                if function.name.0.len() > 1 && is_catalog_schema(&function.name.0[0]) =>
+            {
+                function.name.0.remove(0);
+                unqualified = true;
+            }
+            Expr::CompoundIdentifier(idents)
+                if idents.len() == 3 && is_catalog_schema(&idents[0]) =>
+            {
+                idents.remove(0);
+                unqualified = true;
+            }
+            _ => {}
+        }
+        ControlFlow::<()>::Continue(())
+    });
+    unqualified.then_some(statement)
+}
+
+fn is_catalog_schema(ident: &Ident) -> bool {
+    ident.value.eq_ignore_ascii_case("pg_catalog")
+        || ident.value.eq_ignore_ascii_case("information_schema")
+}
+
+/// The `information_schema.columns` row of a table's column at `idx`
+fn column_row(db: &Database, table: &Table, idx: usize) -> Vec<Value> {
+    let column = &table.columns[idx];
+    let nullable = if column.nullable { "YES" } else { "NO" };
+    let length = match column.sql_type {
+        SqlType::Char(n) | SqlType::Varchar(n) => Value::Integer(n as i64),
+        _ => Value::Null,
+    };
+    vec![
+        Value::Text(db.name.clone()),
+        Value::Text("public".to_string()),
+        Value::Text(table.name.clone()),
+        Value::Text(column.name.clone()),
+        Value::Integer(idx as i64 + 1),
+        column.default.clone().map_or(Value::Null, Value::Text),
+        Value::Text(nullable.to_string()),
+        Value::Text(data_type(&column.sql_type).to_string()),
+        length,
+        comment(db, table, &column.name).map_or(Value::Null, Value::Text),
+    ]
+}
+
+/// A `pg_type` row
+fn type_row(
+    oid: i64,
+    name: &str,
+    namespace: i64,
+    kind: &str,
+    category: &str,
+    element: i64,
+    array: i64,
+) -> Vec<Value> {
+    vec![
+        Value::Integer(oid),
+        Value::Text(name.to_string()),
+        Value::Integer(namespace),
+        Value::Text(kind.to_string()),
+        Value::Text(category.to_string()),
+        Value::Integer(element),
+        Value::Integer(array),
+        Value::Integer(0),
+        Value::Integer(0),
+        Value::Integer(type_length(oid)),
+        Value::Integer(-1),
+        Value::Boolean(false),
+    ]
+}
+
+/// The `pg_type` OID of a column type, the one the PostgreSQL protocol
+/// describes its values with
+fn type_oid(sql_type: &SqlType) -> i64 {
+    let name = match sql_type {
+        SqlType::Boolean => "bool",
+        SqlType::Integer => "int4",
+        SqlType::BigInt => "int8",
+        SqlType::Float => "float4",
+        SqlType::Double => "float8",
+        // Amounts are sent as numeric at their currency's scale
+        SqlType::Decimal(_, _) | SqlType::Money(_) => "numeric",
+        SqlType::Char(_) => "bpchar",
+        SqlType::Varchar(_) => "varchar",
+        SqlType::Text | SqlType::Point | SqlType::Hstore => "text",
+        SqlType::Date => "date",
+        SqlType::Time => "time",
+        SqlType::Timestamp => "timestamp",
+        SqlType::TimestampTz => "timestamptz",
+        SqlType::Uuid => "uuid",
+        SqlType::Json => "jsonb",
+        SqlType::Bytea => "bytea",
+        SqlType::Enum(labels) => return enums::oid(labels) as i64,
+        SqlType::Array(element) => {
+            let element = type_oid(element);
+            return BUILTIN_TYPES
+                .iter()
+                .find(|(oid, ..)| *oid == element)
+                .map_or(1009, |(.., array)| *array);
+        }
+    };
+    BUILTIN_TYPES
+        .iter()
+        .find(|(_, builtin, ..)| *builtin == name)
+        .map_or(25, |(oid, ..)| *oid)
+}
+
+/// The bytes a value of a type takes, `-1` for types of varying length
+pub(crate) fn type_length(oid: i64) -> i64 {
+    match oid {
+        16 => 1,
+        21 => 2,
+        23 | 700 | 1082 => 4,
+        20 | 701 | 1083 | 1114 | 1184 => 8,
+        2950 => 16,
+        _ => -1,
+    }
+}
+
+/// A column's `atttypmod`: the length of a `CHAR(n)` or `VARCHAR(n)` and the
+/// precision and scale of a `DECIMAL(p,s)`, each plus the 4 bytes of the
+/// length header PostgreSQL counts in, or `-1` for types without one
+pub(crate) fn type_modifier(sql_type: &SqlType) -> i64 {
+    match sql_type {
+        SqlType::Char(n) | SqlType::Varchar(n) => *n as i64 + 4,
+        SqlType::Decimal(precision, scale) => (((*precision as i64) << 16) | *scale as i64) + 4,
+        _ => -1,
+    }
+}
+
+/// The catalog function called `name`, if it is one
+pub(crate) fn function(name: &str) -> Option<fn(&[Value]) -> crate::Result<Value>> {
+    let function: fn(&[Value]) -> crate::Result<Value> = match name.to_uppercase().as_str() {
+        "FORMAT_TYPE" => format_type,
+        "PG_GET_EXPR" => get_expr,
+        "PG_CLIENT_ENCODING" => |_| Ok(Value::Text("UTF8".to_string())),
+        "CURRENT_SCHEMA" => |_| Ok(Value::Text("public".to_string())),
+        // Every client may read every table
+        "PG_TABLE_IS_VISIBLE" | "HAS_TABLE_PRIVILEGE" | "HAS_SCHEMA_PRIVILEGE" => {
+            |_| Ok(Value::Boolean(true))
+        }
+        _ => return None,
+    };
+    Some(function)
+}
+
+/// `format_type(type_oid, typmod)`: a type's SQL name, with the length,
+/// precision and scale its modifier gives, as `character varying(255)`
+fn format_type(args: &[Value]) -> crate::Result<Value> {
+    let (oid, modifier) = match args {
+        [Value::Null, ..] => return Ok(Value::Null),
+        [Value::Integer(oid)] | [Value::Integer(oid), Value::Null] => (*oid, -1),
+        [Value::Integer(oid), Value::Integer(modifier)] => (*oid, *modifier),
+        _ => {
+            return Err(YamlBaseError::Database {
+                message: "format_type requires a type OID and a type modifier".to_string(),
+            });
+        }
+    };
+    Ok(Value::Text(type_name(oid, modifier)))
+}
+
+fn type_name(oid: i64, modifier: i64) -> String {
+    if let Some((element, ..)) = BUILTIN_TYPES.iter().find(|(.., array)| *array == oid) {
+        return format!("{}[]", type_name(*element, modifier));
+    }
+    let name = match oid {
+        16 => "boolean",
+        17 => "bytea",
+        20 => "bigint",
+        21 => "smallint",
+        23 => "integer",
+        25 => "text",
+        700 => "real",
+        701 => "double precision",
+        1042 => "character",
+        1043 => "character varying",
+        1082 => "date",
+        1083 => "time without time zone",
+        1114 => "timestamp without time zone",
+        1184 => "timestamp with time zone",
+        1700 => "numeric",
+        2950 => "uuid",
+        3802 => "jsonb",
+        // As PostgreSQL names a type it does not know
+        _ => "???",
+    };
+    match (oid, modifier - 4) {
+        (1042 | 1043, length) if length >= 0 => format!("{}({})", name, length),
+        (1700, modifier) if modifier >= 0 => {
+            format!("{}({},{})", name, modifier >> 16, modifier & 0xffff)
+        }
+        _ => name.to_string(),
+    }
+}
+
+/// `pg_get_expr(adbin, adrelid)`: the text of a default, which `pg_attrdef`
+/// keeps as the expression itself
+fn get_expr(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [expr, _] | [expr, _, _] => Ok(expr.clone()),
+        _ => Err(YamlBaseError::Database {
+            message: "pg_get_expr requires an expression and a relation OID".to_string(),
+        }),
+    }
+}
+
+/// A column's comment, from its table's `annotations`
+fn comment(db: &Database, table: &Table, column: &str) -> Option<String> {
+    db.annotations
+        .get(&table.name)?
+        .get(column)
+        .map(|annotation| annotation.comment())
+}
+
+/// A type's name, as `information_schema.columns.data_type` gives it in PostgreSQL
+pub(crate) fn data_type(sql_type: &SqlType) -> &'static str {
+    match sql_type {
+        SqlType::Integer => "integer",
+        SqlType::BigInt => "bigint",
+        SqlType::Char(_) => "character",
+        SqlType::Varchar(_) => "character varying",
+        SqlType::Text => "text",
+        SqlType::Timestamp => "timestamp without time zone",
+        SqlType::TimestampTz => "timestamp with time zone",
+        SqlType::Date => "date",
+        SqlType::Time => "time without time zone",
+        SqlType::Boolean => "boolean",
+        SqlType::Decimal(..) => "numeric",
+        SqlType::Float => "real",
+        SqlType::Double => "double precision",
+        SqlType::Uuid => "uuid",
+        SqlType::Json => "jsonb",
+        SqlType::Point => "point",
+        SqlType::Money(_) => "money",
+        SqlType::Hstore => "hstore",
+        SqlType::Bytea => "bytea",
+        SqlType::Enum(_) => "USER-DEFINED",
+        SqlType::Array(_) => "ARRAY",
+    }
+}
+
+fn text(name: &str) -> Column {
+    catalog_column(name, SqlType::Text)
+}
+
+fn integer(name: &str) -> Column {
+    catalog_column(name, SqlType::Integer)
+}
+
+fn boolean(name: &str) -> Column {
+    catalog_column(name, SqlType::Boolean)
+}
+
+fn catalog_column(name: &str, sql_type: SqlType) -> Column {
+    Column {
+        name: name.to_string(),
+        sql_type,
+        primary_key: false,
+        nullable: true,
+        unique: false,
+        default: None,
+        references: None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Annotation;
+    use crate::sql::parse_sql;
+
+    fn database() -> Database {
+        let mut db = Database::new("shop".to_string());
+        db.add_table(Table::new(
+            "users".to_string(),
+            vec![
+                integer("id"),
+                catalog_column("email", SqlType::Varchar(255)),
+            ],
+        ))
+        .unwrap();
+        db.annotations.insert(
+            "users".to_string(),
+            [(
+                "email".to_string(),
+                Annotation {
+                    description: Some("Contact address".to_string()),
+                    source: None,
+                    pii: true,
+                },
+            )]
+            .into_iter()
+            .collect(),
+        );
+        db
+    }
+
+    fn resolved(sql: &str, db: &Database) -> Option<(String, Database)> {
+        let statement = parse_sql(sql).unwrap().remove(0);
+        resolve(&statement, db, &[])
+            .unwrap()
+            .map(|(statement, scratch)| (statement.to_string(), scratch))
+    }
+
+    #[test]
+    fn test_catalog_relations_are_resolved() {
+        let db = database();
+
+        assert!(resolved("SELECT * FROM users", &db).is_none());
+        let (sql, scratch) = resolved(
+            "SELECT c.column_name FROM information_schema.columns c JOIN users u ON true",
+            &db,
+        )
+        .unwrap();
+        assert_eq!(
+            sql,
+            "SELECT c.column_name FROM columns AS c JOIN users AS u ON true"
+        );
+        assert_eq!(
+            scratch.tables.keys().collect::<Vec<_>>(),
+            ["columns", "users"]
+        );
+        assert_eq!(
+            scratch.tables["columns"].rows[1][9],
+            Value::Text("Contact address (PII)".to_string())
+        );
+        assert_eq!(scratch.tables["columns"].rows[1][8], Value::Integer(255));
+
+        let (_, scratch) = resolved("SELECT * FROM pg_description", &db).unwrap();
+        assert_eq!(
+            scratch.tables["pg_description"].rows,
+            vec![vec![
+                Value::Integer(FIRST_OID),
+                Value::Integer(PG_CLASS_OID),
+                Value::Integer(2),
+                Value::Text("Contact address (PII)".to_string()),
+            ]]
+        );
+    }
+
+    #[test]
+    fn test_columns_are_described_for_odbc_drivers() {
+        let mut db = database();
+        let mut price = catalog_column("price", SqlType::Decimal(10, 2));
+        price.nullable = false;
+        price.default = Some("0".to_string());
+        db.add_table(Table::new(
+            "products".to_string(),
+            vec![integer("id"), price],
+        ))
+        .unwrap();
+
+        let (_, scratch) = resolved(
+            "SELECT c.relname, a.attname, t.typname, pg_get_expr(d.adbin, d.adrelid) \
+             FROM pg_catalog.pg_class c \
+             JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace \
+             JOIN pg_catalog.pg_attribute a ON a.attrelid = c.oid \
+             JOIN pg_catalog.pg_type t ON t.oid = a.atttypid \
+             LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum",
+            &db,
+        )
+        .unwrap();
+        assert_eq!(
+            scratch.tables.keys().collect::<Vec<_>>(),
+            [
+                "pg_class",
+                "pg_namespace",
+                "pg_attribute",
+                "pg_type",
+                "pg_attrdef"
+            ]
+        );
+        // users' columns come first, then those of products
+        assert_eq!(
+            scratch.tables["pg_attribute"].rows[1][5],
+            Value::Integer(255 + 4)
+        );
+        assert_eq!(
+            scratch.tables["pg_attribute"].rows[3],
+            vec![
+                Value::Integer(FIRST_OID + 1),
+                Value::Text("price".to_string()),
+                Value::Integer(1700),
+                Value::Integer(2),
+                Value::Integer(-1),
+                Value::Integer((10 << 16 | 2) + 4),
+                Value::Boolean(true),
+                Value::Boolean(true),
+                Value::Boolean(false),
+            ]
+        );
+        assert_eq!(
+            scratch.tables["pg_attrdef"].rows,
+            vec![vec![
+                Value::Integer(FIRST_ATTRDEF_OID),
+                Value::Integer(FIRST_OID + 1),
+                Value::Integer(2),
+                Value::Text("0".to_string()),
+            ]]
+        );
+        assert_eq!(scratch.tables["pg_namespace"].rows.len(), 2);
+
+        let format = |oid: i64, modifier: i64| {
+            format_type(&[Value::Integer(oid), Value::Integer(modifier)]).unwrap()
+        };
+        assert_eq!(
+            format(1043, 259),
+            Value::Text("character varying(255)".to_string())
+        );
+        assert_eq!(
+            format(1700, (10 << 16 | 2) + 4),
+            Value::Text("numeric(10,2)".to_string())
+        );
+        assert_eq!(format(1007, -1), Value::Text("integer[]".to_string()));
+        assert_eq!(format(1, -1), Value::Text("???".to_string()));
+        assert_eq!(
+            format_type(&[Value::Null, Value::Null]).unwrap(),
+            Value::Null
+        );
+        assert_eq!(type_oid(&SqlType::Array(Box::new(SqlType::Text))), 1009);
+    }
+
+    #[test]
+    fn test_catalog_qualifiers_are_left_out() {
+        let unqualified = |sql: &str| {
+            let statement = parse_sql(sql).unwrap().remove(0);
+            unqualify(&statement).map(|statement| statement.to_string())
+        };
+
+        // The query SQLAlchemy's has_table() sends, as pandas' to_sql does
+        assert_eq!(
+            unqualified(
+                "SELECT pg_catalog.pg_class.relname FROM pg_catalog.pg_class \
+                 JOIN pg_catalog.pg_namespace \
+                 ON pg_catalog.pg_namespace.oid = pg_catalog.pg_class.relnamespace \
+                 WHERE pg_catalog.pg_class.relname = 'users' \
+                 AND pg_catalog.pg_table_is_visible(pg_catalog.pg_class.oid)"
+            )
+            .unwrap(),
+            "SELECT pg_class.relname FROM pg_catalog.pg_class \
+             JOIN pg_catalog.pg_namespace \
+             ON pg_namespace.oid = pg_class.relnamespace \
+             WHERE pg_class.relname = 'users' \
+             AND pg_table_is_visible(pg_class.oid)"
+        );
+        assert_eq!(
+            unqualified("SELECT pg_catalog.version()").unwrap(),
+            "SELECT version()"
+        );
+        assert!(unqualified("SELECT u.id, lower(u.email) FROM users u").is_none());
+    }
+
+    #[test]
+    fn test_enum_types_are_listed() {
+        let mut db = database();
+        let status = SqlType::Enum(vec!["pending".to_string(), "shipped".to_string()]);
+        db.add_table(Table::new(
+            "orders".to_string(),
+            vec![integer("id"), catalog_column("status", status.clone())],
+        ))
+        .unwrap();
+        let SqlType::Enum(labels) = &status else {
+            unreachable!()
+        };
+        let oid = enums::oid(labels) as i64;
+
+        let (_, scratch) = resolved(
+            "SELECT t.typname, e.enumlabel FROM pg_type t JOIN pg_enum e ON e.enumtypid = t.oid",
+            &db,
+        )
+        .unwrap();
+        let enum_types: Vec<_> = scratch.tables["pg_type"]
+            .rows
+            .iter()
+            .filter(|row| row[3] == Value::Text("e".to_string()))
+            .collect();
+        assert_eq!(enum_types.len(), 1);
+        assert_eq!(enum_types[0][0], Value::Integer(oid));
+        assert_eq!(enum_types[0][1], Value::Text("orders_status".to_string()));
+        assert_eq!(
+            scratch.tables["pg_enum"].rows[1],
+            vec![
+                Value::Integer(oid + 2),
+                Value::Integer(oid),
+                Value::Float(2.0),
+                Value::Text("shipped".to_string()),
+            ]
+        );
+        assert!(
+            scratch.tables["pg_type"]
+                .rows
+                .iter()
+                .any(|row| row[1] == Value::Text("_int4".to_string()))
+        );
+
+        let (_, scratch) = resolved("SELECT * FROM information_schema.columns", &db).unwrap();
+        let row = &scratch.tables["columns"].rows[3];
+        assert_eq!(row[3], Value::Text("status".to_string()));
+        assert_eq!(row[7], Value::Text("USER-DEFINED".to_string()));
+    }
+
+    #[test]
+    fn test_sessions_are_listed() {
+        let db = database();
+        let backend_start = chrono::NaiveDate::from_ymd_opt(2024, 1, 31)
+            .unwrap()
+            .and_hms_opt(12, 0, 0)
+            .unwrap();
+        let sessions = [
+            SessionInfo {
+                pid: 1,
+                user: "alice".to_string(),
+                database: "shop".to_string(),
+                client_addr: Some("127.0.0.1".to_string()),
+                application_name: "psql".to_string(),
+                backend_start,
+            },
+            SessionInfo {
+                pid: 2,
+                user: "bob".to_string(),
+                database: "reports".to_string(),
+                client_addr: None,
+                application_name: String::new(),
+                backend_start,
+            },
+        ];
+        let statement = parse_sql(
+            "SELECT a.usename, d.numbackends FROM pg_stat_activity a \
+             JOIN pg_catalog.pg_stat_database d ON d.datname = a.datname",
+        )
+        .unwrap()
+        .remove(0);
+        let (_, scratch) = resolve(&statement, &db, &sessions).unwrap().unwrap();
+
+        assert_eq!(
+            scratch.tables["pg_stat_activity"].rows[0],
+            vec![
+                Value::Text("shop".to_string()),
+                Value::Integer(1),
+                Value::Text("alice".to_string()),
+                Value::Text("psql".to_string()),
+                Value::Text("127.0.0.1".to_string()),
+                Value::Timestamp(backend_start),
+            ]
+        );
+        assert_eq!(scratch.tables["pg_stat_activity"].rows[1][4], Value::Null);
+        assert_eq!(
+            scratch.tables["pg_stat_database"].rows,
+            vec![
+                vec![Value::Text("reports".to_string()), Value::Integer(1)],
+                vec![Value::Text("shop".to_string()), Value::Integer(1)],
+            ]
+        );
+    }
+}
@@ -0,0 +1,640 @@
+//! Type conversions: explicit casts, `CAST(x AS type)` or PostgreSQL's
+//! `x::type`, and the implicit coercions comparisons apply.
+//!
+//! YAML leaves types loose, so a value often meets another type in a
+//! comparison: a zip code typed as text against a number, or a date column
+//! against `'2024-01-31'`. Like PostgreSQL and MySQL, text that reads as the
+//! other side's type is compared as that type, so `'10' > 9` holds where
+//! comparing the text would say it does not. The matrix:
+//!
+//! | one side | other side                  | compared as                              |
+//! |----------|-----------------------------|------------------------------------------|
+//! | text     | integer, float, decimal     | the number the text reads                |
+//! | text     | date, timestamp, time, uuid | the text parsed as that type             |
+//! | text     | boolean                     | `t`/`f`, `yes`/`no`, `on`/`off`, `1`/`0` |
+//! | date     | timestamp                   | the date at midnight                     |
+//! | boolean  | integer                     | 1 and 0, as in MySQL                     |
+//!
+//! Text with a UTC offset, such as `'2024-01-31 14:00:00+02'`, meets a
+//! timestamp as the instant it names in UTC, which is how `TIMESTAMPTZ`
+//! columns hold their values. Numbers of different types compare by value.
+//! Text that does not read as the other type leaves the pair as it is, so
+//! `=` is false and ordering comparisons fail as incompatible.
+
+use chrono::{NaiveDate, NaiveTime};
+use rust_decimal::Decimal;
+use sqlparser::ast::{BinaryOperator, DataType, ExactNumberInfo, Expr, TimezoneInfo};
+use std::borrow::Cow;
+use std::cmp::Ordering;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+use crate::database::clock::parse_timestamp;
+use crate::database::numeric;
+use crate::database::timezone::{has_offset, parse_instant};
+use crate::sql::{array, bytea, enums, geo, hstore, json};
+use crate::yaml::schema::{SqlType, YamlColumn};
+
+/// A comparison found in an expression, with the operands its caller still
+/// has to evaluate
+pub(crate) struct Comparison<'a> {
+    pub left: &'a Expr,
+    pub right: &'a Expr,
+    op: &'a BinaryOperator,
+}
+
+impl<'a> Comparison<'a> {
+    pub fn of(expr: &'a Expr) -> Option<Self> {
+        match expr {
+            Expr::BinaryOp { left, op, right }
+                if matches!(
+                    op,
+                    BinaryOperator::Eq
+                        | BinaryOperator::NotEq
+                        | BinaryOperator::Lt
+                        | BinaryOperator::LtEq
+                        | BinaryOperator::Gt
+                        | BinaryOperator::GtEq
+                        | BinaryOperator::Spaceship
+                ) =>
+            {
+                Some(Self { left, right, op })
+            }
+            _ => None,
+        }
+    }
+
+    /// Compare the evaluated operands, giving NULL when either is NULL except
+    /// for MySQL's NULL-safe `<=>`
+    pub fn evaluate(&self, left: &Value, right: &Value) -> crate::Result<Value> {
+        apply_comparison(self.op, left, right)
+    }
+}
+
+/// `left op right` for a comparison operator, as [`Comparison::evaluate`]
+/// makes it
+pub(crate) fn apply_comparison(
+    op: &BinaryOperator,
+    left: &Value,
+    right: &Value,
+) -> crate::Result<Value> {
+    match (left, right) {
+        (Value::Null, Value::Null) if *op == BinaryOperator::Spaceship => {
+            return Ok(Value::Boolean(true));
+        }
+        (Value::Null, _) | (_, Value::Null) if *op == BinaryOperator::Spaceship => {
+            return Ok(Value::Boolean(false));
+        }
+        (Value::Null, _) | (_, Value::Null) => return Ok(Value::Null),
+        _ => {}
+    }
+    let result = match op {
+        BinaryOperator::Eq | BinaryOperator::Spaceship => equals(left, right),
+        BinaryOperator::NotEq => !equals(left, right),
+        op => {
+            let ordering = compare(left, right).ok_or_else(|| YamlBaseError::Database {
+                message: format!("Cannot compare {:?} with {:?}", left, right),
+            })?;
+            match op {
+                BinaryOperator::Lt => ordering.is_lt(),
+                BinaryOperator::LtEq => ordering.is_le(),
+                BinaryOperator::Gt => ordering.is_gt(),
+                _ => ordering.is_ge(),
+            }
+        }
+    };
+    Ok(Value::Boolean(result))
+}
+
+/// Order two values after coercing them to a common type, or `None` when
+/// their types have no common order
+pub(crate) fn compare(left: &Value, right: &Value) -> Option<Ordering> {
+    let (left, right) = coerce(left, right);
+    left.compare(&right)
+}
+
+/// Whether two non-NULL values are equal once coerced to a common type
+pub(crate) fn equals(left: &Value, right: &Value) -> bool {
+    let (left, right) = coerce(left, right);
+    // Values without an order, such as JSON documents, are compared as they are
+    match left.compare(&right) {
+        Some(ordering) => ordering.is_eq(),
+        None => left == right,
+    }
+}
+
+/// Bring a pair of values to a common type, per the matrix above
+pub(crate) fn coerce<'v>(left: &'v Value, right: &'v Value) -> (Cow<'v, Value>, Cow<'v, Value>) {
+    let converted = match (left, right) {
+        (Value::Text(_), Value::Text(_)) => None,
+        (Value::Text(text), other) => text_as(text, other).map(|left| (left, right.clone())),
+        (other, Value::Text(text)) => text_as(text, other).map(|right| (left.clone(), right)),
+        (Value::Date(date), Value::Timestamp(_)) => Some((
+            Value::Timestamp(date.and_time(NaiveTime::MIN)),
+            right.clone(),
+        )),
+        (Value::Timestamp(_), Value::Date(date)) => Some((
+            left.clone(),
+            Value::Timestamp(date.and_time(NaiveTime::MIN)),
+        )),
+        (Value::Boolean(b), Value::Integer(_)) => Some((Value::Integer(*b as i64), right.clone())),
+        (Value::Integer(_), Value::Boolean(b)) => Some((left.clone(), Value::Integer(*b as i64))),
+        _ => None,
+    };
+    match converted {
+        Some((left, right)) => (Cow::Owned(left), Cow::Owned(right)),
+        None => (Cow::Borrowed(left), Cow::Borrowed(right)),
+    }
+}
+
+/// Read text as the type of the value it meets, if it can be
+fn text_as(text: &str, other: &Value) -> Option<Value> {
+    let text = text.trim();
+    match other {
+        Value::Integer(_) => text
+            .parse()
+            .map(Value::Integer)
+            .ok()
+            .or_else(|| text.parse().ok().map(Value::Double)),
+        Value::Float(_) | Value::Double(_) => text.parse().ok().map(Value::Double),
+        Value::Decimal(_) => text.parse().ok().map(Value::Decimal),
+        Value::Boolean(_) => parse_bool(text).map(Value::Boolean),
+        Value::Date(_) => parse_date(text).map(Value::Date),
+        Value::Timestamp(_) if has_offset(text) => parse_instant(text).ok().map(Value::Timestamp),
+        Value::Timestamp(_) => parse_timestamp(text).ok().map(Value::Timestamp),
+        Value::Time(_) => parse_time(text).map(Value::Time),
+        Value::Uuid(_) => text.parse().ok().map(Value::Uuid),
+        _ => None,
+    }
+}
+
+fn parse_bool(text: &str) -> Option<bool> {
+    match text.to_lowercase().as_str() {
+        "true" | "t" | "yes" | "y" | "on" | "1" => Some(true),
+        "false" | "f" | "no" | "n" | "off" | "0" => Some(false),
+        _ => None,
+    }
+}
+
+/// A date, or the date of a timestamp, as PostgreSQL reads `'2024-01-31 10:00'::date`
+fn parse_date(text: &str) -> Option<NaiveDate> {
+    NaiveDate::parse_from_str(text, "%Y-%m-%d")
+        .ok()
+        .or_else(|| parse_timestamp(text).ok().map(|at| at.date()))
+}
+
+fn parse_time(text: &str) -> Option<NaiveTime> {
+    ["%H:%M:%S%.f", "%H:%M"]
+        .iter()
+        .find_map(|format| NaiveTime::parse_from_str(text, format).ok())
+}
+
+/// Convert a value for `CAST(value AS data_type)` or `value::data_type`
+pub(crate) fn cast(value: Value, data_type: &DataType) -> crate::Result<Value> {
+    if matches!(value, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let fail = |value: &Value, type_name: &str| YamlBaseError::Database {
+        message: match value {
+            Value::Text(s) => format!("Cannot cast '{}' to {}", s, type_name),
+            value => format!("Cannot cast {:?} to {}", value, type_name),
+        },
+    };
+
+    match data_type {
+        DataType::Int(_)
+        | DataType::Integer(_)
+        | DataType::BigInt(_)
+        | DataType::SmallInt(_)
+        | DataType::TinyInt(_)
+        | DataType::Int2(_)
+        | DataType::Int4(_)
+        | DataType::Int8(_) => match value {
+            Value::Integer(i) => Ok(Value::Integer(i)),
+            Value::Double(d) => Ok(Value::Integer(d as i64)),
+            Value::Float(f) => Ok(Value::Integer(f as i64)),
+            Value::Decimal(d) => d
+                .trunc()
+                .try_into()
+                .map(Value::Integer)
+                .map_err(|_| fail(&value, "INTEGER")),
+            Value::Text(ref s) => s
+                .trim()
+                .parse::<i64>()
+                .map(Value::Integer)
+                .map_err(|_| fail(&value, "INTEGER")),
+            Value::Boolean(b) => Ok(Value::Integer(if b { 1 } else { 0 })),
+            _ => Err(fail(&value, "INTEGER")),
+        },
+        DataType::Float(_) | DataType::Real | DataType::Float4 => match value {
+            Value::Integer(i) => Ok(Value::Float(i as f32)),
+            Value::Double(d) => Ok(Value::Float(d as f32)),
+            Value::Float(f) => Ok(Value::Float(f)),
+            Value::Decimal(d) => d
+                .try_into()
+                .map(Value::Float)
+                .map_err(|_| fail(&value, "FLOAT")),
+            Value::Text(ref s) => s
+                .trim()
+                .parse::<f32>()
+                .map(Value::Float)
+                .map_err(|_| fail(&value, "FLOAT")),
+            _ => Err(fail(&value, "FLOAT")),
+        },
+        DataType::Double | DataType::DoublePrecision | DataType::Float8 => match value {
+            Value::Integer(i) => Ok(Value::Double(i as f64)),
+            Value::Double(d) => Ok(Value::Double(d)),
+            Value::Float(f) => Ok(Value::Double(f as f64)),
+            Value::Decimal(d) => d
+                .try_into()
+                .map(Value::Double)
+                .map_err(|_| fail(&value, "DOUBLE")),
+            Value::Text(ref s) => s
+                .trim()
+                .parse::<f64>()
+                .map(Value::Double)
+                .map_err(|_| fail(&value, "DOUBLE")),
+            _ => Err(fail(&value, "DOUBLE")),
+        },
+        DataType::Decimal(info) | DataType::Numeric(info) => {
+            let decimal = match &value {
+                Value::Integer(i) => Some(Decimal::from(*i)),
+                Value::Double(d) => numeric::from_f64(*d),
+                Value::Float(f) => numeric::from_f32(*f),
+                Value::Decimal(d) => Some(*d),
+                Value::Text(s) => s.trim().parse().ok(),
+                _ => None,
+            }
+            .ok_or_else(|| fail(&value, "DECIMAL"))?;
+            // `NUMERIC(10,2)` rounds half away from zero and keeps trailing zeros
+            Ok(Value::Decimal(match info {
+                ExactNumberInfo::PrecisionAndScale(precision, scale) => {
+                    numeric::fit(decimal, *precision as u32, *scale as u32)?
+                }
+                ExactNumberInfo::Precision(precision) => {
+                    numeric::fit(decimal, *precision as u32, 0)?
+                }
+                ExactNumberInfo::None => decimal,
+            }))
+        }
+        DataType::Varchar(_)
+        | DataType::Char(_)
+        | DataType::Character(_)
+        | DataType::CharacterVarying(_)
+        | DataType::String(_)
+        | DataType::Text => Ok(Value::Text(value.to_string())),
+        DataType::Date => match value {
+            Value::Date(d) => Ok(Value::Date(d)),
+            Value::Timestamp(at) => Ok(Value::Date(at.date())),
+            Value::Text(ref s) => parse_date(s.trim())
+                .map(Value::Date)
+                .ok_or_else(|| fail(&value, "DATE")),
+            _ => Err(fail(&value, "DATE")),
+        },
+        DataType::Timestamp(_, TimezoneInfo::WithTimeZone | TimezoneInfo::Tz) => match value {
+            Value::Timestamp(at) => Ok(Value::Timestamp(at)),
+            Value::Date(d) => Ok(Value::Timestamp(d.and_time(NaiveTime::MIN))),
+            Value::Text(ref s) => parse_instant(s)
+                .map(Value::Timestamp)
+                .map_err(|_| fail(&value, "TIMESTAMPTZ")),
+            _ => Err(fail(&value, "TIMESTAMPTZ")),
+        },
+        DataType::Timestamp(..) | DataType::Datetime(_) => match value {
+            Value::Timestamp(at) => Ok(Value::Timestamp(at)),
+            Value::Date(d) => Ok(Value::Timestamp(d.and_time(NaiveTime::MIN))),
+            Value::Text(ref s) => parse_timestamp(s)
+                .map(Value::Timestamp)
+                .map_err(|_| fail(&value, "TIMESTAMP")),
+            _ => Err(fail(&value, "TIMESTAMP")),
+        },
+        DataType::Time(..) => match value {
+            Value::Time(t) => Ok(Value::Time(t)),
+            Value::Timestamp(at) => Ok(Value::Time(at.time())),
+            Value::Text(ref s) => parse_time(s.trim())
+                .map(Value::Time)
+                .ok_or_else(|| fail(&value, "TIME")),
+            _ => Err(fail(&value, "TIME")),
+        },
+        DataType::Boolean | DataType::Bool => match value {
+            Value::Boolean(b) => Ok(Value::Boolean(b)),
+            Value::Integer(i) => Ok(Value::Boolean(i != 0)),
+            Value::Double(d) => Ok(Value::Boolean(d != 0.0)),
+            Value::Float(f) => Ok(Value::Boolean(f != 0.0)),
+            Value::Text(ref s) => parse_bool(s.trim())
+                .map(Value::Boolean)
+                .ok_or_else(|| fail(&value, "BOOLEAN")),
+            _ => Err(fail(&value, "BOOLEAN")),
+        },
+        DataType::Uuid => match value {
+            Value::Uuid(u) => Ok(Value::Uuid(u)),
+            Value::Text(ref s) => s
+                .trim()
+                .parse()
+                .map(Value::Uuid)
+                .map_err(|_| fail(&value, "UUID")),
+            _ => Err(fail(&value, "UUID")),
+        },
+        // `location::geography`, as PostGIS distance queries write it
+        DataType::Custom(name, _) if geo::is_geo_type(&name.to_string()) => geo::cast(value),
+        DataType::Custom(name, _) if hstore::is_hstore_type(&name.to_string()) => {
+            hstore::cast(value)
+        }
+        DataType::JSON | DataType::JSONB => json::cast(value),
+        DataType::Bytea | DataType::Blob(_) => bytea::cast(value),
+        // `'{1,2}'::int[]`, read as YAML reads the type name
+        DataType::Array(_) => {
+            match YamlColumn::parse(String::new(), &data_type.to_string())?.get_base_type()? {
+                SqlType::Array(element) => array::cast(value, &element),
+                _ => Err(fail(&value, &data_type.to_string())),
+            }
+        }
+        _ => Err(YamlBaseError::NotImplemented(format!(
+            "CAST to {:?} is not supported",
+            data_type
+        ))),
+    }
+}
+
+/// Convert a value stored into a column, as `INSERT` does, to the column's
+/// type: the text `'2024-01-31'` becomes a date in a date column and an
+/// integer becomes a decimal in a decimal one. A value that does not convert
+/// is an error, as is a decimal too large for its column.
+pub(crate) fn assign(value: Value, sql_type: &SqlType) -> crate::Result<Value> {
+    // Decimals are brought to the column's scale however they were computed
+    if let (Value::Decimal(d), SqlType::Decimal(precision, scale)) = (&value, sql_type) {
+        return numeric::fit(*d, *precision, *scale).map(Value::Decimal);
+    }
+    // Array text is checked element by element, enum text against the
+    // labels, and binary text read as bytes
+    if value.is_compatible_with(sql_type)
+        && !matches!(
+            sql_type,
+            SqlType::Array(_) | SqlType::Enum(_) | SqlType::Bytea
+        )
+    {
+        return Ok(value);
+    }
+    let data_type = match sql_type {
+        SqlType::Integer | SqlType::BigInt => DataType::BigInt(None),
+        SqlType::Float => DataType::Real,
+        SqlType::Double => DataType::DoublePrecision,
+        SqlType::Decimal(precision, scale) => DataType::Decimal(
+            ExactNumberInfo::PrecisionAndScale(*precision as u64, *scale as u64),
+        ),
+        SqlType::Money(_) => DataType::Decimal(ExactNumberInfo::None),
+        SqlType::Char(_) | SqlType::Varchar(_) | SqlType::Text => DataType::Text,
+        SqlType::Timestamp => DataType::Timestamp(None, TimezoneInfo::None),
+        SqlType::TimestampTz => DataType::Timestamp(None, TimezoneInfo::Tz),
+        SqlType::Date => DataType::Date,
+        SqlType::Time => DataType::Time(None, TimezoneInfo::None),
+        SqlType::Boolean => DataType::Boolean,
+        SqlType::Uuid => DataType::Uuid,
+        SqlType::Point => return geo::cast(value),
+        SqlType::Hstore => return hstore::cast(value),
+        SqlType::Json => return json::cast(value),
+        SqlType::Bytea => return bytea::cast(value),
+        SqlType::Enum(labels) => return enums::check(value, labels),
+        SqlType::Array(element) => return array::cast(value, element),
+    };
+    cast(value, &data_type)
+}
+
+/// The value of a column's type that a comparison with a value of that
+/// column compares `value` as, or `None` when there is none, as for NULL or
+/// text that does not read as the column's type. Index lookups use it to find
+/// the rows `=`, `<` and the rest would match.
+pub(crate) fn compared_as(value: &Value, sql_type: &SqlType) -> Option<Value> {
+    match (value, sql_type) {
+        (Value::Null, _) => None,
+        (value, sql_type) if value.is_compatible_with(sql_type) => Some(value.clone()),
+        (Value::Text(text), SqlType::Integer | SqlType::BigInt) => {
+            text.trim().parse().ok().map(Value::Integer)
+        }
+        (Value::Text(text), SqlType::Double) => text.trim().parse().ok().map(Value::Double),
+        (Value::Text(text), SqlType::Decimal(_, _) | SqlType::Money(_)) => {
+            text.trim().parse().ok().map(Value::Decimal)
+        }
+        (Value::Text(text), SqlType::Boolean) => parse_bool(text.trim()).map(Value::Boolean),
+        (Value::Text(text), SqlType::Date) => parse_date(text.trim()).map(Value::Date),
+        (Value::Text(text), SqlType::Timestamp) => {
+            parse_timestamp(text.trim()).ok().map(Value::Timestamp)
+        }
+        (Value::Text(text), SqlType::TimestampTz) => parse_instant(text).ok().map(Value::Timestamp),
+        (Value::Text(text), SqlType::Time) => parse_time(text.trim()).map(Value::Time),
+        (Value::Text(text), SqlType::Uuid) => text.trim().parse().ok().map(Value::Uuid),
+        (Value::Integer(i), SqlType::Decimal(_, _) | SqlType::Money(_)) => {
+            Some(Value::Decimal(Decimal::from(*i)))
+        }
+        (Value::Date(date), SqlType::Timestamp | SqlType::TimestampTz) => {
+            Some(Value::Timestamp(date.and_time(NaiveTime::MIN)))
+        }
+        (Value::Boolean(b), SqlType::Integer | SqlType::BigInt) => Some(Value::Integer(*b as i64)),
+        _ => None,
+    }
+}
+
+/// The type a result column is described to clients as: its own type when
+/// each of its values, in its text form, reads as one, else text. psycopg2
+/// and PyMySQL convert every value by its column's described type, so a
+/// column whose values are not all of it, as a `CASE` giving a number or a
+/// label, goes out as the text each value has.
+pub(crate) fn described_type<'v>(
+    sql_type: Option<&SqlType>,
+    mut values: impl Iterator<Item = &'v Value>,
+) -> SqlType {
+    match sql_type {
+        Some(sql_type) if values.all(|value| reads_as(value, sql_type)) => sql_type.clone(),
+        _ => SqlType::Text,
+    }
+}
+
+/// Whether `value` sent as text reads as a value of `sql_type`
+fn reads_as(value: &Value, sql_type: &SqlType) -> bool {
+    match (value, sql_type) {
+        (value, sql_type) if value.is_compatible_with(sql_type) => true,
+        // Booleans stored as MySQL's 0 and 1 are sent as PostgreSQL's t and f
+        (Value::Integer(_), SqlType::Boolean) => true,
+        (
+            Value::Integer(_),
+            SqlType::Float | SqlType::Double | SqlType::Decimal(_, _) | SqlType::Money(_),
+        ) => true,
+        (
+            Value::Float(_) | Value::Double(_) | Value::Decimal(_),
+            SqlType::Float | SqlType::Double,
+        ) => true,
+        (Value::Float(f), SqlType::Decimal(_, _) | SqlType::Money(_)) => f.is_finite(),
+        (Value::Double(d), SqlType::Decimal(_, _) | SqlType::Money(_)) => d.is_finite(),
+        // A whole number prints without a fraction
+        (Value::Float(f), SqlType::Integer | SqlType::BigInt) => f.is_finite() && f.fract() == 0.0,
+        (Value::Double(d), SqlType::Integer | SqlType::BigInt) => d.is_finite() && d.fract() == 0.0,
+        (Value::Decimal(d), SqlType::Integer | SqlType::BigInt) => d.scale() == 0,
+        (Value::Text(text), SqlType::Integer | SqlType::BigInt) => text.parse::<i64>().is_ok(),
+        (Value::Text(text), SqlType::Float | SqlType::Double) => text.parse::<f64>().is_ok(),
+        (Value::Text(text), SqlType::Decimal(_, _) | SqlType::Money(_)) => {
+            text.parse::<Decimal>().is_ok()
+        }
+        (Value::Text(text), SqlType::Uuid) => text.parse::<uuid::Uuid>().is_ok(),
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parser::parse_expr;
+
+    fn text(s: &str) -> Value {
+        Value::Text(s.to_string())
+    }
+
+    fn compared(sql: &str, left: Value, right: Value) -> Value {
+        let expr = parse_expr(sql).unwrap();
+        Comparison::of(&expr)
+            .unwrap()
+            .evaluate(&left, &right)
+            .unwrap()
+    }
+
+    #[test]
+    fn test_text_is_compared_as_the_other_type() {
+        use Value::{Boolean, Integer, Null};
+        assert_eq!(compared("a > b", text("10"), Integer(9)), Boolean(true));
+        assert_eq!(compared("a = b", Integer(5), text(" 5")), Boolean(true));
+        assert_eq!(
+            compared("a = b", Value::Double(2.5), text("2.50")),
+            Boolean(true)
+        );
+        assert_eq!(compared("a = b", text("abc"), Integer(0)), Boolean(false));
+        assert_eq!(
+            compared("a <> b", Integer(1), Value::Double(1.0)),
+            Boolean(false)
+        );
+        assert_eq!(compared("a = b", Boolean(true), text("t")), Boolean(true));
+        assert_eq!(compared("a = b", Boolean(true), Integer(1)), Boolean(true));
+
+        let day = NaiveDate::from_ymd_opt(2024, 1, 31).unwrap();
+        assert_eq!(
+            compared("a < b", Value::Date(day), text("2024-02-01")),
+            Boolean(true)
+        );
+        assert_eq!(
+            compared(
+                "a = b",
+                Value::Date(day),
+                Value::Timestamp(day.and_hms_opt(0, 0, 0).unwrap())
+            ),
+            Boolean(true)
+        );
+
+        assert_eq!(compared("a = b", Null, Integer(1)), Null);
+        assert_eq!(compared("a <=> b", Null, Null), Boolean(true));
+        assert_eq!(compared("a <=> b", Integer(1), Null), Boolean(false));
+
+        let expr = parse_expr("a < b").unwrap();
+        assert!(
+            Comparison::of(&expr)
+                .unwrap()
+                .evaluate(&text("abc"), &Integer(1))
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_values_are_compared_as_the_column_type() {
+        let day = NaiveDate::from_ymd_opt(2024, 1, 31).unwrap();
+        assert_eq!(
+            compared_as(&text(" 42"), &SqlType::Integer),
+            Some(Value::Integer(42))
+        );
+        assert_eq!(compared_as(&text("4.5"), &SqlType::Integer), None);
+        assert_eq!(
+            compared_as(&text("2024-01-31 10:30:00"), &SqlType::Date),
+            Some(Value::Date(day))
+        );
+        assert_eq!(
+            compared_as(&Value::Integer(3), &SqlType::Decimal(10, 2)),
+            Some(Value::Decimal(Decimal::from(3)))
+        );
+        assert_eq!(compared_as(&Value::Integer(3), &SqlType::Text), None);
+        assert_eq!(compared_as(&Value::Null, &SqlType::Integer), None);
+    }
+
+    #[test]
+    fn test_casts() {
+        let cast_to = |value: Value, sql_type: &str| {
+            let Expr::Cast { data_type, .. } = parse_expr(&format!("x::{}", sql_type)).unwrap()
+            else {
+                panic!("not a cast");
+            };
+            cast(value, &data_type)
+        };
+        assert_eq!(cast_to(text("42"), "int").unwrap(), Value::Integer(42));
+        assert_eq!(
+            cast_to(Value::Integer(3), "numeric(10,2)")
+                .unwrap()
+                .to_string(),
+            "3.00"
+        );
+        assert_eq!(
+            cast_to(text("2.345"), "numeric(10,2)").unwrap().to_string(),
+            "2.35"
+        );
+        assert_eq!(
+            cast_to(text("2024-01-31 10:30:00"), "date").unwrap(),
+            Value::Date(NaiveDate::from_ymd_opt(2024, 1, 31).unwrap())
+        );
+        assert_eq!(
+            cast_to(text("2024-01-31"), "timestamp")
+                .unwrap()
+                .to_string(),
+            "2024-01-31 00:00:00"
+        );
+        assert_eq!(
+            cast_to(
+                Value::Date(NaiveDate::from_ymd_opt(2024, 1, 31).unwrap()),
+                "text"
+            )
+            .unwrap(),
+            text("2024-01-31")
+        );
+        assert_eq!(
+            cast_to(text("off"), "boolean").unwrap(),
+            Value::Boolean(false)
+        );
+        assert_eq!(cast_to(Value::Null, "int").unwrap(), Value::Null);
+        assert!(cast_to(text("maybe"), "boolean").is_err());
+        assert!(cast_to(text("12abc"), "int").is_err());
+    }
+
+    #[test]
+    fn test_columns_are_described_as_their_values_read() {
+        let described =
+            |sql_type: SqlType, values: &[Value]| described_type(Some(&sql_type), values.iter());
+        assert_eq!(
+            described(SqlType::BigInt, &[Value::Integer(1), Value::Null]),
+            SqlType::BigInt
+        );
+        assert_eq!(
+            described(SqlType::Integer, &[Value::Double(2.0), text("3")]),
+            SqlType::Integer
+        );
+        assert_eq!(
+            described(SqlType::Integer, &[Value::Integer(1), Value::Double(2.5)]),
+            SqlType::Text
+        );
+        assert_eq!(
+            described(
+                SqlType::Decimal(10, 2),
+                &[Value::Integer(1), Value::Double(f64::NAN)]
+            ),
+            SqlType::Text
+        );
+        assert_eq!(
+            described(SqlType::Boolean, &[Value::Integer(1)]),
+            SqlType::Boolean
+        );
+        assert_eq!(described(SqlType::Date, &[text("soon")]), SqlType::Text);
+        assert_eq!(described(SqlType::Date, &[]), SqlType::Date);
+        assert_eq!(described_type(None, [text("a")].iter()), SqlType::Text);
+    }
+}
@@ -0,0 +1,787 @@
+//! Bulk loading with PostgreSQL's `COPY ... FROM STDIN` and MySQL's
+//! `LOAD DATA LOCAL INFILE`.
+//!
+//! The protocol plans the load from the statement, streams the data in from
+//! the client and hands the decoded records to `QueryExecutor::copy_in`,
+//! which appends them as one batch: a field converts as a text literal
+//! inserted into its column would, and columns left out take their defaults.
+//!
+//! PostgreSQL's text format separates fields with tabs, reads `\N` as NULL
+//! and decodes backslash escapes such as `\t`; its CSV format quotes fields
+//! and reads an unquoted empty field as NULL. `LOAD DATA` reads the text
+//! format unless its `FIELDS` and `LINES` clauses say otherwise.
+
+use sqlparser::ast::{
+    CopyLegacyCsvOption, CopyLegacyOption, CopyOption, CopySource, CopyTarget, Ident, Statement,
+};
+
+use crate::YamlBaseError;
+use crate::database::Table;
+use crate::sql::parse_sql;
+
+/// A bulk load into a table
+#[derive(Debug, Clone, PartialEq)]
+pub(crate) struct BulkLoad {
+    pub table: String,
+    /// The columns the fields fill, in order; empty for all of them
+    pub columns: Vec<Ident>,
+    pub layout: Layout,
+}
+
+/// How the loaded data lays out records and fields
+#[derive(Debug, Clone, PartialEq)]
+pub(crate) struct Layout {
+    delimiter: String,
+    terminator: String,
+    /// Encloses a field in which delimiters and terminators are literal
+    quote: Option<char>,
+    /// Makes the quote after it literal inside a quoted field
+    quote_escape: Option<char>,
+    /// Whether backslash sequences such as `\t` and `\\` are decoded
+    backslash: bool,
+    /// Unquoted fields that read as NULL, as written before decoding
+    nulls: Vec<String>,
+    /// Leading records to skip, such as a header
+    skip: usize,
+}
+
+impl Layout {
+    /// PostgreSQL's text format
+    fn text(delimiter: char, null: Option<String>) -> Self {
+        Self {
+            delimiter: delimiter.to_string(),
+            terminator: "\n".to_string(),
+            quote: None,
+            quote_escape: None,
+            backslash: true,
+            nulls: vec![null.unwrap_or_else(|| "\\N".to_string())],
+            skip: 0,
+        }
+    }
+
+    /// PostgreSQL's CSV format
+    fn csv(delimiter: char, quote: char, escape: char, null: Option<String>) -> Self {
+        Self {
+            delimiter: delimiter.to_string(),
+            terminator: "\n".to_string(),
+            quote: Some(quote),
+            quote_escape: Some(escape),
+            backslash: false,
+            nulls: vec![null.unwrap_or_default()],
+            skip: 0,
+        }
+    }
+
+    /// The line of the data its first record is on
+    pub(crate) fn first_line(&self) -> usize {
+        self.skip + 1
+    }
+
+    /// The records of `data`, each a field per column; `None` is NULL. A
+    /// line holding just `\.` ends the data, as in psql scripts.
+    pub(crate) fn records(&self, data: &str) -> crate::Result<Vec<Vec<Option<String>>>> {
+        let mut records = Vec::new();
+        let mut record = Vec::new();
+        let mut field = Field::default();
+        let mut chars = data.char_indices().peekable();
+        while let Some(&(pos, c)) = chars.peek() {
+            let rest = &data[pos..];
+            if field.in_quotes {
+                chars.next();
+                let next = chars.peek().map(|&(_, next)| next);
+                if self.backslash && c == '\\' {
+                    field.text.push(unescape(&mut chars));
+                } else if Some(c) == self.quote_escape
+                    && self.quote_escape != self.quote
+                    && next.is_some_and(|next| Some(next) == self.quote || next == c)
+                {
+                    field.text.extend(next);
+                    chars.next();
+                } else if Some(c) == self.quote {
+                    if next == self.quote {
+                        field.text.push(c);
+                        chars.next();
+                    } else {
+                        field.in_quotes = false;
+                    }
+                } else {
+                    field.text.push(c);
+                }
+                continue;
+            }
+
+            if rest.starts_with(&self.delimiter) {
+                record.push(self.finish(&mut field));
+                skip(&mut chars, self.delimiter.chars().count());
+                continue;
+            }
+            let crlf = self.terminator == "\n" && rest.starts_with("\r\n");
+            if crlf || rest.starts_with(&self.terminator) {
+                if self.ends_data(&record, &field) {
+                    field = Field::default();
+                    break;
+                }
+                record.push(self.finish(&mut field));
+                records.push(std::mem::take(&mut record));
+                let width = match crlf {
+                    true => 2,
+                    false => self.terminator.chars().count(),
+                };
+                skip(&mut chars, width);
+                continue;
+            }
+
+            chars.next();
+            if Some(c) == self.quote && !field.quoted && field.raw.is_empty() {
+                field.in_quotes = true;
+                field.quoted = true;
+            } else if self.backslash && c == '\\' {
+                field.raw.push(c);
+                field.raw.extend(chars.peek().map(|&(_, next)| next));
+                field.text.push(unescape(&mut chars));
+            } else {
+                field.raw.push(c);
+                field.text.push(c);
+            }
+        }
+        if field.in_quotes {
+            return Err(YamlBaseError::Database {
+                message: format!("unterminated quoted field in line {}", records.len() + 1),
+            });
+        }
+        if (field.quoted || !field.raw.is_empty() || !record.is_empty())
+            && !self.ends_data(&record, &field)
+        {
+            record.push(self.finish(&mut field));
+            records.push(record);
+        }
+        records.drain(..self.skip.min(records.len()));
+        Ok(records)
+    }
+
+    fn finish(&self, field: &mut Field) -> Option<String> {
+        let field = std::mem::take(field);
+        match !field.quoted && self.nulls.contains(&field.raw) {
+            true => None,
+            false => Some(field.text),
+        }
+    }
+
+    fn ends_data(&self, record: &[Option<String>], field: &Field) -> bool {
+        record.is_empty() && !field.quoted && field.raw == "\\."
+    }
+}
+
+/// The field being read
+#[derive(Debug, Default)]
+struct Field {
+    text: String,
+    /// The field as written, before escapes are decoded
+    raw: String,
+    quoted: bool,
+    in_quotes: bool,
+}
+
+type Chars<'a> = std::iter::Peekable<std::str::CharIndices<'a>>;
+
+fn skip(chars: &mut Chars<'_>, count: usize) {
+    for _ in 0..count {
+        chars.next();
+    }
+}
+
+/// Decode the backslash sequence whose backslash was just read: `\b`, `\f`,
+/// `\n`, `\r`, `\t`, `\v`, up to three octal digits, `\x` and up to two hex
+/// digits, or any other character as itself
+fn unescape(chars: &mut Chars<'_>) -> char {
+    let Some((_, c)) = chars.next() else {
+        return '\\';
+    };
+    match c {
+        'b' => '\u{8}',
+        'f' => '\u{c}',
+        'n' => '\n',
+        'r' => '\r',
+        't' => '\t',
+        'v' => '\u{b}',
+        '0'..='7' => digits(chars, c.to_digit(8), 8, 3).unwrap_or(c),
+        'x' => digits(chars, None, 16, 2).unwrap_or(c),
+        c => c,
+    }
+}
+
+/// The character of up to `max` digits, `first` already read
+fn digits(chars: &mut Chars<'_>, first: Option<u32>, radix: u32, max: usize) -> Option<char> {
+    let mut value = first.unwrap_or(0);
+    let mut count = usize::from(first.is_some());
+    while count < max {
+        let Some(digit) = chars.peek().and_then(|&(_, c)| c.to_digit(radix)) else {
+            break;
+        };
+        value = value * radix + digit;
+        count += 1;
+        chars.next();
+    }
+    (count > 0).then(|| char::from_u32(value)).flatten()
+}
+
+/// Parse a statement of a query string, reading `COPY ... FROM STDIN` also
+/// without the semicolon sqlparser wants before inline data
+pub(crate) fn parse_statement(sql: &str) -> crate::Result<Vec<Statement>> {
+    parse_sql(sql).or_else(|e| {
+        let copy = sql
+            .split_whitespace()
+            .next()
+            .is_some_and(|word| word.eq_ignore_ascii_case("copy"));
+        match copy {
+            true => parse_sql(&format!("{};", sql)).map_err(|_| e),
+            false => Err(e),
+        }
+    })
+}
+
+/// The load a `COPY ... FROM` statement describes, or `None` for any other
+/// statement, `COPY ... TO` included
+pub(crate) fn plan_copy(statement: &Statement) -> Option<crate::Result<BulkLoad>> {
+    let Statement::Copy {
+        source,
+        to: false,
+        target,
+        options,
+        legacy_options,
+        ..
+    } = statement
+    else {
+        return None;
+    };
+    Some(plan_copy_from(source, target, options, legacy_options))
+}
+
+fn plan_copy_from(
+    source: &CopySource,
+    target: &CopyTarget,
+    options: &[CopyOption],
+    legacy_options: &[CopyLegacyOption],
+) -> crate::Result<BulkLoad> {
+    let CopySource::Table {
+        table_name,
+        columns,
+    } = source
+    else {
+        return Err(YamlBaseError::Database {
+            message: "COPY FROM needs a table, not a query".to_string(),
+        });
+    };
+    if !matches!(target, CopyTarget::Stdin) {
+        return Err(YamlBaseError::NotImplemented(
+            "COPY FROM a file or program; use COPY ... FROM STDIN".to_string(),
+        ));
+    }
+
+    let mut csv = false;
+    let mut delimiter = None;
+    let mut null = None;
+    let mut header = false;
+    let mut quote = None;
+    let mut escape = None;
+    let forced = || YamlBaseError::NotImplemented("COPY FORCE_NOT_NULL and FORCE_NULL".to_string());
+    for option in options {
+        match option {
+            CopyOption::Format(format) => match format.value.to_lowercase().as_str() {
+                "text" => csv = false,
+                "csv" => csv = true,
+                other => {
+                    return Err(YamlBaseError::NotImplemented(format!(
+                        "COPY format {}",
+                        other
+                    )));
+                }
+            },
+            CopyOption::Delimiter(c) => delimiter = Some(*c),
+            CopyOption::Null(text) => null = Some(text.clone()),
+            CopyOption::Header(on) => header = *on,
+            CopyOption::Quote(c) => quote = Some(*c),
+            CopyOption::Escape(c) => escape = Some(*c),
+            CopyOption::ForceNotNull(_) | CopyOption::ForceNull(_) => return Err(forced()),
+            // FREEZE, ENCODING and FORCE_QUOTE do not change what is read
+            _ => {}
+        }
+    }
+    for option in legacy_options {
+        match option {
+            CopyLegacyOption::Binary => {
+                return Err(YamlBaseError::NotImplemented(
+                    "COPY format binary".to_string(),
+                ));
+            }
+            CopyLegacyOption::Delimiter(c) => delimiter = Some(*c),
+            CopyLegacyOption::Null(text) => null = Some(text.clone()),
+            CopyLegacyOption::Csv(csv_options) => {
+                csv = true;
+                for option in csv_options {
+                    match option {
+                        CopyLegacyCsvOption::Header => header = true,
+                        CopyLegacyCsvOption::Quote(c) => quote = Some(*c),
+                        CopyLegacyCsvOption::Escape(c) => escape = Some(*c),
+                        CopyLegacyCsvOption::ForceNotNull(_) => return Err(forced()),
+                        CopyLegacyCsvOption::ForceQuote(_) => {}
+                    }
+                }
+            }
+        }
+    }
+
+    let mut layout = if csv {
+        let quote = quote.unwrap_or('"');
+        Layout::csv(
+            delimiter.unwrap_or(','),
+            quote,
+            escape.unwrap_or(quote),
+            null,
+        )
+    } else {
+        Layout::text(delimiter.unwrap_or('\t'), null)
+    };
+    layout.skip = usize::from(header);
+    Ok(BulkLoad {
+        table: table_name
+            .0
+            .last()
+            .map(|ident| ident.value.clone())
+            .unwrap_or_default(),
+        columns: columns.clone(),
+        layout,
+    })
+}
+
+/// Check that a record has a field for every loaded column, with PostgreSQL's
+/// messages. `line` counts from 1.
+pub(crate) fn check_width(
+    table: &Table,
+    targets: &[usize],
+    record: &[Option<String>],
+    line: usize,
+) -> crate::Result<()> {
+    let message = match targets.get(record.len()) {
+        Some(&missing) => format!(
+            "missing data for column \"{}\"",
+            table.columns[missing].name
+        ),
+        None if record.len() > targets.len() => "extra data after last expected column".to_string(),
+        None => return Ok(()),
+    };
+    Err(YamlBaseError::Database {
+        message: format!("{} (COPY {}, line {})", message, table.name, line),
+    })
+}
+
+/// The load a `LOAD DATA ... INFILE` statement describes, with the file it
+/// names, or `None` for any other statement
+pub(crate) fn parse_load_data(sql: &str) -> Option<crate::Result<(BulkLoad, String)>> {
+    let tokens = lex(sql)?;
+    let mut tokens = Tokens {
+        tokens: &tokens,
+        pos: 0,
+    };
+    if !(tokens.keyword("LOAD") && tokens.keyword("DATA")) {
+        return None;
+    }
+    Some(load_data(&mut tokens))
+}
+
+fn load_data(tokens: &mut Tokens<'_>) -> crate::Result<(BulkLoad, String)> {
+    let _ = tokens.keyword("LOW_PRIORITY") || tokens.keyword("CONCURRENT");
+    if !tokens.keyword("LOCAL") {
+        return Err(YamlBaseError::NotImplemented(
+            "LOAD DATA INFILE reading a file on the server; use LOAD DATA LOCAL INFILE".to_string(),
+        ));
+    }
+    tokens.expect_keyword("INFILE")?;
+    let file = tokens.string()?;
+    if tokens.keyword("REPLACE") {
+        return Err(YamlBaseError::NotImplemented(
+            "LOAD DATA ... REPLACE".to_string(),
+        ));
+    }
+    let _ = tokens.keyword("IGNORE");
+    tokens.expect_keyword("INTO")?;
+    tokens.expect_keyword("TABLE")?;
+    let mut table = tokens.identifier()?;
+    while tokens.punct('.') {
+        table = tokens.identifier()?;
+    }
+    if tokens.keyword("CHARACTER") {
+        tokens.expect_keyword("SET")?;
+        tokens.identifier()?;
+    }
+
+    let mut layout = Layout {
+        delimiter: "\t".to_string(),
+        terminator: "\n".to_string(),
+        quote: None,
+        quote_escape: None,
+        backslash: true,
+        nulls: vec!["\\N".to_string()],
+        skip: 0,
+    };
+    if tokens.keyword("FIELDS") || tokens.keyword("COLUMNS") {
+        loop {
+            if tokens.keyword("TERMINATED") {
+                tokens.expect_keyword("BY")?;
+                layout.delimiter = tokens.string()?;
+            } else if tokens.keyword("ENCLOSED")
+                || (tokens.keyword("OPTIONALLY") && tokens.keyword("ENCLOSED"))
+            {
+                tokens.expect_keyword("BY")?;
+                layout.quote = tokens.string()?.chars().next();
+                // An unquoted NULL reads as NULL once fields can be quoted
+                layout.nulls.push("NULL".to_string());
+            } else if tokens.keyword("ESCAPED") {
+                tokens.expect_keyword("BY")?;
+                match tokens.string()?.as_str() {
+                    "\\" => layout.backslash = true,
+                    "" => {
+                        layout.backslash = false;
+                        layout.nulls.retain(|null| null != "\\N");
+                    }
+                    other => {
+                        return Err(YamlBaseError::NotImplemented(format!(
+                            "LOAD DATA ... ESCAPED BY '{}'",
+                            other
+                        )));
+                    }
+                }
+            } else {
+                break;
+            }
+        }
+    }
+    if tokens.keyword("LINES") {
+        loop {
+            if tokens.keyword("STARTING") {
+                return Err(YamlBaseError::NotImplemented(
+                    "LOAD DATA ... LINES STARTING BY".to_string(),
+                ));
+            } else if tokens.keyword("TERMINATED") {
+                tokens.expect_keyword("BY")?;
+                layout.terminator = tokens.string()?;
+            } else {
+                break;
+            }
+        }
+    }
+    if layout.delimiter.is_empty() || layout.terminator.is_empty() {
+        return Err(YamlBaseError::NotImplemented(
+            "LOAD DATA with empty field or line terminators".to_string(),
+        ));
+    }
+    if tokens.keyword("IGNORE") {
+        layout.skip = tokens.number()?;
+        if !(tokens.keyword("LINES") || tokens.keyword("ROWS")) {
+            return Err(tokens.unexpected("LINES"));
+        }
+    }
+
+    let mut columns = Vec::new();
+    if tokens.punct('(') {
+        loop {
+            columns.push(Ident::new(tokens.identifier()?));
+            if tokens.punct(')') {
+                break;
+            }
+            if !tokens.punct(',') {
+                return Err(tokens.unexpected("',' or ')'"));
+            }
+        }
+    }
+    if tokens.keyword("SET") {
+        return Err(YamlBaseError::NotImplemented(
+            "LOAD DATA ... SET".to_string(),
+        ));
+    }
+    let _ = tokens.punct(';');
+    if tokens.pos < tokens.tokens.len() {
+        return Err(tokens.unexpected("the end of the statement"));
+    }
+    Ok((
+        BulkLoad {
+            table,
+            columns,
+            layout,
+        },
+        file,
+    ))
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token {
+    Word(String),
+    /// A quoted string, escapes decoded
+    Str(String),
+    /// A backquoted identifier
+    Quoted(String),
+    Number(String),
+    Punct(char),
+}
+
+/// The tokens of a MySQL statement, or `None` if it cannot be read
+fn lex(sql: &str) -> Option<Vec<Token>> {
+    let mut tokens = Vec::new();
+    let mut chars = sql.char_indices().peekable();
+    while let Some((_, c)) = chars.next() {
+        match c {
+            c if c.is_whitespace() => {}
+            '\'' | '"' | '`' => {
+                let mut text = String::new();
+                loop {
+                    let (_, next) = chars.next()?;
+                    if next == c {
+                        // A doubled quote is a quote
+                        if chars.peek().is_some_and(|&(_, after)| after == c) {
+                            chars.next();
+                            text.push(c);
+                            continue;
+                        }
+                        break;
+                    }
+                    if next == '\\' && c != '`' {
+                        text.push(match chars.next()?.1 {
+                            '0' => '\0',
+                            'n' => '\n',
+                            'r' => '\r',
+                            't' => '\t',
+                            'b' => '\u{8}',
+                            'Z' => '\u{1a}',
+                            other => other,
+                        });
+                        continue;
+                    }
+                    text.push(next);
+                }
+                tokens.push(match c {
+                    '`' => Token::Quoted(text),
+                    _ => Token::Str(text),
+                });
+            }
+            c if c.is_ascii_digit() => {
+                let mut number = c.to_string();
+                while let Some(&(_, digit)) = chars.peek().filter(|(_, d)| d.is_ascii_digit()) {
+                    number.push(digit);
+                    chars.next();
+                }
+                tokens.push(Token::Number(number));
+            }
+            c if c.is_alphanumeric() || c == '_' || c == '$' => {
+                let mut word = c.to_string();
+                while let Some(&(_, next)) = chars
+                    .peek()
+                    .filter(|(_, n)| n.is_alphanumeric() || *n == '_' || *n == '$')
+                {
+                    word.push(next);
+                    chars.next();
+                }
+                tokens.push(Token::Word(word));
+            }
+            c => tokens.push(Token::Punct(c)),
+        }
+    }
+    Some(tokens)
+}
+
+struct Tokens<'a> {
+    tokens: &'a [Token],
+    pos: usize,
+}
+
+impl Tokens<'_> {
+    fn keyword(&mut self, keyword: &str) -> bool {
+        match self.tokens.get(self.pos) {
+            Some(Token::Word(word)) if word.eq_ignore_ascii_case(keyword) => {
+                self.pos += 1;
+                true
+            }
+            _ => false,
+        }
+    }
+
+    fn expect_keyword(&mut self, keyword: &str) -> crate::Result<()> {
+        match self.keyword(keyword) {
+            true => Ok(()),
+            false => Err(self.unexpected(keyword)),
+        }
+    }
+
+    fn punct(&mut self, punct: char) -> bool {
+        let found = self.tokens.get(self.pos) == Some(&Token::Punct(punct));
+        self.pos += usize::from(found);
+        found
+    }
+
+    fn string(&mut self) -> crate::Result<String> {
+        match self.tokens.get(self.pos) {
+            Some(Token::Str(text)) => {
+                self.pos += 1;
+                Ok(text.clone())
+            }
+            _ => Err(self.unexpected("a quoted string")),
+        }
+    }
+
+    fn identifier(&mut self) -> crate::Result<String> {
+        match self.tokens.get(self.pos) {
+            Some(Token::Word(name) | Token::Quoted(name)) => {
+                self.pos += 1;
+                Ok(name.clone())
+            }
+            _ => Err(self.unexpected("a name")),
+        }
+    }
+
+    fn number(&mut self) -> crate::Result<usize> {
+        match self.tokens.get(self.pos) {
+            Some(Token::Number(number)) => {
+                self.pos += 1;
+                number.parse().map_err(|_| self.unexpected("a line count"))
+            }
+            _ => Err(self.unexpected("a line count")),
+        }
+    }
+
+    fn unexpected(&self, expected: &str) -> YamlBaseError {
+        let found = match self.tokens.get(self.pos) {
+            None => "the end of the statement".to_string(),
+            Some(Token::Word(word) | Token::Number(word)) => word.clone(),
+            Some(Token::Str(text)) => format!("'{}'", text),
+            Some(Token::Quoted(name)) => format!("`{}`", name),
+            Some(Token::Punct(c)) => c.to_string(),
+        };
+        YamlBaseError::Database {
+            message: format!(
+                "Syntax error in LOAD DATA: expected {}, found {}",
+                expected, found
+            ),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn copy(sql: &str) -> BulkLoad {
+        let statement = parse_statement(sql).unwrap().remove(0);
+        plan_copy(&statement).unwrap().unwrap()
+    }
+
+    fn fields(record: &[&str]) -> Vec<Option<String>> {
+        record
+            .iter()
+            .map(|field| (*field != "NULL").then(|| field.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn test_text_format() {
+        let load = copy("COPY users (id, name) FROM STDIN");
+        assert_eq!(load.table, "users");
+        assert_eq!(load.columns.len(), 2);
+        let records = load
+            .layout
+            .records("1\tAda\\tL.\n2\t\\N\r\n3\t\n\\.\n4\tignored\n")
+            .unwrap();
+        assert_eq!(
+            records,
+            vec![
+                fields(&["1", "Ada\tL."]),
+                fields(&["2", "NULL"]),
+                fields(&["3", ""])
+            ]
+        );
+        assert_eq!(
+            load.layout.records("\\x41\\101\\\\\tb").unwrap(),
+            vec![fields(&["AA\\", "b"])]
+        );
+    }
+
+    #[test]
+    fn test_csv_format() {
+        let load = copy("COPY users FROM STDIN WITH (FORMAT csv, HEADER true);");
+        let records = load
+            .layout
+            .records("id,name\n1,\"Smith, \"\"J\"\"\"\n2,\n3,\"\"\n")
+            .unwrap();
+        assert_eq!(
+            records,
+            vec![
+                fields(&["1", "Smith, \"J\""]),
+                fields(&["2", "NULL"]),
+                fields(&["3", ""]),
+            ]
+        );
+        assert!(load.layout.records("1,\"open\n").is_err());
+
+        let legacy = copy("COPY users FROM STDIN WITH DELIMITER '|' CSV QUOTE '''';");
+        assert_eq!(
+            legacy.layout.records("'a|b'|c\n").unwrap(),
+            vec![fields(&["a|b", "c"])]
+        );
+    }
+
+    #[test]
+    fn test_copy_to_and_from_files_are_not_loads() {
+        let statement = parse_sql("COPY users TO STDOUT").unwrap().remove(0);
+        assert!(plan_copy(&statement).is_none());
+        let statement = parse_sql("COPY users FROM '/tmp/users.csv'")
+            .unwrap()
+            .remove(0);
+        assert!(matches!(
+            plan_copy(&statement),
+            Some(Err(YamlBaseError::NotImplemented(_)))
+        ));
+    }
+
+    #[test]
+    fn test_load_data() {
+        let (load, file) = parse_load_data(
+            "LOAD DATA LOCAL INFILE '/tmp/users.csv' INTO TABLE shop.`users` \
+             FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '\"' \
+             LINES TERMINATED BY '\\r\\n' IGNORE 1 LINES (id, name)",
+        )
+        .unwrap()
+        .unwrap();
+        assert_eq!(file, "/tmp/users.csv");
+        assert_eq!(load.table, "users");
+        assert_eq!(load.columns, vec![Ident::new("id"), Ident::new("name")]);
+        let records = load
+            .layout
+            .records("id,name\r\n1,\"Smith, J\"\r\n2,NULL\r\n3,\\N\r\n4,\"NULL\"")
+            .unwrap();
+        assert_eq!(
+            records,
+            vec![
+                fields(&["1", "Smith, J"]),
+                fields(&["2", "NULL"]),
+                fields(&["3", "NULL"]),
+                vec![Some("4".to_string()), Some("NULL".to_string())],
+            ]
+        );
+
+        let (load, _) = parse_load_data("load data local infile 'x' into table t")
+            .unwrap()
+            .unwrap();
+        assert_eq!(
+            load.layout.records("1\ta\\tb\n").unwrap(),
+            vec![fields(&["1", "a\tb"])]
+        );
+
+        assert!(parse_load_data("SELECT 1").is_none());
+        assert!(matches!(
+            parse_load_data("LOAD DATA INFILE 'x' INTO TABLE t"),
+            Some(Err(YamlBaseError::NotImplemented(_)))
+        ));
+        assert!(matches!(
+            parse_load_data("LOAD DATA LOCAL INFILE 'x' INTO t"),
+            Some(Err(YamlBaseError::Database { .. }))
+        ));
+    }
+}
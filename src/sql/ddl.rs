@@ -0,0 +1,914 @@
+//! Table definitions from SQL DDL, so migration tools can create and reshape
+//! tables at run time.
+//!
+//! Columns get the types, constraints and defaults the same definition would
+//! get in a YAML `columns` section: `id INTEGER PRIMARY KEY` here and
+//! `id: "INTEGER PRIMARY KEY"` there make the same column. Defaults must be
+//! constants, `CURRENT_TIMESTAMP` or `gen_random_uuid()`. CHECK constraints are accepted and
+//! ignored, and a primary key or foreign key over several columns is refused,
+//! since neither can be written in YAML either. Indexes, from `CREATE INDEX`
+//! or a MySQL `INDEX`/`KEY` clause, are built over the table's rows and
+//! follow its columns through renames; dropping a column drops its indexes.
+//! `SERIAL`, `GENERATED ... AS IDENTITY` and `AUTO_INCREMENT` columns number
+//! the rows inserted without a value for them, from 1.
+
+use sqlparser::ast::{
+    AlterColumnOperation, AlterTableOperation, CharacterLength, ColumnDef, ColumnOption,
+    CreateIndex, DataType, ExactNumberInfo, Expr, FunctionArg, FunctionArgExpr, FunctionArguments,
+    Ident, IndexType, ObjectName, TableConstraint, TimezoneInfo, UnaryOperator, Value as SqlValue,
+};
+use std::collections::HashSet;
+
+use crate::YamlBaseError;
+use crate::database::{Column, Identity, Index, IndexKind, Table, Value};
+use crate::sql::coercion;
+use crate::sql::sequences;
+use crate::yaml::parser::parse_default_value;
+use crate::yaml::schema::{SqlType, YamlColumn};
+
+/// The empty table `CREATE TABLE name (columns, constraints)` makes
+pub(crate) fn build_table(
+    name: String,
+    definitions: &[ColumnDef],
+    constraints: &[TableConstraint],
+) -> crate::Result<Table> {
+    let mut columns: Vec<Column> = Vec::with_capacity(definitions.len());
+    for definition in definitions {
+        if columns
+            .iter()
+            .any(|column| column.name.eq_ignore_ascii_case(&definition.name.value))
+        {
+            return Err(YamlBaseError::Database {
+                message: format!("column \"{}\" specified more than once", definition.name),
+            });
+        }
+        columns.push(build_column(definition)?);
+    }
+    for constraint in constraints {
+        apply_constraint(&name, &mut columns, constraint)?;
+    }
+    check_primary_key_count(&name, &columns)?;
+    let indexes = constraints
+        .iter()
+        .filter_map(|constraint| constraint_index(&name, constraint))
+        .collect::<Vec<_>>();
+    let identities = definitions
+        .iter()
+        .filter_map(|definition| identity(definition, 1))
+        .collect();
+    rebuild(name, columns, Vec::new(), &indexes, identities)
+}
+
+/// An index by its definition, which outlives the rows it was built over
+#[derive(Debug, Clone)]
+pub(crate) struct IndexDefinition {
+    pub name: String,
+    pub columns: Vec<String>,
+    pub kind: IndexKind,
+    pub unique: bool,
+}
+
+impl IndexDefinition {
+    fn of(index: &Index) -> Self {
+        Self {
+            name: index.name.clone(),
+            columns: index.columns.clone(),
+            kind: index.kind,
+            unique: index.unique,
+        }
+    }
+
+    /// The index over a table's rows
+    pub(crate) fn build(&self, table: &Table) -> crate::Result<Index> {
+        Index::new(
+            self.name.clone(),
+            table,
+            &self.columns,
+            self.kind,
+            self.unique,
+        )
+    }
+}
+
+/// The index `CREATE [UNIQUE] INDEX [name] ON table [USING method] (columns)`
+/// defines. A partial index's WHERE clause is accepted and the index covers
+/// every row, which answers the same lookups.
+pub(crate) fn index_definition(create: &CreateIndex) -> crate::Result<IndexDefinition> {
+    let columns = create
+        .columns
+        .iter()
+        .map(|column| match &column.expr {
+            Expr::Identifier(ident) => Ok(ident.value.clone()),
+            expr => Err(YamlBaseError::NotImplemented(format!(
+                "Indexes on expressions such as {} are not supported",
+                expr
+            ))),
+        })
+        .collect::<crate::Result<Vec<_>>>()?;
+    let kind = match create
+        .using
+        .as_ref()
+        .map(|using| using.to_string().to_lowercase())
+    {
+        None => IndexKind::Btree,
+        Some(method) if method == "btree" => IndexKind::Btree,
+        Some(method) if method == "hash" => IndexKind::Hash,
+        Some(method) => {
+            return Err(YamlBaseError::NotImplemented(format!(
+                "Index method {} is not supported (use btree or hash)",
+                method
+            )));
+        }
+    };
+    let table_name = object_name(&create.table_name);
+    Ok(IndexDefinition {
+        name: create
+            .name
+            .as_ref()
+            .map(object_name)
+            .unwrap_or_else(|| default_index_name(&table_name, &columns)),
+        columns,
+        kind,
+        unique: create.unique,
+    })
+}
+
+/// The index a MySQL `INDEX name (columns)` or `KEY name (columns)` clause defines
+fn constraint_index(table_name: &str, constraint: &TableConstraint) -> Option<IndexDefinition> {
+    let TableConstraint::Index {
+        name,
+        index_type,
+        columns,
+        ..
+    } = constraint
+    else {
+        return None;
+    };
+    let columns: Vec<String> = columns.iter().map(|column| column.value.clone()).collect();
+    Some(IndexDefinition {
+        name: name
+            .as_ref()
+            .map(|name| name.value.clone())
+            .unwrap_or_else(|| default_index_name(table_name, &columns)),
+        kind: match index_type {
+            Some(IndexType::Hash) => IndexKind::Hash,
+            _ => IndexKind::Btree,
+        },
+        columns,
+        unique: false,
+    })
+}
+
+/// PostgreSQL's name for an unnamed index, such as `orders_customer_id_idx`
+fn default_index_name(table_name: &str, columns: &[String]) -> String {
+    format!("{}_{}_idx", table_name, columns.join("_"))
+}
+
+/// `table` after one `ALTER TABLE` operation. Operations that are skipped,
+/// such as `ADD COLUMN IF NOT EXISTS` of a column that exists, leave a notice.
+pub(crate) fn alter_table(
+    table: &Table,
+    operation: &AlterTableOperation,
+    notices: &mut Vec<String>,
+) -> crate::Result<Table> {
+    let mut name = table.name.clone();
+    let mut columns = table.columns.clone();
+    let mut rows = table.rows.clone();
+    let mut indexes: Vec<IndexDefinition> = table.indexes.iter().map(IndexDefinition::of).collect();
+    let mut identities = table.identities.clone();
+
+    match operation {
+        AlterTableOperation::AddColumn {
+            if_not_exists,
+            column_def,
+            ..
+        } => {
+            if find_column(&columns, &column_def.name.value).is_some() {
+                if *if_not_exists {
+                    notices.push(format!(
+                        "column \"{}\" of relation \"{}\" already exists, skipping",
+                        column_def.name, name
+                    ));
+                    return rebuild(name, columns, rows, &indexes, identities);
+                }
+                return Err(YamlBaseError::Database {
+                    message: format!(
+                        "column \"{}\" of relation \"{}\" already exists",
+                        column_def.name, name
+                    ),
+                });
+            }
+            let column = build_column(column_def)?;
+            if let Some(identity) = identity(column_def, rows.len() as i64 + 1) {
+                // Existing rows are numbered in table order
+                for (row, number) in rows.iter_mut().zip(1..) {
+                    row.push(Value::Integer(number));
+                }
+                identities.push(identity);
+                columns.push(column);
+                return rebuild(name, columns, rows, &indexes, identities);
+            }
+            if default_sequence(&column).is_some() && !rows.is_empty() {
+                return Err(YamlBaseError::NotImplemented(
+                    "Adding a column with a nextval() default to a table with rows is not supported"
+                        .to_string(),
+                ));
+            }
+            // Existing rows take the default, so NOT NULL needs one unless the table is empty
+            let value = column_default(&column)?;
+            if value == Value::Null && !column.nullable && !rows.is_empty() {
+                return Err(YamlBaseError::Database {
+                    message: format!("column \"{}\" contains null values", column.name),
+                });
+            }
+            for row in &mut rows {
+                // A fresh UUID each, not one shared by every row
+                row.push(if generates_uuid(&column) {
+                    column_default(&column)?
+                } else {
+                    value.clone()
+                });
+            }
+            columns.push(column);
+        }
+        AlterTableOperation::DropColumn {
+            column_name,
+            if_exists,
+            ..
+        } => match find_column(&columns, &column_name.value) {
+            Some(idx) => {
+                let dropped = columns.remove(idx);
+                for row in &mut rows {
+                    row.remove(idx);
+                }
+                indexes.retain(|index| {
+                    !index
+                        .columns
+                        .iter()
+                        .any(|column| column.eq_ignore_ascii_case(&dropped.name))
+                });
+                identities.retain(|identity| identity.column != dropped.name);
+            }
+            None if *if_exists => notices.push(format!(
+                "column \"{}\" of relation \"{}\" does not exist, skipping",
+                column_name, name
+            )),
+            None => return Err(no_such_column(&name, column_name)),
+        },
+        AlterTableOperation::RenameColumn {
+            old_column_name,
+            new_column_name,
+        } => {
+            let idx = find_column(&columns, &old_column_name.value)
+                .ok_or_else(|| no_such_column(&name, old_column_name))?;
+            if find_column(&columns, &new_column_name.value).is_some_and(|other| other != idx) {
+                return Err(YamlBaseError::Database {
+                    message: format!(
+                        "column \"{}\" of relation \"{}\" already exists",
+                        new_column_name, name
+                    ),
+                });
+            }
+            let renamed = indexes
+                .iter_mut()
+                .flat_map(|index| &mut index.columns)
+                .chain(identities.iter_mut().map(|identity| &mut identity.column));
+            for column in renamed {
+                if column.eq_ignore_ascii_case(&columns[idx].name) {
+                    *column = new_column_name.value.clone();
+                }
+            }
+            columns[idx].name = new_column_name.value.clone();
+        }
+        AlterTableOperation::RenameTable { table_name } => {
+            name = object_name(table_name);
+        }
+        AlterTableOperation::AlterColumn { column_name, op } => {
+            let idx = find_column(&columns, &column_name.value)
+                .ok_or_else(|| no_such_column(&name, column_name))?;
+            let column = &mut columns[idx];
+            match op {
+                AlterColumnOperation::SetNotNull => column.nullable = false,
+                AlterColumnOperation::DropNotNull if column.primary_key => {
+                    return Err(YamlBaseError::Database {
+                        message: format!("column \"{}\" is in a primary key", column.name),
+                    });
+                }
+                AlterColumnOperation::DropNotNull => column.nullable = true,
+                AlterColumnOperation::SetDefault { value } => {
+                    let default = default_text(value)?;
+                    check_default(&default, &column.sql_type)?;
+                    column.default = Some(default);
+                }
+                AlterColumnOperation::DropDefault => column.default = None,
+                AlterColumnOperation::SetDataType { data_type, using } => {
+                    if using.is_some() {
+                        return Err(YamlBaseError::NotImplemented(
+                            "ALTER COLUMN ... TYPE ... USING is not supported".to_string(),
+                        ));
+                    }
+                    column.sql_type = sql_type(data_type)?;
+                    if let Some(default) = &column.default {
+                        check_default(default, &column.sql_type)?;
+                    }
+                    for row in &mut rows {
+                        let value = std::mem::replace(&mut row[idx], Value::Null);
+                        row[idx] = coercion::assign(value, &column.sql_type)?;
+                    }
+                }
+                _ => {
+                    return Err(YamlBaseError::NotImplemented(format!(
+                        "ALTER COLUMN {} is not supported",
+                        op
+                    )));
+                }
+            }
+        }
+        AlterTableOperation::AddConstraint(constraint) => {
+            apply_constraint(&name, &mut columns, constraint)?;
+            check_primary_key_count(&name, &columns)?;
+            indexes.extend(constraint_index(&name, constraint));
+        }
+        _ => {
+            return Err(YamlBaseError::NotImplemented(format!(
+                "ALTER TABLE {} is not supported",
+                operation
+            )));
+        }
+    }
+
+    rebuild(name, columns, rows, &indexes, identities)
+}
+
+/// The column a definition such as `email VARCHAR(255) NOT NULL UNIQUE` makes
+fn build_column(definition: &ColumnDef) -> crate::Result<Column> {
+    let mut column = Column {
+        name: definition.name.value.clone(),
+        sql_type: sql_type(&definition.data_type)?,
+        primary_key: false,
+        nullable: true,
+        unique: false,
+        default: None,
+        references: None,
+    };
+    for option in &definition.options {
+        match &option.option {
+            ColumnOption::Null => column.nullable = true,
+            ColumnOption::NotNull => column.nullable = false,
+            ColumnOption::Unique { is_primary, .. } => {
+                if *is_primary {
+                    column.primary_key = true;
+                    column.nullable = false;
+                } else {
+                    column.unique = true;
+                }
+            }
+            ColumnOption::Default(expr) => column.default = Some(default_text(expr)?),
+            ColumnOption::ForeignKey {
+                foreign_table,
+                referred_columns,
+                ..
+            } => {
+                column.references = Some(reference(foreign_table, referred_columns)?);
+            }
+            _ => {}
+        }
+    }
+    if let Some(default) = &column.default {
+        check_default(default, &column.sql_type)?;
+    }
+    if identity(definition, 1).is_some() {
+        column.nullable = false;
+    }
+    Ok(column)
+}
+
+/// The numbering of a `SERIAL`, `GENERATED ... AS IDENTITY` or MySQL
+/// `AUTO_INCREMENT` column, starting at `next`; `None` for other columns
+fn identity(definition: &ColumnDef, next: i64) -> Option<Identity> {
+    let serial = match &definition.data_type {
+        DataType::Custom(name, _) => matches!(
+            name.to_string().to_uppercase().as_str(),
+            "SERIAL" | "BIGSERIAL" | "SMALLSERIAL" | "SERIAL2" | "SERIAL4" | "SERIAL8"
+        ),
+        _ => false,
+    };
+    let generated = definition.options.iter().any(|option| {
+        matches!(
+            option.option,
+            ColumnOption::Generated {
+                generation_expr: None,
+                ..
+            }
+        )
+    });
+    let auto_increment = definition.options.iter().any(|option| {
+        matches!(&option.option, ColumnOption::DialectSpecific(tokens)
+            if tokens.iter().any(|token| token.to_string().eq_ignore_ascii_case("AUTO_INCREMENT")))
+    });
+    (serial || generated || auto_increment).then(|| Identity {
+        column: definition.name.value.clone(),
+        next,
+        auto_increment,
+    })
+}
+
+fn apply_constraint(
+    table_name: &str,
+    columns: &mut [Column],
+    constraint: &TableConstraint,
+) -> crate::Result<()> {
+    let single_column = |names: &[Ident], kind: &str| match names {
+        [name] => find_column(columns, &name.value).ok_or_else(|| no_such_column(table_name, name)),
+        _ => Err(YamlBaseError::NotImplemented(format!(
+            "{} over several columns is not supported",
+            kind
+        ))),
+    };
+    match constraint {
+        TableConstraint::PrimaryKey { columns: names, .. } => {
+            let idx = single_column(names, "PRIMARY KEY")?;
+            columns[idx].primary_key = true;
+            columns[idx].nullable = false;
+        }
+        TableConstraint::Unique { columns: names, .. } => {
+            let idx = single_column(names, "UNIQUE")?;
+            columns[idx].unique = true;
+        }
+        TableConstraint::ForeignKey {
+            columns: names,
+            foreign_table,
+            referred_columns,
+            ..
+        } => {
+            let idx = single_column(names, "FOREIGN KEY")?;
+            columns[idx].references = Some(reference(foreign_table, referred_columns)?);
+        }
+        _ => {}
+    }
+    Ok(())
+}
+
+fn check_primary_key_count(table_name: &str, columns: &[Column]) -> crate::Result<()> {
+    if columns.iter().filter(|column| column.primary_key).count() > 1 {
+        return Err(YamlBaseError::Database {
+            message: format!(
+                "multiple primary keys for table \"{}\" are not allowed",
+                table_name
+            ),
+        });
+    }
+    Ok(())
+}
+
+/// The table with `rows` checked against its new columns, its indexes built
+/// over them and its identity columns numbering on from where they were
+fn rebuild(
+    name: String,
+    columns: Vec<Column>,
+    rows: Vec<Vec<Value>>,
+    indexes: &[IndexDefinition],
+    identities: Vec<Identity>,
+) -> crate::Result<Table> {
+    let mut table = Table::new(name, columns);
+    table.identities = identities;
+    table.rows.reserve(rows.len());
+    for row in rows {
+        table.insert_row(row)?;
+    }
+    if let Some(pk_idx) = table.primary_key_index {
+        let mut keys = HashSet::with_capacity(table.rows.len());
+        for row in &table.rows {
+            if !keys.insert(&row[pk_idx]) {
+                return Err(YamlBaseError::Database {
+                    message: format!(
+                        "Duplicate key value {} violates primary key of table '{}'",
+                        row[pk_idx], table.name
+                    ),
+                });
+            }
+        }
+    }
+    for definition in indexes {
+        let index = definition.build(&table)?;
+        table.indexes.push(index);
+    }
+    Ok(table)
+}
+
+/// The column type for a SQL data type, read as YAML reads type names
+fn sql_type(data_type: &DataType) -> crate::Result<SqlType> {
+    let length = |length: &Option<CharacterLength>, default: usize| match length {
+        Some(CharacterLength::IntegerLength { length, .. }) => *length as usize,
+        _ => default,
+    };
+    Ok(match data_type {
+        DataType::Int(_)
+        | DataType::Integer(_)
+        | DataType::BigInt(_)
+        | DataType::SmallInt(_)
+        | DataType::TinyInt(_)
+        | DataType::Int2(_)
+        | DataType::Int4(_)
+        | DataType::Int8(_) => SqlType::Integer,
+        DataType::Char(len) | DataType::Character(len) => SqlType::Char(length(len, 1)),
+        DataType::Varchar(len) | DataType::CharacterVarying(len) => {
+            SqlType::Varchar(length(len, 255))
+        }
+        DataType::Text | DataType::String(_) => SqlType::Text,
+        DataType::Timestamp(_, TimezoneInfo::WithTimeZone | TimezoneInfo::Tz) => {
+            SqlType::TimestampTz
+        }
+        DataType::Timestamp(..) | DataType::Datetime(_) => SqlType::Timestamp,
+        DataType::Date => SqlType::Date,
+        DataType::Time(..) => SqlType::Time,
+        DataType::Boolean | DataType::Bool => SqlType::Boolean,
+        DataType::Decimal(info) | DataType::Numeric(info) => match info {
+            ExactNumberInfo::None => SqlType::Decimal(10, 2),
+            ExactNumberInfo::Precision(precision) => SqlType::Decimal(*precision as u32, 0),
+            ExactNumberInfo::PrecisionAndScale(precision, scale) => {
+                SqlType::Decimal(*precision as u32, *scale as u32)
+            }
+        },
+        DataType::Float(_) | DataType::Real | DataType::Float4 => SqlType::Float,
+        DataType::Double | DataType::DoublePrecision | DataType::Float8 => SqlType::Double,
+        DataType::Uuid => SqlType::Uuid,
+        DataType::JSON | DataType::JSONB => SqlType::Json,
+        DataType::Bytea | DataType::Blob(_) => SqlType::Bytea,
+        DataType::Custom(name, _)
+            if matches!(
+                name.to_string().to_uppercase().as_str(),
+                "SERIAL" | "BIGSERIAL" | "SMALLSERIAL" | "SERIAL2" | "SERIAL4" | "SERIAL8"
+            ) =>
+        {
+            SqlType::Integer
+        }
+        // POINT, HSTORE, MONEY(EUR) and the like
+        other => YamlColumn::parse(String::new(), &other.to_string())?.get_base_type()?,
+    })
+}
+
+/// A column default in the text form YAML gives it
+fn default_text(expr: &Expr) -> crate::Result<String> {
+    match expr {
+        Expr::Value(SqlValue::SingleQuotedString(text)) => Ok(text.clone()),
+        Expr::Value(SqlValue::Number(number, _)) => Ok(number.clone()),
+        Expr::Value(SqlValue::Boolean(value)) => Ok(value.to_string()),
+        Expr::Value(SqlValue::Null) => Ok("NULL".to_string()),
+        Expr::UnaryOp {
+            op: UnaryOperator::Minus,
+            expr,
+        } if matches!(**expr, Expr::Value(SqlValue::Number(..))) => Ok(format!("-{}", expr)),
+        // `'active'::text`, as pg_dump writes defaults
+        Expr::Cast { expr, .. } | Expr::Nested(expr) => default_text(expr),
+        Expr::Function(function)
+            if matches!(
+                function.name.to_string().to_uppercase().as_str(),
+                "CURRENT_TIMESTAMP" | "NOW" | "LOCALTIMESTAMP"
+            ) =>
+        {
+            Ok("CURRENT_TIMESTAMP".to_string())
+        }
+        // MySQL's `DEFAULT (UUID())` and the uuid-ossp function
+        Expr::Function(function)
+            if matches!(
+                function.name.to_string().to_uppercase().as_str(),
+                "GEN_RANDOM_UUID" | "UUID_GENERATE_V4" | "UUID"
+            ) =>
+        {
+            Ok(UUID_DEFAULT.to_string())
+        }
+        // `nextval('orders_id_seq'::regclass)`, as pg_dump writes SERIAL columns
+        Expr::Function(function) if function.name.to_string().eq_ignore_ascii_case("NEXTVAL") => {
+            let name = match &function.args {
+                FunctionArguments::List(list) => match list.args.as_slice() {
+                    [FunctionArg::Unnamed(FunctionArgExpr::Expr(arg))] => {
+                        sequences::sequence_name(arg)
+                    }
+                    _ => None,
+                },
+                _ => None,
+            };
+            name.map(|name| format!("nextval('{}')", name))
+                .ok_or_else(|| unsupported_default(expr))
+        }
+        _ => Err(unsupported_default(expr)),
+    }
+}
+
+fn unsupported_default(expr: &Expr) -> YamlBaseError {
+    YamlBaseError::NotImplemented(format!(
+        "DEFAULT {} is not supported (use a constant, CURRENT_TIMESTAMP, gen_random_uuid() or nextval())",
+        expr
+    ))
+}
+
+/// The default whose value each row draws from the server's UUID generator
+pub(crate) const UUID_DEFAULT: &str = "gen_random_uuid()";
+
+/// Whether a column's default is a fresh UUID for each row
+pub(crate) fn generates_uuid(column: &Column) -> bool {
+    column
+        .default
+        .as_deref()
+        .is_some_and(|default| default.eq_ignore_ascii_case(UUID_DEFAULT))
+}
+
+/// The sequence a column's `nextval('name')` default draws from for each row
+pub(crate) fn default_sequence(column: &Column) -> Option<&str> {
+    column
+        .default
+        .as_deref()?
+        .strip_prefix("nextval('")?
+        .strip_suffix("')")
+}
+
+/// That a default holds a value of the column's type
+fn check_default(default: &str, sql_type: &SqlType) -> crate::Result<()> {
+    if !default.starts_with("nextval('") {
+        parse_default_value(default, sql_type)?;
+    }
+    Ok(())
+}
+
+/// The value a column takes when a write leaves it out or sets it to
+/// `DEFAULT`; NULL for a `nextval()` default, which the executor draws
+pub(crate) fn column_default(column: &Column) -> crate::Result<Value> {
+    match &column.default {
+        Some(_) if default_sequence(column).is_some() => Ok(Value::Null),
+        Some(default) => parse_default_value(default, &column.sql_type),
+        None => Ok(Value::Null),
+    }
+}
+
+fn reference(
+    foreign_table: &ObjectName,
+    referred_columns: &[Ident],
+) -> crate::Result<(String, String)> {
+    match referred_columns {
+        [column] => Ok((object_name(foreign_table), column.value.clone())),
+        [] => Err(YamlBaseError::NotImplemented(
+            "REFERENCES needs the referenced column".to_string(),
+        )),
+        _ => Err(YamlBaseError::NotImplemented(
+            "FOREIGN KEY over several columns is not supported".to_string(),
+        )),
+    }
+}
+
+/// The table part of a possibly schema-qualified name
+pub(crate) fn object_name(name: &ObjectName) -> String {
+    name.0
+        .last()
+        .map(|ident| ident.value.clone())
+        .unwrap_or_default()
+}
+
+fn find_column(columns: &[Column], name: &str) -> Option<usize> {
+    columns
+        .iter()
+        .position(|column| column.name.eq_ignore_ascii_case(name))
+}
+
+fn no_such_column(table_name: &str, column: &Ident) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!(
+            "column \"{}\" of relation \"{}\" does not exist",
+            column.value, table_name
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use sqlparser::ast::Statement;
+    use sqlparser::dialect::PostgreSqlDialect;
+    use sqlparser::parser::Parser;
+
+    fn parse(sql: &str) -> Statement {
+        Parser::parse_sql(&PostgreSqlDialect {}, sql)
+            .unwrap()
+            .remove(0)
+    }
+
+    fn create(sql: &str) -> crate::Result<Table> {
+        let Statement::CreateTable(create) = parse(sql) else {
+            panic!("not a CREATE TABLE: {}", sql);
+        };
+        build_table(
+            object_name(&create.name),
+            &create.columns,
+            &create.constraints,
+        )
+    }
+
+    fn alter(table: &Table, sql: &str) -> crate::Result<Table> {
+        let Statement::AlterTable { operations, .. } = parse(sql) else {
+            panic!("not an ALTER TABLE: {}", sql);
+        };
+        let mut notices = Vec::new();
+        let mut table = table.clone();
+        for operation in &operations {
+            table = alter_table(&table, operation, &mut notices)?;
+        }
+        Ok(table)
+    }
+
+    #[test]
+    fn test_columns_match_their_yaml_definitions() {
+        let table = create(
+            "CREATE TABLE public.orders (
+                id BIGSERIAL,
+                customer_id INT NOT NULL REFERENCES customers(id),
+                status VARCHAR(20) DEFAULT 'pending'::character varying,
+                total NUMERIC(10, 2),
+                placed_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+                CONSTRAINT orders_pkey PRIMARY KEY (id),
+                CHECK (total >= 0)
+            )",
+        )
+        .unwrap();
+        assert_eq!(table.name, "orders");
+        assert_eq!(table.primary_key_index, Some(0));
+
+        let yaml = crate::yaml::parser::build_columns(
+            &[
+                ("id", "INTEGER PRIMARY KEY"),
+                ("customer_id", "INTEGER NOT NULL REFERENCES customers(id)"),
+                ("status", "VARCHAR(20) DEFAULT pending"),
+                ("total", "DECIMAL(10,2)"),
+                ("placed_at", "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"),
+            ]
+            .into_iter()
+            .map(|(name, type_def)| (name.to_string(), type_def.to_string()))
+            .collect::<indexmap::IndexMap<_, _>>(),
+        )
+        .unwrap();
+        for (column, expected) in table.columns.iter().zip(&yaml) {
+            assert_eq!(column.sql_type, expected.sql_type, "{}", column.name);
+            assert_eq!(column.primary_key, expected.primary_key, "{}", column.name);
+            assert_eq!(column.nullable, expected.nullable, "{}", column.name);
+            assert_eq!(
+                column.default.as_deref().map(str::to_uppercase),
+                expected.default.as_deref().map(str::to_uppercase),
+                "{}",
+                column.name
+            );
+        }
+        assert_eq!(
+            table.columns[1].references,
+            Some(("customers".to_string(), "id".to_string()))
+        );
+
+        for sql in [
+            "CREATE TABLE t (a INT, A TEXT)",
+            "CREATE TABLE t (a INT, b INT, PRIMARY KEY (a, b))",
+            "CREATE TABLE t (a INT PRIMARY KEY, b INT PRIMARY KEY)",
+            "CREATE TABLE t (a INT DEFAULT 'x')",
+            "CREATE TABLE t (a TEXT DEFAULT upper('x'))",
+        ] {
+            assert!(create(sql).is_err(), "{}", sql);
+        }
+    }
+
+    #[test]
+    fn test_alter_table_reshapes_rows() {
+        let mut table = create("CREATE TABLE users (id INT PRIMARY KEY, name TEXT)").unwrap();
+        table
+            .insert_row(vec![Value::Integer(1), Value::Text("Ann".to_string())])
+            .unwrap();
+        table
+            .insert_row(vec![Value::Integer(2), Value::Null])
+            .unwrap();
+
+        let altered = [
+            "ALTER TABLE users ADD COLUMN active BOOLEAN NOT NULL DEFAULT true",
+            "ALTER TABLE users RENAME COLUMN name TO full_name",
+            "ALTER TABLE users ALTER COLUMN id TYPE TEXT",
+        ]
+        .iter()
+        .try_fold(table.clone(), |table, sql| alter(&table, sql))
+        .unwrap();
+        let names: Vec<&str> = altered.columns.iter().map(|c| c.name.as_str()).collect();
+        assert_eq!(names, ["id", "full_name", "active"]);
+        assert_eq!(
+            altered.rows[0],
+            vec![
+                Value::Text("1".to_string()),
+                Value::Text("Ann".to_string()),
+                Value::Boolean(true),
+            ]
+        );
+
+        let dropped = alter(&altered, "ALTER TABLE users DROP COLUMN full_name").unwrap();
+        assert_eq!(
+            dropped.rows[1],
+            vec![Value::Text("2".to_string()), Value::Boolean(true)]
+        );
+        let renamed = alter(&dropped, "ALTER TABLE users RENAME TO members").unwrap();
+        assert_eq!(renamed.name, "members");
+
+        for sql in [
+            "ALTER TABLE users ADD COLUMN email TEXT NOT NULL",
+            "ALTER TABLE users ALTER COLUMN name SET NOT NULL",
+            "ALTER TABLE users ALTER COLUMN name TYPE INTEGER",
+            "ALTER TABLE users RENAME COLUMN name TO id",
+            "ALTER TABLE users DROP COLUMN missing",
+        ] {
+            assert!(alter(&table, sql).is_err(), "{}", sql);
+        }
+        alter(&table, "ALTER TABLE users DROP COLUMN IF EXISTS missing").unwrap();
+    }
+
+    #[test]
+    fn test_indexes_follow_their_columns() {
+        let mut table = create("CREATE TABLE users (id INT, name TEXT, city TEXT)").unwrap();
+        for (id, name, city) in [(1, "Ann", "Oslo"), (2, "Bob", "Rome")] {
+            table
+                .insert_row(vec![
+                    Value::Integer(id),
+                    Value::Text(name.to_string()),
+                    Value::Text(city.to_string()),
+                ])
+                .unwrap();
+        }
+        let Statement::CreateIndex(create_index) =
+            parse("CREATE INDEX ON users USING HASH (city, name)")
+        else {
+            panic!("not a CREATE INDEX");
+        };
+        let definition = index_definition(&create_index).unwrap();
+        assert_eq!(definition.name, "users_city_name_idx");
+        assert_eq!(definition.kind, IndexKind::Hash);
+        table.indexes.push(definition.build(&table).unwrap());
+
+        let renamed = alter(&table, "ALTER TABLE users RENAME COLUMN city TO town").unwrap();
+        assert_eq!(renamed.indexes[0].columns, ["town", "name"]);
+        let bob = [
+            Value::Text("Rome".to_string()),
+            Value::Text("Bob".to_string()),
+        ];
+        assert_eq!(renamed.indexes[0].find(&bob), Some(vec![1]));
+        let widened = alter(&renamed, "ALTER TABLE users ADD COLUMN age INT").unwrap();
+        assert_eq!(widened.indexes[0].find(&bob), Some(vec![1]));
+        let dropped = alter(&widened, "ALTER TABLE users DROP COLUMN name").unwrap();
+        assert!(dropped.indexes.is_empty());
+
+        for sql in [
+            "CREATE INDEX ON users (lower(name))",
+            "CREATE INDEX ON users USING gin (name)",
+        ] {
+            let Statement::CreateIndex(create_index) = parse(sql) else {
+                panic!("not a CREATE INDEX: {}", sql);
+            };
+            assert!(index_definition(&create_index).is_err(), "{}", sql);
+        }
+    }
+
+    #[test]
+    fn test_identity_columns_are_numbered() {
+        let table = create(
+            "CREATE TABLE t (
+                a SERIAL,
+                b INT GENERATED ALWAYS AS IDENTITY,
+                c INT AUTO_INCREMENT PRIMARY KEY,
+                d INT GENERATED ALWAYS AS (c * 2) STORED
+            )",
+        )
+        .unwrap();
+        let identities: Vec<(&str, i64, bool)> = table
+            .identities
+            .iter()
+            .map(|identity| {
+                (
+                    identity.column.as_str(),
+                    identity.next,
+                    identity.auto_increment,
+                )
+            })
+            .collect();
+        assert_eq!(
+            identities,
+            [("a", 1, false), ("b", 1, false), ("c", 1, true)]
+        );
+        assert!(!table.columns[0].nullable && !table.columns[1].nullable);
+
+        let mut users = create("CREATE TABLE users (name TEXT)").unwrap();
+        for name in ["Ann", "Bob"] {
+            users
+                .insert_row(vec![Value::Text(name.to_string())])
+                .unwrap();
+        }
+        let numbered = alter(&users, "ALTER TABLE users ADD COLUMN id SERIAL").unwrap();
+        assert_eq!(
+            numbered.rows[1],
+            vec![Value::Text("Bob".to_string()), Value::Integer(2)]
+        );
+        assert_eq!(numbered.identities[0].next, 3);
+        let renamed = alter(&numbered, "ALTER TABLE users RENAME COLUMN id TO user_id").unwrap();
+        assert_eq!(renamed.identities[0].column, "user_id");
+        let dropped = alter(&renamed, "ALTER TABLE users DROP COLUMN user_id").unwrap();
+        assert!(dropped.identities.is_empty());
+    }
+}
@@ -0,0 +1,97 @@
+//! Enumerated types, declared in YAML as `status: enum(pending, shipped)`.
+//!
+//! A value is held as the text of one of its type's labels, and loading or
+//! storing any other text is an error. Each distinct list of labels is a
+//! PostgreSQL enum type, named after the first column declaring it, as in
+//! `orders_status`, with an OID derived from the labels, so that it is the
+//! same on every connection and every restart. Result columns of the type
+//! carry that OID, and `pg_type` and `pg_enum` describe it, which is how
+//! clients such as pgx learn to read it as text.
+
+use crate::YamlBaseError;
+use crate::database::{Database, Value};
+use crate::yaml::schema::SqlType;
+
+/// Where enum type OIDs start, above any OID yamlbase gives a table
+const FIRST_OID: u32 = 1 << 24;
+
+/// The OID of the enum type with these labels
+pub(crate) fn oid(labels: &[String]) -> u32 {
+    // FNV-1a, stable across builds unlike the standard library's hasher
+    let hash = labels
+        .iter()
+        .flat_map(|label| label.bytes().chain([0]))
+        .fold(0x811c_9dc5_u32, |hash, b| {
+            (hash ^ b as u32).wrapping_mul(0x0100_0193)
+        });
+    FIRST_OID | (hash & 0x00ff_ffff)
+}
+
+/// A value stored into a column of the enum type with these labels: text
+/// that is one of them, in the same case
+pub(crate) fn check(value: Value, labels: &[String]) -> crate::Result<Value> {
+    match value {
+        Value::Null => Ok(Value::Null),
+        Value::Text(ref text) if labels.contains(text) => Ok(value),
+        value => Err(YamlBaseError::TypeConversion(format!(
+            "invalid input value for enum ({}): \"{}\"",
+            labels.join(", "),
+            value
+        ))),
+    }
+}
+
+/// An enum type of a database
+pub(crate) struct EnumType<'a> {
+    pub oid: u32,
+    pub name: String,
+    pub labels: &'a [String],
+}
+
+/// The enum types of a database's columns, one for each distinct list of
+/// labels, in the order their first columns are declared
+pub(crate) fn types(db: &Database) -> Vec<EnumType<'_>> {
+    let mut types: Vec<EnumType> = Vec::new();
+    for table in db.tables.values() {
+        for column in &table.columns {
+            let SqlType::Enum(labels) = &column.sql_type else {
+                continue;
+            };
+            let oid = oid(labels);
+            if types.iter().all(|existing| existing.oid != oid) {
+                types.push(EnumType {
+                    oid,
+                    name: format!("{}_{}", table.name, column.name),
+                    labels,
+                });
+            }
+        }
+    }
+    types
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn labels(labels: &[&str]) -> Vec<String> {
+        labels.iter().map(ToString::to_string).collect()
+    }
+
+    #[test]
+    fn test_enum_values_are_checked() {
+        let status = labels(&["pending", "shipped", "delivered"]);
+        let text = |s: &str| Value::Text(s.to_string());
+
+        assert_eq!(check(text("shipped"), &status).unwrap(), text("shipped"));
+        assert_eq!(check(Value::Null, &status).unwrap(), Value::Null);
+        let error = check(text("Shipped"), &status).unwrap_err();
+        assert!(error.to_string().contains("invalid input value for enum"));
+        assert!(check(Value::Integer(1), &status).is_err());
+
+        // The OID depends on the labels alone
+        assert_eq!(oid(&status), oid(&status.clone()));
+        assert_ne!(oid(&status), oid(&labels(&["pending", "shipped"])));
+        assert!(oid(&status) >= FIRST_OID);
+    }
+}
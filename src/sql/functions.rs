@@ -0,0 +1,146 @@
+//! Registry for user-defined SQL functions.
+//!
+//! Applications embedding yamlbase as a library can register domain-specific
+//! scalar and aggregate functions before starting the server:
+//!
+//! ```
+//! use yamlbase::database::Value;
+//! use yamlbase::sql::functions::register_scalar_function;
+//!
+//! register_scalar_function("normalize_sku", |args| match args {
+//!     [Value::Text(sku)] => Ok(Value::Text(sku.trim().to_uppercase().replace(' ', "-"))),
+//!     [Value::Null] => Ok(Value::Null),
+//!     _ => Err(yamlbase::YamlBaseError::Database {
+//!         message: "normalize_sku requires one string argument".to_string(),
+//!     }),
+//! });
+//! ```
+//!
+//! Function names are case-insensitive. Built-in functions always take
+//! precedence, so a registered function can never change the behaviour of an
+//! existing query.
+
+use once_cell::sync::Lazy;
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+use crate::database::Value;
+
+/// A scalar function receives the evaluated arguments for a single row
+pub type ScalarFunction = Arc<dyn Fn(&[Value]) -> crate::Result<Value> + Send + Sync>;
+
+/// An aggregate function receives the evaluated arguments of every row in the group
+pub type AggregateFunction = Arc<dyn Fn(&[Vec<Value>]) -> crate::Result<Value> + Send + Sync>;
+
+#[derive(Default)]
+struct Registry {
+    scalar: HashMap<String, ScalarFunction>,
+    aggregate: HashMap<String, AggregateFunction>,
+}
+
+static REGISTRY: Lazy<RwLock<Registry>> = Lazy::new(|| RwLock::new(Registry::default()));
+
+/// Register (or replace) a scalar function callable from SQL as `name(args...)`
+pub fn register_scalar_function<F>(name: &str, function: F)
+where
+    F: Fn(&[Value]) -> crate::Result<Value> + Send + Sync + 'static,
+{
+    let mut registry = REGISTRY.write().unwrap_or_else(|e| e.into_inner());
+    let name = name.to_uppercase();
+    registry.aggregate.remove(&name);
+    registry.scalar.insert(name, Arc::new(function));
+}
+
+/// Register (or replace) an aggregate function usable in grouped and whole-table queries
+pub fn register_aggregate_function<F>(name: &str, function: F)
+where
+    F: Fn(&[Vec<Value>]) -> crate::Result<Value> + Send + Sync + 'static,
+{
+    let mut registry = REGISTRY.write().unwrap_or_else(|e| e.into_inner());
+    let name = name.to_uppercase();
+    registry.scalar.remove(&name);
+    registry.aggregate.insert(name, Arc::new(function));
+}
+
+/// Remove a registered function, returning whether one existed
+pub fn unregister_function(name: &str) -> bool {
+    let mut registry = REGISTRY.write().unwrap_or_else(|e| e.into_inner());
+    let name = name.to_uppercase();
+    let scalar = registry.scalar.remove(&name).is_some();
+    let aggregate = registry.aggregate.remove(&name).is_some();
+    scalar || aggregate
+}
+
+/// The scalar function a call resolves to once the executor's own built-ins
+/// are ruled out: a geospatial, JSON, array, binary string, interval or
+/// system catalog function, else a registered one
+pub(crate) fn scalar_function(name: &str) -> Option<ScalarFunction> {
+    if let Some(function) = super::geo::function(name) {
+        return Some(Arc::new(function));
+    }
+    if let Some(function) = super::json::function(name) {
+        return Some(Arc::new(function));
+    }
+    if let Some(function) = super::array::function(name) {
+        return Some(Arc::new(function));
+    }
+    if let Some(function) = super::bytea::function(name) {
+        return Some(Arc::new(function));
+    }
+    if let Some(function) = super::interval::function(name) {
+        return Some(Arc::new(function));
+    }
+    if let Some(function) = super::catalog::function(name) {
+        return Some(Arc::new(function));
+    }
+    let registry = REGISTRY.read().unwrap_or_else(|e| e.into_inner());
+    registry.scalar.get(&name.to_uppercase()).cloned()
+}
+
+pub(crate) fn aggregate_function(name: &str) -> Option<AggregateFunction> {
+    let registry = REGISTRY.read().unwrap_or_else(|e| e.into_inner());
+    registry.aggregate.get(&name.to_uppercase()).cloned()
+}
+
+pub(crate) fn is_aggregate(name: &str) -> bool {
+    let registry = REGISTRY.read().unwrap_or_else(|e| e.into_inner());
+    registry.aggregate.contains_key(&name.to_uppercase())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_register_and_lookup_is_case_insensitive() {
+        register_scalar_function("test_double_it", |args| match args {
+            [Value::Integer(i)] => Ok(Value::Integer(i * 2)),
+            _ => Ok(Value::Null),
+        });
+
+        let function = scalar_function("TEST_DOUBLE_IT").unwrap();
+        assert_eq!(function(&[Value::Integer(21)]).unwrap(), Value::Integer(42));
+        assert!(!is_aggregate("test_double_it"));
+
+        assert!(unregister_function("Test_Double_It"));
+        assert!(scalar_function("test_double_it").is_none());
+        assert!(!unregister_function("test_double_it"));
+    }
+
+    #[test]
+    fn test_reregistering_switches_kind() {
+        register_scalar_function("test_switch_kind", |_| Ok(Value::Null));
+        register_aggregate_function("test_switch_kind", |rows| {
+            Ok(Value::Integer(rows.len() as i64))
+        });
+
+        assert!(scalar_function("test_switch_kind").is_none());
+        assert!(is_aggregate("test_switch_kind"));
+        let function = aggregate_function("test_switch_kind").unwrap();
+        assert_eq!(
+            function(&[vec![Value::Null], vec![Value::Null]]).unwrap(),
+            Value::Integer(2)
+        );
+        unregister_function("test_switch_kind");
+    }
+}
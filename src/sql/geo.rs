@@ -0,0 +1,349 @@
+//! A minimal geospatial subset: `POINT` columns and the distance functions
+//! store-locator queries rely on.
+//!
+//! A point is kept as WKT text, `POINT(lon lat)`, the way PostGIS's `ST_AsText`
+//! prints it, and written in YAML as a `{ lat: ..., lon: ... }` mapping or as
+//! that text. Distances are great-circle distances in meters on a sphere: what
+//! MySQL's `ST_Distance_Sphere` computes, and within about 0.5% of the
+//! spheroidal distance PostGIS uses for `geography`.
+
+use rust_decimal::prelude::ToPrimitive;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+use crate::yaml::schema::SqlType;
+
+/// Mean earth radius PostGIS uses for spherical distances, in meters
+const EARTH_RADIUS: f64 = 6_371_008.8;
+/// Earth radius MySQL's `ST_Distance_Sphere` defaults to, in meters
+const MYSQL_EARTH_RADIUS: f64 = 6_370_986.0;
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Point {
+    pub lat: f64,
+    pub lon: f64,
+}
+
+impl Point {
+    pub fn new(lat: f64, lon: f64) -> crate::Result<Self> {
+        if !(-90.0..=90.0).contains(&lat) || !(-180.0..=180.0).contains(&lon) {
+            return Err(YamlBaseError::TypeConversion(format!(
+                "Point latitude {} / longitude {} is out of range",
+                lat, lon
+            )));
+        }
+        Ok(Self { lat, lon })
+    }
+
+    /// Parse WKT such as `POINT(4.89 52.37)`, longitude first, optionally with
+    /// a PostGIS `SRID=4326;` prefix
+    pub fn parse(text: &str) -> crate::Result<Self> {
+        let invalid = || {
+            YamlBaseError::TypeConversion(format!(
+                "Cannot parse point: {} (expected POINT(lon lat))",
+                text
+            ))
+        };
+        let mut wkt = text.trim();
+        if let Some((srid, rest)) = wkt.split_once(';') {
+            if !srid.trim().to_uppercase().starts_with("SRID=") {
+                return Err(invalid());
+            }
+            wkt = rest.trim();
+        }
+        let coordinates = wkt
+            .get(..5)
+            .filter(|keyword| keyword.eq_ignore_ascii_case("POINT"))
+            .and_then(|_| wkt[5..].trim().strip_prefix('('))
+            .and_then(|rest| rest.strip_suffix(')'))
+            .ok_or_else(invalid)?;
+        let numbers: Vec<f64> = coordinates
+            .split_whitespace()
+            .map(|number| number.parse().map_err(|_| invalid()))
+            .collect::<crate::Result<_>>()?;
+        match numbers.as_slice() {
+            [lon, lat] => Self::new(*lat, *lon),
+            _ => Err(invalid()),
+        }
+    }
+
+    pub fn to_wkt(&self) -> String {
+        format!("POINT({} {})", self.lon, self.lat)
+    }
+
+    /// Great-circle distance to `other` in meters, by the haversine formula
+    pub fn distance(&self, other: &Point, radius: f64) -> f64 {
+        let (lat1, lat2) = (self.lat.to_radians(), other.lat.to_radians());
+        let d_lat = lat2 - lat1;
+        let d_lon = (other.lon - self.lon).to_radians();
+        let a = (d_lat / 2.0).sin().powi(2) + lat1.cos() * lat2.cos() * (d_lon / 2.0).sin().powi(2);
+        2.0 * radius * a.sqrt().asin()
+    }
+}
+
+/// Whether a cast target such as `::geography` names a point-holding type
+pub(crate) fn is_geo_type(name: &str) -> bool {
+    matches!(
+        name.to_uppercase().as_str(),
+        "GEOGRAPHY" | "GEOMETRY" | "POINT"
+    )
+}
+
+/// The column type of a PostGIS-style `GEOGRAPHY(POINT, 4326)`,
+/// `GEOMETRY(Point)` or bare `GEOGRAPHY`: only WGS 84 points are kept
+pub(crate) fn column_type(type_def: &str) -> crate::Result<SqlType> {
+    let upper = type_def.trim().to_uppercase();
+    let rest = upper.trim_start_matches(|c: char| c.is_ascii_alphabetic());
+    let Some(params) = rest.trim_start().strip_prefix('(') else {
+        return Ok(SqlType::Point);
+    };
+    let params = params.split(')').next().unwrap_or_default();
+    let mut params = params.split(',').map(str::trim);
+    let name = &upper[..upper.len() - rest.len()];
+    match params.next() {
+        Some("POINT") => {}
+        shape => {
+            return Err(YamlBaseError::TypeConversion(format!(
+                "Only {}(POINT) columns are supported, not {}({})",
+                name,
+                name,
+                shape.unwrap_or_default()
+            )));
+        }
+    }
+    match params.next() {
+        None | Some("4326") => Ok(SqlType::Point),
+        Some(srid) => Err(YamlBaseError::TypeConversion(format!(
+            "Points are WGS 84 (SRID 4326), not SRID {}",
+            srid
+        ))),
+    }
+}
+
+/// Cast a value to a geo type, checking that text holds a point
+pub(crate) fn cast(value: Value) -> crate::Result<Value> {
+    match value {
+        Value::Null => Ok(Value::Null),
+        Value::Text(text) => Ok(Value::Text(Point::parse(&text)?.to_wkt())),
+        other => Err(YamlBaseError::Database {
+            message: format!("Cannot cast {:?} to a point", other),
+        }),
+    }
+}
+
+/// The geospatial function called `name`, if it is one
+pub(crate) fn function(name: &str) -> Option<fn(&[Value]) -> crate::Result<Value>> {
+    let function: fn(&[Value]) -> crate::Result<Value> = match name.to_uppercase().as_str() {
+        "ST_POINT" | "ST_MAKEPOINT" | "POINT" => make_point,
+        "ST_GEOMFROMTEXT" | "ST_GEOGFROMTEXT" | "ST_POINTFROMTEXT" => from_text,
+        "ST_SETSRID" => set_srid,
+        "ST_ASTEXT" => as_text,
+        "ST_X" | "ST_LONGITUDE" => longitude,
+        "ST_Y" | "ST_LATITUDE" => latitude,
+        "ST_DISTANCE" => st_distance,
+        "ST_DISTANCESPHERE" => st_distance_sphere,
+        "ST_DISTANCE_SPHERE" => mysql_distance_sphere,
+        "ST_DWITHIN" => within,
+        _ => return None,
+    };
+    Some(function)
+}
+
+fn wrong_arguments(function: &str, expected: &str) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!("{} requires {}", function, expected),
+    }
+}
+
+fn point_arg(value: &Value, function: &str) -> crate::Result<Point> {
+    match value {
+        Value::Text(text) => Point::parse(text),
+        _ => Err(wrong_arguments(function, "point arguments")),
+    }
+}
+
+fn number_arg(value: &Value, function: &str) -> crate::Result<f64> {
+    match value {
+        Value::Integer(i) => Ok(*i as f64),
+        Value::Float(f) => Ok(*f as f64),
+        Value::Double(d) => Ok(*d),
+        Value::Decimal(d) => d
+            .to_f64()
+            .ok_or_else(|| wrong_arguments(function, "numeric arguments")),
+        _ => Err(wrong_arguments(function, "numeric arguments")),
+    }
+}
+
+/// `ST_MakePoint(lon, lat)`; PostGIS and MySQL both take the longitude first
+fn make_point(args: &[Value]) -> crate::Result<Value> {
+    let [lon, lat] = args else {
+        return Err(wrong_arguments(
+            "ST_MAKEPOINT",
+            "a longitude and a latitude",
+        ));
+    };
+    if matches!(lon, Value::Null) || matches!(lat, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let point = Point::new(
+        number_arg(lat, "ST_MAKEPOINT")?,
+        number_arg(lon, "ST_MAKEPOINT")?,
+    )?;
+    Ok(Value::Text(point.to_wkt()))
+}
+
+/// `ST_GeomFromText('POINT(lon lat)'[, srid])`
+fn from_text(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [Value::Null] | [Value::Null, _] => Ok(Value::Null),
+        [text] | [text, _] => Ok(Value::Text(point_arg(text, "ST_GEOMFROMTEXT")?.to_wkt())),
+        _ => Err(wrong_arguments("ST_GEOMFROMTEXT", "a WKT point")),
+    }
+}
+
+/// `ST_SetSRID(point, srid)`; every point is WGS 84, so the SRID is not kept
+fn set_srid(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [point, _] => Ok(point.clone()),
+        _ => Err(wrong_arguments("ST_SETSRID", "a point and an SRID")),
+    }
+}
+
+fn as_text(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [Value::Null] => Ok(Value::Null),
+        [point] => Ok(Value::Text(point_arg(point, "ST_ASTEXT")?.to_wkt())),
+        _ => Err(wrong_arguments("ST_ASTEXT", "one point")),
+    }
+}
+
+fn longitude(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [Value::Null] => Ok(Value::Null),
+        [point] => Ok(Value::Double(point_arg(point, "ST_X")?.lon)),
+        _ => Err(wrong_arguments("ST_X", "one point")),
+    }
+}
+
+fn latitude(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [Value::Null] => Ok(Value::Null),
+        [point] => Ok(Value::Double(point_arg(point, "ST_Y")?.lat)),
+        _ => Err(wrong_arguments("ST_Y", "one point")),
+    }
+}
+
+/// `ST_Distance(a, b)`, in meters
+fn st_distance(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [a, b] => sphere_distance(a, b, EARTH_RADIUS, "ST_DISTANCE"),
+        _ => Err(wrong_arguments("ST_DISTANCE", "two points")),
+    }
+}
+
+/// PostGIS's `ST_DistanceSphere(a, b[, radius])`
+fn st_distance_sphere(args: &[Value]) -> crate::Result<Value> {
+    distance_with_radius(args, EARTH_RADIUS, "ST_DISTANCESPHERE")
+}
+
+/// MySQL's `ST_Distance_Sphere(a, b[, radius])`
+fn mysql_distance_sphere(args: &[Value]) -> crate::Result<Value> {
+    distance_with_radius(args, MYSQL_EARTH_RADIUS, "ST_DISTANCE_SPHERE")
+}
+
+fn distance_with_radius(args: &[Value], default: f64, function: &str) -> crate::Result<Value> {
+    match args {
+        [a, b] => sphere_distance(a, b, default, function),
+        [_, _, Value::Null] => Ok(Value::Null),
+        [a, b, radius] => sphere_distance(a, b, number_arg(radius, function)?, function),
+        _ => Err(wrong_arguments(
+            function,
+            "two points and an optional radius",
+        )),
+    }
+}
+
+fn sphere_distance(a: &Value, b: &Value, radius: f64, function: &str) -> crate::Result<Value> {
+    if matches!(a, Value::Null) || matches!(b, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let (a, b) = (point_arg(a, function)?, point_arg(b, function)?);
+    Ok(Value::Double(a.distance(&b, radius)))
+}
+
+/// `ST_DWithin(a, b, meters)`
+fn within(args: &[Value]) -> crate::Result<Value> {
+    let [a, b, meters] = args else {
+        return Err(wrong_arguments("ST_DWITHIN", "two points and a distance"));
+    };
+    if args.iter().any(|arg| matches!(arg, Value::Null)) {
+        return Ok(Value::Null);
+    }
+    let (a, b) = (point_arg(a, "ST_DWITHIN")?, point_arg(b, "ST_DWITHIN")?);
+    let meters = number_arg(meters, "ST_DWITHIN")?;
+    Ok(Value::Boolean(a.distance(&b, EARTH_RADIUS) <= meters))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_points_parse_from_wkt() {
+        let amsterdam = Point::parse("POINT(4.8952 52.3702)").unwrap();
+        assert_eq!(amsterdam, Point::new(52.3702, 4.8952).unwrap());
+        assert_eq!(
+            Point::parse(" SRID=4326;point (4.8952 52.3702)").unwrap(),
+            amsterdam
+        );
+        assert_eq!(amsterdam.to_wkt(), "POINT(4.8952 52.3702)");
+
+        assert!(Point::parse("POINT(4.8952)").is_err());
+        assert!(Point::parse("LINESTRING(0 0, 1 1)").is_err());
+        assert!(Point::parse("POINT(200 10)").is_err());
+    }
+
+    #[test]
+    fn test_postgis_column_types_hold_points() {
+        for type_def in [
+            "GEOGRAPHY",
+            "geography(Point, 4326) NOT NULL",
+            "GEOMETRY(POINT)",
+            "geometry DEFAULT 'POINT(0 0)'",
+        ] {
+            assert_eq!(column_type(type_def).unwrap(), SqlType::Point);
+        }
+        assert_eq!(
+            column_type("geography(LineString, 4326)")
+                .unwrap_err()
+                .to_string(),
+            "Type conversion error: Only GEOGRAPHY(POINT) columns are supported, not GEOGRAPHY(LINESTRING)"
+        );
+        assert!(column_type("geometry(Point, 3857)").is_err());
+    }
+
+    #[test]
+    fn test_distances_match_the_engines() {
+        let point = |lon: f64, lat: f64| Value::Text(Point::new(lat, lon).unwrap().to_wkt());
+        let (amsterdam, paris) = (point(4.8952, 52.3702), point(2.3522, 48.8566));
+        let meters = |name: &str, args: &[Value]| match function(name).unwrap()(args).unwrap() {
+            Value::Double(meters) => meters,
+            other => panic!("{:?}", other),
+        };
+
+        // About 430 km apart
+        let postgres = meters("ST_Distance", &[amsterdam.clone(), paris.clone()]);
+        assert!((postgres - 429_860.0).abs() < 100.0, "{}", postgres);
+        let mysql = meters("ST_Distance_Sphere", &[amsterdam.clone(), paris.clone()]);
+        assert!((postgres - mysql) / postgres < 1e-5);
+
+        let within = function("ST_DWithin").unwrap();
+        let args = |meters: i64| [amsterdam.clone(), paris.clone(), Value::Integer(meters)];
+        assert_eq!(within(&args(500_000)).unwrap(), Value::Boolean(true));
+        assert_eq!(within(&args(400_000)).unwrap(), Value::Boolean(false));
+        assert_eq!(
+            function("ST_Distance").unwrap()(&[amsterdam, Value::Null]).unwrap(),
+            Value::Null
+        );
+    }
+}
@@ -0,0 +1,427 @@
+//! `GROUPING SETS`, `ROLLUP` and `CUBE`.
+//!
+//! A query grouped by several grouping sets runs as one plain GROUP BY per
+//! set, and the results are appended in the order PostgreSQL produces them:
+//! `ROLLUP(a, b)` groups by `(a, b)`, `(a)` and `()`, and `CUBE(a, b)` by
+//! `(a, b)`, `(a)`, `(b)` and `()`. Several elements in one GROUP BY combine
+//! into every pairing of their sets. In the run for a set, the grouping
+//! columns it leaves out read NULL, except inside aggregate arguments, and
+//! `GROUPING(a, b)` is a constant with a bit set for each argument the set
+//! leaves out, the last argument being the lowest bit.
+
+use sqlparser::ast::{
+    Expr, FunctionArg, FunctionArgExpr, FunctionArguments, GroupByExpr, GroupByWithModifier, Ident,
+    Query, Select, SelectItem, Value as SqlValue, VisitMut, VisitorMut,
+};
+use std::ops::ControlFlow;
+
+use crate::YamlBaseError;
+
+/// PostgreSQL's limits on the size of a CUBE and on the sets of one query
+const MAX_CUBE_ELEMENTS: usize = 12;
+const MAX_GROUPING_SETS: usize = 4096;
+
+pub(crate) struct GroupingSets {
+    sets: Vec<Vec<Expr>>,
+    /// Every expression grouped by in any of the sets
+    columns: Vec<Expr>,
+}
+
+impl GroupingSets {
+    /// The grouping sets of a SELECT, or `None` when it is grouped by plain
+    /// expressions only and never calls `GROUPING`
+    pub fn of(select: &Select) -> crate::Result<Option<Self>> {
+        let GroupByExpr::Expressions(exprs, modifiers) = &select.group_by else {
+            return Ok(None);
+        };
+        let nested = exprs.iter().any(|expr| {
+            matches!(
+                expr,
+                Expr::Rollup(_) | Expr::Cube(_) | Expr::GroupingSets(_)
+            )
+        });
+        let modifier = modifiers.iter().find(|modifier| {
+            matches!(
+                modifier,
+                GroupByWithModifier::Rollup | GroupByWithModifier::Cube
+            )
+        });
+        if !nested && modifier.is_none() && (exprs.is_empty() || !calls_grouping(select)) {
+            return Ok(None);
+        }
+
+        // MySQL's `GROUP BY a, b WITH ROLLUP` is `GROUP BY ROLLUP(a, b)`
+        let elements = match modifier {
+            Some(modifier) => {
+                let lists = exprs.iter().map(|expr| vec![expr.clone()]).collect();
+                match modifier {
+                    GroupByWithModifier::Cube => vec![Expr::Cube(lists)],
+                    _ => vec![Expr::Rollup(lists)],
+                }
+            }
+            None => exprs.clone(),
+        };
+
+        let mut sets = vec![vec![]];
+        for element in &elements {
+            let element_sets = element_sets(element)?;
+            sets = sets
+                .iter()
+                .flat_map(|set: &Vec<Expr>| {
+                    element_sets
+                        .iter()
+                        .map(move |extra| distinct([set.as_slice(), extra.as_slice()].concat()))
+                })
+                .collect();
+            if sets.len() > MAX_GROUPING_SETS {
+                return Err(YamlBaseError::Database {
+                    message: format!(
+                        "too many grouping sets present (maximum {})",
+                        MAX_GROUPING_SETS
+                    ),
+                });
+            }
+        }
+        let columns = distinct(sets.concat());
+        Ok(Some(Self { sets, columns }))
+    }
+
+    /// One SELECT per grouping set, grouped by that set alone.
+    /// `is_aggregate` tells the aggregate calls, whose arguments keep their
+    /// values.
+    pub fn selects(
+        &self,
+        select: &Select,
+        is_aggregate: fn(&Expr) -> bool,
+    ) -> crate::Result<Vec<Select>> {
+        self.sets
+            .iter()
+            .map(|set| {
+                let mut grouped = select.clone();
+                grouped.group_by = GroupByExpr::Expressions(set.clone(), vec![]);
+                let mut substitution = Substitution {
+                    set,
+                    columns: &self.columns,
+                    is_aggregate,
+                    aggregates: 0,
+                    queries: 0,
+                };
+                for item in &mut grouped.projection {
+                    substitution.substitute_item(item)?;
+                }
+                if let Some(having) = &mut grouped.having {
+                    substitution.substitute(having)?;
+                }
+                Ok(grouped)
+            })
+            .collect()
+    }
+}
+
+/// The grouping sets one element of a GROUP BY stands for
+fn element_sets(element: &Expr) -> crate::Result<Vec<Vec<Expr>>> {
+    Ok(match element {
+        Expr::Rollup(lists) => (0..=lists.len())
+            .rev()
+            .map(|len| lists[..len].concat())
+            .collect(),
+        Expr::Cube(lists) => {
+            if lists.len() > MAX_CUBE_ELEMENTS {
+                return Err(YamlBaseError::Database {
+                    message: format!("CUBE is limited to {} elements", MAX_CUBE_ELEMENTS),
+                });
+            }
+            // Subsets in the order of their bit masks, the first list being the highest bit
+            let len = lists.len();
+            (0..1usize << len)
+                .rev()
+                .map(|mask| {
+                    lists
+                        .iter()
+                        .enumerate()
+                        .filter(|(idx, _)| mask & (1 << (len - 1 - idx)) != 0)
+                        .flat_map(|(_, list)| list.clone())
+                        .collect()
+                })
+                .collect()
+        }
+        Expr::GroupingSets(lists) => lists.clone(),
+        expr => vec![vec![expr.clone()]],
+    })
+}
+
+fn distinct(exprs: Vec<Expr>) -> Vec<Expr> {
+    let mut unique: Vec<Expr> = Vec::with_capacity(exprs.len());
+    for expr in exprs {
+        if !unique.iter().any(|seen| same_expr(seen, &expr)) {
+            unique.push(expr);
+        }
+    }
+    unique
+}
+
+/// Whether two expressions name the same grouping column; a bare column
+/// matches a qualified one of the same name
+fn same_expr(a: &Expr, b: &Expr) -> bool {
+    match (a, b) {
+        (Expr::Identifier(a), Expr::Identifier(b)) => a.value.eq_ignore_ascii_case(&b.value),
+        (Expr::CompoundIdentifier(a), Expr::CompoundIdentifier(b)) => {
+            a.len() == b.len()
+                && a.iter()
+                    .zip(b)
+                    .all(|(a, b)| a.value.eq_ignore_ascii_case(&b.value))
+        }
+        (Expr::Identifier(ident), Expr::CompoundIdentifier(parts))
+        | (Expr::CompoundIdentifier(parts), Expr::Identifier(ident)) => parts
+            .last()
+            .is_some_and(|last| last.value.eq_ignore_ascii_case(&ident.value)),
+        (Expr::Nested(a), b) | (b, Expr::Nested(a)) => same_expr(a, b),
+        (a, b) => a == b,
+    }
+}
+
+/// The arguments of a `GROUPING(...)` call
+fn grouping_arguments(expr: &Expr) -> Option<Vec<&Expr>> {
+    let Expr::Function(func) = expr else {
+        return None;
+    };
+    let [name] = func.name.0.as_slice() else {
+        return None;
+    };
+    if !name.value.eq_ignore_ascii_case("grouping") || func.over.is_some() {
+        return None;
+    }
+    let FunctionArguments::List(list) = &func.args else {
+        return None;
+    };
+    list.args
+        .iter()
+        .map(|arg| match arg {
+            FunctionArg::Unnamed(FunctionArgExpr::Expr(expr)) => Some(expr),
+            _ => None,
+        })
+        .collect()
+}
+
+fn calls_grouping(select: &Select) -> bool {
+    let mut found = false;
+    let mut find = |expr: &Expr| {
+        found |= grouping_arguments(expr).is_some();
+        ControlFlow::<()>::Continue(())
+    };
+    let _ = sqlparser::ast::visit_expressions(&select.projection, &mut find);
+    let _ = sqlparser::ast::visit_expressions(&select.having, &mut find);
+    found
+}
+
+/// Rewrites the projection and HAVING clause of the run for one set
+struct Substitution<'a> {
+    set: &'a [Expr],
+    columns: &'a [Expr],
+    is_aggregate: fn(&Expr) -> bool,
+    /// Depth of aggregate calls and of subqueries around the visited expression
+    aggregates: usize,
+    queries: usize,
+}
+
+impl Substitution<'_> {
+    /// Substitute within a projected expression, keeping the output name of a
+    /// column or `GROUPING` call that turns into a constant
+    fn substitute_item(&mut self, item: &mut SelectItem) -> crate::Result<()> {
+        let SelectItem::UnnamedExpr(expr) = item else {
+            if let SelectItem::ExprWithAlias { expr, .. } = item {
+                self.substitute(expr)?;
+            }
+            return Ok(());
+        };
+        let name = match expr {
+            Expr::Identifier(ident) => Some(ident.clone()),
+            Expr::CompoundIdentifier(parts) => parts.last().cloned(),
+            expr if grouping_arguments(expr).is_some() => Some(Ident::new("grouping")),
+            _ => None,
+        };
+        self.substitute(expr)?;
+        if let (Some(alias), Expr::Value(_)) = (name, &*expr) {
+            *item = SelectItem::ExprWithAlias {
+                expr: expr.clone(),
+                alias,
+            };
+        }
+        Ok(())
+    }
+
+    fn substitute(&mut self, expr: &mut Expr) -> crate::Result<()> {
+        match expr.visit(self) {
+            ControlFlow::Break(error) => Err(error),
+            ControlFlow::Continue(()) => Ok(()),
+        }
+    }
+
+    fn grouped(&self, expr: &Expr) -> bool {
+        self.set.iter().any(|grouped| same_expr(grouped, expr))
+    }
+
+    fn is_aggregate_call(&self, expr: &Expr) -> bool {
+        matches!(expr, Expr::Function(_)) && (self.is_aggregate)(expr)
+    }
+}
+
+impl VisitorMut for Substitution<'_> {
+    type Break = YamlBaseError;
+
+    fn pre_visit_query(&mut self, _query: &mut Query) -> ControlFlow<YamlBaseError> {
+        self.queries += 1;
+        ControlFlow::Continue(())
+    }
+
+    fn post_visit_query(&mut self, _query: &mut Query) -> ControlFlow<YamlBaseError> {
+        self.queries -= 1;
+        ControlFlow::Continue(())
+    }
+
+    fn pre_visit_expr(&mut self, expr: &mut Expr) -> ControlFlow<YamlBaseError> {
+        if self.queries > 0 {
+            return ControlFlow::Continue(());
+        }
+        if let Some(arguments) = grouping_arguments(expr) {
+            if self.aggregates > 0 {
+                return ControlFlow::Break(YamlBaseError::Database {
+                    message: "aggregate function calls cannot contain GROUPING".to_string(),
+                });
+            }
+            if arguments.len() > 31 {
+                return ControlFlow::Break(YamlBaseError::Database {
+                    message: "GROUPING must have fewer than 32 arguments".to_string(),
+                });
+            }
+            let mut mask = 0u32;
+            for argument in &arguments {
+                if !self
+                    .columns
+                    .iter()
+                    .any(|column| same_expr(column, argument))
+                {
+                    return ControlFlow::Break(YamlBaseError::Database {
+                        message: "arguments to GROUPING must be grouping expressions of the associated query level".to_string(),
+                    });
+                }
+                mask = (mask << 1) | u32::from(!self.grouped(argument));
+            }
+            *expr = Expr::Value(SqlValue::Number(mask.to_string(), false));
+        } else if self.is_aggregate_call(expr) {
+            self.aggregates += 1;
+        } else if self.aggregates == 0
+            && self.columns.iter().any(|column| same_expr(column, expr))
+            && !self.grouped(expr)
+        {
+            *expr = Expr::Value(SqlValue::Null);
+        }
+        ControlFlow::Continue(())
+    }
+
+    fn post_visit_expr(&mut self, expr: &mut Expr) -> ControlFlow<YamlBaseError> {
+        if self.queries == 0 && self.is_aggregate_call(expr) {
+            self.aggregates -= 1;
+        }
+        ControlFlow::Continue(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parse_sql;
+    use sqlparser::ast::{SetExpr, Statement};
+
+    fn select(sql: &str) -> Select {
+        let Statement::Query(query) = parse_sql(sql).unwrap().remove(0) else {
+            panic!("not a query");
+        };
+        let SetExpr::Select(select) = *query.body else {
+            panic!("not a select");
+        };
+        *select
+    }
+
+    fn sets(sql: &str) -> Vec<String> {
+        GroupingSets::of(&select(sql))
+            .unwrap()
+            .unwrap()
+            .sets
+            .iter()
+            .map(|set| {
+                set.iter()
+                    .map(|expr| expr.to_string())
+                    .collect::<Vec<_>>()
+                    .join(",")
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_grouping_sets_expand_in_postgres_order() {
+        assert_eq!(
+            sets("SELECT 1 FROM t GROUP BY ROLLUP(a, b)"),
+            ["a,b", "a", ""]
+        );
+        assert_eq!(
+            sets("SELECT 1 FROM t GROUP BY CUBE(a, b)"),
+            ["a,b", "a", "b", ""]
+        );
+        assert_eq!(
+            sets("SELECT 1 FROM t GROUP BY a, GROUPING SETS ((b), (c), ())"),
+            ["a,b", "a,c", "a"]
+        );
+        assert_eq!(
+            sets("SELECT 1 FROM t GROUP BY ROLLUP((a, b), c)"),
+            ["a,b,c", "a,b", ""]
+        );
+        assert!(
+            GroupingSets::of(&select("SELECT a FROM t GROUP BY a"))
+                .unwrap()
+                .is_none()
+        );
+    }
+
+    #[test]
+    fn test_ungrouped_columns_read_null_outside_aggregates() {
+        let query = select(
+            "SELECT region, t.category, SUM(amount), COUNT(region), GROUPING(region, category) \
+             FROM t GROUP BY ROLLUP(region, category) HAVING GROUPING(category) = 1",
+        );
+        let sets = GroupingSets::of(&query).unwrap().unwrap();
+        let selects = sets
+            .selects(
+                &query,
+                |expr| matches!(expr, Expr::Function(f) if f.name.to_string() != "GROUPING"),
+            )
+            .unwrap();
+        let projections: Vec<String> = selects
+            .iter()
+            .map(|select| {
+                select
+                    .projection
+                    .iter()
+                    .map(|item| item.to_string())
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            })
+            .collect();
+        assert_eq!(
+            projections,
+            [
+                "region, t.category, SUM(amount), COUNT(region), 0 AS grouping",
+                "region, NULL AS category, SUM(amount), COUNT(region), 1 AS grouping",
+                "NULL AS region, NULL AS category, SUM(amount), COUNT(region), 3 AS grouping",
+            ]
+        );
+        assert_eq!(selects[0].having.as_ref().unwrap().to_string(), "0 = 1");
+        assert!(
+            matches!(&selects[2].group_by, GroupByExpr::Expressions(exprs, _) if exprs.is_empty())
+        );
+
+        let invalid = select("SELECT GROUPING(amount) FROM t GROUP BY ROLLUP(region)");
+        let sets = GroupingSets::of(&invalid).unwrap().unwrap();
+        assert!(sets.selects(&invalid, |_| false).is_err());
+    }
+}
@@ -0,0 +1,439 @@
+//! PostgreSQL `hstore` columns: flat maps from text keys to text values or
+//! NULL, written in YAML as mappings.
+//!
+//! A value is kept in hstore's own text form, `"size"=>"M", "color"=>NULL`,
+//! which is what PostgreSQL sends clients, with the keys in PostgreSQL's
+//! output order: shorter keys first, then by their bytes. The operators are
+//! the ones hstore queries lean on: `->` to read a key, `?`, `?&` and `?|` to
+//! test for keys, and `@>` / `<@` for containment. JSON documents share
+//! them, along with `->>`, `#>` and `#>>`; see [`crate::sql::json`]. So do
+//! arrays for `@>` and `<@`; see [`crate::sql::array`].
+
+use sqlparser::ast::{BinaryOperator, Expr};
+use std::collections::BTreeMap;
+use std::iter::Peekable;
+use std::str::Chars;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+use crate::sql::{array, json};
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Hstore {
+    entries: BTreeMap<String, Option<String>>,
+}
+
+impl FromIterator<(String, Option<String>)> for Hstore {
+    fn from_iter<I: IntoIterator<Item = (String, Option<String>)>>(iter: I) -> Self {
+        let mut entries = BTreeMap::new();
+        for (key, value) in iter {
+            // Like PostgreSQL, the first of duplicate keys is kept
+            entries.entry(key).or_insert(value);
+        }
+        Self { entries }
+    }
+}
+
+impl Hstore {
+    /// Parse hstore text such as `a=>1, "b c"=>"x", d=>NULL`
+    pub fn parse(text: &str) -> crate::Result<Self> {
+        let invalid = |reason: &str| {
+            YamlBaseError::TypeConversion(format!("Cannot parse hstore {:?}: {}", text, reason))
+        };
+        let mut chars = text.chars().peekable();
+        let mut entries = Vec::new();
+        loop {
+            skip_whitespace(&mut chars);
+            if chars.peek().is_none() {
+                break;
+            }
+            let key = match token(&mut chars).map_err(invalid)? {
+                Token::Quoted(key) | Token::Bare(key) => key,
+            };
+            skip_whitespace(&mut chars);
+            if chars.next() != Some('=') || chars.next() != Some('>') {
+                return Err(invalid("expected => after a key"));
+            }
+            skip_whitespace(&mut chars);
+            let value = match token(&mut chars).map_err(invalid)? {
+                Token::Bare(value) if value.eq_ignore_ascii_case("NULL") => None,
+                Token::Quoted(value) | Token::Bare(value) => Some(value),
+            };
+            entries.push((key, value));
+            skip_whitespace(&mut chars);
+            match chars.next() {
+                None => break,
+                Some(',') => {}
+                Some(_) => return Err(invalid("expected a comma between pairs")),
+            }
+        }
+        Ok(entries.into_iter().collect())
+    }
+
+    pub fn from_value(value: &Value) -> crate::Result<Self> {
+        match value {
+            Value::Text(text) => Self::parse(text),
+            other => Err(YamlBaseError::Database {
+                message: format!("Expected an hstore, got {:?}", other),
+            }),
+        }
+    }
+
+    pub fn get(&self, key: &str) -> Option<&str> {
+        self.entries.get(key).and_then(|value| value.as_deref())
+    }
+
+    pub fn contains_key(&self, key: &str) -> bool {
+        self.entries.contains_key(key)
+    }
+
+    /// Whether every pair of `other` is also in this hstore
+    pub fn contains(&self, other: &Hstore) -> bool {
+        other
+            .entries
+            .iter()
+            .all(|(key, value)| self.entries.get(key) == Some(value))
+    }
+
+    /// The pairs in PostgreSQL's output order
+    pub fn entries(&self) -> Vec<(&str, Option<&str>)> {
+        let mut entries: Vec<_> = self
+            .entries
+            .iter()
+            .map(|(key, value)| (key.as_str(), value.as_deref()))
+            .collect();
+        entries.sort_by(|(a, _), (b, _)| a.len().cmp(&b.len()).then_with(|| a.cmp(b)));
+        entries
+    }
+
+    pub fn to_text(&self) -> String {
+        let quote = |s: &str| format!("\"{}\"", s.replace('\\', "\\\\").replace('"', "\\\""));
+        self.entries()
+            .into_iter()
+            .map(|(key, value)| match value {
+                Some(value) => format!("{}=>{}", quote(key), quote(value)),
+                None => format!("{}=>NULL", quote(key)),
+            })
+            .collect::<Vec<_>>()
+            .join(", ")
+    }
+}
+
+enum Token {
+    Quoted(String),
+    Bare(String),
+}
+
+fn skip_whitespace(chars: &mut Peekable<Chars>) {
+    while chars.next_if(|c| c.is_whitespace()).is_some() {}
+}
+
+fn token(chars: &mut Peekable<Chars>) -> Result<Token, &'static str> {
+    if chars.next_if_eq(&'"').is_some() {
+        let mut text = String::new();
+        loop {
+            match chars.next() {
+                Some('"') => return Ok(Token::Quoted(text)),
+                Some('\\') => text.push(chars.next().ok_or("unterminated quote")?),
+                Some(c) => text.push(c),
+                None => return Err("unterminated quote"),
+            }
+        }
+    }
+    let mut text = String::new();
+    while let Some(c) = chars.next_if(|c| !c.is_whitespace() && !matches!(c, ',' | '=' | '"')) {
+        text.push(c);
+    }
+    if text.is_empty() {
+        Err("expected a key or value")
+    } else {
+        Ok(Token::Bare(text))
+    }
+}
+
+/// Whether a cast target such as `::hstore` names the hstore type
+pub(crate) fn is_hstore_type(name: &str) -> bool {
+    name.eq_ignore_ascii_case("HSTORE")
+}
+
+/// Cast a value to hstore, bringing its text to the canonical form
+pub(crate) fn cast(value: Value) -> crate::Result<Value> {
+    match value {
+        Value::Null => Ok(Value::Null),
+        value => Ok(Value::Text(Hstore::from_value(&value)?.to_text())),
+    }
+}
+
+/// An hstore, JSON or array operator found in an expression, with the
+/// operands its caller still has to evaluate. `ARRAY[...]` constructors and
+/// `ANY` / `ALL` over an array column are evaluated here as well.
+pub(crate) struct HstoreOp<'a> {
+    /// The hstore, document or array first, then the key, the keys or path
+    /// of an `ARRAY[...]`, or the value it is compared with; the elements of
+    /// a constructor; or the value compared with an array's elements, then
+    /// the array
+    pub operands: Vec<&'a Expr>,
+    op: Op,
+}
+
+enum Op {
+    Get,
+    GetText,
+    GetPath,
+    GetPathText,
+    HasKey,
+    HasAllKeys,
+    HasAnyKey,
+    Contains,
+    ContainedBy,
+    Construct,
+    Any(BinaryOperator),
+    All(BinaryOperator),
+}
+
+impl<'a> HstoreOp<'a> {
+    pub fn of(expr: &'a Expr) -> Option<Self> {
+        match expr {
+            Expr::Array(array) => {
+                let mut operands = Vec::new();
+                flatten(&array.elem, &mut operands);
+                return Some(Self {
+                    operands,
+                    op: Op::Construct,
+                });
+            }
+            Expr::AnyOp {
+                left,
+                compare_op,
+                right,
+                ..
+            } => {
+                return Some(Self {
+                    operands: vec![&**left, &**right],
+                    op: Op::Any(compare_op.clone()),
+                });
+            }
+            Expr::AllOp {
+                left,
+                compare_op,
+                right,
+            } => {
+                return Some(Self {
+                    operands: vec![&**left, &**right],
+                    op: Op::All(compare_op.clone()),
+                });
+            }
+            _ => {}
+        }
+        let Expr::BinaryOp { left, op, right } = expr else {
+            return None;
+        };
+        let op = match op {
+            BinaryOperator::Arrow => Op::Get,
+            BinaryOperator::LongArrow => Op::GetText,
+            BinaryOperator::HashArrow => Op::GetPath,
+            BinaryOperator::HashLongArrow => Op::GetPathText,
+            BinaryOperator::Question => Op::HasKey,
+            BinaryOperator::QuestionAnd => Op::HasAllKeys,
+            BinaryOperator::QuestionPipe => Op::HasAnyKey,
+            BinaryOperator::AtArrow => Op::Contains,
+            BinaryOperator::ArrowAt => Op::ContainedBy,
+            _ => return None,
+        };
+        let mut operands = vec![&**left];
+        match (&op, &**right) {
+            (
+                Op::HasAllKeys | Op::HasAnyKey | Op::GetPath | Op::GetPathText,
+                Expr::Array(array),
+            ) => operands.extend(&array.elem),
+            (_, right) => operands.push(right),
+        }
+        Some(Self { operands, op })
+    }
+
+    /// Apply the operator to the evaluated operands, giving NULL for a NULL
+    /// hstore, document or key
+    pub fn evaluate(&self, values: &[Value]) -> crate::Result<Value> {
+        match (&self.op, values) {
+            (Op::Construct, elements) => return Ok(Value::Text(array::format(elements))),
+            (Op::Any(op), [left, elements]) => {
+                return array::compare_each(left, op, elements, false);
+            }
+            (Op::All(op), [left, elements]) => {
+                return array::compare_each(left, op, elements, true);
+            }
+            _ => {}
+        }
+        let Some((hstore, rest)) = values.split_first() else {
+            return Ok(Value::Null);
+        };
+        if matches!(hstore, Value::Null) || matches!(rest, [Value::Null]) {
+            return Ok(Value::Null);
+        }
+        match (&self.op, hstore, rest) {
+            (Op::Contains, Value::Text(text), [other]) if array::is_literal(text) => {
+                return Ok(Value::Boolean(array::contains(hstore, other)?));
+            }
+            (Op::ContainedBy, Value::Text(text), [other]) if array::is_literal(text) => {
+                return Ok(Value::Boolean(array::contains(other, hstore)?));
+            }
+            _ => {}
+        }
+        let json_only = matches!(self.op, Op::GetText | Op::GetPath | Op::GetPathText);
+        if json_only || matches!(hstore, Value::Json(_)) {
+            return self.evaluate_json(&json::document(hstore)?, rest);
+        }
+        let hstore = Hstore::from_value(hstore)?;
+        Ok(match (&self.op, rest) {
+            (Op::Get, [key]) => hstore
+                .get(&key.to_string())
+                .map_or(Value::Null, |value| Value::Text(value.to_string())),
+            (Op::HasKey, [key]) => Value::Boolean(hstore.contains_key(&key.to_string())),
+            (Op::HasAllKeys, keys) => {
+                Value::Boolean(text_array(keys).iter().all(|key| hstore.contains_key(key)))
+            }
+            (Op::HasAnyKey, keys) => {
+                Value::Boolean(text_array(keys).iter().any(|key| hstore.contains_key(key)))
+            }
+            (Op::Contains, [other]) => Value::Boolean(hstore.contains(&Hstore::from_value(other)?)),
+            (Op::ContainedBy, [other]) => {
+                Value::Boolean(Hstore::from_value(other)?.contains(&hstore))
+            }
+            _ => {
+                return Err(YamlBaseError::Database {
+                    message: "hstore operator expects a single right operand".to_string(),
+                });
+            }
+        })
+    }
+}
+
+impl HstoreOp<'_> {
+    fn evaluate_json(&self, document: &serde_json::Value, rest: &[Value]) -> crate::Result<Value> {
+        Ok(match (&self.op, rest) {
+            (Op::Get, [key]) => json::json_value(json::get(document, key)?),
+            (Op::GetText, [key]) => json::text_value(json::get(document, key)?),
+            (Op::GetPath, path) => json::json_value(json::get_path(document, &text_array(path))),
+            (Op::GetPathText, path) => {
+                json::text_value(json::get_path(document, &text_array(path)))
+            }
+            (Op::HasKey, [key]) => Value::Boolean(json::has_key(document, &key.to_string())),
+            (Op::HasAllKeys, keys) => Value::Boolean(
+                text_array(keys)
+                    .iter()
+                    .all(|key| json::has_key(document, key)),
+            ),
+            (Op::HasAnyKey, keys) => Value::Boolean(
+                text_array(keys)
+                    .iter()
+                    .any(|key| json::has_key(document, key)),
+            ),
+            (Op::Contains, [other]) => {
+                Value::Boolean(json::contains(document, &json::document(other)?))
+            }
+            (Op::ContainedBy, [other]) => {
+                Value::Boolean(json::contains(&json::document(other)?, document))
+            }
+            _ => {
+                return Err(YamlBaseError::Database {
+                    message: "JSON operator expects a single right operand".to_string(),
+                });
+            }
+        })
+    }
+}
+
+/// The elements of `ARRAY[...]` constructors, nested ones flattened
+fn flatten<'a>(elements: &'a [Expr], operands: &mut Vec<&'a Expr>) {
+    for element in elements {
+        match element {
+            Expr::Array(array) => flatten(&array.elem, operands),
+            element => operands.push(element),
+        }
+    }
+}
+
+/// The keys of an `ARRAY['a', 'b']` or of a `'{a,b}'` array literal, NULLs left out
+fn text_array(values: &[Value]) -> Vec<String> {
+    match values {
+        [Value::Text(text)] if text.starts_with('{') && text.ends_with('}') => text
+            [1..text.len() - 1]
+            .split(',')
+            .map(|key| key.trim().trim_matches('"').to_string())
+            .filter(|key| !key.is_empty())
+            .collect(),
+        values => values
+            .iter()
+            .filter(|value| !matches!(value, Value::Null))
+            .map(ToString::to_string)
+            .collect(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parser::parse_expr;
+
+    fn apply(sql: &str, values: &[Value]) -> Value {
+        let expr = parse_expr(sql).unwrap();
+        HstoreOp::of(&expr).unwrap().evaluate(values).unwrap()
+    }
+
+    #[test]
+    fn test_hstore_text_round_trips() {
+        let hstore =
+            Hstore::parse(r#"color => red, "size"=>"XL", "a \"b\""=>NULL, k=>"""#).unwrap();
+        assert_eq!(hstore.get("color"), Some("red"));
+        assert_eq!(hstore.get("a \"b\""), None);
+        assert!(hstore.contains_key("a \"b\""));
+        assert_eq!(
+            hstore.to_text(),
+            r#""k"=>"", "size"=>"XL", "a \"b\""=>NULL, "color"=>"red""#
+        );
+        assert_eq!(Hstore::parse(&hstore.to_text()).unwrap(), hstore);
+        assert_eq!(Hstore::parse("").unwrap(), Hstore::default());
+        assert!(Hstore::parse("a=>1 b=>2").is_err());
+        assert!(Hstore::parse("a=>\"1").is_err());
+    }
+
+    #[test]
+    fn test_hstore_operators() {
+        let attrs = Value::Text(r#""size"=>"M", "color"=>"red", "note"=>NULL"#.to_string());
+        let text = |s: &str| Value::Text(s.to_string());
+
+        assert_eq!(
+            apply("a -> b", &[attrs.clone(), text("color")]),
+            text("red")
+        );
+        assert_eq!(apply("a -> b", &[attrs.clone(), text("note")]), Value::Null);
+        assert_eq!(apply("a -> b", &[Value::Null, text("x")]), Value::Null);
+        assert_eq!(
+            apply("a ? b", &[attrs.clone(), text("note")]),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            apply(
+                "a ?& ARRAY[b, c]",
+                &[attrs.clone(), text("size"), text("x")]
+            ),
+            Value::Boolean(false)
+        );
+        assert_eq!(
+            apply("a ?| b", &[attrs.clone(), text("{x,size}")]),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            apply("a @> b", &[attrs.clone(), text("color=>red, size=>M")]),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            apply("a @> b", &[attrs.clone(), text("color=>blue")]),
+            Value::Boolean(false)
+        );
+        assert_eq!(
+            apply("a <@ b", &[text("size=>M"), attrs]),
+            Value::Boolean(true)
+        );
+    }
+}
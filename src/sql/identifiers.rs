@@ -0,0 +1,262 @@
+//! How long identifiers may be.
+//!
+//! PostgreSQL cuts identifiers longer than 63 bytes as it reads a statement,
+//! wherever they appear, and sends a NOTICE saying so: `SELECT id AS <a
+//! 70-byte alias>` returns a column named by the alias's first 63 bytes, and
+//! a table created with a long name is found again by the same long name.
+//! ORMs that build join aliases out of table and column names rely on this
+//! to bind result columns. MySQL instead refuses table, column and index
+//! names longer than 64 characters with error 1059; column aliases there may
+//! be longer. `--max-identifier-length` sets another limit for either.
+
+use sqlparser::ast::{AlterTableOperation, ObjectName, Statement, visit_relations};
+use std::borrow::Cow;
+use std::ops::ControlFlow;
+
+/// PostgreSQL's `NAMEDATALEN - 1`, in bytes
+pub const POSTGRES_MAX_IDENTIFIER_LENGTH: usize = 63;
+
+/// MySQL's limit on table, column and index names, in characters
+pub const MYSQL_MAX_IDENTIFIER_LENGTH: usize = 64;
+
+/// `sql` with every identifier, quoted or not, longer than `limit` bytes cut
+/// to at most `limit` without splitting a character, and the notice
+/// PostgreSQL gives for each one cut. String literals, comments and dollar
+/// quoted text are left alone.
+pub(crate) fn truncate(sql: &str, limit: usize) -> (Cow<'_, str>, Vec<String>) {
+    let bytes = sql.as_bytes();
+    let mut truncated = String::new();
+    let mut copied = 0;
+    let mut notices = Vec::new();
+    let mut cut = |start: usize, end: usize, replacement: String, notice: String| {
+        truncated.push_str(&sql[copied..start]);
+        truncated.push_str(&replacement);
+        copied = end;
+        notices.push(notice);
+    };
+
+    let mut pos = 0;
+    while pos < bytes.len() {
+        match bytes[pos] {
+            b'\'' => {
+                // `E'...'` strings escape quotes with backslashes as well
+                let escapes = pos > 0 && bytes[pos - 1].eq_ignore_ascii_case(&b'e');
+                pos += 1;
+                while pos < bytes.len() {
+                    match bytes[pos] {
+                        b'\\' if escapes => pos += 1,
+                        b'\'' if bytes.get(pos + 1) == Some(&b'\'') => pos += 1,
+                        b'\'' => break,
+                        _ => {}
+                    }
+                    pos += 1;
+                }
+                pos += 1;
+            }
+            b'"' => {
+                let start = pos;
+                pos += 1;
+                while pos < bytes.len() {
+                    if bytes[pos] == b'"' {
+                        if bytes.get(pos + 1) == Some(&b'"') {
+                            pos += 1;
+                        } else {
+                            break;
+                        }
+                    }
+                    pos += 1;
+                }
+                let end = (pos + 1).min(bytes.len());
+                let name = sql[start + 1..pos.min(bytes.len())].replace("\"\"", "\"");
+                if name.len() > limit {
+                    let short = clip(&name, limit);
+                    let quoted = format!("\"{}\"", short.replace('"', "\"\""));
+                    cut(start, end, quoted, notice(&name, short));
+                }
+                pos = end;
+            }
+            b'-' if bytes.get(pos + 1) == Some(&b'-') => {
+                while pos < bytes.len() && bytes[pos] != b'\n' {
+                    pos += 1;
+                }
+            }
+            b'/' if bytes.get(pos + 1) == Some(&b'*') => {
+                pos = sql[pos + 2..]
+                    .find("*/")
+                    .map_or(bytes.len(), |end| pos + 2 + end + 2);
+            }
+            b'$' => {
+                // `$tag$ ... $tag$`, but not a `$1` parameter
+                let tag_end = sql[pos + 1..]
+                    .find(|c: char| !(c.is_alphanumeric() || c == '_'))
+                    .map(|len| pos + 1 + len);
+                match tag_end.filter(|&end| {
+                    bytes[end] == b'$'
+                        && !bytes[pos + 1..end].first().is_some_and(u8::is_ascii_digit)
+                }) {
+                    Some(tag_end) => {
+                        let tag = &sql[pos..=tag_end];
+                        pos = sql[tag_end + 1..]
+                            .find(tag)
+                            .map_or(bytes.len(), |end| tag_end + 1 + end + tag.len());
+                    }
+                    None => pos += 1 + word_len(&bytes[pos + 1..]),
+                }
+            }
+            // Numbers such as `1e10` are not identifiers
+            b'0'..=b'9' => pos += word_len(&bytes[pos..]),
+            b if b == b'_' || b.is_ascii_alphabetic() || b >= 0x80 => {
+                let start = pos;
+                pos += word_len(&bytes[pos..]);
+                let name = &sql[start..pos];
+                if name.len() > limit {
+                    let short = clip(name, limit);
+                    cut(start, pos, short.to_string(), notice(name, short));
+                }
+            }
+            _ => pos += 1,
+        }
+    }
+
+    if notices.is_empty() {
+        return (Cow::Borrowed(sql), notices);
+    }
+    truncated.push_str(&sql[copied.min(sql.len())..]);
+    (Cow::Owned(truncated), notices)
+}
+
+/// Check, as MySQL does, that the tables a statement names and the columns
+/// and indexes it creates or renames have names of at most `limit`
+/// characters, giving the first name that is too long
+pub(crate) fn too_long(statement: &Statement, limit: usize) -> Option<String> {
+    let long = |name: &str| name.chars().count() > limit;
+    let in_object = |name: &ObjectName| {
+        name.0
+            .iter()
+            .find(|ident| long(&ident.value))
+            .map(|ident| ident.value.clone())
+    };
+
+    let relation = visit_relations(statement, |name| match in_object(name) {
+        Some(ident) => ControlFlow::Break(ident),
+        None => ControlFlow::Continue(()),
+    });
+    if let ControlFlow::Break(ident) = relation {
+        return Some(ident);
+    }
+    let mut created = Vec::new();
+    match statement {
+        Statement::CreateTable(create) => created.extend(
+            create
+                .columns
+                .iter()
+                .map(|column| column.name.value.clone()),
+        ),
+        Statement::CreateIndex(create) => {
+            created.extend(create.name.as_ref().and_then(in_object));
+        }
+        Statement::AlterTable { operations, .. } => {
+            for operation in operations {
+                match operation {
+                    AlterTableOperation::AddColumn { column_def, .. } => {
+                        created.push(column_def.name.value.clone())
+                    }
+                    AlterTableOperation::RenameColumn {
+                        new_column_name, ..
+                    } => created.push(new_column_name.value.clone()),
+                    AlterTableOperation::RenameTable { table_name } => {
+                        created.extend(in_object(table_name))
+                    }
+                    _ => {}
+                }
+            }
+        }
+        _ => {}
+    }
+    created.into_iter().find(|name| long(name))
+}
+
+/// The length of the identifier characters at the start of `bytes`
+fn word_len(bytes: &[u8]) -> usize {
+    bytes
+        .iter()
+        .take_while(|b| b.is_ascii_alphanumeric() || **b == b'_' || **b == b'$' || **b >= 0x80)
+        .count()
+}
+
+/// The longest start of `name` of at most `limit` bytes that ends at a
+/// character boundary
+fn clip(name: &str, limit: usize) -> &str {
+    let mut end = limit.min(name.len());
+    while !name.is_char_boundary(end) {
+        end -= 1;
+    }
+    &name[..end]
+}
+
+fn notice(name: &str, short: &str) -> String {
+    format!("identifier \"{}\" will be truncated to \"{}\"", name, short)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parse_sql;
+
+    #[test]
+    fn test_long_identifiers_are_cut_as_postgres_reads_them() {
+        let long = "a".repeat(70);
+        let short = "a".repeat(63);
+
+        let sql = "SELECT u.id AS LONG, \"LONG\" FROM users u WHERE name = 'LONG' -- LONG";
+        let (truncated, notices) =
+            truncate(&sql.replace("LONG", &long), POSTGRES_MAX_IDENTIFIER_LENGTH);
+        let expected = "SELECT u.id AS SHORT, \"SHORT\" FROM users u WHERE name = 'LONG' -- LONG";
+        assert_eq!(
+            truncated,
+            expected.replace("SHORT", &short).replace("LONG", &long)
+        );
+        assert_eq!(notices.len(), 2);
+        assert_eq!(
+            notices[0],
+            format!("identifier \"{}\" will be truncated to \"{}\"", long, short)
+        );
+
+        // Characters are not split, and statements without long identifiers
+        // are left as they are
+        let accented = format!("SELECT 1 AS {}é", "a".repeat(62));
+        let (truncated, _) = truncate(&accented, POSTGRES_MAX_IDENTIFIER_LENGTH);
+        assert_eq!(truncated, format!("SELECT 1 AS {}", "a".repeat(62)));
+        let sql =
+            "SELECT $1, $body$ LONG $body$, E'it\\'s LONG', 1e10 FROM t".replace("LONG", &long);
+        let (truncated, notices) = truncate(&sql, POSTGRES_MAX_IDENTIFIER_LENGTH);
+        assert!(matches!(truncated, Cow::Borrowed(_)));
+        assert!(notices.is_empty());
+    }
+
+    #[test]
+    fn test_mysql_refuses_long_names() {
+        let statement = |sql: &str| parse_sql(sql).unwrap().remove(0);
+        let long = "t".repeat(65);
+
+        let create = statement(&format!("CREATE TABLE {} (id INT)", long));
+        assert_eq!(
+            too_long(&create, MYSQL_MAX_IDENTIFIER_LENGTH),
+            Some(long.clone())
+        );
+        let column = statement(&format!("CREATE TABLE t (id INT, {} TEXT)", long));
+        assert_eq!(
+            too_long(&column, MYSQL_MAX_IDENTIFIER_LENGTH),
+            Some(long.clone())
+        );
+        let select = statement(&format!("SELECT * FROM {}", long));
+        assert_eq!(
+            too_long(&select, MYSQL_MAX_IDENTIFIER_LENGTH),
+            Some(long.clone())
+        );
+
+        // Column aliases may be longer
+        let alias = statement(&format!("SELECT id AS {} FROM t", long));
+        assert_eq!(too_long(&alias, MYSQL_MAX_IDENTIFIER_LENGTH), None);
+    }
+}
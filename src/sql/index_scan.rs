@@ -0,0 +1,338 @@
+//! Index scans: the rows a WHERE clause can match, found through the table's
+//! indexes rather than by reading every row.
+//!
+//! The clause's AND-ed conditions on single columns are looked up: `=` and
+//! `IN` with literals, and for a btree index `BETWEEN`, `<`, `<=`, `>` and
+//! `>=` on its first column. A hash index needs an equality on each of its
+//! columns, a btree index one on a leading prefix. Literals are converted the
+//! way a comparison converts them, so `placed_on = '2024-01-31'` finds the
+//! rows of a date column; a literal the column's type cannot hold, such as
+//! the number in `zip = 1000` against text, leaves the condition to the scan.
+//! When several indexes apply, the one finding the fewest rows is used. The
+//! rows found are candidates: the caller still evaluates the whole clause on
+//! each of them.
+
+use sqlparser::ast::{BinaryOperator, Expr};
+use std::collections::HashMap;
+use std::ops::Bound;
+
+use crate::database::{Index, Table, Value};
+use crate::sql::coercion;
+
+/// What the conditions say about one column
+#[derive(Default)]
+struct Restriction {
+    /// The values `=` or `IN` allows
+    values: Option<Vec<Value>>,
+    /// Bounds, each with whether it is inclusive
+    lower: Option<(Value, bool)>,
+    upper: Option<(Value, bool)>,
+}
+
+/// Positions of the rows of `table` that may satisfy `selection`, in table
+/// order, or `None` when no index applies. `literal` gives the value of an
+/// operand that is a constant.
+pub(crate) fn candidates<F>(table: &Table, selection: &Expr, literal: F) -> Option<Vec<usize>>
+where
+    F: Fn(&Expr) -> Option<Value>,
+{
+    let indexes: Vec<&Index> = table
+        .indexes
+        .iter()
+        .filter(|index| index.covers(table.rows.len()))
+        .collect();
+    if indexes.is_empty() {
+        return None;
+    }
+
+    let mut conditions = Vec::new();
+    conjuncts(selection, &mut conditions);
+    let mut restrictions: HashMap<usize, Restriction> = HashMap::new();
+    for condition in conditions {
+        restrict(table, condition, &literal, &mut restrictions);
+    }
+    if restrictions.is_empty() {
+        return None;
+    }
+
+    let mut rows = indexes
+        .into_iter()
+        .filter_map(|index| lookup(table, index, &restrictions))
+        .min_by_key(Vec::len)?;
+    rows.sort_unstable();
+    rows.dedup();
+    Some(rows)
+}
+
+fn conjuncts<'a>(expr: &'a Expr, conditions: &mut Vec<&'a Expr>) {
+    match expr {
+        Expr::BinaryOp {
+            left,
+            op: BinaryOperator::And,
+            right,
+        } => {
+            conjuncts(left, conditions);
+            conjuncts(right, conditions);
+        }
+        Expr::Nested(inner) => conjuncts(inner, conditions),
+        expr => conditions.push(expr),
+    }
+}
+
+/// Record what a condition says about its column, if it is one an index can
+/// look up. A column restricted twice keeps the first restriction, which
+/// still finds every row the clause matches.
+fn restrict<F>(
+    table: &Table,
+    condition: &Expr,
+    literal: &F,
+    restrictions: &mut HashMap<usize, Restriction>,
+) where
+    F: Fn(&Expr) -> Option<Value>,
+{
+    let value_of = |column: usize, expr: &Expr| {
+        literal(expr)
+            .and_then(|value| coercion::compared_as(&value, &table.columns[column].sql_type))
+    };
+    match condition {
+        Expr::BinaryOp { left, op, right } => {
+            let Some(reversed) = flipped(op) else {
+                return;
+            };
+            let (column, operand, op) = match (column_of(table, left), column_of(table, right)) {
+                (Some(column), None) => (column, right, op.clone()),
+                (None, Some(column)) => (column, left, reversed),
+                _ => return,
+            };
+            let Some(value) = value_of(column, operand) else {
+                return;
+            };
+            let restriction = restrictions.entry(column).or_default();
+            match op {
+                BinaryOperator::Eq => {
+                    restriction.values.get_or_insert_with(|| vec![value]);
+                }
+                BinaryOperator::Gt => {
+                    restriction.lower.get_or_insert((value, false));
+                }
+                BinaryOperator::GtEq => {
+                    restriction.lower.get_or_insert((value, true));
+                }
+                BinaryOperator::Lt => {
+                    restriction.upper.get_or_insert((value, false));
+                }
+                BinaryOperator::LtEq => {
+                    restriction.upper.get_or_insert((value, true));
+                }
+                _ => {}
+            }
+        }
+        Expr::InList {
+            expr,
+            list,
+            negated: false,
+        } => {
+            let Some(column) = column_of(table, expr) else {
+                return;
+            };
+            let Some(values) = list
+                .iter()
+                .map(|item| value_of(column, item))
+                .collect::<Option<Vec<_>>>()
+            else {
+                return;
+            };
+            let restriction = restrictions.entry(column).or_default();
+            restriction.values.get_or_insert(values);
+        }
+        Expr::Between {
+            expr,
+            negated: false,
+            low,
+            high,
+        } => {
+            let Some(column) = column_of(table, expr) else {
+                return;
+            };
+            let (Some(low), Some(high)) = (value_of(column, low), value_of(column, high)) else {
+                return;
+            };
+            let restriction = restrictions.entry(column).or_default();
+            restriction.lower.get_or_insert((low, true));
+            restriction.upper.get_or_insert((high, true));
+        }
+        _ => {}
+    }
+}
+
+/// The position of the column an operand names, bare or qualified by the
+/// table's name
+fn column_of(table: &Table, expr: &Expr) -> Option<usize> {
+    match expr {
+        Expr::Identifier(ident) => table.get_column_index(&ident.value),
+        Expr::CompoundIdentifier(parts) if parts.len() == 2 => {
+            if parts[0].value.eq_ignore_ascii_case(&table.name) {
+                table.get_column_index(&parts[1].value)
+            } else {
+                None
+            }
+        }
+        _ => None,
+    }
+}
+
+/// The comparison with its operands swapped, so `5 < id` reads `id > 5`, or
+/// `None` for an operator an index cannot look up
+fn flipped(op: &BinaryOperator) -> Option<BinaryOperator> {
+    match op {
+        BinaryOperator::Eq => Some(BinaryOperator::Eq),
+        BinaryOperator::Lt => Some(BinaryOperator::Gt),
+        BinaryOperator::LtEq => Some(BinaryOperator::GtEq),
+        BinaryOperator::Gt => Some(BinaryOperator::Lt),
+        BinaryOperator::GtEq => Some(BinaryOperator::LtEq),
+        _ => None,
+    }
+}
+
+/// The rows one index finds for the restrictions, if it can look them up
+fn lookup(
+    table: &Table,
+    index: &Index,
+    restrictions: &HashMap<usize, Restriction>,
+) -> Option<Vec<usize>> {
+    let restricted: Vec<Option<&Restriction>> = index
+        .columns
+        .iter()
+        .map(|column| {
+            table
+                .get_column_index(column)
+                .and_then(|position| restrictions.get(&position))
+        })
+        .collect();
+
+    let prefix: Vec<Value> = restricted
+        .iter()
+        .map_while(|restriction| match restriction?.values.as_deref()? {
+            [value] => Some(value.clone()),
+            _ => None,
+        })
+        .collect();
+    if let Some(rows) = index.find(&prefix) {
+        return Some(rows);
+    }
+
+    let first = restricted.first().copied().flatten()?;
+    if let Some(values) = &first.values {
+        let found = values
+            .iter()
+            .map(|value| index.find(std::slice::from_ref(value)))
+            .collect::<Option<Vec<_>>>()?;
+        return Some(found.into_iter().flatten().collect());
+    }
+    if first.lower.is_none() && first.upper.is_none() {
+        return None;
+    }
+    let bound = |limit: &Option<(Value, bool)>| match limit {
+        Some((value, true)) => Bound::Included(value),
+        Some((value, false)) => Bound::Excluded(value),
+        None => Bound::Unbounded,
+    };
+    index.range(bound(&first.lower), bound(&first.upper))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{Column, IndexKind};
+    use crate::sql::parser::parse_expr;
+    use crate::yaml::schema::SqlType;
+    use sqlparser::ast::Value as SqlValue;
+
+    fn table() -> Table {
+        let columns = [
+            ("id", SqlType::Integer),
+            ("city", SqlType::Text),
+            ("joined", SqlType::Date),
+        ]
+        .into_iter()
+        .map(|(name, sql_type)| Column {
+            name: name.to_string(),
+            sql_type,
+            primary_key: false,
+            nullable: true,
+            unique: false,
+            default: None,
+            references: None,
+        })
+        .collect();
+        let mut table = Table::new("people".to_string(), columns);
+        for (id, city, joined) in [
+            (1, "Oslo", "2024-01-05"),
+            (2, "Rome", "2024-02-10"),
+            (3, "Oslo", "2024-03-15"),
+            (4, "Lima", "2024-04-20"),
+        ] {
+            table.rows.push(vec![
+                Value::Integer(id),
+                Value::Text(city.to_string()),
+                Value::Date(joined.parse().unwrap()),
+            ]);
+        }
+        table
+    }
+
+    fn index(table: &mut Table, column: &str, kind: IndexKind) {
+        let index = Index::new(
+            format!("people_{}_idx", column),
+            table,
+            &[column.to_string()],
+            kind,
+            false,
+        )
+        .unwrap();
+        table.indexes.push(index);
+    }
+
+    fn found(table: &Table, clause: &str) -> Option<Vec<usize>> {
+        let literal = |expr: &Expr| match expr {
+            Expr::Value(SqlValue::Number(n, _)) => n.parse().ok().map(Value::Integer),
+            Expr::Value(SqlValue::SingleQuotedString(s)) => Some(Value::Text(s.clone())),
+            _ => None,
+        };
+        candidates(table, &parse_expr(clause).unwrap(), literal)
+    }
+
+    #[test]
+    fn test_candidates() {
+        let mut table = table();
+        assert_eq!(found(&table, "city = 'Oslo'"), None);
+
+        index(&mut table, "city", IndexKind::Hash);
+        index(&mut table, "joined", IndexKind::Btree);
+        assert_eq!(found(&table, "city = 'Oslo'"), Some(vec![0, 2]));
+        assert_eq!(
+            found(&table, "id > 1 AND (people.city IN ('Rome', 'Lima'))"),
+            Some(vec![1, 3])
+        );
+        assert_eq!(found(&table, "city < 'Oslo'"), None);
+        assert_eq!(
+            found(&table, "'2024-02-10' <= joined AND joined < '2024-04-20'"),
+            Some(vec![1, 2])
+        );
+        assert_eq!(
+            found(&table, "joined BETWEEN '2024-01-01' AND '2024-02-28'"),
+            Some(vec![0, 1])
+        );
+        // The smaller of the two lookups
+        assert_eq!(
+            found(&table, "city = 'Oslo' AND joined > '2024-03-01'"),
+            Some(vec![2])
+        );
+        assert_eq!(found(&table, "city = 'Oslo' OR id = 2"), None);
+        assert_eq!(found(&table, "joined = 'soon'"), None);
+        assert_eq!(found(&table, "other.city = 'Oslo'"), None);
+
+        table.rows.pop();
+        assert_eq!(found(&table, "city = 'Oslo'"), None);
+    }
+}
@@ -0,0 +1,91 @@
+//! Stopping a statement partway through.
+//!
+//! Each statement runs on a task of its own with an [`Interrupt`] that scans
+//! and joins check as they go. The statement stops at its next check once its
+//! deadline, the executor's query timeout, passes, or once nobody waits for
+//! it any more: the client disconnected, the connection was dropped or timed
+//! out, or the server is shutting down. Without the checks a long scan would
+//! keep a core busy long after the client gave up, since a task that never
+//! yields cannot be dropped.
+
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+
+use crate::YamlBaseError;
+
+/// What a running statement checks to know whether to stop
+#[derive(Debug, Clone, Default)]
+pub(crate) struct Interrupt {
+    cancelled: Arc<AtomicBool>,
+    deadline: Option<(Instant, Duration)>,
+}
+
+impl Interrupt {
+    /// The interrupt of a statement that may run for `timeout`
+    pub(crate) fn after(timeout: Duration) -> Self {
+        Self {
+            cancelled: Arc::default(),
+            deadline: Some((Instant::now() + timeout, timeout)),
+        }
+    }
+
+    /// A guard cancelling the statement when dropped, which happens when the
+    /// future waiting for it is
+    pub(crate) fn cancel_on_drop(&self) -> CancelOnDrop {
+        CancelOnDrop(self.cancelled.clone())
+    }
+
+    /// Fail if the statement should stop
+    pub(crate) fn check(&self) -> crate::Result<()> {
+        if self.cancelled.load(Ordering::Relaxed) {
+            return Err(YamlBaseError::Cancelled(
+                "nobody waits for the result any more".to_string(),
+            ));
+        }
+        match self.deadline {
+            Some((deadline, timeout)) if Instant::now() >= deadline => Err(timed_out(timeout)),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// Cancels a statement when dropped; see [`Interrupt::cancel_on_drop`]
+pub(crate) struct CancelOnDrop(Arc<AtomicBool>);
+
+impl Drop for CancelOnDrop {
+    fn drop(&mut self) {
+        self.0.store(true, Ordering::Relaxed);
+    }
+}
+
+/// The error of a statement that ran longer than `timeout`
+pub(crate) fn timed_out(timeout: Duration) -> YamlBaseError {
+    YamlBaseError::Cancelled(format!(
+        "Query execution timeout after {} seconds. Consider optimizing your query or increasing timeout limit.",
+        timeout.as_secs()
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_statements_stop_when_dropped_or_late() {
+        assert!(Interrupt::default().check().is_ok());
+
+        let interrupt = Interrupt::after(Duration::from_secs(60));
+        let guard = interrupt.cancel_on_drop();
+        assert!(interrupt.check().is_ok());
+        drop(guard);
+        assert!(matches!(
+            interrupt.check(),
+            Err(YamlBaseError::Cancelled(_))
+        ));
+
+        let late = Interrupt::after(Duration::ZERO);
+        let error = late.check().unwrap_err();
+        assert!(error.to_string().contains("Query execution timeout"));
+    }
+}
@@ -0,0 +1,475 @@
+//! Intervals: `INTERVAL '7 days'`, `INTERVAL '1 day 02:30:00'`, or as MySQL
+//! writes them, `INTERVAL 7 DAY`.
+//!
+//! An interval is held as the text PostgreSQL shows it as, such as `7 days`
+//! or `1 day 02:30:00`. Adding one to a timestamp, date or time, or taking
+//! one from it, as in `now() - interval '1 hour'`, moves it by the months of
+//! the interval, then its days, then its time, so `'2024-01-31' + interval
+//! '1 month'` is `2024-02-29`; as in PostgreSQL a date becomes a timestamp,
+//! and text in interval form counts as an interval, as in `now() - '1 hour'`.
+//! MySQL's `DATE_ADD(date, INTERVAL 7 DAY)` and `DATE_SUB`, and `ADDDATE` and
+//! `SUBDATE`, move dates the same way, but keep a date a date when the
+//! interval has no time part.
+
+use chrono::{Months, NaiveDate, NaiveDateTime, TimeDelta};
+use sqlparser::ast::BinaryOperator;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+use crate::database::clock::parse_timestamp;
+
+const MICROS_PER_SECOND: i64 = 1_000_000;
+const MICROS_PER_DAY: i64 = 86_400 * MICROS_PER_SECOND;
+
+/// A span of months, days and time, which PostgreSQL keeps apart since
+/// months and days differ in length
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+struct Interval {
+    months: i64,
+    days: i64,
+    micros: i64,
+}
+
+/// What one of a unit is in an interval
+#[derive(Debug, Clone, Copy)]
+enum Unit {
+    Months(i64),
+    Days(i64),
+    Micros(i64),
+}
+
+fn unit(name: &str) -> Option<Unit> {
+    let unit = match name.to_lowercase().as_str() {
+        "microsecond" | "microseconds" | "us" | "usec" | "usecs" => Unit::Micros(1),
+        "millisecond" | "milliseconds" | "ms" | "msec" | "msecs" => Unit::Micros(1_000),
+        "second" | "seconds" | "sec" | "secs" | "s" => Unit::Micros(MICROS_PER_SECOND),
+        "minute" | "minutes" | "min" | "mins" | "m" => Unit::Micros(60 * MICROS_PER_SECOND),
+        "hour" | "hours" | "hr" | "hrs" | "h" => Unit::Micros(3_600 * MICROS_PER_SECOND),
+        "day" | "days" | "d" => Unit::Days(1),
+        "week" | "weeks" | "w" => Unit::Days(7),
+        "month" | "months" | "mon" | "mons" => Unit::Months(1),
+        "quarter" | "quarters" => Unit::Months(3),
+        "year" | "years" | "yr" | "yrs" | "y" => Unit::Months(12),
+        "decade" | "decades" => Unit::Months(120),
+        "century" | "centuries" => Unit::Months(1_200),
+        _ => return None,
+    };
+    Some(unit)
+}
+
+impl Interval {
+    /// `amount` of a unit; as in PostgreSQL, a fraction of a month is taken
+    /// as 30 days and a fraction of a day as 24 hours
+    fn of(amount: f64, unit: Unit) -> Self {
+        match unit {
+            Unit::Months(months) => {
+                let months = amount * months as f64;
+                let days = months.fract() * 30.0;
+                Self {
+                    months: months.trunc() as i64,
+                    days: days.trunc() as i64,
+                    micros: (days.fract() * MICROS_PER_DAY as f64).round() as i64,
+                }
+            }
+            Unit::Days(days) => {
+                let days = amount * days as f64;
+                Self {
+                    months: 0,
+                    days: days.trunc() as i64,
+                    micros: (days.fract() * MICROS_PER_DAY as f64).round() as i64,
+                }
+            }
+            Unit::Micros(micros) => Self {
+                months: 0,
+                days: 0,
+                micros: (amount * micros as f64).round() as i64,
+            },
+        }
+    }
+
+    fn plus(self, other: Self) -> Self {
+        Self {
+            months: self.months + other.months,
+            days: self.days + other.days,
+            micros: self.micros + other.micros,
+        }
+    }
+
+    fn negated(self) -> Self {
+        Self {
+            months: -self.months,
+            days: -self.days,
+            micros: -self.micros,
+        }
+    }
+
+    /// Interval text as PostgreSQL reads it: amounts with units, as in
+    /// `1 day 2 hours` or `90min`, and a time, as in `-01:30:00`, optionally
+    /// ending in `ago`. Unlike PostgreSQL, a number needs a unit, so numbers
+    /// in text are not taken for intervals.
+    fn parse(text: &str) -> Option<Self> {
+        let text = text.trim().to_lowercase();
+        let text = text.strip_prefix('@').unwrap_or(&text);
+        let (text, ago) = match text.trim_end().strip_suffix("ago") {
+            Some(rest) => (rest, true),
+            None => (text, false),
+        };
+
+        // Split amounts from the units written straight after them
+        let mut tokens = Vec::new();
+        for word in text.split_whitespace() {
+            match word.find(|c: char| c.is_ascii_alphabetic()) {
+                Some(at) if at > 0 && !word.contains(':') => {
+                    tokens.extend([&word[..at], &word[at..]])
+                }
+                _ => tokens.push(word),
+            }
+        }
+        if tokens.is_empty() {
+            return None;
+        }
+
+        let mut interval = Self::default();
+        let mut tokens = tokens.into_iter();
+        while let Some(token) = tokens.next() {
+            let part = if token.contains(':') {
+                Self::of_time(token)?
+            } else {
+                let amount = token.parse::<f64>().ok().filter(|n| n.is_finite())?;
+                Self::of(amount, unit(tokens.next()?)?)
+            };
+            interval = interval.plus(part);
+        }
+        Some(if ago { interval.negated() } else { interval })
+    }
+
+    /// A time of day as an interval: `[-]H:MM[:SS[.ffffff]]`
+    fn of_time(token: &str) -> Option<Self> {
+        let (negative, token) = match token.strip_prefix('-') {
+            Some(rest) => (true, rest),
+            None => (false, token.strip_prefix('+').unwrap_or(token)),
+        };
+        let mut parts = token.split(':');
+        let hours: i64 = parts.next()?.parse().ok()?;
+        let minutes: i64 = parts.next()?.parse().ok()?;
+        let seconds: f64 = match parts.next() {
+            Some(seconds) => seconds.parse().ok()?,
+            None => 0.0,
+        };
+        if parts.next().is_some() || minutes >= 60 || !(0.0..60.0).contains(&seconds) {
+            return None;
+        }
+        let micros = (hours * 3_600 + minutes * 60) * MICROS_PER_SECOND
+            + (seconds * MICROS_PER_SECOND as f64).round() as i64;
+        Some(Self {
+            micros: if negative { -micros } else { micros },
+            ..Self::default()
+        })
+    }
+
+    /// The interval as PostgreSQL shows it, as in `1 year 2 mons 3 days 04:05:06`
+    fn to_text(self) -> String {
+        let plural =
+            |n: i64, one: &str, many: &str| format!("{} {}", n, if n == 1 { one } else { many });
+        let mut parts = Vec::new();
+        if self.months / 12 != 0 {
+            parts.push(plural(self.months / 12, "year", "years"));
+        }
+        if self.months % 12 != 0 {
+            parts.push(plural(self.months % 12, "mon", "mons"));
+        }
+        if self.days != 0 {
+            parts.push(plural(self.days, "day", "days"));
+        }
+        if self.micros != 0 || parts.is_empty() {
+            let micros = self.micros.unsigned_abs();
+            let seconds = micros / MICROS_PER_SECOND as u64;
+            let mut time = format!(
+                "{}{:02}:{:02}:{:02}",
+                if self.micros < 0 { "-" } else { "" },
+                seconds / 3_600,
+                seconds / 60 % 60,
+                seconds % 60
+            );
+            let fraction = micros % MICROS_PER_SECOND as u64;
+            if fraction != 0 {
+                time.push_str(format!(".{:06}", fraction).trim_end_matches('0'));
+            }
+            parts.push(time);
+        }
+        parts.join(" ")
+    }
+
+    /// A timestamp moved by the interval
+    fn shift(self, at: NaiveDateTime) -> crate::Result<NaiveDateTime> {
+        let months = Months::new(self.months.unsigned_abs() as u32);
+        let days = chrono::Days::new(self.days.unsigned_abs());
+        Some(at)
+            .and_then(|at| {
+                if self.months < 0 {
+                    at.checked_sub_months(months)
+                } else {
+                    at.checked_add_months(months)
+                }
+            })
+            .and_then(|at| {
+                if self.days < 0 {
+                    at.checked_sub_days(days)
+                } else {
+                    at.checked_add_days(days)
+                }
+            })
+            .and_then(|at| at.checked_add_signed(TimeDelta::microseconds(self.micros)))
+            .ok_or_else(|| YamlBaseError::Database {
+                message: "timestamp out of range".to_string(),
+            })
+    }
+}
+
+/// The value of an `INTERVAL` expression, given the value it wraps: text
+/// such as `'1 day 2 hours'`, or a number of the unit after it, as in
+/// `INTERVAL 7 DAY` or `INTERVAL '7' DAY`
+pub(crate) fn literal(interval: &sqlparser::ast::Interval, value: Value) -> crate::Result<Value> {
+    let invalid = |value: &Value| YamlBaseError::Database {
+        message: format!("invalid input syntax for type interval: \"{}\"", value),
+    };
+    let amount = match &value {
+        Value::Null => return Ok(Value::Null),
+        Value::Integer(n) => Some(*n as f64),
+        Value::Double(n) => Some(*n),
+        Value::Float(n) => Some(*n as f64),
+        Value::Decimal(n) => n.to_string().parse().ok(),
+        Value::Text(text) => text.trim().parse().ok(),
+        _ => None,
+    }
+    .filter(|amount: &f64| amount.is_finite());
+    let parsed = match (amount, &interval.leading_field) {
+        (Some(amount), Some(field)) => {
+            unit(&field.to_string()).map(|unit| Interval::of(amount, unit))
+        }
+        // PostgreSQL takes a bare number for seconds
+        (Some(amount), None) => Some(Interval::of(amount, Unit::Micros(MICROS_PER_SECOND))),
+        (None, _) => match &value {
+            Value::Text(text) => Interval::parse(text),
+            _ => None,
+        },
+    };
+    parsed
+        .map(|interval| Value::Text(interval.to_text()))
+        .ok_or_else(|| invalid(&value))
+}
+
+/// The interval text stands for, if it is interval text
+fn interval_of(value: &Value) -> Option<Interval> {
+    match value {
+        Value::Text(text) => Interval::parse(text),
+        _ => None,
+    }
+}
+
+/// Whether a value is a point in time an interval can move
+fn is_point(value: &Value) -> bool {
+    match value {
+        Value::Null | Value::Timestamp(_) | Value::Date(_) | Value::Time(_) => true,
+        Value::Text(text) => parse_timestamp(text).is_ok(),
+        _ => false,
+    }
+}
+
+/// Whether `left op right` moves a point in time by an interval: a
+/// timestamp, date or time plus or minus an interval, or an interval plus one
+pub(crate) fn is_arithmetic(left: &Value, op: &BinaryOperator, right: &Value) -> bool {
+    match op {
+        BinaryOperator::Plus => {
+            (is_point(left) && interval_of(right).is_some())
+                || (interval_of(left).is_some() && is_point(right))
+        }
+        BinaryOperator::Minus => is_point(left) && interval_of(right).is_some(),
+        _ => false,
+    }
+}
+
+/// `left op right` for operands [`is_arithmetic`] accepts
+pub(crate) fn arithmetic(left: &Value, op: &BinaryOperator, right: &Value) -> crate::Result<Value> {
+    let (point, interval) = match interval_of(right) {
+        Some(interval) if is_point(left) => (left, interval),
+        _ => (right, interval_of(left).unwrap_or_default()),
+    };
+    let interval = match op {
+        BinaryOperator::Minus => interval.negated(),
+        _ => interval,
+    };
+    match point {
+        Value::Null => Ok(Value::Null),
+        Value::Time(time) => Ok(Value::Time(
+            time.overflowing_add_signed(TimeDelta::microseconds(interval.micros))
+                .0,
+        )),
+        point => Ok(Value::Timestamp(interval.shift(timestamp(point)?)?)),
+    }
+}
+
+fn timestamp(value: &Value) -> crate::Result<NaiveDateTime> {
+    match value {
+        Value::Timestamp(at) => Ok(*at),
+        Value::Date(date) => Ok(date.and_hms_opt(0, 0, 0).unwrap()),
+        Value::Text(text) => {
+            parse_timestamp(text).map_err(|message| YamlBaseError::Database { message })
+        }
+        value => Err(YamlBaseError::Database {
+            message: format!("Cannot move {} by an interval", value),
+        }),
+    }
+}
+
+/// The MySQL date function a call names, if it is one that takes an interval
+pub(crate) fn function(name: &str) -> Option<fn(&[Value]) -> crate::Result<Value>> {
+    let function: fn(&[Value]) -> crate::Result<Value> = match name.to_uppercase().as_str() {
+        "DATE_ADD" | "ADDDATE" => date_add,
+        "DATE_SUB" | "SUBDATE" => date_sub,
+        _ => return None,
+    };
+    Some(function)
+}
+
+/// `DATE_ADD(date, INTERVAL n unit)`, or `ADDDATE(date, days)`
+fn date_add(args: &[Value]) -> crate::Result<Value> {
+    move_date(args, false)
+}
+
+/// `DATE_SUB(date, INTERVAL n unit)`, or `SUBDATE(date, days)`
+fn date_sub(args: &[Value]) -> crate::Result<Value> {
+    move_date(args, true)
+}
+
+fn move_date(args: &[Value], subtract: bool) -> crate::Result<Value> {
+    let [point, interval] = args else {
+        return Err(YamlBaseError::Database {
+            message: format!(
+                "{} requires a date and an interval",
+                if subtract { "DATE_SUB" } else { "DATE_ADD" }
+            ),
+        });
+    };
+    if matches!(point, Value::Null) || matches!(interval, Value::Null) {
+        return Ok(Value::Null);
+    }
+    let interval = match interval {
+        Value::Integer(days) => Interval::of(*days as f64, Unit::Days(1)),
+        interval => interval_of(interval).ok_or_else(|| YamlBaseError::Database {
+            message: format!("Invalid interval: {}", interval),
+        })?,
+    };
+    let interval = if subtract {
+        interval.negated()
+    } else {
+        interval
+    };
+
+    let date = match point {
+        Value::Date(date) => Some(*date),
+        Value::Text(text) => NaiveDate::parse_from_str(text.trim(), "%Y-%m-%d").ok(),
+        _ => None,
+    };
+    let moved = interval.shift(timestamp(point)?)?;
+    // A date moved by whole days stays a date, as in MySQL
+    Ok(match date {
+        Some(_) if interval.micros == 0 => Value::Date(moved.date()),
+        _ => Value::Timestamp(moved),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn text(s: &str) -> Value {
+        Value::Text(s.to_string())
+    }
+
+    fn at(s: &str) -> Value {
+        Value::Timestamp(parse_timestamp(s).unwrap())
+    }
+
+    #[test]
+    fn test_intervals_show_as_in_postgres() {
+        let show = |s: &str| Interval::parse(s).map(Interval::to_text);
+        assert_eq!(show("7 days").as_deref(), Some("7 days"));
+        assert_eq!(show("1 hour").as_deref(), Some("01:00:00"));
+        assert_eq!(show("90min").as_deref(), Some("01:30:00"));
+        assert_eq!(show("1 day 2 hours").as_deref(), Some("1 day 02:00:00"));
+        assert_eq!(show("14 months").as_deref(), Some("1 year 2 mons"));
+        assert_eq!(show("1.5 days").as_deref(), Some("1 day 12:00:00"));
+        assert_eq!(show("2 weeks ago").as_deref(), Some("-14 days"));
+        assert_eq!(show("-00:00:01.5").as_deref(), Some("-00:00:01.5"));
+        assert_eq!(
+            show("@ 3 days 04:05:06").as_deref(),
+            Some("3 days 04:05:06")
+        );
+        assert_eq!(show("0 seconds").as_deref(), Some("00:00:00"));
+        assert_eq!(show("7"), None);
+        assert_eq!(show("2024-01-31"), None);
+        assert_eq!(show("7 fortnights"), None);
+        assert_eq!(show(""), None);
+    }
+
+    #[test]
+    fn test_points_in_time_move_by_intervals() {
+        let minus = BinaryOperator::Minus;
+        let plus = BinaryOperator::Plus;
+        let now = text("2024-03-10 12:00:00");
+        assert!(is_arithmetic(&now, &minus, &text("01:00:00")));
+        assert!(!is_arithmetic(&text("01:00:00"), &minus, &now));
+        assert!(!is_arithmetic(&now, &minus, &text("2024-03-09")));
+        assert!(!is_arithmetic(&Value::Integer(3), &plus, &text("1 day")));
+
+        assert_eq!(
+            arithmetic(&now, &minus, &text("01:00:00")).unwrap(),
+            at("2024-03-10 11:00:00")
+        );
+        assert_eq!(
+            arithmetic(&text("1 day"), &plus, &at("2024-03-10 12:00:00")).unwrap(),
+            at("2024-03-11 12:00:00")
+        );
+        // Months go first, and end on the last day of a shorter month
+        let date = Value::Date(NaiveDate::from_ymd_opt(2024, 1, 31).unwrap());
+        assert_eq!(
+            arithmetic(&date, &plus, &text("1 mon 1 day")).unwrap(),
+            at("2024-03-01 00:00:00")
+        );
+        assert_eq!(
+            arithmetic(&Value::Null, &minus, &text("1 day")).unwrap(),
+            Value::Null
+        );
+    }
+
+    #[test]
+    fn test_mysql_date_functions() {
+        let date_sub = function("date_sub").unwrap();
+        let date_add = function("ADDDATE").unwrap();
+        let day = |s: &str| Value::Date(NaiveDate::parse_from_str(s, "%Y-%m-%d").unwrap());
+
+        assert_eq!(
+            date_sub(&[text("2024-03-10 12:00:00"), text("7 days")]).unwrap(),
+            at("2024-03-03 12:00:00")
+        );
+        assert_eq!(
+            date_sub(&[day("2024-03-10"), text("7 days")]).unwrap(),
+            day("2024-03-03")
+        );
+        assert_eq!(
+            date_add(&[text("2024-03-10"), text("01:00:00")]).unwrap(),
+            at("2024-03-10 01:00:00")
+        );
+        assert_eq!(
+            date_add(&[day("2024-02-28"), Value::Integer(2)]).unwrap(),
+            day("2024-03-01")
+        );
+        assert_eq!(
+            date_add(&[Value::Null, text("1 day")]).unwrap(),
+            Value::Null
+        );
+        assert!(date_add(&[day("2024-02-28"), text("soon")]).is_err());
+        assert!(date_add(&[day("2024-02-28")]).is_err());
+    }
+}
@@ -0,0 +1,379 @@
+//! `JSON` / `JSONB` columns: documents written in YAML as mappings or
+//! sequences, or as JSON text.
+//!
+//! The operators are PostgreSQL's: `->` and `->>` read an object key or an
+//! array element as JSON or as text, `#>` and `#>>` follow a path of them,
+//! `@>` / `<@` test containment, and `?`, `?|` and `?&` test for keys. The
+//! `jsonb_extract_path` and `jsonb_extract_path_text` functions, and their
+//! `json_` namesakes, follow a path as well. MySQL reads documents with
+//! paths such as `$.address.city` or `$.tags[0]`: `JSON_EXTRACT`, and `->`
+//! and `->>` when given one, take them, and `JSON_UNQUOTE` turns a JSON
+//! string into text.
+
+use serde_json::Value as JsonValue;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+
+/// Cast a value to JSON, parsing text
+pub(crate) fn cast(value: Value) -> crate::Result<Value> {
+    match value {
+        Value::Null | Value::Json(_) => Ok(value),
+        Value::Text(ref s) => {
+            serde_json::from_str(s)
+                .map(Value::Json)
+                .map_err(|_| YamlBaseError::Database {
+                    message: format!("Cannot cast '{}' to JSON", s),
+                })
+        }
+        value => Err(YamlBaseError::Database {
+            message: format!("Cannot cast {:?} to JSON", value),
+        }),
+    }
+}
+
+/// The document a JSON argument holds; text is parsed, as MySQL's JSON
+/// functions take it
+pub(crate) fn document(value: &Value) -> crate::Result<JsonValue> {
+    match value {
+        Value::Json(json) => Ok(json.clone()),
+        Value::Text(text) => serde_json::from_str(text).map_err(|_| YamlBaseError::Database {
+            message: format!("Invalid JSON text: '{}'", text),
+        }),
+        other => Err(YamlBaseError::Database {
+            message: format!("Expected a JSON document, got {:?}", other),
+        }),
+    }
+}
+
+/// `document -> key`: an object's key, or an array's element counted from
+/// the end when negative. A MySQL path such as `'$.a[0]'` is followed.
+pub(crate) fn get<'a>(
+    document: &'a JsonValue,
+    key: &Value,
+) -> crate::Result<Option<&'a JsonValue>> {
+    match key {
+        Value::Text(path) if path.starts_with('$') => mysql_path(document, path),
+        Value::Text(key) => Ok(document.get(key.as_str())),
+        Value::Integer(index) => Ok(element(document, *index)),
+        other => Err(YamlBaseError::Database {
+            message: format!("A JSON key must be text or an integer, got {:?}", other),
+        }),
+    }
+}
+
+/// `document #> '{a,0,b}'`: keys of objects and indexes of arrays in turn
+pub(crate) fn get_path<'a, S: AsRef<str>>(
+    document: &'a JsonValue,
+    path: &[S],
+) -> Option<&'a JsonValue> {
+    path.iter().try_fold(document, |node, step| {
+        let step = step.as_ref();
+        match node {
+            JsonValue::Array(_) => element(node, step.parse().ok()?),
+            _ => node.get(step),
+        }
+    })
+}
+
+fn element(document: &JsonValue, index: i64) -> Option<&JsonValue> {
+    let array = document.as_array()?;
+    let index = match index {
+        0.. => index,
+        _ => array.len() as i64 + index,
+    };
+    array.get(usize::try_from(index).ok()?)
+}
+
+/// Follow a MySQL path: `$`, then `.key`, `."quoted key"` and `[index]`
+/// steps
+pub(crate) fn mysql_path<'a>(
+    document: &'a JsonValue,
+    path: &str,
+) -> crate::Result<Option<&'a JsonValue>> {
+    let invalid = || YamlBaseError::Database {
+        message: format!("Invalid JSON path expression '{}'", path),
+    };
+    let mut rest = path.trim().strip_prefix('$').ok_or_else(invalid)?;
+    let mut node = Some(document);
+    while !rest.is_empty() {
+        if let Some(after) = rest.strip_prefix('[') {
+            let (index, after) = after.split_once(']').ok_or_else(invalid)?;
+            let index: usize = index.trim().parse().map_err(|_| invalid())?;
+            node = node.and_then(|node| node.as_array()?.get(index));
+            rest = after;
+        } else if let Some(after) = rest.strip_prefix('.') {
+            let (key, after) = match after.strip_prefix('"') {
+                Some(quoted) => {
+                    let (key, after) = quoted.split_once('"').ok_or_else(invalid)?;
+                    (key, after)
+                }
+                None => after.split_at(after.find(['.', '[']).unwrap_or(after.len())),
+            };
+            if key.is_empty() || key == "*" {
+                return Err(invalid());
+            }
+            node = node.and_then(|node| node.as_object()?.get(key));
+            rest = after;
+        } else {
+            return Err(invalid());
+        }
+    }
+    Ok(node)
+}
+
+/// A found value as `->` gives it: JSON, with a missing one NULL
+pub(crate) fn json_value(found: Option<&JsonValue>) -> Value {
+    found.map_or(Value::Null, |json| Value::Json(json.clone()))
+}
+
+/// A found value as `->>` gives it: strings unquoted, other values as JSON
+/// text, and JSON `null` or a missing value NULL
+pub(crate) fn text_value(found: Option<&JsonValue>) -> Value {
+    match found {
+        None | Some(JsonValue::Null) => Value::Null,
+        Some(JsonValue::String(s)) => Value::Text(s.clone()),
+        Some(json) => Value::Text(json.to_string()),
+    }
+}
+
+/// Whether `document @> contained`, as jsonb decides it: an object holds
+/// the keys of the other with values that contain theirs, an array holds
+/// something containing each element of the other, and an array at the top
+/// also contains a scalar it has as an element
+pub(crate) fn contains(document: &JsonValue, contained: &JsonValue) -> bool {
+    match (document, contained) {
+        (JsonValue::Array(elements), scalar) if !scalar.is_array() && !scalar.is_object() => {
+            elements.iter().any(|element| same(element, scalar))
+        }
+        (document, contained) => contains_nested(document, contained),
+    }
+}
+
+fn contains_nested(document: &JsonValue, contained: &JsonValue) -> bool {
+    match (document, contained) {
+        (JsonValue::Object(object), JsonValue::Object(other)) => {
+            other.iter().all(|(key, value)| {
+                object
+                    .get(key)
+                    .is_some_and(|held| contains_nested(held, value))
+            })
+        }
+        (JsonValue::Array(elements), JsonValue::Array(other)) => other.iter().all(|value| {
+            elements
+                .iter()
+                .any(|element| contains_nested(element, value))
+        }),
+        (document, contained) => same(document, contained),
+    }
+}
+
+/// Scalars compare as jsonb compares them, so `1` and `1.0` are the same
+fn same(a: &JsonValue, b: &JsonValue) -> bool {
+    match (a, b) {
+        (JsonValue::Number(a), JsonValue::Number(b)) => a.as_f64() == b.as_f64(),
+        (a, b) => a == b,
+    }
+}
+
+/// `document ? key`: an object has the key, or an array the string
+pub(crate) fn has_key(document: &JsonValue, key: &str) -> bool {
+    match document {
+        JsonValue::Object(object) => object.contains_key(key),
+        JsonValue::Array(elements) => elements.iter().any(|element| element == key),
+        JsonValue::String(s) => s == key,
+        _ => false,
+    }
+}
+
+/// The JSON function called `name`, if it is one
+pub(crate) fn function(name: &str) -> Option<fn(&[Value]) -> crate::Result<Value>> {
+    let function: fn(&[Value]) -> crate::Result<Value> = match name.to_uppercase().as_str() {
+        "JSONB_EXTRACT_PATH" | "JSON_EXTRACT_PATH" => extract_path,
+        "JSONB_EXTRACT_PATH_TEXT" | "JSON_EXTRACT_PATH_TEXT" => extract_path_text,
+        "JSON_EXTRACT" => json_extract,
+        "JSON_UNQUOTE" => json_unquote,
+        _ => return None,
+    };
+    Some(function)
+}
+
+fn wrong_arguments(function: &str, expected: &str) -> YamlBaseError {
+    YamlBaseError::Database {
+        message: format!("{} requires {}", function, expected),
+    }
+}
+
+/// The document and the path of `jsonb_extract_path(document, VARIADIC
+/// path)`, or `None` when either is NULL
+fn path_args(args: &[Value], function: &str) -> crate::Result<Option<(JsonValue, Vec<String>)>> {
+    let Some((document_arg, path)) = args.split_first() else {
+        return Err(wrong_arguments(function, "a JSON document and a path"));
+    };
+    if matches!(document_arg, Value::Null) || path.iter().any(|step| matches!(step, Value::Null)) {
+        return Ok(None);
+    }
+    let path = path.iter().map(ToString::to_string).collect();
+    Ok(Some((document(document_arg)?, path)))
+}
+
+fn extract_path(args: &[Value]) -> crate::Result<Value> {
+    Ok(match path_args(args, "JSONB_EXTRACT_PATH")? {
+        Some((document, path)) => json_value(get_path(&document, &path)),
+        None => Value::Null,
+    })
+}
+
+fn extract_path_text(args: &[Value]) -> crate::Result<Value> {
+    Ok(match path_args(args, "JSONB_EXTRACT_PATH_TEXT")? {
+        Some((document, path)) => text_value(get_path(&document, &path)),
+        None => Value::Null,
+    })
+}
+
+/// MySQL's `JSON_EXTRACT(document, path[, path...])`: the value at a single
+/// path, or an array of the values found at several
+fn json_extract(args: &[Value]) -> crate::Result<Value> {
+    let [document_arg, paths @ ..] = args else {
+        return Err(wrong_arguments(
+            "JSON_EXTRACT",
+            "a JSON document and a path",
+        ));
+    };
+    if paths.is_empty() {
+        return Err(wrong_arguments(
+            "JSON_EXTRACT",
+            "a JSON document and a path",
+        ));
+    }
+    if args.iter().any(|arg| matches!(arg, Value::Null)) {
+        return Ok(Value::Null);
+    }
+    let document = document(document_arg)?;
+    let mut found = Vec::new();
+    for path in paths {
+        let Value::Text(path) = path else {
+            return Err(wrong_arguments("JSON_EXTRACT", "text paths"));
+        };
+        found.extend(mysql_path(&document, path)?.cloned());
+    }
+    Ok(match (paths.len(), found.len()) {
+        (_, 0) => Value::Null,
+        (1, _) => Value::Json(found.remove(0)),
+        _ => Value::Json(JsonValue::Array(found)),
+    })
+}
+
+/// MySQL's `JSON_UNQUOTE(value)`: a JSON string as text, anything else as
+/// its JSON text
+fn json_unquote(args: &[Value]) -> crate::Result<Value> {
+    match args {
+        [Value::Null] => Ok(Value::Null),
+        [Value::Json(JsonValue::String(s))] => Ok(Value::Text(s.clone())),
+        [Value::Json(json)] => Ok(Value::Text(json.to_string())),
+        [Value::Text(text)] => match serde_json::from_str(text) {
+            Ok(JsonValue::String(s)) => Ok(Value::Text(s)),
+            _ => Ok(Value::Text(text.clone())),
+        },
+        _ => Err(wrong_arguments("JSON_UNQUOTE", "one JSON value")),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_paths_reach_into_documents() {
+        let doc = json!({"name": "Ada", "tags": ["a", "b"], "address": {"city": "Paris"}});
+        let text = |s: &str| Value::Text(s.to_string());
+
+        assert_eq!(get(&doc, &text("name")).unwrap(), Some(&json!("Ada")));
+        assert_eq!(get(&doc, &text("missing")).unwrap(), None);
+        assert_eq!(
+            get(&doc["tags"], &Value::Integer(-1)).unwrap(),
+            Some(&json!("b"))
+        );
+        assert_eq!(get_path(&doc, &["address", "city"]), Some(&json!("Paris")));
+        assert_eq!(get_path(&doc, &["tags", "0"]), Some(&json!("a")));
+        assert_eq!(get_path(&doc, &["tags", "x"]), None);
+
+        assert_eq!(
+            get(&doc, &text("$.address.city")).unwrap(),
+            Some(&json!("Paris"))
+        );
+        assert_eq!(mysql_path(&doc, "$.tags[1]").unwrap(), Some(&json!("b")));
+        assert_eq!(mysql_path(&doc, "$").unwrap(), Some(&doc));
+        assert!(mysql_path(&doc, "$.tags[x]").is_err());
+        assert!(mysql_path(&doc, "name").is_err());
+
+        assert_eq!(text_value(Some(&json!("Ada"))), text("Ada"));
+        assert_eq!(text_value(Some(&json!({"a": 1}))), text("{\"a\":1}"));
+        assert_eq!(text_value(Some(&JsonValue::Null)), Value::Null);
+        assert_eq!(
+            json_value(Some(&JsonValue::Null)),
+            Value::Json(JsonValue::Null)
+        );
+    }
+
+    #[test]
+    fn test_containment_follows_jsonb() {
+        let doc = json!({"a": 1, "tags": ["x", "y"], "nested": {"b": [1, 2]}});
+        assert!(contains(&doc, &json!({"a": 1.0})));
+        assert!(contains(&doc, &json!({"tags": ["y"]})));
+        assert!(contains(&doc, &json!({"nested": {"b": [2]}})));
+        assert!(!contains(&doc, &json!({"tags": "x"})));
+        assert!(!contains(&doc, &json!({"a": 2})));
+        assert!(contains(&json!(["x", "y"]), &json!("x")));
+        assert!(!contains(&json!([["x"]]), &json!(["x"])));
+
+        assert!(has_key(&doc, "tags"));
+        assert!(has_key(&json!(["x"]), "x"));
+        assert!(!has_key(&doc, "x"));
+    }
+
+    #[test]
+    fn test_json_functions() {
+        let doc = Value::Text(r#"{"user": {"name": "Ada", "roles": ["admin"]}}"#.to_string());
+        let text = |s: &str| Value::Text(s.to_string());
+        let call = |name: &str, args: &[Value]| function(name).unwrap()(args).unwrap();
+
+        assert_eq!(
+            call(
+                "jsonb_extract_path_text",
+                &[doc.clone(), text("user"), text("name")]
+            ),
+            text("Ada")
+        );
+        assert_eq!(
+            call(
+                "jsonb_extract_path",
+                &[doc.clone(), text("user"), text("roles")]
+            ),
+            Value::Json(json!(["admin"]))
+        );
+        assert_eq!(
+            call("json_extract_path_text", &[doc.clone(), text("nobody")]),
+            Value::Null
+        );
+        assert_eq!(
+            call("JSON_EXTRACT", &[doc.clone(), text("$.user.name")]),
+            Value::Json(json!("Ada"))
+        );
+        assert_eq!(
+            call(
+                "JSON_EXTRACT",
+                &[doc.clone(), text("$.user.name"), text("$.user.roles[0]")]
+            ),
+            Value::Json(json!(["Ada", "admin"]))
+        );
+        assert_eq!(call("JSON_EXTRACT", &[doc, text("$.age")]), Value::Null);
+        assert_eq!(
+            call("JSON_UNQUOTE", &[Value::Json(json!("Ada"))]),
+            text("Ada")
+        );
+        assert_eq!(call("JSON_UNQUOTE", &[text("\"Ada\"")]), text("Ada"));
+        assert!(function("upper").is_none());
+    }
+}
@@ -0,0 +1,572 @@
+//! Backslashes in string literals, and comments.
+//!
+//! PostgreSQL reads `'...'` strings as they are, backslashes included, and
+//! takes C-like escapes only in `E'...'` strings: `E'it\'s\n'`. With
+//! `standard_conforming_strings` off, plain strings take them as well. MySQL
+//! takes backslash escapes in `'...'` and `"..."` strings alike, `"..."`
+//! being a string there unless `sql_mode` has `ANSI_QUOTES`, and
+//! `NO_BACKSLASH_ESCAPES` makes backslashes plain characters. Statements are
+//! rewritten before they are parsed so that every string is a standard
+//! `'...'` one holding what the server would have read. Comments, which
+//! drivers and tracing libraries put anywhere in a statement, are removed
+//! the same way, knowing where strings begin and end.
+
+use std::borrow::Cow;
+
+use crate::sql::sql_mode::SqlMode;
+
+/// How a server reads the strings of a statement
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum Escapes {
+    /// PostgreSQL, with whether `standard_conforming_strings` is on
+    Postgres { standard_conforming_strings: bool },
+    /// MySQL, with whether backslashes escape and whether `"..."` quotes an
+    /// identifier rather than a string
+    MySql {
+        backslash_escapes: bool,
+        ansi_quotes: bool,
+    },
+}
+
+impl Escapes {
+    /// PostgreSQL's, for a session's `standard_conforming_strings`
+    pub(crate) fn postgres(setting: Option<&str>) -> Self {
+        let off = setting.is_some_and(|setting| {
+            ["off", "false", "no", "0"]
+                .iter()
+                .any(|off| setting.trim().eq_ignore_ascii_case(off))
+        });
+        Escapes::Postgres {
+            standard_conforming_strings: !off,
+        }
+    }
+
+    /// MySQL's, for a session's `sql_mode`
+    pub(crate) fn mysql(sql_mode: &str) -> Self {
+        let mode = SqlMode::parse(sql_mode);
+        Escapes::MySql {
+            backslash_escapes: mode.backslash_escapes,
+            ansi_quotes: mode.ansi_quotes,
+        }
+    }
+}
+
+/// `sql` with its strings written as standard `'...'` strings, their
+/// escapes decoded as `escapes` says, or why an `E'...'` string is invalid.
+/// Identifiers, comments and dollar quoted text are left alone.
+pub(crate) fn normalize(sql: &str, escapes: Escapes) -> Result<Cow<'_, str>, String> {
+    let mut normalized = String::new();
+    let mut copied = 0;
+    scan(sql, escapes, |part| {
+        let Part::Quoted {
+            start,
+            end,
+            body,
+            quote,
+            prefixed,
+            string,
+            backslashes,
+        } = part
+        else {
+            return Ok(());
+        };
+        if !string || !(prefixed || quote == b'"' || backslashes && body.contains('\\')) {
+            return Ok(());
+        }
+        let text = match escapes {
+            Escapes::Postgres { .. } => decode_postgres(body, backslashes)?,
+            Escapes::MySql { .. } => decode_mysql(body, quote as char, backslashes),
+        };
+        normalized.push_str(&sql[copied..start]);
+        normalized.push('\'');
+        normalized.push_str(&text.replace('\'', "''"));
+        normalized.push('\'');
+        copied = end;
+        Ok(())
+    })?;
+
+    if copied == 0 {
+        return Ok(Cow::Borrowed(sql));
+    }
+    normalized.push_str(&sql[copied..]);
+    Ok(Cow::Owned(normalized))
+}
+
+/// `sql` with each of its comments replaced by a space, so that optimizer
+/// hints such as `/*+ INDEX(t idx) */`, sqlcommenter trailers such as
+/// `/*traceparent='00-...'*/` and MySQL's `#` comments never reach the
+/// parser. The text of a MySQL `/*!40101 ... */` comment is kept, as MySQL
+/// runs it; an unterminated `/*` is left for the parser to report.
+pub(crate) fn strip_comments(sql: &str, escapes: Escapes) -> Cow<'_, str> {
+    let mut stripped = String::new();
+    let mut copied = 0;
+    // Only strings are ever refused, and they are not looked at here
+    let _ = scan(sql, escapes, |part| {
+        if let Part::Comment { start, end } = part {
+            stripped.push_str(&sql[copied..start]);
+            stripped.push(' ');
+            copied = end;
+        }
+        Ok(())
+    });
+
+    if copied == 0 {
+        return Cow::Borrowed(sql);
+    }
+    stripped.push_str(&sql[copied..]);
+    Cow::Owned(stripped)
+}
+
+/// A part of a statement that [`scan`] stops at
+enum Part<'a> {
+    /// A quoted string or identifier at `start..end`, quotes and any `E`
+    /// prefix included, with whether it is a string and whether
+    /// backslashes escape in it
+    Quoted {
+        start: usize,
+        end: usize,
+        body: &'a str,
+        quote: u8,
+        prefixed: bool,
+        string: bool,
+        backslashes: bool,
+    },
+    /// A comment at `start..end`, or the `/*!` opening or `*/` closing of a
+    /// MySQL comment whose text is part of the statement
+    Comment { start: usize, end: usize },
+}
+
+/// Read `sql` as a server reading strings as `escapes` says would, showing
+/// `visit` each quoted string or identifier and each comment. Words,
+/// backticks and dollar quoted text are passed over.
+fn scan<'a>(
+    sql: &'a str,
+    escapes: Escapes,
+    mut visit: impl FnMut(Part<'a>) -> Result<(), String>,
+) -> Result<(), String> {
+    let postgres = matches!(escapes, Escapes::Postgres { .. });
+    let bytes = sql.as_bytes();
+    // Inside a MySQL `/*! ... */` comment
+    let mut executable = false;
+
+    let mut pos = 0;
+    while pos < bytes.len() {
+        match bytes[pos] {
+            quote @ (b'\'' | b'"') => {
+                // `E'...'`, but not the end of a word such as `WHERE'a'`
+                let prefixed = postgres
+                    && quote == b'\''
+                    && pos > 0
+                    && bytes[pos - 1].eq_ignore_ascii_case(&b'e')
+                    && (pos < 2 || !is_word(bytes[pos - 2]));
+                let (string, backslashes) = match escapes {
+                    Escapes::Postgres {
+                        standard_conforming_strings,
+                    } => (
+                        quote == b'\'',
+                        quote == b'\'' && (prefixed || !standard_conforming_strings),
+                    ),
+                    Escapes::MySql {
+                        ansi_quotes: true, ..
+                    } if quote == b'"' => (false, false),
+                    Escapes::MySql {
+                        backslash_escapes, ..
+                    } => (true, backslash_escapes),
+                };
+                let start = pos;
+                pos += 1;
+                while pos < bytes.len() {
+                    match bytes[pos] {
+                        b'\\' if backslashes => pos += 1,
+                        b if b == quote && bytes.get(pos + 1) == Some(&quote) => pos += 1,
+                        b if b == quote => break,
+                        _ => {}
+                    }
+                    pos += 1;
+                }
+                if pos >= bytes.len() {
+                    // Unterminated, which the parser reports
+                    break;
+                }
+                pos += 1;
+                visit(Part::Quoted {
+                    start: if prefixed { start - 1 } else { start },
+                    end: pos,
+                    body: &sql[start + 1..pos - 1],
+                    quote,
+                    prefixed,
+                    string,
+                    backslashes,
+                })?;
+            }
+            b'`' if !postgres => {
+                pos += 1 + sql[pos + 1..].find('`').map_or(bytes.len(), |end| end + 1);
+            }
+            // MySQL needs a space or control character after `--`
+            b'-' if bytes.get(pos + 1) == Some(&b'-')
+                && (postgres
+                    || bytes
+                        .get(pos + 2)
+                        .is_none_or(|b| b.is_ascii_whitespace() || b.is_ascii_control())) =>
+            {
+                let start = pos;
+                while pos < bytes.len() && bytes[pos] != b'\n' {
+                    pos += 1;
+                }
+                visit(Part::Comment { start, end: pos })?;
+            }
+            b'#' if !postgres => {
+                let start = pos;
+                while pos < bytes.len() && bytes[pos] != b'\n' {
+                    pos += 1;
+                }
+                visit(Part::Comment { start, end: pos })?;
+            }
+            b'*' if executable && bytes.get(pos + 1) == Some(&b'/') => {
+                executable = false;
+                visit(Part::Comment {
+                    start: pos,
+                    end: pos + 2,
+                })?;
+                pos += 2;
+            }
+            // `/*!` and the MySQL version from which the text is run
+            b'/' if !postgres && !executable && bytes[pos..].starts_with(b"/*!") => {
+                let start = pos;
+                pos += 3;
+                pos += digits(&bytes[pos..], 5, |b| b.is_ascii_digit());
+                executable = true;
+                visit(Part::Comment { start, end: pos })?;
+            }
+            b'/' if bytes.get(pos + 1) == Some(&b'*') => match comment_end(bytes, pos, postgres) {
+                Some(end) => {
+                    visit(Part::Comment { start: pos, end })?;
+                    pos = end;
+                }
+                // Unterminated, which the parser reports
+                None => break,
+            },
+            b'$' if postgres => {
+                // `$tag$ ... $tag$`, but not a `$1` parameter
+                let tag_end = sql[pos + 1..]
+                    .find(|c: char| !(c.is_alphanumeric() || c == '_'))
+                    .map(|len| pos + 1 + len);
+                match tag_end.filter(|&end| {
+                    bytes[end] == b'$'
+                        && !bytes[pos + 1..end].first().is_some_and(u8::is_ascii_digit)
+                }) {
+                    Some(tag_end) => {
+                        let tag = &sql[pos..=tag_end];
+                        pos = sql[tag_end + 1..]
+                            .find(tag)
+                            .map_or(bytes.len(), |end| tag_end + 1 + end + tag.len());
+                    }
+                    None => pos += 1,
+                }
+            }
+            b if is_word(b) => {
+                while pos < bytes.len() && (is_word(bytes[pos]) || bytes[pos] == b'$') {
+                    pos += 1;
+                }
+            }
+            _ => pos += 1,
+        }
+    }
+    Ok(())
+}
+
+/// Where the `/* ... */` comment at `start` ends, just past its `*/`;
+/// PostgreSQL's comments nest, MySQL's do not
+fn comment_end(bytes: &[u8], start: usize, nested: bool) -> Option<usize> {
+    let mut depth = 0;
+    let mut pos = start;
+    while pos + 1 < bytes.len() {
+        match &bytes[pos..pos + 2] {
+            b"/*" if nested || depth == 0 => {
+                depth += 1;
+                pos += 2;
+            }
+            b"*/" => {
+                depth -= 1;
+                pos += 2;
+                if depth == 0 {
+                    return Some(pos);
+                }
+            }
+            _ => pos += 1,
+        }
+    }
+    None
+}
+
+fn is_word(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_' || b >= 0x80
+}
+
+/// The text of a PostgreSQL string: a doubled quote is one, and with
+/// backslash escapes `\b`, `\f`, `\n`, `\r` and `\t`, octal and hexadecimal bytes, `\u` and
+/// `\U` code points, and any other character after a backslash as itself
+fn decode_postgres(body: &str, backslashes: bool) -> Result<String, String> {
+    if !backslashes {
+        return Ok(body.replace("''", "'"));
+    }
+    let bytes = body.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut pending_surrogate = None;
+    let mut pos = 0;
+    while pos < bytes.len() {
+        if bytes[pos] != b'\\' || pos + 1 == bytes.len() {
+            if pending_surrogate.is_some() {
+                return Err("invalid Unicode surrogate pair".to_string());
+            }
+            decoded.push(bytes[pos]);
+            pos += if bytes[pos..].starts_with(b"''") {
+                2
+            } else {
+                1
+            };
+            continue;
+        }
+        let escape = bytes[pos + 1];
+        pos += 2;
+        if pending_surrogate.is_some() && !matches!(escape, b'u' | b'U') {
+            return Err("invalid Unicode surrogate pair".to_string());
+        }
+        match escape {
+            b'b' => decoded.push(0x08),
+            b'f' => decoded.push(0x0c),
+            b'n' => decoded.push(b'\n'),
+            b'r' => decoded.push(b'\r'),
+            b't' => decoded.push(b'\t'),
+            b'0'..=b'7' => {
+                let digits = digits(&bytes[pos - 1..], 3, |b| matches!(b, b'0'..=b'7'));
+                let value = u32::from_str_radix(&body[pos - 1..pos - 1 + digits], 8)
+                    .map_err(|e| e.to_string())?;
+                decoded.push(value as u8);
+                pos += digits - 1;
+            }
+            b'x' if bytes.get(pos).is_some_and(u8::is_ascii_hexdigit) => {
+                let digits = digits(&bytes[pos..], 2, |b| b.is_ascii_hexdigit());
+                let value =
+                    u8::from_str_radix(&body[pos..pos + digits], 16).map_err(|e| e.to_string())?;
+                decoded.push(value);
+                pos += digits;
+            }
+            b'u' | b'U' => {
+                let len = if escape == b'u' { 4 } else { 8 };
+                if digits(&bytes[pos..], len, |b| b.is_ascii_hexdigit()) < len {
+                    return Err(
+                        "invalid Unicode escape: Unicode escapes must be \\uXXXX or \\UXXXXXXXX"
+                            .to_string(),
+                    );
+                }
+                let code =
+                    u32::from_str_radix(&body[pos..pos + len], 16).map_err(|e| e.to_string())?;
+                pos += len;
+                let code = match (pending_surrogate.take(), code) {
+                    (None, 0xd800..=0xdbff) => {
+                        pending_surrogate = Some(code);
+                        continue;
+                    }
+                    (Some(high), 0xdc00..=0xdfff) => {
+                        0x10000 + ((high - 0xd800) << 10) + (code - 0xdc00)
+                    }
+                    (Some(_), _) | (None, 0xdc00..=0xdfff) => {
+                        return Err("invalid Unicode surrogate pair".to_string());
+                    }
+                    (None, code) => code,
+                };
+                match char::from_u32(code).filter(|c| *c != '\0') {
+                    Some(c) => decoded.extend_from_slice(c.encode_utf8(&mut [0; 4]).as_bytes()),
+                    None => return Err("invalid Unicode escape value".to_string()),
+                }
+            }
+            other => decoded.push(other),
+        }
+    }
+    if pending_surrogate.is_some() {
+        return Err("invalid Unicode surrogate pair".to_string());
+    }
+    match String::from_utf8(decoded) {
+        Ok(text) if !text.contains('\0') => Ok(text),
+        Ok(_) => Err("invalid byte sequence for encoding \"UTF8\": 0x00".to_string()),
+        Err(e) => {
+            let bad = e.as_bytes()[e.utf8_error().valid_up_to()];
+            Err(format!(
+                "invalid byte sequence for encoding \"UTF8\": 0x{:02x}",
+                bad
+            ))
+        }
+    }
+}
+
+/// How many of the first `max` bytes are digits by `is_digit`
+fn digits(bytes: &[u8], max: usize, is_digit: impl Fn(u8) -> bool) -> usize {
+    bytes.iter().take(max).take_while(|b| is_digit(**b)).count()
+}
+
+/// The text of a MySQL string quoted with `quote`: a doubled quote is one,
+/// and with backslash escapes `\0`, `\b`, `\n`, `\r`, `\t` and `\Z` are
+/// control characters, `\%` and `\_` keep their backslash for `LIKE`, and
+/// any other character after a backslash is itself
+fn decode_mysql(body: &str, quote: char, backslashes: bool) -> String {
+    let mut decoded = String::with_capacity(body.len());
+    let mut chars = body.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' if backslashes => match chars.next() {
+                Some('0') => decoded.push('\0'),
+                Some('b') => decoded.push('\u{8}'),
+                Some('n') => decoded.push('\n'),
+                Some('r') => decoded.push('\r'),
+                Some('t') => decoded.push('\t'),
+                Some('Z') => decoded.push('\u{1a}'),
+                Some(wildcard @ ('%' | '_')) => {
+                    decoded.push('\\');
+                    decoded.push(wildcard);
+                }
+                Some(other) => decoded.push(other),
+                None => decoded.push('\\'),
+            },
+            c if c == quote && chars.peek() == Some(&quote) => {
+                chars.next();
+                decoded.push(quote);
+            }
+            c => decoded.push(c),
+        }
+    }
+    decoded
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const STANDARD: Escapes = Escapes::Postgres {
+        standard_conforming_strings: true,
+    };
+    const MYSQL: Escapes = Escapes::MySql {
+        backslash_escapes: true,
+        ansi_quotes: false,
+    };
+
+    #[test]
+    fn test_postgres_escape_strings() {
+        let normalize = |sql, escapes| normalize(sql, escapes).unwrap().into_owned();
+
+        assert_eq!(
+            normalize(r"SELECT E'it\'s\n', e'tab\there', 'C:\dir'", STANDARD),
+            "SELECT 'it''s\n', 'tab\there', 'C:\\dir'"
+        );
+        assert_eq!(
+            normalize(r"SELECT E'\101\x42\u0043\U0001F600\q', E'a''b'", STANDARD),
+            "SELECT 'ABC\u{1F600}q', 'a''b'"
+        );
+        assert_eq!(
+            normalize(r"SELECT E'\uD83D\uDE00', E'\303\251'", STANDARD),
+            "SELECT '\u{1F600}', 'é'"
+        );
+
+        // Without standard_conforming_strings plain strings take escapes too
+        let off = Escapes::postgres(Some("off"));
+        assert_eq!(
+            normalize(r"SELECT 'it\'s', 'a\\b'", off),
+            "SELECT 'it''s', 'a\\b'"
+        );
+        assert_eq!(Escapes::postgres(Some("on")), STANDARD);
+        assert_eq!(Escapes::postgres(None), STANDARD);
+
+        // Statements without escapes are left as they are, and so are
+        // identifiers, comments and dollar quoted text
+        let sql = r#"SELECT "E'x\n'", $$E'\n'$$ FROM t WHERE'a\'='a\' -- E'\n'"#;
+        for sql in [sql, "SELECT 'it''s'"] {
+            assert!(matches!(
+                super::normalize(sql, STANDARD).unwrap(),
+                Cow::Borrowed(_)
+            ));
+        }
+
+        for invalid in [
+            r"E'\u12'",
+            r"E'\000'",
+            r"E'\xff'",
+            r"E'\uD83D'",
+            r"E'\u0000'",
+        ] {
+            assert!(super::normalize(invalid, STANDARD).is_err(), "{}", invalid);
+        }
+    }
+
+    #[test]
+    fn test_mysql_backslash_escapes() {
+        let normalize = |sql, escapes| normalize(sql, escapes).unwrap().into_owned();
+
+        assert_eq!(
+            normalize(
+                r#"SELECT 'it\'s', "say \"hi\"", 'a\\b', 'x\%y\_', '\0\Z\q'"#,
+                MYSQL
+            ),
+            "SELECT 'it''s', 'say \"hi\"', 'a\\b', 'x\\%y\\_', '\0\u{1a}q'"
+        );
+        assert_eq!(
+            normalize(r#"SELECT "it's", 'a''b', "a""b" FROM `we'ird`"#, MYSQL),
+            r#"SELECT 'it''s', 'a''b', 'a"b' FROM `we'ird`"#
+        );
+
+        // NO_BACKSLASH_ESCAPES keeps backslashes as they are
+        let plain = Escapes::mysql("STRICT_TRANS_TABLES,NO_BACKSLASH_ESCAPES");
+        assert_eq!(
+            normalize(r#"SELECT 'C:\dir\', "a\n""#, plain),
+            r#"SELECT 'C:\dir\', 'a\n'"#
+        );
+
+        // With ANSI_QUOTES `"..."` is an identifier
+        let ansi = Escapes::mysql("ANSI_QUOTES");
+        assert_eq!(
+            normalize(r#"SELECT "col" FROM t WHERE a = 'x\ty' # it's"#, ansi),
+            "SELECT \"col\" FROM t WHERE a = 'x\ty' # it's"
+        );
+    }
+
+    #[test]
+    fn test_comments_are_stripped() {
+        let strip = |sql, escapes| strip_comments(sql, escapes).into_owned();
+
+        // Hints, sqlcommenter trailers and line comments anywhere
+        assert_eq!(
+            strip(
+                "SELECT /*+ IndexScan(users) */ * FROM users -- list\nWHERE id = 1 /*controller='users',traceparent='00-4bf9-01'*/",
+                STANDARD
+            ),
+            "SELECT   * FROM users  \nWHERE id = 1  "
+        );
+        // PostgreSQL's comments nest, and strings, identifiers and dollar
+        // quotes keep what looks like a comment
+        assert_eq!(
+            strip(
+                r#"SELECT '-- no', "/* no */", $$/* no */$$ /* a /* b */ c */"#,
+                STANDARD
+            ),
+            r#"SELECT '-- no', "/* no */", $$/* no */$$  "#
+        );
+        assert_eq!(strip("SELECT 1 /* open", STANDARD), "SELECT 1 /* open");
+        assert!(matches!(
+            strip_comments("SELECT 'a#b' # x", STANDARD),
+            Cow::Borrowed(_)
+        ));
+
+        // MySQL's `#`, `-- ` only before a space, its comments do not nest,
+        // and the text of `/*! */` comments is run
+        assert_eq!(
+            strip("SELECT 5--2, 'it\\'s -- no' # yes\n-- yes", MYSQL),
+            "SELECT 5--2, 'it\\'s -- no'  \n "
+        );
+        assert_eq!(
+            strip(
+                "/*!40101 SET NAMES utf8mb4 */; SELECT /* a /* b */ 1 */",
+                MYSQL
+            ),
+            "  SET NAMES utf8mb4  ; SELECT   1 */"
+        );
+    }
+}
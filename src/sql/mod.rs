@@ -1,8 +1,39 @@
+pub mod advisor;
+pub(crate) mod array;
+pub(crate) mod booleans;
+pub mod budget;
+pub(crate) mod bytea;
+pub(crate) mod catalog;
+pub(crate) mod coercion;
+pub(crate) mod copy;
+mod ddl;
+pub(crate) mod enums;
 pub mod executor;
 mod executor_comprehensive_tests;
+pub mod functions;
+pub mod geo;
+mod grouping_sets;
+pub mod hstore;
+pub(crate) mod identifiers;
+mod index_scan;
+mod interrupt;
+pub(crate) mod interval;
+pub(crate) mod json;
+pub(crate) mod literals;
+pub mod n_plus_one;
 pub mod parser;
+mod pattern;
+mod predicate;
+mod quantified;
 mod recursive_cte;
+pub(crate) mod returning;
+mod rewrite;
+mod row_filter;
+mod sequences;
+mod session_dataset;
+pub(crate) mod sql_mode;
 mod tests_string_functions;
+mod upsert;
 
 pub use executor::QueryExecutor;
-pub use parser::{SqlDialect, parse_sql, parse_sql_with_dialect};
+pub use parser::{SqlDialect, parse_sql, parse_sql_with_dialect, split_statements};
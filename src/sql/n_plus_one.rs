@@ -0,0 +1,237 @@
+//! N+1 query detection (`--n-plus-one-threshold`).
+//!
+//! ORMs that lazily load associations issue one query per parent row, e.g.
+//! `SELECT * FROM items WHERE order_id = 1`, `... = 2`, and so on. Queries are
+//! fingerprinted by replacing their literals with `?`; when one connection runs
+//! enough distinct queries with the same fingerprint within the time window (and
+//! the same transaction), the burst is logged, sent to the client as a notice
+//! where the protocol supports it, and listed by the admin API under
+//! `GET /n-plus-one`.
+
+use serde::Serialize;
+use sqlparser::ast::Statement;
+use sqlparser::dialect::GenericDialect;
+use sqlparser::tokenizer::{Token, Tokenizer};
+use std::collections::hash_map::DefaultHasher;
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::hash::{Hash, Hasher};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+use tracing::warn;
+
+/// Reports kept for the admin API; older ones are dropped
+const MAX_REPORTS: usize = 100;
+/// Example queries kept per report
+const MAX_EXAMPLES: usize = 3;
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct NPlusOneReport {
+    /// The query with its literals replaced by `?`
+    pub fingerprint: String,
+    /// Distinct queries with this fingerprint in the burst
+    pub queries: usize,
+    /// Time between the first and the last query of the burst
+    pub elapsed_ms: f64,
+    pub examples: Vec<String>,
+    pub message: String,
+}
+
+/// Shared detector settings and the reports found on all connections
+pub struct NPlusOneDetector {
+    threshold: usize,
+    window: Duration,
+    reports: Mutex<VecDeque<NPlusOneReport>>,
+}
+
+/// Recent query fingerprints of one connection
+#[derive(Debug, Default)]
+pub struct ConnectionPatterns {
+    bursts: HashMap<String, Burst>,
+}
+
+#[derive(Debug)]
+struct Burst {
+    started: Instant,
+    distinct: HashSet<u64>,
+    examples: Vec<String>,
+    reported: bool,
+}
+
+impl NPlusOneDetector {
+    pub fn new(threshold: usize, window: Duration) -> Self {
+        Self {
+            threshold: threshold.max(2),
+            window,
+            reports: Mutex::new(VecDeque::new()),
+        }
+    }
+
+    /// Account for one statement run on a connection, returning a report the
+    /// moment a burst crosses the threshold
+    pub fn observe(
+        &self,
+        patterns: &mut ConnectionPatterns,
+        statement: &Statement,
+    ) -> Option<NPlusOneReport> {
+        match statement {
+            // Bursts are scoped to a transaction
+            Statement::StartTransaction { .. }
+            | Statement::Commit { .. }
+            | Statement::Rollback { .. } => {
+                patterns.bursts.clear();
+                return None;
+            }
+            Statement::Query(_) => {}
+            _ => return None,
+        }
+
+        let sql = statement.to_string();
+        let fingerprint = fingerprint(&sql)?;
+        let now = Instant::now();
+
+        if patterns.bursts.len() > 256 {
+            patterns
+                .bursts
+                .retain(|_, burst| now.duration_since(burst.started) <= self.window);
+        }
+        let burst = patterns
+            .bursts
+            .entry(fingerprint.clone())
+            .or_insert_with(|| Burst::new(now));
+        if now.duration_since(burst.started) > self.window {
+            *burst = Burst::new(now);
+        }
+
+        let mut hasher = DefaultHasher::new();
+        sql.hash(&mut hasher);
+        if burst.distinct.insert(hasher.finish()) && burst.examples.len() < MAX_EXAMPLES {
+            burst.examples.push(sql);
+        }
+        if burst.reported || burst.distinct.len() < self.threshold {
+            return None;
+        }
+        burst.reported = true;
+
+        let elapsed = now.duration_since(burst.started);
+        let report = NPlusOneReport {
+            message: format!(
+                "Possible N+1 query pattern: {} queries like `{}` within {:.0}ms",
+                burst.distinct.len(),
+                fingerprint,
+                elapsed.as_secs_f64() * 1000.0
+            ),
+            fingerprint,
+            queries: burst.distinct.len(),
+            elapsed_ms: elapsed.as_secs_f64() * 1000.0,
+            examples: burst.examples.clone(),
+        };
+        warn!("{}", report.message);
+
+        let mut reports = self.reports.lock().unwrap();
+        if reports.len() == MAX_REPORTS {
+            reports.pop_front();
+        }
+        reports.push_back(report.clone());
+        Some(report)
+    }
+
+    pub fn reports(&self) -> Vec<NPlusOneReport> {
+        self.reports.lock().unwrap().iter().cloned().collect()
+    }
+
+    pub fn clear(&self) {
+        self.reports.lock().unwrap().clear();
+    }
+}
+
+impl Burst {
+    fn new(started: Instant) -> Self {
+        Self {
+            started,
+            distinct: HashSet::new(),
+            examples: Vec::new(),
+            reported: false,
+        }
+    }
+}
+
+/// The query text with every literal replaced by `?`
+fn fingerprint(sql: &str) -> Option<String> {
+    let tokens = Tokenizer::new(&GenericDialect {}, sql).tokenize().ok()?;
+    let mut normalized = String::with_capacity(sql.len());
+    for token in tokens {
+        match token {
+            Token::Number(..)
+            | Token::SingleQuotedString(_)
+            | Token::NationalStringLiteral(_)
+            | Token::HexStringLiteral(_)
+            | Token::Placeholder(_) => normalized.push('?'),
+            other => normalized.push_str(&other.to_string()),
+        }
+    }
+    Some(normalized)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parse_sql;
+
+    fn statement(sql: &str) -> Statement {
+        parse_sql(sql).unwrap().remove(0)
+    }
+
+    #[test]
+    fn test_fingerprint_replaces_literals() {
+        assert_eq!(
+            fingerprint("SELECT * FROM items WHERE order_id = 42 AND sku = 'A-1'").unwrap(),
+            "SELECT * FROM items WHERE order_id = ? AND sku = ?"
+        );
+    }
+
+    #[test]
+    fn test_burst_is_reported_once_at_threshold() {
+        let detector = NPlusOneDetector::new(3, Duration::from_secs(10));
+        let mut patterns = ConnectionPatterns::default();
+
+        let mut reports = Vec::new();
+        for order_id in 1..=5 {
+            let sql = format!("SELECT * FROM items WHERE order_id = {}", order_id);
+            reports.extend(detector.observe(&mut patterns, &statement(&sql)));
+        }
+
+        assert_eq!(reports.len(), 1);
+        assert_eq!(reports[0].queries, 3);
+        assert_eq!(
+            reports[0].fingerprint,
+            "SELECT * FROM items WHERE order_id = ?"
+        );
+        assert_eq!(reports[0].examples.len(), 3);
+        assert_eq!(detector.reports(), reports);
+    }
+
+    #[test]
+    fn test_identical_queries_and_transaction_boundaries_do_not_count() {
+        let detector = NPlusOneDetector::new(3, Duration::from_secs(10));
+        let mut patterns = ConnectionPatterns::default();
+
+        // Repeating the very same query is not an N+1 pattern
+        for _ in 0..5 {
+            let found = detector.observe(
+                &mut patterns,
+                &statement("SELECT * FROM items WHERE id = 1"),
+            );
+            assert!(found.is_none());
+        }
+
+        let run = |patterns: &mut ConnectionPatterns, id: i32| {
+            let sql = format!("SELECT * FROM items WHERE id = {}", id);
+            detector.observe(patterns, &statement(&sql))
+        };
+        assert!(run(&mut patterns, 2).is_none());
+        detector.observe(&mut patterns, &statement("COMMIT"));
+        assert!(run(&mut patterns, 3).is_none());
+        assert!(run(&mut patterns, 4).is_none());
+        assert!(run(&mut patterns, 5).is_some());
+    }
+}
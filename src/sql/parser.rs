@@ -1,9 +1,10 @@
-use sqlparser::ast::{Query, Statement};
+use sqlparser::ast::{Expr, Query, Statement};
 use sqlparser::dialect::{GenericDialect, PostgreSqlDialect};
 use sqlparser::parser::Parser;
+use sqlparser::tokenizer::Token;
 use tracing::debug;
 
-#[derive(Debug, Clone, Copy, Default)]
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
 pub enum SqlDialect {
     #[default]
     PostgreSQL,
@@ -33,6 +34,79 @@ pub fn parse_sql_with_dialect(sql: &str, dialect: SqlDialect) -> crate::Result<V
     Ok(statements)
 }
 
+/// Parse a standalone expression, such as a filter written in the YAML file
+pub fn parse_expr(sql: &str) -> crate::Result<Expr> {
+    let dialect = PostgreSqlDialect {};
+    let mut parser = Parser::new(&dialect).try_with_sql(sql)?;
+    let expr = parser.parse_expr()?;
+    parser.expect_token(&Token::EOF)?;
+    Ok(expr)
+}
+
+/// The statements of a multi-statement query string, split at semicolons
+/// outside quotes, dollar quotes and comments, trimmed and without empty ones
+pub fn split_statements(sql: &str) -> Vec<&str> {
+    let bytes = sql.as_bytes();
+    let mut statements = Vec::new();
+    let mut start = 0;
+    let mut pos = 0;
+    while pos < bytes.len() {
+        match bytes[pos] {
+            quote @ (b'\'' | b'"') => {
+                pos += 1;
+                while pos < bytes.len() {
+                    if bytes[pos] == quote {
+                        // A doubled quote is an escaped one
+                        if bytes.get(pos + 1) == Some(&quote) {
+                            pos += 1;
+                        } else {
+                            break;
+                        }
+                    }
+                    pos += 1;
+                }
+            }
+            b'-' if bytes.get(pos + 1) == Some(&b'-') => {
+                while pos < bytes.len() && bytes[pos] != b'\n' {
+                    pos += 1;
+                }
+            }
+            b'/' if bytes.get(pos + 1) == Some(&b'*') => {
+                pos = sql[pos + 2..]
+                    .find("*/")
+                    .map_or(bytes.len(), |end| pos + 2 + end + 1);
+            }
+            b'$' => {
+                // `$tag$ ... $tag$`, but not a `$1` parameter
+                let tag_end = sql[pos + 1..]
+                    .find(|c: char| !(c.is_alphanumeric() || c == '_'))
+                    .map(|len| pos + 1 + len);
+                if let Some(tag_end) = tag_end.filter(|&end| {
+                    bytes[end] == b'$'
+                        && !bytes[pos + 1..end].first().is_some_and(u8::is_ascii_digit)
+                }) {
+                    let tag = &sql[pos..=tag_end];
+                    pos = sql[tag_end + 1..]
+                        .find(tag)
+                        .map_or(bytes.len(), |end| tag_end + end + tag.len());
+                }
+            }
+            b';' => {
+                statements.push(&sql[start..pos]);
+                start = pos + 1;
+            }
+            _ => {}
+        }
+        pos += 1;
+    }
+    statements.push(&sql[start.min(sql.len())..]);
+    statements
+        .into_iter()
+        .map(str::trim)
+        .filter(|statement| !statement.is_empty())
+        .collect()
+}
+
 pub fn is_select_query(statement: &Statement) -> Option<&Query> {
     match statement {
         Statement::Query(query) => Some(query),
@@ -44,6 +118,19 @@ pub fn is_select_query(statement: &Statement) -> Option<&Query> {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_split_statements() {
+        assert_eq!(
+            split_statements("RESET ALL; SELECT 'a;b', \"c;\" FROM t;; UNLISTEN *"),
+            vec!["RESET ALL", "SELECT 'a;b', \"c;\" FROM t", "UNLISTEN *"]
+        );
+        assert_eq!(
+            split_statements("SELECT 'it''s;' -- one; two\n; SELECT /* ; */ $$;$$, $1"),
+            vec!["SELECT 'it''s;' -- one; two", "SELECT /* ; */ $$;$$, $1"]
+        );
+        assert!(split_statements(" ; ").is_empty());
+    }
+
     #[test]
     fn test_postgresql_dialect_parsing() {
         let sql = "SELECT * FROM users LIMIT 5";
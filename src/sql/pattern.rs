@@ -0,0 +1,317 @@
+//! Pattern matching operators: `LIKE` / `ILIKE` with `%` and `_` wildcards and
+//! an `ESCAPE` character, Postgres's `~`, `~*`, `!~` and `!~*` regex matches,
+//! and MySQL's `REGEXP` / `RLIKE`.
+//!
+//! Every operator is compiled to a [`Regex`], so regex patterns use the `regex`
+//! crate's syntax, which covers the POSIX classes and the Perl-style escapes
+//! both engines accept. `REGEXP` matches case-insensitively, as it does under
+//! MySQL's default collation.
+
+use once_cell::sync::Lazy;
+use regex::Regex;
+use sqlparser::ast::{BinaryOperator, Expr};
+use std::collections::HashMap;
+use std::sync::Mutex;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+
+/// Compiled patterns are reused across rows and queries, up to this many
+const CACHE_CAPACITY: usize = 256;
+
+static CACHE: Lazy<Mutex<HashMap<(Matcher, String), Regex>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// A pattern match found in an expression, with the operands its caller
+/// still has to evaluate
+pub(crate) struct PatternTest<'a> {
+    pub expr: &'a Expr,
+    pub pattern: &'a Expr,
+    matcher: Matcher,
+    negated: bool,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+enum Matcher {
+    Like {
+        escape: Option<String>,
+        case_insensitive: bool,
+    },
+    Regex {
+        case_insensitive: bool,
+    },
+}
+
+impl<'a> PatternTest<'a> {
+    pub fn of(expr: &'a Expr) -> Option<Self> {
+        let like = |escape: Option<String>, case_insensitive| Matcher::Like {
+            escape,
+            case_insensitive,
+        };
+        let (expr, pattern, matcher, negated) = match expr {
+            Expr::Like {
+                negated,
+                any: false,
+                expr,
+                pattern,
+                escape_char,
+            } => (
+                expr,
+                pattern,
+                like(escape_char.as_ref().map(ToString::to_string), false),
+                *negated,
+            ),
+            Expr::ILike {
+                negated,
+                any: false,
+                expr,
+                pattern,
+                escape_char,
+            } => (
+                expr,
+                pattern,
+                like(escape_char.as_ref().map(ToString::to_string), true),
+                *negated,
+            ),
+            Expr::RLike {
+                negated,
+                expr,
+                pattern,
+                ..
+            } => (
+                expr,
+                pattern,
+                Matcher::Regex {
+                    case_insensitive: true,
+                },
+                *negated,
+            ),
+            Expr::BinaryOp { left, op, right } => {
+                let (matcher, negated) = match op {
+                    BinaryOperator::PGRegexMatch => (
+                        Matcher::Regex {
+                            case_insensitive: false,
+                        },
+                        false,
+                    ),
+                    BinaryOperator::PGRegexIMatch => (
+                        Matcher::Regex {
+                            case_insensitive: true,
+                        },
+                        false,
+                    ),
+                    BinaryOperator::PGRegexNotMatch => (
+                        Matcher::Regex {
+                            case_insensitive: false,
+                        },
+                        true,
+                    ),
+                    BinaryOperator::PGRegexNotIMatch => (
+                        Matcher::Regex {
+                            case_insensitive: true,
+                        },
+                        true,
+                    ),
+                    BinaryOperator::PGLikeMatch => (like(None, false), false),
+                    BinaryOperator::PGILikeMatch => (like(None, true), false),
+                    BinaryOperator::PGNotLikeMatch => (like(None, false), true),
+                    BinaryOperator::PGNotILikeMatch => (like(None, true), true),
+                    _ => return None,
+                };
+                (left, right, matcher, negated)
+            }
+            _ => return None,
+        };
+        Some(Self {
+            expr,
+            pattern,
+            matcher,
+            negated,
+        })
+    }
+
+    /// Match the evaluated operands, giving NULL when either one is NULL
+    pub fn evaluate(&self, value: &Value, pattern: &Value) -> crate::Result<Value> {
+        let (value, pattern) = match (value, pattern) {
+            (Value::Null, _) | (_, Value::Null) => return Ok(Value::Null),
+            (value, Value::Text(pattern)) => (text(value), pattern),
+            _ => {
+                return Err(YamlBaseError::Database {
+                    message: "Pattern must be a string".to_string(),
+                });
+            }
+        };
+        let matched = with_regex(&self.matcher, pattern, |regex| regex.is_match(&value))?;
+        Ok(Value::Boolean(matched != self.negated))
+    }
+}
+
+/// Numbers, dates and the like are matched by their text, as MySQL does
+fn text(value: &Value) -> String {
+    match value {
+        Value::Text(s) => s.clone(),
+        value => value.to_string(),
+    }
+}
+
+fn with_regex<T>(
+    matcher: &Matcher,
+    pattern: &str,
+    f: impl FnOnce(&Regex) -> T,
+) -> crate::Result<T> {
+    let key = (matcher.clone(), pattern.to_string());
+    let mut cache = CACHE.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(regex) = cache.get(&key) {
+        return Ok(f(regex));
+    }
+    let regex = compile(matcher, pattern)?;
+    let result = f(&regex);
+    if cache.len() >= CACHE_CAPACITY {
+        cache.clear();
+    }
+    cache.insert(key, regex);
+    Ok(result)
+}
+
+fn compile(matcher: &Matcher, pattern: &str) -> crate::Result<Regex> {
+    let (source, case_insensitive) = match matcher {
+        Matcher::Like {
+            escape,
+            case_insensitive,
+        } => (
+            like_to_regex(pattern, escape.as_deref())?,
+            *case_insensitive,
+        ),
+        Matcher::Regex { case_insensitive } => (pattern.to_string(), *case_insensitive),
+    };
+    let flags = if case_insensitive { "(?i)" } else { "" };
+    Regex::new(&format!("{}{}", flags, source)).map_err(|e| YamlBaseError::Database {
+        message: format!("Invalid regular expression '{}': {}", pattern, e),
+    })
+}
+
+/// Translate a LIKE pattern into an anchored regex. The escape character
+/// defaults to a backslash, and `ESCAPE ''` turns escaping off.
+fn like_to_regex(pattern: &str, escape: Option<&str>) -> crate::Result<String> {
+    let escape = match escape {
+        None => Some('\\'),
+        Some(escape) => {
+            let mut chars = escape.chars();
+            match (chars.next(), chars.next()) {
+                (None, _) => None,
+                (Some(c), None) => Some(c),
+                _ => {
+                    return Err(YamlBaseError::Database {
+                        message: format!(
+                            "Invalid escape string '{}': it must be a single character",
+                            escape
+                        ),
+                    });
+                }
+            }
+        }
+    };
+
+    let mut regex = String::from("(?s)^");
+    let mut chars = pattern.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            c if Some(c) == escape => match chars.next() {
+                Some(escaped) => regex.push_str(&regex::escape(&escaped.to_string())),
+                None => {
+                    return Err(YamlBaseError::Database {
+                        message: format!(
+                            "LIKE pattern '{}' ends with its escape character",
+                            pattern
+                        ),
+                    });
+                }
+            },
+            '%' => regex.push_str(".*"),
+            '_' => regex.push('.'),
+            c => regex.push_str(&regex::escape(&c.to_string())),
+        }
+    }
+    regex.push('$');
+    Ok(regex)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parser::parse_expr;
+
+    fn matches(sql: &str, value: &str, pattern: &str) -> Value {
+        let expr = parse_expr(sql).unwrap();
+        let test = PatternTest::of(&expr).unwrap();
+        test.evaluate(
+            &Value::Text(value.to_string()),
+            &Value::Text(pattern.to_string()),
+        )
+        .unwrap()
+    }
+
+    #[test]
+    fn test_like_wildcards_and_escapes() {
+        assert_eq!(
+            matches("a LIKE b", "report.pdf", "%.pdf"),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            matches("a LIKE b", "report_pdf", "%.pdf"),
+            Value::Boolean(false)
+        );
+        assert_eq!(matches("a LIKE b", "a\nb", "a_b"), Value::Boolean(true));
+        assert_eq!(matches("a LIKE b", "100%", "100\\%"), Value::Boolean(true));
+        assert_eq!(matches("a LIKE b", "1000", "100\\%"), Value::Boolean(false));
+        assert_eq!(
+            matches("a LIKE b ESCAPE '!'", "50%", "50!%"),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            matches("a LIKE b ESCAPE ''", "a\\b", "a\\b"),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            matches("a NOT LIKE b", "Alice", "A%"),
+            Value::Boolean(false)
+        );
+        assert_eq!(matches("a LIKE b", "Alice", "a%"), Value::Boolean(false));
+        assert_eq!(matches("a ILIKE b", "Alice", "a%"), Value::Boolean(true));
+        assert_eq!(matches("a !~~* b", "Alice", "a%"), Value::Boolean(false));
+
+        let expr = parse_expr("a LIKE b ESCAPE '!!'").unwrap();
+        let test = PatternTest::of(&expr).unwrap();
+        let pattern = Value::Text("x".to_string());
+        assert!(test.evaluate(&pattern, &pattern).is_err());
+    }
+
+    #[test]
+    fn test_regex_operators() {
+        assert_eq!(
+            matches("a ~ b", "order-42", "^order-[0-9]+$"),
+            Value::Boolean(true)
+        );
+        assert_eq!(
+            matches("a ~ b", "ORDER-42", "^order"),
+            Value::Boolean(false)
+        );
+        assert_eq!(
+            matches("a ~* b", "ORDER-42", "^order"),
+            Value::Boolean(true)
+        );
+        assert_eq!(matches("a !~ b", "order-42", "\\d"), Value::Boolean(false));
+        assert_eq!(matches("a !~* b", "ORDER-42", "^x"), Value::Boolean(true));
+
+        let expr = parse_expr("a ~ b").unwrap();
+        let test = PatternTest::of(&expr).unwrap();
+        let text = Value::Text("x".to_string());
+        assert_eq!(test.evaluate(&Value::Null, &text).unwrap(), Value::Null);
+        assert_eq!(
+            test.evaluate(&Value::Integer(42), &Value::Text("^4".to_string()))
+                .unwrap(),
+            Value::Boolean(true)
+        );
+        assert!(test.evaluate(&text, &Value::Text("(".to_string())).is_err());
+    }
+}
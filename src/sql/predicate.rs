@@ -0,0 +1,216 @@
+//! The `IN (...)`, `BETWEEN` and `IS [NOT] NULL` predicates under SQL's
+//! three-valued logic.
+//!
+//! A NULL operand makes `IN` and `BETWEEN` unknown rather than false, unless
+//! the other operands settle the answer anyway: `2 IN (1, 2, NULL)` is true
+//! and `5 BETWEEN NULL AND 3` is false, but `3 NOT IN (1, 2, NULL)` is NULL,
+//! so a filter on it keeps no rows, as in PostgreSQL and MySQL. `IS NULL` and
+//! `IS NOT NULL` are never unknown. Operands of different types are compared
+//! after the coercions of [`coercion`].
+
+use sqlparser::ast::Expr;
+use std::cmp::Ordering;
+
+use crate::YamlBaseError;
+use crate::database::Value;
+use crate::sql::coercion;
+
+/// A predicate found in an expression, with the operands its caller still
+/// has to evaluate
+pub(crate) struct Predicate<'a> {
+    /// The tested expression first, then the list or the two bounds
+    pub operands: Vec<&'a Expr>,
+    kind: Kind,
+    negated: bool,
+}
+
+enum Kind {
+    InList,
+    Between,
+    IsNull,
+}
+
+impl<'a> Predicate<'a> {
+    pub fn of(expr: &'a Expr) -> Option<Self> {
+        let (kind, operands, negated) = match expr {
+            Expr::InList {
+                expr,
+                list,
+                negated,
+            } => (
+                Kind::InList,
+                std::iter::once(expr.as_ref()).chain(list).collect(),
+                *negated,
+            ),
+            Expr::Between {
+                expr,
+                negated,
+                low,
+                high,
+            } => (Kind::Between, vec![&**expr, &**low, &**high], *negated),
+            Expr::IsNull(expr) => (Kind::IsNull, vec![&**expr], false),
+            Expr::IsNotNull(expr) => (Kind::IsNull, vec![&**expr], true),
+            _ => return None,
+        };
+        Some(Self {
+            operands,
+            kind,
+            negated,
+        })
+    }
+
+    /// Test the evaluated operands, giving NULL when the answer is unknown
+    pub fn evaluate(&self, values: &[Value]) -> crate::Result<Value> {
+        let Some((value, rest)) = values.split_first() else {
+            return Ok(Value::Null);
+        };
+        let result = match (&self.kind, rest) {
+            (Kind::IsNull, _) => Some(matches!(value, Value::Null)),
+            (Kind::InList, list) => in_list(value, list),
+            (Kind::Between, [low, high]) => between(value, low, high)?,
+            (Kind::Between, _) => None,
+        };
+        Ok(match result {
+            Some(result) => Value::Boolean(result != self.negated),
+            None => Value::Null,
+        })
+    }
+}
+
+/// A value is in the list when it equals an item, and unknown when it
+/// matches none but a NULL item might have been it
+fn in_list(value: &Value, list: &[Value]) -> Option<bool> {
+    let mut unknown = false;
+    for item in list {
+        match equals(value, item) {
+            Some(true) => return Some(true),
+            Some(false) => {}
+            None => unknown = true,
+        }
+    }
+    if unknown { None } else { Some(false) }
+}
+
+/// `low <= value AND value <= high`, where one false side is enough
+fn between(value: &Value, low: &Value, high: &Value) -> crate::Result<Option<bool>> {
+    let above_low = compare(value, low, "BETWEEN")?.map(Ordering::is_ge);
+    let below_high = compare(value, high, "BETWEEN")?.map(Ordering::is_le);
+    Ok(match (above_low, below_high) {
+        (Some(false), _) | (_, Some(false)) => Some(false),
+        (Some(true), Some(true)) => Some(true),
+        _ => None,
+    })
+}
+
+fn equals(value: &Value, item: &Value) -> Option<bool> {
+    if matches!(value, Value::Null) || matches!(item, Value::Null) {
+        return None;
+    }
+    Some(coercion::equals(value, item))
+}
+
+fn compare(value: &Value, other: &Value, operator: &str) -> crate::Result<Option<Ordering>> {
+    if matches!(value, Value::Null) || matches!(other, Value::Null) {
+        return Ok(None);
+    }
+    coercion::compare(value, other)
+        .map(Some)
+        .ok_or_else(|| YamlBaseError::Database {
+            message: format!(
+                "{} requires compatible types, got {:?} and {:?}",
+                operator, value, other
+            ),
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parser::parse_expr;
+    use chrono::NaiveDate;
+
+    fn test(sql: &str, values: &[Value]) -> Value {
+        let expr = parse_expr(sql).unwrap();
+        Predicate::of(&expr).unwrap().evaluate(values).unwrap()
+    }
+
+    #[test]
+    fn test_in_lists_with_nulls() {
+        use Value::{Boolean, Integer, Null};
+        let list = [Integer(2), Integer(1), Integer(2), Null];
+        assert_eq!(test("a IN (b, c, d)", &list), Boolean(true));
+        assert_eq!(test("a NOT IN (b, c, d)", &list), Boolean(false));
+
+        let list = [Integer(3), Integer(1), Integer(2), Null];
+        assert_eq!(test("a IN (b, c, d)", &list), Null);
+        assert_eq!(test("a NOT IN (b, c, d)", &list), Null);
+        assert_eq!(test("a NOT IN (b, c)", &list[..3]), Boolean(true));
+
+        assert_eq!(test("a IN (b)", &[Null, Integer(1)]), Null);
+        assert_eq!(test("a NOT IN (b)", &[Null, Null]), Null);
+        assert_eq!(
+            test("a IN (b)", &[Integer(1), Value::Double(1.0)]),
+            Boolean(true)
+        );
+    }
+
+    #[test]
+    fn test_between_and_is_null() {
+        use Value::{Boolean, Integer, Null};
+        let range = |value, low, high| [value, low, high];
+        assert_eq!(
+            test(
+                "a BETWEEN b AND c",
+                &range(Integer(2), Integer(1), Integer(3))
+            ),
+            Boolean(true)
+        );
+        assert_eq!(
+            test(
+                "a NOT BETWEEN b AND c",
+                &range(Integer(5), Integer(1), Integer(3))
+            ),
+            Boolean(true)
+        );
+        assert_eq!(
+            test("a BETWEEN b AND c", &range(Null, Integer(1), Integer(3))),
+            Null
+        );
+        assert_eq!(
+            test(
+                "a NOT BETWEEN b AND c",
+                &range(Integer(2), Null, Integer(3))
+            ),
+            Null
+        );
+        assert_eq!(
+            test("a BETWEEN b AND c", &range(Integer(5), Null, Integer(3))),
+            Boolean(false)
+        );
+        let day = NaiveDate::from_ymd_opt(2024, 3, 15).unwrap();
+        assert_eq!(
+            test(
+                "a BETWEEN b AND c",
+                &range(
+                    Value::Date(day),
+                    Value::Text("2024-03-01".to_string()),
+                    Value::Text("2024-03-31".to_string())
+                )
+            ),
+            Boolean(true)
+        );
+
+        let expr = parse_expr("a BETWEEN b AND c").unwrap();
+        let text = Value::Text("x".to_string());
+        assert!(
+            Predicate::of(&expr)
+                .unwrap()
+                .evaluate(&range(Integer(1), text.clone(), text))
+                .is_err()
+        );
+
+        assert_eq!(test("a IS NULL", &[Null]), Boolean(true));
+        assert_eq!(test("a IS NOT NULL", &[Null]), Boolean(false));
+        assert_eq!(test("a IS NOT NULL", &[Integer(0)]), Boolean(true));
+    }
+}
@@ -0,0 +1,413 @@
+//! Quantified comparisons: `ANY`, its synonym `SOME`, and `ALL`.
+//!
+//! They are rewritten into predicates the executor already evaluates before
+//! the statement runs. Over an array, as in `id = ANY($1)` with an array
+//! parameter or `price > ALL (ARRAY[10, 20])`, `= ANY` becomes an IN list,
+//! `<> ALL` a NOT IN list, and any other comparison an OR (ANY) or AND (ALL)
+//! of one comparison per element. Over a subquery, `= ANY` becomes IN and
+//! `<> ALL` NOT IN, while the other comparisons are made with the subquery's
+//! MIN or MAX: `price > ALL (SELECT ...)` holds when the subquery has no rows
+//! or `price` exceeds its largest value. A NULL among a subquery's values
+//! makes these comparisons false rather than unknown, which filters rows the
+//! same way and only differs under NOT. Over an array column, as in
+//! `'admin' = ANY(roles)`, they are left for the executor to compare with
+//! each row's elements; see [`crate::sql::array`].
+
+use sqlparser::ast::{
+    BinaryOperator, Expr, Function, FunctionArg, FunctionArgExpr, FunctionArgumentList,
+    FunctionArguments, GroupByExpr, Ident, ObjectName, Query, SelectItem, SetExpr, Statement,
+    Value as SqlValue,
+};
+use std::ops::ControlFlow;
+
+use crate::YamlBaseError;
+use crate::sql::array;
+
+/// The statement with its quantified comparisons rewritten, or `None` when it
+/// has none. `is_aggregate` tells the aggregate calls, so a subquery that
+/// computes a single value is compared with directly.
+pub(crate) fn rewrite(
+    statement: &Statement,
+    is_aggregate: fn(&Expr) -> bool,
+) -> crate::Result<Option<Statement>> {
+    let quantified = sqlparser::ast::visit_expressions(statement, |expr| {
+        if matches!(expr, Expr::AnyOp { right, .. } | Expr::AllOp { right, .. } if !per_row(right))
+        {
+            ControlFlow::Break(())
+        } else {
+            ControlFlow::Continue(())
+        }
+    });
+    if quantified.is_continue() {
+        return Ok(None);
+    }
+
+    let mut statement = statement.clone();
+    // Expressions are visited innermost first, so nested quantifiers are
+    // rewritten before the subqueries holding them are copied
+    let result = sqlparser::ast::visit_expressions_mut(&mut statement, |expr| {
+        let rewritten = match &*expr {
+            Expr::AnyOp { right, .. } | Expr::AllOp { right, .. } if per_row(right) => {
+                return ControlFlow::Continue(());
+            }
+            Expr::AnyOp {
+                left,
+                compare_op,
+                right,
+                ..
+            } => Quantifier::Any.rewrite(left, compare_op, right, is_aggregate),
+            Expr::AllOp {
+                left,
+                compare_op,
+                right,
+            } => Quantifier::All.rewrite(left, compare_op, right, is_aggregate),
+            _ => return ControlFlow::Continue(()),
+        };
+        match rewritten {
+            Ok(rewritten) => {
+                *expr = Expr::Nested(Box::new(rewritten));
+                ControlFlow::Continue(())
+            }
+            Err(e) => ControlFlow::Break(e),
+        }
+    });
+    match result {
+        ControlFlow::Break(e) => Err(e),
+        ControlFlow::Continue(()) => Ok(Some(statement)),
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Quantifier {
+    Any,
+    All,
+}
+
+impl Quantifier {
+    fn name(self) -> &'static str {
+        match self {
+            Quantifier::Any => "ANY",
+            Quantifier::All => "ALL",
+        }
+    }
+
+    fn rewrite(
+        self,
+        left: &Expr,
+        op: &BinaryOperator,
+        right: &Expr,
+        is_aggregate: fn(&Expr) -> bool,
+    ) -> crate::Result<Expr> {
+        if let Expr::Subquery(query) = right {
+            return self.over_subquery(left, op, query, is_aggregate);
+        }
+        Ok(match array_elements(right)? {
+            Some(elements) => self.over_array(left, op, elements),
+            // A NULL array compares as NULL
+            None => comparison(left, op, Expr::Value(SqlValue::Null)),
+        })
+    }
+
+    /// `= ANY` and `<> ALL` are IN and NOT IN
+    fn is_membership(self, op: &BinaryOperator) -> bool {
+        matches!(
+            (self, op),
+            (Quantifier::Any, BinaryOperator::Eq) | (Quantifier::All, BinaryOperator::NotEq)
+        )
+    }
+
+    fn over_array(self, left: &Expr, op: &BinaryOperator, elements: Vec<Expr>) -> Expr {
+        if self.is_membership(op) && !elements.is_empty() {
+            return Expr::InList {
+                expr: Box::new(left.clone()),
+                list: elements,
+                negated: self == Quantifier::All,
+            };
+        }
+        let connective = match self {
+            Quantifier::Any => BinaryOperator::Or,
+            Quantifier::All => BinaryOperator::And,
+        };
+        let comparisons = elements
+            .into_iter()
+            .map(|element| comparison(left, op, element))
+            .collect();
+        // No element satisfies ANY, and every element of none satisfies ALL
+        balanced(comparisons, &connective)
+            .unwrap_or(Expr::Value(SqlValue::Boolean(self == Quantifier::All)))
+    }
+
+    fn over_subquery(
+        self,
+        left: &Expr,
+        op: &BinaryOperator,
+        query: &Query,
+        is_aggregate: fn(&Expr) -> bool,
+    ) -> crate::Result<Expr> {
+        if self.is_membership(op) {
+            return Ok(Expr::InSubquery {
+                expr: Box::new(left.clone()),
+                subquery: Box::new(query.clone()),
+                negated: self == Quantifier::All,
+            });
+        }
+
+        let unsupported = || {
+            YamlBaseError::NotImplemented(format!(
+                "{} {} over a subquery needs one ungrouped column and no LIMIT",
+                op,
+                self.name()
+            ))
+        };
+        let SetExpr::Select(select) = query.body.as_ref() else {
+            return Err(unsupported());
+        };
+        let value = match select.projection.as_slice() {
+            [SelectItem::UnnamedExpr(expr)] | [SelectItem::ExprWithAlias { expr, .. }] => expr,
+            _ => return Err(unsupported()),
+        };
+        let grouped = match &select.group_by {
+            GroupByExpr::Expressions(exprs, _) => !exprs.is_empty(),
+            GroupByExpr::All(..) => true,
+        };
+        if grouped
+            || select.having.is_some()
+            || query.limit.is_some()
+            || query.offset.is_some()
+            || query.fetch.is_some()
+        {
+            return Err(unsupported());
+        }
+        // An aggregate without GROUP BY has exactly one value
+        if is_aggregate(value) {
+            return Ok(comparison(
+                left,
+                op,
+                Expr::Subquery(Box::new(query.clone())),
+            ));
+        }
+
+        let extreme = |name: &str| {
+            let mut extreme = query.clone();
+            extreme.order_by = None;
+            if let SetExpr::Select(select) = extreme.body.as_mut() {
+                select.distinct = None;
+                select.projection = vec![SelectItem::UnnamedExpr(aggregate(name, value))];
+            }
+            comparison(left, op, Expr::Subquery(Box::new(extreme)))
+        };
+        let compared = match (self, op) {
+            (Quantifier::All, BinaryOperator::Gt | BinaryOperator::GtEq)
+            | (Quantifier::Any, BinaryOperator::Lt | BinaryOperator::LtEq) => extreme("MAX"),
+            (Quantifier::All, BinaryOperator::Lt | BinaryOperator::LtEq)
+            | (Quantifier::Any, BinaryOperator::Gt | BinaryOperator::GtEq) => extreme("MIN"),
+            // Equal to every value, or different from some, means being
+            // equal to both the smallest and the largest, or not
+            (Quantifier::All, BinaryOperator::Eq) => and(extreme("MIN"), extreme("MAX")),
+            (Quantifier::Any, BinaryOperator::NotEq) => Expr::BinaryOp {
+                left: Box::new(extreme("MIN")),
+                op: BinaryOperator::Or,
+                right: Box::new(extreme("MAX")),
+            },
+            _ => return Err(unsupported()),
+        };
+        if self == Quantifier::Any {
+            return Ok(compared);
+        }
+
+        // ALL holds over no rows, and not when some value is NULL
+        let mut nulls = query.clone();
+        nulls.order_by = None;
+        if let SetExpr::Select(select) = nulls.body.as_mut() {
+            let is_null = Expr::IsNull(Box::new(value.clone()));
+            select.selection = Some(match select.selection.take() {
+                Some(selection) => and(Expr::Nested(Box::new(selection)), is_null),
+                None => is_null,
+            });
+        }
+        let exists = |query: Query| Expr::Exists {
+            subquery: Box::new(query),
+            negated: true,
+        };
+        Ok(Expr::BinaryOp {
+            left: Box::new(exists(query.clone())),
+            op: BinaryOperator::Or,
+            right: Box::new(Expr::Nested(Box::new(and(compared, exists(nulls))))),
+        })
+    }
+}
+
+/// Whether an array operand is only known row by row, as a column or a
+/// function of one is; the executor compares with its elements itself
+fn per_row(expr: &Expr) -> bool {
+    match expr {
+        Expr::Nested(inner) | Expr::Cast { expr: inner, .. } => per_row(inner),
+        Expr::Identifier(_) | Expr::CompoundIdentifier(_) | Expr::Function(_) => true,
+        _ => false,
+    }
+}
+
+/// The elements of an array operand, flattened, or `None` for a NULL array
+fn array_elements(expr: &Expr) -> crate::Result<Option<Vec<Expr>>> {
+    match expr {
+        Expr::Nested(inner) | Expr::Cast { expr: inner, .. } => array_elements(inner),
+        Expr::Value(SqlValue::Null) => Ok(None),
+        // An array literal, as array parameters arrive
+        Expr::Value(SqlValue::SingleQuotedString(literal)) => {
+            let elements = array::parse(literal).ok_or_else(|| YamlBaseError::Database {
+                message: format!("malformed array literal: \"{}\"", literal),
+            })?;
+            Ok(Some(
+                elements
+                    .into_iter()
+                    .map(|element| match element {
+                        Some(text) => Expr::Value(SqlValue::SingleQuotedString(text)),
+                        None => Expr::Value(SqlValue::Null),
+                    })
+                    .collect(),
+            ))
+        }
+        Expr::Array(array) => {
+            let mut elements = Vec::with_capacity(array.elem.len());
+            for element in &array.elem {
+                match element {
+                    Expr::Array(_) => elements.extend(array_elements(element)?.unwrap_or_default()),
+                    element => elements.push(element.clone()),
+                }
+            }
+            Ok(Some(elements))
+        }
+        _ => Err(YamlBaseError::Database {
+            message: "op ANY/ALL (array) requires array on right side".to_string(),
+        }),
+    }
+}
+
+fn comparison(left: &Expr, op: &BinaryOperator, right: Expr) -> Expr {
+    Expr::BinaryOp {
+        left: Box::new(left.clone()),
+        op: op.clone(),
+        right: Box::new(right),
+    }
+}
+
+fn and(left: Expr, right: Expr) -> Expr {
+    Expr::BinaryOp {
+        left: Box::new(left),
+        op: BinaryOperator::And,
+        right: Box::new(right),
+    }
+}
+
+/// The expressions joined by `connective` as a balanced tree, which keeps long
+/// arrays from nesting deeply
+fn balanced(mut exprs: Vec<Expr>, connective: &BinaryOperator) -> Option<Expr> {
+    match exprs.len() {
+        0 => None,
+        1 => exprs.pop(),
+        len => {
+            let right = exprs.split_off(len / 2);
+            Some(Expr::BinaryOp {
+                left: Box::new(balanced(exprs, connective)?),
+                op: connective.clone(),
+                right: Box::new(balanced(right, connective)?),
+            })
+        }
+    }
+}
+
+fn aggregate(name: &str, arg: &Expr) -> Expr {
+    Expr::Function(Function {
+        name: ObjectName(vec![Ident::new(name)]),
+        parameters: FunctionArguments::None,
+        args: FunctionArguments::List(FunctionArgumentList {
+            duplicate_treatment: None,
+            args: vec![FunctionArg::Unnamed(FunctionArgExpr::Expr(arg.clone()))],
+            clauses: vec![],
+        }),
+        filter: None,
+        null_treatment: None,
+        over: None,
+        within_group: vec![],
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parse_sql;
+
+    fn rewritten(sql: &str) -> String {
+        let statement = parse_sql(sql).unwrap().remove(0);
+        rewrite(&statement, |expr| matches!(expr, Expr::Function(_)))
+            .unwrap()
+            .unwrap()
+            .to_string()
+    }
+
+    #[test]
+    fn test_rewrites_over_arrays() {
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE id = ANY('{1,2}')"),
+            "SELECT * FROM t WHERE (id IN ('1', '2'))"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE id <> ALL(ARRAY[1, 2])"),
+            "SELECT * FROM t WHERE (id NOT IN (1, 2))"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE id > SOME(ARRAY[1, 2, 3])"),
+            "SELECT * FROM t WHERE (id > 1 OR id > 2 OR id > 3)"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE id = ANY('{}')"),
+            "SELECT * FROM t WHERE (false)"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE id < ALL(NULL)"),
+            "SELECT * FROM t WHERE (id < NULL)"
+        );
+    }
+
+    #[test]
+    fn test_rewrites_over_subqueries() {
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE id = ANY(SELECT id FROM u)"),
+            "SELECT * FROM t WHERE (id IN (SELECT id FROM u))"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE x > ANY(SELECT y FROM u WHERE z = 1)"),
+            "SELECT * FROM t WHERE (x > (SELECT MIN(y) FROM u WHERE z = 1))"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE x >= ALL(SELECT y FROM u)"),
+            "SELECT * FROM t WHERE (NOT EXISTS (SELECT y FROM u) OR (x >= (SELECT MAX(y) FROM u) \
+             AND NOT EXISTS (SELECT y FROM u WHERE y IS NULL)))"
+        );
+        assert_eq!(
+            rewritten("SELECT * FROM t WHERE x < ALL(SELECT AVG(y) FROM u)"),
+            "SELECT * FROM t WHERE (x < (SELECT AVG(y) FROM u))"
+        );
+    }
+
+    #[test]
+    fn test_unsupported_operands() {
+        let statement = parse_sql("SELECT * FROM t WHERE x > ALL(SELECT y FROM u LIMIT 1)")
+            .unwrap()
+            .remove(0);
+        assert!(rewrite(&statement, |_| false).is_err());
+
+        let statement = parse_sql("SELECT * FROM t WHERE x = ANY(5)")
+            .unwrap()
+            .remove(0);
+        assert!(rewrite(&statement, |_| false).is_err());
+
+        let statement = parse_sql("SELECT * FROM t WHERE 'a' = ANY(t.tags)")
+            .unwrap()
+            .remove(0);
+        assert!(rewrite(&statement, |_| false).unwrap().is_none());
+
+        let statement = parse_sql("SELECT * FROM t WHERE x = 1").unwrap().remove(0);
+        assert!(rewrite(&statement, |_| false).unwrap().is_none());
+    }
+}
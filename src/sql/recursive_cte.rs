@@ -1,7 +1,7 @@
 // Implementation of RECURSIVE CTE support for yamlbase
 use crate::YamlBaseError;
 use crate::database::Database;
-use crate::sql::executor::{QueryExecutor, QueryResult};
+use crate::sql::executor::{QueryExecutor, QueryResult, apply_cte_column_names};
 use sqlparser::ast::{Cte, SetExpr, SetOperator};
 use std::collections::{HashMap, HashSet};
 
@@ -44,9 +44,11 @@ impl QueryExecutor {
         let mut all_rows = Vec::new();
         let mut working_table = match base_query {
             SetExpr::Select(select) => {
-                let result = self
+                let mut result = self
                     .execute_select_with_cte_context(db, select, &cte.query, cte_results)
                     .await?;
+                // The recursive term refers to the CTE by its declared column names
+                apply_cte_column_names(cte, &mut result)?;
                 all_rows.extend(result.rows.clone());
                 result
             }
@@ -0,0 +1,106 @@
+//! `RETURNING` on INSERT, UPDATE and DELETE.
+//!
+//! A write's RETURNING list is the select list of a query over the table it
+//! writes, which runs against just the rows the write left behind: the new
+//! versions of inserted and updated rows, and the rows a DELETE removed. The
+//! returned columns are so named and typed as a SELECT's would be, and a
+//! prepared write can be described from the query before it runs.
+
+use sqlparser::ast::{
+    FromTable, Ident, Insert, ObjectName, Query, SelectItem, SetExpr, Statement, TableFactor,
+};
+
+use crate::sql::parse_sql;
+
+/// The query the RETURNING list of a write stands for, or `None` for a
+/// statement without one
+pub fn returning_query(statement: &Statement) -> Option<Query> {
+    match statement {
+        Statement::Insert(insert) => of_insert(insert),
+        Statement::Update {
+            table, returning, ..
+        } => of_relation(&table.relation, returning.as_deref()?),
+        Statement::Delete(delete) => {
+            let (FromTable::WithFromKeyword(from) | FromTable::WithoutKeyword(from)) = &delete.from;
+            of_relation(&from.first()?.relation, delete.returning.as_deref()?)
+        }
+        _ => None,
+    }
+}
+
+/// The query for the RETURNING list of an INSERT
+pub(crate) fn of_insert(insert: &Insert) -> Option<Query> {
+    select(
+        insert.table_name.0.last()?,
+        insert.table_alias.as_ref(),
+        insert.returning.as_deref()?,
+    )
+}
+
+/// The query for the RETURNING list of an UPDATE or DELETE of `relation`
+pub(crate) fn of_relation(relation: &TableFactor, items: &[SelectItem]) -> Option<Query> {
+    let TableFactor::Table { name, alias, .. } = relation else {
+        return None;
+    };
+    select(
+        name.0.last()?,
+        alias.as_ref().map(|alias| &alias.name),
+        items,
+    )
+}
+
+/// `SELECT items FROM table [AS alias]`
+fn select(table: &Ident, alias: Option<&Ident>, items: &[SelectItem]) -> Option<Query> {
+    let template = match alias {
+        Some(_) => "SELECT * FROM t AS a",
+        None => "SELECT * FROM t",
+    };
+    let Some(Statement::Query(mut query)) = parse_sql(template).ok()?.pop() else {
+        return None;
+    };
+    let SetExpr::Select(select) = query.body.as_mut() else {
+        return None;
+    };
+    select.projection = items.to_vec();
+    if let TableFactor::Table {
+        name,
+        alias: table_alias,
+        ..
+    } = &mut select.from.first_mut()?.relation
+    {
+        *name = ObjectName(vec![table.clone()]);
+        if let (Some(table_alias), Some(alias)) = (table_alias, alias) {
+            table_alias.name = alias.clone();
+        }
+    }
+    Some(*query)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn returning(sql: &str) -> Option<String> {
+        let statement = parse_sql(sql).unwrap().remove(0);
+        returning_query(&statement).map(|query| query.to_string())
+    }
+
+    #[test]
+    fn test_returning_lists_select_from_the_written_table() {
+        assert_eq!(
+            returning("INSERT INTO public.users (name) VALUES ('Ada') RETURNING id, name")
+                .as_deref(),
+            Some("SELECT id, name FROM users")
+        );
+        assert_eq!(
+            returning("UPDATE users AS u SET name = 'Lin' RETURNING u.*").as_deref(),
+            Some("SELECT u.* FROM users AS u")
+        );
+        assert_eq!(
+            returning("DELETE FROM users WHERE id = 1 RETURNING id * 2 AS twice").as_deref(),
+            Some("SELECT id * 2 AS twice FROM users")
+        );
+        assert_eq!(returning("DELETE FROM users"), None);
+        assert_eq!(returning("SELECT 1"), None);
+    }
+}
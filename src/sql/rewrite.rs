@@ -0,0 +1,107 @@
+//! Rewrite rules from `database.rewrites`, which redirect the statements a
+//! client library sends before they run: a catalog query for tables yamlbase
+//! does not have, or a vendor function it does not implement, can be replaced
+//! by SQL it can run or answered with fixed rows.
+//!
+//! A `match` rule's regular expression is searched for in the statement as
+//! yamlbase prints it, the same text the `before_query` hook receives:
+//! keywords upper-cased and tokens single-spaced, identifiers and literals as
+//! the client wrote them. A `statement` rule matches statements that parse to
+//! the same syntax tree as its SQL. Rules are tried in order and the first
+//! that matches applies; the statement it produces is not rewritten again.
+
+use sqlparser::ast::Statement;
+
+use crate::database::{Rewrite, RewriteAction, RewritePattern};
+use crate::script::HookOutcome;
+
+/// What the first rule matching `statement` makes of it
+pub(crate) fn apply(rules: &[Rewrite], statement: &Statement) -> HookOutcome {
+    if rules.is_empty() {
+        return HookOutcome::Continue;
+    }
+    let sql = statement.to_string();
+    for rule in rules {
+        let matched = match &rule.pattern {
+            RewritePattern::Regex(regex) => regex.is_match(&sql),
+            RewritePattern::Statement(pattern) => **pattern == *statement,
+        };
+        if !matched {
+            continue;
+        }
+        return match (&rule.action, &rule.pattern) {
+            (RewriteAction::Replace(replace), RewritePattern::Regex(regex)) => {
+                HookOutcome::Rewrite(regex.replace_all(&sql, replace.as_str()).into_owned())
+            }
+            (RewriteAction::Replace(replace), RewritePattern::Statement(_)) => {
+                HookOutcome::Rewrite(replace.clone())
+            }
+            (RewriteAction::Result { columns, rows }, _) => HookOutcome::Answer {
+                columns: columns.clone(),
+                rows: rows.clone(),
+            },
+        };
+    }
+    HookOutcome::Continue
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Value;
+    use crate::sql::parse_sql;
+
+    fn statement(sql: &str) -> Statement {
+        parse_sql(sql).unwrap().remove(0)
+    }
+
+    #[test]
+    fn test_first_matching_rule_applies() {
+        let regex = |pattern: &str| RewritePattern::Regex(regex::Regex::new(pattern).unwrap());
+        let version = RewriteAction::Result {
+            columns: vec!["version".to_string()],
+            rows: vec![vec![Value::Text("PostgreSQL 16.0".to_string())]],
+        };
+        let rules = vec![
+            Rewrite {
+                pattern: regex(r"\bpg_catalog\.(\w+)"),
+                action: RewriteAction::Replace("$1".to_string()),
+            },
+            Rewrite {
+                pattern: RewritePattern::Statement(Box::new(statement("select version()"))),
+                action: version.clone(),
+            },
+            Rewrite {
+                pattern: regex(r"^SELECT version\(\).*"),
+                action: RewriteAction::Replace("SELECT 1".to_string()),
+            },
+        ];
+
+        assert_eq!(
+            apply(
+                &rules,
+                &statement("SELECT t.typname FROM pg_catalog.pg_type t, pg_catalog.pg_namespace n")
+            ),
+            HookOutcome::Rewrite(
+                "SELECT t.typname FROM pg_type AS t, pg_namespace AS n".to_string()
+            )
+        );
+        let HookOutcome::Answer { columns, rows } = apply(&rules, &statement("SELECT   version()"))
+        else {
+            panic!("not answered");
+        };
+        assert_eq!(RewriteAction::Result { columns, rows }, version);
+        assert_eq!(
+            apply(&rules, &statement("SELECT version() AS v")),
+            HookOutcome::Rewrite("SELECT 1".to_string())
+        );
+        assert_eq!(
+            apply(&rules, &statement("SELECT id FROM users")),
+            HookOutcome::Continue
+        );
+        assert_eq!(
+            apply(&[], &statement("SELECT version()")),
+            HookOutcome::Continue
+        );
+    }
+}
@@ -0,0 +1,347 @@
+//! Row filters ANDed into the queries of a statement, like the row policies
+//! of a production database.
+//!
+//! Every query block reading a filtered table gets the table's filter in its
+//! WHERE clause, or in the ON clause for a joined table so outer joins still
+//! keep their unmatched rows. Two kinds of filter apply:
+//!
+//! - soft deletes, configured per table with `soft_delete`, hide deleted rows
+//!   unless a session opts out with `SET yamlbase.include_deleted = on`;
+//! - tenancy, configured with `database.tenancy`, keeps a tenant user to its
+//!   tenant's rows of the tables with the tenant column.
+
+use sqlparser::ast::{
+    BinaryOperator, Expr, Ident, JoinConstraint, JoinOperator, Query, Select, SetExpr, Statement,
+    TableFactor, Value as SqlValue, VisitMut, VisitorMut,
+};
+use std::ops::ControlFlow;
+
+use crate::YamlBaseError;
+use crate::database::{Database, Table, Value};
+use crate::sql::coercion;
+
+/// Restrict every table with a soft delete filter to its live rows, returning
+/// whether the statement changed
+pub(crate) fn exclude_deleted(statement: &mut Statement, db: &Database) -> bool {
+    restrict(statement, db, |table| {
+        db.soft_deletes
+            .iter()
+            .find(|(name, _)| name.eq_ignore_ascii_case(&table.name))
+            .map(|(_, soft_delete)| soft_delete.filter.clone())
+    })
+}
+
+/// Restrict every table with the tenant column to the tenant's rows, returning
+/// whether the statement changed
+pub(crate) fn restrict_to_tenant(
+    statement: &mut Statement,
+    db: &Database,
+    scope: &TenantScope,
+) -> bool {
+    restrict(statement, db, |table| scope.condition(table))
+}
+
+/// The tenant a session's user stands for
+#[derive(Debug, Clone)]
+pub(crate) struct TenantScope {
+    pub column: String,
+    pub tenant: Value,
+}
+
+impl TenantScope {
+    /// `column = tenant` for a table with the tenant column, or `None` for a
+    /// table every tenant shares
+    pub(crate) fn condition(&self, table: &Table) -> Option<Expr> {
+        let (idx, tenant) = self.tenant_in(table)?;
+        let literal = match tenant {
+            Value::Integer(_) | Value::Float(_) | Value::Double(_) | Value::Decimal(_) => {
+                SqlValue::Number(tenant.to_string(), false)
+            }
+            Value::Boolean(b) => SqlValue::Boolean(b),
+            tenant => SqlValue::SingleQuotedString(tenant.to_string()),
+        };
+        Some(Expr::BinaryOp {
+            left: Box::new(Expr::Identifier(Ident::new(&table.columns[idx].name))),
+            op: BinaryOperator::Eq,
+            right: Box::new(Expr::Value(literal)),
+        })
+    }
+
+    /// Check that a row written by the tenant belongs to it. A new row
+    /// (`claim`) without a tenant is given the session's.
+    pub(crate) fn check_row(
+        &self,
+        table: &Table,
+        row: &mut [Value],
+        claim: bool,
+    ) -> crate::Result<()> {
+        let Some((idx, tenant)) = self.tenant_in(table) else {
+            return Ok(());
+        };
+        if claim && row[idx] == Value::Null {
+            row[idx] = tenant;
+        } else if row[idx] != tenant {
+            return Err(YamlBaseError::Database {
+                message: format!(
+                    "new row violates row-level security policy for table \"{}\"",
+                    table.name
+                ),
+            });
+        }
+        Ok(())
+    }
+
+    /// The tenant column's index and the tenant as a value of its type
+    fn tenant_in(&self, table: &Table) -> Option<(usize, Value)> {
+        let idx = table.get_column_index(&self.column)?;
+        let tenant = coercion::assign(self.tenant.clone(), &table.columns[idx].sql_type)
+            .unwrap_or_else(|_| self.tenant.clone());
+        Some((idx, tenant))
+    }
+}
+
+fn restrict(
+    statement: &mut Statement,
+    db: &Database,
+    condition: impl Fn(&Table) -> Option<Expr>,
+) -> bool {
+    let mut filter = RowFilter {
+        db,
+        condition,
+        ctes: Vec::new(),
+        changed: false,
+    };
+    let _ = statement.visit(&mut filter);
+    filter.changed
+}
+
+struct RowFilter<'a, F> {
+    db: &'a Database,
+    /// The filter a table's rows must satisfy, if any
+    condition: F,
+    /// CTE names of the enclosing queries, which shadow tables of the same name
+    ctes: Vec<Vec<String>>,
+    changed: bool,
+}
+
+impl<F: Fn(&Table) -> Option<Expr>> VisitorMut for RowFilter<'_, F> {
+    type Break = ();
+
+    fn pre_visit_query(&mut self, query: &mut Query) -> ControlFlow<()> {
+        let names = query
+            .with
+            .iter()
+            .flat_map(|with| &with.cte_tables)
+            .map(|cte| cte.alias.name.value.to_lowercase())
+            .collect();
+        self.ctes.push(names);
+        ControlFlow::Continue(())
+    }
+
+    fn post_visit_query(&mut self, query: &mut Query) -> ControlFlow<()> {
+        // Nested queries are visited on their own, so only this block's selects are filtered
+        self.filter_set_expr(&mut query.body);
+        self.ctes.pop();
+        ControlFlow::Continue(())
+    }
+}
+
+impl<F: Fn(&Table) -> Option<Expr>> RowFilter<'_, F> {
+    fn filter_set_expr(&mut self, body: &mut SetExpr) {
+        match body {
+            SetExpr::Select(select) => self.filter_select(select),
+            SetExpr::SetOperation { left, right, .. } => {
+                self.filter_set_expr(left);
+                self.filter_set_expr(right);
+            }
+            _ => {}
+        }
+    }
+
+    fn filter_select(&mut self, select: &mut Select) {
+        // A lone table keeps the filter's column names as written
+        let qualify = select.from.len() > 1 || select.from.iter().any(|t| !t.joins.is_empty());
+        let mut conditions = Vec::new();
+
+        for table in &mut select.from {
+            conditions.extend(self.row_condition(&table.relation, qualify));
+            for join in &mut table.joins {
+                let Some(condition) = self.row_condition(&join.relation, true) else {
+                    continue;
+                };
+                match join_condition_mut(&mut join.join_operator) {
+                    Some(on) => *on = and(on.clone(), condition),
+                    // CROSS and USING joins have no ON clause to extend
+                    None => conditions.push(condition),
+                }
+            }
+        }
+
+        for condition in conditions {
+            select.selection = Some(match select.selection.take() {
+                Some(selection) => and(selection, condition),
+                None => condition,
+            });
+        }
+    }
+
+    /// The filter a table's rows must satisfy, or `None` for a relation
+    /// without one
+    fn row_condition(&mut self, relation: &TableFactor, qualify: bool) -> Option<Expr> {
+        let TableFactor::Table { name, alias, .. } = relation else {
+            return None;
+        };
+        let table_ident = name.0.last()?;
+        let table_name = table_ident.value.to_lowercase();
+        if self.ctes.iter().flatten().any(|cte| *cte == table_name) {
+            return None;
+        }
+        let table = self.db.get_table(&table_ident.value)?;
+
+        let mut filter = (self.condition)(table)?;
+        if qualify {
+            let qualifier = alias
+                .as_ref()
+                .map_or_else(|| table_ident.clone(), |alias| alias.name.clone());
+            let columns: Vec<String> = table
+                .columns
+                .iter()
+                .map(|c| c.name.to_lowercase())
+                .collect();
+            qualify_columns(&mut filter, &qualifier, &columns);
+        }
+        self.changed = true;
+        Some(filter)
+    }
+}
+
+fn join_condition_mut(operator: &mut JoinOperator) -> Option<&mut Expr> {
+    match operator {
+        JoinOperator::Inner(JoinConstraint::On(on))
+        | JoinOperator::LeftOuter(JoinConstraint::On(on))
+        | JoinOperator::RightOuter(JoinConstraint::On(on))
+        | JoinOperator::FullOuter(JoinConstraint::On(on)) => Some(on),
+        _ => None,
+    }
+}
+
+/// Prefix the filter's bare column names with the table's alias, so they stay
+/// unambiguous next to the other tables of a join
+fn qualify_columns(filter: &mut Expr, qualifier: &Ident, columns: &[String]) {
+    let _ = sqlparser::ast::visit_expressions_mut(filter, |expr| {
+        if let Expr::Identifier(ident) = expr {
+            if columns.contains(&ident.value.to_lowercase()) {
+                *expr = Expr::CompoundIdentifier(vec![qualifier.clone(), ident.clone()]);
+            }
+        }
+        ControlFlow::<()>::Continue(())
+    });
+}
+
+fn and(left: Expr, right: Expr) -> Expr {
+    // Parenthesize ORs so the statement still reads as it evaluates
+    let operand = |expr: Expr| match expr {
+        Expr::BinaryOp {
+            op: BinaryOperator::Or,
+            ..
+        } => Box::new(Expr::Nested(Box::new(expr))),
+        expr => Box::new(expr),
+    };
+    Expr::BinaryOp {
+        left: operand(left),
+        op: BinaryOperator::And,
+        right: operand(right),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::{Column, SoftDelete, Table};
+    use crate::sql::parser::{parse_expr, parse_sql};
+    use crate::yaml::schema::SqlType;
+
+    fn database() -> Database {
+        let mut db = Database::new("test".to_string());
+        for name in ["users", "orders"] {
+            let columns = ["id", "user_id", "deleted_at"]
+                .into_iter()
+                .map(|column| Column {
+                    name: column.to_string(),
+                    sql_type: SqlType::Integer,
+                    primary_key: column == "id",
+                    nullable: true,
+                    unique: false,
+                    default: None,
+                    references: None,
+                })
+                .collect();
+            db.add_table(Table::new(name.to_string(), columns)).unwrap();
+        }
+        db.soft_deletes.insert(
+            "users".to_string(),
+            SoftDelete {
+                filter: parse_expr("deleted_at IS NULL").unwrap(),
+            },
+        );
+        db
+    }
+
+    fn rewrite(sql: &str) -> String {
+        let mut statement = parse_sql(sql).unwrap().remove(0);
+        exclude_deleted(&mut statement, &database());
+        statement.to_string()
+    }
+
+    #[test]
+    fn test_filters_are_added_where_the_table_is_read() {
+        assert_eq!(
+            rewrite("SELECT * FROM users WHERE id > 1"),
+            "SELECT * FROM users WHERE id > 1 AND deleted_at IS NULL"
+        );
+        assert_eq!(
+            rewrite("SELECT * FROM orders o LEFT JOIN users u ON u.id = o.user_id"),
+            "SELECT * FROM orders AS o LEFT JOIN users AS u ON u.id = o.user_id AND u.deleted_at IS NULL"
+        );
+        assert_eq!(
+            rewrite("SELECT * FROM users WHERE id = 1 OR id = 2"),
+            "SELECT * FROM users WHERE (id = 1 OR id = 2) AND deleted_at IS NULL"
+        );
+        assert_eq!(
+            rewrite("SELECT * FROM orders WHERE user_id IN (SELECT id FROM users)"),
+            "SELECT * FROM orders WHERE user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)"
+        );
+    }
+
+    #[test]
+    fn test_ctes_shadowing_a_table_are_left_alone() {
+        let sql = "WITH users AS (SELECT * FROM orders) SELECT * FROM users";
+        assert_eq!(rewrite(sql), sql);
+        assert_eq!(rewrite("SELECT * FROM orders"), "SELECT * FROM orders");
+    }
+
+    #[test]
+    fn test_tenant_scope() {
+        let mut db = database();
+        db.soft_deletes.clear();
+        let scope = TenantScope {
+            column: "user_id".to_string(),
+            tenant: Value::Text("7".to_string()),
+        };
+        let mut statement = parse_sql("SELECT * FROM orders WHERE id > 1")
+            .unwrap()
+            .remove(0);
+        assert!(restrict_to_tenant(&mut statement, &db, &scope));
+        assert_eq!(
+            statement.to_string(),
+            "SELECT * FROM orders WHERE id > 1 AND user_id = 7"
+        );
+
+        let orders = db.get_table("orders").unwrap();
+        let mut row = vec![Value::Integer(1), Value::Null, Value::Null];
+        scope.check_row(orders, &mut row, true).unwrap();
+        assert_eq!(row[1], Value::Integer(7));
+        row[1] = Value::Integer(8);
+        assert!(scope.check_row(orders, &mut row, true).is_err());
+    }
+}
@@ -0,0 +1,198 @@
+//! Sequences: `CREATE SEQUENCE` and `DROP SEQUENCE`, PostgreSQL's
+//! `nextval()`, `currval()`, `setval()` and `lastval()`, and MySQL's
+//! `LAST_INSERT_ID()`.
+//!
+//! A sequence is shared by every connection, while `currval()`, `lastval()`
+//! and `LAST_INSERT_ID()` report what the connection itself drew. An
+//! identity column (`SERIAL`, `GENERATED ... AS IDENTITY`, `AUTO_INCREMENT`)
+//! counts as drawing from `<table>_<column>_seq`, the sequence PostgreSQL
+//! would make for it: an INSERT that numbers rows sets that sequence's
+//! `currval()` and `lastval()`, and the first number it gives becomes
+//! `LAST_INSERT_ID()` and the insert id of MySQL's OK packet.
+
+use sqlparser::ast::{Expr, SequenceOptions, UnaryOperator, Value as SqlValue};
+use std::collections::HashMap;
+
+use crate::YamlBaseError;
+use crate::database::Sequence;
+
+/// What a connection drew from sequences and identity columns
+#[derive(Debug, Default)]
+pub(crate) struct Drawn {
+    /// The value last drawn from each sequence, by lower-cased name
+    current: HashMap<String, i64>,
+    last: Option<i64>,
+    last_insert_id: u64,
+    /// The first number the current statement's INSERT gave
+    insert_id: Option<u64>,
+}
+
+impl Drawn {
+    /// Record `value` drawn from `sequence` by `nextval()` or a default
+    pub(crate) fn draw(&mut self, sequence: &str, value: i64) {
+        self.current.insert(sequence.to_lowercase(), value);
+        self.last = Some(value);
+    }
+
+    /// Record `value` given to the identity column `column` of `table`
+    pub(crate) fn number(&mut self, table: &str, column: &str, value: i64) {
+        self.draw(&implicit_name(table, column), value);
+        if self.insert_id.is_none() {
+            self.insert_id = Some(value as u64);
+            self.last_insert_id = value as u64;
+        }
+    }
+
+    /// `currval(sequence)`
+    pub(crate) fn current(&self, sequence: &str) -> crate::Result<i64> {
+        self.current
+            .get(&sequence.to_lowercase())
+            .copied()
+            .ok_or_else(|| YamlBaseError::Database {
+                message: format!(
+                    "currval of sequence \"{}\" is not yet defined in this session",
+                    sequence
+                ),
+            })
+    }
+
+    /// `lastval()`
+    pub(crate) fn last(&self) -> crate::Result<i64> {
+        self.last.ok_or_else(|| YamlBaseError::Database {
+            message: "lastval is not yet defined in this session".to_string(),
+        })
+    }
+
+    pub(crate) fn last_insert_id(&self) -> u64 {
+        self.last_insert_id
+    }
+
+    /// `LAST_INSERT_ID(value)`, which the next `LAST_INSERT_ID()` returns
+    pub(crate) fn set_last_insert_id(&mut self, value: u64) {
+        self.last_insert_id = value;
+    }
+
+    /// Forget the current statement's insert id as the next one starts
+    pub(crate) fn start_statement(&mut self) {
+        self.insert_id = None;
+    }
+
+    pub(crate) fn take_insert_id(&mut self) -> Option<u64> {
+        self.insert_id.take()
+    }
+}
+
+/// The name of the sequence PostgreSQL makes for a `SERIAL` column
+pub(crate) fn implicit_name(table: &str, column: &str) -> String {
+    format!("{}_{}_seq", table, column).to_lowercase()
+}
+
+/// The sequence `CREATE SEQUENCE` options describe. `START WITH` defaults
+/// to 1, or -1 for a descending sequence; `MINVALUE`, `MAXVALUE`, `CACHE`
+/// and `CYCLE` are accepted but not enforced.
+pub(crate) fn plan(options: &[SequenceOptions]) -> crate::Result<Sequence> {
+    let mut increment = 1;
+    let mut start = None;
+    for option in options {
+        match option {
+            SequenceOptions::IncrementBy(expr, _) => increment = integer(expr)?,
+            SequenceOptions::StartWith(expr, _) => start = Some(integer(expr)?),
+            _ => {}
+        }
+    }
+    if increment == 0 {
+        return Err(YamlBaseError::Database {
+            message: "INCREMENT must not be zero".to_string(),
+        });
+    }
+    let start = start.unwrap_or(if increment > 0 { 1 } else { -1 });
+    Ok(Sequence::new(start, increment))
+}
+
+/// The sequence a literal argument such as `'orders_id_seq'` or
+/// `'public.orders_id_seq'::regclass` names, without its schema
+pub(crate) fn sequence_name(expr: &Expr) -> Option<String> {
+    match expr {
+        Expr::Cast { expr, .. } | Expr::Nested(expr) => sequence_name(expr),
+        Expr::Value(SqlValue::SingleQuotedString(name)) => Some(unqualified(name)),
+        _ => None,
+    }
+}
+
+/// `name` without the schema a `public.name` argument gives it
+pub(crate) fn unqualified(name: &str) -> String {
+    name.rsplit('.')
+        .next()
+        .unwrap_or(name)
+        .trim_matches('"')
+        .to_string()
+}
+
+fn integer(expr: &Expr) -> crate::Result<i64> {
+    let parsed = match expr {
+        Expr::Value(SqlValue::Number(number, _)) => number.parse().ok(),
+        Expr::UnaryOp {
+            op: UnaryOperator::Minus,
+            expr,
+        } => match expr.as_ref() {
+            Expr::Value(SqlValue::Number(number, _)) => {
+                number.parse::<i64>().ok().map(|value| -value)
+            }
+            _ => None,
+        },
+        _ => None,
+    };
+    parsed.ok_or_else(|| YamlBaseError::Database {
+        message: format!("Invalid sequence option value: {}", expr),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::sql::parse_sql;
+    use sqlparser::ast::Statement;
+
+    fn planned(sql: &str) -> Sequence {
+        match parse_sql(sql).unwrap().remove(0) {
+            Statement::CreateSequence {
+                sequence_options, ..
+            } => plan(&sequence_options).unwrap(),
+            other => panic!("not CREATE SEQUENCE: {}", other),
+        }
+    }
+
+    #[test]
+    fn test_sequence_options() {
+        assert_eq!(planned("CREATE SEQUENCE s"), Sequence::new(1, 1));
+        assert_eq!(
+            planned("CREATE SEQUENCE s INCREMENT BY 10 START WITH 100 CACHE 20"),
+            Sequence::new(100, 10)
+        );
+        assert_eq!(
+            planned("CREATE SEQUENCE s INCREMENT BY -1"),
+            Sequence::new(-1, -1)
+        );
+    }
+
+    #[test]
+    fn test_identities_draw_from_their_implicit_sequence() {
+        let mut drawn = Drawn::default();
+        assert!(drawn.last().is_err());
+
+        drawn.start_statement();
+        drawn.number("Orders", "id", 7);
+        drawn.number("Orders", "id", 8);
+        assert_eq!(drawn.current("orders_id_seq").unwrap(), 8);
+        assert_eq!(drawn.last().unwrap(), 8);
+        assert_eq!(drawn.take_insert_id(), Some(7));
+        assert_eq!(drawn.last_insert_id(), 7);
+
+        drawn.start_statement();
+        drawn.draw("invoice_no", 100);
+        assert_eq!(drawn.take_insert_id(), None);
+        assert_eq!(drawn.last_insert_id(), 7);
+        assert_eq!(drawn.last().unwrap(), 100);
+        assert!(drawn.current("ledger_no").is_err());
+    }
+}
@@ -0,0 +1,160 @@
+//! Tables a connection uploads for itself with `SET yamlbase.dataset`.
+//!
+//! The value is YAML in the `tables:` format of a dataset file; its tables
+//! are visible to the uploading session only, shadow shared tables of the
+//! same name, and are gone when the session ends or runs
+//! `SET yamlbase.dataset = DEFAULT`. A statement that only touches uploaded
+//! tables runs against them like any other, writes included; a query that
+//! also reads shared tables runs against a scratch copy of both, and a write
+//! that mixes the two is refused.
+
+use indexmap::IndexMap;
+use serde::Deserialize;
+use sqlparser::ast::{DollarQuotedString, Expr, Value as SqlValue};
+
+use crate::YamlBaseError;
+use crate::database::{Database, Table};
+use crate::yaml::YamlTable;
+use crate::yaml::parser::build_table;
+
+/// The part of an uploaded dataset that is read; a `database` section, as
+/// a whole dataset file has, is ignored
+#[derive(Deserialize)]
+struct Upload {
+    tables: IndexMap<String, YamlTable>,
+}
+
+/// Which dataset a statement's tables are in
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum Route {
+    /// None of them were uploaded
+    Shared,
+    /// All of them were uploaded, or are unknown to the shared dataset
+    Session,
+    /// Some were uploaded and some are shared
+    Both,
+}
+
+/// The YAML a `SET yamlbase.dataset` assigns, or `None` for `DEFAULT`
+pub(crate) fn assigned_yaml(value: &[Expr]) -> crate::Result<Option<&str>> {
+    match value {
+        [
+            Expr::Value(
+                SqlValue::SingleQuotedString(yaml)
+                | SqlValue::EscapedStringLiteral(yaml)
+                | SqlValue::DoubleQuotedString(yaml)
+                | SqlValue::DollarQuotedString(DollarQuotedString { value: yaml, .. }),
+            ),
+        ] => Ok(Some(yaml)),
+        [Expr::Identifier(ident)] if ident.value.eq_ignore_ascii_case("default") => Ok(None),
+        _ => Err(YamlBaseError::Database {
+            message: "yamlbase.dataset takes a YAML string or DEFAULT".to_string(),
+        }),
+    }
+}
+
+/// The tables of an uploaded dataset, with their rows
+pub(crate) fn parse_tables(yaml: &str) -> crate::Result<Vec<Table>> {
+    let upload: Upload = serde_yaml::from_str(yaml)?;
+    upload
+        .tables
+        .iter()
+        .map(|(name, table)| build_table(name, table))
+        .collect()
+}
+
+/// Where the tables a statement references are
+pub(crate) fn route(referenced: &[String], session: &Database, shared: &Database) -> Route {
+    let uploaded = referenced
+        .iter()
+        .filter(|name| session.get_table(name).is_some())
+        .count();
+    if uploaded == 0 {
+        return Route::Shared;
+    }
+    let shared_only = referenced
+        .iter()
+        .any(|name| session.get_table(name).is_none() && shared.get_table(name).is_some());
+    match shared_only {
+        true => Route::Both,
+        false => Route::Session,
+    }
+}
+
+/// A scratch database holding the referenced tables, the uploaded ones
+/// taking the place of shared tables of the same name
+pub(crate) fn combine(referenced: &[String], session: &Database, shared: &Database) -> Database {
+    let mut combined = Database::new(shared.name.clone());
+    for name in referenced {
+        if combined.get_table(name).is_some() {
+            continue;
+        }
+        if let Some(table) = session.get_table(name).or_else(|| shared.get_table(name)) {
+            combined.tables.insert(table.name.clone(), table.clone());
+        }
+    }
+    combined
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const UPLOAD: &str = r#"
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "TEXT"
+    data:
+      - id: 7
+        name: "Mallory"
+"#;
+
+    fn database(tables: Vec<Table>) -> Database {
+        let mut db = Database::new("test".to_string());
+        for table in tables {
+            db.add_table(table).unwrap();
+        }
+        db
+    }
+
+    #[test]
+    fn test_uploads_hold_tables() {
+        let tables = parse_tables(UPLOAD).unwrap();
+        assert_eq!(tables.len(), 1);
+        assert_eq!(tables[0].name, "users");
+        assert_eq!(tables[0].rows.len(), 1);
+
+        let with_header = format!("database:\n  name: \"ignored\"\n{}", UPLOAD);
+        assert_eq!(parse_tables(&with_header).unwrap().len(), 1);
+        assert!(parse_tables("users: []").is_err());
+    }
+
+    #[test]
+    fn test_routes_by_where_tables_are() {
+        let session = database(parse_tables(UPLOAD).unwrap());
+        let shared = database(vec![
+            Table::new("users".to_string(), vec![]),
+            Table::new("orders".to_string(), vec![]),
+        ]);
+        let names = |names: &[&str]| {
+            names
+                .iter()
+                .map(|name| name.to_string())
+                .collect::<Vec<_>>()
+        };
+
+        assert_eq!(route(&names(&["orders"]), &session, &shared), Route::Shared);
+        assert_eq!(
+            route(&names(&["USERS", "recent"]), &session, &shared),
+            Route::Session
+        );
+        let both = names(&["users", "orders"]);
+        assert_eq!(route(&both, &session, &shared), Route::Both);
+
+        let combined = combine(&both, &session, &shared);
+        assert_eq!(combined.get_table("users").unwrap().rows.len(), 1);
+        assert!(combined.get_table("orders").is_some());
+    }
+}
@@ -0,0 +1,201 @@
+//! MySQL's `sql_mode`.
+//!
+//! A MySQL session's `SET sql_mode = '...'` changes what its statements
+//! accept. `ONLY_FULL_GROUP_BY` refuses a select list column that is neither
+//! grouped by nor aggregated; without it the column has the value of one of
+//! the group's rows, the first. `STRICT_TRANS_TABLES` (or
+//! `STRICT_ALL_TABLES`) refuses a value that does not fit its column, such as
+//! `'abc'` in an `INT` or text longer than a `VARCHAR(n)`; without it numbers
+//! are read from the start of the text, `'12abc'` as 12 and `'abc'` as 0, and
+//! text is cut to the column's length. `ANSI_QUOTES` and
+//! `NO_BACKSLASH_ESCAPES` change how strings read, see [`literals`]. MySQL
+//! 8.0's default modes are strict and need full GROUP BYs, as PostgreSQL
+//! always does.
+//!
+//! [`literals`]: crate::sql::literals
+
+use crate::YamlBaseError;
+use crate::database::{Column, Value, numeric};
+use crate::sql::coercion;
+use crate::yaml::schema::SqlType;
+
+/// The modes of an `sql_mode` that yamlbase follows
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct SqlMode {
+    pub only_full_group_by: bool,
+    pub strict: bool,
+    pub ansi_quotes: bool,
+    pub backslash_escapes: bool,
+}
+
+impl Default for SqlMode {
+    fn default() -> Self {
+        Self {
+            only_full_group_by: true,
+            strict: true,
+            ansi_quotes: false,
+            backslash_escapes: true,
+        }
+    }
+}
+
+impl SqlMode {
+    /// Read a comma separated `sql_mode`, such as
+    /// `'STRICT_TRANS_TABLES,ANSI_QUOTES'`; `ANSI` and `TRADITIONAL` stand
+    /// for the modes they combine, and modes yamlbase does not follow are
+    /// accepted and ignored
+    pub(crate) fn parse(sql_mode: &str) -> Self {
+        let modes: Vec<String> = sql_mode
+            .split(',')
+            .map(|mode| mode.trim().to_uppercase())
+            .collect();
+        let has = |names: &[&str]| modes.iter().any(|mode| names.contains(&mode.as_str()));
+        Self {
+            only_full_group_by: has(&["ONLY_FULL_GROUP_BY", "ANSI"]),
+            strict: has(&["STRICT_TRANS_TABLES", "STRICT_ALL_TABLES", "TRADITIONAL"]),
+            ansi_quotes: has(&["ANSI_QUOTES", "ANSI"]),
+            backslash_escapes: !has(&["NO_BACKSLASH_ESCAPES"]),
+        }
+    }
+}
+
+/// Convert a value an `INSERT` or `UPDATE` stores into `column`, as
+/// [`coercion::assign`] does, refusing text longer than a `CHAR(n)` or
+/// `VARCHAR(n)` column holds; outside strict mode a value that does not
+/// convert or fit is made to, where MySQL would
+pub(crate) fn store(value: Value, column: &Column, mode: SqlMode) -> crate::Result<Value> {
+    let value = if mode.strict {
+        coercion::assign(value, &column.sql_type)?
+    } else {
+        match coercion::assign(value.clone(), &column.sql_type) {
+            Ok(value) => value,
+            Err(e) => lenient(&value, &column.sql_type).ok_or(e)?,
+        }
+    };
+    let size = match &column.sql_type {
+        SqlType::Char(size) | SqlType::Varchar(size) => *size,
+        _ => return Ok(value),
+    };
+    match value {
+        Value::Text(text) if text.chars().count() > size => {
+            if mode.strict {
+                return Err(YamlBaseError::Database {
+                    message: format!(
+                        "Data too long for column '{}': it holds at most {} characters",
+                        column.name, size
+                    ),
+                });
+            }
+            Ok(Value::Text(text.chars().take(size).collect()))
+        }
+        value => Ok(value),
+    }
+}
+
+/// The value non-strict MySQL stores for text that does not read as a
+/// number of a numeric column: the number it starts with, or 0
+fn lenient(value: &Value, sql_type: &SqlType) -> Option<Value> {
+    let Value::Text(text) = value else {
+        return None;
+    };
+    let number = leading_number(text);
+    match sql_type {
+        SqlType::Integer | SqlType::BigInt => Some(Value::Integer(number.round() as i64)),
+        SqlType::Float => Some(Value::Float(number as f32)),
+        SqlType::Double => Some(Value::Double(number)),
+        SqlType::Decimal(precision, scale) => numeric::from_f64(number)
+            .and_then(|d| numeric::fit(d, *precision, *scale).ok())
+            .map(Value::Decimal),
+        _ => None,
+    }
+}
+
+/// The number at the start of `text`, as in `'12.5kg'`, or 0 if there is none
+fn leading_number(text: &str) -> f64 {
+    let text = text.trim_start();
+    let bytes = text.as_bytes();
+    let digits = |mut end: usize| {
+        while bytes.get(end).is_some_and(u8::is_ascii_digit) {
+            end += 1;
+        }
+        end
+    };
+    let mut end = digits(usize::from(matches!(bytes.first(), Some(b'+' | b'-'))));
+    if bytes.get(end) == Some(&b'.') {
+        end = digits(end + 1);
+    }
+    if matches!(bytes.get(end), Some(b'e' | b'E')) {
+        let sign = usize::from(matches!(bytes.get(end + 1), Some(b'+' | b'-')));
+        if bytes.get(end + 1 + sign).is_some_and(u8::is_ascii_digit) {
+            end = digits(end + 1 + sign);
+        }
+    }
+    text[..end].parse().unwrap_or(0.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn column(name: &str, sql_type: SqlType) -> Column {
+        Column {
+            name: name.to_string(),
+            sql_type,
+            primary_key: false,
+            nullable: true,
+            unique: false,
+            default: None,
+            references: None,
+        }
+    }
+
+    #[test]
+    fn test_modes_are_read_from_sql_mode() {
+        assert_eq!(
+            SqlMode::parse(
+                "ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ZERO_DATE,ERROR_FOR_DIVISION_BY_ZERO,NO_ENGINE_SUBSTITUTION"
+            ),
+            SqlMode::default()
+        );
+        let ansi = SqlMode::parse("ansi, no_backslash_escapes");
+        assert!(ansi.only_full_group_by && ansi.ansi_quotes);
+        assert!(!ansi.strict && !ansi.backslash_escapes);
+        let empty = SqlMode::parse("");
+        assert!(!empty.only_full_group_by && !empty.strict && empty.backslash_escapes);
+        assert!(SqlMode::parse("TRADITIONAL").strict);
+    }
+
+    #[test]
+    fn test_values_are_stored_strictly_or_made_to_fit() {
+        let age = column("age", SqlType::Integer);
+        let code = column("code", SqlType::Varchar(3));
+        let text = |s: &str| Value::Text(s.to_string());
+        let strict = SqlMode::default();
+        let lenient = SqlMode::parse("");
+
+        assert_eq!(store(text("42"), &age, strict).unwrap(), Value::Integer(42));
+        assert!(store(text("12abc"), &age, strict).is_err());
+        let error = store(text("abcd"), &code, strict).unwrap_err();
+        assert!(
+            error
+                .to_string()
+                .contains("Data too long for column 'code'")
+        );
+
+        assert_eq!(
+            store(text("12abc"), &age, lenient).unwrap(),
+            Value::Integer(12)
+        );
+        assert_eq!(
+            store(text("abc"), &age, lenient).unwrap(),
+            Value::Integer(0)
+        );
+        assert_eq!(
+            store(text(" -2.5e1x"), &age, lenient).unwrap(),
+            Value::Integer(-25)
+        );
+        assert_eq!(store(text("abcd"), &code, lenient).unwrap(), text("abc"));
+        assert_eq!(store(text("abc"), &code, strict).unwrap(), text("abc"));
+        assert!(store(text("someday"), &column("at", SqlType::Date), lenient).is_err());
+    }
+}
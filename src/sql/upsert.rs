@@ -0,0 +1,326 @@
+//! Upserts: PostgreSQL's `INSERT ... ON CONFLICT` and MySQL's
+//! `INSERT ... ON DUPLICATE KEY UPDATE`.
+//!
+//! A row conflicts with a row of the table, or one the statement inserted
+//! before it, that has the same values on a unique key: the primary key, a
+//! UNIQUE column or a unique index. NULLs never conflict. `ON CONFLICT
+//! (columns)` names the key, which must be one of these over exactly those
+//! columns, and `ON CONFLICT ON CONSTRAINT` names a unique index or the
+//! primary key as `<table>_pkey`; without a target, and for MySQL, any
+//! unique key counts. The update's assignments and WHERE clause see the
+//! existing row, with `EXCLUDED.column` (PostgreSQL) or `VALUES(column)`
+//! (MySQL) giving the value the row proposed.
+
+use sqlparser::ast::{
+    ConflictTarget, Expr, FunctionArg, FunctionArgExpr, FunctionArguments, Ident, OnConflictAction,
+    OnInsert,
+};
+use std::ops::ControlFlow;
+
+use crate::YamlBaseError;
+use crate::database::{Table, Value};
+
+/// What an INSERT does with the rows that conflict
+pub(crate) struct Upsert {
+    /// The positions of the columns of each key a row can conflict on
+    keys: Vec<Vec<usize>>,
+    pub(crate) action: UpsertAction,
+}
+
+pub(crate) enum UpsertAction {
+    /// `DO NOTHING`: skip the row
+    Nothing,
+    /// `DO UPDATE SET ...` or `ON DUPLICATE KEY UPDATE ...`
+    Update {
+        /// Column positions and values, with the proposed row's columns
+        /// bound to those of `excluded`
+        assignments: Vec<(usize, Expr)>,
+        selection: Option<Expr>,
+        /// The table's columns followed by the proposed row's, which the
+        /// assignments are evaluated against
+        excluded: Table,
+        /// Whether updating a row twice is an error, as it is in PostgreSQL
+        once: bool,
+    },
+}
+
+impl Upsert {
+    pub(crate) fn plan(table: &Table, on: &OnInsert) -> crate::Result<Self> {
+        let (keys, action) = match on {
+            OnInsert::DuplicateKeyUpdate(assignments) => (
+                unique_keys(table),
+                update(table, &assignments_of(table, assignments)?, None, false),
+            ),
+            OnInsert::OnConflict(on_conflict) => {
+                let keys = match &on_conflict.conflict_target {
+                    None => unique_keys(table),
+                    Some(ConflictTarget::Columns(columns)) => vec![key_over(table, columns)?],
+                    Some(ConflictTarget::OnConstraint(name)) => {
+                        vec![key_named(table, &super::ddl::object_name(name))?]
+                    }
+                };
+                let action = match &on_conflict.action {
+                    OnConflictAction::DoNothing => UpsertAction::Nothing,
+                    OnConflictAction::DoUpdate(do_update) => {
+                        if on_conflict.conflict_target.is_none() {
+                            return Err(YamlBaseError::Database {
+                                message: "ON CONFLICT DO UPDATE requires inference specification or constraint name".to_string(),
+                            });
+                        }
+                        update(
+                            table,
+                            &assignments_of(table, &do_update.assignments)?,
+                            do_update.selection.as_ref(),
+                            true,
+                        )
+                    }
+                };
+                (keys, action)
+            }
+            _ => {
+                return Err(YamlBaseError::NotImplemented(
+                    "This INSERT ... ON clause is not supported".to_string(),
+                ));
+            }
+        };
+        Ok(Self { keys, action })
+    }
+
+    /// The position among `rows` of the first row `row` conflicts with
+    pub(crate) fn conflict<'r>(
+        &self,
+        row: &[Value],
+        rows: impl IntoIterator<Item = &'r [Value]>,
+    ) -> Option<usize> {
+        let keys: Vec<&Vec<usize>> = self
+            .keys
+            .iter()
+            .filter(|key| key.iter().all(|&idx| row[idx] != Value::Null))
+            .collect();
+        if keys.is_empty() {
+            return None;
+        }
+        rows.into_iter().position(|other| {
+            keys.iter()
+                .any(|key| key.iter().all(|&idx| other[idx] == row[idx]))
+        })
+    }
+}
+
+/// The existing row followed by the proposed one, as the columns of
+/// [`UpsertAction::Update`]'s `excluded` table lay them out
+pub(crate) fn excluded_row(existing: &[Value], proposed: &[Value]) -> Vec<Value> {
+    existing.iter().chain(proposed).cloned().collect()
+}
+
+fn update(
+    table: &Table,
+    assignments: &[(usize, &Expr)],
+    selection: Option<&Expr>,
+    once: bool,
+) -> UpsertAction {
+    let mut columns = table.columns.clone();
+    columns.extend(table.columns.iter().map(|column| {
+        let mut excluded = column.clone();
+        excluded.name = excluded_name(&column.name);
+        excluded.primary_key = false;
+        excluded
+    }));
+    UpsertAction::Update {
+        assignments: assignments
+            .iter()
+            .map(|&(idx, expr)| (idx, bind_excluded(expr)))
+            .collect(),
+        selection: selection.map(bind_excluded),
+        excluded: Table::new(table.name.clone(), columns),
+        once,
+    }
+}
+
+fn assignments_of<'a>(
+    table: &Table,
+    assignments: &'a [sqlparser::ast::Assignment],
+) -> crate::Result<Vec<(usize, &'a Expr)>> {
+    super::executor::update_targets(table, assignments)
+}
+
+/// A name no column of the table can have, since it is not an identifier
+fn excluded_name(column: &str) -> String {
+    format!("excluded.{}", column.to_lowercase())
+}
+
+/// The expression with `EXCLUDED.column` and `VALUES(column)` naming the
+/// proposed row's columns
+fn bind_excluded(expr: &Expr) -> Expr {
+    let mut bound = expr.clone();
+    let _ = sqlparser::ast::visit_expressions_mut(&mut bound, |expr| {
+        let column = match expr {
+            Expr::CompoundIdentifier(parts)
+                if parts.len() == 2 && parts[0].value.eq_ignore_ascii_case("excluded") =>
+            {
+                Some(parts[1].value.clone())
+            }
+            Expr::Function(function)
+                if function.name.to_string().eq_ignore_ascii_case("VALUES") =>
+            {
+                match &function.args {
+                    FunctionArguments::List(list) => match list.args.as_slice() {
+                        [FunctionArg::Unnamed(FunctionArgExpr::Expr(Expr::Identifier(ident)))] => {
+                            Some(ident.value.clone())
+                        }
+                        _ => None,
+                    },
+                    _ => None,
+                }
+            }
+            _ => None,
+        };
+        if let Some(column) = column {
+            *expr = Expr::Identifier(Ident::new(excluded_name(&column)));
+        }
+        ControlFlow::<()>::Continue(())
+    });
+    bound
+}
+
+/// Every key of the table: its primary key, UNIQUE columns and unique indexes
+fn unique_keys(table: &Table) -> Vec<Vec<usize>> {
+    let mut keys: Vec<Vec<usize>> = table
+        .columns
+        .iter()
+        .enumerate()
+        .filter(|(_, column)| column.primary_key || column.unique)
+        .map(|(idx, _)| vec![idx])
+        .collect();
+    for index in table.indexes.iter().filter(|index| index.unique) {
+        if let Some(key) = positions(table, &index.columns) {
+            if !keys.contains(&key) {
+                keys.push(key);
+            }
+        }
+    }
+    keys
+}
+
+fn positions(table: &Table, columns: &[String]) -> Option<Vec<usize>> {
+    columns
+        .iter()
+        .map(|column| table.get_column_index(column))
+        .collect()
+}
+
+/// The key `ON CONFLICT (columns)` names
+fn key_over(table: &Table, columns: &[Ident]) -> crate::Result<Vec<usize>> {
+    let names: Vec<String> = columns.iter().map(|ident| ident.value.clone()).collect();
+    let mut key = positions(table, &names).ok_or_else(no_matching_constraint)?;
+    key.sort_unstable();
+    unique_keys(table)
+        .into_iter()
+        .find(|unique| {
+            let mut unique = unique.clone();
+            unique.sort_unstable();
+            unique == key
+        })
+        .ok_or_else(no_matching_constraint)
+}
+
+/// The key `ON CONFLICT ON CONSTRAINT name` names
+fn key_named(table: &Table, name: &str) -> crate::Result<Vec<usize>> {
+    if name.eq_ignore_ascii_case(&format!("{}_pkey", table.name)) {
+        if let Some(idx) = table.primary_key_index {
+            return Ok(vec![idx]);
+        }
+    }
+    table
+        .indexes
+        .iter()
+        .find(|index| index.unique && index.name.eq_ignore_ascii_case(name))
+        .and_then(|index| positions(table, &index.columns))
+        .ok_or_else(|| YamlBaseError::Database {
+            message: format!(
+                "constraint \"{}\" for table \"{}\" does not exist",
+                name, table.name
+            ),
+        })
+}
+
+fn no_matching_constraint() -> YamlBaseError {
+    YamlBaseError::Database {
+        message:
+            "there is no unique or exclusion constraint matching the ON CONFLICT specification"
+                .to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Column;
+    use crate::sql::parser::parse_expr;
+    use crate::yaml::schema::SqlType;
+
+    fn table() -> Table {
+        let column = |name: &str, primary_key: bool, unique: bool| Column {
+            name: name.to_string(),
+            sql_type: SqlType::Integer,
+            primary_key,
+            nullable: !primary_key,
+            unique,
+            default: None,
+            references: None,
+        };
+        Table::new(
+            "users".to_string(),
+            vec![
+                column("id", true, false),
+                column("email", false, true),
+                column("visits", false, false),
+            ],
+        )
+    }
+
+    #[test]
+    fn test_conflicts_are_found_on_unique_keys() {
+        let table = table();
+        let upsert = Upsert {
+            keys: unique_keys(&table),
+            action: UpsertAction::Nothing,
+        };
+        let rows = [
+            vec![Value::Integer(1), Value::Integer(10), Value::Integer(0)],
+            vec![Value::Integer(2), Value::Null, Value::Integer(0)],
+        ];
+        let rows = || rows.iter().map(Vec::as_slice);
+        let row = |id, email| vec![id, email, Value::Integer(0)];
+
+        assert_eq!(
+            upsert.conflict(&row(Value::Integer(2), Value::Integer(11)), rows()),
+            Some(1)
+        );
+        assert_eq!(
+            upsert.conflict(&row(Value::Integer(3), Value::Integer(10)), rows()),
+            Some(0)
+        );
+        assert_eq!(
+            upsert.conflict(&row(Value::Integer(3), Value::Null), rows()),
+            None
+        );
+
+        assert_eq!(key_over(&table, &[Ident::new("EMAIL")]).unwrap(), [1]);
+        assert!(key_over(&table, &[Ident::new("visits")]).is_err());
+        assert_eq!(key_named(&table, "users_pkey").unwrap(), [0]);
+        assert!(key_named(&table, "users_email_key").is_err());
+    }
+
+    #[test]
+    fn test_excluded_values_are_bound() {
+        assert_eq!(
+            bind_excluded(&parse_expr("visits + EXCLUDED.visits").unwrap()).to_string(),
+            "visits + excluded.visits"
+        );
+        assert_eq!(
+            bind_excluded(&parse_expr("VALUES(Visits) * 2").unwrap()).to_string(),
+            "excluded.visits * 2"
+        );
+    }
+}
@@ -1,12 +1,17 @@
 pub mod parser;
 pub mod schema;
+pub mod validate;
 pub mod watcher;
+pub mod writer;
 
 #[cfg(test)]
 mod tests;
 
-pub use parser::parse_yaml_database;
+pub use parser::{
+    dataset_checksum, find_dataset_file, load_yaml_database, load_yaml_str, parse_yaml_database,
+};
 pub use schema::{AuthConfig, YamlColumn, YamlDatabase, YamlTable};
+pub use validate::{DATASET_JSON_SCHEMA, ValidationIssue, validate_yaml_str};
 pub use watcher::FileWatcher;
 
 // For fuzzing
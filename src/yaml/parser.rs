@@ -1,81 +1,548 @@
 use indexmap::IndexMap;
-use std::path::Path;
-use tracing::{debug, info};
+use sha2::{Digest, Sha256};
+use sqlparser::ast::{BinaryOperator, Expr, Ident, Value as SqlValue};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use tracing::{debug, info, warn};
 
-use crate::database::{Column, Database, Table, Value as DbValue};
-use crate::yaml::schema::{AuthConfig, SqlType, YamlColumn, YamlDatabase};
+use crate::database::clock::parse_timestamp;
+use crate::database::numeric;
+use crate::database::timezone::parse_instant;
+use crate::database::{
+    Annotation, Column, Database, Expiry, Rewrite, RewriteAction, RewritePattern, SoftDelete,
+    Table, Tenancy, TenantUser, Value as DbValue,
+};
+use crate::script::ScriptEngine;
+use crate::sql::geo::Point;
+use crate::sql::hstore::Hstore;
+use crate::sql::{array, bytea, enums};
+use crate::yaml::schema::{
+    AuthConfig, DatabaseInfo, SqlType, YamlAnnotation, YamlColumn, YamlDatabase, YamlExpiry,
+    YamlRewrite, YamlSoftDelete, YamlTable, YamlTenancy,
+};
 
 pub async fn parse_yaml_database(path: &Path) -> crate::Result<(Database, Option<AuthConfig>)> {
+    load_yaml_database(path, false).await
+}
+
+/// Parse a dataset file. With `skip_invalid`, a table that fails to load is left
+/// out and recorded in [`Database::errored_tables`] instead of failing the whole file.
+pub async fn load_yaml_database(
+    path: &Path,
+    skip_invalid: bool,
+) -> crate::Result<(Database, Option<AuthConfig>)> {
     info!("Parsing YAML database from: {}", path.display());
 
     let content = tokio::fs::read_to_string(path).await?;
-    let yaml_db: YamlDatabase = serde_yaml::from_str(&content)?;
+    load_yaml_str(&content, skip_invalid)
+}
+
+/// Parse dataset file contents that were already read, recording their checksum
+pub fn load_yaml_str(
+    content: &str,
+    skip_invalid: bool,
+) -> crate::Result<(Database, Option<AuthConfig>)> {
+    let yaml_db: YamlDatabase = serde_yaml::from_str(content)?;
+    let (mut database, auth) = build_database_with(&yaml_db, skip_invalid)?;
+    database.checksum = Some(dataset_checksum(content.as_bytes()));
+    Ok((database, auth))
+}
+
+/// Hex SHA-256 of dataset file contents
+pub fn dataset_checksum(content: &[u8]) -> String {
+    hex::encode(Sha256::digest(content))
+}
+
+/// Pick the dataset file in `dir` that serves `database`: the one named
+/// `<database>.yaml` (or `.yml`), or else the one declaring that database name
+pub async fn find_dataset_file(dir: &Path, database: Option<&str>) -> crate::Result<PathBuf> {
+    /// Only the `database` section of a dataset file
+    #[derive(serde::Deserialize)]
+    struct Header {
+        database: DatabaseInfo,
+    }
 
+    let mut files = Vec::new();
+    let mut entries = tokio::fs::read_dir(dir).await?;
+    while let Some(entry) = entries.next_entry().await? {
+        let path = entry.path();
+        if matches!(
+            path.extension().and_then(|ext| ext.to_str()),
+            Some("yaml" | "yml")
+        ) {
+            files.push(path);
+        }
+    }
+    files.sort();
+
+    // File names are checked first so that large suites are not parsed
+    if let Some(name) = database {
+        if let Some(path) = files
+            .iter()
+            .find(|path| path.file_stem().and_then(|stem| stem.to_str()) == Some(name))
+        {
+            return Ok(path.clone());
+        }
+    }
+
+    let mut declared = Vec::new();
+    for path in &files {
+        let Ok(content) = tokio::fs::read_to_string(path).await else {
+            continue;
+        };
+        if let Ok(header) = serde_yaml::from_str::<Header>(&content) {
+            if database == Some(header.database.name.as_str()) {
+                return Ok(path.clone());
+            }
+            declared.push(header.database.name);
+        }
+    }
+
+    let available = if declared.is_empty() {
+        "none".to_string()
+    } else {
+        declared.join(", ")
+    };
+    Err(crate::YamlBaseError::Config(match database {
+        Some(name) => format!(
+            "No dataset in {} serves database '{}' (available: {})",
+            dir.display(),
+            name,
+            available
+        ),
+        None => format!(
+            "{} is a directory; choose a database to serve with --database (available: {})",
+            dir.display(),
+            available
+        ),
+    }))
+}
+
+/// Build the in-memory database for an already deserialized dataset
+pub(crate) fn build_database(
+    yaml_db: &YamlDatabase,
+) -> crate::Result<(Database, Option<AuthConfig>)> {
+    build_database_with(yaml_db, false)
+}
+
+fn build_database_with(
+    yaml_db: &YamlDatabase,
+    skip_invalid: bool,
+) -> crate::Result<(Database, Option<AuthConfig>)> {
     let auth_config = yaml_db.database.auth.clone();
     let mut database = Database::new(yaml_db.database.name.clone());
+    let mut generators = Vec::new();
 
-    for (table_name, yaml_table) in yaml_db.tables {
+    for (table_name, yaml_table) in &yaml_db.tables {
         debug!("Parsing table: {}", table_name);
 
-        let mut columns = Vec::new();
-        let mut column_map = IndexMap::new();
+        let built = build_table(table_name, yaml_table).and_then(|table| {
+            let expiry = match &yaml_table.expiry {
+                Some(expiry) => Some(build_expiry(expiry, &table.columns)?),
+                None => None,
+            };
+            let soft_delete = match &yaml_table.soft_delete {
+                Some(soft_delete) => Some(build_soft_delete(soft_delete, &table.columns)?),
+                None => None,
+            };
+            let annotations = build_annotations(&yaml_table.annotations, &table.columns)?;
+            Ok((table, expiry, soft_delete, annotations))
+        });
+        let (table, expiry, soft_delete, annotations) = match built {
+            Ok(built) => built,
+            Err(e) if skip_invalid => {
+                warn!("Skipping invalid table '{}': {}", table_name, e);
+                database
+                    .errored_tables
+                    .insert(table_name.clone(), e.to_string());
+                continue;
+            }
+            Err(e) => return Err(e),
+        };
 
-        for (col_name, type_def) in &yaml_table.columns {
-            let yaml_column = YamlColumn::parse(col_name.clone(), type_def)?;
-            let sql_type = yaml_column.get_base_type()?;
+        if let Some(generator) = &yaml_table.generator {
+            generators.push((table_name.clone(), generator.clone()));
+        }
+        if let Some(expiry) = expiry {
+            database.expiries.insert(table_name.clone(), expiry);
+        }
+        if let Some(soft_delete) = soft_delete {
+            database
+                .soft_deletes
+                .insert(table_name.clone(), soft_delete);
+        }
+        if !annotations.is_empty() {
+            database.annotations.insert(table_name.clone(), annotations);
+        }
 
-            let column = Column {
-                name: yaml_column.name.clone(),
-                sql_type,
+        database.add_table(table)?;
+    }
+
+    if let Some(tenancy) = &yaml_db.database.tenancy {
+        let tables = database
+            .tables
+            .values()
+            .map(|table| table.columns.as_slice());
+        database.tenancy = Some(build_tenancy(tenancy, tables, auth_config.as_ref())?);
+    }
+    database.rewrites = yaml_db
+        .database
+        .rewrites
+        .iter()
+        .map(build_rewrite)
+        .collect::<crate::Result<_>>()?;
+
+    if let Some(source) = &yaml_db.database.script {
+        database.script = Some(Arc::new(ScriptEngine::load(source, generators)?));
+    } else if !generators.is_empty() {
+        return Err(crate::YamlBaseError::Config(
+            "Tables with a generator require database.script".to_string(),
+        ));
+    }
+
+    if database.errored_tables.is_empty() {
+        info!(
+            "Successfully parsed database with {} tables",
+            database.tables.len()
+        );
+    } else {
+        warn!(
+            "Parsed database with {} tables, {} skipped as invalid: {}",
+            database.tables.len(),
+            database.errored_tables.len(),
+            database
+                .errored_tables
+                .keys()
+                .cloned()
+                .collect::<Vec<_>>()
+                .join(", ")
+        );
+    }
+    Ok((database, auth_config))
+}
+
+/// Build one table with its rows
+pub(crate) fn build_table(table_name: &str, yaml_table: &YamlTable) -> crate::Result<Table> {
+    let mut table = Table::new(table_name.to_string(), build_columns(&yaml_table.columns)?);
+
+    // Parse and insert data
+    for row_data in &yaml_table.data {
+        let row = build_row(row_data, &table.columns)?;
+        table.insert_row(row)?;
+    }
+
+    Ok(table)
+}
+
+/// Parse the `columns` section of a table definition
+pub(crate) fn build_columns(definitions: &IndexMap<String, String>) -> crate::Result<Vec<Column>> {
+    definitions
+        .iter()
+        .map(|(col_name, type_def)| {
+            let yaml_column = YamlColumn::parse(col_name.clone(), type_def)?;
+            Ok(Column {
+                sql_type: yaml_column.get_base_type()?,
+                name: yaml_column.name,
                 primary_key: yaml_column.is_primary_key,
                 nullable: yaml_column.is_nullable,
                 unique: yaml_column.is_unique,
                 default: yaml_column.default_value,
                 references: yaml_column.references.map(|r| (r.table, r.column)),
-            };
+            })
+        })
+        .collect()
+}
+
+/// Resolve a table's `expiry` section against its columns
+pub(crate) fn build_expiry(expiry: &YamlExpiry, columns: &[Column]) -> crate::Result<Expiry> {
+    let duration = |duration: std::time::Duration| {
+        chrono::Duration::from_std(duration).map_err(|_| {
+            crate::YamlBaseError::Config(format!("Expiry duration {:?} is too long", duration))
+        })
+    };
+
+    match (&expiry.at, expiry.after, &expiry.column) {
+        (Some(at), None, None) if expiry.ttl.is_none() => Ok(Expiry::At(
+            parse_timestamp(at).map_err(crate::YamlBaseError::Config)?,
+        )),
+        (None, Some(after), None) if expiry.ttl.is_none() => Ok(Expiry::After(duration(after)?)),
+        (None, None, Some(column)) => {
+            let index = columns
+                .iter()
+                .position(|c| &c.name == column)
+                .ok_or_else(|| {
+                    crate::YamlBaseError::Config(format!(
+                        "Expiry column '{}' does not exist",
+                        column
+                    ))
+                })?;
+            if !matches!(
+                columns[index].sql_type,
+                SqlType::Timestamp | SqlType::TimestampTz | SqlType::Date
+            ) {
+                return Err(crate::YamlBaseError::Config(format!(
+                    "Expiry column '{}' must be a TIMESTAMP or DATE",
+                    column
+                )));
+            }
+            Ok(Expiry::Column {
+                index,
+                ttl: duration(expiry.ttl.unwrap_or_default())?,
+            })
+        }
+        _ => Err(crate::YamlBaseError::Config(
+            "Expiry needs exactly one of at, after or column (ttl goes with column)".to_string(),
+        )),
+    }
+}
 
-            column_map.insert(yaml_column.name.clone(), columns.len());
-            columns.push(column);
-        }
-
-        let mut table = Table::new(table_name.clone(), columns);
-
-        // Parse and insert data
-        for row_data in yaml_table.data {
-            let mut row = Vec::new();
-
-            for column in &table.columns {
-                let value = if let Some(yaml_value) = row_data.get(&column.name) {
-                    parse_value(yaml_value, &column.sql_type)?
-                } else if column.nullable {
-                    DbValue::Null
-                } else if let Some(default) = &column.default {
-                    parse_default_value(default, &column.sql_type)?
-                } else {
-                    return Err(crate::YamlBaseError::Database {
-                        message: format!(
-                            "Non-nullable column '{}' has no value and no default",
-                            column.name
-                        ),
-                    });
-                };
-                row.push(value);
+/// Resolve the `database.tenancy` section. Tenants must be scalars, and some
+/// table must have the tenant column or nothing would be restricted.
+pub(crate) fn build_tenancy<'a>(
+    tenancy: &YamlTenancy,
+    mut tables: impl Iterator<Item = &'a [Column]>,
+    auth: Option<&AuthConfig>,
+) -> crate::Result<Tenancy> {
+    if !tables.any(|columns| {
+        columns
+            .iter()
+            .any(|column| column.name.eq_ignore_ascii_case(&tenancy.column))
+    }) {
+        return Err(crate::YamlBaseError::Config(format!(
+            "No table has the tenant column '{}'",
+            tenancy.column
+        )));
+    }
+    let users = tenancy
+        .users
+        .iter()
+        .map(|(name, user)| {
+            if auth.is_some_and(|auth| auth.username == *name) {
+                return Err(crate::YamlBaseError::Config(format!(
+                    "Tenant user '{}' is also the database's auth user",
+                    name
+                )));
             }
+            let tenant = scalar_value(&user.tenant).ok_or_else(|| {
+                crate::YamlBaseError::Config(format!(
+                    "Tenant of user '{}' must be a number, string or boolean",
+                    name
+                ))
+            })?;
+            Ok((
+                name.clone(),
+                TenantUser {
+                    password: user.password.clone(),
+                    tenant,
+                },
+            ))
+        })
+        .collect::<crate::Result<_>>()?;
+
+    Ok(Tenancy {
+        column: tenancy.column.clone(),
+        users,
+    })
+}
+
+/// A YAML number, string or boolean as a value of its own type
+fn scalar_value(value: &serde_yaml::Value) -> Option<DbValue> {
+    match value {
+        serde_yaml::Value::Number(n) => n
+            .as_i64()
+            .map(DbValue::Integer)
+            .or_else(|| n.as_f64().map(DbValue::Double)),
+        serde_yaml::Value::String(s) => Some(DbValue::Text(s.clone())),
+        serde_yaml::Value::Bool(b) => Some(DbValue::Boolean(*b)),
+        _ => None,
+    }
+}
 
-            table.insert_row(row)?;
+/// Resolve one of `database.rewrites`. A `statement` rule's SQL, and its
+/// replacement, must parse; a `match` rule's replacement may only parse once
+/// its groups are filled in, so it is checked when the rule applies.
+pub(crate) fn build_rewrite(rewrite: &YamlRewrite) -> crate::Result<Rewrite> {
+    let single_statement = |sql: &str| {
+        let mut statements = crate::sql::parse_sql(sql).map_err(|e| {
+            crate::YamlBaseError::Config(format!("Invalid rewrite statement '{}': {}", sql, e))
+        })?;
+        match statements.len() {
+            1 => Ok(statements.remove(0)),
+            _ => Err(crate::YamlBaseError::Config(format!(
+                "Rewrite statement '{}' must be a single statement",
+                sql
+            ))),
         }
+    };
 
-        database.add_table(table)?;
+    let pattern = match (&rewrite.pattern, &rewrite.statement) {
+        (Some(pattern), None) => {
+            RewritePattern::Regex(regex::Regex::new(pattern).map_err(|e| {
+                crate::YamlBaseError::Config(format!(
+                    "Invalid rewrite pattern '{}': {}",
+                    pattern, e
+                ))
+            })?)
+        }
+        (None, Some(statement)) => {
+            RewritePattern::Statement(Box::new(single_statement(statement)?))
+        }
+        _ => {
+            return Err(crate::YamlBaseError::Config(
+                "A rewrite rule needs either match or statement".to_string(),
+            ));
+        }
+    };
+
+    let action = match (&rewrite.replace, &rewrite.result) {
+        (Some(replace), None) => {
+            if matches!(pattern, RewritePattern::Statement(_)) {
+                single_statement(replace)?;
+            }
+            RewriteAction::Replace(replace.clone())
+        }
+        (None, Some(result)) => {
+            let rows = result
+                .rows
+                .iter()
+                .map(|row| {
+                    if row.len() != result.columns.len() {
+                        return Err(crate::YamlBaseError::Config(format!(
+                            "Rewrite result row has {} values for {} columns",
+                            row.len(),
+                            result.columns.len()
+                        )));
+                    }
+                    row.iter()
+                        .map(|value| match value {
+                            serde_yaml::Value::Null => Ok(DbValue::Null),
+                            value => scalar_value(value).ok_or_else(|| {
+                                crate::YamlBaseError::Config(
+                                    "Rewrite result values must be numbers, strings, booleans or null"
+                                        .to_string(),
+                                )
+                            }),
+                        })
+                        .collect()
+                })
+                .collect::<crate::Result<_>>()?;
+            RewriteAction::Result {
+                columns: result.columns.clone(),
+                rows,
+            }
+        }
+        _ => {
+            return Err(crate::YamlBaseError::Config(
+                "A rewrite rule needs either replace or result".to_string(),
+            ));
+        }
+    };
+
+    Ok(Rewrite { pattern, action })
+}
+
+/// Resolve a table's `soft_delete` section into the filter live rows satisfy.
+/// Without an explicit filter a row is live while the column is NULL, or
+/// FALSE for a BOOLEAN flag.
+pub(crate) fn build_soft_delete(
+    soft_delete: &YamlSoftDelete,
+    columns: &[Column],
+) -> crate::Result<SoftDelete> {
+    let column = columns
+        .iter()
+        .find(|c| c.name == soft_delete.column)
+        .ok_or_else(|| {
+            crate::YamlBaseError::Config(format!(
+                "Soft delete column '{}' does not exist",
+                soft_delete.column
+            ))
+        })?;
+
+    let filter = match &soft_delete.filter {
+        Some(filter) => crate::sql::parser::parse_expr(filter).map_err(|e| {
+            crate::YamlBaseError::Config(format!("Invalid soft delete filter '{}': {}", filter, e))
+        })?,
+        None => {
+            let column_expr = || Expr::Identifier(Ident::new(&column.name));
+            let is_null = Expr::IsNull(Box::new(column_expr()));
+            if matches!(column.sql_type, SqlType::Boolean) {
+                Expr::BinaryOp {
+                    left: Box::new(is_null),
+                    op: BinaryOperator::Or,
+                    right: Box::new(Expr::BinaryOp {
+                        left: Box::new(column_expr()),
+                        op: BinaryOperator::Eq,
+                        right: Box::new(Expr::Value(SqlValue::Boolean(false))),
+                    }),
+                }
+            } else {
+                is_null
+            }
+        }
+    };
+
+    Ok(SoftDelete { filter })
+}
+
+/// Check that a table's `annotations` name its columns
+pub(crate) fn build_annotations(
+    annotations: &IndexMap<String, YamlAnnotation>,
+    columns: &[Column],
+) -> crate::Result<IndexMap<String, Annotation>> {
+    annotations
+        .iter()
+        .map(|(column, annotation)| {
+            if !columns.iter().any(|c| c.name == *column) {
+                return Err(crate::YamlBaseError::Config(format!(
+                    "Annotated column '{}' does not exist",
+                    column
+                )));
+            }
+            Ok((
+                column.clone(),
+                Annotation {
+                    description: annotation.description.clone(),
+                    source: annotation.source.clone(),
+                    pii: annotation.pii,
+                },
+            ))
+        })
+        .collect()
+}
+
+/// Convert a mapping of column name to YAML value into a row ordered like `columns`,
+/// filling in NULLs and defaults for missing columns
+pub(crate) fn build_row(
+    row_data: &IndexMap<String, serde_yaml::Value>,
+    columns: &[Column],
+) -> crate::Result<Vec<DbValue>> {
+    let mut row = Vec::with_capacity(columns.len());
+
+    for column in columns {
+        let value = if let Some(yaml_value) = row_data.get(&column.name) {
+            parse_value(yaml_value, &column.sql_type)?
+        } else if column.nullable {
+            DbValue::Null
+        } else if let Some(default) = &column.default {
+            parse_default_value(default, &column.sql_type)?
+        } else {
+            return Err(crate::YamlBaseError::Database {
+                message: format!(
+                    "Non-nullable column '{}' has no value and no default",
+                    column.name
+                ),
+            });
+        };
+        row.push(value);
     }
 
-    info!(
-        "Successfully parsed database with {} tables",
-        database.tables.len()
-    );
-    Ok((database, auth_config))
+    Ok(row)
 }
 
-fn parse_value(yaml_value: &serde_yaml::Value, sql_type: &SqlType) -> crate::Result<DbValue> {
+pub(crate) fn parse_value(
+    yaml_value: &serde_yaml::Value,
+    sql_type: &SqlType,
+) -> crate::Result<DbValue> {
     use serde_yaml::Value;
 
     match (yaml_value, sql_type) {
@@ -116,10 +583,10 @@ fn parse_value(yaml_value: &serde_yaml::Value, sql_type: &SqlType) -> crate::Res
             }
         }
 
-        (Value::Number(n), SqlType::Decimal(_, _)) => {
+        (Value::Number(n), SqlType::Decimal(precision, scale)) => {
             let s = n.to_string();
             match s.parse::<rust_decimal::Decimal>() {
-                Ok(d) => Ok(DbValue::Decimal(d)),
+                Ok(d) => Ok(DbValue::Decimal(numeric::fit(d, *precision, *scale)?)),
                 Err(_) => Err(crate::YamlBaseError::TypeConversion(format!(
                     "Cannot convert {:?} to decimal",
                     n
@@ -127,24 +594,31 @@ fn parse_value(yaml_value: &serde_yaml::Value, sql_type: &SqlType) -> crate::Res
             }
         }
 
+        // Quoted, a decimal keeps digits a YAML number would lose to a float
+        (Value::String(s), SqlType::Decimal(precision, scale)) => {
+            match s.trim().parse::<rust_decimal::Decimal>() {
+                Ok(d) => Ok(DbValue::Decimal(numeric::fit(d, *precision, *scale)?)),
+                Err(_) => Err(crate::YamlBaseError::TypeConversion(format!(
+                    "Cannot convert '{}' to decimal",
+                    s
+                ))),
+            }
+        }
+
         (Value::String(s), SqlType::Char(_) | SqlType::Varchar(_) | SqlType::Text) => {
             Ok(DbValue::Text(s.clone()))
         }
 
         (Value::String(s), SqlType::Timestamp) => {
-            match chrono::NaiveDateTime::parse_from_str(s, "%Y-%m-%d %H:%M:%S") {
-                Ok(dt) => Ok(DbValue::Timestamp(dt)),
-                Err(_) => {
-                    // Try ISO format
-                    match chrono::DateTime::parse_from_rfc3339(s) {
-                        Ok(dt) => Ok(DbValue::Timestamp(dt.naive_local())),
-                        Err(_) => Err(crate::YamlBaseError::TypeConversion(format!(
-                            "Cannot parse timestamp: {}",
-                            s
-                        ))),
-                    }
-                }
-            }
+            parse_timestamp(s).map(DbValue::Timestamp).map_err(|_| {
+                crate::YamlBaseError::TypeConversion(format!("Cannot parse timestamp: {}", s))
+            })
+        }
+
+        (Value::String(s), SqlType::TimestampTz) => {
+            parse_instant(s).map(DbValue::Timestamp).map_err(|_| {
+                crate::YamlBaseError::TypeConversion(format!("Cannot parse timestamp: {}", s))
+            })
         }
 
         (Value::String(s), SqlType::Date) => {
@@ -183,7 +657,96 @@ fn parse_value(yaml_value: &serde_yaml::Value, sql_type: &SqlType) -> crate::Res
             ))),
         },
 
-        (Value::Mapping(_) | Value::Sequence(_), SqlType::Json) => {
+        (Value::Number(n), SqlType::Money(currency)) => {
+            let amount = n
+                .to_string()
+                .parse::<rust_decimal::Decimal>()
+                .map_err(|_| {
+                    crate::YamlBaseError::TypeConversion(format!("Cannot parse amount: {}", n))
+                })?;
+            Ok(DbValue::Decimal(currency.amount(amount)?))
+        }
+
+        (Value::String(s), SqlType::Money(currency)) => {
+            Ok(DbValue::Decimal(currency.parse_amount(s)?))
+        }
+
+        (Value::String(s), SqlType::Point) => Ok(DbValue::Text(Point::parse(s)?.to_wkt())),
+
+        (Value::Mapping(mapping), SqlType::Point) => {
+            let coordinate = |keys: &[&str]| {
+                keys.iter()
+                    .find_map(|key| mapping.get(*key))
+                    .and_then(Value::as_f64)
+                    .ok_or_else(|| {
+                        crate::YamlBaseError::TypeConversion(format!(
+                            "A point needs numeric lat and lon, got {:?}",
+                            yaml_value
+                        ))
+                    })
+            };
+            let lat = coordinate(&["lat", "latitude"])?;
+            let lon = coordinate(&["lon", "lng", "longitude"])?;
+            Ok(DbValue::Text(Point::new(lat, lon)?.to_wkt()))
+        }
+
+        (Value::String(s), SqlType::Hstore) => Ok(DbValue::Text(Hstore::parse(s)?.to_text())),
+
+        (Value::String(s), SqlType::Enum(labels)) => enums::check(DbValue::Text(s.clone()), labels),
+
+        // Hex after `\x` or `0x`, otherwise base64
+        (Value::String(s), SqlType::Bytea) => Ok(DbValue::Text(bytea::parse(s)?)),
+
+        (Value::Mapping(mapping), SqlType::Hstore) => {
+            let text = |value: &Value| match value {
+                Value::String(s) => Some(s.clone()),
+                Value::Number(n) => Some(n.to_string()),
+                Value::Bool(b) => Some(b.to_string()),
+                _ => None,
+            };
+            let hstore = mapping
+                .iter()
+                .map(|(key, value)| {
+                    let invalid = || {
+                        crate::YamlBaseError::TypeConversion(format!(
+                            "An hstore maps text keys to text values, got {:?}: {:?}",
+                            key, value
+                        ))
+                    };
+                    let value = match value {
+                        Value::Null => None,
+                        value => Some(text(value).ok_or_else(invalid)?),
+                    };
+                    Ok((text(key).ok_or_else(invalid)?, value))
+                })
+                .collect::<crate::Result<Hstore>>()?;
+            Ok(DbValue::Text(hstore.to_text()))
+        }
+
+        // A list holds the elements, a string the array's text
+        (Value::Sequence(items), SqlType::Array(element)) => {
+            let elements = items
+                .iter()
+                .map(|item| parse_value(item, element))
+                .collect::<crate::Result<Vec<_>>>()?;
+            Ok(DbValue::Text(array::format(&elements)))
+        }
+
+        (Value::String(s), SqlType::Array(element)) => {
+            array::cast(DbValue::Text(s.clone()), element)
+        }
+
+        // A string is JSON text, as an INSERT would give it
+        (Value::String(s), SqlType::Json) => {
+            serde_json::from_str(s).map(DbValue::Json).map_err(|e| {
+                crate::YamlBaseError::TypeConversion(format!("Invalid JSON text {:?}: {}", s, e))
+            })
+        }
+
+        (
+            Value::Mapping(_) | Value::Sequence(_) | Value::Number(_) | Value::Bool(_),
+            SqlType::Json,
+        ) => {
             let json_str = serde_json::to_string(yaml_value).map_err(|e| {
                 crate::YamlBaseError::TypeConversion(format!("Cannot convert to JSON: {}", e))
             })?;
@@ -199,12 +762,19 @@ fn parse_value(yaml_value: &serde_yaml::Value, sql_type: &SqlType) -> crate::Res
     }
 }
 
-fn parse_default_value(default: &str, sql_type: &SqlType) -> crate::Result<DbValue> {
+pub(crate) fn parse_default_value(default: &str, sql_type: &SqlType) -> crate::Result<DbValue> {
     match default.to_uppercase().as_str() {
         "NULL" => Ok(DbValue::Null),
         "TRUE" => Ok(DbValue::Boolean(true)),
         "FALSE" => Ok(DbValue::Boolean(false)),
+        "CURRENT_TIMESTAMP" if *sql_type == SqlType::TimestampTz => {
+            Ok(DbValue::Timestamp(chrono::Utc::now().naive_utc()))
+        }
         "CURRENT_TIMESTAMP" => Ok(DbValue::Timestamp(chrono::Local::now().naive_local())),
+        "GEN_RANDOM_UUID()" => parse_value(
+            &serde_yaml::Value::String(uuid::Uuid::new_v4().to_string()),
+            sql_type,
+        ),
         _ => {
             // Try to parse as the specific type
             let yaml_value: serde_yaml::Value = match sql_type {
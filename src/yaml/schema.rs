@@ -1,6 +1,9 @@
 use indexmap::IndexMap;
 use serde::{Deserialize, Serialize};
 use serde_yaml::Value;
+use std::time::Duration;
+
+use crate::database::Currency;
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct YamlDatabase {
@@ -13,6 +16,15 @@ pub struct DatabaseInfo {
     pub name: String,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub auth: Option<AuthConfig>,
+    /// Lua source defining row generators and query hooks
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub script: Option<String>,
+    /// Users who each see only their own tenant's rows
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tenancy: Option<YamlTenancy>,
+    /// Rules redirecting the statements clients send, tried in order
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rewrites: Vec<YamlRewrite>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -21,11 +33,112 @@ pub struct AuthConfig {
     pub password: String,
 }
 
+/// The `database.tenancy` section
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct YamlTenancy {
+    /// Column holding the tenant of each row, in every table that has it
+    pub column: String,
+    pub users: IndexMap<String, YamlTenantUser>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct YamlTenantUser {
+    pub password: String,
+    /// The tenant column's value in the user's rows
+    pub tenant: Value,
+}
+
+/// One of `database.rewrites`: `match` or `statement`, with `replace` or `result`
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct YamlRewrite {
+    /// Regular expression searched for in the statement's SQL
+    #[serde(default, rename = "match", skip_serializing_if = "Option::is_none")]
+    pub pattern: Option<String>,
+    /// SQL of a statement to match however it is spaced or cased
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub statement: Option<String>,
+    /// SQL to run instead; under `match`, what replaces each match, with `$1`
+    /// or `${name}` for its groups
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub replace: Option<String>,
+    /// Rows to answer with instead of running anything
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub result: Option<YamlRewriteResult>,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct YamlRewriteResult {
+    pub columns: Vec<String>,
+    #[serde(default)]
+    pub rows: Vec<Vec<Value>>,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct YamlTable {
     pub columns: IndexMap<String, String>,
     #[serde(default)]
     pub data: Vec<IndexMap<String, Value>>,
+    /// Name of a script function that computes the table's rows at query time
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub generator: Option<String>,
+    /// When the table's rows expire, by the server clock
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expiry: Option<YamlExpiry>,
+    /// Which rows count as soft-deleted and are hidden from queries
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub soft_delete: Option<YamlSoftDelete>,
+    /// What each column holds, where it comes from and whether it is personal
+    /// data, keyed by column name
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub annotations: IndexMap<String, YamlAnnotation>,
+}
+
+/// An entry of a table's `annotations` section
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct YamlAnnotation {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub description: Option<String>,
+    /// Where the column's values come from, e.g. `crm.contacts.email`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub source: Option<String>,
+    /// Whether the column holds personally identifiable information
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub pii: bool,
+}
+
+/// A table's `soft_delete` section
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct YamlSoftDelete {
+    /// Column marking deleted rows: set (or TRUE for a BOOLEAN column) once a row is deleted
+    pub column: String,
+    /// SQL condition live rows satisfy, instead of the default `column IS NULL`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub filter: Option<String>,
+}
+
+/// A table's `expiry` section: one of `at`, `after` or `column` (with an optional `ttl`)
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct YamlExpiry {
+    /// Every row expires at this timestamp
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub at: Option<String>,
+    /// Every row expires this long after the server clock starts, e.g. `10m`
+    #[serde(
+        default,
+        with = "humantime_serde",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub after: Option<Duration>,
+    /// Each row expires at the TIMESTAMP or DATE in this column...
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub column: Option<String>,
+    /// ...plus this long, e.g. `30m` for rows that live 30 minutes past `created_at`
+    #[serde(
+        default,
+        with = "humantime_serde",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub ttl: Option<Duration>,
 }
 
 #[derive(Debug, Clone)]
@@ -49,6 +162,16 @@ impl YamlColumn {
     pub fn parse(name: String, type_def: &str) -> crate::Result<Self> {
         let type_def_upper = type_def.to_uppercase();
         let parts: Vec<&str> = type_def_upper.split_whitespace().collect();
+        let original: Vec<&str> = type_def.split_whitespace().collect();
+        // The labels of `enum(pending, shipped) NOT NULL` are not constraints
+        let labels_end = if is_enum(&type_def_upper) {
+            parts
+                .iter()
+                .position(|part| part.contains(')'))
+                .map_or(0, |end| end + 1)
+        } else {
+            0
+        };
 
         let mut column = YamlColumn {
             name,
@@ -60,7 +183,7 @@ impl YamlColumn {
             references: None,
         };
 
-        let mut i = 0;
+        let mut i = labels_end;
         while i < parts.len() {
             match parts[i] {
                 "PRIMARY" if i + 1 < parts.len() && parts[i + 1] == "KEY" => {
@@ -85,7 +208,8 @@ impl YamlColumn {
                         column.default_value = Some("CURRENT_TIMESTAMP".to_string());
                         i += 2;
                     } else {
-                        column.default_value = Some(parts[i + 1].to_string());
+                        // As written, so text and enum defaults keep their case
+                        column.default_value = Some(original[i + 1].to_string());
                         i += 2;
                     }
                 }
@@ -109,8 +233,17 @@ impl YamlColumn {
 
     pub fn get_base_type(&self) -> crate::Result<SqlType> {
         let type_upper = self.type_def.to_uppercase();
+        if is_enum(&type_upper) {
+            return enum_labels(&self.type_def).map(SqlType::Enum);
+        }
         let base_type = type_upper.split_whitespace().next().unwrap_or("");
 
+        // `TEXT[]` holds arrays of the type before the brackets
+        if let Some(element) = base_type.strip_suffix("[]") {
+            let element = YamlColumn::parse(self.name.clone(), element.trim_end_matches("[]"))?;
+            return Ok(SqlType::Array(Box::new(element.get_base_type()?)));
+        }
+
         Ok(match base_type {
             "INTEGER" | "INT" | "BIGINT" | "SMALLINT" => SqlType::Integer,
             s if s.starts_with("CHAR") && !s.starts_with("CHARACTER") => {
@@ -122,6 +255,8 @@ impl YamlColumn {
                 SqlType::Varchar(size)
             }
             "TEXT" | "CLOB" => SqlType::Text,
+            "TIMESTAMPTZ" => SqlType::TimestampTz,
+            "TIMESTAMP" if type_upper.contains("WITH TIME ZONE") => SqlType::TimestampTz,
             "TIMESTAMP" | "DATETIME" => SqlType::Timestamp,
             "DATE" => SqlType::Date,
             "TIME" => SqlType::Time,
@@ -134,6 +269,28 @@ impl YamlColumn {
             "DOUBLE" => SqlType::Double,
             "UUID" => SqlType::Uuid,
             "JSON" | "JSONB" => SqlType::Json,
+            "POINT" => SqlType::Point,
+            s if s.starts_with("GEOGRAPHY") || s.starts_with("GEOMETRY") => {
+                crate::sql::geo::column_type(&type_upper)?
+            }
+            "HSTORE" => SqlType::Hstore,
+            "BYTEA" | "TINYBLOB" | "MEDIUMBLOB" | "LONGBLOB" => SqlType::Bytea,
+            s if s.starts_with("BLOB") || s.starts_with("VARBINARY") => SqlType::Bytea,
+            s if s.starts_with("MONEY") => {
+                match s["MONEY".len()..]
+                    .strip_prefix('(')
+                    .and_then(|code| code.strip_suffix(')'))
+                {
+                    Some(code) => SqlType::Money(Currency::from_code(code)?),
+                    None if s == "MONEY" => SqlType::Money(Currency::USD),
+                    None => {
+                        return Err(crate::YamlBaseError::TypeConversion(format!(
+                            "Unknown SQL type: {}",
+                            base_type
+                        )));
+                    }
+                }
+            }
             _ => {
                 return Err(crate::YamlBaseError::TypeConversion(format!(
                     "Unknown SQL type: {}",
@@ -152,6 +309,7 @@ pub enum SqlType {
     Varchar(usize),
     Text,
     Timestamp,
+    TimestampTz, // instants, held as UTC timestamps
     Date,
     Time,
     Boolean,
@@ -160,6 +318,63 @@ pub enum SqlType {
     Double,
     Uuid,
     Json,
+    Point, // WGS 84 longitude/latitude, held as WKT text
+    Money(Currency),
+    Hstore, // text keys to nullable text values, held as hstore text
+    Bytea,  // binary strings, held as \x-prefixed hex text
+    // The labels of an enumerated type, its values held as their text
+    Enum(Vec<String>),
+    // One-dimensional arrays of the boxed type, held as array literal text
+    Array(Box<SqlType>),
+}
+
+/// Whether an upper case type is an `ENUM(...)`
+fn is_enum(type_upper: &str) -> bool {
+    type_upper
+        .strip_prefix("ENUM")
+        .is_some_and(|rest| rest.trim_start().starts_with('('))
+}
+
+/// The labels of an `enum(pending, shipped)` type, bare or quoted as in
+/// `ENUM('pending', 'shipped')`, keeping their case
+fn enum_labels(type_def: &str) -> crate::Result<Vec<String>> {
+    let invalid = |why: &str| {
+        crate::YamlBaseError::TypeConversion(format!("Invalid enum type {}: {}", type_def, why))
+    };
+    let open = type_def.find('(').ok_or_else(|| invalid("no labels"))?;
+    let mut chars = type_def[open + 1..].chars().peekable();
+    let mut labels = Vec::new();
+    let mut label = String::new();
+    let mut quote = None;
+    loop {
+        let c = chars.next().ok_or_else(|| invalid("missing ')'"))?;
+        match quote {
+            Some(q) if c == q && chars.peek() == Some(&q) => {
+                chars.next();
+                label.push(q);
+            }
+            Some(q) if c == q => quote = None,
+            Some(_) => label.push(c),
+            None => match c {
+                '\'' | '"' => quote = Some(c),
+                ',' | ')' => {
+                    let trimmed = label.trim().to_string();
+                    if trimmed.is_empty() {
+                        return Err(invalid("a label is empty"));
+                    }
+                    if labels.contains(&trimmed) {
+                        return Err(invalid(&format!("'{}' is listed twice", trimmed)));
+                    }
+                    labels.push(trimmed);
+                    label.clear();
+                    if c == ')' {
+                        return Ok(labels);
+                    }
+                }
+                c => label.push(c),
+            },
+        }
+    }
 }
 
 #[cfg(test)]
@@ -1,5 +1,6 @@
 #[cfg(test)]
-use crate::yaml::schema::{AuthConfig, DatabaseInfo};
+use crate::database::Value;
+use crate::yaml::schema::{AuthConfig, DatabaseInfo, SqlType};
 use std::io::Write;
 use tempfile::NamedTempFile;
 
@@ -62,6 +63,409 @@ tables:
     assert!(auth_config.is_none());
 }
 
+#[tokio::test]
+async fn test_skip_invalid_loads_the_valid_tables() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+    data:
+      - id: 1
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      total: "INTEGER"
+    data:
+      - id: 1
+        total: "a lot"
+"#;
+
+    let mut temp_file = NamedTempFile::new().unwrap();
+    temp_file.write_all(yaml_content.as_bytes()).unwrap();
+    temp_file.flush().unwrap();
+
+    assert!(
+        crate::yaml::parse_yaml_database(temp_file.path())
+            .await
+            .is_err()
+    );
+
+    let (database, _) = crate::yaml::load_yaml_database(temp_file.path(), true)
+        .await
+        .unwrap();
+    assert!(database.get_table("users").is_some());
+    assert!(database.get_table("orders").is_none());
+    let reason = database.table_error("ORDERS").unwrap();
+    assert!(reason.contains("a lot"), "{}", reason);
+}
+
+#[tokio::test]
+async fn test_find_dataset_file_by_file_or_database_name() {
+    let dir = tempfile::tempdir().unwrap();
+    for (file, name) in [("shop.yaml", "shop"), ("crm-fixtures.yml", "crm")] {
+        let content = format!("database:\n  name: \"{}\"\ntables: {{}}\n", name);
+        std::fs::write(dir.path().join(file), content).unwrap();
+    }
+    std::fs::write(dir.path().join("README.md"), "not a dataset").unwrap();
+
+    let find =
+        |database: Option<&'static str>| crate::yaml::find_dataset_file(dir.path(), database);
+    assert_eq!(
+        find(Some("shop")).await.unwrap(),
+        dir.path().join("shop.yaml")
+    );
+    assert_eq!(
+        find(Some("crm")).await.unwrap(),
+        dir.path().join("crm-fixtures.yml")
+    );
+
+    let err = find(Some("billing")).await.unwrap_err().to_string();
+    assert!(err.contains("available: crm, shop"), "{}", err);
+    let err = find(None).await.unwrap_err().to_string();
+    assert!(err.contains("--database"), "{}", err);
+}
+
+#[test]
+fn test_table_expiry_is_resolved_and_validated() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+
+tables:
+  sessions:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      created_at: "TIMESTAMP"
+    expiry:
+      column: created_at
+      ttl: 30m
+  promotions:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+    expiry:
+      at: "2024-06-01 00:00:00"
+  banners:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+    expiry:
+      after: 1h
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    assert_eq!(
+        database.expiries["sessions"],
+        crate::database::Expiry::Column {
+            index: 1,
+            ttl: chrono::Duration::minutes(30)
+        }
+    );
+    assert_eq!(
+        database.expiries["promotions"],
+        crate::database::Expiry::At(crate::database::clock::parse_timestamp("2024-06-01").unwrap())
+    );
+    assert_eq!(
+        database.expiries["banners"],
+        crate::database::Expiry::After(chrono::Duration::hours(1))
+    );
+
+    let invalid = yaml_content
+        .replace("column: created_at", "column: id")
+        .replace("after: 1h", "after: 1h\n      at: \"2024-06-01\"");
+    assert!(crate::yaml::load_yaml_str(&invalid, false).is_err());
+    let issues = crate::yaml::validate_yaml_str(&invalid);
+    let paths: Vec<_> = issues.iter().map(|issue| issue.path.as_str()).collect();
+    assert_eq!(paths, ["tables.sessions.expiry", "tables.banners.expiry"]);
+}
+
+#[test]
+fn test_soft_delete_filters_are_built_and_validated() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      deleted_at: "TIMESTAMP"
+    soft_delete:
+      column: deleted_at
+  posts:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      archived: "BOOLEAN"
+    soft_delete:
+      column: archived
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      status: "VARCHAR(20)"
+    soft_delete:
+      column: status
+      filter: "status <> 'deleted'"
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    let filter = |table: &str| database.soft_deletes[table].filter.to_string();
+    assert_eq!(filter("users"), "deleted_at IS NULL");
+    assert_eq!(filter("posts"), "archived IS NULL OR archived = false");
+    assert_eq!(filter("orders"), "status <> 'deleted'");
+
+    let invalid = yaml_content
+        .replace("column: deleted_at", "column: removed_at")
+        .replace("status <> 'deleted'", "status <>");
+    assert!(crate::yaml::load_yaml_str(&invalid, false).is_err());
+    let issues = crate::yaml::validate_yaml_str(&invalid);
+    let paths: Vec<_> = issues.iter().map(|issue| issue.path.as_str()).collect();
+    assert_eq!(
+        paths,
+        ["tables.users.soft_delete", "tables.orders.soft_delete"]
+    );
+}
+
+#[test]
+fn test_column_annotations_are_loaded_and_validated() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      email: "VARCHAR(255)"
+    annotations:
+      email:
+        description: "Contact address"
+        source: crm.contacts.email
+        pii: true
+      id:
+        description: "Surrogate key"
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    let annotations = &database.annotations["users"];
+    assert!(annotations["email"].pii);
+    assert_eq!(
+        annotations["email"].comment(),
+        "Contact address (source: crm.contacts.email; PII)"
+    );
+    assert_eq!(annotations["id"].comment(), "Surrogate key");
+
+    let invalid = yaml_content
+        .replace("      email:\n", "      mail:\n")
+        .replace("pii: true", "pii: true\n        owner: growth");
+    assert!(crate::yaml::load_yaml_str(&invalid, false).is_err());
+    let issues = crate::yaml::validate_yaml_str(&invalid);
+    let paths: Vec<_> = issues.iter().map(|issue| issue.path.as_str()).collect();
+    assert_eq!(
+        paths,
+        [
+            "tables.users.annotations.mail.owner",
+            "tables.users.annotations"
+        ]
+    );
+}
+
+#[test]
+fn test_tenancy_is_built_and_validated() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "admin"
+    password: "admin"
+  tenancy:
+    column: tenant_id
+    users:
+      acme:
+        password: "acme"
+        tenant: 1
+      globex:
+        password: "globex"
+        tenant: "globex"
+
+tables:
+  projects:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      tenant_id: "INTEGER"
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    let tenancy = database.tenancy.as_ref().unwrap();
+    assert_eq!(tenancy.column, "tenant_id");
+    assert_eq!(tenancy.users["acme"].tenant, Value::Integer(1));
+    assert_eq!(
+        tenancy.users["globex"].tenant,
+        Value::Text("globex".to_string())
+    );
+    assert_eq!(database.tenant_password("acme"), Some("acme"));
+    assert_eq!(database.tenant_password("admin"), None);
+
+    for invalid in [
+        yaml_content.replace("column: tenant_id", "column: org_id"),
+        yaml_content.replace("acme:", "admin:"),
+        yaml_content.replace("tenant: 1", "tenant: [1]"),
+    ] {
+        assert!(crate::yaml::load_yaml_str(&invalid, false).is_err());
+        let issues = crate::yaml::validate_yaml_str(&invalid);
+        let paths: Vec<_> = issues.iter().map(|issue| issue.path.as_str()).collect();
+        assert_eq!(paths, ["database.tenancy"]);
+    }
+}
+
+#[test]
+fn test_rewrites_are_built_and_validated() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+  rewrites:
+    - match: "FROM pg_catalog\\.(\\w+)"
+      replace: "FROM $1"
+    - statement: "SHOW transaction_isolation"
+      result:
+        columns: [transaction_isolation]
+        rows:
+          - ["read committed"]
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    assert_eq!(database.rewrites.len(), 2);
+    assert_eq!(
+        database.rewrites[1].action,
+        crate::database::RewriteAction::Result {
+            columns: vec!["transaction_isolation".to_string()],
+            rows: vec![vec![Value::Text("read committed".to_string())]],
+        }
+    );
+
+    for (invalid, path) in [
+        (
+            yaml_content.replace("match: \"FROM", "match: \"(FROM"),
+            "database.rewrites.0",
+        ),
+        (
+            yaml_content.replace("replace: \"FROM $1\"", "statement: \"SELECT 1\""),
+            "database.rewrites.0",
+        ),
+        (
+            yaml_content.replace("SHOW transaction_isolation", "NOT SQL AT ALL"),
+            "database.rewrites.1",
+        ),
+        (
+            yaml_content.replace("[\"read committed\"]", "[\"read\", \"committed\"]"),
+            "database.rewrites.1",
+        ),
+    ] {
+        assert!(crate::yaml::load_yaml_str(&invalid, false).is_err());
+        let issues = crate::yaml::validate_yaml_str(&invalid);
+        let paths: Vec<_> = issues.iter().map(|issue| issue.path.as_str()).collect();
+        assert_eq!(paths, [path]);
+    }
+}
+
+#[test]
+fn test_money_columns_take_their_currency() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+
+tables:
+  invoices:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      total: "MONEY(eur) NOT NULL"
+      fee: "MONEY"
+    data:
+      - { id: 1, total: 99.9, fee: "$0.30" }
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    let invoices = database.get_table("invoices").unwrap();
+    assert_eq!(
+        invoices.columns[1].sql_type,
+        SqlType::Money(crate::database::Currency::from_code("EUR").unwrap())
+    );
+    assert_eq!(
+        invoices.columns[2].sql_type,
+        SqlType::Money(crate::database::Currency::USD)
+    );
+    let row: Vec<_> = invoices.rows[0].iter().map(ToString::to_string).collect();
+    assert_eq!(row, ["1", "99.90", "0.30"]);
+
+    for invalid in [
+        yaml_content.replace("99.9", "99.999"),
+        yaml_content.replace("99.9", "\"GBP 99.90\""),
+        yaml_content.replace("MONEY(eur)", "MONEY(EURO)"),
+    ] {
+        assert!(
+            crate::yaml::load_yaml_str(&invalid, false).is_err(),
+            "{}",
+            invalid
+        );
+    }
+}
+
+#[test]
+fn test_enum_columns_take_only_their_labels() {
+    let yaml_content = r#"
+database:
+  name: "test_db"
+
+tables:
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      status: "enum(pending, shipped, Delivered) NOT NULL DEFAULT pending"
+      carrier: "ENUM('dhl', 'ups', 'o''neil')"
+    data:
+      - { id: 1, status: shipped, carrier: "o'neil" }
+      - { id: 2 }
+"#;
+
+    let (database, _) = crate::yaml::load_yaml_str(yaml_content, false).unwrap();
+    let orders = database.get_table("orders").unwrap();
+    let labels = |labels: &[&str]| labels.iter().map(ToString::to_string).collect();
+    assert_eq!(
+        orders.columns[1].sql_type,
+        SqlType::Enum(labels(&["pending", "shipped", "Delivered"]))
+    );
+    assert!(!orders.columns[1].nullable);
+    assert_eq!(
+        orders.columns[2].sql_type,
+        SqlType::Enum(labels(&["dhl", "ups", "o'neil"]))
+    );
+    let rows: Vec<Vec<_>> = orders
+        .rows
+        .iter()
+        .map(|row| row.iter().map(ToString::to_string).collect())
+        .collect();
+    assert_eq!(rows, [["1", "shipped", "o'neil"], ["2", "pending", "NULL"]]);
+
+    for invalid in [
+        yaml_content.replace("status: shipped", "status: lost"),
+        yaml_content.replace("status: shipped", "status: Shipped"),
+        yaml_content.replace("shipped, Delivered", "shipped, shipped"),
+        yaml_content.replace("enum(pending, shipped, Delivered)", "enum(pending"),
+    ] {
+        assert!(
+            crate::yaml::load_yaml_str(&invalid, false).is_err(),
+            "{}",
+            invalid
+        );
+    }
+}
+
 #[test]
 fn test_auth_config_serialization() {
     let auth = AuthConfig {
@@ -113,6 +517,9 @@ fn test_auth_override_behavior() {
             username: "yaml_user".to_string(),
             password: "yaml_pass".to_string(),
         }),
+        script: None,
+        tenancy: None,
+        rewrites: Vec::new(),
     };
 
     // Verify auth is properly stored
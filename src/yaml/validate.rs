@@ -0,0 +1,424 @@
+use std::collections::HashSet;
+use std::fmt;
+
+use crate::database::Value as DbValue;
+use crate::yaml::parser::{
+    build_annotations, build_columns, build_expiry, build_rewrite, build_soft_delete,
+    build_tenancy, parse_default_value, parse_value,
+};
+use crate::yaml::schema::{SqlType, YamlColumn, YamlDatabase};
+
+/// JSON Schema describing the dataset file format, for editor and CI integration
+pub const DATASET_JSON_SCHEMA: &str = include_str!("../../schema/yamlbase.schema.json");
+
+const ROOT_KEYS: &[&str] = &["database", "tables"];
+const DATABASE_KEYS: &[&str] = &["name", "auth", "script", "tenancy", "rewrites"];
+const TABLE_KEYS: &[&str] = &[
+    "columns",
+    "data",
+    "generator",
+    "expiry",
+    "soft_delete",
+    "annotations",
+];
+const EXPIRY_KEYS: &[&str] = &["at", "after", "column", "ttl"];
+const SOFT_DELETE_KEYS: &[&str] = &["column", "filter"];
+const ANNOTATION_KEYS: &[&str] = &["description", "source", "pii"];
+const TENANCY_KEYS: &[&str] = &["column", "users"];
+const REWRITE_KEYS: &[&str] = &["match", "statement", "replace", "result"];
+const REWRITE_RESULT_KEYS: &[&str] = &["columns", "rows"];
+
+/// A single problem found in a dataset file, located by a dotted path
+#[derive(Debug, Clone, PartialEq)]
+pub struct ValidationIssue {
+    pub path: String,
+    pub message: String,
+}
+
+impl fmt::Display for ValidationIssue {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.path, self.message)
+    }
+}
+
+impl ValidationIssue {
+    fn new(path: impl Into<String>, message: impl Into<String>) -> Self {
+        Self {
+            path: path.into(),
+            message: message.into(),
+        }
+    }
+}
+
+/// Validate dataset YAML source, returning every problem found rather than stopping at the first
+pub fn validate_yaml_str(content: &str) -> Vec<ValidationIssue> {
+    let raw: serde_yaml::Value = match serde_yaml::from_str(content) {
+        Ok(raw) => raw,
+        Err(e) => return vec![syntax_issue(&e)],
+    };
+
+    let mut issues = check_unknown_keys(&raw);
+
+    match serde_yaml::from_value::<YamlDatabase>(raw) {
+        Ok(yaml_db) => issues.extend(validate_yaml_database(&yaml_db)),
+        Err(_) => {
+            // Re-parse from source so the error carries a line/column location
+            if let Err(e) = serde_yaml::from_str::<YamlDatabase>(content) {
+                issues.push(syntax_issue(&e));
+            }
+        }
+    }
+
+    issues
+}
+
+/// Check column definitions, row values and key constraints of a parsed dataset
+pub fn validate_yaml_database(yaml_db: &YamlDatabase) -> Vec<ValidationIssue> {
+    let mut issues = Vec::new();
+
+    if let Some(tenancy) = &yaml_db.database.tenancy {
+        // Tables with invalid columns are reported below
+        let tables: Vec<_> = yaml_db
+            .tables
+            .values()
+            .filter_map(|table| build_columns(&table.columns).ok())
+            .collect();
+        let built = build_tenancy(
+            tenancy,
+            tables.iter().map(Vec::as_slice),
+            yaml_db.database.auth.as_ref(),
+        );
+        if let Err(e) = built {
+            issues.push(ValidationIssue::new("database.tenancy", e.to_string()));
+        }
+    }
+
+    for (position, rewrite) in yaml_db.database.rewrites.iter().enumerate() {
+        if let Err(e) = build_rewrite(rewrite) {
+            issues.push(ValidationIssue::new(
+                format!("database.rewrites.{}", position),
+                e.to_string(),
+            ));
+        }
+    }
+
+    for (table_name, table) in &yaml_db.tables {
+        let mut columns: Vec<(YamlColumn, SqlType)> = Vec::new();
+
+        for (col_name, type_def) in &table.columns {
+            let path = format!("tables.{}.columns.{}", table_name, col_name);
+            let parsed = YamlColumn::parse(col_name.clone(), type_def).and_then(|column| {
+                let sql_type = column.get_base_type()?;
+                Ok((column, sql_type))
+            });
+
+            match parsed {
+                Ok((column, sql_type)) => {
+                    if let Some(default) = &column.default_value {
+                        if let Err(e) = parse_default_value(default, &sql_type) {
+                            issues.push(ValidationIssue::new(
+                                path.clone(),
+                                format!("Invalid default: {}", e),
+                            ));
+                        }
+                    }
+                    if let Some(reference) = &column.references {
+                        if let Some(issue) =
+                            check_reference(yaml_db, &path, &reference.table, &reference.column)
+                        {
+                            issues.push(issue);
+                        }
+                    }
+                    columns.push((column, sql_type));
+                }
+                Err(e) => issues.push(ValidationIssue::new(path, e.to_string())),
+            }
+        }
+
+        if let Some(expiry) = &table.expiry {
+            // Column problems are reported above
+            if let Ok(built_columns) = build_columns(&table.columns) {
+                if let Err(e) = build_expiry(expiry, &built_columns) {
+                    issues.push(ValidationIssue::new(
+                        format!("tables.{}.expiry", table_name),
+                        e.to_string(),
+                    ));
+                }
+            }
+        }
+
+        if let Some(soft_delete) = &table.soft_delete {
+            if let Ok(built_columns) = build_columns(&table.columns) {
+                if let Err(e) = build_soft_delete(soft_delete, &built_columns) {
+                    issues.push(ValidationIssue::new(
+                        format!("tables.{}.soft_delete", table_name),
+                        e.to_string(),
+                    ));
+                }
+            }
+        }
+
+        if let Ok(built_columns) = build_columns(&table.columns) {
+            if let Err(e) = build_annotations(&table.annotations, &built_columns) {
+                issues.push(ValidationIssue::new(
+                    format!("tables.{}.annotations", table_name),
+                    e.to_string(),
+                ));
+            }
+        }
+
+        if columns.iter().filter(|(c, _)| c.is_primary_key).count() > 1 {
+            issues.push(ValidationIssue::new(
+                format!("tables.{}.columns", table_name),
+                "Only one PRIMARY KEY column is supported per table",
+            ));
+        }
+
+        let mut seen_keys: HashSet<DbValue> = HashSet::new();
+
+        for (row_idx, row) in table.data.iter().enumerate() {
+            let row_path = format!("tables.{}.data[{}]", table_name, row_idx);
+
+            for key in row.keys() {
+                if !table.columns.contains_key(key) {
+                    issues.push(ValidationIssue::new(
+                        format!("{}.{}", row_path, key),
+                        format!("Unknown column '{}'", key),
+                    ));
+                }
+            }
+
+            for (column, sql_type) in &columns {
+                let path = format!("{}.{}", row_path, column.name);
+                let value = match row.get(&column.name) {
+                    Some(yaml_value) => match parse_value(yaml_value, sql_type) {
+                        Ok(value) => value,
+                        Err(e) => {
+                            issues.push(ValidationIssue::new(path, e.to_string()));
+                            continue;
+                        }
+                    },
+                    None if column.is_nullable || column.default_value.is_some() => continue,
+                    None => {
+                        issues.push(ValidationIssue::new(
+                            path,
+                            "Missing value for non-nullable column without a default",
+                        ));
+                        continue;
+                    }
+                };
+
+                if matches!(value, DbValue::Null) && !column.is_nullable {
+                    issues.push(ValidationIssue::new(path, "Column cannot be NULL"));
+                } else if column.is_primary_key && !seen_keys.insert(value.clone()) {
+                    issues.push(ValidationIssue::new(
+                        path,
+                        format!("Duplicate primary key value {}", value),
+                    ));
+                }
+            }
+        }
+    }
+
+    issues
+}
+
+fn syntax_issue(error: &serde_yaml::Error) -> ValidationIssue {
+    let path = match error.location() {
+        Some(location) => format!("line {}, column {}", location.line(), location.column()),
+        None => "<document>".to_string(),
+    };
+    ValidationIssue::new(path, error.to_string())
+}
+
+fn check_unknown_keys(raw: &serde_yaml::Value) -> Vec<ValidationIssue> {
+    let mut issues = Vec::new();
+    unknown_keys_at(raw, "", ROOT_KEYS, &mut issues);
+
+    if let Some(database) = raw.get("database") {
+        unknown_keys_at(database, "database", DATABASE_KEYS, &mut issues);
+        if let Some(tenancy) = database.get("tenancy") {
+            unknown_keys_at(tenancy, "database.tenancy", TENANCY_KEYS, &mut issues);
+        }
+        if let Some(serde_yaml::Value::Sequence(rewrites)) = database.get("rewrites") {
+            for (position, rewrite) in rewrites.iter().enumerate() {
+                let path = format!("database.rewrites.{}", position);
+                unknown_keys_at(rewrite, &path, REWRITE_KEYS, &mut issues);
+                if let Some(result) = rewrite.get("result") {
+                    let path = format!("{}.result", path);
+                    unknown_keys_at(result, &path, REWRITE_RESULT_KEYS, &mut issues);
+                }
+            }
+        }
+    }
+    if let Some(serde_yaml::Value::Mapping(tables)) = raw.get("tables") {
+        for (name, table) in tables {
+            if let Some(name) = name.as_str() {
+                unknown_keys_at(table, &format!("tables.{}", name), TABLE_KEYS, &mut issues);
+                if let Some(expiry) = table.get("expiry") {
+                    let path = format!("tables.{}.expiry", name);
+                    unknown_keys_at(expiry, &path, EXPIRY_KEYS, &mut issues);
+                }
+                if let Some(soft_delete) = table.get("soft_delete") {
+                    let path = format!("tables.{}.soft_delete", name);
+                    unknown_keys_at(soft_delete, &path, SOFT_DELETE_KEYS, &mut issues);
+                }
+                if let Some(serde_yaml::Value::Mapping(annotations)) = table.get("annotations") {
+                    for (column, annotation) in annotations {
+                        if let Some(column) = column.as_str() {
+                            let path = format!("tables.{}.annotations.{}", name, column);
+                            unknown_keys_at(annotation, &path, ANNOTATION_KEYS, &mut issues);
+                        }
+                    }
+                }
+            }
+        }
+    }
+
+    issues
+}
+
+fn unknown_keys_at(
+    value: &serde_yaml::Value,
+    path: &str,
+    allowed: &[&str],
+    issues: &mut Vec<ValidationIssue>,
+) {
+    if let serde_yaml::Value::Mapping(map) = value {
+        for key in map.keys() {
+            if let Some(key) = key.as_str() {
+                if !allowed.contains(&key) {
+                    let key_path = if path.is_empty() {
+                        key.to_string()
+                    } else {
+                        format!("{}.{}", path, key)
+                    };
+                    issues.push(ValidationIssue::new(
+                        key_path,
+                        format!(
+                            "Unknown key '{}' (expected one of: {})",
+                            key,
+                            allowed.join(", ")
+                        ),
+                    ));
+                }
+            }
+        }
+    }
+}
+
+fn check_reference(
+    yaml_db: &YamlDatabase,
+    path: &str,
+    table: &str,
+    column: &str,
+) -> Option<ValidationIssue> {
+    // Column definitions are upper-cased while parsing, so compare case-insensitively
+    let target = yaml_db
+        .tables
+        .iter()
+        .find(|(name, _)| name.eq_ignore_ascii_case(table));
+
+    match target {
+        None => Some(ValidationIssue::new(
+            path,
+            format!("References unknown table '{}'", table.to_lowercase()),
+        )),
+        Some((name, target_table)) => {
+            if target_table
+                .columns
+                .keys()
+                .any(|c| c.eq_ignore_ascii_case(column))
+            {
+                None
+            } else {
+                Some(ValidationIssue::new(
+                    path,
+                    format!(
+                        "References unknown column '{}' in table '{}'",
+                        column.to_lowercase(),
+                        name
+                    ),
+                ))
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn paths(issues: &[ValidationIssue]) -> Vec<&str> {
+        issues.iter().map(|i| i.path.as_str()).collect()
+    }
+
+    #[test]
+    fn test_valid_dataset_has_no_issues() {
+        let yaml = r#"
+database:
+  name: "shop"
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      email: "VARCHAR(100) NOT NULL"
+    data:
+      - id: 1
+        email: "a@example.com"
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      user_id: "INTEGER REFERENCES users(id)"
+"#;
+        assert!(validate_yaml_str(yaml).is_empty());
+    }
+
+    #[test]
+    fn test_reports_every_problem_with_paths() {
+        let yaml = r#"
+database:
+  name: "shop"
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      age: "INTGER"
+      email: "VARCHAR(100) NOT NULL"
+    data:
+      - id: 1
+        email: "a@example.com"
+        nickname: "al"
+      - id: 1
+  orders:
+    columns:
+      user_id: "INTEGER REFERENCES customers(id)"
+"#;
+        let issues = validate_yaml_str(yaml);
+        let paths = paths(&issues);
+        assert!(paths.contains(&"tables.users.columns.age"));
+        assert!(paths.contains(&"tables.users.data[0].nickname"));
+        assert!(paths.contains(&"tables.users.data[1].id"));
+        assert!(paths.contains(&"tables.users.data[1].email"));
+        assert!(paths.contains(&"tables.orders.columns.user_id"));
+    }
+
+    #[test]
+    fn test_unknown_keys_and_syntax_errors() {
+        let issues = validate_yaml_str("database:\n  name: x\ntables:\n  t:\n    colums: {}\n");
+        assert!(paths(&issues).contains(&"tables.t.colums"));
+
+        let issues = validate_yaml_str("database: [unclosed");
+        assert_eq!(issues.len(), 1);
+        assert!(issues[0].path.starts_with("line "));
+    }
+
+    #[test]
+    fn test_bundled_schema_is_valid_json() {
+        let schema: serde_json::Value = serde_json::from_str(DATASET_JSON_SCHEMA).unwrap();
+        assert_eq!(
+            schema["required"],
+            serde_json::json!(["database", "tables"])
+        );
+    }
+}
@@ -1,29 +1,39 @@
 use notify::RecursiveMode;
 use notify_debouncer_mini::new_debouncer;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::time::Duration;
 use tokio::sync::mpsc;
-use tracing::{error, info};
+use tracing::{debug, error, info, warn};
 
+use crate::yaml::parser::dataset_checksum;
+
+/// Watches a dataset file and sends its new contents whenever they change.
+///
+/// The file's directory is watched rather than the file itself, so that
+/// replacements are seen as well as in-place writes: editors that save by
+/// renaming, and Kubernetes ConfigMap / Secret mounts, where the file is a
+/// symlink through `..data` and an update swaps that link to a new directory.
+/// Every event in the directory re-reads the file, and only contents whose
+/// checksum differs from the last ones sent trigger a reload.
 pub struct FileWatcher {
     path: PathBuf,
-    tx: mpsc::Sender<()>,
+    checksum: Option<String>,
+    tx: mpsc::Sender<String>,
 }
 
 impl FileWatcher {
-    pub fn new(path: PathBuf) -> (Self, mpsc::Receiver<()>) {
+    /// `checksum` is that of the contents already loaded, as in
+    /// [`crate::database::Database::checksum`]
+    pub fn new(path: PathBuf, checksum: Option<String>) -> (Self, mpsc::Receiver<String>) {
         let (tx, rx) = mpsc::channel(10);
 
-        let watcher = Self { path, tx };
+        let watcher = Self { path, checksum, tx };
         (watcher, rx)
     }
 
     pub fn start(self) -> anyhow::Result<()> {
-        let path = self.path.clone();
-        let tx = self.tx.clone();
-
         std::thread::spawn(move || {
-            if let Err(e) = watch_file(path, tx) {
+            if let Err(e) = watch_file(self.path, self.checksum, self.tx) {
                 error!("File watcher error: {}", e);
             }
         });
@@ -32,28 +42,39 @@ impl FileWatcher {
     }
 }
 
-fn watch_file(path: PathBuf, tx: mpsc::Sender<()>) -> anyhow::Result<()> {
+fn watch_file(
+    path: PathBuf,
+    mut checksum: Option<String>,
+    tx: mpsc::Sender<String>,
+) -> anyhow::Result<()> {
     let (tx_debounced, rx_debounced) = std::sync::mpsc::channel();
 
     let mut debouncer = new_debouncer(Duration::from_secs(1), tx_debounced)?;
 
+    let dir = watched_dir(&path);
     debouncer
         .watcher()
-        .watch(&path, RecursiveMode::NonRecursive)?;
+        .watch(&dir, RecursiveMode::NonRecursive)?;
 
-    info!("Watching for changes to: {}", path.display());
+    info!(
+        "Watching for changes to: {} (in {})",
+        path.display(),
+        dir.display()
+    );
 
     for event in rx_debounced {
         match event {
             Ok(events) => {
-                for e in events {
-                    if e.path == path {
-                        info!("File changed, triggering reload");
-                        let tx = tx.clone();
-                        tokio::spawn(async move {
-                            let _ = tx.send(()).await;
-                        });
-                    }
+                if events.is_empty() {
+                    continue;
+                }
+                let Some(content) = changed_content(&path, &mut checksum) else {
+                    continue;
+                };
+                info!("File changed, triggering reload");
+                if tx.blocking_send(content).is_err() {
+                    // The server stopped listening for reloads
+                    break;
                 }
             }
             Err(e) => error!("Watch error: {:?}", e),
@@ -62,3 +83,74 @@ fn watch_file(path: PathBuf, tx: mpsc::Sender<()>) -> anyhow::Result<()> {
 
     Ok(())
 }
+
+/// The directory holding `path`; `.` for a bare file name
+fn watched_dir(path: &Path) -> PathBuf {
+    match path.parent() {
+        Some(parent) if !parent.as_os_str().is_empty() => parent.to_path_buf(),
+        _ => PathBuf::from("."),
+    }
+}
+
+/// Read `path` and return its contents if their checksum differs from
+/// `checksum`, which is updated to match
+fn changed_content(path: &Path, checksum: &mut Option<String>) -> Option<String> {
+    let content = match std::fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(e) => {
+            // Mid-replacement, or removed; the next event tries again
+            warn!("Cannot read {}: {}", path.display(), e);
+            return None;
+        }
+    };
+    let new_checksum = dataset_checksum(content.as_bytes());
+    if checksum.as_deref() == Some(new_checksum.as_str()) {
+        debug!("{} is unchanged ({})", path.display(), new_checksum);
+        return None;
+    }
+    *checksum = Some(new_checksum);
+    Some(content)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[cfg(unix)]
+    #[test]
+    fn test_symlink_rotation_is_detected_by_checksum() {
+        // The layout of a Kubernetes ConfigMap volume
+        let dir = tempfile::tempdir().unwrap();
+        let mount = dir.path();
+        std::fs::create_dir(mount.join("..v1")).unwrap();
+        std::fs::write(mount.join("..v1/db.yaml"), "version: 1").unwrap();
+        std::os::unix::fs::symlink("..v1", mount.join("..data")).unwrap();
+        std::os::unix::fs::symlink("..data/db.yaml", mount.join("db.yaml")).unwrap();
+
+        let path = mount.join("db.yaml");
+        let mut checksum = Some(dataset_checksum(b"version: 1"));
+        assert_eq!(changed_content(&path, &mut checksum), None);
+
+        // Swap `..data` to a new directory the way the kubelet does
+        std::fs::create_dir(mount.join("..v2")).unwrap();
+        std::fs::write(mount.join("..v2/db.yaml"), "version: 2").unwrap();
+        std::os::unix::fs::symlink("..v2", mount.join("..data_tmp")).unwrap();
+        std::fs::rename(mount.join("..data_tmp"), mount.join("..data")).unwrap();
+
+        assert_eq!(
+            changed_content(&path, &mut checksum).as_deref(),
+            Some("version: 2")
+        );
+        assert_eq!(checksum, Some(dataset_checksum(b"version: 2")));
+        assert_eq!(changed_content(&path, &mut checksum), None);
+    }
+
+    #[test]
+    fn test_watched_dir() {
+        assert_eq!(watched_dir(Path::new("db.yaml")), PathBuf::from("."));
+        assert_eq!(
+            watched_dir(Path::new("/etc/yamlbase/db.yaml")),
+            PathBuf::from("/etc/yamlbase")
+        );
+    }
+}
@@ -0,0 +1,201 @@
+//! Converting in-memory rows back into YAML values, the inverse of [`super::parser`].
+//!
+//! Used by the write-ahead log and its checkpoints, `yamlbase compact` and
+//! `--write-back`, so every value written here must parse back to the same
+//! [`Value`] for its column type.
+
+use indexmap::IndexMap;
+use serde_yaml::Value as YamlValue;
+use std::path::{Path, PathBuf};
+use tokio::io::AsyncWriteExt;
+
+use crate::database::{Column, Database, Value};
+use crate::sql::array;
+use crate::sql::hstore::Hstore;
+use crate::yaml::schema::{SqlType, YamlDatabase};
+
+pub fn to_yaml_value(value: &Value) -> YamlValue {
+    match value {
+        Value::Null => YamlValue::Null,
+        Value::Integer(i) => YamlValue::Number((*i).into()),
+        Value::Float(f) => YamlValue::Number((*f as f64).into()),
+        Value::Double(f) => YamlValue::Number((*f).into()),
+        // Reading the decimal back as a YAML number keeps its exact digits
+        Value::Decimal(d) => serde_yaml::from_str(&d.to_string()).unwrap_or(YamlValue::Null),
+        Value::Text(s) => YamlValue::String(s.clone()),
+        Value::Boolean(b) => YamlValue::Bool(*b),
+        Value::Timestamp(ts) => {
+            let formatted = if ts.and_utc().timestamp_subsec_nanos() == 0 {
+                ts.format("%Y-%m-%d %H:%M:%S").to_string()
+            } else {
+                format!("{}Z", ts.format("%Y-%m-%dT%H:%M:%S%.f"))
+            };
+            YamlValue::String(formatted)
+        }
+        Value::Date(d) => YamlValue::String(d.format("%Y-%m-%d").to_string()),
+        Value::Time(t) => YamlValue::String(t.format("%H:%M:%S").to_string()),
+        Value::Uuid(u) => YamlValue::String(u.to_string()),
+        Value::Json(json) => serde_yaml::to_value(json).unwrap_or(YamlValue::Null),
+    }
+}
+
+/// A row as a column name to value mapping, in column order
+pub fn row_to_yaml(row: &[Value], columns: &[Column]) -> IndexMap<String, YamlValue> {
+    columns
+        .iter()
+        .zip(row)
+        .map(|(column, value)| {
+            let yaml_value = match (&column.sql_type, value) {
+                // Quoted, so no YAML reader takes the amount for a float
+                (SqlType::Money(_), Value::Decimal(amount)) => {
+                    YamlValue::String(amount.to_string())
+                }
+                (SqlType::Hstore, Value::Text(text)) => match Hstore::parse(text) {
+                    Ok(hstore) => YamlValue::Mapping(
+                        hstore
+                            .entries()
+                            .into_iter()
+                            .map(|(key, value)| {
+                                (key.into(), value.map_or(YamlValue::Null, Into::into))
+                            })
+                            .collect(),
+                    ),
+                    Err(_) => to_yaml_value(value),
+                },
+                (SqlType::Array(element), Value::Text(_)) => {
+                    match array::typed_elements(value, element) {
+                        Ok(elements) => {
+                            YamlValue::Sequence(elements.iter().map(to_yaml_value).collect())
+                        }
+                        Err(_) => to_yaml_value(value),
+                    }
+                }
+                _ => to_yaml_value(value),
+            };
+            (column.name.clone(), yaml_value)
+        })
+        .collect()
+}
+
+/// Render the dataset file `content` with the `data` of every table replaced
+/// by the rows `db` holds now. Comments and formatting are not preserved.
+pub fn render_dataset(content: &str, db: &Database) -> crate::Result<String> {
+    let mut yaml_db: YamlDatabase = serde_yaml::from_str(content)?;
+    for (table_name, yaml_table) in yaml_db.tables.iter_mut() {
+        // Generated tables are recomputed by the script and never written to
+        if yaml_table.generator.is_some() {
+            continue;
+        }
+        let Some(table) = db.get_table(table_name) else {
+            continue;
+        };
+        yaml_table.data = table
+            .rows
+            .iter()
+            .map(|row| {
+                let mut row = row_to_yaml(row, &table.columns);
+                // Missing nullable columns load as NULL, so there is no need to spell them out
+                row.retain(|_, value| !value.is_null());
+                row
+            })
+            .collect();
+    }
+
+    Ok(serde_yaml::to_string(&yaml_db)?)
+}
+
+/// Replace `path` via a rename so a crash never leaves a half-written dataset
+pub async fn write_atomically(path: &Path, content: &str) -> std::io::Result<()> {
+    let mut temp = path.as_os_str().to_owned();
+    temp.push(".tmp");
+    let temp = PathBuf::from(temp);
+
+    let mut file = tokio::fs::File::create(&temp).await?;
+    file.write_all(content.as_bytes()).await?;
+    // Synced before the rename, so a crash cannot leave the new name on an empty file
+    file.sync_all().await?;
+    drop(file);
+    tokio::fs::rename(&temp, path).await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::database::Currency;
+    use crate::yaml::parser::parse_value;
+
+    #[test]
+    fn test_values_round_trip_through_parser() {
+        let cases = vec![
+            (Value::Integer(-42), SqlType::Integer),
+            (Value::Double(2.5), SqlType::Double),
+            (Value::Float(1.1), SqlType::Float),
+            (
+                Value::Decimal("1234.50".parse().unwrap()),
+                SqlType::Decimal(10, 2),
+            ),
+            (Value::Text("it's".to_string()), SqlType::Text),
+            (Value::Boolean(true), SqlType::Boolean),
+            (
+                Value::Timestamp(
+                    chrono::NaiveDate::from_ymd_opt(2024, 1, 15)
+                        .unwrap()
+                        .and_hms_milli_opt(10, 30, 0, 250)
+                        .unwrap(),
+                ),
+                SqlType::Timestamp,
+            ),
+            (
+                Value::Date(chrono::NaiveDate::from_ymd_opt(2024, 2, 29).unwrap()),
+                SqlType::Date,
+            ),
+            (Value::Uuid(uuid::Uuid::new_v4()), SqlType::Uuid),
+            (
+                Value::Json(serde_json::json!({"tags": ["a", "b"]})),
+                SqlType::Json,
+            ),
+            (
+                Value::Text("POINT(4.8952 52.3702)".to_string()),
+                SqlType::Point,
+            ),
+            (
+                Value::Decimal("19.90".parse().unwrap()),
+                SqlType::Money(Currency::USD),
+            ),
+            (
+                Value::Text(r#""size"=>"M", "color"=>NULL"#.to_string()),
+                SqlType::Hstore,
+            ),
+            (Value::Text("\\x89504e47".to_string()), SqlType::Bytea),
+            (
+                Value::Text("{1,NULL,3}".to_string()),
+                SqlType::Array(Box::new(SqlType::Integer)),
+            ),
+            (Value::Null, SqlType::Integer),
+        ];
+
+        for (value, sql_type) in cases {
+            let parsed = parse_value(&to_yaml_value(&value), &sql_type).unwrap();
+            assert_eq!(parsed, value, "{:?} did not round-trip", sql_type);
+        }
+    }
+
+    #[test]
+    fn test_money_is_written_as_text_keeping_its_scale() {
+        let column = Column {
+            name: "total".to_string(),
+            sql_type: SqlType::Money(Currency::from_code("EUR").unwrap()),
+            primary_key: false,
+            nullable: true,
+            unique: false,
+            default: None,
+            references: None,
+        };
+        let amount = Value::Decimal("1234.50".parse().unwrap());
+        let written = row_to_yaml(std::slice::from_ref(&amount), std::slice::from_ref(&column));
+        assert_eq!(written["total"], YamlValue::String("1234.50".to_string()));
+
+        let parsed = parse_value(&written["total"], &column.sql_type).unwrap();
+        assert_eq!(parsed.to_string(), "1234.50");
+    }
+}
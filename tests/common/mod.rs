@@ -122,10 +122,49 @@ impl TestServer {
             log_level: "info".to_string(),
             database: None,
             allow_anonymous: false,
+            auth_ldap: None,
+            auth_ldap_dn: "{user}".to_string(),
+            auth_command: None,
+            max_user_connections: None,
+            user_connection_limits: vec![],
+            max_database_connections: None,
             max_connections: None,
             connection_timeout: None,
             idle_timeout: None,
             enable_keepalive: false,
+            webhooks: vec![],
+            replicas: 0,
+            replica_lag: std::time::Duration::ZERO,
+            admin_port: None,
+            net_bandwidth: None,
+            net_packet_delay: std::time::Duration::ZERO,
+            net_reset_probability: 0.0,
+            persist: false,
+            wal_file: None,
+            checkpoint_interval: None,
+            write_back: false,
+            upstream: None,
+            upstream_schema: "public".to_string(),
+            upstream_limit: 1000,
+            upstream_record: false,
+            disk_store: None,
+            cache_size: 1024 * 1024 * 1024,
+            scenarios: None,
+            n_plus_one_threshold: None,
+            n_plus_one_window: std::time::Duration::from_secs(1),
+            skip_invalid: false,
+            require_tables: vec![],
+            min_rows: vec![],
+            crash_dump_dir: None,
+            soak: false,
+            soak_interval: std::time::Duration::from_secs(60),
+            clock: None,
+            timezone: "UTC".to_string(),
+            uuids: None,
+            max_prepared_statements: 1000,
+            output_buffer: 64 * 1024,
+            slow_client_timeout: std::time::Duration::from_secs(30),
+            max_identifier_length: None,
         });
 
         Self {
@@ -171,10 +210,49 @@ impl TestServer {
             log_level: "info".to_string(),
             database: None,
             allow_anonymous: false,
+            auth_ldap: None,
+            auth_ldap_dn: "{user}".to_string(),
+            auth_command: None,
+            max_user_connections: None,
+            user_connection_limits: vec![],
+            max_database_connections: None,
             max_connections: None,
             connection_timeout: None,
             idle_timeout: None,
             enable_keepalive: false,
+            webhooks: vec![],
+            replicas: 0,
+            replica_lag: std::time::Duration::ZERO,
+            admin_port: None,
+            net_bandwidth: None,
+            net_packet_delay: std::time::Duration::ZERO,
+            net_reset_probability: 0.0,
+            persist: false,
+            wal_file: None,
+            checkpoint_interval: None,
+            write_back: false,
+            upstream: None,
+            upstream_schema: "public".to_string(),
+            upstream_limit: 1000,
+            upstream_record: false,
+            disk_store: None,
+            cache_size: 1024 * 1024 * 1024,
+            scenarios: None,
+            n_plus_one_threshold: None,
+            n_plus_one_window: std::time::Duration::from_secs(1),
+            skip_invalid: false,
+            require_tables: vec![],
+            min_rows: vec![],
+            crash_dump_dir: None,
+            soak: false,
+            soak_interval: std::time::Duration::from_secs(60),
+            clock: None,
+            timezone: "UTC".to_string(),
+            uuids: None,
+            max_prepared_statements: 1000,
+            output_buffer: 64 * 1024,
+            slow_client_timeout: std::time::Duration::from_secs(30),
+            max_identifier_length: None,
         });
 
         Self {
@@ -224,6 +302,10 @@ impl TestServer {
                         yamlbase::yaml::schema::SqlType::Time => "TIME".to_string(),
                         yamlbase::yaml::schema::SqlType::Uuid => "UUID".to_string(),
                         yamlbase::yaml::schema::SqlType::Json => "JSON".to_string(),
+                        yamlbase::yaml::schema::SqlType::TimestampTz => "TIMESTAMPTZ".to_string(),
+                        yamlbase::yaml::schema::SqlType::Bytea => "BYTEA".to_string(),
+                        // Types the tests do not use are served as text
+                        _ => "TEXT".to_string(),
                     };
 
                     let mut col_def = type_str.to_string();
@@ -251,7 +333,13 @@ impl TestServer {
                             yamlbase::database::Value::Integer(i) => tables_yaml.push_str(&i.to_string()),
                             yamlbase::database::Value::Text(s) => tables_yaml.push_str(&format!("\"{}\"", s)),
                             yamlbase::database::Value::Boolean(b) => tables_yaml.push_str(&b.to_string()),
-                            _ => tables_yaml.push_str(&format!("{:?}", val)),
+                            yamlbase::database::Value::Float(_)
+                            | yamlbase::database::Value::Double(_)
+                            | yamlbase::database::Value::Decimal(_) => tables_yaml.push_str(&val.to_string()),
+                            // With its fraction, which Display leaves out
+                            yamlbase::database::Value::Timestamp(ts) => tables_yaml
+                                .push_str(&format!("\"{}\"", ts.format("%Y-%m-%d %H:%M:%S%.f"))),
+                            _ => tables_yaml.push_str(&format!("\"{}\"", val)),
                         }
                         if i < table.columns.len() - 1 {
                             tables_yaml.push('\n');
@@ -299,10 +387,49 @@ impl TestServer {
                 log_level: "info".to_string(),
                 database: None,
                 allow_anonymous: false,
+                auth_ldap: None,
+                auth_ldap_dn: "{user}".to_string(),
+                auth_command: None,
+                max_user_connections: None,
+                user_connection_limits: vec![],
+                max_database_connections: None,
                 max_connections: None,
                 connection_timeout: None,
                 idle_timeout: None,
                 enable_keepalive: false,
+                webhooks: vec![],
+                replicas: 0,
+                replica_lag: std::time::Duration::ZERO,
+                admin_port: None,
+                net_bandwidth: None,
+                net_packet_delay: std::time::Duration::ZERO,
+                net_reset_probability: 0.0,
+                persist: false,
+                wal_file: None,
+                checkpoint_interval: None,
+                write_back: false,
+                upstream: None,
+                upstream_schema: "public".to_string(),
+                upstream_limit: 1000,
+                upstream_record: false,
+                disk_store: None,
+                cache_size: 1024 * 1024 * 1024,
+                scenarios: None,
+                n_plus_one_threshold: None,
+                n_plus_one_window: std::time::Duration::from_secs(1),
+                skip_invalid: false,
+                require_tables: vec![],
+                min_rows: vec![],
+                crash_dump_dir: None,
+                soak: false,
+                soak_interval: std::time::Duration::from_secs(60),
+                clock: None,
+                timezone: "UTC".to_string(),
+                uuids: None,
+                max_prepared_statements: 1000,
+                output_buffer: 64 * 1024,
+                slow_client_timeout: std::time::Duration::from_secs(30),
+                max_identifier_length: None,
             });
 
             Self { port, config, process: Some(process), _temp_file: Some(temp_file) }
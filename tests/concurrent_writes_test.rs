@@ -0,0 +1,368 @@
+//! Mixed read/write workloads against the storage write path.
+//!
+//! These run on the multi-threaded runtime so that readers and writers really
+//! overlap; CI additionally runs this file under ThreadSanitizer
+//! (`make test-concurrency`).
+
+use std::sync::Arc;
+use yamlbase::database::{Column, Database, RowChange, Storage, Table, Value};
+use yamlbase::sql::{QueryExecutor, parse_sql};
+use yamlbase::yaml::schema::SqlType;
+
+const ACCOUNTS: i64 = 20;
+const INITIAL_BALANCE: i64 = 1_000;
+
+fn column(name: &str, primary_key: bool) -> Column {
+    Column {
+        name: name.to_string(),
+        sql_type: SqlType::Integer,
+        primary_key,
+        nullable: false,
+        unique: primary_key,
+        default: None,
+        references: None,
+    }
+}
+
+fn bank() -> Storage {
+    Storage::new(bank_with(ACCOUNTS))
+}
+
+/// The bank dataset with `accounts` accounts, as a reload would load it
+fn bank_with(accounts: i64) -> Database {
+    let mut db = Database::new("bank".to_string());
+    for name in ["accounts", "audit"] {
+        let mut table = Table::new(
+            name.to_string(),
+            vec![column("id", true), column("balance", false)],
+        );
+        if name == "accounts" {
+            for id in 0..accounts {
+                table
+                    .insert_row(vec![Value::Integer(id), Value::Integer(INITIAL_BALANCE)])
+                    .unwrap();
+            }
+        }
+        db.add_table(table).unwrap();
+    }
+    db
+}
+
+fn balance_of(row: &[Value]) -> i64 {
+    match row[1] {
+        Value::Integer(balance) => balance,
+        ref other => panic!("unexpected balance {:?}", other),
+    }
+}
+
+/// Move `amount` between two accounts as a single atomic write
+async fn transfer(storage: &Storage, from: i64, to: i64, amount: i64) {
+    storage
+        .write_table("accounts", |table| {
+            let mut changes = Vec::new();
+            for (index, row) in table.rows.iter().enumerate() {
+                let delta = match &row[0] {
+                    Value::Integer(id) if *id == from => -amount,
+                    Value::Integer(id) if *id == to => amount,
+                    _ => continue,
+                };
+                let mut row = row.clone();
+                row[1] = Value::Integer(balance_of(&row) + delta);
+                changes.push(RowChange::Update { index, row });
+            }
+            Ok(changes)
+        })
+        .await
+        .unwrap();
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 8)]
+async fn test_readers_never_observe_partial_transfers() {
+    let storage = Arc::new(bank());
+    let executor = Arc::new(QueryExecutor::new(storage.clone()).await.unwrap());
+    let total = ACCOUNTS * INITIAL_BALANCE;
+
+    let mut handles = Vec::new();
+    for writer in 0..8i64 {
+        let storage = storage.clone();
+        handles.push(tokio::spawn(async move {
+            for step in 0..100i64 {
+                let from = (writer * 7 + step) % ACCOUNTS;
+                let to = (from + 1 + step % (ACCOUNTS - 1)) % ACCOUNTS;
+                transfer(&storage, from, to, step % 13 + 1).await;
+            }
+        }));
+    }
+    for _ in 0..4 {
+        let executor = executor.clone();
+        handles.push(tokio::spawn(async move {
+            let statement = parse_sql("SELECT balance FROM accounts").unwrap().remove(0);
+            for _ in 0..100 {
+                let result = executor.execute(&statement).await.unwrap();
+                assert_eq!(result.rows.len() as i64, ACCOUNTS);
+                let sum: i64 = result
+                    .rows
+                    .iter()
+                    .map(|row| match row[0] {
+                        Value::Integer(balance) => balance,
+                        _ => 0,
+                    })
+                    .sum();
+                assert_eq!(sum, total, "reader saw a half-applied transfer");
+            }
+        }));
+    }
+    for handle in handles {
+        handle.await.unwrap();
+    }
+
+    let db = storage.database();
+    let db = db.read().await;
+    let sum: i64 = db
+        .get_table("accounts")
+        .unwrap()
+        .rows
+        .iter()
+        .map(|r| balance_of(r))
+        .sum();
+    assert_eq!(sum, total);
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 8)]
+async fn test_reloads_wait_for_updates_planned_against_the_old_rows() {
+    let storage = Arc::new(bank());
+    let executor = Arc::new(QueryExecutor::new(storage.clone()).await.unwrap());
+
+    let mut handles = Vec::new();
+    for writer in 0..4i64 {
+        let executor = executor.clone();
+        handles.push(tokio::spawn(async move {
+            // The last accounts, whose row positions a smaller dataset lacks
+            let sql = format!(
+                "UPDATE accounts SET balance = balance + 1 WHERE id >= {}",
+                ACCOUNTS - 1 - writer
+            );
+            let statement = parse_sql(&sql).unwrap().remove(0);
+            for _ in 0..100 {
+                executor.execute(&statement).await.unwrap();
+            }
+        }));
+    }
+    let reloads = {
+        let storage = storage.clone();
+        tokio::spawn(async move {
+            // Between a single account and all of them, ending with all of them
+            for step in 0..100 {
+                let accounts = if step % 2 == 0 { 1 } else { ACCOUNTS };
+                storage.reload(bank_with(accounts)).await;
+                tokio::task::yield_now().await;
+            }
+        })
+    };
+    for handle in handles {
+        handle.await.unwrap();
+    }
+    reloads.await.unwrap();
+
+    let db = storage.database();
+    let db = db.read().await;
+    let accounts = db.get_table("accounts").unwrap();
+    assert_eq!(accounts.rows.len() as i64, ACCOUNTS);
+    for (index, row) in accounts.rows.iter().enumerate() {
+        assert_eq!(row[0], Value::Integer(index as i64));
+        assert!(balance_of(row) >= INITIAL_BALANCE);
+    }
+    drop(db);
+    assert_eq!(
+        storage
+            .find_by_primary_key("accounts", &Value::Integer(ACCOUNTS - 1))
+            .await
+            .map(|row| row[0].clone()),
+        Some(Value::Integer(ACCOUNTS - 1))
+    );
+}
+
+#[tokio::test(flavor = "multi_thread", worker_threads = 8)]
+async fn test_concurrent_inserts_keep_primary_keys_unique() {
+    let storage = Arc::new(bank());
+
+    // Every writer tries to claim the same ids; exactly one insert per id may win
+    let mut handles = Vec::new();
+    for writer in 0..8i64 {
+        let storage = storage.clone();
+        handles.push(tokio::spawn(async move {
+            let mut won = 0;
+            for id in 0..50i64 {
+                let result = storage
+                    .write_table("audit", |table| {
+                        let exists = table.rows.iter().any(|row| row[0] == Value::Integer(id));
+                        Ok(if exists {
+                            Vec::new()
+                        } else {
+                            vec![RowChange::Insert(vec![
+                                Value::Integer(id),
+                                Value::Integer(writer),
+                            ])]
+                        })
+                    })
+                    .await
+                    .unwrap();
+                won += result.inserted.len();
+            }
+            won
+        }));
+    }
+
+    let mut inserted = 0;
+    for handle in handles {
+        inserted += handle.await.unwrap();
+    }
+    assert_eq!(inserted, 50);
+
+    for id in 0..50i64 {
+        assert!(
+            storage
+                .find_by_primary_key("audit", &Value::Integer(id))
+                .await
+                .is_some()
+        );
+    }
+}
+
+#[tokio::test]
+async fn test_failed_write_leaves_table_untouched() {
+    let storage = bank();
+
+    let result = storage
+        .write_table("accounts", |table| {
+            Ok(vec![
+                RowChange::Delete { index: 0 },
+                // Collides with account 1, so the whole batch must be rejected
+                RowChange::Insert(vec![Value::Integer(1), Value::Integer(5)]),
+                RowChange::Update {
+                    index: 2,
+                    row: vec![table.rows[2][0].clone(), Value::Null],
+                },
+            ])
+        })
+        .await;
+    assert!(result.is_err());
+
+    let db = storage.database();
+    let db = db.read().await;
+    let accounts = db.get_table("accounts").unwrap();
+    assert_eq!(accounts.rows.len() as i64, ACCOUNTS);
+    assert!(
+        accounts
+            .rows
+            .iter()
+            .all(|row| balance_of(row) == INITIAL_BALANCE)
+    );
+}
+
+#[tokio::test]
+async fn test_write_summary_and_index_maintenance() {
+    let storage = bank();
+
+    let summary = storage
+        .write_table("accounts", |_| {
+            Ok(vec![
+                RowChange::Delete { index: 0 },
+                RowChange::Insert(vec![Value::Integer(100), Value::Integer(1)]),
+                RowChange::Update {
+                    index: 5,
+                    row: vec![Value::Integer(5), Value::Integer(0)],
+                },
+            ])
+        })
+        .await
+        .unwrap();
+
+    assert_eq!(summary.affected_rows(), 3);
+    assert_eq!(summary.deleted[0][0], Value::Integer(0));
+    assert!(
+        storage
+            .find_by_primary_key("accounts", &Value::Integer(0))
+            .await
+            .is_none()
+    );
+    assert_eq!(
+        storage
+            .find_by_primary_key("accounts", &Value::Integer(100))
+            .await,
+        Some(vec![Value::Integer(100), Value::Integer(1)])
+    );
+    assert_eq!(
+        storage
+            .find_by_primary_key("accounts", &Value::Integer(5))
+            .await,
+        Some(vec![Value::Integer(5), Value::Integer(0)])
+    );
+}
+
+#[tokio::test]
+async fn test_batch_writes_keep_the_index_in_step() {
+    let storage = bank();
+    const BATCH: i64 = 100_000;
+
+    let start = std::time::Instant::now();
+    let summary = storage
+        .write_table("audit", |_| {
+            Ok((0..BATCH)
+                .map(|id| RowChange::Insert(vec![Value::Integer(id), Value::Integer(id * 2)]))
+                .collect())
+        })
+        .await
+        .unwrap();
+    println!(
+        "Inserted {} rows in one write in {:?}",
+        BATCH,
+        start.elapsed()
+    );
+    assert_eq!(summary.inserted.len() as i64, BATCH);
+    assert_eq!(
+        storage
+            .find_by_primary_key("audit", &Value::Integer(BATCH - 1))
+            .await,
+        Some(vec![
+            Value::Integer(BATCH - 1),
+            Value::Integer((BATCH - 1) * 2)
+        ])
+    );
+
+    // A second batch is indexed after the first, and a duplicate in it rejects it all
+    let result = storage
+        .write_table("audit", |_| {
+            Ok(vec![
+                RowChange::Insert(vec![Value::Integer(BATCH), Value::Integer(0)]),
+                RowChange::Insert(vec![Value::Integer(7), Value::Integer(0)]),
+            ])
+        })
+        .await;
+    assert!(result.is_err());
+
+    // Deleting every other row shifts the rest, which the index follows
+    let summary = storage
+        .write_table("audit", |table| {
+            Ok((0..table.rows.len())
+                .step_by(2)
+                .map(|index| RowChange::Delete { index })
+                .collect())
+        })
+        .await
+        .unwrap();
+    assert_eq!(summary.deleted.len() as i64, BATCH / 2);
+    assert_eq!(summary.deleted[1][0], Value::Integer(2));
+    assert!(
+        storage
+            .find_by_primary_key("audit", &Value::Integer(4))
+            .await
+            .is_none()
+    );
+    assert_eq!(
+        storage
+            .find_by_primary_key("audit", &Value::Integer(5))
+            .await,
+        Some(vec![Value::Integer(5), Value::Integer(10)])
+    );
+}
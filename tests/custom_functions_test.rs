@@ -0,0 +1,122 @@
+use std::sync::Arc;
+use yamlbase::YamlBaseError;
+use yamlbase::database::{Column, Database, Storage, Table, Value};
+use yamlbase::sql::functions::{register_aggregate_function, register_scalar_function};
+use yamlbase::sql::{QueryExecutor, parse_sql};
+use yamlbase::yaml::schema::SqlType;
+
+fn column(name: &str, sql_type: SqlType, primary_key: bool) -> Column {
+    Column {
+        name: name.to_string(),
+        sql_type,
+        primary_key,
+        nullable: !primary_key,
+        unique: primary_key,
+        default: None,
+        references: None,
+    }
+}
+
+async fn products_executor() -> QueryExecutor {
+    let mut db = Database::new("test_db".to_string());
+    let mut products = Table::new(
+        "products".to_string(),
+        vec![
+            column("id", SqlType::Integer, true),
+            column("sku", SqlType::Varchar(50), false),
+            column("category", SqlType::Varchar(50), false),
+            column("price", SqlType::Integer, false),
+        ],
+    );
+    for (id, sku, category, price) in [
+        (1, " ab 100", "tools", 10),
+        (2, "cd 200 ", "tools", 30),
+        (3, "ef 300", "garden", 25),
+    ] {
+        products
+            .insert_row(vec![
+                Value::Integer(id),
+                Value::Text(sku.to_string()),
+                Value::Text(category.to_string()),
+                Value::Integer(price),
+            ])
+            .unwrap();
+    }
+    db.add_table(products).unwrap();
+
+    QueryExecutor::new(Arc::new(Storage::new(db)))
+        .await
+        .unwrap()
+}
+
+fn register_functions() {
+    register_scalar_function("normalize_sku", |args| match args {
+        [Value::Text(sku)] => Ok(Value::Text(sku.trim().to_uppercase().replace(' ', "-"))),
+        [Value::Null] => Ok(Value::Null),
+        _ => Err(YamlBaseError::Database {
+            message: "normalize_sku requires one string argument".to_string(),
+        }),
+    });
+    register_aggregate_function("price_spread", |rows| {
+        let prices: Vec<i64> = rows
+            .iter()
+            .filter_map(|args| match args.first() {
+                Some(Value::Integer(i)) => Some(*i),
+                _ => None,
+            })
+            .collect();
+        match (prices.iter().min(), prices.iter().max()) {
+            (Some(min), Some(max)) => Ok(Value::Integer(max - min)),
+            _ => Ok(Value::Null),
+        }
+    });
+}
+
+#[tokio::test]
+async fn test_custom_scalar_function() {
+    register_functions();
+    let executor = products_executor().await;
+
+    let parsed = parse_sql("SELECT id, normalize_sku(sku) FROM products WHERE id = 1").unwrap();
+    let result = executor.execute(&parsed[0]).await.unwrap();
+    assert_eq!(result.rows.len(), 1);
+    assert_eq!(result.rows[0][1], Value::Text("AB-100".to_string()));
+
+    let parsed = parse_sql("SELECT id FROM products WHERE normalize_sku(sku) = 'CD-200'").unwrap();
+    let result = executor.execute(&parsed[0]).await.unwrap();
+    assert_eq!(result.rows, vec![vec![Value::Integer(2)]]);
+
+    let parsed = parse_sql("SELECT normalize_sku('x y')").unwrap();
+    let result = executor.execute(&parsed[0]).await.unwrap();
+    assert_eq!(result.rows[0][0], Value::Text("X-Y".to_string()));
+}
+
+#[tokio::test]
+async fn test_custom_aggregate_function() {
+    register_functions();
+    let executor = products_executor().await;
+
+    let parsed = parse_sql("SELECT price_spread(price) FROM products").unwrap();
+    let result = executor.execute(&parsed[0]).await.unwrap();
+    assert_eq!(result.rows, vec![vec![Value::Integer(20)]]);
+
+    let parsed = parse_sql(
+        "SELECT category, price_spread(price) FROM products GROUP BY category ORDER BY category",
+    )
+    .unwrap();
+    let result = executor.execute(&parsed[0]).await.unwrap();
+    assert_eq!(
+        result.rows,
+        vec![
+            vec![Value::Text("garden".to_string()), Value::Integer(0)],
+            vec![Value::Text("tools".to_string()), Value::Integer(20)],
+        ]
+    );
+}
+
+#[tokio::test]
+async fn test_unregistered_function_still_errors() {
+    let executor = products_executor().await;
+    let parsed = parse_sql("SELECT no_such_function(sku) FROM products").unwrap();
+    assert!(executor.execute(&parsed[0]).await.is_err());
+}
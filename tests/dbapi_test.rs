@@ -0,0 +1,193 @@
+#![allow(clippy::uninlined_format_args)]
+
+//! The paths Python's db-api drivers and pandas take, as seen on the wire:
+//! the column types PyMySQL converts values by, and the catalog queries,
+//! version check and cursors of psycopg2 and SQLAlchemy. The drivers
+//! themselves are exercised by tests/python/test_dbapi.py.
+
+use mysql::consts::ColumnType;
+use mysql::prelude::*;
+use mysql::{Conn, OptsBuilder};
+use tokio_postgres::{Client, Config, NoTls, SimpleQueryMessage};
+
+mod common;
+use common::TestServer;
+
+const DATASET: &str = "tests/python/notebook.yaml";
+
+#[test]
+fn test_mysql_columns_are_sent_with_their_types() {
+    let server = TestServer::start_mysql(DATASET);
+    let opts = OptsBuilder::new()
+        .ip_or_hostname(Some("127.0.0.1"))
+        .tcp_port(server.port)
+        .user(Some("analyst"))
+        .pass(Some("password"))
+        .db_name(Some("notebook"));
+    let mut conn = Conn::new(opts).expect("Failed to connect to MySQL");
+
+    let mut result = conn
+        .query_iter(
+            "SELECT id, sensor, taken_at, taken_on, reading, price, valid, note \
+             FROM readings WHERE id = 2",
+        )
+        .unwrap();
+    let types: Vec<ColumnType> = result
+        .columns()
+        .as_ref()
+        .iter()
+        .map(|column| column.column_type())
+        .collect();
+    assert_eq!(
+        types,
+        [
+            ColumnType::MYSQL_TYPE_LONG,
+            ColumnType::MYSQL_TYPE_VAR_STRING,
+            ColumnType::MYSQL_TYPE_DATETIME,
+            ColumnType::MYSQL_TYPE_DATE,
+            ColumnType::MYSQL_TYPE_DOUBLE,
+            ColumnType::MYSQL_TYPE_NEWDECIMAL,
+            ColumnType::MYSQL_TYPE_TINY,
+            ColumnType::MYSQL_TYPE_VAR_STRING,
+        ]
+    );
+    let decimals = result.columns().as_ref()[5].decimals();
+    assert_eq!(decimals, 2);
+    let row = result.next().unwrap().unwrap();
+    assert_eq!(row.get::<i64, _>(0), Some(2));
+    assert_eq!(
+        row.get::<String, _>(2).as_deref(),
+        Some("2024-01-31 11:00:00.250")
+    );
+    assert_eq!(row.get::<f64, _>(4), Some(21.0));
+    assert_eq!(row.get::<String, _>(5).as_deref(), Some("1.50"));
+    assert_eq!(row.get::<i64, _>(6), Some(0));
+    drop(result);
+
+    // PyMySQL escapes quotes in the parameters it interpolates with backslashes
+    let notes: Vec<String> = conn
+        .query("SELECT note FROM readings WHERE note = 'O\\'Brien\\'s probe'")
+        .unwrap();
+    assert_eq!(notes, ["O'Brien's probe"]);
+
+    // Counts are BIGINT, which PyMySQL reads as an int like any other
+    let mut result = conn
+        .query_iter("SELECT sensor, COUNT(*) AS n FROM readings GROUP BY sensor")
+        .unwrap();
+    let types: Vec<ColumnType> = result
+        .columns()
+        .as_ref()
+        .iter()
+        .map(|column| column.column_type())
+        .collect();
+    assert_eq!(
+        types,
+        [
+            ColumnType::MYSQL_TYPE_VAR_STRING,
+            ColumnType::MYSQL_TYPE_LONGLONG
+        ]
+    );
+    assert_eq!(result.by_ref().count(), 3);
+}
+
+async fn connect_postgres(server: &TestServer) -> Client {
+    let (client, connection) = Config::new()
+        .host("127.0.0.1")
+        .port(server.port)
+        .user("analyst")
+        .password("password")
+        .dbname("notebook")
+        .connect(NoTls)
+        .await
+        .unwrap();
+    tokio::spawn(async move {
+        if let Err(e) = connection.await {
+            eprintln!("Connection error: {}", e);
+        }
+    });
+    client
+}
+
+/// The first column of each row a simple query returns
+async fn simple_column(client: &Client, sql: &str) -> Vec<Option<String>> {
+    client
+        .simple_query(sql)
+        .await
+        .unwrap()
+        .into_iter()
+        .filter_map(|message| match message {
+            SimpleQueryMessage::Row(row) => Some(row.get(0).map(str::to_string)),
+            _ => None,
+        })
+        .collect()
+}
+
+#[tokio::test]
+async fn test_postgres_answers_sqlalchemy_and_psycopg2() {
+    let server = TestServer::start_postgres(DATASET);
+    let client = connect_postgres(&server).await;
+
+    // SQLAlchemy reads the major version out of this
+    let version = simple_column(&client, "select pg_catalog.version()").await;
+    assert!(version[0].as_deref().unwrap().starts_with("PostgreSQL 14"));
+
+    // has_table(), which pandas' to_sql and read_sql_table begin with
+    let has_table = |table: &str| {
+        format!(
+            "SELECT pg_catalog.pg_class.relname FROM pg_catalog.pg_class \
+             JOIN pg_catalog.pg_namespace \
+             ON pg_catalog.pg_namespace.oid = pg_catalog.pg_class.relnamespace \
+             WHERE pg_catalog.pg_class.relname = '{}' \
+             AND pg_catalog.pg_class.relkind = ANY (ARRAY['r', 'p', 'f', 'v', 'm']) \
+             AND pg_catalog.pg_table_is_visible(pg_catalog.pg_class.oid) \
+             AND pg_catalog.pg_namespace.nspname != 'pg_catalog'",
+            table
+        )
+    };
+    assert_eq!(
+        simple_column(&client, &has_table("readings")).await,
+        [Some("readings".to_string())]
+    );
+    assert!(
+        simple_column(&client, &has_table("missing"))
+            .await
+            .is_empty()
+    );
+
+    // psycopg2 interpolates its parameters as literals with casts
+    let ids = simple_column(
+        &client,
+        "SELECT id FROM readings \
+         WHERE taken_at > '2024-01-31T10:30:00'::timestamp AND taken_on <= '2024-02-01'::date \
+         ORDER BY id",
+    )
+    .await;
+    assert_eq!(
+        ids,
+        [
+            Some("2".to_string()),
+            Some("3".to_string()),
+            Some("4".to_string())
+        ]
+    );
+    let taken_at = simple_column(&client, "SELECT taken_at FROM readings WHERE id = 2").await;
+    assert_eq!(taken_at, [Some("2024-01-31 11:00:00.250".to_string())]);
+
+    // A named cursor, as psycopg2 opens for pandas' chunked reads
+    client.simple_query("BEGIN").await.unwrap();
+    client
+        .simple_query("DECLARE \"c_1\" CURSOR WITHOUT HOLD FOR SELECT id FROM readings ORDER BY id")
+        .await
+        .unwrap();
+    let mut chunks = Vec::new();
+    loop {
+        let chunk = simple_column(&client, "FETCH FORWARD 2 FROM \"c_1\"").await;
+        if chunk.is_empty() {
+            break;
+        }
+        chunks.push(chunk.len());
+    }
+    assert_eq!(chunks, [2, 2, 1]);
+    client.simple_query("CLOSE \"c_1\"").await.unwrap();
+    client.simple_query("COMMIT").await.unwrap();
+}
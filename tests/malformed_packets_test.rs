@@ -0,0 +1,77 @@
+#![allow(clippy::uninlined_format_args)]
+
+use clap::Parser;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use yamlbase::config::Config;
+use yamlbase::database::{Database, Storage};
+use yamlbase::protocol::Connection;
+
+/// Serve exactly one connection with `protocol`, send it `bytes`, and return
+/// what the handler returned once the client has hung up
+async fn send_raw(protocol: &str, bytes: &[u8]) -> yamlbase::Result<()> {
+    let config = Arc::new(Config::parse_from([
+        "yamlbase",
+        "-f",
+        "db.yaml",
+        "--protocol",
+        protocol,
+    ]));
+    let storage = Arc::new(Storage::new(Database::new("test_db".to_string())));
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let server = tokio::spawn(async move {
+        let (stream, _) = listener.accept().await.unwrap();
+        Connection::new(config, storage).handle(stream).await
+    });
+
+    let mut client = TcpStream::connect(addr).await.unwrap();
+    client.write_all(bytes).await.unwrap();
+    client.shutdown().await.unwrap();
+    let mut response = Vec::new();
+    let _ = client.read_to_end(&mut response).await;
+
+    let result = tokio::time::timeout(Duration::from_secs(5), server)
+        .await
+        .expect("handler did not finish")
+        .unwrap();
+    // Connection::handle turns panics into errors; those must not count here
+    if let Err(e) = &result {
+        assert!(!e.to_string().contains("panicked"), "{}", e);
+    }
+    result
+}
+
+#[tokio::test]
+async fn test_postgres_rejects_bad_startup_lengths() {
+    // Shorter than the length field itself
+    assert!(send_raw("postgres", &[0, 0, 0, 3]).await.is_err());
+    // Claims to be several gigabytes long
+    assert!(
+        send_raw("postgres", &[0xff, 0xff, 0xff, 0xff, 0, 3, 0, 0])
+            .await
+            .is_err()
+    );
+    // Truncated before the announced length arrives
+    assert!(
+        send_raw("postgres", &[0, 0, 0, 40, 0, 3, 0, 0, b'u'])
+            .await
+            .is_err()
+    );
+}
+
+#[tokio::test]
+async fn test_mysql_rejects_truncated_handshake_response() {
+    // A handshake response packet of 5 bytes, far shorter than its fixed prefix
+    let packet = [5, 0, 0, 1, 0x0d, 0xa2, 0, 0, 0];
+    assert!(send_raw("mysql", &packet).await.is_err());
+
+    // A username without its terminator
+    let mut packet = vec![40, 0, 0, 1];
+    packet.extend_from_slice(&[0u8; 32]);
+    packet.extend_from_slice(b"rootroot");
+    assert!(send_raw("mysql", &packet).await.is_err());
+}
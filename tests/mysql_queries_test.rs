@@ -21,8 +21,8 @@ fn test_mysql_various_queries() {
         _mysql_test_query(&mut stream, "SELECT 1, 2, 3", vec!["1", "2", "3"]);
         _mysql_test_query(&mut stream, "SELECT 1 AS num", vec!["1"]);
         _mysql_test_query(&mut stream, "SELECT -5", vec!["-5"]);
-        _mysql_test_query(&mut stream, "SELECT true", vec!["true"]);
-        _mysql_test_query(&mut stream, "SELECT false", vec!["false"]);
+        _mysql_test_query(&mut stream, "SELECT true", vec!["1"]);
+        _mysql_test_query(&mut stream, "SELECT false", vec!["0"]);
         _mysql_test_query(&mut stream, "SELECT null", vec!["NULL"]);
 
         // Test SELECT with FROM
@@ -1,6 +1,8 @@
 #![allow(clippy::uninlined_format_args)]
 
-use postgres::{Client, NoTls};
+use postgres::error::SqlState;
+use postgres::types::Type;
+use postgres::{Client, NoTls, SimpleQueryMessage};
 use std::path::Path;
 use std::process::{Child, Command};
 use std::thread;
@@ -46,6 +48,10 @@ struct TestServer {
 
 impl TestServer {
     fn start_postgres(yaml_content: &str) -> Self {
+        Self::start_postgres_with_args(yaml_content, &[])
+    }
+
+    fn start_postgres_with_args(yaml_content: &str, extra_args: &[&str]) -> Self {
         // Create temporary YAML file
         let mut temp_file = NamedTempFile::new().unwrap();
         std::io::Write::write_all(&mut temp_file, yaml_content.as_bytes()).unwrap();
@@ -66,6 +72,7 @@ impl TestServer {
             "--log-level".to_string(),
             "debug".to_string(),
         ]);
+        args.extend(extra_args.iter().map(|arg| arg.to_string()));
 
         let process = Command::new(&cmd)
             .args(&args)
@@ -401,3 +408,663 @@ tables:
         duration
     );
 }
+
+#[test]
+fn test_postgres_extended_protocol_statement_lifecycle() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      username: "VARCHAR(50)"
+    data:
+      - id: 1
+        username: "alice"
+"#;
+
+    let server = TestServer::start_postgres_with_args(yaml, &["--max-prepared-statements", "2"]);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    // Past the cap of two, preparing drops the least recently used statement
+    let first = client
+        .prepare("SELECT id FROM users WHERE id = $1")
+        .unwrap();
+    let second = client
+        .prepare("SELECT username FROM users WHERE id = $1")
+        .unwrap();
+    assert_eq!(client.query(&first, &[&1i32]).unwrap().len(), 1);
+    let third = client.prepare("SELECT id, username FROM users").unwrap();
+    let error = client.query(&second, &[&1i32]).unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::INVALID_SQL_STATEMENT_NAME));
+    assert_eq!(client.query(&first, &[&1i32]).unwrap().len(), 1);
+    assert_eq!(client.query(&third, &[]).unwrap().len(), 1);
+
+    // DEALLOCATE ALL, as poolers send between clients, drops every statement
+    client.batch_execute("DEALLOCATE ALL").unwrap();
+    let error = client.query(&first, &[&1i32]).unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::INVALID_SQL_STATEMENT_NAME));
+
+    let error = client
+        .batch_execute("DEALLOCATE no_such_statement")
+        .unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::INVALID_SQL_STATEMENT_NAME));
+
+    // The connection stays usable after the errors
+    let rows = client.query("SELECT username FROM users", &[]).unwrap();
+    assert_eq!(rows[0].get::<_, String>(0), "alice");
+}
+
+#[test]
+fn test_postgres_session_state_behind_a_pooler() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      username: "VARCHAR(50)"
+    data:
+      - id: 1
+        username: "alice"
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    // pgbouncer passes the client's startup parameters on
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db application_name=billing",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    let show = |client: &mut Client, name: &str| -> String {
+        let rows = client.query(&format!("SHOW {}", name), &[]).unwrap();
+        rows[0].get(0)
+    };
+    assert_eq!(show(&mut client, "application_name"), "billing");
+
+    // Startup parameter replay, then the reset pgbouncer runs between clients
+    client
+        .batch_execute("SET application_name = 'worker'; SET statement_timeout TO 5000")
+        .unwrap();
+    assert_eq!(show(&mut client, "application_name"), "worker");
+    client.batch_execute("RESET statement_timeout").unwrap();
+    assert_eq!(show(&mut client, "statement_timeout"), "0");
+    client.batch_execute("DISCARD ALL").unwrap();
+    assert_eq!(show(&mut client, "application_name"), "billing");
+
+    // A multi-statement reset query, as configured in pgbouncer
+    client
+        .batch_execute("SET application_name = 'worker'")
+        .unwrap();
+    client
+        .batch_execute("LISTEN jobs; CLOSE ALL; UNLISTEN *; DISCARD PLANS; RESET ALL;")
+        .unwrap();
+    assert_eq!(show(&mut client, "application_name"), "billing");
+    let error = client
+        .batch_execute("SET application_name = 'half'; SELEC 1")
+        .unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::SYNTAX_ERROR));
+    assert_eq!(show(&mut client, "application_name"), "billing");
+
+    let error = client.batch_execute("SHOW no_such_setting").unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::UNDEFINED_OBJECT));
+
+    // Ping queries
+    assert!(client.simple_query("").unwrap().is_empty());
+    let messages = client.simple_query("SELECT 1").unwrap();
+    assert!(
+        messages.iter().any(
+            |message| matches!(message, SimpleQueryMessage::Row(row) if row.get(0) == Some("1"))
+        )
+    );
+
+    // A failed transaction refuses statements until it is rolled back
+    let mut transaction = client.transaction().unwrap();
+    transaction
+        .batch_execute("SET application_name = 'in_transaction'")
+        .unwrap();
+    assert!(transaction.batch_execute("SELECT * FROM missing").is_err());
+    let error = transaction.batch_execute("SELECT 1").unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::IN_FAILED_SQL_TRANSACTION));
+    transaction.rollback().unwrap();
+
+    let error = client.batch_execute("BEGIN; DISCARD ALL").unwrap_err();
+    assert_eq!(error.code(), Some(&SqlState::ACTIVE_SQL_TRANSACTION));
+    client.batch_execute("ROLLBACK").unwrap();
+
+    let rows = client.query("SELECT username FROM users", &[]).unwrap();
+    assert_eq!(rows[0].get::<_, String>(0), "alice");
+}
+
+#[test]
+fn test_postgres_insert_select_archives_rows() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      status: "VARCHAR(20)"
+      total: "DECIMAL(10,2)"
+    data:
+      - id: 1
+        status: "shipped"
+        total: 10.50
+      - id: 2
+        status: "pending"
+        total: 25.00
+      - id: 3
+        status: "shipped"
+        total: 40.25
+  archive_orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      status: "VARCHAR(20)"
+      total: "DECIMAL(10,2)"
+    data: []
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    let inserted = client
+        .execute(
+            "INSERT INTO archive_orders SELECT * FROM orders WHERE status = 'shipped'",
+            &[],
+        )
+        .unwrap();
+    assert_eq!(inserted, 2);
+
+    let rows = client
+        .query("SELECT id FROM archive_orders ORDER BY id", &[])
+        .unwrap();
+    let ids: Vec<i32> = rows.iter().map(|row| row.get(0)).collect();
+    assert_eq!(ids, vec![1, 3]);
+
+    // Archiving the same rows again violates the primary key and changes nothing
+    let error = client
+        .batch_execute("INSERT INTO archive_orders SELECT * FROM orders")
+        .unwrap_err();
+    assert!(error.to_string().contains("Duplicate key value"));
+    let rows = client.query("SELECT id FROM archive_orders", &[]).unwrap();
+    assert_eq!(rows.len(), 2);
+}
+
+#[test]
+fn test_postgres_insert_values_with_parameters() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      username: "VARCHAR(50) NOT NULL"
+      active: "BOOLEAN DEFAULT true"
+    data:
+      - id: 1
+        username: "alice"
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    // Placeholders take the types of the columns they fill
+    let inserted = client
+        .execute(
+            "INSERT INTO users (id, username, active) VALUES ($1, $2, $3), ($4, $5, DEFAULT)",
+            &[&2i32, &"bob", &false, &3i32, &"carol"],
+        )
+        .unwrap();
+    assert_eq!(inserted, 2);
+    let inserted = client
+        .execute("INSERT INTO users VALUES (4, 'dave', NULL)", &[])
+        .unwrap();
+    assert_eq!(inserted, 1);
+
+    let rows = client
+        .query("SELECT id, username, active FROM users ORDER BY id", &[])
+        .unwrap();
+    let users: Vec<(i32, String, Option<bool>)> = rows
+        .iter()
+        .map(|row| (row.get(0), row.get(1), row.get(2)))
+        .collect();
+    assert_eq!(
+        users,
+        vec![
+            (1, "alice".to_string(), None),
+            (2, "bob".to_string(), Some(false)),
+            (3, "carol".to_string(), Some(true)),
+            (4, "dave".to_string(), None),
+        ]
+    );
+
+    let error = client
+        .execute(
+            "INSERT INTO users (id, username) VALUES ($1, $2)",
+            &[&1i32, &"again"],
+        )
+        .unwrap_err();
+    assert!(error.to_string().contains("Duplicate key value"));
+}
+
+#[test]
+fn test_postgres_update_and_delete_with_parameters() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      username: "VARCHAR(50) NOT NULL"
+      active: "BOOLEAN DEFAULT true"
+    data:
+      - id: 1
+        username: "alice"
+        active: true
+      - id: 2
+        username: "bob"
+        active: true
+      - id: 3
+        username: "carol"
+        active: false
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    let updated = client
+        .execute(
+            "UPDATE users SET username = $1, active = $2 WHERE id = $3",
+            &[&"bobby", &false, &2i32],
+        )
+        .unwrap();
+    assert_eq!(updated, 1);
+    let deleted = client
+        .execute(
+            "DELETE FROM users WHERE active = false AND id > $1",
+            &[&2i32],
+        )
+        .unwrap();
+    assert_eq!(deleted, 1);
+    let updated = client
+        .execute("UPDATE users SET active = DEFAULT", &[])
+        .unwrap();
+    assert_eq!(updated, 2);
+
+    let rows = client
+        .query("SELECT id, username, active FROM users ORDER BY id", &[])
+        .unwrap();
+    let users: Vec<(i32, String, bool)> = rows
+        .iter()
+        .map(|row| (row.get(0), row.get(1), row.get(2)))
+        .collect();
+    assert_eq!(
+        users,
+        vec![
+            (1, "alice".to_string(), true),
+            (2, "bobby".to_string(), true),
+        ]
+    );
+}
+
+#[test]
+fn test_postgres_runs_migration_scripts() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      username: "VARCHAR(50) NOT NULL"
+    data:
+      - id: 1
+        username: "alice"
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    // The bookkeeping a migration tool does, over the extended protocol
+    client
+        .execute(
+            "CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)",
+            &[],
+        )
+        .unwrap();
+    client.execute("TRUNCATE schema_migrations", &[]).unwrap();
+    client
+        .execute(
+            "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)",
+            &[&1i32, &true],
+        )
+        .unwrap();
+
+    // A migration script, over the simple protocol
+    client
+        .batch_execute(
+            "CREATE TABLE orders (
+                 id SERIAL PRIMARY KEY,
+                 user_id INTEGER NOT NULL REFERENCES users(id),
+                 status VARCHAR(20) NOT NULL DEFAULT 'pending'
+             );
+             CREATE INDEX ON orders USING hash (user_id);
+             ALTER TABLE users ADD COLUMN email TEXT;
+             DROP TABLE IF EXISTS legacy_orders;",
+        )
+        .unwrap();
+    client
+        .execute("INSERT INTO orders (id, user_id) VALUES (1, 1)", &[])
+        .unwrap();
+
+    let rows = client
+        .query(
+            "SELECT u.username, u.email, o.status FROM users u JOIN orders o ON o.user_id = u.id",
+            &[],
+        )
+        .unwrap();
+    assert_eq!(rows.len(), 1);
+    assert_eq!(rows[0].get::<_, String>(0), "alice");
+    assert_eq!(rows[0].get::<_, Option<String>>(1), None);
+    assert_eq!(rows[0].get::<_, String>(2), "pending");
+    let rows = client
+        .query("SELECT id FROM orders WHERE user_id = $1", &[&1i32])
+        .unwrap();
+    assert_eq!(rows.len(), 1);
+
+    client
+        .batch_execute("DROP INDEX orders_user_id_idx; DROP TABLE orders")
+        .unwrap();
+    assert!(client.query("SELECT id FROM orders", &[]).is_err());
+}
+
+#[test]
+fn test_postgres_tenant_users_are_isolated() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+  tenancy:
+    column: tenant_id
+    users:
+      acme:
+        password: "acme-secret"
+        tenant: 1
+      globex:
+        password: "globex-secret"
+        tenant: 2
+
+tables:
+  invoices:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      tenant_id: "INTEGER"
+      amount: "INTEGER"
+    data:
+      - id: 1
+        tenant_id: 1
+        amount: 100
+      - id: 2
+        tenant_id: 2
+        amount: 250
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+    let connect = |user: &str, password: &str| {
+        Client::connect(
+            &format!(
+                "host=localhost port={} user={} password={} dbname=test_db",
+                server.port, user, password
+            ),
+            NoTls,
+        )
+    };
+    let ids = |client: &mut Client| -> Vec<i32> {
+        client
+            .query("SELECT id FROM invoices ORDER BY id", &[])
+            .unwrap()
+            .iter()
+            .map(|row| row.get(0))
+            .collect()
+    };
+
+    let mut acme = connect("acme", "acme-secret").expect("Failed to connect");
+    let mut globex = connect("globex", "globex-secret").expect("Failed to connect");
+    assert!(connect("acme", "globex-secret").is_err());
+
+    assert_eq!(ids(&mut acme), vec![1]);
+    assert_eq!(ids(&mut globex), vec![2]);
+
+    let inserted = acme
+        .execute(
+            "INSERT INTO invoices (id, amount) VALUES ($1, $2)",
+            &[&3i32, &75i32],
+        )
+        .unwrap();
+    assert_eq!(inserted, 1);
+    let deleted = globex
+        .execute("DELETE FROM invoices WHERE id = 1", &[])
+        .unwrap();
+    assert_eq!(deleted, 0);
+    let error = globex
+        .execute("INSERT INTO invoices VALUES (4, 1, 10)", &[])
+        .unwrap_err();
+    assert!(error.to_string().contains("row-level security"));
+
+    assert_eq!(ids(&mut acme), vec![1, 3]);
+    let mut admin = connect("yamlbase", "password").expect("Failed to connect");
+    assert_eq!(ids(&mut admin), vec![1, 2, 3]);
+}
+
+#[test]
+fn test_postgres_qualified_wildcard_column_names() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  users:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      username: "VARCHAR(50)"
+    data:
+      - id: 1
+        username: "alice"
+  orders:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      user_id: "INTEGER"
+    data:
+      - id: 10
+        user_id: 1
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+
+    let sql = "SELECT u.*, o.id AS order_id FROM users u JOIN orders o ON o.user_id = u.id";
+
+    // Prepared: the names come from the statement description
+    let rows = client.query(sql, &[]).unwrap();
+    let names: Vec<&str> = rows[0]
+        .columns()
+        .iter()
+        .map(|column| column.name())
+        .collect();
+    assert_eq!(names, vec!["id", "username", "order_id"]);
+    assert_eq!(rows[0].get::<_, i32>("order_id"), 10);
+    assert_eq!(rows[0].get::<_, String>("username"), "alice");
+
+    // Simple query: the names come from the result
+    let messages = client.simple_query(sql).unwrap();
+    let columns = messages
+        .iter()
+        .find_map(|message| match message {
+            SimpleQueryMessage::Row(row) => Some(row.columns()),
+            _ => None,
+        })
+        .unwrap();
+    let names: Vec<&str> = columns.iter().map(|column| column.name()).collect();
+    assert_eq!(names, vec!["id", "username", "order_id"]);
+}
+
+#[test]
+fn test_postgres_quantified_comparisons_with_array_parameters() {
+    let yaml = r#"
+database:
+  name: "test_db"
+  auth:
+    username: "yamlbase"
+    password: "password"
+
+tables:
+  products:
+    columns:
+      id: "INTEGER PRIMARY KEY"
+      name: "VARCHAR(50)"
+      category: "VARCHAR(50)"
+      price: "INTEGER"
+    data:
+      - id: 1
+        name: "pen"
+        category: "office"
+        price: 2
+      - id: 2
+        name: "desk"
+        category: "furniture"
+        price: 150
+      - id: 3
+        name: "stapler"
+        category: "office"
+        price: 8
+"#;
+
+    let server = TestServer::start_postgres(yaml);
+
+    let mut client = Client::connect(
+        &format!(
+            "host=localhost port={} user=yamlbase password=password dbname=test_db",
+            server.port
+        ),
+        NoTls,
+    )
+    .expect("Failed to connect");
+    let ids = |rows: Vec<postgres::Row>| rows.iter().map(|row| row.get(0)).collect::<Vec<i32>>();
+
+    // Arrays are bound in the binary format, as sqlx expands `IN` lists
+    let stmt = client
+        .prepare_typed(
+            "SELECT id FROM products WHERE id = ANY($1) ORDER BY id",
+            &[Type::INT8_ARRAY],
+        )
+        .unwrap();
+    let rows = client.query(&stmt, &[&vec![1i64, 3]]).unwrap();
+    assert_eq!(ids(rows), vec![1, 3]);
+    let rows = client.query(&stmt, &[&Vec::<i64>::new()]).unwrap();
+    assert!(rows.is_empty());
+
+    let stmt = client
+        .prepare_typed(
+            "SELECT id FROM products WHERE name <> ALL($1) ORDER BY id",
+            &[Type::TEXT_ARRAY],
+        )
+        .unwrap();
+    let rows = client.query(&stmt, &[&vec!["pen", "desk"]]).unwrap();
+    assert_eq!(ids(rows), vec![3]);
+
+    let rows = client
+        .query(
+            "SELECT id FROM products WHERE price > ALL \
+             (SELECT price FROM products WHERE category = 'office')",
+            &[],
+        )
+        .unwrap();
+    assert_eq!(ids(rows), vec![2]);
+}
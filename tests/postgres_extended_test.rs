@@ -1,5 +1,7 @@
 #![allow(clippy::uninlined_format_args)]
 
+use bytes::BytesMut;
+use tokio_postgres::types::{Format, IsNull, ToSql, Type};
 use tokio_postgres::{Config, NoTls};
 use yamlbase::database::{Column, Database, Table, Value};
 use yamlbase::yaml::schema::SqlType;
@@ -187,3 +189,269 @@ async fn test_postgres_prepared_statement_reuse() {
         assert_eq!(rows[0].get::<_, i32>(0), i);
     }
 }
+
+#[tokio::test]
+async fn test_portals_are_fetched_in_batches() {
+    let mut db = Database::new("test_db".to_string());
+
+    let columns = vec![Column {
+        name: "value".to_string(),
+        sql_type: SqlType::Integer,
+        primary_key: false,
+        nullable: false,
+        unique: false,
+        default: None,
+        references: None,
+    }];
+
+    let mut table = Table::new("numbers".to_string(), columns);
+    for i in 1..=25 {
+        table.insert_row(vec![Value::Integer(i)]).unwrap();
+    }
+
+    db.add_table(table).unwrap();
+
+    let test_server = TestServer::new_postgres(db).await;
+
+    let pg_config = Config::new()
+        .host("127.0.0.1")
+        .port(test_server.port)
+        .user("yamlbase")
+        .password("password")
+        .dbname("test_db")
+        .to_owned();
+
+    let (mut client, connection) = pg_config.connect(NoTls).await.unwrap();
+
+    tokio::spawn(async move {
+        if let Err(e) = connection.await {
+            eprintln!("Connection error: {}", e);
+        }
+    });
+
+    // A named portal, fetched ten rows at a time with Execute row limits
+    let transaction = client.transaction().await.unwrap();
+    let portal = transaction
+        .bind("SELECT value FROM numbers WHERE value > $1", &[&0i32])
+        .await
+        .unwrap();
+    let mut batches = Vec::new();
+    loop {
+        let rows = transaction.query_portal(&portal, 10).await.unwrap();
+        let values: Vec<i32> = rows.iter().map(|row| row.get(0)).collect();
+        let done = values.len() < 10;
+        batches.push(values);
+        if done {
+            break;
+        }
+    }
+    assert_eq!(
+        batches.iter().map(Vec::len).collect::<Vec<_>>(),
+        [10, 10, 5]
+    );
+    assert_eq!(batches[1][0], 11);
+    assert_eq!(batches[2][4], 25);
+
+    // A finished portal has no rows left
+    assert!(
+        transaction
+            .query_portal(&portal, 10)
+            .await
+            .unwrap()
+            .is_empty()
+    );
+
+    // Portals of one transaction are fetched independently, as JDBC fetches
+    // each open result set
+    let values = |rows: Vec<tokio_postgres::Row>| -> Vec<i32> {
+        rows.iter().map(|row| row.get(0)).collect()
+    };
+    let evens = transaction
+        .bind("SELECT value FROM numbers WHERE value % 2 = $1", &[&0i32])
+        .await
+        .unwrap();
+    let odds = transaction
+        .bind("SELECT value FROM numbers WHERE value % 2 = $1", &[&1i32])
+        .await
+        .unwrap();
+    let rows = transaction.query_portal(&evens, 3).await.unwrap();
+    assert_eq!(values(rows), [2, 4, 6]);
+    let rows = transaction.query_portal(&odds, 3).await.unwrap();
+    assert_eq!(values(rows), [1, 3, 5]);
+    let rows = transaction.query_portal(&evens, 3).await.unwrap();
+    assert_eq!(values(rows), [8, 10, 12]);
+    transaction.commit().await.unwrap();
+}
+
+#[tokio::test]
+async fn test_binary_results_match_the_described_types() {
+    let mut db = Database::new("test_db".to_string());
+
+    let column = |name: &str, sql_type: SqlType| Column {
+        name: name.to_string(),
+        sql_type,
+        primary_key: false,
+        nullable: false,
+        unique: false,
+        default: None,
+        references: None,
+    };
+    let columns = vec![
+        column("id", SqlType::BigInt),
+        column("taken_at", SqlType::Timestamp),
+        column("ratio", SqlType::Double),
+        column("sensor", SqlType::Uuid),
+    ];
+    let taken_at = chrono::NaiveDate::from_ymd_opt(2024, 1, 31)
+        .unwrap()
+        .and_hms_milli_opt(12, 30, 0, 250)
+        .unwrap();
+    let sensor = uuid::Uuid::parse_str("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11").unwrap();
+
+    let mut table = Table::new("readings".to_string(), columns);
+    for id in [1, 2] {
+        table
+            .insert_row(vec![
+                Value::Integer(id),
+                Value::Timestamp(taken_at),
+                Value::Double(0.5),
+                Value::Uuid(sensor),
+            ])
+            .unwrap();
+    }
+    db.add_table(table).unwrap();
+
+    let test_server = TestServer::new_postgres(db).await;
+
+    let pg_config = Config::new()
+        .host("127.0.0.1")
+        .port(test_server.port)
+        .user("yamlbase")
+        .password("password")
+        .dbname("test_db")
+        .to_owned();
+
+    let (client, connection) = pg_config.connect(NoTls).await.unwrap();
+
+    tokio::spawn(async move {
+        if let Err(e) = connection.await {
+            eprintln!("Connection error: {}", e);
+        }
+    });
+
+    // tokio-postgres asks for every result column in binary, as pgx does
+    // for int, float, timestamp and uuid columns
+    let rows = client
+        .query(
+            "SELECT id, taken_at, ratio, sensor FROM readings WHERE id = $1",
+            &[&2i32],
+        )
+        .await
+        .unwrap();
+    assert_eq!(rows.len(), 1);
+    assert_eq!(rows[0].get::<_, i64>(0), 2);
+    assert_eq!(rows[0].get::<_, chrono::NaiveDateTime>(1), taken_at);
+    assert_eq!(rows[0].get::<_, f64>(2), 0.5);
+    assert_eq!(rows[0].get::<_, uuid::Uuid>(3), sensor);
+
+    // An integer sum is sent as the float8 the statement was described with
+    let row = client
+        .query_one("SELECT SUM(id) AS total FROM readings", &[])
+        .await
+        .unwrap();
+    assert_eq!(row.get::<_, f64>(0), 3.0);
+}
+
+/// A parameter tokio-postgres sends in the text format, as psql and many
+/// drivers do
+#[derive(Debug)]
+struct TextParameter(&'static str);
+
+impl ToSql for TextParameter {
+    fn to_sql(
+        &self,
+        _ty: &Type,
+        out: &mut BytesMut,
+    ) -> Result<IsNull, Box<dyn std::error::Error + Sync + Send>> {
+        out.extend_from_slice(self.0.as_bytes());
+        Ok(IsNull::No)
+    }
+
+    fn accepts(_ty: &Type) -> bool {
+        true
+    }
+
+    fn encode_format(&self, _ty: &Type) -> Format {
+        Format::Text
+    }
+
+    fn to_sql_checked(
+        &self,
+        ty: &Type,
+        out: &mut BytesMut,
+    ) -> Result<IsNull, Box<dyn std::error::Error + Sync + Send>> {
+        self.to_sql(ty, out)
+    }
+}
+
+#[tokio::test]
+async fn test_text_parameters_are_parsed_as_the_column_type() {
+    let mut db = Database::new("test_db".to_string());
+
+    let column = |name: &str, sql_type: SqlType| Column {
+        name: name.to_string(),
+        sql_type,
+        primary_key: false,
+        nullable: false,
+        unique: false,
+        default: None,
+        references: None,
+    };
+    let columns = vec![
+        column("id", SqlType::Integer),
+        column("active", SqlType::Boolean),
+        column("ratio", SqlType::Double),
+    ];
+    db.add_table(Table::new("flags".to_string(), columns))
+        .unwrap();
+
+    let test_server = TestServer::new_postgres(db).await;
+
+    let pg_config = Config::new()
+        .host("127.0.0.1")
+        .port(test_server.port)
+        .user("yamlbase")
+        .password("password")
+        .dbname("test_db")
+        .to_owned();
+
+    let (client, connection) = pg_config.connect(NoTls).await.unwrap();
+
+    tokio::spawn(async move {
+        if let Err(e) = connection.await {
+            eprintln!("Connection error: {}", e);
+        }
+    });
+
+    // The statement is prepared without types, so they come from the columns
+    let inserted = client
+        .execute(
+            "INSERT INTO flags (id, active, ratio) VALUES ($1, $2, $3)",
+            &[
+                &TextParameter("42"),
+                &TextParameter("f"),
+                &TextParameter("1.5"),
+            ],
+        )
+        .await
+        .unwrap();
+    assert_eq!(inserted, 1);
+
+    let row = client
+        .query_one("SELECT id, active, ratio FROM flags", &[])
+        .await
+        .unwrap();
+    assert_eq!(row.get::<_, i32>(0), 42);
+    assert!(!row.get::<_, bool>(1));
+    assert_eq!(row.get::<_, f64>(2), 1.5);
+}
@@ -289,10 +289,10 @@ tables:
     assert_eq!(result, "2025-01-15");
 
     let result = execute_query(server.port, "SELECT CAST(1 AS BOOLEAN)");
-    assert_eq!(result, "true");
+    assert_eq!(result, "t");
 
     let result = execute_query(server.port, "SELECT CAST('true' AS BOOLEAN)");
-    assert_eq!(result, "true");
+    assert_eq!(result, "t");
 }
 
 #[test]
@@ -62,10 +62,49 @@ async fn test_postgres_simple_protocol() {
         log_level: "info".to_string(),
         database: Some("test_db".to_string()),
         allow_anonymous: false,
+        auth_ldap: None,
+        auth_ldap_dn: "{user}".to_string(),
+        auth_command: None,
+        max_user_connections: None,
+        user_connection_limits: vec![],
+        max_database_connections: None,
         max_connections: None,
         connection_timeout: None,
         idle_timeout: None,
         enable_keepalive: false,
+        webhooks: vec![],
+        replicas: 0,
+        replica_lag: std::time::Duration::ZERO,
+        admin_port: None,
+        net_bandwidth: None,
+        net_packet_delay: std::time::Duration::ZERO,
+        net_reset_probability: 0.0,
+        persist: false,
+        wal_file: None,
+        checkpoint_interval: None,
+        write_back: false,
+        upstream: None,
+        upstream_schema: "public".to_string(),
+        upstream_limit: 1000,
+        upstream_record: false,
+        disk_store: None,
+        cache_size: 1024 * 1024 * 1024,
+        scenarios: None,
+        n_plus_one_threshold: None,
+        n_plus_one_window: std::time::Duration::from_secs(1),
+        skip_invalid: false,
+        require_tables: vec![],
+        min_rows: vec![],
+        crash_dump_dir: None,
+        soak: false,
+        soak_interval: std::time::Duration::from_secs(60),
+        clock: None,
+        timezone: "UTC".to_string(),
+        uuids: None,
+        max_prepared_statements: 1000,
+        output_buffer: 64 * 1024,
+        slow_client_timeout: std::time::Duration::from_secs(30),
+        max_identifier_length: None,
     });
 
     // Start server